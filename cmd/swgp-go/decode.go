@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/database64128/swgp-go/packet"
+)
+
+// decodeUsage is printed before the flags of the decode subcommand.
+const decodeUsage = `Usage: swgp-go decode -mode <mode> -psk <base64> [-sessionSubkeys] [-v] <packet>
+
+Decrypt a captured swgp packet and print the recovered WireGuard packet's message type and length.
+The packet is given in hex or base64. Hex is tried first.
+`
+
+// runDecode runs the decode subcommand with args and returns the exit code.
+func runDecode(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("decode", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, decodeUsage)
+		fs.PrintDefaults()
+	}
+	mode := fs.String("mode", "", "Proxy mode of the packet.\nAvailable modes: "+strings.Join(packet.RegisteredHandlers(), ", "))
+	psk := fs.String("psk", "", "Base64-encoded PSK that encrypted the packet. With directional PSKs, use the sender's outbound PSK")
+	sessionSubkeys := fs.Bool("sessionSubkeys", false, "The packet is from a paranoid service with session subkeys enabled")
+	verbose := fs.Bool("v", false, "Also print the decrypted WireGuard packet in full")
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if *mode == "" || fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	pskBytes, err := base64.StdEncoding.DecodeString(*psk)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to decode PSK: %v\n", err)
+		return 1
+	}
+
+	swgpPacket, err := decodePacketArg(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	wgPacket, err := decryptPacket(*mode, pskBytes, *sessionSubkeys, swgpPacket)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to decrypt %d-byte swgp packet: %v\n", len(swgpPacket), err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "swgp packet length: %d\n", len(swgpPacket))
+	fmt.Fprintf(stdout, "WireGuard message type: %d (%s)\n", wgPacket[0], wgMessageTypeName(wgPacket[0]))
+	fmt.Fprintf(stdout, "WireGuard packet length: %d\n", len(wgPacket))
+	if *verbose {
+		fmt.Fprint(stdout, hex.Dump(wgPacket))
+	}
+
+	// Modes without authentication, like zero-overhead, decrypt anything, so a wrong mode
+	// or PSK only shows in the recovered packet.
+	if err = checkDecryptedPacket(wgPacket); err != nil {
+		fmt.Fprintf(stderr, "Not a valid WireGuard packet, check the mode and PSK: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// checkDecryptedPacket returns an error if the decrypted packet is not a WireGuard or swgp cookie message.
+func checkDecryptedPacket(wgPacket []byte) error {
+	if wgMessageTypeName(wgPacket[0]) == "unknown" {
+		return fmt.Errorf("unknown message type %d", wgPacket[0])
+	}
+	return packet.CheckWireGuardPacket(wgPacket)
+}
+
+// decodePacketArg decodes a packet given in hex or base64.
+// Colons and whitespace, as copied from packet capture tools, are ignored in hex.
+func decodePacketArg(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if b, err := hex.DecodeString(strings.NewReplacer(":", "", " ", "", "\n", "").Replace(s)); err == nil {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	if b, err := base64.RawStdEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return nil, errors.New("packet is neither hex nor base64")
+}
+
+// decryptPacket decrypts the swgp packet with the handler of mode and returns a copy of the WireGuard packet.
+func decryptPacket(mode string, psk []byte, sessionSubkeys bool, swgpPacket []byte) ([]byte, error) {
+	var opts map[string]any
+	if sessionSubkeys {
+		opts = map[string]any{packet.OptionSessionSubkeys: true}
+	}
+	handler, err := packet.NewHandler(mode, psk, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, len(swgpPacket))
+	copy(buf, swgpPacket)
+
+	wgPacketStart, wgPacketLength, err := handler.DecryptZeroCopy(buf, 0, len(buf))
+	if err != nil {
+		return nil, err
+	}
+	if wgPacketLength == 0 {
+		return nil, errors.New("empty WireGuard packet")
+	}
+	return buf[wgPacketStart : wgPacketStart+wgPacketLength], nil
+}
+
+// wgMessageTypeName returns a readable name of the WireGuard message type.
+func wgMessageTypeName(msgType byte) string {
+	switch msgType {
+	case packet.WireGuardMessageTypeHandshakeInitiation:
+		return "handshake initiation"
+	case packet.WireGuardMessageTypeHandshakeResponse:
+		return "handshake response"
+	case packet.WireGuardMessageTypeHandshakeCookieReply:
+		return "handshake cookie reply"
+	case packet.WireGuardMessageTypeData:
+		return "data"
+	case packet.MessageTypeCookieChallenge:
+		return "swgp cookie challenge"
+	case packet.MessageTypeCookieEcho:
+		return "swgp cookie echo"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/database64128/swgp-go/packet"
+)
+
+// newTestSwgpPacket returns a handshake initiation encrypted with the handler of mode and psk.
+func newTestSwgpPacket(t *testing.T, mode string, psk []byte) []byte {
+	handler, err := packet.NewHandler(mode, psk, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headroom := handler.Headroom()
+	buf := make([]byte, 1452)
+	wgPacket := buf[headroom.Front : headroom.Front+packet.WireGuardMessageLengthHandshakeInitiation]
+	if _, err = rand.Read(wgPacket); err != nil {
+		t.Fatal(err)
+	}
+	wgPacket[0] = packet.WireGuardMessageTypeHandshakeInitiation
+	wgPacket[1], wgPacket[2], wgPacket[3] = 0, 0, 0
+
+	swgpPacketStart, swgpPacketLength, err := handler.EncryptZeroCopy(buf, headroom.Front, len(wgPacket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[swgpPacketStart : swgpPacketStart+swgpPacketLength]
+}
+
+func TestRunDecode(t *testing.T) {
+	psk := make([]byte, 32)
+	if _, err := rand.Read(psk); err != nil {
+		t.Fatal(err)
+	}
+	pskArg := base64.StdEncoding.EncodeToString(psk)
+
+	for _, mode := range []string{"zero-overhead", "paranoid"} {
+		t.Run(mode, func(t *testing.T) {
+			swgpPacket := newTestSwgpPacket(t, mode, psk)
+
+			for _, packetArg := range []string{
+				hex.EncodeToString(swgpPacket),
+				base64.StdEncoding.EncodeToString(swgpPacket),
+			} {
+				var stdout, stderr bytes.Buffer
+				if code := runDecode([]string{"-mode", mode, "-psk", pskArg, packetArg}, &stdout, &stderr); code != 0 {
+					t.Fatalf("Exit code %d, expected 0, stderr: %s", code, stderr.String())
+				}
+				for _, line := range []string{
+					"WireGuard message type: 1 (handshake initiation)",
+					"WireGuard packet length: 148",
+				} {
+					if !strings.Contains(stdout.String(), line) {
+						t.Errorf("Expected output to contain %q, got: %s", line, stdout.String())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRunDecodeErrors(t *testing.T) {
+	psk := make([]byte, 32)
+	if _, err := rand.Read(psk); err != nil {
+		t.Fatal(err)
+	}
+	pskArg := base64.StdEncoding.EncodeToString(psk)
+	otherPSKArg := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	paranoidPacket := hex.EncodeToString(newTestSwgpPacket(t, "paranoid", psk))
+
+	for _, c := range []struct {
+		name         string
+		args         []string
+		expectedCode int
+	}{
+		{"NoMode", []string{"-psk", pskArg, paranoidPacket}, 2},
+		{"NoPacket", []string{"-mode", "paranoid", "-psk", pskArg}, 2},
+		{"BadPSK", []string{"-mode", "paranoid", "-psk", "!", paranoidPacket}, 1},
+		{"BadPacket", []string{"-mode", "paranoid", "-psk", pskArg, "not a packet!"}, 1},
+		{"WrongPSK", []string{"-mode", "paranoid", "-psk", otherPSKArg, paranoidPacket}, 1},
+		{"UnknownMode", []string{"-mode", "no-such-mode", "-psk", pskArg, paranoidPacket}, 1},
+		{"Help", []string{"-h"}, 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := runDecode(c.args, &stdout, &stderr); code != c.expectedCode {
+				t.Errorf("Exit code %d, expected %d, stderr: %s", code, c.expectedCode, stderr.String())
+			}
+		})
+	}
+}
+
+func TestDecodePacketArg(t *testing.T) {
+	expected := []byte{0x01, 0x00, 0xab, 0xcd}
+
+	for _, s := range []string{
+		"0100abcd",
+		"01:00:ab:cd",
+		" 01 00 ab cd\n",
+		"AQCrzQ==",
+		"AQCrzQ",
+	} {
+		b, err := decodePacketArg(s)
+		if err != nil {
+			t.Errorf("decodePacketArg(%q) failed: %v", s, err)
+			continue
+		}
+		if !bytes.Equal(b, expected) {
+			t.Errorf("decodePacketArg(%q) = %x, expected %x", s, b, expected)
+		}
+	}
+
+	if _, err := decodePacketArg("not a packet!"); err == nil {
+		t.Error("Expected error for a packet that is neither hex nor base64")
+	}
+}
@@ -18,11 +18,16 @@ import (
 var (
 	testConf = flag.Bool("testConf", false, "Test the configuration file without starting the services")
 	confPath = flag.String("confPath", "", "Path to JSON configuration file")
+	watch    = flag.Bool("watch", false, "Watch the configuration files for changes and reload automatically")
 	zapConf  = flag.String("zapConf", "", "Preset name or path to JSON configuration file for building the zap logger.\nAvailable presets: console (default), systemd, production, development")
 	logLevel = flag.String("logLevel", "", "Override the logger configuration's log level.\nAvailable levels: debug, info, warn, error, dpanic, panic, fatal")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "decode" {
+		os.Exit(runDecode(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	flag.Parse()
 
 	if *confPath == "" {
@@ -31,10 +36,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	var (
-		zc zap.Config
-		sc service.Config
-	)
+	var zc zap.Config
 
 	switch *zapConf {
 	case "console", "":
@@ -61,6 +63,16 @@ func main() {
 		zc.Level.SetLevel(l)
 	}
 
+	// Load the config before building the logger, as it may set the log format.
+	// Errors are logged once the logger is built.
+	sc, confErr := service.LoadConfig(*confPath)
+	if confErr == nil && sc.LogFormat != "" {
+		if err := logging.SetEncoding(&zc, sc.LogFormat); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
 	logger, err := zc.Build()
 	if err != nil {
 		fmt.Println(err)
@@ -68,13 +80,16 @@ func main() {
 	}
 	defer logger.Sync()
 
-	if err = jsonhelper.LoadAndDecodeDisallowUnknownFields(*confPath, &sc); err != nil {
+	if confErr != nil {
 		logger.Fatal("Failed to load config",
 			zap.Stringp("confPath", confPath),
-			zap.Error(err),
+			zap.Error(confErr),
 		)
 	}
 
+	// Tag every log line with the node ID, so that logs from many nodes can be told apart.
+	logger = logger.With(zap.String("nodeID", sc.NodeIDOrHostname()))
+
 	m, err := sc.Manager(logger)
 	if err != nil {
 		logger.Fatal("Failed to create service manager",
@@ -88,8 +103,22 @@ func main() {
 		return
 	}
 
+	// A graceful restart passes the listening sockets of the old process.
+	inheritedSockets, err := service.InheritedSocketsFromEnv()
+	if err != nil {
+		logger.Fatal("Failed to inherit listening sockets", zap.Error(err))
+	}
+	m.InheritSockets(inheritedSockets)
+
 	ctx, cancel := context.WithCancel(context.Background())
 
+	restartSigCh := notifyRestartSignal()
+
+	// Catch SIGHUP before starting the services, as it kills the process by default.
+	// A reload signal sent while the services are starting is handled once they are running.
+	reloadSigCh := make(chan os.Signal, 1)
+	signal.Notify(reloadSigCh, syscall.SIGHUP)
+
 	go func() {
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
@@ -105,6 +134,40 @@ func main() {
 		)
 	}
 
+	notifyReady(logger)
+
+	go handleRestartSignal(restartSigCh, m, logger, cancel)
+
+	reload := func(sc service.Config) {
+		if err := m.Reload(ctx, sc); err != nil {
+			logger.Warn("Failed to reload services",
+				zap.Stringp("confPath", confPath),
+				zap.Error(err),
+			)
+		}
+	}
+
+	go func() {
+		for sig := range reloadSigCh {
+			logger.Info("Received reload signal", zap.Stringer("signal", sig))
+
+			sc, err := service.LoadConfig(*confPath)
+			if err != nil {
+				logger.Warn("Failed to load config for reload",
+					zap.Stringp("confPath", confPath),
+					zap.Error(err),
+				)
+				continue
+			}
+
+			reload(sc)
+		}
+	}()
+
+	if *watch {
+		go service.NewConfigWatcher(*confPath, logger).Run(ctx, reload)
+	}
+
 	<-ctx.Done()
 	m.Stop()
 }
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+
+	"github.com/database64128/swgp-go/service"
+	"go.uber.org/zap"
+)
+
+// notifyRestartSignal returns nil, as graceful restart is only supported on Unix.
+func notifyRestartSignal() chan os.Signal { return nil }
+
+// handleRestartSignal does nothing, as graceful restart is only supported on Unix.
+func handleRestartSignal(sigCh chan os.Signal, m *service.Manager, logger *zap.Logger, done func()) {}
+
+// notifyReady does nothing, as graceful restart and service manager notifications are only supported on Unix.
+func notifyReady(logger *zap.Logger) {}
@@ -0,0 +1,204 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/database64128/swgp-go/service"
+	"go.uber.org/zap"
+)
+
+const (
+	// restartReadyFDEnv is the environment variable that passes the readiness pipe to the new process.
+	restartReadyFDEnv = "SWGP_RESTART_READY_FD"
+
+	// restartReadyTimeout is how long the old process waits for the new process to start its services.
+	restartReadyTimeout = time.Minute
+)
+
+// notifyRestartSignal returns a channel that receives SIGUSR2, for [handleRestartSignal].
+// It must be called before the services are started, as SIGUSR2 kills the process by default,
+// so that a restart signal sent while the services are starting is handled once they are running.
+func notifyRestartSignal() chan os.Signal {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR2)
+	return sigCh
+}
+
+// handleRestartSignal restarts the process on each signal from sigCh, handing the listening sockets of m over to a new copy of itself.
+// Once the new process has started its services, done is called to stop the services of this process and exit.
+func handleRestartSignal(sigCh chan os.Signal, m *service.Manager, logger *zap.Logger, done func()) {
+	for sig := range sigCh {
+		logger.Info("Received restart signal", zap.Stringer("signal", sig))
+
+		pid, err := restart(m)
+		if err != nil {
+			logger.Warn("Failed to restart, continuing to run", zap.Error(err))
+			continue
+		}
+
+		logger.Info("New process is ready, stopping services", zap.Int("pid", pid))
+		signal.Stop(sigCh)
+		done()
+		return
+	}
+}
+
+// restart starts a new copy of the executable with the same arguments, passing it the listening sockets of m,
+// and waits for it to signal readiness. It returns the pid of the new process.
+//
+// If the new process fails to become ready in time, it is killed, and the listening sockets stay with m.
+//
+// The sessions of servers with a session state file are saved first, for the new process to restore.
+// Their ports are released when m stops, and the restored sessions bind them once they are.
+func restart(m *service.Manager) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	m.SaveSessionState()
+
+	files, err := m.ListenerFiles()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readyR.Close()
+
+	cmd := restartCommand(exe, os.Args[1:], files, readyW)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	readyCh := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := readyR.Read(b[:])
+		readyCh <- err
+	}()
+
+	select {
+	case err = <-readyCh:
+	case <-time.After(restartReadyTimeout):
+		err = fmt.Errorf("new process did not become ready within %s", restartReadyTimeout)
+	}
+	if err != nil {
+		// The pipe is closed without a write if the new process exits before it is ready.
+		cmd.Process.Kill()
+		waitErr := cmd.Wait()
+		if waitErr != nil {
+			err = errors.Join(err, waitErr)
+		}
+		return 0, err
+	}
+
+	// The new process outlives this one. Release it instead of waiting.
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
+
+// restartCommand returns the command that starts exe with args, and passes it the listening sockets in files,
+// keyed by socket key, and readyW, the write end of the readiness pipe.
+func restartCommand(exe string, args []string, files map[string]*os.File, readyW *os.File) *exec.Cmd {
+	// ExtraFiles become fds 3, 4, ... in the new process, without close-on-exec.
+	keys := make([]string, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	extraFiles := make([]*os.File, 0, 1+len(files))
+	extraFiles = append(extraFiles, readyW)
+	fds := make(map[string]int, len(files))
+	for _, key := range keys {
+		fds[key] = 3 + len(extraFiles)
+		extraFiles = append(extraFiles, files[key])
+	}
+
+	cmd := exec.Command(exe, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		service.InheritedSocketsEnv+"="+service.InheritedSocketsEnvValue(fds),
+		restartReadyFDEnv+"=3",
+	)
+	cmd.ExtraFiles = extraFiles
+	return cmd
+}
+
+// notifyReady tells the service manager, and the process that started this one with [restart],
+// that the services are running.
+//
+// Under systemd with Type=notify, a process started by a restart also becomes the main process of the service,
+// before the old process exits, so that systemd does not consider the service stopped when it does.
+// This requires NotifyAccess=all, as the new process is not the main process yet when it notifies.
+func notifyReady(logger *zap.Logger) {
+	value, restarted := os.LookupEnv(restartReadyFDEnv)
+
+	state := "READY=1"
+	if restarted {
+		state = fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid())
+	}
+	if err := sdNotify(state); err != nil {
+		logger.Warn("Failed to notify service manager of readiness", zap.Error(err))
+	}
+
+	if !restarted {
+		return
+	}
+	os.Unsetenv(restartReadyFDEnv)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil || fd < 3 {
+		logger.Warn("Bad restart readiness file descriptor", zap.String("fd", value))
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "restart-ready")
+	defer f.Close()
+	if _, err = f.Write([]byte{1}); err != nil {
+		logger.Warn("Failed to notify old process of readiness", zap.Error(err))
+	}
+}
+
+// sdNotify sends state to the service manager, like sd_notify(3).
+// It does nothing if the process was not started by a service manager that expects notifications.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	_, err = c.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,143 @@
+//go:build unix
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/database64128/swgp-go/service"
+	"go.uber.org/zap"
+)
+
+const (
+	// restartHelperEnv makes TestRestartHelperProcess act as the new process of a restart.
+	restartHelperEnv = "SWGP_TEST_RESTART_HELPER"
+
+	// restartHelperAddrsEnv passes the expected local addresses of the inherited sockets, keyed by socket key.
+	restartHelperAddrsEnv = "SWGP_TEST_RESTART_ADDRS"
+)
+
+func TestRestartCommandHandsOverSockets(t *testing.T) {
+	files := make(map[string]*os.File)
+	addrs := make(map[string]string)
+	for _, key := range []string{"udp :20571", "udp :20570"} {
+		c, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		f, err := c.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files[key] = f
+		addrs[key] = c.LocalAddr().String()
+	}
+	addrsJSON, err := json.Marshal(addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notifySocket := filepath.Join(t.TempDir(), "notify")
+	notifyConn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: notifySocket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notifyConn.Close()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readyR.Close()
+
+	cmd := restartCommand(os.Args[0], []string{"-test.run=^TestRestartHelperProcess$"}, files, readyW)
+	cmd.Env = append(cmd.Env,
+		restartHelperEnv+"=1",
+		restartHelperAddrsEnv+"="+string(addrsJSON),
+		"NOTIFY_SOCKET="+notifySocket,
+	)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b [1]byte
+	if _, err = readyR.Read(b[:]); err != nil {
+		t.Errorf("Expected the new process to signal readiness, got %v", err)
+	}
+	if err = cmd.Wait(); err != nil {
+		t.Fatalf("New process failed: %v", err)
+	}
+
+	state := make([]byte, 64)
+	n, err := notifyConn.Read(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("MAINPID=%d\nREADY=1", cmd.Process.Pid); string(state[:n]) != expected {
+		t.Errorf("Service manager got %q, expected %q", state[:n], expected)
+	}
+}
+
+// TestRestartHelperProcess is the new process started by TestRestartCommandHandsOverSockets.
+func TestRestartHelperProcess(t *testing.T) {
+	if os.Getenv(restartHelperEnv) == "" {
+		t.Skip("Only run as the new process of a restart")
+	}
+
+	var addrs map[string]string
+	if err := json.Unmarshal([]byte(os.Getenv(restartHelperAddrsEnv)), &addrs); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := service.InheritedSocketsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(addrs) {
+		t.Fatalf("Inherited %d sockets, expected %d", len(files), len(addrs))
+	}
+	for key, f := range files {
+		c, err := net.FilePacketConn(f)
+		if err != nil {
+			t.Fatalf("Inherited socket %s: %v", key, err)
+		}
+		if addr := c.LocalAddr().String(); addr != addrs[key] {
+			t.Errorf("Inherited socket %s is bound to %s, expected %s", key, addr, addrs[key])
+		}
+		c.Close()
+		f.Close()
+	}
+
+	notifyReady(zap.NewNop())
+}
+
+func TestNotifyRestartSignalBeforeStart(t *testing.T) {
+	sigCh := notifyRestartSignal()
+	defer signal.Stop(sigCh)
+
+	// Without the channel, SIGUSR2 would kill the test process.
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	if sig := <-sigCh; sig != syscall.SIGUSR2 {
+		t.Errorf("Got signal %v, expected %v", sig, syscall.SIGUSR2)
+	}
+}
+
+func TestSdNotifyWithoutServiceManager(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("Expected no error without NOTIFY_SOCKET, got %v", err)
+	}
+}
@@ -125,13 +125,61 @@ func (a Addr) IPPort() netip.AddrPort {
 //
 // String representations of IP addresses are not supported.
 func ResolveIP(ctx context.Context, host string) (netip.Addr, error) {
-	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	return resolveIP(ctx, net.DefaultResolver, host)
+}
+
+func resolveIP(ctx context.Context, resolver *net.Resolver, host string) (netip.Addr, error) {
+	ips, err := resolver.LookupNetIP(ctx, "ip", host)
 	if err != nil {
 		return netip.Addr{}, err
 	}
 	return ips[0], nil
 }
 
+// ResolveIPNetwork is like [ResolveIP], but only returns an IP address of the address family
+// of network, which is one of "ip", "ip4", "ip6", or their "udp" and "tcp" counterparts.
+func ResolveIPNetwork(ctx context.Context, network, host string) (netip.Addr, error) {
+	return resolveIPNetwork(ctx, net.DefaultResolver, network, host)
+}
+
+func resolveIPNetwork(ctx context.Context, resolver *net.Resolver, network, host string) (netip.Addr, error) {
+	ips, err := resolver.LookupNetIP(ctx, ipNetwork(network), host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	ip := ips[0]
+	if ipNetwork(network) == "ip4" {
+		ip = ip.Unmap()
+	}
+	return ip, nil
+}
+
+// ipNetwork returns the IP network name of the same address family as network.
+func ipNetwork(network string) string {
+	switch network {
+	case "ip4", "udp4", "tcp4":
+		return "ip4"
+	case "ip6", "udp6", "tcp6":
+		return "ip6"
+	default:
+		return "ip"
+	}
+}
+
+// IPMatchesNetwork returns whether the IP address can be used on network,
+// which is one of "ip", "ip4", "ip6", or their "udp" and "tcp" counterparts.
+// IPv4-mapped IPv6 addresses are treated as IPv4 addresses.
+func IPMatchesNetwork(ip netip.Addr, network string) bool {
+	switch ipNetwork(network) {
+	case "ip4":
+		return ip.Unmap().Is4()
+	case "ip6":
+		return ip.Is6() && !ip.Is4In6()
+	default:
+		return true
+	}
+}
+
 // ResolveIP returns the IP address itself or the resolved IP address of the domain name.
 //
 // If the address is zero value, this method panics.
@@ -151,17 +199,60 @@ func (a Addr) ResolveIP(ctx context.Context) (netip.Addr, error) {
 //
 // If the address is zero value, this method panics.
 func (a Addr) ResolveIPPort(ctx context.Context) (netip.AddrPort, error) {
+	return a.ResolveIPPortWithResolver(ctx, net.DefaultResolver)
+}
+
+// ResolveIPPortWithResolver is like [Addr.ResolveIPPort], but resolves the domain name with resolver.
+// A nil resolver is the default resolver.
+//
+// If the address is zero value, this method panics.
+func (a Addr) ResolveIPPortWithResolver(ctx context.Context, resolver *net.Resolver) (netip.AddrPort, error) {
 	switch a.af {
 	case addressFamilyNetip:
 		return a.ipPort(), nil
 	case addressFamilyDomain:
-		ip, err := ResolveIP(ctx, a.domain())
+		ip, err := resolveIP(ctx, resolver, a.domain())
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		return netip.AddrPortFrom(ip, a.port), nil
+	default:
+		panic("ResolveIPPortWithResolver() called on zero value")
+	}
+}
+
+// ResolveIPPortNetwork is like [Addr.ResolveIPPort], but only returns an IP address of the address family
+// of network, which is one of "ip", "ip4", "ip6", or their "udp" and "tcp" counterparts.
+// An IP address of another address family is an error.
+//
+// If the address is zero value, this method panics.
+func (a Addr) ResolveIPPortNetwork(ctx context.Context, network string) (netip.AddrPort, error) {
+	return a.ResolveIPPortNetworkWithResolver(ctx, net.DefaultResolver, network)
+}
+
+// ResolveIPPortNetworkWithResolver is like [Addr.ResolveIPPortNetwork], but resolves the domain name with resolver.
+// A nil resolver is the default resolver.
+//
+// If the address is zero value, this method panics.
+func (a Addr) ResolveIPPortNetworkWithResolver(ctx context.Context, resolver *net.Resolver, network string) (netip.AddrPort, error) {
+	switch a.af {
+	case addressFamilyNetip:
+		addrPort := a.ipPort()
+		if !IPMatchesNetwork(addrPort.Addr(), network) {
+			return netip.AddrPort{}, fmt.Errorf("address %s cannot be used on network %s", addrPort, network)
+		}
+		if ipNetwork(network) == "ip4" {
+			addrPort = netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+		}
+		return addrPort, nil
+	case addressFamilyDomain:
+		ip, err := resolveIPNetwork(ctx, resolver, network, a.domain())
 		if err != nil {
 			return netip.AddrPort{}, err
 		}
 		return netip.AddrPortFrom(ip, a.port), nil
 	default:
-		panic("ResolveIPPort() called on zero value")
+		panic("ResolveIPPortNetworkWithResolver() called on zero value")
 	}
 }
 
@@ -190,6 +190,59 @@ func TestAddrResolveIPPort(t *testing.T) {
 	assertPanic(t, func() { addrZero.ResolveIPPort(ctx) })
 }
 
+func TestIPMatchesNetwork(t *testing.T) {
+	ip4 := netip.AddrFrom4([4]byte{192, 0, 2, 1})
+	ip4In6 := netip.AddrFrom16(ip4.As16())
+
+	for _, c := range []struct {
+		ip       netip.Addr
+		network  string
+		expected bool
+	}{
+		{ip4, "udp", true},
+		{ip4, "udp4", true},
+		{ip4, "udp6", false},
+		{ip4In6, "udp4", true},
+		{ip4In6, "udp6", false},
+		{addrIPAddr, "udp", true},
+		{addrIPAddr, "udp4", false},
+		{addrIPAddr, "udp6", true},
+		{addrIPAddr, "tcp6", true},
+	} {
+		if got := IPMatchesNetwork(c.ip, c.network); got != c.expected {
+			t.Errorf("IPMatchesNetwork(%s, %q) = %v, expected %v", c.ip, c.network, got, c.expected)
+		}
+	}
+}
+
+func TestAddrResolveIPPortNetwork(t *testing.T) {
+	ctx := context.Background()
+
+	ipPort, err := addrIP.ResolveIPPortNetwork(ctx, "udp6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipPort != addrIPAddrPort {
+		t.Errorf("addrIP.ResolveIPPortNetwork(udp6) returned %s, expected %s.", ipPort, addrIPAddrPort)
+	}
+
+	if _, err = addrIP.ResolveIPPortNetwork(ctx, "udp4"); err == nil {
+		t.Error("addrIP.ResolveIPPortNetwork(udp4) returned nil error.")
+	}
+
+	ip4AddrPort := netip.AddrPortFrom(netip.AddrFrom4([4]byte{192, 0, 2, 1}), addrIPPort)
+	ip4In6Addr := AddrFromIPPort(netip.AddrPortFrom(netip.AddrFrom16(ip4AddrPort.Addr().As16()), addrIPPort))
+	ipPort, err = ip4In6Addr.ResolveIPPortNetwork(ctx, "udp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipPort != ip4AddrPort {
+		t.Errorf("ip4In6Addr.ResolveIPPortNetwork(udp4) returned %s, expected %s.", ipPort, ip4AddrPort)
+	}
+
+	assertPanic(t, func() { addrZero.ResolveIPPortNetwork(ctx, "udp") })
+}
+
 func TestAddrHost(t *testing.T) {
 	if host := addrIP.Host(); host != addrIPHost {
 		t.Errorf("addrIP.Host() returned %s, expected %s.", host, addrIPHost)
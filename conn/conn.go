@@ -2,10 +2,17 @@ package conn
 
 import (
 	"context"
+	"errors"
 	"net"
 	"syscall"
+
+	"go.uber.org/zap"
 )
 
+// ErrDontFragmentUnsupported is returned when setting or getting the don't-fragment bit
+// is not supported on the current platform.
+var ErrDontFragmentUnsupported = errors.New("don't-fragment bit is not supported on this platform")
+
 type setFunc = func(fd int, network string) error
 
 type setFuncSlice []setFunc
@@ -46,6 +53,14 @@ func (fns setFuncSlice) controlFunc() func(network, address string, c syscall.Ra
 	}
 }
 
+// udpConnNetwork returns "udp4" if the UDP socket is bound to an IPv4 address, or "udp6" otherwise.
+func udpConnNetwork(udpConn *net.UDPConn) string {
+	if addr, ok := udpConn.LocalAddr().(*net.UDPAddr); ok && addr.AddrPort().Addr().Unmap().Is4() {
+		return "udp4"
+	}
+	return "udp6"
+}
+
 // ListenConfig is [net.ListenConfig] but provides a subjectively nicer API.
 type ListenConfig net.ListenConfig
 
@@ -58,6 +73,28 @@ func (lc *ListenConfig) ListenUDP(ctx context.Context, network, address string)
 	return pc.(*net.UDPConn), nil
 }
 
+// ListenTCP wraps [net.ListenConfig.Listen] and returns a [*net.TCPListener] directly.
+func (lc *ListenConfig) ListenTCP(ctx context.Context, network, address string) (*net.TCPListener, error) {
+	ln, err := (*net.ListenConfig)(lc).Listen(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return ln.(*net.TCPListener), nil
+}
+
+// DialTCP dials address with the listen config's control function
+// and returns a [*net.TCPConn] directly.
+func (lc *ListenConfig) DialTCP(ctx context.Context, network, address string) (*net.TCPConn, error) {
+	d := net.Dialer{
+		Control: lc.Control,
+	}
+	c, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.TCPConn), nil
+}
+
 // ListenerSocketOptions contains listener-specific socket options.
 type ListenerSocketOptions struct {
 	// Fwmark sets the listener's fwmark on Linux, or user cookie on FreeBSD.
@@ -70,15 +107,57 @@ type ListenerSocketOptions struct {
 	// Available on most platforms except Windows.
 	TrafficClass int
 
+	// TTL sets the IP TTL and IPv6 hop limit of packets sent by the listener.
+	// The default value 0 keeps the system default.
+	//
+	// Available on most platforms.
+	TTL int
+
 	// PathMTUDiscovery enables Path MTU Discovery on the listener.
+	// This also sets the don't-fragment bit, so DontFragment has no further effect.
 	//
 	// Available on Linux, macOS, FreeBSD, and Windows.
 	PathMTUDiscovery bool
 
+	// DontFragment sets the don't-fragment bit on packets sent by the listener.
+	// Oversized sends fail with EMSGSIZE instead of being fragmented.
+	// Use it on listeners that do not enable PathMTUDiscovery.
+	//
+	// Available on Linux, macOS, FreeBSD, and Windows.
+	DontFragment bool
+
 	// ReceivePacketInfo enables the reception of packet information control messages on the listener.
 	//
 	// Available on Linux, macOS, and Windows.
 	ReceivePacketInfo bool
+
+	// Transparent sets IP_TRANSPARENT on the listener, so that it can receive packets
+	// redirected by TPROXY, and enables the reception of original destination address
+	// control messages. Parse them with [ParseOrigDstAddrCmsg].
+	//
+	// Available on Linux.
+	Transparent bool
+
+	// ReceiveDropCounter enables the reception of SO_RXQ_OVFL control messages on the listener,
+	// which carry the number of packets dropped because the receive buffer was full.
+	// Strip them with [StripDropCounterCmsg].
+	//
+	// Available on Linux.
+	ReceiveDropCounter bool
+
+	// ReceiveErrors sets IP_RECVERR and IPV6_RECVERR on the listener, so that ICMP errors,
+	// such as port unreachable, are reported even though the socket is not connected.
+	// Reads then fail with ECONNREFUSED when the destination port is unreachable.
+	// Drain the error queue after each failed read or write with [DrainErrorQueue].
+	//
+	// Available on Linux.
+	ReceiveErrors bool
+
+	// BindToDevice binds the listener to the named network device with SO_BINDTODEVICE.
+	// Binding to a VRF device places the listener in the VRF, so that it uses the VRF's routing table.
+	//
+	// Available on Linux.
+	BindToDevice string
 }
 
 // ListenConfig returns a [ListenConfig] with a control function that sets the socket options.
@@ -107,24 +186,41 @@ var (
 	DefaultUDPClientListenConfig = DefaultUDPClientSocketOptions.ListenConfig()
 )
 
-// ListenConfigCache is a map of [ListenerSocketOptions] to [ListenConfig].
-type ListenConfigCache map[ListenerSocketOptions]ListenConfig
+// ListenConfigCache caches the [ListenConfig] of each [ListenerSocketOptions].
+type ListenConfigCache struct {
+	logger  *zap.Logger
+	configs map[ListenerSocketOptions]ListenConfig
+}
 
 // NewListenConfigCache creates a new cache for [ListenConfig] with a few default entries.
 func NewListenConfigCache() ListenConfigCache {
 	return ListenConfigCache{
-		DefaultUDPServerSocketOptions: DefaultUDPServerListenConfig,
-		DefaultUDPClientSocketOptions: DefaultUDPClientListenConfig,
+		configs: map[ListenerSocketOptions]ListenConfig{
+			DefaultUDPServerSocketOptions: DefaultUDPServerListenConfig,
+			DefaultUDPClientSocketOptions: DefaultUDPClientListenConfig,
+		},
+	}
+}
+
+// NewListenConfigCacheWithLogger is like [NewListenConfigCache], but the cached [ListenConfig]s
+// log the socket options they set, as described in [ListenerSocketOptions.ListenConfigWithLogger].
+func NewListenConfigCacheWithLogger(logger *zap.Logger) ListenConfigCache {
+	if logger == nil || !logger.Core().Enabled(zap.DebugLevel) {
+		return NewListenConfigCache()
+	}
+	return ListenConfigCache{
+		logger:  logger,
+		configs: make(map[ListenerSocketOptions]ListenConfig),
 	}
 }
 
 // Get returns a [ListenConfig] for the given [ListenerSocketOptions].
 func (cache ListenConfigCache) Get(lso ListenerSocketOptions) (lc ListenConfig) {
-	lc, ok := cache[lso]
+	lc, ok := cache.configs[lso]
 	if ok {
 		return
 	}
-	lc = lso.ListenConfig()
-	cache[lso] = lc
+	lc = lso.ListenConfigWithLogger(cache.logger)
+	cache.configs[lso] = lc
 	return
 }
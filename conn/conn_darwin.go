@@ -25,6 +25,8 @@ func setRecvPktinfo(fd int, network string) error {
 func (lso ListenerSocketOptions) buildSetFns() setFuncSlice {
 	return setFuncSlice{}.
 		appendSetTrafficClassFunc(lso.TrafficClass).
+		appendSetTTLFunc(lso.TTL).
 		appendSetPMTUDFunc(lso.PathMTUDiscovery).
+		appendSetDontFragmentFunc(lso.DontFragment).
 		appendSetRecvPktinfoFunc(lso.ReceivePacketInfo)
 }
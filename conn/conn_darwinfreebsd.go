@@ -23,3 +23,43 @@ func setPMTUD(fd int, network string) error {
 	}
 	return nil
 }
+
+func setDontFragment(fd int, network string, dontFragment bool) error {
+	var value int
+	if dontFragment {
+		value = 1
+	}
+
+	switch network {
+	case "udp4":
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_DONTFRAG, value); err != nil {
+			return fmt.Errorf("failed to set socket option IP_DONTFRAG: %w", err)
+		}
+	case "udp6":
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, value); err != nil {
+			return fmt.Errorf("failed to set socket option IPV6_DONTFRAG: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported network: %s", network)
+	}
+	return nil
+}
+
+func getDontFragment(fd int, network string) (bool, error) {
+	switch network {
+	case "udp4":
+		value, err := unix.GetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_DONTFRAG)
+		if err != nil {
+			return false, fmt.Errorf("failed to get socket option IP_DONTFRAG: %w", err)
+		}
+		return value != 0, nil
+	case "udp6":
+		value, err := unix.GetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG)
+		if err != nil {
+			return false, fmt.Errorf("failed to get socket option IPV6_DONTFRAG: %w", err)
+		}
+		return value != 0, nil
+	default:
+		return false, fmt.Errorf("unsupported network: %s", network)
+	}
+}
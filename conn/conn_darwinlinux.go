@@ -11,7 +11,11 @@ import (
 )
 
 // SocketControlMessageBufferSize specifies the buffer size for receiving socket control messages.
-const SocketControlMessageBufferSize = unix.SizeofCmsghdr + (unix.SizeofInet6Pktinfo+unix.SizeofPtr-1) & ^(unix.SizeofPtr-1)
+// It fits a packet information message, an original destination address message on transparent listeners,
+// and a drop counter message.
+const SocketControlMessageBufferSize = unix.SizeofCmsghdr + (unix.SizeofInet6Pktinfo+unix.SizeofPtr-1) & ^(unix.SizeofPtr-1) +
+	unix.SizeofCmsghdr + (unix.SizeofSockaddrInet6+unix.SizeofPtr-1) & ^(unix.SizeofPtr-1) +
+	unix.SizeofCmsghdr + (4+unix.SizeofPtr-1) & ^(unix.SizeofPtr-1)
 
 // ParsePktinfoCmsg parses a single socket control message of type IP_PKTINFO or IPV6_PKTINFO,
 // and returns the IP address and index of the network interface the packet was received from,
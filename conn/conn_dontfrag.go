@@ -0,0 +1,48 @@
+//go:build darwin || freebsd || linux || windows
+
+package conn
+
+import "net"
+
+// SetDontFragment sets or clears the don't-fragment bit on packets sent by the UDP socket.
+//
+// When set, sending a packet larger than the path MTU fails with EMSGSIZE,
+// instead of the packet being fragmented.
+//
+// This function is only implemented for Linux, macOS, FreeBSD, and Windows.
+// On other platforms, it returns [ErrDontFragmentUnsupported].
+func SetDontFragment(udpConn *net.UDPConn, dontFragment bool) error {
+	rawConn, err := udpConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	network := udpConnNetwork(udpConn)
+
+	if cerr := rawConn.Control(func(fd uintptr) {
+		err = setDontFragment(int(fd), network, dontFragment)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// DontFragment returns whether the don't-fragment bit is set on packets sent by the UDP socket.
+//
+// This function is only implemented for Linux, macOS, FreeBSD, and Windows.
+// On other platforms, it returns [ErrDontFragmentUnsupported].
+func DontFragment(udpConn *net.UDPConn) (dontFragment bool, err error) {
+	rawConn, err := udpConn.SyscallConn()
+	if err != nil {
+		return false, err
+	}
+
+	network := udpConnNetwork(udpConn)
+
+	if cerr := rawConn.Control(func(fd uintptr) {
+		dontFragment, err = getDontFragment(int(fd), network)
+	}); cerr != nil {
+		return false, cerr
+	}
+	return
+}
@@ -0,0 +1,38 @@
+//go:build darwin || freebsd || linux || windows
+
+package conn
+
+import (
+	"context"
+	"testing"
+)
+
+func testSetDontFragment(t *testing.T, network, address string) {
+	udpConn, err := DefaultUDPClientListenConfig.ListenUDP(context.Background(), network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	for _, want := range []bool{true, false, true} {
+		if err = SetDontFragment(udpConn, want); err != nil {
+			t.Fatalf("SetDontFragment(%t) failed: %v", want, err)
+		}
+
+		got, err := DontFragment(udpConn)
+		if err != nil {
+			t.Fatalf("DontFragment() failed: %v", err)
+		}
+		if got != want {
+			t.Errorf("DontFragment() = %t, want %t", got, want)
+		}
+	}
+}
+
+func TestSetDontFragmentUDP4(t *testing.T) {
+	testSetDontFragment(t, "udp4", "127.0.0.1:0")
+}
+
+func TestSetDontFragmentUDP6(t *testing.T) {
+	testSetDontFragment(t, "udp6", "[::1]:0")
+}
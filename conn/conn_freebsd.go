@@ -17,5 +17,7 @@ func (lso ListenerSocketOptions) buildSetFns() setFuncSlice {
 	return setFuncSlice{}.
 		appendSetFwmarkFunc(lso.Fwmark).
 		appendSetTrafficClassFunc(lso.TrafficClass).
-		appendSetPMTUDFunc(lso.PathMTUDiscovery)
+		appendSetTTLFunc(lso.TTL).
+		appendSetPMTUDFunc(lso.PathMTUDiscovery).
+		appendSetDontFragmentFunc(lso.DontFragment)
 }
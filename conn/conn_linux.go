@@ -32,6 +32,25 @@ func setTrafficClass(fd int, network string, trafficClass int) error {
 	return nil
 }
 
+func setTTL(fd int, network string, ttl int) error {
+	// Set IP_TTL for both v4 and v6.
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TTL, ttl); err != nil {
+		return fmt.Errorf("failed to set socket option IP_TTL: %w", err)
+	}
+
+	switch network {
+	case "tcp4", "udp4":
+	case "tcp6", "udp6":
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl); err != nil {
+			return fmt.Errorf("failed to set socket option IPV6_UNICAST_HOPS: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported network: %s", network)
+	}
+
+	return nil
+}
+
 func setPMTUD(fd int, network string) error {
 	// Set IP_MTU_DISCOVER for both v4 and v6.
 	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO); err != nil {
@@ -51,6 +70,54 @@ func setPMTUD(fd int, network string) error {
 	return nil
 }
 
+func setDontFragment(fd int, network string, dontFragment bool) error {
+	value := unix.IP_PMTUDISC_DONT
+	if dontFragment {
+		value = unix.IP_PMTUDISC_DO
+	}
+
+	// Set IP_MTU_DISCOVER for both v4 and v6.
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, value); err != nil {
+		return fmt.Errorf("failed to set socket option IP_MTU_DISCOVER: %w", err)
+	}
+
+	switch network {
+	case "tcp4", "udp4":
+	case "tcp6", "udp6":
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, value); err != nil {
+			return fmt.Errorf("failed to set socket option IPV6_MTU_DISCOVER: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported network: %s", network)
+	}
+
+	return nil
+}
+
+func getDontFragment(fd int, network string) (bool, error) {
+	level, opt, name := unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, "IP_MTU_DISCOVER"
+
+	switch network {
+	case "tcp4", "udp4":
+	case "tcp6", "udp6":
+		level, opt, name = unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, "IPV6_MTU_DISCOVER"
+	default:
+		return false, fmt.Errorf("unsupported network: %s", network)
+	}
+
+	value, err := unix.GetsockoptInt(fd, level, opt)
+	if err != nil {
+		return false, fmt.Errorf("failed to get socket option %s: %w", name, err)
+	}
+
+	switch value {
+	case unix.IP_PMTUDISC_DO, unix.IP_PMTUDISC_PROBE:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
 func setRecvPktinfo(fd int, network string) error {
 	switch network {
 	case "udp4":
@@ -71,6 +138,12 @@ func (lso ListenerSocketOptions) buildSetFns() setFuncSlice {
 	return setFuncSlice{}.
 		appendSetFwmarkFunc(lso.Fwmark).
 		appendSetTrafficClassFunc(lso.TrafficClass).
+		appendSetTTLFunc(lso.TTL).
 		appendSetPMTUDFunc(lso.PathMTUDiscovery).
-		appendSetRecvPktinfoFunc(lso.ReceivePacketInfo)
+		appendSetDontFragmentFunc(lso.DontFragment).
+		appendSetRecvPktinfoFunc(lso.ReceivePacketInfo).
+		appendSetTransparentFunc(lso.Transparent).
+		appendSetRecvDropCounterFunc(lso.ReceiveDropCounter).
+		appendSetRecvErrFunc(lso.ReceiveErrors).
+		appendSetBindToDeviceFunc(lso.BindToDevice)
 }
@@ -8,3 +8,12 @@ func (fns setFuncSlice) appendSetPMTUDFunc(pmtud bool) setFuncSlice {
 	}
 	return fns
 }
+
+func (fns setFuncSlice) appendSetDontFragmentFunc(dontFragment bool) setFuncSlice {
+	if dontFragment {
+		return append(fns, func(fd int, network string) error {
+			return setDontFragment(fd, network, true)
+		})
+	}
+	return fns
+}
@@ -3,5 +3,7 @@
 package conn
 
 func (lso ListenerSocketOptions) buildSetFns() setFuncSlice {
-	return setFuncSlice{}.appendSetTrafficClassFunc(lso.TrafficClass)
+	return setFuncSlice{}.
+		appendSetTrafficClassFunc(lso.TrafficClass).
+		appendSetTTLFunc(lso.TTL)
 }
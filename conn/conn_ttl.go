@@ -0,0 +1,12 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris || windows || zos
+
+package conn
+
+func (fns setFuncSlice) appendSetTTLFunc(ttl int) setFuncSlice {
+	if ttl != 0 {
+		return append(fns, func(fd int, network string) error {
+			return setTTL(fd, network, ttl)
+		})
+	}
+	return fns
+}
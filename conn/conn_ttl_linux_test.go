@@ -0,0 +1,60 @@
+package conn
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func getsockoptInt(t *testing.T, rawConn syscall.RawConn, level, opt int) int {
+	t.Helper()
+	var (
+		value int
+		err   error
+	)
+	if cerr := rawConn.Control(func(fd uintptr) {
+		value, err = unix.GetsockoptInt(int(fd), level, opt)
+	}); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func testListenerSocketOptionsTTL(t *testing.T, network, address string) {
+	const ttl = 7
+	lso := ListenerSocketOptions{TTL: ttl}
+	lc := lso.ListenConfig()
+
+	udpConn, err := lc.ListenUDP(context.Background(), network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	rawConn, err := udpConn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := getsockoptInt(t, rawConn, unix.IPPROTO_IP, unix.IP_TTL); got != ttl {
+		t.Errorf("IP_TTL = %d, want %d", got, ttl)
+	}
+	if network == "udp6" {
+		if got := getsockoptInt(t, rawConn, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS); got != ttl {
+			t.Errorf("IPV6_UNICAST_HOPS = %d, want %d", got, ttl)
+		}
+	}
+}
+
+func TestListenerSocketOptionsTTLUDP4(t *testing.T) {
+	testListenerSocketOptionsTTL(t, "udp4", "127.0.0.1:0")
+}
+
+func TestListenerSocketOptionsTTLUDP6(t *testing.T) {
+	testListenerSocketOptionsTTL(t, "udp6", "[::1]:0")
+}
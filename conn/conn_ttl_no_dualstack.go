@@ -0,0 +1,25 @@
+//go:build aix || darwin || dragonfly || freebsd || netbsd || openbsd || solaris || zos
+
+package conn
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+func setTTL(fd int, network string, ttl int) error {
+	switch network {
+	case "tcp4", "udp4":
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TTL, ttl); err != nil {
+			return fmt.Errorf("failed to set socket option IP_TTL: %w", err)
+		}
+	case "tcp6", "udp6":
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl); err != nil {
+			return fmt.Errorf("failed to set socket option IPV6_UNICAST_HOPS: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported network: %s", network)
+	}
+	return nil
+}
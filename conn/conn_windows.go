@@ -22,6 +22,25 @@ const (
 	IP_PMTUDISC_MAX
 )
 
+func setTTL(fd int, network string, ttl int) error {
+	// Set IP_TTL for both v4 and v6.
+	if err := windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IP, windows.IP_TTL, ttl); err != nil {
+		return fmt.Errorf("failed to set socket option IP_TTL: %w", err)
+	}
+
+	switch network {
+	case "tcp4", "udp4":
+	case "tcp6", "udp6":
+		if err := windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IPV6, windows.IPV6_UNICAST_HOPS, ttl); err != nil {
+			return fmt.Errorf("failed to set socket option IPV6_UNICAST_HOPS: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported network: %s", network)
+	}
+
+	return nil
+}
+
 func setPMTUD(fd int, network string) error {
 	// Set IP_MTU_DISCOVER for both v4 and v6.
 	if err := windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IP, IP_MTU_DISCOVER, IP_PMTUDISC_DO); err != nil {
@@ -41,6 +60,54 @@ func setPMTUD(fd int, network string) error {
 	return nil
 }
 
+func setDontFragment(fd int, network string, dontFragment bool) error {
+	value := IP_PMTUDISC_DONT
+	if dontFragment {
+		value = IP_PMTUDISC_DO
+	}
+
+	// Set IP_MTU_DISCOVER for both v4 and v6.
+	if err := windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IP, IP_MTU_DISCOVER, value); err != nil {
+		return fmt.Errorf("failed to set socket option IP_MTU_DISCOVER: %w", err)
+	}
+
+	switch network {
+	case "tcp4", "udp4":
+	case "tcp6", "udp6":
+		if err := windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IPV6, IPV6_MTU_DISCOVER, value); err != nil {
+			return fmt.Errorf("failed to set socket option IPV6_MTU_DISCOVER: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported network: %s", network)
+	}
+
+	return nil
+}
+
+func getDontFragment(fd int, network string) (bool, error) {
+	level, opt, name := windows.IPPROTO_IP, IP_MTU_DISCOVER, "IP_MTU_DISCOVER"
+
+	switch network {
+	case "tcp4", "udp4":
+	case "tcp6", "udp6":
+		level, opt, name = windows.IPPROTO_IPV6, IPV6_MTU_DISCOVER, "IPV6_MTU_DISCOVER"
+	default:
+		return false, fmt.Errorf("unsupported network: %s", network)
+	}
+
+	value, err := windows.GetsockoptInt(windows.Handle(fd), level, opt)
+	if err != nil {
+		return false, fmt.Errorf("failed to get socket option %s: %w", name, err)
+	}
+
+	switch value {
+	case IP_PMTUDISC_DO, IP_PMTUDISC_PROBE:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
 func setRecvPktinfo(fd int, network string) error {
 	// Set IP_PKTINFO for both v4 and v6.
 	if err := windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IP, windows.IP_PKTINFO, 1); err != nil {
@@ -62,7 +129,9 @@ func setRecvPktinfo(fd int, network string) error {
 
 func (lso ListenerSocketOptions) buildSetFns() setFuncSlice {
 	return setFuncSlice{}.
+		appendSetTTLFunc(lso.TTL).
 		appendSetPMTUDFunc(lso.PathMTUDiscovery).
+		appendSetDontFragmentFunc(lso.DontFragment).
 		appendSetRecvPktinfoFunc(lso.ReceivePacketInfo)
 }
 
@@ -6,6 +6,7 @@ import (
 	"net"
 	"os"
 	"syscall"
+	"time"
 )
 
 type rawUDPConn struct {
@@ -51,6 +52,7 @@ type MmsgWConn struct {
 	writeMsgvec  []Mmsghdr
 	writeFlags   int
 	writeErr     error
+	writeNoBufs  bool
 }
 
 // RConn returns a new [MmsgRConn] instance for batch reading.
@@ -87,6 +89,11 @@ func (c rawUDPConn) WConn() *MmsgWConn {
 		case 0:
 		case syscall.EAGAIN:
 			return false
+		case syscall.ENOBUFS:
+			// Stop here, so that WriteMsgs backs off and retries outside of RawConn.Write.
+			mmsgWConn.writeErr = os.NewSyscallError("sendmmsg", errno)
+			mmsgWConn.writeNoBufs = true
+			return true
 		default:
 			mmsgWConn.writeErr = os.NewSyscallError("sendmmsg", errno)
 			n = 1
@@ -117,12 +124,32 @@ func (c *MmsgRConn) ReadMsgs(msgvec []Mmsghdr, flags int) (int, error) {
 }
 
 // WriteMsgs writes all messages in the given msgvec and returns the last encountered error.
+//
+// A message that fails with ENOBUFS is retried a bounded number of times after a short backoff,
+// then dropped.
 func (c *MmsgWConn) WriteMsgs(msgvec []Mmsghdr, flags int) error {
 	c.writeMsgvec = msgvec
 	c.writeFlags = flags
 	c.writeErr = nil
-	if err := c.rawConn.Write(c.rawWriteFunc); err != nil {
-		return err
+	for attempt := 0; ; {
+		c.writeNoBufs = false
+		if err := c.rawConn.Write(c.rawWriteFunc); err != nil {
+			return err
+		}
+		if !c.writeNoBufs {
+			return c.writeErr
+		}
+
+		delay, retry := transientSendRetryDelay(c.writeErr, attempt)
+		if !retry {
+			c.writeMsgvec = c.writeMsgvec[1:]
+			if len(c.writeMsgvec) == 0 {
+				return c.writeErr
+			}
+			attempt = 0
+			continue
+		}
+		time.Sleep(delay)
+		attempt++
 	}
-	return c.writeErr
 }
@@ -0,0 +1,47 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/database64128/swgp-go/fastrand"
+)
+
+// ErrNoPortsAvailable is returned when every port in a port range is in use.
+var ErrNoPortsAvailable = errors.New("no ports available")
+
+// ListenUDPPortRange is like [ListenConfig.ListenUDP], but binds to a port between portMin and portMax
+// (inclusive) on host. Ports are tried in order from a random starting point, skipping ports in use.
+//
+// If all ports are in use, the returned error wraps [ErrNoPortsAvailable].
+func (lc *ListenConfig) ListenUDPPortRange(ctx context.Context, network, host string, portMin, portMax uint16) (*net.UDPConn, error) {
+	offset := fastrand.Uint32n(uint32(portMax) - uint32(portMin) + 1)
+	return bindInRange(portMin, portMax, offset, func(port uint16) (*net.UDPConn, error) {
+		return lc.ListenUDP(ctx, network, net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10)))
+	})
+}
+
+// bindInRange calls bind with each port between portMin and portMax (inclusive), starting at
+// the port offset ports after portMin and wrapping around, until bind returns a socket. Ports in use are skipped,
+// and any other error is returned right away. offset must be less than the number of ports in the range.
+//
+// If all ports are in use, the returned error wraps [ErrNoPortsAvailable].
+func bindInRange(portMin, portMax uint16, offset uint32, bind func(port uint16) (*net.UDPConn, error)) (*net.UDPConn, error) {
+	n := uint32(portMax) - uint32(portMin) + 1
+
+	for i := uint32(0); i < n; i++ {
+		port := uint32(portMin) + (offset+i)%n
+		c, err := bind(uint16(port))
+		if err == nil {
+			return c, nil
+		}
+		if !IsAddrInUse(err) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("%w in range %d-%d", ErrNoPortsAvailable, portMin, portMax)
+}
@@ -0,0 +1,13 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris || zos
+
+package conn
+
+import (
+	"errors"
+	"syscall"
+)
+
+// IsAddrInUse returns whether err is caused by the local address being in use.
+func IsAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
@@ -0,0 +1,148 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestListenUDPPortRange(t *testing.T) {
+	ctx := context.Background()
+	lc := DefaultUDPClientListenConfig
+	ports := make(map[int]struct{})
+
+	for i := 0; i < 2; i++ {
+		c, err := lc.ListenUDPPortRange(ctx, "udp", "", 20298, 20299)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		port := c.LocalAddr().(*net.UDPAddr).Port
+		if port < 20298 || port > 20299 {
+			t.Errorf("Bound port %d is out of range", port)
+		}
+		ports[port] = struct{}{}
+	}
+	if len(ports) != 2 {
+		t.Errorf("Expected 2 distinct ports, got %v", ports)
+	}
+
+	if _, err := lc.ListenUDPPortRange(ctx, "udp", "", 20298, 20299); !errors.Is(err, ErrNoPortsAvailable) {
+		t.Errorf("Expected ErrNoPortsAvailable, got %v", err)
+	}
+}
+
+func TestListenUDPPortRangeSkipsPortInUse(t *testing.T) {
+	ctx := context.Background()
+	lc := DefaultUDPClientListenConfig
+
+	existing, err := net.ListenUDP("udp", &net.UDPAddr{Port: 20545})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer existing.Close()
+
+	// Whatever the starting point, the only free port is the one not already bound.
+	for i := 0; i < 4; i++ {
+		c, err := lc.ListenUDPPortRange(ctx, "udp", "", 20545, 20546)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := c.LocalAddr().(*net.UDPAddr).Port
+		c.Close()
+		if port != 20546 {
+			t.Errorf("Bound port %d, expected 20546", port)
+		}
+	}
+
+	if _, err := lc.ListenUDPPortRange(ctx, "udp", "", 20545, 20545); !errors.Is(err, ErrNoPortsAvailable) {
+		t.Errorf("Expected ErrNoPortsAvailable, got %v", err)
+	}
+}
+
+func TestBindInRange(t *testing.T) {
+	errInUse := addrInUseError(t)
+	errOther := errors.New("other error")
+
+	for _, c := range []struct {
+		name        string
+		portMin     uint16
+		portMax     uint16
+		offset      uint32
+		inUse       []uint16
+		failing     []uint16
+		expectErr   error
+		expectTried []uint16
+	}{
+		{"FirstPort", 100, 103, 0, nil, nil, nil, []uint16{100}},
+		{"Offset", 100, 103, 2, nil, nil, nil, []uint16{102}},
+		{"LastPort", 100, 103, 3, nil, nil, nil, []uint16{103}},
+		{"SkipInUse", 100, 103, 2, []uint16{102, 103}, nil, nil, []uint16{102, 103, 100}},
+		{"SinglePort", 100, 100, 0, nil, nil, nil, []uint16{100}},
+		{"SinglePortInUse", 100, 100, 0, []uint16{100}, nil, ErrNoPortsAvailable, []uint16{100}},
+		{"Exhausted", 100, 102, 1, []uint16{100, 101, 102}, nil, ErrNoPortsAvailable, []uint16{101, 102, 100}},
+		{"OtherError", 100, 103, 0, []uint16{100}, []uint16{101}, errOther, []uint16{100, 101}},
+		{"FullRangeWraps", 0, 65535, 65535, []uint16{65535}, nil, nil, []uint16{65535, 0}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var tried []uint16
+			_, err := bindInRange(c.portMin, c.portMax, c.offset, func(port uint16) (*net.UDPConn, error) {
+				tried = append(tried, port)
+				switch {
+				case containsPort(c.failing, port):
+					return nil, errOther
+				case containsPort(c.inUse, port):
+					return nil, errInUse
+				default:
+					return nil, nil
+				}
+			})
+
+			if c.expectErr == nil && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if c.expectErr != nil && !errors.Is(err, c.expectErr) {
+				t.Errorf("Expected error %v, got %v", c.expectErr, err)
+			}
+			if len(tried) != len(c.expectTried) {
+				t.Fatalf("Tried ports %v, expected %v", tried, c.expectTried)
+			}
+			for i := range tried {
+				if tried[i] != c.expectTried[i] {
+					t.Fatalf("Tried ports %v, expected %v", tried, c.expectTried)
+				}
+			}
+		})
+	}
+}
+
+func containsPort(ports []uint16, port uint16) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// addrInUseError returns the error of binding to an address that is already bound.
+func addrInUseError(t *testing.T) error {
+	t.Helper()
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c2, err := net.ListenUDP("udp", c.LocalAddr().(*net.UDPAddr))
+	if err == nil {
+		c2.Close()
+		t.Fatal("Expected binding to a bound address to fail")
+	}
+	if !IsAddrInUse(err) {
+		t.Fatalf("Expected an address in use error, got %v", err)
+	}
+	return err
+}
@@ -0,0 +1,12 @@
+package conn
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// IsAddrInUse returns whether err is caused by the local address being in use.
+func IsAddrInUse(err error) bool {
+	return errors.Is(err, windows.WSAEADDRINUSE)
+}
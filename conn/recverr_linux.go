@@ -0,0 +1,75 @@
+package conn
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+func setRecvErr(fd int, network string) error {
+	// Set IP_RECVERR for both v4 and v6.
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVERR, 1); err != nil {
+		return fmt.Errorf("failed to set socket option IP_RECVERR: %w", err)
+	}
+
+	switch network {
+	case "udp4":
+	case "udp6":
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_RECVERR, 1); err != nil {
+			return fmt.Errorf("failed to set socket option IPV6_RECVERR: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported network: %s", network)
+	}
+
+	return nil
+}
+
+func (fns setFuncSlice) appendSetRecvErrFunc(recvErr bool) setFuncSlice {
+	if recvErr {
+		return append(fns, setRecvErr)
+	}
+	return fns
+}
+
+// DrainErrorQueue discards the queued errors of a socket with [ListenerSocketOptions.ReceiveErrors] set,
+// and clears the pending socket error.
+//
+// A queued error makes the socket readable, and is reported once by the next read or write as the pending
+// socket error, which could be any ICMP error, not only port unreachable. The queued errors take up space
+// in the receive buffer, and keep the socket readable, so they must be drained after each failed read or write.
+// Older kernels leave the pending socket error set after dequeuing the last error,
+// so it is cleared after draining, to keep a drained error from being reported again.
+//
+// This function is only implemented for Linux. On other platforms, it does nothing.
+func DrainErrorQueue(c *net.UDPConn) error {
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var buf [1]byte
+	var oob [256]byte
+	var rerr error
+
+	if err = rawConn.Read(func(fd uintptr) bool {
+		for {
+			_, _, _, _, err := unix.Recvmsg(int(fd), buf[:], oob[:], unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+			if err != nil {
+				if err != unix.EAGAIN {
+					rerr = fmt.Errorf("failed to read error queue: %w", err)
+					return true
+				}
+				break
+			}
+		}
+		if _, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR); err != nil {
+			rerr = fmt.Errorf("failed to clear pending socket error: %w", err)
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	return rerr
+}
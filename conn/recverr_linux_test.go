@@ -0,0 +1,62 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDrainErrorQueue(t *testing.T) {
+	lso := ListenerSocketOptions{
+		ReceiveErrors: true,
+	}
+	lc := lso.ListenConfig()
+
+	udpConn, err := lc.ListenUDP(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	// Nothing listens on the destination port, so each packet queues a port-unreachable error.
+	// Each write after the first reports the pending error of the one before, which stays queued.
+	closedAddrPort := netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 20572)
+	for i := 0; i < 4; i++ {
+		if _, err = udpConn.WriteToUDPAddrPort([]byte{0}, closedAddrPort); err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err = DrainErrorQueue(udpConn); err != nil {
+		t.Fatal(err)
+	}
+
+	rawConn, err := udpConn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rerr error
+	if err = rawConn.Control(func(fd uintptr) {
+		_, _, _, _, rerr = unix.Recvmsg(int(fd), make([]byte, 1), make([]byte, 256), unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if rerr != unix.EAGAIN {
+		t.Errorf("Expected an empty error queue, got %v", rerr)
+	}
+
+	// The drained errors must not be reported again.
+	if err = udpConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = udpConn.ReadFromUDPAddrPort(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected read to time out after draining, got %v", err)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package conn
+
+import "net"
+
+// DrainErrorQueue discards the queued errors of a socket with [ListenerSocketOptions.ReceiveErrors] set.
+//
+// This function is only implemented for Linux. On other platforms, it does nothing.
+func DrainErrorQueue(c *net.UDPConn) error {
+	return nil
+}
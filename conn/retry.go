@@ -0,0 +1,56 @@
+package conn
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+const (
+	// sendRetryAttempts is the maximum number of times a send that failed with ENOBUFS is retried.
+	sendRetryAttempts = 3
+
+	// sendRetryBackoff is the delay before the first retry of a send that failed with ENOBUFS.
+	// The delay doubles on each retry.
+	sendRetryBackoff = 50 * time.Microsecond
+)
+
+// transientSendRetryDelay returns whether a send that failed attempt times, last with err, should be retried,
+// and how long to wait before retrying.
+//
+// ENOBUFS means the kernel ran out of buffers for a moment, so it is retried after a short backoff.
+// Other errors are not retried. The Go runtime already retries sends interrupted by signals.
+func transientSendRetryDelay(err error, attempt int) (time.Duration, bool) {
+	if attempt >= sendRetryAttempts || !errors.Is(err, syscall.ENOBUFS) {
+		return 0, false
+	}
+	return sendRetryBackoff << attempt, true
+}
+
+// WriteToUDPAddrPort is like [net.UDPConn.WriteToUDPAddrPort],
+// but retries a bounded number of times on ENOBUFS.
+func WriteToUDPAddrPort(c *net.UDPConn, b []byte, addr netip.AddrPort) (n int, err error) {
+	for attempt := 0; ; attempt++ {
+		n, err = c.WriteToUDPAddrPort(b, addr)
+		delay, retry := transientSendRetryDelay(err, attempt)
+		if !retry {
+			return n, err
+		}
+		time.Sleep(delay)
+	}
+}
+
+// WriteMsgUDPAddrPort is like [net.UDPConn.WriteMsgUDPAddrPort],
+// but retries a bounded number of times on ENOBUFS.
+func WriteMsgUDPAddrPort(c *net.UDPConn, b, oob []byte, addr netip.AddrPort) (n, oobn int, err error) {
+	for attempt := 0; ; attempt++ {
+		n, oobn, err = c.WriteMsgUDPAddrPort(b, oob, addr)
+		delay, retry := transientSendRetryDelay(err, attempt)
+		if !retry {
+			return n, oobn, err
+		}
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,35 @@
+package conn
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTransientSendRetryDelay(t *testing.T) {
+	for _, c := range []struct {
+		name          string
+		err           error
+		attempt       int
+		expectedDelay time.Duration
+		expectedRetry bool
+	}{
+		{"Success", nil, 0, 0, false},
+		{"EINTR", syscall.EINTR, 0, 0, false},
+		{"ENOBUFS", syscall.ENOBUFS, 0, sendRetryBackoff, true},
+		{"WrappedENOBUFS", os.NewSyscallError("sendmmsg", syscall.ENOBUFS), 1, 2 * sendRetryBackoff, true},
+		{"ENOBUFSBackoff", syscall.ENOBUFS, 2, 4 * sendRetryBackoff, true},
+		{"ENOBUFSExhausted", syscall.ENOBUFS, sendRetryAttempts, 0, false},
+		{"EMSGSIZE", syscall.EMSGSIZE, 0, 0, false},
+		{"Other", errors.New("use of closed network connection"), 0, 0, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			delay, retry := transientSendRetryDelay(c.err, c.attempt)
+			if retry != c.expectedRetry || delay != c.expectedDelay {
+				t.Errorf("Got (%v, %v), expected (%v, %v)", delay, retry, c.expectedDelay, c.expectedRetry)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package conn
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func setRecvDropCounter(fd int, network string) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RXQ_OVFL, 1); err != nil {
+		return fmt.Errorf("failed to set socket option SO_RXQ_OVFL: %w", err)
+	}
+	return nil
+}
+
+func (fns setFuncSlice) appendSetRecvDropCounterFunc(recvDropCounter bool) setFuncSlice {
+	if recvDropCounter {
+		return append(fns, setRecvDropCounter)
+	}
+	return fns
+}
+
+// StripDropCounterCmsg removes the SO_RXQ_OVFL control message from the front of cmsg,
+// where the kernel places it before control messages of other levels.
+//
+// It returns the remaining control messages, and the number of packets the kernel has dropped
+// on the socket since it was created because the receive buffer was full.
+// ok is false if cmsg does not start with a drop counter, which is the case until the first drop.
+//
+// This function is only implemented for Linux. On other platforms, it returns cmsg unchanged.
+func StripDropCounterCmsg(cmsg []byte) (rest []byte, dropCount uint32, ok bool) {
+	if len(cmsg) < unix.CmsgSpace(4) {
+		return cmsg, 0, false
+	}
+	cmsghdr := (*unix.Cmsghdr)(unsafe.Pointer(&cmsg[0]))
+	if cmsghdr.Level != unix.SOL_SOCKET || cmsghdr.Type != unix.SO_RXQ_OVFL || int(cmsghdr.Len) != unix.CmsgLen(4) {
+		return cmsg, 0, false
+	}
+	dropCount = *(*uint32)(unsafe.Pointer(&cmsg[unix.SizeofCmsghdr]))
+	return cmsg[unix.CmsgSpace(4):], dropCount, true
+}
@@ -0,0 +1,79 @@
+package conn
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStripDropCounterCmsg(t *testing.T) {
+	lso := ListenerSocketOptions{
+		ReceivePacketInfo:  true,
+		ReceiveDropCounter: true,
+	}
+	lc := lso.ListenConfig()
+
+	serverConn, err := lc.ListenUDP(context.Background(), "udp4", "127.0.0.1:20319")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	// Shrink the receive buffer, so that a burst overflows it.
+	if err = serverConn.SetReadBuffer(1); err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, err := net.Dial("udp4", "127.0.0.1:20319")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	payload := make([]byte, 1024)
+	for i := 0; i < 64; i++ {
+		if _, err = clientConn.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The drop count is recorded when a packet is queued, so drain the burst,
+	// and read a packet sent after the drops.
+	b := make([]byte, len(payload))
+	if err = serverConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err = serverConn.Read(b); err != nil {
+			break
+		}
+	}
+	if err = serverConn.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = clientConn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	cmsgBuf := make([]byte, SocketControlMessageBufferSize)
+	_, cmsgn, _, _, err := serverConn.ReadMsgUDPAddrPort(b, cmsgBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rest, dropCount, ok := StripDropCounterCmsg(cmsgBuf[:cmsgn])
+	if !ok {
+		t.Fatal("Expected drop counter control message after overflowing the receive buffer")
+	}
+	if dropCount == 0 {
+		t.Error("Expected a non-zero drop count")
+	}
+	if _, _, err = ParsePktinfoCmsg(rest); err != nil {
+		t.Errorf("Failed to parse pktinfo after stripping drop counter: %v", err)
+	}
+
+	if _, _, ok = StripDropCounterCmsg(rest); ok {
+		t.Error("Expected no drop counter in the remaining control messages")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package conn
+
+// StripDropCounterCmsg removes the SO_RXQ_OVFL control message from the front of cmsg,
+// and returns the remaining control messages and the number of packets dropped by the kernel.
+//
+// This function is only implemented for Linux. On other platforms, it returns cmsg unchanged.
+func StripDropCounterCmsg(cmsg []byte) (rest []byte, dropCount uint32, ok bool) {
+	return cmsg, 0, false
+}
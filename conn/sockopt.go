@@ -0,0 +1,127 @@
+package conn
+
+import (
+	"reflect"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// socketOption is a socket option requested by a field of [ListenerSocketOptions].
+type socketOption struct {
+	// name is the name of the field.
+	name string
+
+	// value is the requested value.
+	value any
+
+	// fns sets the option. It is empty if the option is not supported on the current platform.
+	fns setFuncSlice
+}
+
+// socketOptions returns the socket options requested by lso, one for each field with a non-zero value, in field order.
+// Each option is set by what [ListenerSocketOptions.buildSetFns] builds for its field alone,
+// so new fields are picked up without being listed here.
+func (lso ListenerSocketOptions) socketOptions() []socketOption {
+	var opts []socketOption
+	v := reflect.ValueOf(lso)
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.IsZero() {
+			continue
+		}
+		var single ListenerSocketOptions
+		reflect.ValueOf(&single).Elem().Field(i).Set(field)
+		opts = append(opts, socketOption{
+			name:  t.Field(i).Name,
+			value: field.Interface(),
+			fns:   single.buildSetFns(),
+		})
+	}
+	return opts
+}
+
+// ListenConfigWithLogger is like [ListenerSocketOptions.ListenConfig], but if logger is enabled at debug level,
+// the control function logs each requested socket option, whether it is supported on the current platform,
+// whether the kernel accepted it, and the value read back from the socket, where that is implemented.
+// It also logs the receive and send buffer sizes granted by the kernel.
+//
+// Whether to log is decided when the [ListenConfig] is created.
+// If logger is nil or not enabled at debug level, it returns [ListenerSocketOptions.ListenConfig].
+func (lso ListenerSocketOptions) ListenConfigWithLogger(logger *zap.Logger) ListenConfig {
+	if logger == nil || !logger.Core().Enabled(zap.DebugLevel) {
+		return lso.ListenConfig()
+	}
+	return ListenConfig{
+		Control: lso.loggingControlFunc(logger),
+	}
+}
+
+// loggingControlFunc returns a control function that sets the socket options one at a time, and logs the outcome of each.
+// Like the control function of [ListenerSocketOptions.ListenConfig], it stops at the first option the kernel rejects.
+func (lso ListenerSocketOptions) loggingControlFunc(logger *zap.Logger) func(network, address string, c syscall.RawConn) error {
+	opts := lso.socketOptions()
+
+	return func(network, address string, c syscall.RawConn) (err error) {
+		if cerr := c.Control(func(fd uintptr) {
+			for _, opt := range opts {
+				if len(opt.fns) == 0 {
+					logger.Debug("Socket option not supported on this platform, ignored",
+						zap.String("network", network),
+						zap.String("address", address),
+						zap.String("option", opt.name),
+						zap.Any("value", opt.value),
+					)
+					continue
+				}
+
+				for _, fn := range opt.fns {
+					if err = fn(int(fd), network); err != nil {
+						logger.Debug("Kernel rejected socket option",
+							zap.String("network", network),
+							zap.String("address", address),
+							zap.String("option", opt.name),
+							zap.Any("value", opt.value),
+							zap.Error(err),
+						)
+						return
+					}
+				}
+
+				fields := []zap.Field{
+					zap.String("network", network),
+					zap.String("address", address),
+					zap.String("option", opt.name),
+					zap.Any("value", opt.value),
+				}
+				readBack, ok, rerr := getSocketOption(int(fd), network, opt.name)
+				switch {
+				case rerr != nil:
+					fields = append(fields, zap.NamedError("readBackError", rerr))
+				case ok:
+					fields = append(fields, zap.Any("readBack", readBack))
+				}
+				logger.Debug("Set socket option", fields...)
+			}
+
+			if receiveBuffer, sendBuffer, ok, rerr := getBufferSizes(int(fd)); rerr != nil {
+				logger.Debug("Failed to get socket buffer sizes",
+					zap.String("network", network),
+					zap.String("address", address),
+					zap.Error(rerr),
+				)
+			} else if ok {
+				logger.Debug("Got socket buffer sizes",
+					zap.String("network", network),
+					zap.String("address", address),
+					zap.Int("receiveBuffer", receiveBuffer),
+					zap.Int("sendBuffer", sendBuffer),
+				)
+			}
+		}); cerr != nil {
+			return cerr
+		}
+		return
+	}
+}
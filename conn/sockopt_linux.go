@@ -0,0 +1,95 @@
+package conn
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// getSocketOption reads back the value of the socket option requested by the named field of [ListenerSocketOptions].
+// ok is false if the value is not read back.
+func getSocketOption(fd int, network, name string) (value any, ok bool, err error) {
+	var is6 bool
+	switch network {
+	case "tcp4", "udp4":
+	case "tcp6", "udp6":
+		is6 = true
+	default:
+		return nil, false, fmt.Errorf("unsupported network: %s", network)
+	}
+
+	var (
+		level, opt int
+		optName    string
+		isBool     bool
+	)
+
+	switch name {
+	case "Fwmark":
+		level, opt, optName = unix.SOL_SOCKET, unix.SO_MARK, "SO_MARK"
+	case "TrafficClass":
+		level, opt, optName = unix.IPPROTO_IP, unix.IP_TOS, "IP_TOS"
+		if is6 {
+			level, opt, optName = unix.IPPROTO_IPV6, unix.IPV6_TCLASS, "IPV6_TCLASS"
+		}
+	case "TTL":
+		level, opt, optName = unix.IPPROTO_IP, unix.IP_TTL, "IP_TTL"
+		if is6 {
+			level, opt, optName = unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, "IPV6_UNICAST_HOPS"
+		}
+	case "PathMTUDiscovery", "DontFragment":
+		dontFragment, err := getDontFragment(fd, network)
+		if err != nil {
+			return nil, false, err
+		}
+		return dontFragment, true, nil
+	case "ReceivePacketInfo":
+		level, opt, optName, isBool = unix.IPPROTO_IP, unix.IP_PKTINFO, "IP_PKTINFO", true
+		if is6 {
+			level, opt, optName = unix.IPPROTO_IPV6, unix.IPV6_RECVPKTINFO, "IPV6_RECVPKTINFO"
+		}
+	case "Transparent":
+		level, opt, optName, isBool = unix.IPPROTO_IP, unix.IP_TRANSPARENT, "IP_TRANSPARENT", true
+		if is6 {
+			level, opt, optName = unix.IPPROTO_IPV6, unix.IPV6_TRANSPARENT, "IPV6_TRANSPARENT"
+		}
+	case "ReceiveDropCounter":
+		level, opt, optName, isBool = unix.SOL_SOCKET, unix.SO_RXQ_OVFL, "SO_RXQ_OVFL", true
+	case "ReceiveErrors":
+		level, opt, optName, isBool = unix.IPPROTO_IP, unix.IP_RECVERR, "IP_RECVERR", true
+		if is6 {
+			level, opt, optName = unix.IPPROTO_IPV6, unix.IPV6_RECVERR, "IPV6_RECVERR"
+		}
+	case "BindToDevice":
+		device, err := unix.GetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to get socket option SO_BINDTODEVICE: %w", err)
+		}
+		return device, true, nil
+	default:
+		return nil, false, nil
+	}
+
+	v, err := unix.GetsockoptInt(fd, level, opt)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get socket option %s: %w", optName, err)
+	}
+	if isBool {
+		return v != 0, true, nil
+	}
+	return v, true, nil
+}
+
+// getBufferSizes returns the receive and send buffer sizes granted by the kernel.
+// Linux reports twice the requested sizes, to account for bookkeeping overhead.
+func getBufferSizes(fd int) (receiveBuffer, sendBuffer int, ok bool, err error) {
+	receiveBuffer, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("failed to get socket option SO_RCVBUF: %w", err)
+	}
+	sendBuffer, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("failed to get socket option SO_SNDBUF: %w", err)
+	}
+	return receiveBuffer, sendBuffer, true, nil
+}
@@ -0,0 +1,85 @@
+package conn
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestListenConfigWithLogger(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	lso := ListenerSocketOptions{
+		TTL:               42,
+		PathMTUDiscovery:  true,
+		ReceivePacketInfo: true,
+	}
+	lc := lso.ListenConfigWithLogger(zap.New(core))
+
+	udpConn, err := lc.ListenUDP(context.Background(), "udp4", "127.0.0.1:20557")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn.Close()
+
+	readBacks := make(map[string]any)
+	for _, entry := range logs.FilterMessage("Set socket option").All() {
+		fields := entry.ContextMap()
+		if fields["network"] != "udp4" {
+			t.Errorf("network = %v, expected udp4", fields["network"])
+		}
+		readBacks[fields["option"].(string)] = fields["readBack"]
+	}
+	for option, expected := range map[string]any{
+		"TTL":               int64(42),
+		"PathMTUDiscovery":  true,
+		"ReceivePacketInfo": true,
+	} {
+		if readBack, ok := readBacks[option]; !ok {
+			t.Errorf("Expected %s to be logged", option)
+		} else if readBack != expected {
+			t.Errorf("%s read back %v, expected %v", option, readBack, expected)
+		}
+	}
+
+	entries := logs.FilterMessage("Got socket buffer sizes").All()
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 buffer sizes entry, got %d", len(entries))
+	}
+	if receiveBuffer, _ := entries[0].ContextMap()["receiveBuffer"].(int64); receiveBuffer <= 0 {
+		t.Errorf("receiveBuffer = %d, expected the granted size", receiveBuffer)
+	}
+}
+
+func TestListenConfigWithLoggerRejected(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	lso := ListenerSocketOptions{
+		BindToDevice: "swgp-no-such-dev",
+	}
+	lc := lso.ListenConfigWithLogger(zap.New(core))
+
+	if udpConn, err := lc.ListenUDP(context.Background(), "udp4", "127.0.0.1:20558"); err == nil {
+		udpConn.Close()
+		t.Fatal("Expected error for a device that does not exist")
+	}
+
+	entries := logs.FilterMessage("Kernel rejected socket option").All()
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 rejected option, got %d", len(entries))
+	}
+	if option := entries[0].ContextMap()["option"]; option != "BindToDevice" {
+		t.Errorf("option = %v, expected BindToDevice", option)
+	}
+	if n := logs.FilterMessage("Set socket option").Len(); n != 0 {
+		t.Errorf("Expected no set options, got %d", n)
+	}
+}
+
+func TestListenConfigWithLoggerDisabled(t *testing.T) {
+	core, _ := observer.New(zap.InfoLevel)
+	lc := ListenerSocketOptions{}.ListenConfigWithLogger(zap.New(core))
+	if lc.Control != nil {
+		t.Error("Expected no control function without socket options when debug logging is disabled")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package conn
+
+// getSocketOption is not implemented on this platform, so values are not read back.
+func getSocketOption(fd int, network, name string) (value any, ok bool, err error) {
+	return nil, false, nil
+}
+
+// getBufferSizes is not implemented on this platform, so buffer sizes are not logged.
+func getBufferSizes(fd int) (receiveBuffer, sendBuffer int, ok bool, err error) {
+	return 0, 0, false, nil
+}
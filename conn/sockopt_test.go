@@ -0,0 +1,40 @@
+package conn
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSocketOptionsCoverAllFields(t *testing.T) {
+	// Set every field, so that a new field is covered without changing this test.
+	var lso ListenerSocketOptions
+	v := reflect.ValueOf(&lso).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		switch field := v.Field(i); field.Kind() {
+		case reflect.Bool:
+			field.SetBool(true)
+		case reflect.Int:
+			field.SetInt(1)
+		case reflect.String:
+			field.SetString("swgp0")
+		default:
+			t.Fatalf("Unexpected kind %s of field %s", field.Kind(), v.Type().Field(i).Name)
+		}
+	}
+
+	opts := lso.socketOptions()
+	if len(opts) != v.NumField() {
+		t.Fatalf("Got %d socket options, expected one for each of the %d fields", len(opts), v.NumField())
+	}
+
+	var fnCount int
+	for i, opt := range opts {
+		if name := v.Type().Field(i).Name; opt.name != name {
+			t.Errorf("opts[%d].name = %q, expected %q", i, opt.name, name)
+		}
+		fnCount += len(opt.fns)
+	}
+	if setFnCount := len(lso.buildSetFns()); fnCount != setFnCount {
+		t.Errorf("Socket options set %d functions, buildSetFns builds %d", fnCount, setFnCount)
+	}
+}
@@ -0,0 +1,90 @@
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func setTransparent(fd int, network string) error {
+	// Set IP_TRANSPARENT and IP_RECVORIGDSTADDR for both v4 and v6.
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TRANSPARENT, 1); err != nil {
+		return fmt.Errorf("failed to set socket option IP_TRANSPARENT: %w", err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVORIGDSTADDR, 1); err != nil {
+		return fmt.Errorf("failed to set socket option IP_RECVORIGDSTADDR: %w", err)
+	}
+
+	switch network {
+	case "udp4":
+	case "udp6":
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TRANSPARENT, 1); err != nil {
+			return fmt.Errorf("failed to set socket option IPV6_TRANSPARENT: %w", err)
+		}
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_RECVORIGDSTADDR, 1); err != nil {
+			return fmt.Errorf("failed to set socket option IPV6_RECVORIGDSTADDR: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported network: %s", network)
+	}
+
+	return nil
+}
+
+func (fns setFuncSlice) appendSetTransparentFunc(transparent bool) setFuncSlice {
+	if transparent {
+		return append(fns, setTransparent)
+	}
+	return fns
+}
+
+// ParseOrigDstAddrCmsg splits the socket control messages received on a transparent listener
+// into the packet information control message and the original destination address of the packet.
+//
+// The returned pktinfo can be parsed by [ParsePktinfoCmsg] and used for sending replies.
+// It is nil if cmsg contains no packet information control message.
+//
+// This function is only implemented for Linux. On other platforms, it returns an error.
+func ParseOrigDstAddrCmsg(cmsg []byte) (pktinfo []byte, origDstAddrPort netip.AddrPort, err error) {
+	var found bool
+
+	for len(cmsg) >= unix.SizeofCmsghdr {
+		cmsghdr := (*unix.Cmsghdr)(unsafe.Pointer(&cmsg[0]))
+		msgLen := int(cmsghdr.Len)
+		if msgLen < unix.SizeofCmsghdr || msgLen > len(cmsg) {
+			return nil, netip.AddrPort{}, fmt.Errorf("bad control message length %d", msgLen)
+		}
+		data := cmsg[unix.SizeofCmsghdr:msgLen]
+
+		switch {
+		case cmsghdr.Level == unix.IPPROTO_IP && cmsghdr.Type == unix.IP_ORIGDSTADDR,
+			cmsghdr.Level == unix.IPPROTO_IPV6 && cmsghdr.Type == unix.IPV6_ORIGDSTADDR:
+			if len(data) == 0 {
+				return nil, netip.AddrPort{}, errors.New("empty original destination control message")
+			}
+			origDstAddrPort, err = SockaddrToAddrPort(&data[0], uint32(len(data)))
+			if err != nil {
+				return nil, netip.AddrPort{}, err
+			}
+			found = true
+
+		case cmsghdr.Level == unix.IPPROTO_IP && cmsghdr.Type == unix.IP_PKTINFO,
+			cmsghdr.Level == unix.IPPROTO_IPV6 && cmsghdr.Type == unix.IPV6_PKTINFO:
+			pktinfo = cmsg[:msgLen]
+		}
+
+		space := unix.CmsgSpace(msgLen - unix.SizeofCmsghdr)
+		if space > len(cmsg) {
+			break
+		}
+		cmsg = cmsg[space:]
+	}
+
+	if !found {
+		return nil, netip.AddrPort{}, errors.New("missing original destination control message")
+	}
+	return pktinfo, origDstAddrPort, nil
+}
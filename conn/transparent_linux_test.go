@@ -0,0 +1,69 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+)
+
+func TestTransparentOrigDstAddr(t *testing.T) {
+	for _, c := range []struct {
+		network string
+		address string
+	}{
+		{"udp4", "127.0.0.1:20315"},
+		{"udp6", "[::1]:20316"},
+	} {
+		t.Run(c.network, func(t *testing.T) {
+			lso := ListenerSocketOptions{
+				ReceivePacketInfo: true,
+				Transparent:       true,
+			}
+			lc := lso.ListenConfig()
+
+			serverConn, err := lc.ListenUDP(context.Background(), c.network, c.address)
+			if err != nil {
+				if errors.Is(err, os.ErrPermission) {
+					t.Skipf("Transparent sockets require CAP_NET_ADMIN: %v", err)
+				}
+				t.Fatal(err)
+			}
+			defer serverConn.Close()
+
+			clientConn, err := net.Dial(c.network, c.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer clientConn.Close()
+
+			if _, err = clientConn.Write([]byte("swgp")); err != nil {
+				t.Fatal(err)
+			}
+
+			b := make([]byte, 16)
+			cmsgBuf := make([]byte, SocketControlMessageBufferSize)
+			_, cmsgn, _, _, err := serverConn.ReadMsgUDPAddrPort(b, cmsgBuf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pktinfo, origDstAddrPort, err := ParseOrigDstAddrCmsg(cmsgBuf[:cmsgn])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := netip.MustParseAddrPort(c.address); origDstAddrPort != expected {
+				t.Errorf("Got original destination %s, expected %s", origDstAddrPort, expected)
+			}
+			if _, _, err = ParsePktinfoCmsg(pktinfo); err != nil {
+				t.Errorf("Failed to parse pktinfo: %v", err)
+			}
+		})
+	}
+
+	if _, _, err := ParseOrigDstAddrCmsg(nil); err == nil {
+		t.Error("Expected error for missing original destination control message")
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package conn
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// ParseOrigDstAddrCmsg splits the socket control messages received on a transparent listener
+// into the packet information control message and the original destination address of the packet.
+//
+// This function is only implemented for Linux. On other platforms, it returns an error.
+func ParseOrigDstAddrCmsg(cmsg []byte) (pktinfo []byte, origDstAddrPort netip.AddrPort, err error) {
+	return nil, netip.AddrPort{}, errors.New("original destination address is only supported on Linux")
+}
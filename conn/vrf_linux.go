@@ -0,0 +1,101 @@
+package conn
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func setBindToDevice(fd int, device string) error {
+	if err := unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, device); err != nil {
+		return fmt.Errorf("failed to set socket option SO_BINDTODEVICE: %w", err)
+	}
+	return nil
+}
+
+func (fns setFuncSlice) appendSetBindToDeviceFunc(device string) setFuncSlice {
+	if device != "" {
+		return append(fns, func(fd int, network string) error {
+			return setBindToDevice(fd, device)
+		})
+	}
+	return fns
+}
+
+// CheckVRF returns an error if there is no network device named name, or if the device is not a VRF.
+//
+// This function is only implemented for Linux. On other platforms, it returns an error.
+func CheckVRF(name string) error {
+	kind, err := linkKind(name)
+	if err != nil {
+		return err
+	}
+	if kind != "vrf" {
+		return fmt.Errorf("network device %s is not a VRF", name)
+	}
+	return nil
+}
+
+// linkKind returns the link kind of the network device, like "vrf" or "wireguard",
+// or an empty string for devices without one, like physical interfaces.
+func linkKind(name string) (string, error) {
+	rib, err := syscall.NetlinkRIB(unix.RTM_GETLINK, unix.AF_UNSPEC)
+	if err != nil {
+		return "", fmt.Errorf("failed to dump network devices: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse network devices: %w", err)
+	}
+
+	for i := range msgs {
+		m := &msgs[i]
+		if m.Header.Type != unix.RTM_NEWLINK || len(m.Data) < unix.SizeofIfInfomsg {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(m)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse network device attributes: %w", err)
+		}
+
+		var (
+			ifname   string
+			linkInfo []byte
+		)
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case unix.IFLA_IFNAME:
+				ifname = unix.ByteSliceToString(attr.Value)
+			case unix.IFLA_LINKINFO:
+				linkInfo = attr.Value
+			}
+		}
+		if ifname == name {
+			return parseLinkInfoKind(linkInfo), nil
+		}
+	}
+
+	return "", fmt.Errorf("network device %s does not exist", name)
+}
+
+// parseLinkInfoKind returns the IFLA_INFO_KIND of the nested IFLA_LINKINFO attributes.
+func parseLinkInfoKind(b []byte) string {
+	for len(b) >= unix.SizeofRtAttr {
+		attr := (*unix.RtAttr)(unsafe.Pointer(&b[0]))
+		attrLen := int(attr.Len)
+		if attrLen < unix.SizeofRtAttr || attrLen > len(b) {
+			return ""
+		}
+		if attr.Type == unix.IFLA_INFO_KIND {
+			return unix.ByteSliceToString(b[unix.SizeofRtAttr:attrLen])
+		}
+		alignedLen := (attrLen + unix.RTA_ALIGNTO - 1) &^ (unix.RTA_ALIGNTO - 1)
+		if alignedLen > len(b) {
+			return ""
+		}
+		b = b[alignedLen:]
+	}
+	return ""
+}
@@ -0,0 +1,20 @@
+package conn
+
+import "testing"
+
+func TestCheckVRF(t *testing.T) {
+	kind, err := linkKind("lo")
+	if err != nil {
+		t.Skipf("Failed to look up the loopback device: %v", err)
+	}
+	if kind != "" {
+		t.Errorf("Expected loopback device to have no link kind, got %q", kind)
+	}
+
+	if err = CheckVRF("lo"); err == nil {
+		t.Error("Expected error for a device that is not a VRF.")
+	}
+	if err = CheckVRF("swgp-no-such-vrf"); err == nil {
+		t.Error("Expected error for a device that does not exist.")
+	}
+}
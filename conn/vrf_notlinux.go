@@ -0,0 +1,12 @@
+//go:build !linux
+
+package conn
+
+import "errors"
+
+// CheckVRF returns an error if there is no network device named name, or if the device is not a VRF.
+//
+// This function is only implemented for Linux. On other platforms, it returns an error.
+func CheckVRF(name string) error {
+	return errors.New("VRF is only supported on Linux")
+}
@@ -3,6 +3,7 @@ package jsonhelper
 import (
 	"encoding/json"
 	"os"
+	"time"
 )
 
 func LoadAndDecodeDisallowUnknownFields(path string, v any) error {
@@ -16,3 +17,21 @@ func LoadAndDecodeDisallowUnknownFields(path string, v any) error {
 	d.DisallowUnknownFields()
 	return d.Decode(v)
 }
+
+// Duration is a [time.Duration] that is encoded as a duration string like "1m30s" in JSON.
+type Duration time.Duration
+
+// MarshalText implements the [encoding.TextMarshaler] MarshalText method.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements the [encoding.TextUnmarshaler] UnmarshalText method.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
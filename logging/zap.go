@@ -1,6 +1,8 @@
 package logging
 
 import (
+	"fmt"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -54,3 +56,19 @@ func NewProductionConsoleEncoderConfig(suppressTimestamps bool) zapcore.EncoderC
 		ConsoleSeparator: " ",
 	}
 }
+
+// SetEncoding sets the encoding of the logging configuration to "console" or "json".
+//
+// For "json", levels are encoded in lowercase without color, like [zap.NewProductionEncoderConfig],
+// as color escape sequences do not belong in JSON.
+func SetEncoding(zc *zap.Config, encoding string) error {
+	switch encoding {
+	case "console":
+	case "json":
+		zc.EncoderConfig.EncodeLevel = zapcore.LowercaseLevelEncoder
+	default:
+		return fmt.Errorf("unknown log format: %s", encoding)
+	}
+	zc.Encoding = encoding
+	return nil
+}
@@ -0,0 +1,111 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Bundle messages are proxy-layer messages that carry several small WireGuard data packets
+// between swgp clients and servers in one swgp packet, to save the per-packet overhead of the path.
+// Like cookie messages, they are encrypted by packet handlers just like WireGuard packets.
+//
+//	bundle := 1B message type + 3B reserved + 1*(2B u16be packet length + WireGuard data packet)
+//
+// Only data packets are bundled. Handshake messages and proxy-layer control messages are always sent on their own,
+// so that the server sees them the same way with or without bundles.
+const (
+	// MessageTypeBundle is the message type of a bundle.
+	// It is outside the range of WireGuard message types.
+	MessageTypeBundle = 0xC4
+
+	// BundleHeaderLength is the length of a bundle without any packets.
+	BundleHeaderLength = 4
+
+	// BundleFrameHeaderLength is the length of the length prefix of each packet in a bundle.
+	BundleFrameHeaderLength = 2
+
+	// MaxBundlePackets is the maximum number of packets in a bundle.
+	// Receivers size their batches with it, so larger bundles are rejected as malformed.
+	MaxBundlePackets = 16
+
+	// BundleRearReserve is the space a sender must leave after a bundle in the buffer,
+	// in addition to the handler's rear headroom. The zero-overhead modes encrypt bundles in full,
+	// like handshake messages, so that the headers of the bundled packets are not exposed.
+	BundleRearReserve = zeroOverheadHandshakePacketMinimumOverhead
+)
+
+// IsBundle returns whether the packet is a bundle.
+func IsBundle(b []byte) bool {
+	return len(b) >= BundleHeaderLength && b[0] == MessageTypeBundle && b[1] == 0 && b[2] == 0 && b[3] == 0
+}
+
+// IsBundleable returns whether the WireGuard packet may be carried in a bundle.
+func IsBundleable(wgPacket []byte) bool {
+	return len(wgPacket) >= WireGuardMessageLengthDataMin && wgPacket[0] == WireGuardMessageTypeData
+}
+
+// BundleLength returns the length of a bundle of n packets totalling wgBytes bytes.
+func BundleLength(n, wgBytes int) int {
+	return BundleHeaderLength + n*BundleFrameHeaderLength + wgBytes
+}
+
+// StartBundle turns the WireGuard packet at b[start:start+length] into a bundle that carries it,
+// and returns the length of the bundle. The packet is moved towards the end of b to make room
+// for the headers, so b must have at least [BundleLength](1, length) bytes from start.
+func StartBundle(b []byte, start, length int) int {
+	bundle := b[start : start+BundleLength(1, length)]
+	copy(bundle[BundleHeaderLength+BundleFrameHeaderLength:], bundle[:length])
+	bundle[0] = MessageTypeBundle
+	bundle[1] = 0
+	bundle[2] = 0
+	bundle[3] = 0
+	binary.BigEndian.PutUint16(bundle[BundleHeaderLength:], uint16(length))
+	return len(bundle)
+}
+
+// AppendToBundle appends the WireGuard packet to the bundle at b[start:start+bundleLength],
+// and returns the new length of the bundle. b must have room for the packet and its length prefix.
+func AppendToBundle(b []byte, start, bundleLength int, wgPacket []byte) int {
+	frame := b[start+bundleLength : start+bundleLength+BundleFrameHeaderLength+len(wgPacket)]
+	binary.BigEndian.PutUint16(frame, uint16(len(wgPacket)))
+	copy(frame[BundleFrameHeaderLength:], wgPacket)
+	return bundleLength + len(frame)
+}
+
+// AppendBundledPackets appends the packets carried by the bundle to wgPackets, and returns the extended slice.
+// The bundle must have passed [CheckWireGuardPacket].
+func AppendBundledPackets(wgPackets [][]byte, bundle []byte) [][]byte {
+	for i := BundleHeaderLength; i < len(bundle); {
+		length := int(binary.BigEndian.Uint16(bundle[i:]))
+		i += BundleFrameHeaderLength
+		wgPackets = append(wgPackets, bundle[i:i+length])
+		i += length
+	}
+	return wgPackets
+}
+
+// checkBundle checks that the bundle carries between 1 and [MaxBundlePackets] complete data packets.
+func checkBundle(bundle []byte) error {
+	var n int
+	for i := BundleHeaderLength; i < len(bundle); n++ {
+		if n == MaxBundlePackets {
+			return &HandlerErr{ErrMalformedPacket, fmt.Sprintf("bundle carries more than %d packets", MaxBundlePackets)}
+		}
+		if i+BundleFrameHeaderLength > len(bundle) {
+			return &HandlerErr{ErrMalformedPacket, fmt.Sprintf("bundled packet %d has a truncated length prefix", n)}
+		}
+		length := int(binary.BigEndian.Uint16(bundle[i:]))
+		i += BundleFrameHeaderLength
+		if length > len(bundle)-i {
+			return &HandlerErr{ErrMalformedPacket, fmt.Sprintf("bundled packet %d has length %d, but only %d bytes remain", n, length, len(bundle)-i)}
+		}
+		if !IsBundleable(bundle[i : i+length]) {
+			return &HandlerErr{ErrMalformedPacket, fmt.Sprintf("bundled packet %d is not a data message", n)}
+		}
+		i += length
+	}
+	if n == 0 {
+		return &HandlerErr{ErrMalformedPacket, "empty bundle"}
+	}
+	return nil
+}
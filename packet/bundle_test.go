@@ -0,0 +1,109 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func testBundledDataPacket(length int, fill byte) []byte {
+	wgPacket := bytes.Repeat([]byte{fill}, length)
+	wgPacket[0] = WireGuardMessageTypeData
+	return wgPacket
+}
+
+func TestBundle(t *testing.T) {
+	wgPackets := [][]byte{
+		testBundledDataPacket(WireGuardMessageLengthKeepalive, 1),
+		testBundledDataPacket(80, 2),
+		testBundledDataPacket(200, 3),
+	}
+
+	// The first packet is bundled in place.
+	const start = 8
+	b := make([]byte, 1024)
+	copy(b[start:], wgPackets[0])
+
+	length := StartBundle(b, start, len(wgPackets[0]))
+	for _, wgPacket := range wgPackets[1:] {
+		length = AppendToBundle(b, start, length, wgPacket)
+	}
+	bundle := b[start : start+length]
+
+	if expectedLength := BundleLength(3, WireGuardMessageLengthKeepalive+80+200); length != expectedLength {
+		t.Errorf("Bundle length = %d, want %d", length, expectedLength)
+	}
+	if !IsBundle(bundle) {
+		t.Error("IsBundle() = false, want true")
+	}
+	if err := CheckWireGuardPacket(bundle); err != nil {
+		t.Fatalf("CheckWireGuardPacket(bundle) = %v", err)
+	}
+
+	got := AppendBundledPackets(nil, bundle)
+	if len(got) != len(wgPackets) {
+		t.Fatalf("AppendBundledPackets() returned %d packets, want %d", len(got), len(wgPackets))
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], wgPackets[i]) {
+			t.Errorf("Bundled packet %d = %v, want %v", i, got[i], wgPackets[i])
+		}
+	}
+}
+
+func TestCheckWireGuardPacketBundle(t *testing.T) {
+	data := testBundledDataPacket(WireGuardMessageLengthKeepalive, 0)
+	handshake := make([]byte, WireGuardMessageLengthHandshakeInitiation)
+	handshake[0] = WireGuardMessageTypeHandshakeInitiation
+
+	newBundle := func(wgPackets ...[]byte) []byte {
+		b := make([]byte, 4096)
+		b[0] = MessageTypeBundle
+		length := BundleHeaderLength
+		for _, wgPacket := range wgPackets {
+			length = AppendToBundle(b, 0, length, wgPacket)
+		}
+		return b[:length]
+	}
+
+	tooMany := make([][]byte, MaxBundlePackets+1)
+	for i := range tooMany {
+		tooMany[i] = data
+	}
+
+	for _, c := range []struct {
+		name   string
+		bundle []byte
+	}{
+		{"Empty", newBundle()},
+		{"Handshake", newBundle(data, handshake)},
+		{"TooMany", newBundle(tooMany...)},
+		{"TruncatedLength", newBundle(data)[:BundleLength(1, len(data))+1]},
+		{"TruncatedPacket", newBundle(data, data)[:BundleLength(2, 2*len(data))-1]},
+		{"Reserved", append([]byte{MessageTypeBundle, 1, 0, 0}, newBundle(data)[BundleHeaderLength:]...)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if err := CheckWireGuardPacket(c.bundle); !errors.Is(err, ErrMalformedPacket) {
+				t.Errorf("Expected ErrMalformedPacket, got %v", err)
+			}
+		})
+	}
+
+	if err := CheckWireGuardPacket(newBundle(tooMany[1:]...)); err != nil {
+		t.Errorf("Bundle of MaxBundlePackets packets: unexpected error: %v", err)
+	}
+}
+
+func TestIsBundleable(t *testing.T) {
+	if !IsBundleable(testBundledDataPacket(WireGuardMessageLengthKeepalive, 0)) {
+		t.Error("IsBundleable(keepalive) = false, want true")
+	}
+	if IsBundleable(testBundledDataPacket(WireGuardMessageLengthKeepalive-1, 0)) {
+		t.Error("IsBundleable(truncated data packet) = true, want false")
+	}
+	handshake := make([]byte, WireGuardMessageLengthHandshakeInitiation)
+	handshake[0] = WireGuardMessageTypeHandshakeInitiation
+	if IsBundleable(handshake) {
+		t.Error("IsBundleable(handshake initiation) = true, want false")
+	}
+}
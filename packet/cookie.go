@@ -0,0 +1,114 @@
+package packet
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+// Cookie messages are proxy-layer control messages exchanged between swgp servers and clients.
+// They are encrypted by packet handlers just like WireGuard packets.
+//
+//	cookieMessage := 1B message type + 3B reserved + 16B cookie + embedded WireGuard packet
+//
+// A server that requires cookies answers a packet from a source without a session with a cookie challenge,
+// which carries no embedded packet, and is no longer than the packet that triggered it. The client echoes
+// the cookie back as a cookie echo with its pending handshake initiation embedded, and the server creates
+// the session and relays the embedded packet.
+const (
+	// MessageTypeCookieChallenge is the message type of a cookie challenge.
+	// It is outside the range of WireGuard message types.
+	MessageTypeCookieChallenge = 0xC0
+
+	// MessageTypeCookieEcho is the message type of a cookie echo.
+	// It is outside the range of WireGuard message types.
+	MessageTypeCookieEcho = 0xC1
+
+	// CookieLength is the length of a cookie.
+	CookieLength = 16
+
+	// CookieMessageHeaderLength is the length of a cookie message without the embedded WireGuard packet.
+	CookieMessageHeaderLength = 4 + CookieLength
+)
+
+// cookieSecretLength is the length of the secret used to generate cookies.
+const cookieSecretLength = 32
+
+// CookieLifetime is how long a cookie stays valid. A cookie is valid for at least
+// CookieLifetime and at most twice that.
+const CookieLifetime = 2 * time.Minute
+
+// IsCookieChallenge returns whether the packet is a cookie challenge.
+func IsCookieChallenge(b []byte) bool {
+	return isCookieMessage(b, MessageTypeCookieChallenge)
+}
+
+// IsCookieEcho returns whether the packet is a cookie echo.
+func IsCookieEcho(b []byte) bool {
+	return isCookieMessage(b, MessageTypeCookieEcho)
+}
+
+func isCookieMessage(b []byte, messageType byte) bool {
+	return len(b) >= CookieMessageHeaderLength && b[0] == messageType && b[1] == 0 && b[2] == 0 && b[3] == 0
+}
+
+// PutCookieMessageHeader writes a cookie message header to b.
+// b must be at least [CookieMessageHeaderLength] bytes long.
+func PutCookieMessageHeader(b []byte, messageType byte, cookie []byte) {
+	_ = b[CookieMessageHeaderLength-1]
+	b[0] = messageType
+	b[1] = 0
+	b[2] = 0
+	b[3] = 0
+	copy(b[4:CookieMessageHeaderLength], cookie)
+}
+
+// CookieFromMessage returns the cookie in the cookie message.
+func CookieFromMessage(b []byte) []byte {
+	return b[4:CookieMessageHeaderLength]
+}
+
+// CookieGenerator generates and verifies stateless cookies bound to source addresses.
+//
+// A cookie is the truncated HMAC-SHA256 of the source address and the current time period,
+// keyed by a random secret.
+//
+// CookieGenerator is safe for concurrent use by multiple goroutines.
+type CookieGenerator struct {
+	secret [cookieSecretLength]byte
+}
+
+// NewCookieGenerator returns a new cookie generator with a random secret.
+func NewCookieGenerator() (*CookieGenerator, error) {
+	var g CookieGenerator
+	if _, err := rand.Read(g.secret[:]); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// Generate returns the cookie for addrPort at time now.
+func (g *CookieGenerator) Generate(addrPort netip.AddrPort, now time.Time) []byte {
+	return g.generate(addrPort, now.Unix()/int64(CookieLifetime/time.Second))
+}
+
+// Verify returns whether cookie is valid for addrPort at time now.
+func (g *CookieGenerator) Verify(addrPort netip.AddrPort, cookie []byte, now time.Time) bool {
+	period := now.Unix() / int64(CookieLifetime/time.Second)
+	return hmac.Equal(cookie, g.generate(addrPort, period)) || hmac.Equal(cookie, g.generate(addrPort, period-1))
+}
+
+func (g *CookieGenerator) generate(addrPort netip.AddrPort, period int64) []byte {
+	var b [8 + 16 + 2]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(period))
+	addr := addrPort.Addr().As16()
+	copy(b[8:24], addr[:])
+	binary.BigEndian.PutUint16(b[24:], addrPort.Port())
+
+	mac := hmac.New(sha256.New, g.secret[:])
+	mac.Write(b[:])
+	return mac.Sum(nil)[:CookieLength]
+}
@@ -0,0 +1,67 @@
+package packet
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestCookieGeneratorVerify(t *testing.T) {
+	g, err := NewCookieGenerator()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrPort := netip.MustParseAddrPort("[2001:db8::1]:20220")
+	otherAddrPort := netip.MustParseAddrPort("[2001:db8::1]:20221")
+	now := time.Now()
+
+	cookie := g.Generate(addrPort, now)
+	if len(cookie) != CookieLength {
+		t.Fatalf("Expected cookie length %d, got %d", CookieLength, len(cookie))
+	}
+
+	if !g.Verify(addrPort, cookie, now) {
+		t.Error("Cookie should be valid for the same address.")
+	}
+	if !g.Verify(addrPort, cookie, now.Add(CookieLifetime)) {
+		t.Error("Cookie should be valid for at least CookieLifetime.")
+	}
+	if g.Verify(addrPort, cookie, now.Add(2*CookieLifetime+time.Second)) {
+		t.Error("Cookie should expire after twice CookieLifetime.")
+	}
+	if g.Verify(otherAddrPort, cookie, now) {
+		t.Error("Cookie should be invalid for a different address.")
+	}
+
+	other, err := NewCookieGenerator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Verify(addrPort, cookie, now) {
+		t.Error("Cookie should be invalid for a different secret.")
+	}
+}
+
+func TestCookieMessageHeader(t *testing.T) {
+	cookie := bytes.Repeat([]byte{0xAA}, CookieLength)
+	b := make([]byte, CookieMessageHeaderLength)
+
+	PutCookieMessageHeader(b, MessageTypeCookieChallenge, cookie)
+	if !IsCookieChallenge(b) || IsCookieEcho(b) {
+		t.Error("Expected a cookie challenge.")
+	}
+	if !bytes.Equal(CookieFromMessage(b), cookie) {
+		t.Error("Cookie mismatch.")
+	}
+
+	PutCookieMessageHeader(b, MessageTypeCookieEcho, cookie)
+	if IsCookieChallenge(b) || !IsCookieEcho(b) {
+		t.Error("Expected a cookie echo.")
+	}
+
+	if IsCookieEcho(b[:CookieMessageHeaderLength-1]) {
+		t.Error("Short packet should not be a cookie message.")
+	}
+}
@@ -0,0 +1,174 @@
+package packet
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/database64128/swgp-go/fastrand"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// TLV types of the extensible header.
+const (
+	// TLVTypeEnd marks the end of the header. It has no length or value.
+	TLVTypeEnd = 0
+
+	// TLVTypePadding carries the u16be length of the padding after the payload.
+	TLVTypePadding = 1
+)
+
+// tlvPaddingLength is the length of a padding TLV, including its type and length bytes.
+const tlvPaddingLength = 1 + 1 + 2
+
+// extensibleHeaderLength is the length of the header written by [extensibleHandler]:
+// a padding TLV followed by the end marker.
+const extensibleHeaderLength = tlvPaddingLength + 1
+
+var ErrTLVHeader = errors.New("malformed TLV header")
+
+// parseExtensibleHeader parses the TLV header at the beginning of b,
+// and returns the header length and the padding length.
+//
+// Each TLV is a 1-byte type, a 1-byte value length, and the value.
+// TLVs of unknown types are skipped, so that newer peers can add types
+// without breaking older ones.
+func parseExtensibleHeader(b []byte) (headerLength, paddingLength int, err error) {
+	for i := 0; i < len(b); {
+		tlvType := b[i]
+		if tlvType == TLVTypeEnd {
+			return i + 1, paddingLength, nil
+		}
+
+		if i+2 > len(b) {
+			return 0, 0, &HandlerErr{ErrTLVHeader, fmt.Sprintf("TLV type %d at offset %d is truncated", tlvType, i)}
+		}
+		valueLength := int(b[i+1])
+		valueStart := i + 2
+		i = valueStart + valueLength
+		if i > len(b) {
+			return 0, 0, &HandlerErr{ErrTLVHeader, fmt.Sprintf("TLV type %d value length %d is out of range", tlvType, valueLength)}
+		}
+
+		switch tlvType {
+		case TLVTypePadding:
+			if valueLength != 2 {
+				return 0, 0, &HandlerErr{ErrTLVHeader, fmt.Sprintf("padding TLV value length %d, expected 2", valueLength)}
+			}
+			paddingLength = int(binary.BigEndian.Uint16(b[valueStart:i]))
+		}
+	}
+	return 0, 0, &HandlerErr{ErrTLVHeader, "missing end of header"}
+}
+
+// extensibleHandler encrypts and decrypts whole packets using an AEAD cipher, like [paranoidHandler],
+// but describes the plaintext with an extensible TLV header instead of a fixed layout.
+//
+//	swgpPacket := 24B nonce + AEAD_Seal(TLV header + payload + padding)
+//	TLV header := *(1B type + 1B value length + value) + 1B end marker
+//
+// Padding follows the same rules as [paranoidHandler].
+//
+// extensibleHandler implements the Handler interface.
+type extensibleHandler struct {
+	aead cipher.AEAD
+}
+
+// NewExtensibleHandler creates an "extensible" handler that
+// uses the given PSK to encrypt and decrypt packets.
+func NewExtensibleHandler(psk []byte) (Handler, error) {
+	aead, err := chacha20poly1305.NewX(psk)
+	if err != nil {
+		return nil, err
+	}
+
+	return &extensibleHandler{
+		aead: aead,
+	}, nil
+}
+
+// Headroom implements the Handler Headroom method.
+func (*extensibleHandler) Headroom() Headroom {
+	return Headroom{
+		Front: chacha20poly1305.NonceSizeX + extensibleHeaderLength,
+		Rear:  chacha20poly1305.Overhead,
+	}
+}
+
+// EncryptZeroCopy implements the Handler EncryptZeroCopy method.
+func (h *extensibleHandler) EncryptZeroCopy(buf []byte, wgPacketStart, wgPacketLength int) (swgpPacketStart, swgpPacketLength int, err error) {
+	// Determine padding length.
+	rearHeadroom := len(buf) - wgPacketStart - wgPacketLength
+	paddingHeadroom := rearHeadroom - chacha20poly1305.Overhead
+	if wgPacket := buf[wgPacketStart : wgPacketStart+wgPacketLength]; paddingHeadroom > paranoidKeepalivePaddingMaxLength &&
+		(IsWireGuardKeepalive(wgPacket) || IsCookieChallenge(wgPacket)) {
+		paddingHeadroom = paranoidKeepalivePaddingMaxLength
+	}
+	if paddingHeadroom > math.MaxUint16 {
+		paddingHeadroom = math.MaxUint16
+	}
+	var paddingLen int
+	if paddingHeadroom > 0 {
+		paddingLen = 1 + int(fastrand.Uint32n(uint32(paddingHeadroom)))
+	}
+
+	// Calculate offsets.
+	headerStart := wgPacketStart - extensibleHeaderLength
+	swgpPacketStart = headerStart - chacha20poly1305.NonceSizeX
+	swgpPacketLength = chacha20poly1305.NonceSizeX + extensibleHeaderLength + wgPacketLength + paddingLen + chacha20poly1305.Overhead
+
+	nonce := buf[swgpPacketStart:headerStart]
+	header := buf[headerStart:wgPacketStart]
+	plaintext := buf[headerStart : wgPacketStart+wgPacketLength+paddingLen]
+
+	// Write random nonce.
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return
+	}
+
+	// Write header.
+	header[0] = TLVTypePadding
+	header[1] = 2
+	binary.BigEndian.PutUint16(header[2:tlvPaddingLength], uint16(paddingLen))
+	header[tlvPaddingLength] = TLVTypeEnd
+
+	// AEAD seal.
+	h.aead.Seal(nonce, nonce, plaintext, nil)
+
+	return
+}
+
+// DecryptZeroCopy implements the Handler DecryptZeroCopy method.
+func (h *extensibleHandler) DecryptZeroCopy(buf []byte, swgpPacketStart, swgpPacketLength int) (wgPacketStart, wgPacketLength int, err error) {
+	if swgpPacketLength < chacha20poly1305.NonceSizeX+1+chacha20poly1305.Overhead {
+		err = &HandlerErr{ErrPacketSize, fmt.Sprintf("swgp packet (length %d) is too short", swgpPacketLength)}
+		return
+	}
+
+	nonce := buf[swgpPacketStart : swgpPacketStart+chacha20poly1305.NonceSizeX]
+	ciphertext := buf[swgpPacketStart+chacha20poly1305.NonceSizeX : swgpPacketStart+swgpPacketLength]
+
+	// AEAD open.
+	plaintext, err := h.aead.Open(ciphertext[:0], nonce, ciphertext, nil)
+	if err != nil {
+		return
+	}
+
+	// Parse header and strip padding.
+	headerLength, paddingLength, err := parseExtensibleHeader(plaintext)
+	if err != nil {
+		return
+	}
+	if paddingLength > len(plaintext)-headerLength {
+		err = &HandlerErr{ErrPayloadLength, fmt.Sprintf("padding length %d is out of range", paddingLength)}
+		return
+	}
+
+	wgPacketStart = swgpPacketStart + chacha20poly1305.NonceSizeX + headerLength
+	wgPacketLength = len(plaintext) - headerLength - paddingLength
+	return
+}
@@ -0,0 +1,122 @@
+package packet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func testNewExtensibleHandler(t *testing.T) Handler {
+	psk := make([]byte, 32)
+	_, err := rand.Read(psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := NewExtensibleHandler(psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func testExtensibleVerifyPacket(t *testing.T, wgPacket, swgpPacket, decryptedWgPacket []byte) {
+	if len(swgpPacket) < chacha20poly1305.NonceSizeX+extensibleHeaderLength+len(wgPacket)+chacha20poly1305.Overhead {
+		t.Error("Bad swgpPacket length.")
+	}
+
+	if !bytes.Equal(wgPacket, decryptedWgPacket) {
+		t.Error("Decrypted packet is different from original packet.")
+	}
+}
+
+func TestExtensibleHandlePacket(t *testing.T) {
+	h := testNewExtensibleHandler(t)
+
+	for i := 1; i < 128; i++ {
+		testHandler(t, WireGuardMessageTypeHandshakeInitiation, i, 0, 0, h, nil, nil, testExtensibleVerifyPacket)
+		testHandler(t, WireGuardMessageTypeHandshakeResponse, i, 0, 0, h, nil, nil, testExtensibleVerifyPacket)
+		testHandler(t, WireGuardMessageTypeHandshakeCookieReply, i, 0, 0, h, nil, nil, testExtensibleVerifyPacket)
+		testHandler(t, WireGuardMessageTypeData, i, 0, 0, h, nil, nil, testExtensibleVerifyPacket)
+		testHandler(t, WireGuardMessageTypeData, i, 0, 256, h, nil, nil, testExtensibleVerifyPacket)
+	}
+}
+
+func TestExtensibleHandleKeepalivePacket(t *testing.T) {
+	h := testNewExtensibleHandler(t)
+
+	verifyFunc := func(t *testing.T, wgPacket, swgpPacket, decryptedWgPacket []byte) {
+		testExtensibleVerifyPacket(t, wgPacket, swgpPacket, decryptedWgPacket)
+
+		maxLength := chacha20poly1305.NonceSizeX + extensibleHeaderLength + WireGuardMessageLengthKeepalive + paranoidKeepalivePaddingMaxLength + chacha20poly1305.Overhead
+		if len(swgpPacket) > maxLength {
+			t.Errorf("Keepalive swgpPacket length %d exceeds %d", len(swgpPacket), maxLength)
+		}
+	}
+
+	for i := 0; i < 128; i++ {
+		testHandler(t, WireGuardMessageTypeData, WireGuardMessageLengthKeepalive, 0, 1400, h, nil, nil, verifyFunc)
+	}
+}
+
+func TestExtensibleSkipsUnknownTLV(t *testing.T) {
+	h := testNewExtensibleHandler(t)
+	aead := h.(*extensibleHandler).aead
+
+	wgPacket := []byte{WireGuardMessageTypeData, 1, 2, 3}
+	padding := []byte{0, 0, 0}
+
+	// A newer peer may send TLV types this version does not know about.
+	var plaintext []byte
+	plaintext = append(plaintext, 0xfe, 3, 'n', 'e', 'w')
+	plaintext = append(plaintext, TLVTypePadding, 2, 0, byte(len(padding)))
+	plaintext = append(plaintext, TLVTypeEnd)
+	plaintext = append(plaintext, wgPacket...)
+	plaintext = append(plaintext, padding...)
+
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	buf := aead.Seal(nonce, nonce, plaintext, nil)
+
+	wgPacketStart, wgPacketLength, err := h.DecryptZeroCopy(buf, 0, len(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := buf[wgPacketStart : wgPacketStart+wgPacketLength]; !bytes.Equal(got, wgPacket) {
+		t.Errorf("Decrypted packet %v, expected %v", got, wgPacket)
+	}
+}
+
+func TestParseExtensibleHeader(t *testing.T) {
+	for _, c := range []struct {
+		name                  string
+		header                []byte
+		expectedHeaderLength  int
+		expectedPaddingLength int
+		expectedErr           error
+	}{
+		{"EndOnly", []byte{TLVTypeEnd}, 1, 0, nil},
+		{"Padding", []byte{TLVTypePadding, 2, 1, 0, TLVTypeEnd}, 5, 256, nil},
+		{"UnknownThenPadding", []byte{0x80, 0, TLVTypePadding, 2, 0, 7, TLVTypeEnd, 0xff}, 7, 7, nil},
+		{"Empty", nil, 0, 0, ErrTLVHeader},
+		{"MissingEnd", []byte{0x80, 1, 0}, 0, 0, ErrTLVHeader},
+		{"TruncatedLength", []byte{0x80}, 0, 0, ErrTLVHeader},
+		{"TruncatedValue", []byte{0x80, 4, 0}, 0, 0, ErrTLVHeader},
+		{"BadPaddingLength", []byte{TLVTypePadding, 1, 0, TLVTypeEnd}, 0, 0, ErrTLVHeader},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			headerLength, paddingLength, err := parseExtensibleHeader(c.header)
+			if !errors.Is(err, c.expectedErr) {
+				t.Fatalf("Expected error %v, got %v", c.expectedErr, err)
+			}
+			if headerLength != c.expectedHeaderLength || paddingLength != c.expectedPaddingLength {
+				t.Errorf("Got header length %d and padding length %d, expected %d and %d", headerLength, paddingLength, c.expectedHeaderLength, c.expectedPaddingLength)
+			}
+		})
+	}
+}
@@ -1,7 +1,10 @@
 // Package packet contains types and methods that transform WireGuard packets.
 package packet
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 const (
 	WireGuardMessageTypeHandshakeInitiation  = 1
@@ -12,13 +15,85 @@ const (
 	WireGuardMessageLengthHandshakeInitiation  = 148
 	WireGuardMessageLengthHandshakeResponse    = 92
 	WireGuardMessageLengthHandshakeCookieReply = 64
+
+	// WireGuardMessageLengthKeepalive is the length of a keepalive message,
+	// which is a data message with an empty payload.
+	WireGuardMessageLengthKeepalive = 32
+
+	// WireGuardMessageLengthDataMin is the minimum length of a data message.
+	WireGuardMessageLengthDataMin = WireGuardMessageLengthKeepalive
 )
 
+// IsWireGuardKeepalive returns whether the WireGuard packet is a keepalive message.
+func IsWireGuardKeepalive(wgPacket []byte) bool {
+	return len(wgPacket) == WireGuardMessageLengthKeepalive && wgPacket[0] == WireGuardMessageTypeData
+}
+
 var (
-	ErrPacketSize    = errors.New("packet is too big or too small to be processed")
-	ErrPayloadLength = errors.New("payload length field value is out of range")
+	ErrPacketSize      = errors.New("packet is too big or too small to be processed")
+	ErrPayloadLength   = errors.New("payload length field value is out of range")
+	ErrMalformedPacket = errors.New("packet length does not match its message type")
 )
 
+// CheckWireGuardPacket checks the length of a decrypted WireGuard packet against its message type.
+//
+// Handshake messages must have their exact lengths, and data messages must not be shorter than
+// [WireGuardMessageLengthDataMin]. Cookie messages must have a complete header, and the embedded
+// WireGuard packet, if any, is checked in turn. MTU probes must have a complete header, and MTU probe
+// acks must have their exact length. Bundles must carry only complete data messages.
+// Packets of unknown message types are not checked.
+func CheckWireGuardPacket(wgPacket []byte) error {
+	if len(wgPacket) == 0 {
+		return &HandlerErr{ErrMalformedPacket, "empty packet"}
+	}
+
+	var expectedLength int
+
+	switch wgPacket[0] {
+	case WireGuardMessageTypeHandshakeInitiation:
+		expectedLength = WireGuardMessageLengthHandshakeInitiation
+	case WireGuardMessageTypeHandshakeResponse:
+		expectedLength = WireGuardMessageLengthHandshakeResponse
+	case WireGuardMessageTypeHandshakeCookieReply:
+		expectedLength = WireGuardMessageLengthHandshakeCookieReply
+	case WireGuardMessageTypeData:
+		if len(wgPacket) < WireGuardMessageLengthDataMin {
+			return &HandlerErr{ErrMalformedPacket, fmt.Sprintf("data message too short: %d", len(wgPacket))}
+		}
+		return nil
+	case MessageTypeCookieChallenge, MessageTypeCookieEcho:
+		if len(wgPacket) < CookieMessageHeaderLength {
+			return &HandlerErr{ErrMalformedPacket, fmt.Sprintf("cookie message too short: %d", len(wgPacket))}
+		}
+		if len(wgPacket) == CookieMessageHeaderLength {
+			return nil
+		}
+		return CheckWireGuardPacket(wgPacket[CookieMessageHeaderLength:])
+	case MessageTypeMTUProbe:
+		if len(wgPacket) < MTUProbeHeaderLength {
+			return &HandlerErr{ErrMalformedPacket, fmt.Sprintf("MTU probe too short: %d", len(wgPacket))}
+		}
+		return nil
+	case MessageTypeMTUProbeAck:
+		if len(wgPacket) != MTUProbeAckLength {
+			return &HandlerErr{ErrMalformedPacket, fmt.Sprintf("MTU probe ack has length %d, expected %d", len(wgPacket), MTUProbeAckLength)}
+		}
+		return nil
+	case MessageTypeBundle:
+		if !IsBundle(wgPacket) {
+			return &HandlerErr{ErrMalformedPacket, "malformed bundle header"}
+		}
+		return checkBundle(wgPacket)
+	default:
+		return nil
+	}
+
+	if len(wgPacket) != expectedLength {
+		return &HandlerErr{ErrMalformedPacket, fmt.Sprintf("handshake message type %d has length %d, expected %d", wgPacket[0], len(wgPacket), expectedLength)}
+	}
+	return nil
+}
+
 // Headroom reports the amount of extra space required in read/write buffers besides the payload.
 type Headroom struct {
 	// Front is the minimum space required at the beginning of the buffer before payload.
@@ -55,3 +55,66 @@ func testHandler(
 
 	verifyFunc(t, wgPacket, swgpPacket, decryptedWgPacket)
 }
+
+func TestCheckWireGuardPacket(t *testing.T) {
+	for _, c := range []struct {
+		msgType byte
+		length  int
+	}{
+		{WireGuardMessageTypeHandshakeInitiation, WireGuardMessageLengthHandshakeInitiation},
+		{WireGuardMessageTypeHandshakeResponse, WireGuardMessageLengthHandshakeResponse},
+		{WireGuardMessageTypeHandshakeCookieReply, WireGuardMessageLengthHandshakeCookieReply},
+	} {
+		b := make([]byte, c.length+1)
+		b[0] = c.msgType
+
+		if err := CheckWireGuardPacket(b[:c.length]); err != nil {
+			t.Errorf("Message type %d of length %d: unexpected error: %v", c.msgType, c.length, err)
+		}
+		for _, n := range []int{1, 16, c.length - 1, c.length + 1} {
+			if err := CheckWireGuardPacket(b[:n]); !errors.Is(err, ErrMalformedPacket) {
+				t.Errorf("Message type %d of length %d: expected ErrMalformedPacket, got %v", c.msgType, n, err)
+			}
+		}
+	}
+
+	data := make([]byte, 128)
+	data[0] = WireGuardMessageTypeData
+	for n := 1; n < WireGuardMessageLengthDataMin; n++ {
+		if err := CheckWireGuardPacket(data[:n]); !errors.Is(err, ErrMalformedPacket) {
+			t.Errorf("Data message of length %d: expected ErrMalformedPacket, got %v", n, err)
+		}
+	}
+	for n := WireGuardMessageLengthDataMin; n <= len(data); n++ {
+		if err := CheckWireGuardPacket(data[:n]); err != nil {
+			t.Errorf("Data message of length %d: unexpected error: %v", n, err)
+		}
+	}
+
+	if err := CheckWireGuardPacket(nil); !errors.Is(err, ErrMalformedPacket) {
+		t.Errorf("Empty packet: expected ErrMalformedPacket, got %v", err)
+	}
+
+	if err := CheckWireGuardPacket([]byte{0xFF}); err != nil {
+		t.Errorf("Unknown message type: unexpected error: %v", err)
+	}
+}
+
+func TestCheckWireGuardPacketCookieMessage(t *testing.T) {
+	b := make([]byte, CookieMessageHeaderLength+WireGuardMessageLengthHandshakeInitiation)
+	PutCookieMessageHeader(b, MessageTypeCookieEcho, make([]byte, CookieLength))
+	b[CookieMessageHeaderLength] = WireGuardMessageTypeHandshakeInitiation
+
+	if err := CheckWireGuardPacket(b[:CookieMessageHeaderLength]); err != nil {
+		t.Errorf("Cookie echo without embedded packet: unexpected error: %v", err)
+	}
+	if err := CheckWireGuardPacket(b); err != nil {
+		t.Errorf("Cookie echo with handshake initiation: unexpected error: %v", err)
+	}
+	if err := CheckWireGuardPacket(b[:CookieMessageHeaderLength-1]); !errors.Is(err, ErrMalformedPacket) {
+		t.Errorf("Truncated cookie echo header: expected ErrMalformedPacket, got %v", err)
+	}
+	if err := CheckWireGuardPacket(b[:len(b)-1]); !errors.Is(err, ErrMalformedPacket) {
+		t.Errorf("Cookie echo with truncated handshake initiation: expected ErrMalformedPacket, got %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func testNewIntegrityHandler(t *testing.T, psk []byte) Handler {
+	t.Helper()
+	h, err := NewIntegrityHandler(psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func testIntegrityVerifyPacket(t *testing.T, wgPacket, swgpPacket, decryptedWgPacket []byte) {
+	if len(swgpPacket) != len(wgPacket)+integrityTagLength {
+		t.Errorf("Expected swgpPacket length %d, got %d", len(wgPacket)+integrityTagLength, len(swgpPacket))
+	}
+
+	if !bytes.Equal(wgPacket, swgpPacket[:len(wgPacket)]) {
+		t.Error("The payload should not be encrypted.")
+	}
+
+	if !bytes.Equal(wgPacket, decryptedWgPacket) {
+		t.Error("Decrypted packet is different from original packet.")
+	}
+}
+
+func TestIntegrityHandlePacket(t *testing.T) {
+	h := testNewIntegrityHandler(t, testGeneratePSK(t))
+
+	for i := 1; i < 128; i++ {
+		testHandler(t, WireGuardMessageTypeHandshakeInitiation, i, 0, 0, h, nil, nil, testIntegrityVerifyPacket)
+		testHandler(t, WireGuardMessageTypeData, i, 0, 0, h, nil, nil, testIntegrityVerifyPacket)
+	}
+}
+
+func TestIntegrityRejectsTamperedPackets(t *testing.T) {
+	psk := testGeneratePSK(t)
+	h := testNewIntegrityHandler(t, psk)
+
+	wgPacket := make([]byte, WireGuardMessageLengthHandshakeInitiation)
+	wgPacket[0] = WireGuardMessageTypeHandshakeInitiation
+	swgpPacket := testEncrypt(t, h, wgPacket)
+
+	for i := range swgpPacket {
+		tampered := append([]byte(nil), swgpPacket...)
+		tampered[i] ^= 1
+		if _, err := testDecrypt(h, tampered); !errors.Is(err, ErrPacketAuthentication) {
+			t.Fatalf("Expected packet with byte %d flipped to fail authentication, got %v", i, err)
+		}
+	}
+
+	if _, err := testDecrypt(h, swgpPacket[:len(swgpPacket)-1]); !errors.Is(err, ErrPacketAuthentication) {
+		t.Errorf("Expected truncated packet to fail authentication, got %v", err)
+	}
+	if _, err := testDecrypt(h, swgpPacket[:integrityTagLength]); !errors.Is(err, ErrPacketSize) {
+		t.Errorf("Expected packet without payload to be rejected, got %v", err)
+	}
+	if _, err := testDecrypt(testNewIntegrityHandler(t, testGeneratePSK(t)), swgpPacket); !errors.Is(err, ErrPacketAuthentication) {
+		t.Errorf("Expected packet to fail authentication under another PSK, got %v", err)
+	}
+
+	// A packet of another mode under the same PSK does not authenticate.
+	paranoid := testNewParanoidSessionHandler(t, psk)
+	if _, err := testDecrypt(h, testEncrypt(t, paranoid, wgPacket)); !errors.Is(err, ErrPacketAuthentication) {
+		t.Errorf("Expected paranoid packet to fail authentication, got %v", err)
+	}
+}
+
+func TestIntegrityHandlerAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("The race detector drops sync.Pool items, so the MAC pool reallocates.")
+	}
+
+	h := testNewIntegrityHandler(t, testGeneratePSK(t))
+	headroom := h.Headroom()
+	buf := make([]byte, headroom.Front+WireGuardMessageLengthHandshakeInitiation+headroom.Rear)
+	buf[headroom.Front] = WireGuardMessageTypeHandshakeInitiation
+
+	allocs := testing.AllocsPerRun(100, func() {
+		swgpPacketStart, swgpPacketLength, err := h.EncryptZeroCopy(buf, headroom.Front, WireGuardMessageLengthHandshakeInitiation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = h.DecryptZeroCopy(buf, swgpPacketStart, swgpPacketLength); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations per packet, got %v", allocs)
+	}
+}
+
+func TestNewIntegrityHandlerBadPSK(t *testing.T) {
+	if _, err := NewIntegrityHandler(make([]byte, 16)); err == nil {
+		t.Error("Expected PSK of the wrong length to be rejected.")
+	}
+}
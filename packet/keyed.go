@@ -0,0 +1,151 @@
+package packet
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+const (
+	// keyIDLength is the length of the key identifier prepended by [keyedHandler].
+	keyIDLength = 1
+
+	// KeyIDMaskKeySize is the size of the mask key of [NewKeyedHandler].
+	KeyIDMaskKeySize = 32
+
+	// keyIDMaskInputLength is the length of the tail of the inner swgp packet the key ID mask is derived from.
+	// Shorter packets, which are not valid WireGuard messages, are zero-padded.
+	keyIDMaskInputLength = 16
+)
+
+var ErrUnknownKeyID = errors.New("unknown key ID")
+
+// KeyedHandler is a [Handler] that holds many keys, each identified by a 1-byte key ID.
+// Every packet carries the ID of the key it is encrypted with, so the receiver
+// picks the key right away instead of trying each one.
+type KeyedHandler interface {
+	Handler
+
+	// KeyID returns the key ID carried by the swgp packet.
+	KeyID(swgpPacket []byte) (byte, error)
+
+	// WithKeyID returns a handler that encrypts packets with the key of keyID,
+	// and decrypts packets like the keyed handler. It returns nil if there is no such key.
+	WithKeyID(keyID byte) Handler
+}
+
+// keyedHandler prepends the key ID to packets encrypted by the handler of the key.
+//
+//	mask := SHA-256(maskKey + innerSwgpPacket[len-16:])[0]
+//	swgpPacket := (key ID XOR mask) + innerSwgpPacket
+//
+// The mask is derived with a keyed PRF from the last 16 bytes of the inner packet, which are ciphertext,
+// an AEAD tag, or a random nonce, and unique per packet. Without the mask key, the masked key ID is
+// indistinguishable from a random byte, and unlike a mask taken from the packet itself, it cannot be
+// combined with any byte on the wire into a stable per-key fingerprint. The input to SHA-256 has a fixed length,
+// so the keyed hash is a PRF without the extra pass of HMAC.
+//
+// keyedHandler implements the KeyedHandler interface.
+type keyedHandler struct {
+	handlers *[256]Handler
+	maskKey  [KeyIDMaskKeySize]byte
+	keyID    byte
+	headroom Headroom
+}
+
+// NewKeyedHandler returns a keyed handler that encrypts packets with the handler of keyID,
+// and decrypts packets with the handler of the key ID they carry. Key IDs are masked with maskKey,
+// a [KeyIDMaskKeySize]-byte key shared by all keys of the server.
+// All handlers must be of the same mode.
+func NewKeyedHandler(handlers map[byte]Handler, maskKey []byte, keyID byte) (KeyedHandler, error) {
+	if handlers[keyID] == nil {
+		return nil, fmt.Errorf("no handler for key ID %d", keyID)
+	}
+	if len(maskKey) != KeyIDMaskKeySize {
+		return nil, fmt.Errorf("key ID mask key must be %d bytes, got %d", KeyIDMaskKeySize, len(maskKey))
+	}
+
+	var h keyedHandler
+	copy(h.maskKey[:], maskKey)
+	h.handlers = new([256]Handler)
+	for id, handler := range handlers {
+		h.handlers[id] = handler
+		headroom := handler.Headroom()
+		if h.headroom.Front < headroom.Front {
+			h.headroom.Front = headroom.Front
+		}
+		if h.headroom.Rear < headroom.Rear {
+			h.headroom.Rear = headroom.Rear
+		}
+	}
+	h.headroom.Front += keyIDLength
+	h.keyID = keyID
+	return &h, nil
+}
+
+// Headroom implements the Handler Headroom method.
+func (h *keyedHandler) Headroom() Headroom {
+	return h.headroom
+}
+
+// KeyID implements the KeyedHandler KeyID method.
+func (h *keyedHandler) KeyID(swgpPacket []byte) (byte, error) {
+	if len(swgpPacket) < keyIDLength+1 {
+		return 0, &HandlerErr{ErrPacketSize, fmt.Sprintf("swgp packet (length %d) is too short", len(swgpPacket))}
+	}
+	return swgpPacket[0] ^ h.keyIDMask(swgpPacket[keyIDLength:]), nil
+}
+
+// keyIDMask returns the mask of the key ID of the inner swgp packet.
+func (h *keyedHandler) keyIDMask(innerSwgpPacket []byte) byte {
+	var input [KeyIDMaskKeySize + keyIDMaskInputLength]byte
+	copy(input[:], h.maskKey[:])
+	if len(innerSwgpPacket) > keyIDMaskInputLength {
+		innerSwgpPacket = innerSwgpPacket[len(innerSwgpPacket)-keyIDMaskInputLength:]
+	}
+	copy(input[KeyIDMaskKeySize:], innerSwgpPacket)
+	sum := sha256.Sum256(input[:])
+	return sum[0]
+}
+
+// WithKeyID implements the KeyedHandler WithKeyID method.
+func (h *keyedHandler) WithKeyID(keyID byte) Handler {
+	if h.handlers[keyID] == nil {
+		return nil
+	}
+	hc := *h
+	hc.keyID = keyID
+	return &hc
+}
+
+// EncryptZeroCopy implements the Handler EncryptZeroCopy method.
+func (h *keyedHandler) EncryptZeroCopy(buf []byte, wgPacketStart, wgPacketLength int) (swgpPacketStart, swgpPacketLength int, err error) {
+	swgpPacketStart, swgpPacketLength, err = h.handlers[h.keyID].EncryptZeroCopy(buf, wgPacketStart, wgPacketLength)
+	if err != nil {
+		return
+	}
+	if swgpPacketStart < keyIDLength {
+		err = &HandlerErr{ErrPacketSize, fmt.Sprintf("no room for key ID before swgp packet at %d", swgpPacketStart)}
+		return
+	}
+
+	mask := h.keyIDMask(buf[swgpPacketStart : swgpPacketStart+swgpPacketLength])
+	swgpPacketStart -= keyIDLength
+	swgpPacketLength += keyIDLength
+	buf[swgpPacketStart] = h.keyID ^ mask
+	return
+}
+
+// DecryptZeroCopy implements the Handler DecryptZeroCopy method.
+func (h *keyedHandler) DecryptZeroCopy(buf []byte, swgpPacketStart, swgpPacketLength int) (wgPacketStart, wgPacketLength int, err error) {
+	keyID, err := h.KeyID(buf[swgpPacketStart : swgpPacketStart+swgpPacketLength])
+	if err != nil {
+		return
+	}
+	handler := h.handlers[keyID]
+	if handler == nil {
+		err = &HandlerErr{ErrUnknownKeyID, fmt.Sprintf("unknown key ID %d", keyID)}
+		return
+	}
+	return handler.DecryptZeroCopy(buf, swgpPacketStart+keyIDLength, swgpPacketLength-keyIDLength)
+}
@@ -0,0 +1,175 @@
+package packet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func testNewKeyedHandler(t *testing.T, keyIDs ...byte) KeyedHandler {
+	handlers := make(map[byte]Handler, len(keyIDs))
+	for _, keyID := range keyIDs {
+		handlers[keyID] = testNewZeroOverheadHandler(t)
+	}
+	h, err := NewKeyedHandler(handlers, testKeyIDMaskKey, keyIDs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// testKeyIDMaskKey is the key ID mask key of keyed handlers in tests.
+var testKeyIDMaskKey = bytes.Repeat([]byte{0x5a}, KeyIDMaskKeySize)
+
+func testKeyedVerifyPacket(t *testing.T, wgPacket, swgpPacket, decryptedWgPacket []byte) {
+	if len(swgpPacket) < keyIDLength+len(wgPacket) {
+		t.Error("Bad swgpPacket length.")
+	}
+
+	if !bytes.Equal(wgPacket, decryptedWgPacket) {
+		t.Error("Decrypted packet is different from original packet.")
+	}
+}
+
+func TestKeyedHandlePacket(t *testing.T) {
+	h := testNewKeyedHandler(t, 7, 42)
+
+	for i := 1; i < 128; i++ {
+		testHandler(t, WireGuardMessageTypeHandshakeInitiation, i, 0, zeroOverheadHandshakePacketMinimumOverhead, h, nil, nil, testKeyedVerifyPacket)
+		testHandler(t, WireGuardMessageTypeHandshakeResponse, i, 0, zeroOverheadHandshakePacketMinimumOverhead, h, nil, nil, testKeyedVerifyPacket)
+		testHandler(t, WireGuardMessageTypeHandshakeCookieReply, i, 0, zeroOverheadHandshakePacketMinimumOverhead, h, nil, nil, testKeyedVerifyPacket)
+		testHandler(t, WireGuardMessageTypeData, i, 0, 0, h, nil, nil, testKeyedVerifyPacket)
+		testHandler(t, WireGuardMessageTypeData, i, 0, 256, h, nil, nil, testKeyedVerifyPacket)
+	}
+}
+
+func TestKeyedHandlerSelectsKey(t *testing.T) {
+	server := testNewKeyedHandler(t, 1, 2, 3)
+	headroom := server.Headroom()
+
+	for _, keyID := range []byte{1, 2, 3} {
+		client := server.WithKeyID(keyID)
+		if client == nil {
+			t.Fatalf("WithKeyID(%d) returned nil", keyID)
+		}
+
+		buf := make([]byte, headroom.Front+WireGuardMessageLengthKeepalive+headroom.Rear)
+		if _, err := rand.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		buf[headroom.Front] = WireGuardMessageTypeData
+		wgPacket := append([]byte(nil), buf[headroom.Front:headroom.Front+WireGuardMessageLengthKeepalive]...)
+
+		swgpPacketStart, swgpPacketLength, err := client.EncryptZeroCopy(buf, headroom.Front, WireGuardMessageLengthKeepalive)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gotKeyID, err := server.KeyID(buf[swgpPacketStart : swgpPacketStart+swgpPacketLength])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotKeyID != keyID {
+			t.Errorf("KeyID() = %d, expected %d", gotKeyID, keyID)
+		}
+
+		wgPacketStart, wgPacketLength, err := server.DecryptZeroCopy(buf, swgpPacketStart, swgpPacketLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[wgPacketStart:wgPacketStart+wgPacketLength], wgPacket) {
+			t.Error("Decrypted packet is different from original packet.")
+		}
+	}
+
+	if server.WithKeyID(4) != nil {
+		t.Error("Expected WithKeyID to return nil for unknown key ID")
+	}
+}
+
+func TestKeyedHandlerUnknownKeyID(t *testing.T) {
+	client := testNewKeyedHandler(t, 9)
+	server := testNewKeyedHandler(t, 1)
+
+	testHandler(t, WireGuardMessageTypeData, WireGuardMessageLengthKeepalive, 0, 0, client, nil, nil, testKeyedVerifyPacket)
+
+	headroom := client.Headroom()
+	buf := make([]byte, headroom.Front+WireGuardMessageLengthKeepalive+headroom.Rear)
+	buf[headroom.Front] = WireGuardMessageTypeData
+	swgpPacketStart, swgpPacketLength, err := client.EncryptZeroCopy(buf, headroom.Front, WireGuardMessageLengthKeepalive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = server.DecryptZeroCopy(buf, swgpPacketStart, swgpPacketLength); !errors.Is(err, ErrUnknownKeyID) {
+		t.Errorf("Expected error %v, got %v", ErrUnknownKeyID, err)
+	}
+}
+
+func TestKeyedHandlerMasksKeyID(t *testing.T) {
+	h := testNewKeyedHandler(t, 5)
+	headroom := h.Headroom()
+
+	// An observer without the mask key sees the masked key ID and the rest of the packet.
+	// No byte of the packet may unmask the key ID, so the masked key ID XOR any byte
+	// must not be constant across packets of the same key.
+	const packets = 64
+	const wgPacketLength = WireGuardMessageLengthKeepalive
+	var xors [keyIDLength + wgPacketLength]map[byte]struct{}
+	for i := range xors {
+		xors[i] = make(map[byte]struct{})
+	}
+
+	for i := 0; i < packets; i++ {
+		buf := make([]byte, headroom.Front+wgPacketLength+headroom.Rear)
+		if _, err := rand.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		buf[headroom.Front] = WireGuardMessageTypeData
+
+		swgpPacketStart, swgpPacketLength, err := h.EncryptZeroCopy(buf, headroom.Front, wgPacketLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+		swgpPacket := buf[swgpPacketStart : swgpPacketStart+swgpPacketLength]
+		for j := range xors {
+			xors[j][swgpPacket[0]^swgpPacket[j]] = struct{}{}
+		}
+
+		keyID, err := h.KeyID(swgpPacket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keyID != 5 {
+			t.Fatalf("KeyID() = %d, expected 5", keyID)
+		}
+	}
+
+	for j := 1; j < len(xors); j++ {
+		if len(xors[j]) < 2 {
+			t.Errorf("Masked key ID XOR byte %d is constant across packets", j)
+		}
+	}
+}
+
+func TestKeyedHandlerKeyIDNoAlloc(t *testing.T) {
+	h := testNewKeyedHandler(t, 5)
+	swgpPacket := make([]byte, keyIDLength+WireGuardMessageLengthKeepalive)
+	if allocs := testing.AllocsPerRun(100, func() {
+		_, _ = h.KeyID(swgpPacket)
+	}); allocs != 0 {
+		t.Errorf("KeyID allocates %v times, expected 0", allocs)
+	}
+}
+
+func TestNewKeyedHandlerMissingKeyID(t *testing.T) {
+	if _, err := NewKeyedHandler(map[byte]Handler{1: NewPassthroughHandler()}, testKeyIDMaskKey, 2); err == nil {
+		t.Error("Expected error for missing encryption key ID")
+	}
+}
+
+func TestNewKeyedHandlerMaskKeySize(t *testing.T) {
+	if _, err := NewKeyedHandler(map[byte]Handler{1: NewPassthroughHandler()}, testKeyIDMaskKey[:16], 1); err == nil {
+		t.Error("Expected error for short key ID mask key")
+	}
+}
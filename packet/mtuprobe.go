@@ -0,0 +1,84 @@
+package packet
+
+import (
+	"encoding/binary"
+
+	"github.com/database64128/swgp-go/fastrand"
+)
+
+// MTU probe messages are proxy-layer control messages exchanged between swgp clients and servers.
+// Like cookie messages, they are encrypted by packet handlers just like WireGuard packets.
+//
+//	mtuProbe    := 1B message type + 3B reserved + 4B probe ID + random padding
+//	mtuProbeAck := 1B message type + 3B reserved + 4B probe ID + 2B swgp packet length of the probe + 6B reserved
+//
+// A client measuring the path MTU to its server sends probes padded to the packet sizes under test,
+// with the don't-fragment bit set. The server answers each probe that gets through with an ack.
+// Acks are much smaller than probes, so they cannot be used for amplification. An ack is one block long,
+// so that the zero-overhead mode encrypts all of it.
+const (
+	// MessageTypeMTUProbe is the message type of an MTU probe.
+	// It is outside the range of WireGuard message types.
+	MessageTypeMTUProbe = 0xC2
+
+	// MessageTypeMTUProbeAck is the message type of an MTU probe ack.
+	// It is outside the range of WireGuard message types.
+	MessageTypeMTUProbeAck = 0xC3
+
+	// MTUProbeHeaderLength is the length of an MTU probe without padding.
+	MTUProbeHeaderLength = 4 + 4
+
+	// MTUProbeAckLength is the length of an MTU probe ack.
+	MTUProbeAckLength = 16
+)
+
+// IsMTUProbe returns whether the packet is an MTU probe.
+func IsMTUProbe(b []byte) bool {
+	return len(b) >= MTUProbeHeaderLength && b[0] == MessageTypeMTUProbe && b[1] == 0 && b[2] == 0 && b[3] == 0
+}
+
+// IsMTUProbeAck returns whether the packet is an MTU probe ack.
+func IsMTUProbeAck(b []byte) bool {
+	return len(b) == MTUProbeAckLength && b[0] == MessageTypeMTUProbeAck && b[1] == 0 && b[2] == 0 && b[3] == 0
+}
+
+// PutMTUProbe writes an MTU probe with probeID to b, padded with random bytes to the length of b.
+// b must be at least [MTUProbeHeaderLength] bytes long.
+func PutMTUProbe(b []byte, probeID uint32) {
+	_ = b[MTUProbeHeaderLength-1]
+	b[0] = MessageTypeMTUProbe
+	b[1] = 0
+	b[2] = 0
+	b[3] = 0
+	binary.BigEndian.PutUint32(b[4:MTUProbeHeaderLength], probeID)
+	padding := b[MTUProbeHeaderLength:]
+	for i := range padding {
+		padding[i] = byte(fastrand.Uint32())
+	}
+}
+
+// PutMTUProbeAck writes the ack of the MTU probe with probeID, received in a swgp packet of probeLength bytes, to b.
+// b must be at least [MTUProbeAckLength] bytes long.
+func PutMTUProbeAck(b []byte, probeID uint32, probeLength int) {
+	_ = b[MTUProbeAckLength-1]
+	b[0] = MessageTypeMTUProbeAck
+	b[1] = 0
+	b[2] = 0
+	b[3] = 0
+	binary.BigEndian.PutUint32(b[4:MTUProbeHeaderLength], probeID)
+	binary.BigEndian.PutUint16(b[MTUProbeHeaderLength:MTUProbeHeaderLength+2], uint16(probeLength))
+	reserved := b[MTUProbeHeaderLength+2 : MTUProbeAckLength]
+	for i := range reserved {
+		reserved[i] = 0
+	}
+}
+
+// MTUProbeID returns the probe ID in the MTU probe or MTU probe ack.
+func MTUProbeID(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b[4:MTUProbeHeaderLength])
+}
+
+// MTUProbeAckProbeLength returns the swgp packet length of the probe acknowledged by the MTU probe ack.
+func MTUProbeAckProbeLength(b []byte) int {
+	return int(binary.BigEndian.Uint16(b[MTUProbeHeaderLength : MTUProbeHeaderLength+2]))
+}
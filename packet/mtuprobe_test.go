@@ -0,0 +1,51 @@
+package packet
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMTUProbe(t *testing.T) {
+	b := make([]byte, 1200)
+	PutMTUProbe(b, 0xdeadbeef)
+
+	if !IsMTUProbe(b) {
+		t.Error("IsMTUProbe() = false, want true")
+	}
+	if IsMTUProbeAck(b) {
+		t.Error("IsMTUProbeAck() = true, want false")
+	}
+	if id := MTUProbeID(b); id != 0xdeadbeef {
+		t.Errorf("MTUProbeID() = %#x, want %#x", id, 0xdeadbeef)
+	}
+	if err := CheckWireGuardPacket(b); err != nil {
+		t.Errorf("CheckWireGuardPacket(probe) = %v", err)
+	}
+	if err := CheckWireGuardPacket(b[:MTUProbeHeaderLength-1]); !errors.Is(err, ErrMalformedPacket) {
+		t.Errorf("Truncated MTU probe: expected ErrMalformedPacket, got %v", err)
+	}
+}
+
+func TestMTUProbeAck(t *testing.T) {
+	b := make([]byte, MTUProbeAckLength)
+	PutMTUProbeAck(b, 42, 1452)
+
+	if !IsMTUProbeAck(b) {
+		t.Error("IsMTUProbeAck() = false, want true")
+	}
+	if IsMTUProbe(b) {
+		t.Error("IsMTUProbe() = true, want false")
+	}
+	if id := MTUProbeID(b); id != 42 {
+		t.Errorf("MTUProbeID() = %d, want 42", id)
+	}
+	if n := MTUProbeAckProbeLength(b); n != 1452 {
+		t.Errorf("MTUProbeAckProbeLength() = %d, want 1452", n)
+	}
+	if err := CheckWireGuardPacket(b); err != nil {
+		t.Errorf("CheckWireGuardPacket(ack) = %v", err)
+	}
+	if err := CheckWireGuardPacket(append(b, 0)); !errors.Is(err, ErrMalformedPacket) {
+		t.Errorf("Oversized MTU probe ack: expected ErrMalformedPacket, got %v", err)
+	}
+}
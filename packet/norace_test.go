@@ -0,0 +1,6 @@
+//go:build !race
+
+package packet
+
+// raceEnabled is whether the race detector is enabled.
+const raceEnabled = false
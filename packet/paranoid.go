@@ -4,6 +4,7 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
 
@@ -11,34 +12,144 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
+// paranoidKeepalivePaddingMaxLength is the maximum padding length of a keepalive message.
+//
+// Keepalives are sent frequently and carry no payload. Padding them up to MTU
+// would waste a lot of bandwidth for no benefit.
+//
+// Cookie challenges are capped the same way, so that a server answering replayed packets
+// from spoofed sources does not amplify the traffic.
+const paranoidKeepalivePaddingMaxLength = 32
+
+// paranoidMinPacketLength is the length of a paranoid packet with a 1-byte payload and no padding.
+const paranoidMinPacketLength = chacha20poly1305.NonceSizeX + 2 + 1 + chacha20poly1305.Overhead
+
 // paranoidHandler encrypts and decrypts whole packets using an AEAD cipher.
 // All packets, irrespective of message type, are padded up to the maximum packet length
-// to hide any possible characteristics.
+// to hide any possible characteristics. Keepalive messages and cookie challenges are the exception:
+// they only receive a small amount of padding.
+//
+// With size classes, packets are instead padded up to the smallest size class that fits them,
+// so that packet sizes follow the distribution of the classes. Cookie challenges still receive
+// a small amount of random padding.
 //
 //	swgpPacket := 24B nonce + AEAD_Seal(u16be payload length + payload + padding)
 //
-// paranoidHandler implements the Handler interface.
+// With session subkeys, each session encrypts its packets under a subkey derived from the PSK
+// and the session's random salt, which every packet carries masked after the nonce:
+//
+//	swgpPacket := 24B nonce + 16B masked session salt + AEAD_Seal_subkey(u16be payload length + payload + padding)
+//
+// paranoidHandler implements the SessionHandler interface.
 type paranoidHandler struct {
+	// aead encrypts packets. With session subkeys, it uses the subkey of salt.
 	aead cipher.AEAD
+
+	// sizeClasses are the swgp packet lengths to pad packets up to, in ascending order.
+	// If empty, packets are padded by a random length.
+	sizeClasses []int
+
+	// subkeys is nil if session subkeys are disabled.
+	subkeys *sessionSubkeys
+
+	// salt is the session salt of packets encrypted by the handler.
+	salt [sessionSaltLength]byte
 }
 
 // NewParanoidHandler creates a "paranoid" handler that
 // uses the given PSK to encrypt and decrypt packets.
 func NewParanoidHandler(psk []byte) (Handler, error) {
-	aead, err := chacha20poly1305.NewX(psk)
+	return newParanoidHandler(psk, nil, false)
+}
+
+// NewParanoidHandlerWithSizeClasses is like [NewParanoidHandler], but the handler pads each packet
+// up to the smallest of sizeClasses that fits it, instead of by a random length.
+// A packet that fits no size class within its buffer is padded up to the end of the buffer.
+//
+// sizeClasses are swgp packet lengths. They must be in ascending order,
+// and each must fit a packet with a 1-byte payload.
+func NewParanoidHandlerWithSizeClasses(psk []byte, sizeClasses []int) (Handler, error) {
+	if len(sizeClasses) == 0 {
+		return nil, errors.New("no padding size classes")
+	}
+	return newParanoidHandler(psk, sizeClasses, false)
+}
+
+// NewParanoidHandlerWithSessionSubkeys is like [NewParanoidHandler], but the handler encrypts the packets
+// of each session under a subkey derived from psk and a random session salt, instead of under psk itself.
+// Use [SessionHandler.NewSession] to create the handler of each session.
+// Packets are decrypted under the subkey of the salt they carry, whichever session sent them.
+//
+// If sizeClasses is not empty, packets are padded like [NewParanoidHandlerWithSizeClasses].
+func NewParanoidHandlerWithSessionSubkeys(psk []byte, sizeClasses []int) (SessionHandler, error) {
+	return newParanoidHandler(psk, sizeClasses, true)
+}
+
+func newParanoidHandler(psk []byte, sizeClasses []int, sessionSubkeys bool) (*paranoidHandler, error) {
+	var h paranoidHandler
+
+	if sessionSubkeys {
+		if len(psk) != chacha20poly1305.KeySize {
+			return nil, fmt.Errorf("PSK must be %d bytes, got %d", chacha20poly1305.KeySize, len(psk))
+		}
+		subkeys, err := newSessionSubkeys(psk)
+		if err != nil {
+			return nil, err
+		}
+		h.subkeys = subkeys
+	}
+
+	minPacketLength := paranoidMinPacketLength + h.saltLength()
+	for i, size := range sizeClasses {
+		if size < minPacketLength {
+			return nil, fmt.Errorf("padding size class %d is smaller than the minimum packet length %d", size, minPacketLength)
+		}
+		if i > 0 && size <= sizeClasses[i-1] {
+			return nil, fmt.Errorf("padding size classes must be in ascending order, got %d after %d", size, sizeClasses[i-1])
+		}
+	}
+	h.sizeClasses = sizeClasses
+
+	var err error
+	if h.subkeys != nil {
+		h.salt, h.aead, err = h.subkeys.newSalt()
+	} else {
+		h.aead, err = chacha20poly1305.NewX(psk)
+	}
 	if err != nil {
 		return nil, err
 	}
+	return &h, nil
+}
 
-	return &paranoidHandler{
-		aead: aead,
-	}, nil
+// NewSession implements the SessionHandler NewSession method.
+// If session subkeys are disabled, h itself is returned.
+func (h *paranoidHandler) NewSession() (Handler, error) {
+	if h.subkeys == nil {
+		return h, nil
+	}
+	salt, aead, err := h.subkeys.newSalt()
+	if err != nil {
+		return nil, err
+	}
+	hc := *h
+	hc.salt = salt
+	hc.aead = aead
+	return &hc, nil
+}
+
+// saltLength returns the length of the session salt in each packet, which is 0 without session subkeys.
+func (h *paranoidHandler) saltLength() int {
+	if h.subkeys == nil {
+		return 0
+	}
+	return sessionSaltLength
 }
 
 // Headroom implements the Handler Headroom method.
-func (*paranoidHandler) Headroom() Headroom {
+func (h *paranoidHandler) Headroom() Headroom {
 	return Headroom{
-		Front: chacha20poly1305.NonceSizeX + 2,
+		Front: chacha20poly1305.NonceSizeX + h.saltLength() + 2,
 		Rear:  chacha20poly1305.Overhead,
 	}
 }
@@ -53,16 +164,26 @@ func (h *paranoidHandler) EncryptZeroCopy(buf []byte, wgPacketStart, wgPacketLen
 	// Determine padding length.
 	rearHeadroom := len(buf) - wgPacketStart - wgPacketLength
 	paddingHeadroom := rearHeadroom - chacha20poly1305.Overhead
+	wgPacket := buf[wgPacketStart : wgPacketStart+wgPacketLength]
 	var paddingLen int
-	if paddingHeadroom > 0 {
-		paddingLen = 1 + int(fastrand.Uint32n(uint32(paddingHeadroom)))
+	if len(h.sizeClasses) > 0 && !IsCookieChallenge(wgPacket) {
+		paddingLen = h.sizeClassPaddingLength(wgPacketLength, paddingHeadroom)
+	} else {
+		if paddingHeadroom > paranoidKeepalivePaddingMaxLength && (IsWireGuardKeepalive(wgPacket) || IsCookieChallenge(wgPacket)) {
+			paddingHeadroom = paranoidKeepalivePaddingMaxLength
+		}
+		if paddingHeadroom > 0 {
+			paddingLen = 1 + int(fastrand.Uint32n(uint32(paddingHeadroom)))
+		}
 	}
 
 	// Calculate offsets.
-	swgpPacketStart = wgPacketStart - 2 - chacha20poly1305.NonceSizeX
-	swgpPacketLength = chacha20poly1305.NonceSizeX + 2 + wgPacketLength + paddingLen + chacha20poly1305.Overhead
+	saltLength := h.saltLength()
+	swgpPacketStart = wgPacketStart - 2 - saltLength - chacha20poly1305.NonceSizeX
+	swgpPacketLength = chacha20poly1305.NonceSizeX + saltLength + 2 + wgPacketLength + paddingLen + chacha20poly1305.Overhead
 
-	nonce := buf[swgpPacketStart : wgPacketStart-2]
+	nonce := buf[swgpPacketStart : swgpPacketStart+chacha20poly1305.NonceSizeX]
+	header := buf[swgpPacketStart : wgPacketStart-2]
 	payloadLength := buf[wgPacketStart-2 : wgPacketStart]
 	plaintext := buf[wgPacketStart-2 : wgPacketStart+wgPacketLength+paddingLen]
 
@@ -72,27 +193,58 @@ func (h *paranoidHandler) EncryptZeroCopy(buf []byte, wgPacketStart, wgPacketLen
 		return
 	}
 
+	// Write masked session salt.
+	if h.subkeys != nil {
+		salt := header[chacha20poly1305.NonceSizeX:]
+		copy(salt, h.salt[:])
+		h.subkeys.mask(salt, nonce)
+	}
+
 	// Write payload length.
 	binary.BigEndian.PutUint16(payloadLength, uint16(wgPacketLength))
 
 	// AEAD seal.
-	h.aead.Seal(nonce, nonce, plaintext, nil)
+	h.aead.Seal(header, nonce, plaintext, nil)
 
 	return
 }
 
+// sizeClassPaddingLength returns the padding length that brings a packet with a payload of wgPacketLength
+// up to the smallest size class that fits it, or up to paddingHeadroom if no size class fits.
+func (h *paranoidHandler) sizeClassPaddingLength(wgPacketLength, paddingHeadroom int) int {
+	if paddingHeadroom <= 0 {
+		return 0
+	}
+	unpaddedLength := chacha20poly1305.NonceSizeX + h.saltLength() + 2 + wgPacketLength + chacha20poly1305.Overhead
+	for _, size := range h.sizeClasses {
+		if size >= unpaddedLength {
+			if paddingLen := size - unpaddedLength; paddingLen <= paddingHeadroom {
+				return paddingLen
+			}
+			break
+		}
+	}
+	return paddingHeadroom
+}
+
 // DecryptZeroCopy implements the Handler DecryptZeroCopy method.
 func (h *paranoidHandler) DecryptZeroCopy(buf []byte, swgpPacketStart, swgpPacketLength int) (wgPacketStart, wgPacketLength int, err error) {
-	if swgpPacketLength < chacha20poly1305.NonceSizeX+2+1+chacha20poly1305.Overhead {
+	saltLength := h.saltLength()
+	if swgpPacketLength < paranoidMinPacketLength+saltLength {
 		err = &HandlerErr{ErrPacketSize, fmt.Sprintf("swgp packet (length %d) is too short", swgpPacketLength)}
 		return
 	}
 
 	nonce := buf[swgpPacketStart : swgpPacketStart+chacha20poly1305.NonceSizeX]
-	ciphertext := buf[swgpPacketStart+chacha20poly1305.NonceSizeX : swgpPacketStart+swgpPacketLength]
+	ciphertext := buf[swgpPacketStart+chacha20poly1305.NonceSizeX+saltLength : swgpPacketStart+swgpPacketLength]
 
 	// AEAD open.
-	plaintext, err := h.aead.Open(ciphertext[:0], nonce, ciphertext, nil)
+	var plaintext []byte
+	if h.subkeys != nil {
+		plaintext, err = h.openSession(nonce, buf[swgpPacketStart+chacha20poly1305.NonceSizeX:], ciphertext)
+	} else {
+		plaintext, err = h.aead.Open(ciphertext[:0], nonce, ciphertext, nil)
+	}
 	if err != nil {
 		return
 	}
@@ -105,7 +257,33 @@ func (h *paranoidHandler) DecryptZeroCopy(buf []byte, swgpPacketStart, swgpPacke
 		return
 	}
 
-	wgPacketStart = swgpPacketStart + chacha20poly1305.NonceSizeX + 2
+	wgPacketStart = swgpPacketStart + chacha20poly1305.NonceSizeX + saltLength + 2
 	wgPacketLength = payloadLength
 	return
 }
+
+// openSession unmasks the session salt and opens the ciphertext under the salt's subkey.
+// The subkey is cached once it has authenticated the packet.
+func (h *paranoidHandler) openSession(nonce, maskedSalt, ciphertext []byte) ([]byte, error) {
+	var salt [sessionSaltLength]byte
+	copy(salt[:], maskedSalt)
+	h.subkeys.mask(salt[:], nonce)
+
+	aead, ok := h.subkeys.lookup(salt)
+	if !ok {
+		var err error
+		aead, err = h.subkeys.derive(salt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	plaintext, err := aead.Open(ciphertext[:0], nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		h.subkeys.store(salt, aead)
+	}
+	return plaintext, nil
+}
@@ -42,3 +42,71 @@ func TestParanoidHandlePacket(t *testing.T) {
 		testHandler(t, WireGuardMessageTypeData, i, 0, 0, h, nil, nil, testParanoidVerifyPacket)
 	}
 }
+
+func TestParanoidHandleKeepalivePacket(t *testing.T) {
+	h := testNewParanoidHandler(t)
+
+	verifyFunc := func(t *testing.T, wgPacket, swgpPacket, decryptedWgPacket []byte) {
+		testParanoidVerifyPacket(t, wgPacket, swgpPacket, decryptedWgPacket)
+
+		maxLength := chacha20poly1305.NonceSizeX + 2 + WireGuardMessageLengthKeepalive + paranoidKeepalivePaddingMaxLength + chacha20poly1305.Overhead
+		if len(swgpPacket) > maxLength {
+			t.Errorf("Keepalive swgpPacket length %d exceeds %d", len(swgpPacket), maxLength)
+		}
+	}
+
+	// Leave enough room for a full-sized packet, so only the keepalive rule limits padding.
+	for i := 0; i < 128; i++ {
+		testHandler(t, WireGuardMessageTypeData, WireGuardMessageLengthKeepalive, 0, 1400, h, nil, nil, verifyFunc)
+	}
+}
+
+func TestParanoidSizeClassPadding(t *testing.T) {
+	psk := make([]byte, 32)
+	if _, err := rand.Read(psk); err != nil {
+		t.Fatal(err)
+	}
+	sizeClasses := []int{96, 256, 1280}
+	h, err := NewParanoidHandlerWithSizeClasses(psk, sizeClasses)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		msgType           byte
+		length            int
+		extraRearHeadroom int
+		expectedLength    int
+	}{
+		{WireGuardMessageTypeData, WireGuardMessageLengthKeepalive, 1400, 96},
+		{WireGuardMessageTypeHandshakeInitiation, WireGuardMessageLengthHandshakeInitiation, 1400, 256},
+		{WireGuardMessageTypeHandshakeResponse, WireGuardMessageLengthHandshakeResponse, 1400, 256},
+		{WireGuardMessageTypeData, 1024, 1400, 1280},
+		// The largest size class does not fit in the buffer: pad up to the end of the buffer.
+		{WireGuardMessageTypeData, 1024, 100, chacha20poly1305.NonceSizeX + 2 + 1024 + chacha20poly1305.Overhead + 100},
+		// No size class fits: pad up to the end of the buffer.
+		{WireGuardMessageTypeData, 1300, 50, chacha20poly1305.NonceSizeX + 2 + 1300 + chacha20poly1305.Overhead + 50},
+	} {
+		verifyFunc := func(t *testing.T, wgPacket, swgpPacket, decryptedWgPacket []byte) {
+			testParanoidVerifyPacket(t, wgPacket, swgpPacket, decryptedWgPacket)
+			if len(swgpPacket) != c.expectedLength {
+				t.Errorf("Packet of type %d and length %d padded to %d, expected %d", c.msgType, c.length, len(swgpPacket), c.expectedLength)
+			}
+		}
+		testHandler(t, c.msgType, c.length, 0, c.extraRearHeadroom, h, nil, nil, verifyFunc)
+	}
+}
+
+func TestNewParanoidHandlerWithSizeClassesErrors(t *testing.T) {
+	psk := make([]byte, 32)
+	for _, sizeClasses := range [][]int{
+		nil,
+		{paranoidMinPacketLength - 1, 1280},
+		{256, 96},
+		{256, 256},
+	} {
+		if _, err := NewParanoidHandlerWithSizeClasses(psk, sizeClasses); err == nil {
+			t.Errorf("Expected error for size classes %v", sizeClasses)
+		}
+	}
+}
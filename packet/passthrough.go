@@ -0,0 +1,29 @@
+package packet
+
+// passthroughHandler forwards packets verbatim without any transformation.
+// It provides no obfuscation and is meant for debugging and staged rollouts.
+//
+//	swgpPacket := wgPacket
+//
+// passthroughHandler implements the Handler interface.
+type passthroughHandler struct{}
+
+// NewPassthroughHandler creates a passthrough handler that forwards packets as is.
+func NewPassthroughHandler() Handler {
+	return passthroughHandler{}
+}
+
+// Headroom implements the Handler Headroom method.
+func (passthroughHandler) Headroom() Headroom {
+	return Headroom{}
+}
+
+// EncryptZeroCopy implements the Handler EncryptZeroCopy method.
+func (passthroughHandler) EncryptZeroCopy(buf []byte, wgPacketStart, wgPacketLength int) (swgpPacketStart, swgpPacketLength int, err error) {
+	return wgPacketStart, wgPacketLength, nil
+}
+
+// DecryptZeroCopy implements the Handler DecryptZeroCopy method.
+func (passthroughHandler) DecryptZeroCopy(buf []byte, swgpPacketStart, swgpPacketLength int) (wgPacketStart, wgPacketLength int, err error) {
+	return swgpPacketStart, swgpPacketLength, nil
+}
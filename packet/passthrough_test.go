@@ -0,0 +1,25 @@
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testPassthroughVerifyPacket(t *testing.T, wgPacket, swgpPacket, decryptedWgPacket []byte) {
+	if !bytes.Equal(wgPacket, swgpPacket) {
+		t.Error("The packet should be untouched.")
+	}
+
+	if !bytes.Equal(wgPacket, decryptedWgPacket) {
+		t.Error("Decrypted packet is different from original packet.")
+	}
+}
+
+func TestPassthroughHandlePacket(t *testing.T) {
+	h := NewPassthroughHandler()
+
+	for i := 1; i < 128; i++ {
+		testHandler(t, WireGuardMessageTypeHandshakeInitiation, i, 0, 0, h, nil, nil, testPassthroughVerifyPacket)
+		testHandler(t, WireGuardMessageTypeData, i, 0, 0, h, nil, nil, testPassthroughVerifyPacket)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package packet
+
+// raceEnabled is whether the race detector is enabled.
+// It randomly drops sync.Pool items, so tests must not count on pool reuse.
+const raceEnabled = true
@@ -0,0 +1,184 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// HandlerFactory creates a handler from a PSK and mode-specific options.
+// Factories must not retain or modify opts.
+type HandlerFactory func(psk []byte, opts map[string]any) (Handler, error)
+
+// OptionSizeClasses is the option key of the size classes of the "paranoid" handler.
+// The value must be an []int. See [NewParanoidHandlerWithSizeClasses].
+const OptionSizeClasses = "sizeClasses"
+
+// OptionSessionSubkeys is the option key that enables session subkeys of the "paranoid" handler.
+// The value must be a bool. See [NewParanoidHandlerWithSessionSubkeys].
+const OptionSessionSubkeys = "sessionSubkeys"
+
+var ErrUnknownHandler = errors.New("unknown handler")
+
+// ModeInfo describes a registered handler, so that tools can list and validate proxy modes
+// without hardcoding them.
+type ModeInfo struct {
+	// Name is the name the handler is registered under, and is used as the proxy mode.
+	Name string
+
+	// Description is a short human-readable summary of the mode.
+	Description string
+
+	// Options are the keys of the server and client config fields that configure the mode,
+	// like "paddingSizeClasses", besides proxyMode and proxyPSK.
+	// Handlers registered by other packages are configured with proxyModeOptions.
+	Options []string
+
+	// PSKOptional reports whether the handler works without a PSK.
+	PSKOptional bool
+}
+
+// registeredHandler is a handler factory and the description of its mode.
+type registeredHandler struct {
+	info    ModeInfo
+	factory HandlerFactory
+}
+
+var (
+	handlerFactoriesMu sync.RWMutex
+	handlerFactories   = make(map[string]registeredHandler)
+)
+
+func init() {
+	RegisterMode(ModeInfo{
+		Name:        "zero-overhead",
+		Description: "Encrypts the first 16 bytes of packets with AES, and pads and encrypts handshake packets. Data packets have no overhead.",
+	}, func(psk []byte, _ map[string]any) (Handler, error) {
+		return NewZeroOverheadHandler(psk)
+	})
+	RegisterMode(ModeInfo{
+		Name:        "zero-overhead-keyed",
+		Description: "Like zero-overhead, but with multiple keys, each identified by a masked 1-byte key ID prefixed to every packet.",
+		Options:     []string{"proxyKeys", "proxyKeyID", "proxyKeyMaskKey"},
+	}, func(_ []byte, _ map[string]any) (Handler, error) {
+		// A keyed handler holds many keys, which do not fit in a single PSK.
+		return nil, errors.New("zero-overhead-keyed handlers must be created with NewKeyedHandler")
+	})
+	RegisterMode(ModeInfo{
+		Name:        "paranoid",
+		Description: "Encrypts and pads whole packets with XChaCha20-Poly1305 to hide their characteristics.",
+		Options:     []string{"paddingStrategy", "paddingSizeClasses", "sessionSubkeys"},
+	}, func(psk []byte, opts map[string]any) (Handler, error) {
+		var sessionSubkeys bool
+		if v, ok := opts[OptionSessionSubkeys]; ok && v != nil {
+			if sessionSubkeys, ok = v.(bool); !ok {
+				return nil, fmt.Errorf("option %s must be bool, got %T", OptionSessionSubkeys, v)
+			}
+		}
+		var sizeClasses []int
+		if v, ok := opts[OptionSizeClasses]; ok && v != nil {
+			if sizeClasses, ok = v.([]int); !ok {
+				return nil, fmt.Errorf("option %s must be []int, got %T", OptionSizeClasses, v)
+			}
+		}
+		switch {
+		case sessionSubkeys:
+			return NewParanoidHandlerWithSessionSubkeys(psk, sizeClasses)
+		case sizeClasses != nil:
+			return NewParanoidHandlerWithSizeClasses(psk, sizeClasses)
+		default:
+			return NewParanoidHandler(psk)
+		}
+	})
+	RegisterMode(ModeInfo{
+		Name:        "extensible",
+		Description: "Like paranoid, but describes the plaintext with an extensible TLV header.",
+	}, func(psk []byte, _ map[string]any) (Handler, error) {
+		return NewExtensibleHandler(psk)
+	})
+	RegisterMode(ModeInfo{
+		Name:        "integrity",
+		Description: "Authenticates packets with a keyed BLAKE2s MAC without encrypting them. Provides no obfuscation.",
+	}, func(psk []byte, _ map[string]any) (Handler, error) {
+		return NewIntegrityHandler(psk)
+	})
+	RegisterMode(ModeInfo{
+		Name:        "passthrough",
+		Description: "Relays packets unmodified, for testing and debugging only.",
+		PSKOptional: true,
+	}, func(_ []byte, _ map[string]any) (Handler, error) {
+		// The PSK is not used and may be omitted.
+		return NewPassthroughHandler(), nil
+	})
+}
+
+// RegisterHandler makes a handler available by name, so the name can be used as a proxy mode.
+// It is meant to be called from init functions.
+//
+// RegisterHandler panics if the name is empty, the factory is nil, or the name is already registered.
+// Use [RegisterMode] to also describe the mode in [Modes].
+func RegisterHandler(name string, factory HandlerFactory) {
+	RegisterMode(ModeInfo{Name: name}, factory)
+}
+
+// RegisterMode is like [RegisterHandler], and registers the handler under info.Name
+// with info as its description in [Modes].
+func RegisterMode(info ModeInfo, factory HandlerFactory) {
+	if info.Name == "" {
+		panic("packet: RegisterHandler with empty name")
+	}
+	if factory == nil {
+		panic("packet: RegisterHandler factory is nil for handler " + info.Name)
+	}
+
+	info.Options = append([]string(nil), info.Options...)
+
+	handlerFactoriesMu.Lock()
+	defer handlerFactoriesMu.Unlock()
+	if _, ok := handlerFactories[info.Name]; ok {
+		panic("packet: RegisterHandler called twice for handler " + info.Name)
+	}
+	handlerFactories[info.Name] = registeredHandler{info: info, factory: factory}
+}
+
+// RegisteredHandlers returns the sorted names of the registered handlers.
+func RegisteredHandlers() []string {
+	handlerFactoriesMu.RLock()
+	names := make([]string, 0, len(handlerFactories))
+	for name := range handlerFactories {
+		names = append(names, name)
+	}
+	handlerFactoriesMu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Modes returns the descriptions of the registered handlers, sorted by name.
+func Modes() []ModeInfo {
+	handlerFactoriesMu.RLock()
+	modes := make([]ModeInfo, 0, len(handlerFactories))
+	for _, h := range handlerFactories {
+		info := h.info
+		info.Options = append([]string(nil), info.Options...)
+		modes = append(modes, info)
+	}
+	handlerFactoriesMu.RUnlock()
+	sort.Slice(modes, func(i, j int) bool { return modes[i].Name < modes[j].Name })
+	return modes
+}
+
+// NewHandler creates a handler with the factory registered under name.
+//
+// If no handler is registered under name, the returned error wraps [ErrUnknownHandler]
+// and lists the registered handlers.
+func NewHandler(name string, psk []byte, opts map[string]any) (Handler, error) {
+	handlerFactoriesMu.RLock()
+	factory := handlerFactories[name].factory
+	handlerFactoriesMu.RUnlock()
+	if factory == nil {
+		return nil, fmt.Errorf("%w %q, registered handlers: %s", ErrUnknownHandler, name, strings.Join(RegisteredHandlers(), ", "))
+	}
+	return factory(psk, opts)
+}
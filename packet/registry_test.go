@@ -0,0 +1,113 @@
+package packet
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRegisteredHandlersBuiltin(t *testing.T) {
+	names := RegisteredHandlers()
+	for _, name := range []string{"extensible", "integrity", "paranoid", "passthrough", "zero-overhead", "zero-overhead-keyed"} {
+		found := false
+		for _, n := range names {
+			if n == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Built-in handler %s is not registered, registered handlers: %v", name, names)
+		}
+	}
+}
+
+func TestRegisterHandler(t *testing.T) {
+	var gotOpts map[string]any
+	RegisterHandler("test-register", func(psk []byte, opts map[string]any) (Handler, error) {
+		gotOpts = opts
+		return NewPassthroughHandler(), nil
+	})
+
+	h, err := NewHandler("test-register", nil, map[string]any{"key": "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotOpts["key"] != "value" {
+		t.Errorf("Expected options to be passed to the factory, got %v", gotOpts)
+	}
+	for i := 1; i < 128; i++ {
+		testHandler(t, WireGuardMessageTypeData, i, 0, 0, h, nil, nil, testPassthroughVerifyPacket)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected RegisterHandler to panic on duplicate name.")
+		}
+	}()
+	RegisterHandler("test-register", func(psk []byte, opts map[string]any) (Handler, error) {
+		return NewPassthroughHandler(), nil
+	})
+}
+
+func TestNewHandlerUnknown(t *testing.T) {
+	_, err := NewHandler("no-such-handler", nil, nil)
+	if !errors.Is(err, ErrUnknownHandler) {
+		t.Fatalf("Expected ErrUnknownHandler, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "paranoid") {
+		t.Errorf("Expected error to list registered handlers, got %v", err)
+	}
+}
+
+func TestNewHandlerParanoidSizeClasses(t *testing.T) {
+	psk := make([]byte, 32)
+	if _, err := NewHandler("paranoid", psk, map[string]any{OptionSizeClasses: []int{1472}}); err != nil {
+		t.Errorf("Expected size classes to be accepted, got %v", err)
+	}
+	if _, err := NewHandler("paranoid", psk, map[string]any{OptionSizeClasses: []float64{1472}}); err == nil {
+		t.Error("Expected size classes of the wrong type to be rejected.")
+	}
+}
+
+func TestModes(t *testing.T) {
+	RegisterHandler("test-modes", func(psk []byte, opts map[string]any) (Handler, error) {
+		return NewPassthroughHandler(), nil
+	})
+
+	modes := Modes()
+	if len(modes) != len(RegisteredHandlers()) {
+		t.Errorf("Expected a mode for each of %v, got %v", RegisteredHandlers(), modes)
+	}
+	for i := 1; i < len(modes); i++ {
+		if modes[i-1].Name >= modes[i].Name {
+			t.Errorf("Modes are not sorted by name: %v", modes)
+		}
+	}
+
+	byName := make(map[string]ModeInfo, len(modes))
+	for _, mode := range modes {
+		byName[mode.Name] = mode
+	}
+	paranoid := byName["paranoid"]
+	if paranoid.Description == "" || len(paranoid.Options) != 3 || paranoid.PSKOptional {
+		t.Errorf("Unexpected paranoid mode info: %+v", paranoid)
+	}
+	if !byName["passthrough"].PSKOptional {
+		t.Error("Expected passthrough mode to not require a PSK.")
+	}
+	if keyed, ok := byName["zero-overhead-keyed"]; !ok || len(keyed.Options) != 3 {
+		t.Errorf("Unexpected zero-overhead-keyed mode info: %+v", keyed)
+	}
+	if mode, ok := byName["test-modes"]; !ok || mode.Description != "" || mode.Options != nil {
+		t.Errorf("Expected handler registered without info to have an empty description, got %+v", mode)
+	}
+
+	// The returned options are copies.
+	paranoid.Options[0] = "modified"
+	for _, mode := range Modes() {
+		if mode.Name == "paranoid" && mode.Options[0] != "paddingStrategy" {
+			t.Error("Expected Modes to return copies of the options.")
+		}
+	}
+}
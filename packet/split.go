@@ -0,0 +1,42 @@
+package packet
+
+// splitHandler encrypts packets with one handler and decrypts packets with another,
+// so that each direction can use its own key.
+//
+// splitHandler implements the Handler interface.
+type splitHandler struct {
+	encrypter Handler
+	decrypter Handler
+}
+
+// NewSplitHandler returns a handler that encrypts packets with encrypter and decrypts packets with decrypter.
+// The two handlers are usually of the same mode with different keys.
+func NewSplitHandler(encrypter, decrypter Handler) Handler {
+	return &splitHandler{
+		encrypter: encrypter,
+		decrypter: decrypter,
+	}
+}
+
+// Headroom implements the Handler Headroom method.
+func (h *splitHandler) Headroom() Headroom {
+	eh := h.encrypter.Headroom()
+	dh := h.decrypter.Headroom()
+	if eh.Front < dh.Front {
+		eh.Front = dh.Front
+	}
+	if eh.Rear < dh.Rear {
+		eh.Rear = dh.Rear
+	}
+	return eh
+}
+
+// EncryptZeroCopy implements the Handler EncryptZeroCopy method.
+func (h *splitHandler) EncryptZeroCopy(buf []byte, wgPacketStart, wgPacketLength int) (swgpPacketStart, swgpPacketLength int, err error) {
+	return h.encrypter.EncryptZeroCopy(buf, wgPacketStart, wgPacketLength)
+}
+
+// DecryptZeroCopy implements the Handler DecryptZeroCopy method.
+func (h *splitHandler) DecryptZeroCopy(buf []byte, swgpPacketStart, swgpPacketLength int) (wgPacketStart, wgPacketLength int, err error) {
+	return h.decrypter.DecryptZeroCopy(buf, swgpPacketStart, swgpPacketLength)
+}
@@ -0,0 +1,51 @@
+package packet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestSplitHandlePacket(t *testing.T) {
+	a := testNewParanoidHandler(t)
+	b := testNewParanoidHandler(t)
+	local := NewSplitHandler(a, b)
+	remote := NewSplitHandler(b, a)
+	headroom := local.Headroom()
+
+	for i := 1; i < 128; i++ {
+		buf := make([]byte, headroom.Front+i+headroom.Rear)
+		if _, err := rand.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		buf[headroom.Front] = WireGuardMessageTypeData
+		wgPacket := append([]byte(nil), buf[headroom.Front:headroom.Front+i]...)
+
+		swgpPacketStart, swgpPacketLength, err := local.EncryptZeroCopy(buf, headroom.Front, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		swgpPacket := append([]byte(nil), buf[swgpPacketStart:swgpPacketStart+swgpPacketLength]...)
+
+		// A packet sent in one direction does not decrypt as the other direction.
+		if _, _, err = local.DecryptZeroCopy(swgpPacket, 0, len(swgpPacket)); err == nil {
+			t.Fatal("Expected local handler to fail decrypting its own packet")
+		}
+
+		wgPacketStart, wgPacketLength, err := remote.DecryptZeroCopy(buf, swgpPacketStart, swgpPacketLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[wgPacketStart:wgPacketStart+wgPacketLength], wgPacket) {
+			t.Error("Decrypted packet is different from original packet.")
+		}
+	}
+}
+
+func TestSplitHandlerHeadroom(t *testing.T) {
+	paranoid := testNewParanoidHandler(t)
+	h := NewSplitHandler(NewPassthroughHandler(), paranoid)
+	if got, expected := h.Headroom(), paranoid.Headroom(); got != expected {
+		t.Errorf("Headroom() = %+v, expected %+v", got, expected)
+	}
+}
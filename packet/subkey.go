@@ -0,0 +1,132 @@
+package packet
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// sessionSaltLength is the length of the session salt that a session subkey is derived from.
+	sessionSaltLength = 16
+
+	// sessionSubkeyCacheSize is the maximum number of peer session subkeys kept by a handler.
+	// When the cache is full, it is emptied, and the subkeys of active sessions are derived again.
+	sessionSubkeyCacheSize = 4096
+
+	sessionSubkeyInfo   = "swgp-go paranoid session subkey"
+	sessionSaltMaskInfo = "swgp-go paranoid session salt mask"
+)
+
+// SessionHandler is a [Handler] that encrypts the packets of each session under its own subkey,
+// derived from the PSK and a random session salt. The PSK stays the long-term secret,
+// and limits the data encrypted under any single key.
+type SessionHandler interface {
+	Handler
+
+	// NewSession returns a handler that encrypts packets under the subkey of a new random session salt,
+	// and decrypts packets like the session handler.
+	NewSession() (Handler, error)
+}
+
+// NewSessionHandler returns the handler of a new session.
+//
+// If h, or the encrypting handler of a split handler, is a [SessionHandler], the returned handler
+// encrypts packets under a new session subkey. Otherwise, h is returned.
+func NewSessionHandler(h Handler) (Handler, error) {
+	switch h := h.(type) {
+	case SessionHandler:
+		return h.NewSession()
+	case *splitHandler:
+		sh, ok := h.encrypter.(SessionHandler)
+		if !ok {
+			return h, nil
+		}
+		encrypter, err := sh.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		return NewSplitHandler(encrypter, h.decrypter), nil
+	default:
+		return h, nil
+	}
+}
+
+// sessionSubkeys derives session subkeys from a PSK, and caches the subkeys of peer sessions.
+//
+// The session salt is carried in every packet, masked with a hash of the packet's random nonce,
+// so that it is not a stable fingerprint of the session on the wire.
+//
+// sessionSubkeys is safe for concurrent use by multiple goroutines.
+type sessionSubkeys struct {
+	psk     []byte
+	maskKey [32]byte
+
+	mu    sync.RWMutex
+	cache map[[sessionSaltLength]byte]cipher.AEAD
+}
+
+func newSessionSubkeys(psk []byte) (*sessionSubkeys, error) {
+	k := sessionSubkeys{
+		psk:   append([]byte(nil), psk...),
+		cache: make(map[[sessionSaltLength]byte]cipher.AEAD),
+	}
+	if _, err := io.ReadFull(hkdf.New(sha256.New, psk, nil, []byte(sessionSaltMaskInfo)), k.maskKey[:]); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// newSalt returns a random session salt and its subkey.
+func (k *sessionSubkeys) newSalt() (salt [sessionSaltLength]byte, aead cipher.AEAD, err error) {
+	if _, err = rand.Read(salt[:]); err != nil {
+		return
+	}
+	aead, err = k.derive(salt)
+	return
+}
+
+// derive returns the subkey of the session salt.
+func (k *sessionSubkeys) derive(salt [sessionSaltLength]byte) (cipher.AEAD, error) {
+	subkey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, k.psk, salt[:], []byte(sessionSubkeyInfo)), subkey); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(subkey)
+}
+
+// mask masks or unmasks the session salt in place with a hash of the packet's nonce.
+func (k *sessionSubkeys) mask(salt, nonce []byte) {
+	var b [32 + chacha20poly1305.NonceSizeX]byte
+	copy(b[:], k.maskKey[:])
+	copy(b[32:], nonce)
+	m := sha256.Sum256(b[:])
+	for i := range salt[:sessionSaltLength] {
+		salt[i] ^= m[i]
+	}
+}
+
+// lookup returns the cached subkey of the peer session salt.
+func (k *sessionSubkeys) lookup(salt [sessionSaltLength]byte) (cipher.AEAD, bool) {
+	k.mu.RLock()
+	aead, ok := k.cache[salt]
+	k.mu.RUnlock()
+	return aead, ok
+}
+
+// store caches the subkey of the peer session salt.
+// It must only be called after the subkey has authenticated a packet, so that forged salts
+// cannot fill the cache.
+func (k *sessionSubkeys) store(salt [sessionSaltLength]byte, aead cipher.AEAD) {
+	k.mu.Lock()
+	if len(k.cache) >= sessionSubkeyCacheSize {
+		k.cache = make(map[[sessionSaltLength]byte]cipher.AEAD)
+	}
+	k.cache[salt] = aead
+	k.mu.Unlock()
+}
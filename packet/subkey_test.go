@@ -0,0 +1,190 @@
+package packet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func testNewParanoidSessionHandler(t *testing.T, psk []byte) SessionHandler {
+	t.Helper()
+	h, err := NewParanoidHandlerWithSessionSubkeys(psk, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func testGeneratePSK(t *testing.T) []byte {
+	t.Helper()
+	psk := make([]byte, 32)
+	if _, err := rand.Read(psk); err != nil {
+		t.Fatal(err)
+	}
+	return psk
+}
+
+// testEncrypt encrypts wgPacket with h and returns a copy of the swgp packet.
+func testEncrypt(t *testing.T, h Handler, wgPacket []byte) []byte {
+	t.Helper()
+	headroom := h.Headroom()
+	buf := make([]byte, headroom.Front+len(wgPacket)+headroom.Rear)
+	copy(buf[headroom.Front:], wgPacket)
+	swgpPacketStart, swgpPacketLength, err := h.EncryptZeroCopy(buf, headroom.Front, len(wgPacket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), buf[swgpPacketStart:swgpPacketStart+swgpPacketLength]...)
+}
+
+// testDecrypt decrypts a copy of swgpPacket with h.
+func testDecrypt(h Handler, swgpPacket []byte) ([]byte, error) {
+	buf := append([]byte(nil), swgpPacket...)
+	wgPacketStart, wgPacketLength, err := h.DecryptZeroCopy(buf, 0, len(buf))
+	if err != nil {
+		return nil, err
+	}
+	return buf[wgPacketStart : wgPacketStart+wgPacketLength], nil
+}
+
+// testUnmaskSalt returns the session salt of a swgp packet encrypted by h.
+func testUnmaskSalt(h SessionHandler, swgpPacket []byte) []byte {
+	salt := append([]byte(nil), swgpPacket[chacha20poly1305.NonceSizeX:chacha20poly1305.NonceSizeX+sessionSaltLength]...)
+	h.(*paranoidHandler).subkeys.mask(salt, swgpPacket[:chacha20poly1305.NonceSizeX])
+	return salt
+}
+
+func TestParanoidSessionSubkeysHandlePacket(t *testing.T) {
+	h := testNewParanoidSessionHandler(t, testGeneratePSK(t))
+
+	verifyFunc := func(t *testing.T, wgPacket, swgpPacket, decryptedWgPacket []byte) {
+		if len(swgpPacket) < chacha20poly1305.NonceSizeX+sessionSaltLength+2+len(wgPacket)+chacha20poly1305.Overhead {
+			t.Error("Bad swgpPacket length.")
+		}
+		if !bytes.Equal(wgPacket, decryptedWgPacket) {
+			t.Error("Decrypted packet is different from original packet.")
+		}
+	}
+
+	for i := 1; i < 128; i++ {
+		testHandler(t, WireGuardMessageTypeHandshakeInitiation, i, 0, 0, h, nil, nil, verifyFunc)
+		testHandler(t, WireGuardMessageTypeData, i, 0, 0, h, nil, nil, verifyFunc)
+	}
+}
+
+func TestParanoidSessionSubkeys(t *testing.T) {
+	psk := testGeneratePSK(t)
+	sender := testNewParanoidSessionHandler(t, psk)
+	receiver := testNewParanoidSessionHandler(t, psk)
+
+	sessionA, err := sender.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionB, err := sender.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wgPacket := make([]byte, WireGuardMessageLengthHandshakeInitiation)
+	wgPacket[0] = WireGuardMessageTypeHandshakeInitiation
+
+	a1 := testEncrypt(t, sessionA, wgPacket)
+	a2 := testEncrypt(t, sessionA, wgPacket)
+	b1 := testEncrypt(t, sessionB, wgPacket)
+
+	// Any handler with the PSK decrypts packets of any session.
+	for _, swgpPacket := range [][]byte{a1, a2, b1, a1} {
+		decrypted, err := testDecrypt(receiver, swgpPacket)
+		if err != nil {
+			t.Fatalf("Failed to decrypt session packet: %v", err)
+		}
+		if !bytes.Equal(decrypted, wgPacket) {
+			t.Error("Decrypted packet is different from original packet.")
+		}
+	}
+
+	// A session keeps its salt, but the salt on the wire changes with every packet.
+	saltA1, saltA2, saltB1 := testUnmaskSalt(receiver, a1), testUnmaskSalt(receiver, a2), testUnmaskSalt(receiver, b1)
+	if !bytes.Equal(saltA1, saltA2) {
+		t.Error("Expected packets of the same session to carry the same salt")
+	}
+	if bytes.Equal(saltA1, saltB1) {
+		t.Error("Expected sessions to have different salts")
+	}
+	if bytes.Equal(a1[chacha20poly1305.NonceSizeX:chacha20poly1305.NonceSizeX+sessionSaltLength], a2[chacha20poly1305.NonceSizeX:chacha20poly1305.NonceSizeX+sessionSaltLength]) {
+		t.Error("Expected the masked salt to change with every packet")
+	}
+
+	// Packets are not encrypted under the raw PSK, and cannot be decrypted without it.
+	raw, err := NewParanoidHandler(psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutSalt := append(append([]byte(nil), a1[:chacha20poly1305.NonceSizeX]...), a1[chacha20poly1305.NonceSizeX+sessionSaltLength:]...)
+	if _, err = testDecrypt(raw, withoutSalt); err == nil {
+		t.Error("Expected session packet not to decrypt under the raw PSK")
+	}
+	if _, err = testDecrypt(testNewParanoidSessionHandler(t, testGeneratePSK(t)), a1); err == nil {
+		t.Error("Expected session packet not to decrypt under another PSK")
+	}
+
+	// Only authenticated subkeys are cached.
+	subkeys := receiver.(*paranoidHandler).subkeys
+	if n := len(subkeys.cache); n != 2 {
+		t.Errorf("Expected 2 cached subkeys, got %d", n)
+	}
+	forged := append([]byte(nil), a1...)
+	forged[chacha20poly1305.NonceSizeX] ^= 1
+	if _, err = testDecrypt(receiver, forged); err == nil {
+		t.Error("Expected packet with a forged salt to fail to decrypt")
+	}
+	if n := len(subkeys.cache); n != 2 {
+		t.Errorf("Expected forged salt not to be cached, got %d cached subkeys", n)
+	}
+}
+
+func TestNewSessionHandler(t *testing.T) {
+	psk := testGeneratePSK(t)
+
+	plain := testNewParanoidHandler(t)
+	if h, err := NewSessionHandler(plain); err != nil || h != plain {
+		t.Errorf("Expected handler without session subkeys to be returned as is, got %v, %v", h, err)
+	}
+
+	sessionHandler := testNewParanoidSessionHandler(t, psk)
+	split := NewSplitHandler(sessionHandler, plain)
+	h, err := NewSessionHandler(split)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh, ok := h.(*splitHandler)
+	if !ok {
+		t.Fatalf("Expected split handler, got %T", h)
+	}
+	if sh.encrypter == Handler(sessionHandler) {
+		t.Error("Expected split handler to encrypt under a new session subkey")
+	}
+	if sh.decrypter != plain {
+		t.Error("Expected split handler to keep its decrypter")
+	}
+}
+
+func TestNewHandlerParanoidSessionSubkeys(t *testing.T) {
+	psk := testGeneratePSK(t)
+	h, err := NewHandler("paranoid", psk, map[string]any{OptionSessionSubkeys: true, OptionSizeClasses: []int{1472}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.(SessionHandler); !ok || h.(*paranoidHandler).subkeys == nil {
+		t.Error("Expected handler with session subkeys")
+	}
+	if _, err = NewHandler("paranoid", psk, map[string]any{OptionSessionSubkeys: "true"}); err == nil {
+		t.Error("Expected session subkeys option of the wrong type to be rejected.")
+	}
+	if _, err = NewParanoidHandlerWithSessionSubkeys(psk, []int{paranoidMinPacketLength}); err == nil {
+		t.Error("Expected size class without room for the session salt to be rejected.")
+	}
+}
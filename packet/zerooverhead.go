@@ -16,12 +16,17 @@ import (
 const zeroOverheadHandshakePacketMinimumOverhead = 2 + chacha20poly1305.Overhead + chacha20poly1305.NonceSizeX
 
 // zeroOverheadHandler encrypts and decrypts the first 16 bytes of packets using an AES block cipher.
-// The remainder of handshake packets (message type 1, 2, 3) are also randomly padded and encrypted
-// using an XChaCha20-Poly1305 AEAD cipher to blend into normal traffic.
+// The remainder of handshake packets (message type 1, 2, 3), cookie messages, and bundles are also
+// encrypted using an XChaCha20-Poly1305 AEAD cipher. All but bundles are randomly padded to blend into normal traffic.
 //
 //	swgpPacket := aes(wgDataPacket[:16]) + wgDataPacket[16:]
 //	swgpPacket := aes(wgHandshakePacket[:16]) + AEAD_Seal(payload + padding + u16be payload length) + 24B nonce
 //
+// The message type is the first byte of the AES block, so it is never sent in plaintext.
+// Every WireGuard message is at least 32 bytes long, and the rest of the block is unique per packet
+// (sender index and ephemeral key, or receiver index and counter), so the encrypted first byte
+// is not a stable fingerprint of the message type either.
+//
 // zeroOverheadHandler implements the Handler interface.
 type zeroOverheadHandler struct {
 	cb   cipher.Block
@@ -70,7 +75,8 @@ func (h *zeroOverheadHandler) EncryptZeroCopy(buf []byte, wgPacketStart, wgPacke
 
 	// We are done with non-handshake packets.
 	switch messageType {
-	case WireGuardMessageTypeHandshakeInitiation, WireGuardMessageTypeHandshakeResponse, WireGuardMessageTypeHandshakeCookieReply:
+	case WireGuardMessageTypeHandshakeInitiation, WireGuardMessageTypeHandshakeResponse, WireGuardMessageTypeHandshakeCookieReply,
+		MessageTypeCookieChallenge, MessageTypeCookieEcho, MessageTypeBundle:
 	default:
 		return
 	}
@@ -83,8 +89,10 @@ func (h *zeroOverheadHandler) EncryptZeroCopy(buf []byte, wgPacketStart, wgPacke
 		return
 	}
 
+	// Bundles are not padded, as they carry data packets, which are never padded,
+	// and padding them up to the end of the buffer would undo the savings of bundling.
 	var paddingLen int
-	if paddingHeadroom > 0 {
+	if paddingHeadroom > 0 && messageType != MessageTypeBundle {
 		paddingLen = 1 + int(fastrand.Uint32n(uint32(paddingHeadroom)))
 	}
 
@@ -128,7 +136,8 @@ func (h *zeroOverheadHandler) DecryptZeroCopy(buf []byte, swgpPacketStart, swgpP
 
 	// We are done with non-handshake and short handshake packets.
 	switch buf[swgpPacketStart] {
-	case WireGuardMessageTypeHandshakeInitiation, WireGuardMessageTypeHandshakeResponse, WireGuardMessageTypeHandshakeCookieReply:
+	case WireGuardMessageTypeHandshakeInitiation, WireGuardMessageTypeHandshakeResponse, WireGuardMessageTypeHandshakeCookieReply,
+		MessageTypeCookieChallenge, MessageTypeCookieEcho, MessageTypeBundle:
 		if swgpPacketLength < 16+zeroOverheadHandshakePacketMinimumOverhead {
 			err = &HandlerErr{ErrPacketSize, fmt.Sprintf("swgp packet too short: %d", swgpPacketLength)}
 			return
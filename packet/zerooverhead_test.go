@@ -89,6 +89,46 @@ func TestZeroOverheadHandleHandshakePacket(t *testing.T) {
 	}
 }
 
+func TestZeroOverheadHandleCookieMessage(t *testing.T) {
+	h := testNewZeroOverheadHandler(t)
+
+	for _, length := range []int{CookieMessageHeaderLength, CookieMessageHeaderLength + WireGuardMessageLengthHandshakeInitiation} {
+		testHandler(t, MessageTypeCookieChallenge, length, 1, zeroOverheadHandshakePacketMinimumOverhead, h, nil, nil, testZeroOverheadVerifyHandshakePacket)
+		testHandler(t, MessageTypeCookieEcho, length, 1, zeroOverheadHandshakePacketMinimumOverhead, h, nil, nil, testZeroOverheadVerifyHandshakePacket)
+	}
+}
+
+func TestZeroOverheadHandleBundle(t *testing.T) {
+	h := testNewZeroOverheadHandler(t)
+
+	for _, length := range []int{BundleLength(2, 2*WireGuardMessageLengthKeepalive), 1024} {
+		testHandler(t, MessageTypeBundle, length, 1, zeroOverheadHandshakePacketMinimumOverhead, h, nil, nil, testZeroOverheadVerifyHandshakePacket)
+	}
+}
+
+func TestZeroOverheadBundleNotPadded(t *testing.T) {
+	h := testNewZeroOverheadHandler(t)
+
+	for _, n := range []int{1, 2, MaxBundlePackets} {
+		buf := make([]byte, 1500)
+		wgPacket := make([]byte, WireGuardMessageLengthKeepalive)
+		wgPacket[0] = WireGuardMessageTypeData
+
+		bundleLength := StartBundle(buf, 0, copy(buf, wgPacket))
+		for i := 1; i < n; i++ {
+			bundleLength = AppendToBundle(buf, 0, bundleLength, wgPacket)
+		}
+
+		_, swgpPacketLength, err := h.EncryptZeroCopy(buf, 0, bundleLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if maxLength := BundleLength(n, n*len(wgPacket)) + zeroOverheadHandshakePacketMinimumOverhead; swgpPacketLength > maxLength {
+			t.Errorf("Bundle of %d packets has wire length %d, expected at most %d", n, swgpPacketLength, maxLength)
+		}
+	}
+}
+
 func TestZeroOverheadHandleDataPacket(t *testing.T) {
 	h := testNewZeroOverheadHandler(t)
 
@@ -96,3 +136,36 @@ func TestZeroOverheadHandleDataPacket(t *testing.T) {
 		testHandler(t, WireGuardMessageTypeData, i, 1, 1, h, nil, nil, testZeroOverheadVerifyDataPacket)
 	}
 }
+
+func TestZeroOverheadHidesMessageType(t *testing.T) {
+	h := testNewZeroOverheadHandler(t)
+
+	for _, messageType := range []byte{
+		WireGuardMessageTypeHandshakeInitiation,
+		WireGuardMessageTypeHandshakeResponse,
+		WireGuardMessageTypeHandshakeCookieReply,
+		WireGuardMessageTypeData,
+	} {
+		firstBytes := make(map[byte]struct{})
+
+		for i := 0; i < 64; i++ {
+			buf := make([]byte, 1024)
+			if _, err := rand.Read(buf[:WireGuardMessageLengthKeepalive]); err != nil {
+				t.Fatal(err)
+			}
+			buf[0] = messageType
+			buf[1], buf[2], buf[3] = 0, 0, 0
+
+			swgpPacketStart, _, err := h.EncryptZeroCopy(buf, 0, WireGuardMessageLengthKeepalive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			firstBytes[buf[swgpPacketStart]] = struct{}{}
+		}
+
+		// A plaintext or deterministic message type byte would always encrypt to the same value.
+		if len(firstBytes) < 2 {
+			t.Errorf("Message type %d encrypted to the same first byte in every packet", messageType)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package service
+
+import (
+	"runtime"
+
+	"go.uber.org/zap"
+)
+
+// pinWorkerThread locks the calling goroutine to its OS thread and pins the thread to the configured CPUs.
+// It is a no-op if no CPU affinity is configured.
+//
+// It is only called by the long-lived receive loops on proxyConn. Pinning the goroutines of each session
+// would cost a locked OS thread and a sched_setaffinity call per session.
+//
+// The thread is never unlocked, so it exits with the goroutine instead of being
+// returned to the scheduler with the affinity mask still applied.
+func (s *server) pinWorkerThread() {
+	if len(s.cpuAffinity) == 0 {
+		return
+	}
+
+	runtime.LockOSThread()
+
+	if err := setThreadCPUAffinity(s.cpuAffinity); err != nil {
+		s.logger.Warn("Failed to set CPU affinity of worker thread",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Ints("cpuAffinity", s.cpuAffinity),
+			zap.Error(err),
+		)
+	}
+}
@@ -0,0 +1,29 @@
+package service
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// checkCPUAffinity returns an error if the list of CPUs cannot be used as an affinity mask.
+func checkCPUAffinity(cpus []int) error {
+	var set unix.CPUSet
+	maxCPUs := len(set) * int(unsafe.Sizeof(set[0])) * 8
+	for _, cpu := range cpus {
+		if cpu < 0 || cpu >= maxCPUs {
+			return fmt.Errorf("CPU out of range: %d", cpu)
+		}
+	}
+	return nil
+}
+
+// setThreadCPUAffinity pins the calling thread to the list of CPUs.
+func setThreadCPUAffinity(cpus []int) error {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return unix.SchedSetaffinity(0, &set)
+}
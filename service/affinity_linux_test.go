@@ -0,0 +1,64 @@
+package service
+
+import (
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCheckCPUAffinity(t *testing.T) {
+	if err := checkCPUAffinity([]int{0, 1}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := checkCPUAffinity([]int{-1}); err == nil {
+		t.Error("Expected error for negative CPU.")
+	}
+	if err := checkCPUAffinity([]int{1 << 20}); err == nil {
+		t.Error("Expected error for out-of-range CPU.")
+	}
+}
+
+func TestSetThreadCPUAffinity(t *testing.T) {
+	var orig unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &orig); err != nil {
+		t.Fatal(err)
+	}
+
+	cpu := -1
+	for i := 0; i < len(orig)*64; i++ {
+		if orig.IsSet(i) {
+			cpu = i
+			break
+		}
+	}
+	if cpu < 0 {
+		t.Skip("No CPU in affinity mask")
+	}
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		// Leave the thread locked, so it exits with the goroutine.
+		runtime.LockOSThread()
+
+		if err := setThreadCPUAffinity([]int{cpu}); err != nil {
+			errCh <- err
+			return
+		}
+
+		var set unix.CPUSet
+		if err := unix.SchedGetaffinity(0, &set); err != nil {
+			errCh <- err
+			return
+		}
+		if set.Count() != 1 || !set.IsSet(cpu) {
+			t.Errorf("Expected affinity mask with only CPU %d, got %d CPUs", cpu, set.Count())
+		}
+		errCh <- nil
+	}()
+
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
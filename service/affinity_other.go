@@ -0,0 +1,17 @@
+//go:build !linux
+
+package service
+
+import "errors"
+
+var errCPUAffinityUnsupported = errors.New("CPU affinity is not supported on this platform")
+
+// checkCPUAffinity returns an error if the list of CPUs cannot be used as an affinity mask.
+func checkCPUAffinity(cpus []int) error {
+	return errCPUAffinityUnsupported
+}
+
+// setThreadCPUAffinity pins the calling thread to the list of CPUs.
+func setThreadCPUAffinity(cpus []int) error {
+	return errCPUAffinityUnsupported
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// backoffBehaviorBuffer keeps the newest packets of a session in backoff,
+	// and forwards them once its WireGuard endpoint resolves.
+	backoffBehaviorBuffer = "buffer"
+
+	// backoffBehaviorDrop drops the packets of a session in backoff right away.
+	backoffBehaviorDrop = "drop"
+
+	// defaultBackoffBufferPackets is the default number of packets kept by the buffer backoff behavior.
+	defaultBackoffBufferPackets = 16
+)
+
+// checkBackoffBehavior returns the number of packets kept by the backoff behavior,
+// with 0 replaced by its default value, or an error if the backoff behavior or its buffer size is invalid.
+func checkBackoffBehavior(behavior string, bufferPackets int, resolveTimeout time.Duration, sendChannelCapacity int) (int, error) {
+	switch behavior {
+	case "", backoffBehaviorDrop:
+		if bufferPackets != 0 {
+			return 0, errors.New("backoffBufferPackets requires the buffer backoff behavior")
+		}
+	case backoffBehaviorBuffer:
+		switch {
+		case bufferPackets == 0:
+			bufferPackets = defaultBackoffBufferPackets
+		case bufferPackets < 0:
+			return 0, fmt.Errorf("backoff buffer packets must not be negative: %d", bufferPackets)
+		}
+		if bufferPackets > sendChannelCapacity {
+			return 0, fmt.Errorf("backoff buffer packets %d must not exceed the send channel capacity %d", bufferPackets, sendChannelCapacity)
+		}
+	default:
+		return 0, fmt.Errorf("unknown backoff behavior: %s", behavior)
+	}
+
+	if behavior != "" && resolveTimeout <= 0 {
+		return 0, errors.New("backoffBehavior requires endpointResolveTimeout")
+	}
+	return bufferPackets, nil
+}
+
+// admitDuringBackoff reports whether a packet may be queued for the session, applying the backoff behavior
+// while the resolution of the session's WireGuard endpoint is retried. Without a backoff behavior,
+// packets queue up in the send channel as usual. It is not called for the packet that starts the session.
+//
+// With the buffer behavior, the oldest queued packets are dropped to keep at most backoffBufferPackets,
+// including the new one, so that the buffer holds the newest packets, like the latest handshake initiation.
+//
+// The caller must hold s.mu.
+func (s *server) admitDuringBackoff(natEntry *serverNatEntry, clientAddrPort netip.AddrPort) bool {
+	if s.backoffBehavior == "" || !natEntry.backingOff.Load() {
+		return true
+	}
+
+	if s.backoffBehavior == backoffBehaviorDrop {
+		s.countBackoffDropped(natEntry, clientAddrPort)
+		return false
+	}
+
+	for len(natEntry.wgConnSendCh) >= s.backoffBufferPackets {
+		select {
+		case queuedPacket := <-natEntry.wgConnSendCh:
+			s.putPacketBuf(queuedPacket.buf)
+			s.countBackoffDropped(natEntry, clientAddrPort)
+		default:
+			// The session stopped backing off and drained the channel.
+			return true
+		}
+	}
+	return true
+}
+
+// countBackoffDropped counts a packet of the session dropped during backoff.
+func (s *server) countBackoffDropped(natEntry *serverNatEntry, clientAddrPort netip.AddrPort) {
+	s.backoffDropped.Add(1)
+	if ce := s.logger.Check(zap.DebugLevel, "wgPacket dropped during wg address resolution backoff"); ce != nil {
+		ce.Write(
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Stringer("wgAddress", &natEntry.wgAddr),
+			zap.String("backoffBehavior", s.backoffBehavior),
+		)
+	}
+}
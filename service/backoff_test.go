@@ -0,0 +1,213 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/jsonhelper"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestCheckBackoffBehavior(t *testing.T) {
+	for _, c := range []struct {
+		name           string
+		behavior       string
+		bufferPackets  int
+		resolveTimeout time.Duration
+		expected       int
+		ok             bool
+	}{
+		{"Default", "", 0, 0, 0, true},
+		{"Drop", backoffBehaviorDrop, 0, time.Second, 0, true},
+		{"BufferDefault", backoffBehaviorBuffer, 0, time.Second, defaultBackoffBufferPackets, true},
+		{"Buffer", backoffBehaviorBuffer, 4, time.Second, 4, true},
+		{"BufferSendChannelCapacity", backoffBehaviorBuffer, 64, time.Second, 64, true},
+		{"BufferExceedsSendChannel", backoffBehaviorBuffer, 65, time.Second, 0, false},
+		{"BufferNegative", backoffBehaviorBuffer, -1, time.Second, 0, false},
+		{"BufferPacketsWithoutBuffer", "", 4, time.Second, 0, false},
+		{"BufferPacketsWithDrop", backoffBehaviorDrop, 4, time.Second, 0, false},
+		{"NoResolveTimeout", backoffBehaviorDrop, 0, 0, 0, false},
+		{"Unknown", "replay", 0, time.Second, 0, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			bufferPackets, err := checkBackoffBehavior(c.behavior, c.bufferPackets, c.resolveTimeout, 64)
+			if ok := err == nil; ok != c.ok {
+				t.Fatalf("Expected ok %v, got error %v", c.ok, err)
+			}
+			if bufferPackets != c.expected {
+				t.Errorf("bufferPackets = %d, expected %d", bufferPackets, c.expected)
+			}
+		})
+	}
+}
+
+func TestServerConfigBackoffBehaviorTCP(t *testing.T) {
+	serverConfig := ServerConfig{
+		Name:                   "wg0",
+		ProxyListen:            ":20555",
+		ProxyMode:              "paranoid",
+		ProxyPSK:               generateTestPSK(t),
+		ProxyTransport:         "tcp",
+		WgEndpoint:             conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20556)),
+		MTU:                    1500,
+		EndpointResolveTimeout: jsonhelper.Duration(time.Second),
+		BackoffBehavior:        backoffBehaviorDrop,
+	}
+	if _, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache()); err == nil {
+		t.Error("Expected error for backoffBehavior with the TCP proxy transport")
+	}
+}
+
+func TestServerBackoffBehavior(t *testing.T) {
+	for _, c := range []struct {
+		name          string
+		behavior      string
+		batchMode     string
+		proxyPort     uint16
+		wgPort        uint16
+		clientPort    uint16
+		expectDropped uint64
+	}{
+		// The buffer keeps the newest 2 of the handshake initiation and the 4 data packets.
+		{"Buffer", backoffBehaviorBuffer, "", 20546, 20547, 20548, 3},
+		{"BufferNoBatch", backoffBehaviorBuffer, "no", 20549, 20550, 20551, 3},
+		// The handshake initiation was queued before the first resolution failed.
+		{"Drop", backoffBehaviorDrop, "", 20552, 20553, 20554, 4},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			psk := generateTestPSK(t)
+
+			serverConfig := ServerConfig{
+				Name:                   "wg0",
+				ProxyListen:            fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:              "paranoid",
+				ProxyPSK:               psk,
+				WgEndpoint:             conn.MustAddrFromDomainPort("wg.swgp-go.internal.", c.wgPort),
+				MTU:                    1500,
+				EndpointResolveTimeout: jsonhelper.Duration(10 * time.Second),
+				BackoffBehavior:        c.behavior,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+			if c.behavior == backoffBehaviorBuffer {
+				serverConfig.BackoffBufferPackets = 2
+			}
+
+			clientConfig := ClientConfig{
+				Name:          "wg0",
+				WgListen:      fmt.Sprintf(":%d", c.clientPort),
+				ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.proxyPort)),
+				ProxyMode:     "paranoid",
+				ProxyPSK:      psk,
+				MTU:           1500,
+			}
+
+			ctx := context.Background()
+			loggers := NewLoggers(logger)
+			listenConfigCache := conn.NewListenConfigCache()
+
+			endpoint := newFakeWgEndpoint(t, fmt.Sprintf("127.0.0.1:%d", c.wgPort))
+
+			// Resolution fails until the endpoint comes back.
+			var endpointUp atomic.Bool
+			dnsServer := newFakeDNSServer(t, netip.AddrFrom4([4]byte{127, 0, 0, 1}))
+			resolver := &net.Resolver{
+				PreferGo: true,
+				Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					if !endpointUp.Load() {
+						return nil, errors.New("endpoint is down")
+					}
+					var d net.Dialer
+					return d.DialContext(ctx, network, dnsServer)
+				},
+			}
+
+			s, err := serverConfig.Server(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.setResolver(resolver)
+			if err = s.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+
+			cl, err := clientConfig.Client(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = cl.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer cl.Stop()
+
+			peer := newFakeWgPeer(t, clientConfig.WgListen)
+
+			handshake := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+			peer.Send(handshake)
+			waitFor(t, "session to back off", func() bool {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				for _, natEntry := range s.table {
+					if natEntry.backingOff.Load() {
+						return true
+					}
+				}
+				return false
+			})
+
+			packets := make([][]byte, 4)
+			for i := range packets {
+				packets[i] = newTestWgPacket(t, packet.WireGuardMessageTypeData, 128+i)
+				peer.Send(packets[i])
+			}
+			waitFor(t, "packets to be dropped", func() bool {
+				return s.Stats().BackoffDropped == c.expectDropped
+			})
+
+			endpointUp.Store(true)
+
+			switch c.behavior {
+			case backoffBehaviorBuffer:
+				endpoint.Expect(packets[2])
+				endpoint.Expect(packets[3])
+			case backoffBehaviorDrop:
+				endpoint.Expect(handshake)
+			}
+			endpoint.ExpectNone(100 * time.Millisecond)
+
+			stats := s.Stats()
+			if stats.BackoffDropped != c.expectDropped {
+				t.Errorf("BackoffDropped = %d, expected %d", stats.BackoffDropped, c.expectDropped)
+			}
+			if stats.QueueFullPackets != 0 {
+				t.Errorf("QueueFullPackets = %d, expected 0", stats.QueueFullPackets)
+			}
+
+			// Once the endpoint resolves, packets are no longer dropped.
+			p := newTestWgPacket(t, packet.WireGuardMessageTypeData, 256)
+			peer.Send(p)
+			endpoint.Expect(p)
+		})
+	}
+}
+
+// waitFor waits for cond to become true, and fails the test if it does not in time.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(fakeWgTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// bufferPoolBudget caps the memory retained by the packet buffer pools of all services sharing it.
+//
+// bufferPoolBudget is safe for concurrent use by multiple goroutines.
+type bufferPoolBudget struct {
+	// max is the maximum number of bytes retained by the pools.
+	max atomic.Int64
+
+	// pooled is the number of bytes currently retained by the pools.
+	pooled atomic.Int64
+}
+
+// newBufferPoolBudget returns a budget of max bytes.
+func newBufferPoolBudget(max int64) *bufferPoolBudget {
+	var b bufferPoolBudget
+	b.max.Store(max)
+	return &b
+}
+
+// reserve reserves n bytes for a buffer returned to a pool.
+// It returns false if the budget is exhausted.
+func (b *bufferPoolBudget) reserve(n int) bool {
+	for {
+		pooled := b.pooled.Load()
+		if pooled+int64(n) > b.max.Load() {
+			return false
+		}
+		if b.pooled.CompareAndSwap(pooled, pooled+int64(n)) {
+			return true
+		}
+	}
+}
+
+// release releases n bytes of buffers taken out of a pool.
+func (b *bufferPoolBudget) release(n int) {
+	b.pooled.Add(-int64(n))
+}
+
+// Pooled returns the number of bytes currently retained by the pools.
+func (b *bufferPoolBudget) Pooled() uint64 {
+	return uint64(b.pooled.Load())
+}
+
+// packetBufPool is a pool of packet buffers of the same size.
+//
+// Without a budget, buffers are pooled in a [sync.Pool]. With a budget, buffers are kept
+// in a free list, so that retained memory can be accounted for exactly. Buffers returned
+// to the pool while the budget is exhausted are left to the garbage collector.
+//
+// packetBufPool is safe for concurrent use by multiple goroutines.
+type packetBufPool struct {
+	size   int
+	budget *bufferPoolBudget
+	pool   sync.Pool
+	mu     sync.Mutex
+	free   []*byte
+}
+
+// Get returns a pooled buffer, or a new buffer if none is available.
+func (p *packetBufPool) Get() *byte {
+	if p.budget == nil {
+		if b, ok := p.pool.Get().(*byte); ok {
+			return b
+		}
+		return &make([]byte, p.size)[0]
+	}
+
+	p.mu.Lock()
+	if n := len(p.free); n > 0 {
+		b := p.free[n-1]
+		p.free = p.free[:n-1]
+		p.mu.Unlock()
+		p.budget.release(p.size)
+		return b
+	}
+	p.mu.Unlock()
+	return &make([]byte, p.size)[0]
+}
+
+// Put returns the buffer to the pool.
+func (p *packetBufPool) Put(b *byte) {
+	if p.budget == nil {
+		p.pool.Put(b)
+		return
+	}
+
+	if !p.budget.reserve(p.size) {
+		return
+	}
+	p.mu.Lock()
+	p.free = append(p.free, b)
+	p.mu.Unlock()
+}
+
+// Drain releases all pooled buffers, returning their memory to the budget.
+// It is called when the service stops.
+func (p *packetBufPool) Drain() {
+	if p.budget == nil {
+		return
+	}
+
+	p.mu.Lock()
+	n := len(p.free)
+	p.free = nil
+	p.mu.Unlock()
+	p.budget.release(n * p.size)
+}
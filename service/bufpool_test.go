@@ -0,0 +1,33 @@
+package service
+
+import "testing"
+
+func TestPacketBufPoolBudget(t *testing.T) {
+	budget := newBufferPoolBudget(300)
+	p1 := packetBufPool{size: 100, budget: budget}
+	p2 := packetBufPool{size: 100, budget: budget}
+
+	bufs := make([]*byte, 5)
+	for i := range bufs {
+		bufs[i] = p1.Get()
+	}
+	for _, b := range bufs[:2] {
+		p1.Put(b)
+	}
+	for _, b := range bufs[2:] {
+		p2.Put(b)
+	}
+	if pooled := budget.Pooled(); pooled != 300 {
+		t.Errorf("Expected 300 pooled bytes after exceeding the budget, got %d", pooled)
+	}
+
+	p1.Get()
+	if pooled := budget.Pooled(); pooled != 200 {
+		t.Errorf("Expected 200 pooled bytes after taking a buffer, got %d", pooled)
+	}
+
+	p2.Drain()
+	if pooled := budget.Pooled(); pooled != 100 {
+		t.Errorf("Expected 100 pooled bytes after draining a pool, got %d", pooled)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"net/netip"
 	"os"
@@ -13,6 +14,7 @@ import (
 	"unsafe"
 
 	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/jsonhelper"
 	"github.com/database64128/swgp-go/packet"
 	"go.uber.org/zap"
 )
@@ -30,6 +32,122 @@ type ClientConfig struct {
 	ProxyFwmark       int       `json:"proxyFwmark"`
 	ProxyTrafficClass int       `json:"proxyTrafficClass"`
 	MTU               int       `json:"mtu"`
+
+	// FallbackMTU is the MTU used in place of MTU 0 (auto) when the network interface cannot be determined,
+	// for example when proxyEndpoint is a domain name. It is ignored unless MTU is 0.
+	//
+	// The default value 0 uses 1500.
+	FallbackMTU int `json:"fallbackMTU"`
+
+	// Disabled keeps the client from being started. Its config is still validated.
+	// Set it to turn the client off without removing its config, then reload.
+	Disabled bool `json:"disabled,omitempty"`
+
+	// LogPSKFingerprint logs a fingerprint of each configured PSK when the client starts.
+	// The fingerprint is the first 8 bytes of the key's SHA-256 hash. Compare it with the server's
+	// to check that both use the same key, without logging the key itself.
+	// With directional PSKs, the inbound fingerprint matches the server's outbound fingerprint.
+	LogPSKFingerprint bool `json:"logPSKFingerprint,omitempty"`
+
+	// ProxyPSKInbound and ProxyPSKOutbound replace ProxyPSK with a separate key for each direction.
+	// Received packets are decrypted with ProxyPSKInbound, and sent packets are encrypted with ProxyPSKOutbound.
+	// The client's inbound key is the server's outbound key, and vice versa.
+	ProxyPSKInbound  []byte `json:"proxyPSKInbound"`
+	ProxyPSKOutbound []byte `json:"proxyPSKOutbound"`
+
+	// ProxyModeInbound and ProxyModeOutbound replace ProxyMode with a separate proxy mode for each direction,
+	// to save CPU on a direction that crosses a trusted network. Received packets are decrypted in ProxyModeInbound,
+	// and sent packets are encrypted in ProxyModeOutbound. The client's inbound mode is the server's outbound mode,
+	// and vice versa. PaddingStrategy applies to the outbound mode.
+	ProxyModeInbound  string `json:"proxyModeInbound"`
+	ProxyModeOutbound string `json:"proxyModeOutbound"`
+
+	// PaddingStrategy selects how packets sent by the client are padded in the paranoid proxy mode.
+	// "uniform" (default) pads each packet by a random length. "size-class" pads each packet up to
+	// the smallest of PaddingSizeClasses that fits it, to mimic the packet sizes of another protocol.
+	// The receiver reads the true length from the packet, so the server may use a different strategy.
+	PaddingStrategy string `json:"paddingStrategy"`
+
+	// PaddingSizeClasses are the swgp packet lengths, in ascending order, of the "size-class" padding strategy.
+	// The largest must be at least the maximum packet size, which is MTU minus 28, so that every packet fits a class.
+	PaddingSizeClasses []int `json:"paddingSizeClasses"`
+
+	// SessionSubkeys encrypts the packets of each session under its own subkey in the paranoid proxy mode,
+	// instead of under the PSK itself, to limit the data encrypted under any single key.
+	// Each subkey is derived from the PSK and a random session salt carried in every packet.
+	// It changes the packet format, so the server must enable it too.
+	SessionSubkeys bool `json:"sessionSubkeys"`
+
+	// ProxyModeOptions are passed as is to the handler registered for ProxyMode with [packet.RegisterHandler].
+	// The built-in proxy modes take their options from dedicated fields instead.
+	ProxyModeOptions map[string]any `json:"proxyModeOptions,omitempty"`
+
+	// ProxyKeyID is the ID of ProxyPSK among the server's proxyKeys in the "zero-overhead-keyed" proxy mode.
+	// It is only used in that mode.
+	ProxyKeyID uint8 `json:"proxyKeyID"`
+
+	// ProxyKeyMaskKey is the server's proxyKeyMaskKey in the "zero-overhead-keyed" proxy mode.
+	// It is required in that mode, and only used in that mode.
+	ProxyKeyMaskKey []byte `json:"proxyKeyMaskKey,omitempty"`
+
+	// WgAllowedSource is the prefix of source addresses allowed to send packets to WgListen.
+	// Packets from other sources are dropped. A prefix of length 0, like "::/0" or "0.0.0.0/0",
+	// allows packets from any source.
+	//
+	// If unset, only packets from loopback addresses are allowed.
+	WgAllowedSource netip.Prefix `json:"wgAllowedSource"`
+
+	// TTL sets the IP TTL and IPv6 hop limit of packets sent by both wgConn and proxyConn,
+	// for example to keep packets from looping in a misconfigured network. It must be between 1 and 255.
+	//
+	// The default value 0 uses the system default.
+	TTL int `json:"ttl"`
+
+	// VRF is the name of a VRF device to place the client's sockets in with SO_BINDTODEVICE,
+	// so that both wgConn and proxyConn use the VRF's routing table.
+	// The VRF must exist when the client is created.
+	//
+	// It is only supported on Linux. The default empty value uses the default routing table.
+	VRF string `json:"vrf"`
+
+	// ProxyTransport selects how swgp packets are carried to the server: "udp" (default) or "tcp".
+	// With "tcp", each session connects to ProxyEndpoint over TCP. It must match the server.
+	ProxyTransport string `json:"proxyTransport"`
+
+	// ProxyHealthTimeout is how long packets may be sent to ProxyEndpoint without any coming back
+	// before the proxy path is reported down in stats and logs. An idle path is never down.
+	//
+	// The default value 0 uses 15 seconds, which a working WireGuard peer never exceeds.
+	ProxyHealthTimeout jsonhelper.Duration `json:"proxyHealthTimeout"`
+
+	// EagerConnect resolves ProxyEndpoint and sets up the upstream socket of the first session
+	// when the client starts, instead of when the first packet from WireGuard arrives.
+	// This takes the set-up off the first packet's path, and fails the start if the endpoint
+	// cannot be resolved or routed to.
+	EagerConnect bool `json:"eagerConnect,omitempty"`
+
+	// ProbeMTU measures the path MTU to ProxyEndpoint when the client starts, and clamps the client's MTU to it.
+	// The client sends MTU probes of decreasing size with the don't-fragment bit set, and the server acks
+	// the ones that get through. This catches paths that silently drop packets larger than their MTU,
+	// where handshakes work but data stalls. If no probe gets through, the configured MTU is kept.
+	//
+	// The server must support MTU probes. It is not supported with the TCP proxy transport.
+	ProbeMTU bool `json:"probeMTU,omitempty"`
+
+	// ProxyCoalesce bundles small WireGuard data packets queued for the server into one swgp packet,
+	// to save per-packet overhead on the path, like for a burst of TCP acks. Handshakes and packets
+	// that do not fit are sent on their own. Bundles are always accepted, but the server must be
+	// a version that understands them.
+	//
+	// It requires the sendmmsg batch mode, and is not supported with the TCP proxy transport.
+	ProxyCoalesce bool `json:"proxyCoalesce,omitempty"`
+
+	// ProxyCoalesceDelay is how long a bundle is held open for more packets once the send queue runs empty.
+	// Packets in the bundle are delayed by up to that much, so keep it small, like 100µs.
+	//
+	// The default value 0 only bundles packets that are already queued, and never holds a packet back.
+	ProxyCoalesceDelay jsonhelper.Duration `json:"proxyCoalesceDelay,omitempty"`
+
 	PerfConfig
 }
 
@@ -48,13 +166,18 @@ type clientNatEntry struct {
 	clientPktinfo      atomic.Pointer[[]byte]
 	clientPktinfoCache []byte
 	proxyConnSendCh    chan<- queuedPacket
+	handshakeTimer     handshakeTimer
+	pendingInitiation  pendingInitiation
 }
 
 type clientNatUplinkGeneric struct {
-	clientAddrPort  netip.AddrPort
-	proxyAddrPort   netip.AddrPort
-	proxyConn       *net.UDPConn
-	proxyConnSendCh <-chan queuedPacket
+	clientAddrPort    netip.AddrPort
+	proxyAddrPort     netip.AddrPort
+	proxyConn         *net.UDPConn
+	proxyConnSendCh   <-chan queuedPacket
+	handshakeTimer    *handshakeTimer
+	handler           packet.Handler
+	pendingInitiation *pendingInitiation
 }
 
 type clientNatDownlinkGeneric struct {
@@ -64,54 +187,155 @@ type clientNatDownlinkGeneric struct {
 	proxyConn          *net.UDPConn
 	wgConn             *net.UDPConn
 	maxProxyPacketSize int
+	handshakeTimer     *handshakeTimer
+	pendingInitiation  *pendingInitiation
 }
 
 type client struct {
 	name                  string
 	wgListen              string
+	mtu                   int
 	relayBatchSize        int
 	mainRecvBatchSize     int
 	sendChannelCapacity   int
 	maxProxyPacketSize    int
 	maxProxyPacketSizev6  int
+	wgAllowedSource       netip.Prefix
 	wgTunnelMTU           int
 	wgTunnelMTUv6         int
 	proxyAddr             conn.Addr
+	proxyTransport        string
+	eagerConnect          bool
+	probeMTU              bool
+	proxyCoalesce         bool
+	coalesceDelay         time.Duration
+	eagerProxyConn        atomic.Pointer[eagerProxyConn]
+	pskFingerprintFields  []zap.Field
 	handler               packet.Handler
+	events                *eventBus
+	resolver              *net.Resolver
+	inherited             *inheritedSockets
+	oversizedPackets      atomic.Uint64
+	malformedPackets      atomic.Uint64
+	decryptFailures       atomic.Uint64
+	sendErrors            atomic.Uint64
+	queueFullPackets      atomic.Uint64
+	uplinkTraffic         trafficCounters
+	downlinkTraffic       trafficCounters
+	handshakeRTT          rttEstimator
+	proxyHealth           proxyHealth
+	disallowedPackets     atomic.Uint64
+	bundlesSent           atomic.Uint64
+	bundledPackets        atomic.Uint64
+	receiveDrops          receiveDropCounter
+	panicRecoverer        *panicRecoverer
 	logger                *zap.Logger
+	connLogger            *zap.Logger
+	packetLogger          *zap.Logger
+	logLimiter            *logLimiter
 	wgConn                *net.UDPConn
 	wgConnListenConfig    conn.ListenConfig
 	proxyConnListenConfig conn.ListenConfig
-	packetBufPool         sync.Pool
+	mtuProbeListenConfig  conn.ListenConfig
+	packetBufPool         packetBufPool
 	mu                    sync.Mutex
 	wg                    sync.WaitGroup
 	mwg                   sync.WaitGroup
+	recvHoldsTable        bool
 	table                 map[netip.AddrPort]*clientNatEntry
+	tcpTable              map[netip.AddrPort]*clientTCPEntry
+	cancelTCPDials        context.CancelFunc
 	startFunc             func(context.Context) error
 }
 
 // Client creates a swgp client service from the client config.
 // Call the Start method on the returned service to start it.
-func (cc *ClientConfig) Client(logger *zap.Logger, listenConfigCache conn.ListenConfigCache) (*client, error) {
-	// Require MTU to be at least 1280.
-	if cc.MTU < minimumMTU {
-		return nil, ErrMTUTooSmall
+func (cc *ClientConfig) Client(loggers Loggers, listenConfigCache conn.ListenConfigCache) (*client, error) {
+	// MTU 0 uses the MTU of the network interface that packets to the proxy endpoint go out of.
+	mtu := cc.MTU
+	if mtu == 0 {
+		fallbackMTU, err := resolveFallbackMTU(cc.FallbackMTU)
+		if err != nil {
+			return nil, err
+		}
+		var localAddr netip.Addr
+		if cc.ProxyEndpoint.IsIP() {
+			localAddr, _ = routeLocalAddr(cc.ProxyEndpoint.IPPort())
+		}
+		mtu = autoMTU(localAddr, fallbackMTU, loggers.Service,
+			zap.String("client", cc.Name),
+			zap.Stringer("proxyAddress", &cc.ProxyEndpoint),
+		)
+	}
+
+	// Require MTU to be between 1280 and 65535.
+	if err := checkMTU(mtu, loggers.Service,
+		zap.String("client", cc.Name),
+		zap.Stringer("proxyAddress", &cc.ProxyEndpoint),
+	); err != nil {
+		return nil, err
+	}
+
+	if cc.WgAllowedSource.IsValid() && cc.WgAllowedSource != cc.WgAllowedSource.Masked() {
+		return nil, fmt.Errorf("wgAllowedSource %s has host bits set", cc.WgAllowedSource)
+	}
+
+	if err := checkVRF(cc.VRF); err != nil {
+		return nil, err
+	}
+
+	if err := checkTTL(cc.TTL); err != nil {
+		return nil, err
+	}
+
+	proxyTransport, err := checkProxyTransport(cc.ProxyTransport)
+	if err != nil {
+		return nil, err
+	}
+	if proxyTransport == proxyTransportTCP && cc.ProxyMode == proxyModeZeroOverheadKeyed {
+		return nil, fmt.Errorf("the %s proxy mode is not supported with the TCP proxy transport", proxyModeZeroOverheadKeyed)
+	}
+	if proxyTransport == proxyTransportTCP && cc.ProbeMTU {
+		return nil, errors.New("probeMTU is not supported with the TCP proxy transport")
+	}
+
+	proxyHealthTimeout := time.Duration(cc.ProxyHealthTimeout)
+	switch {
+	case proxyHealthTimeout < 0:
+		return nil, fmt.Errorf("proxy health timeout must not be negative: %s", proxyHealthTimeout)
+	case proxyHealthTimeout == 0:
+		proxyHealthTimeout = defaultProxyHealthTimeout
 	}
 
 	// Check and apply PerfConfig defaults.
+	requestedMainRecvBatchSize := cc.MainRecvBatchSize
 	if err := cc.CheckAndApplyDefaults(); err != nil {
 		return nil, err
 	}
+	if requestedMainRecvBatchSize > cc.MainRecvBatchSize {
+		loggers.Service.Warn("Clamped main recv batch size",
+			zap.String("client", cc.Name),
+			zap.Int("requestedMainRecvBatchSize", requestedMainRecvBatchSize),
+			zap.Int("mainRecvBatchSize", cc.MainRecvBatchSize),
+		)
+	}
+
+	if err = checkProxyCoalesce(cc.ProxyCoalesce, time.Duration(cc.ProxyCoalesceDelay), cc.BatchMode, proxyTransport); err != nil {
+		return nil, err
+	}
 
 	// Create packet handler for user-specified proxy mode.
-	handler, err := getPacketHandlerForProxyMode(cc.ProxyMode, cc.ProxyPSK)
+	handler, err := getClientPacketHandler(cc)
 	if err != nil {
 		return nil, err
 	}
 
 	// maxProxyPacketSize = MTU - IP header length - UDP header length
-	maxProxyPacketSize := cc.MTU - IPv4HeaderLength - UDPHeaderLength
-	maxProxyPacketSizev6 := cc.MTU - IPv6HeaderLength - UDPHeaderLength
+	maxProxyPacketSize := mtu - IPv4HeaderLength - UDPHeaderLength
+	maxProxyPacketSizev6 := mtu - IPv6HeaderLength - UDPHeaderLength
+	if err = checkPaddingSizeClassesCoverage(cc.PaddingSizeClasses, maxProxyPacketSize); err != nil {
+		return nil, err
+	}
 	wgTunnelMTU := getWgTunnelMTUForHandler(handler, maxProxyPacketSize)
 	wgTunnelMTUv6 := getWgTunnelMTUForHandler(handler, maxProxyPacketSizev6)
 
@@ -126,36 +350,75 @@ func (cc *ClientConfig) Client(logger *zap.Logger, listenConfigCache conn.Listen
 	c := client{
 		name:                 cc.Name,
 		wgListen:             cc.WgListen,
+		mtu:                  mtu,
 		relayBatchSize:       cc.RelayBatchSize,
 		mainRecvBatchSize:    cc.MainRecvBatchSize,
 		sendChannelCapacity:  cc.SendChannelCapacity,
 		maxProxyPacketSize:   maxProxyPacketSize,
 		maxProxyPacketSizev6: maxProxyPacketSizev6,
+		wgAllowedSource:      cc.WgAllowedSource,
 		wgTunnelMTU:          wgTunnelMTU,
 		wgTunnelMTUv6:        wgTunnelMTUv6,
 		proxyAddr:            cc.ProxyEndpoint,
+		proxyTransport:       proxyTransport,
+		eagerConnect:         cc.EagerConnect,
+		probeMTU:             cc.ProbeMTU,
+		proxyCoalesce:        cc.ProxyCoalesce,
+		coalesceDelay:        time.Duration(cc.ProxyCoalesceDelay),
 		handler:              handler,
-		logger:               logger,
+		logger:               loggers.Service,
+		connLogger:           loggers.Conn,
+		packetLogger:         loggers.Packet,
+		panicRecoverer:       newPanicRecoverer(loggers.Service, zap.String("client", cc.Name)),
+		logLimiter: newLogLimiter(
+			zap.String("client", cc.Name),
+			zap.String("listenAddress", cc.WgListen),
+		),
 		wgConnListenConfig: listenConfigCache.Get(conn.ListenerSocketOptions{
-			Fwmark:            cc.WgFwmark,
-			TrafficClass:      cc.WgTrafficClass,
-			PathMTUDiscovery:  true,
-			ReceivePacketInfo: true,
+			Fwmark:             cc.WgFwmark,
+			TrafficClass:       cc.WgTrafficClass,
+			TTL:                cc.TTL,
+			PathMTUDiscovery:   true,
+			ReceivePacketInfo:  true,
+			ReceiveDropCounter: true,
+			BindToDevice:       cc.VRF,
 		}),
 		proxyConnListenConfig: listenConfigCache.Get(conn.ListenerSocketOptions{
 			Fwmark:           cc.ProxyFwmark,
 			TrafficClass:     cc.ProxyTrafficClass,
+			TTL:              cc.TTL,
 			PathMTUDiscovery: true,
+			BindToDevice:     cc.VRF,
+		}),
+		// MTU probes are sent with the don't-fragment bit set, so that oversized probes are dropped.
+		mtuProbeListenConfig: listenConfigCache.Get(conn.ListenerSocketOptions{
+			Fwmark:       cc.ProxyFwmark,
+			TrafficClass: cc.ProxyTrafficClass,
+			TTL:          cc.TTL,
+			DontFragment: true,
+			BindToDevice: cc.VRF,
 		}),
-		packetBufPool: sync.Pool{
-			New: func() any {
-				b := make([]byte, maxProxyPacketSize)
-				return &b[0]
-			},
+		packetBufPool: packetBufPool{
+			size: maxProxyPacketSize + 1,
 		},
-		table: make(map[netip.AddrPort]*clientNatEntry),
+		table:    make(map[netip.AddrPort]*clientNatEntry),
+		tcpTable: make(map[netip.AddrPort]*clientTCPEntry),
+	}
+	c.proxyHealth.timeout = proxyHealthTimeout
+	if cc.LogPSKFingerprint {
+		c.pskFingerprintFields = pskFingerprintFields(cc.ProxyPSK, cc.ProxyPSKInbound, cc.ProxyPSKOutbound)
 	}
 	c.setStartFunc(cc.BatchMode)
+	if proxyTransport == proxyTransportTCP {
+		// PMTUD only applies to UDP sockets.
+		c.proxyConnListenConfig = listenConfigCache.Get(conn.ListenerSocketOptions{
+			Fwmark:       cc.ProxyFwmark,
+			TrafficClass: cc.ProxyTrafficClass,
+			TTL:          cc.TTL,
+			BindToDevice: cc.VRF,
+		})
+		c.startFunc = c.startTCP
+	}
 	return &c, nil
 }
 
@@ -166,11 +429,32 @@ func (c *client) String() string {
 
 // Start implements the Service Start method.
 func (c *client) Start(ctx context.Context) (err error) {
-	return c.startFunc(ctx)
+	if c.probeMTU {
+		c.measureMTU(ctx)
+	}
+	if c.eagerConnect {
+		if err = c.connectEagerly(ctx); err != nil {
+			return err
+		}
+	}
+	if err = c.startFunc(ctx); err != nil {
+		c.closeEagerProxyConn()
+		return err
+	}
+	c.logPSKFingerprint()
+	return nil
+}
+
+// logPSKFingerprint logs the fingerprints of the configured PSKs if requested.
+func (c *client) logPSKFingerprint() {
+	if len(c.pskFingerprintFields) == 0 {
+		return
+	}
+	c.logger.Info("PSK fingerprint", append([]zap.Field{zap.String("client", c.name)}, c.pskFingerprintFields...)...)
 }
 
 func (c *client) startGeneric(ctx context.Context) error {
-	wgConn, err := c.wgConnListenConfig.ListenUDP(ctx, "udp", c.wgListen)
+	wgConn, err := c.inherited.listenUDP(ctx, &c.wgConnListenConfig, "udp", c.wgListen)
 	if err != nil {
 		return err
 	}
@@ -179,7 +463,9 @@ func (c *client) startGeneric(ctx context.Context) error {
 	c.mwg.Add(1)
 
 	go func() {
-		c.recvFromWgConnGeneric(ctx, wgConn)
+		c.panicRecoverer.run(func() {
+			c.recvFromWgConnGeneric(ctx, wgConn)
+		}, c.releaseTableAfterPanic)
 		c.mwg.Done()
 	}()
 
@@ -207,6 +493,7 @@ func (c *client) startGeneric(ctx context.Context) error {
 
 func (c *client) recvFromWgConnGeneric(ctx context.Context, wgConn *net.UDPConn) {
 	headroom := c.handler.Headroom()
+	maxWgPacketLength := c.maxProxyPacketSize - headroom.Front - headroom.Rear
 
 	cmsgBuf := make([]byte, conn.SocketControlMessageBufferSize)
 
@@ -217,15 +504,15 @@ func (c *client) recvFromWgConnGeneric(ctx context.Context, wgConn *net.UDPConn)
 
 	for {
 		packetBuf := c.getPacketBuf()
-		plaintextBuf := packetBuf[headroom.Front : c.maxProxyPacketSize-headroom.Rear]
+		recvBuf := packetBuf[headroom.Front : headroom.Front+maxWgPacketLength+1]
 
-		n, cmsgn, flags, clientAddrPort, err := wgConn.ReadMsgUDPAddrPort(plaintextBuf, cmsgBuf)
+		n, cmsgn, flags, clientAddrPort, err := wgConn.ReadMsgUDPAddrPort(recvBuf, cmsgBuf)
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				c.putPacketBuf(packetBuf)
 				break
 			}
-			c.logger.Warn("Failed to read from wgConn",
+			c.connLogger.Warn("Failed to read from wgConn",
 				zap.String("client", c.name),
 				zap.String("listenAddress", c.wgListen),
 				zap.Stringer("clientAddress", clientAddrPort),
@@ -235,9 +522,20 @@ func (c *client) recvFromWgConnGeneric(ctx context.Context, wgConn *net.UDPConn)
 			c.putPacketBuf(packetBuf)
 			continue
 		}
+		if n > maxWgPacketLength {
+			c.oversizedPackets.Add(1)
+			c.logLimiter.Warn(c.logger, "Dropping oversized packet from wgConn", clientAddrPort,
+				zap.String("client", c.name),
+				zap.String("listenAddress", c.wgListen),
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Int("maxPacketLength", maxWgPacketLength),
+			)
+			c.putPacketBuf(packetBuf)
+			continue
+		}
 		err = conn.ParseFlagsForError(flags)
 		if err != nil {
-			c.logger.Warn("Failed to read from wgConn",
+			c.connLogger.Warn("Failed to read from wgConn",
 				zap.String("client", c.name),
 				zap.String("listenAddress", c.wgListen),
 				zap.Stringer("clientAddress", clientAddrPort),
@@ -248,29 +546,42 @@ func (c *client) recvFromWgConnGeneric(ctx context.Context, wgConn *net.UDPConn)
 			continue
 		}
 
+		if !c.isAllowedSource(clientAddrPort.Addr()) {
+			c.disallowedPackets.Add(1)
+			if ce := c.logger.Check(zap.DebugLevel, "Dropping packet from disallowed source"); ce != nil {
+				ce.Write(
+					zap.String("client", c.name),
+					zap.String("listenAddress", c.wgListen),
+					zap.Stringer("clientAddress", clientAddrPort),
+				)
+			}
+			c.putPacketBuf(packetBuf)
+			continue
+		}
+
 		packetsReceived++
 		wgBytesReceived += uint64(n)
 
-		c.mu.Lock()
+		c.lockTable()
 
 		natEntry, ok := c.table[clientAddrPort]
 		if !ok {
 			natEntry = &clientNatEntry{}
 		}
 
-		cmsg := cmsgBuf[:cmsgn]
+		cmsg := c.stripReceiveDrops(cmsgBuf[:cmsgn])
 
 		if !bytes.Equal(natEntry.clientPktinfoCache, cmsg) {
 			clientPktinfoAddr, clientPktinfoIfindex, err := conn.ParsePktinfoCmsg(cmsg)
 			if err != nil {
-				c.logger.Warn("Failed to parse pktinfo control message from wgConn",
+				c.connLogger.Warn("Failed to parse pktinfo control message from wgConn",
 					zap.String("client", c.name),
 					zap.String("listenAddress", c.wgListen),
 					zap.Stringer("clientAddress", clientAddrPort),
 					zap.Error(err),
 				)
 				c.putPacketBuf(packetBuf)
-				c.mu.Unlock()
+				c.unlockTable()
 				continue
 			}
 
@@ -305,7 +616,9 @@ func (c *client) recvFromWgConnGeneric(ctx context.Context, wgConn *net.UDPConn)
 					delete(c.table, clientAddrPort)
 					c.mu.Unlock()
 
-					if !sendChClean {
+					if sendChClean {
+						c.publishEvent(EventSessionEvicted, clientAddrPort, nil)
+					} else {
 						for queuedPacket := range proxyConnSendCh {
 							c.putPacketBuf(queuedPacket.buf)
 						}
@@ -314,31 +627,35 @@ func (c *client) recvFromWgConnGeneric(ctx context.Context, wgConn *net.UDPConn)
 					c.wg.Done()
 				}()
 
-				proxyAddrPort, err := c.proxyAddr.ResolveIPPort(ctx)
-				if err != nil {
-					c.logger.Warn("Failed to resolve proxy address for new session",
-						zap.String("client", c.name),
-						zap.String("listenAddress", c.wgListen),
-						zap.Stringer("clientAddress", clientAddrPort),
-						zap.Error(err),
-					)
-					return
-				}
+				proxyAddrPort, proxyConn, ok := c.takeEagerProxyConn()
+				if !ok {
+					var err error
+					proxyAddrPort, err = c.proxyAddr.ResolveIPPortWithResolver(ctx, c.resolver)
+					if err != nil {
+						c.connLogger.Warn("Failed to resolve proxy address for new session",
+							zap.String("client", c.name),
+							zap.String("listenAddress", c.wgListen),
+							zap.Stringer("clientAddress", clientAddrPort),
+							zap.Error(err),
+						)
+						return
+					}
 
-				proxyConn, err := c.proxyConnListenConfig.ListenUDP(ctx, "udp", "")
-				if err != nil {
-					c.logger.Warn("Failed to create UDP socket for new session",
-						zap.String("client", c.name),
-						zap.String("listenAddress", c.wgListen),
-						zap.Stringer("clientAddress", clientAddrPort),
-						zap.Error(err),
-					)
-					return
+					proxyConn, err = c.proxyConnListenConfig.ListenUDP(ctx, "udp", "")
+					if err != nil {
+						c.connLogger.Warn("Failed to create UDP socket for new session",
+							zap.String("client", c.name),
+							zap.String("listenAddress", c.wgListen),
+							zap.Stringer("clientAddress", clientAddrPort),
+							zap.Error(err),
+						)
+						return
+					}
 				}
 
-				err = proxyConn.SetReadDeadline(time.Now().Add(RejectAfterTime))
+				err := proxyConn.SetReadDeadline(time.Now().Add(RejectAfterTime))
 				if err != nil {
-					c.logger.Warn("Failed to SetReadDeadline on proxyConn",
+					c.connLogger.Warn("Failed to SetReadDeadline on proxyConn",
 						zap.String("client", c.name),
 						zap.String("listenAddress", c.wgListen),
 						zap.Stringer("clientAddress", clientAddrPort),
@@ -367,6 +684,8 @@ func (c *client) recvFromWgConnGeneric(ctx context.Context, wgConn *net.UDPConn)
 					}
 				}
 
+				c.publishEvent(EventSessionCreated, clientAddrPort, nil)
+
 				c.logger.Info("Client relay started",
 					zap.String("client", c.name),
 					zap.String("listenAddress", c.wgListen),
@@ -378,24 +697,36 @@ func (c *client) recvFromWgConnGeneric(ctx context.Context, wgConn *net.UDPConn)
 				c.wg.Add(1)
 
 				go func() {
-					c.relayWgToProxyGeneric(clientNatUplinkGeneric{
-						clientAddrPort:  clientAddrPort,
-						proxyAddrPort:   proxyAddrPort,
-						proxyConn:       proxyConn,
-						proxyConnSendCh: proxyConnSendCh,
+					c.panicRecoverer.runSession(clientAddrPort, func() {
+						c.relayWgToProxyGeneric(clientNatUplinkGeneric{
+							clientAddrPort:    clientAddrPort,
+							proxyAddrPort:     proxyAddrPort,
+							proxyConn:         proxyConn,
+							proxyConnSendCh:   proxyConnSendCh,
+							handshakeTimer:    &natEntry.handshakeTimer,
+							handler:           c.newSessionHandler(clientAddrPort),
+							pendingInitiation: &natEntry.pendingInitiation,
+						})
+					}, func() {
+						c.stopSessionAfterUplinkPanic(proxyConn, proxyConnSendCh)
 					})
 					proxyConn.Close()
 					c.wg.Done()
 				}()
 
-				c.relayProxyToWgGeneric(clientNatDownlinkGeneric{
-					clientAddrPort:     clientAddrPort,
-					clientPktinfo:      &natEntry.clientPktinfo,
-					proxyAddrPort:      proxyAddrPort,
-					proxyConn:          proxyConn,
-					wgConn:             wgConn,
-					maxProxyPacketSize: maxProxyPacketSize,
-				})
+				// The deferred cleanup ends the session if the downlink panics.
+				c.panicRecoverer.runSession(clientAddrPort, func() {
+					c.relayProxyToWgGeneric(clientNatDownlinkGeneric{
+						clientAddrPort:     clientAddrPort,
+						clientPktinfo:      &natEntry.clientPktinfo,
+						proxyAddrPort:      proxyAddrPort,
+						proxyConn:          proxyConn,
+						wgConn:             wgConn,
+						maxProxyPacketSize: maxProxyPacketSize,
+						handshakeTimer:     &natEntry.handshakeTimer,
+						pendingInitiation:  &natEntry.pendingInitiation,
+					})
+				}, nil)
 			}()
 
 			if ce := c.logger.Check(zap.DebugLevel, "New client session"); ce != nil {
@@ -411,6 +742,7 @@ func (c *client) recvFromWgConnGeneric(ctx context.Context, wgConn *net.UDPConn)
 		select {
 		case natEntry.proxyConnSendCh <- queuedPacket{packetBuf, headroom.Front, n}:
 		default:
+			c.queueFullPackets.Add(1)
 			if ce := c.logger.Check(zap.DebugLevel, "swgpPacket dropped due to full send channel"); ce != nil {
 				ce.Write(
 					zap.String("client", c.name),
@@ -422,7 +754,7 @@ func (c *client) recvFromWgConnGeneric(ctx context.Context, wgConn *net.UDPConn)
 			c.putPacketBuf(packetBuf)
 		}
 
-		c.mu.Unlock()
+		c.unlockTable()
 	}
 
 	c.logger.Info("Finished receiving from wgConn",
@@ -441,11 +773,14 @@ func (c *client) relayWgToProxyGeneric(uplink clientNatUplinkGeneric) {
 	)
 
 	for queuedPacket := range uplink.proxyConnSendCh {
+		uplink.handshakeTimer.Sent(queuedPacket.buf[queuedPacket.start : queuedPacket.start+queuedPacket.length])
+		uplink.pendingInitiation.Store(queuedPacket.buf[queuedPacket.start : queuedPacket.start+queuedPacket.length])
+
 		// Update proxyConn read deadline when a handshake initiation/response message is received.
 		switch queuedPacket.buf[queuedPacket.start] {
 		case packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageTypeHandshakeResponse:
 			if err := uplink.proxyConn.SetReadDeadline(time.Now().Add(RejectAfterTime)); err != nil {
-				c.logger.Warn("Failed to SetReadDeadline on proxyConn",
+				c.connLogger.Warn("Failed to SetReadDeadline on proxyConn",
 					zap.String("client", c.name),
 					zap.String("listenAddress", c.wgListen),
 					zap.Stringer("clientAddress", uplink.clientAddrPort),
@@ -457,9 +792,9 @@ func (c *client) relayWgToProxyGeneric(uplink clientNatUplinkGeneric) {
 			}
 		}
 
-		swgpPacketStart, swgpPacketLength, err := c.handler.EncryptZeroCopy(queuedPacket.buf, queuedPacket.start, queuedPacket.length)
+		swgpPacketStart, swgpPacketLength, err := uplink.handler.EncryptZeroCopy(queuedPacket.buf, queuedPacket.start, queuedPacket.length)
 		if err != nil {
-			c.logger.Warn("Failed to encrypt WireGuard packet",
+			c.packetLogger.Warn("Failed to encrypt WireGuard packet",
 				zap.String("client", c.name),
 				zap.String("listenAddress", c.wgListen),
 				zap.Stringer("clientAddress", uplink.clientAddrPort),
@@ -470,9 +805,11 @@ func (c *client) relayWgToProxyGeneric(uplink clientNatUplinkGeneric) {
 		}
 		swgpPacket := queuedPacket.buf[swgpPacketStart : swgpPacketStart+swgpPacketLength]
 
-		_, err = uplink.proxyConn.WriteToUDPAddrPort(swgpPacket, uplink.proxyAddrPort)
+		_, err = conn.WriteToUDPAddrPort(uplink.proxyConn, swgpPacket, uplink.proxyAddrPort)
 		if err != nil {
-			c.logger.Warn("Failed to write swgpPacket to proxyConn",
+			c.sendErrors.Add(1)
+			c.publishEvent(EventSendError, uplink.clientAddrPort, err)
+			c.logLimiter.Warn(c.connLogger, "Failed to write swgpPacket to proxyConn", uplink.clientAddrPort,
 				zap.String("client", c.name),
 				zap.String("listenAddress", c.wgListen),
 				zap.Stringer("clientAddress", uplink.clientAddrPort),
@@ -484,6 +821,8 @@ func (c *client) relayWgToProxyGeneric(uplink clientNatUplinkGeneric) {
 		c.putPacketBuf(queuedPacket.buf)
 		packetsSent++
 		wgBytesSent += uint64(queuedPacket.length)
+		c.uplinkTraffic.add(1, uint64(queuedPacket.length))
+		c.proxySent(uplink.clientAddrPort)
 	}
 
 	c.logger.Info("Finished relay wgConn -> proxyConn",
@@ -500,11 +839,13 @@ func (c *client) relayProxyToWgGeneric(downlink clientNatDownlinkGeneric) {
 	var (
 		clientPktinfop *[]byte
 		clientPktinfo  []byte
+		wgPackets      [][]byte
 		packetsSent    uint64
 		wgBytesSent    uint64
 	)
 
-	packetBuf := make([]byte, downlink.maxProxyPacketSize)
+	// Allocate one extra byte to detect oversized packets.
+	packetBuf := make([]byte, downlink.maxProxyPacketSize+1)
 
 	for {
 		n, _, flags, packetSourceAddrPort, err := downlink.proxyConn.ReadMsgUDPAddrPort(packetBuf, nil)
@@ -512,7 +853,7 @@ func (c *client) relayProxyToWgGeneric(downlink clientNatDownlinkGeneric) {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				break
 			}
-			c.logger.Warn("Failed to read from proxyConn",
+			c.connLogger.Warn("Failed to read from proxyConn",
 				zap.String("client", c.name),
 				zap.String("listenAddress", c.wgListen),
 				zap.Stringer("clientAddress", downlink.clientAddrPort),
@@ -525,7 +866,7 @@ func (c *client) relayProxyToWgGeneric(downlink clientNatDownlinkGeneric) {
 		}
 		err = conn.ParseFlagsForError(flags)
 		if err != nil {
-			c.logger.Warn("Failed to read from proxyConn",
+			c.connLogger.Warn("Failed to read from proxyConn",
 				zap.String("client", c.name),
 				zap.String("listenAddress", c.wgListen),
 				zap.Stringer("clientAddress", downlink.clientAddrPort),
@@ -548,10 +889,23 @@ func (c *client) relayProxyToWgGeneric(downlink clientNatDownlinkGeneric) {
 			)
 			continue
 		}
+		if n > downlink.maxProxyPacketSize {
+			c.oversizedPackets.Add(1)
+			c.logLimiter.Warn(c.logger, "Dropping oversized packet from proxyConn", downlink.clientAddrPort,
+				zap.String("client", c.name),
+				zap.String("listenAddress", c.wgListen),
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.Stringer("proxyAddress", downlink.proxyAddrPort),
+				zap.Int("maxPacketLength", downlink.maxProxyPacketSize),
+			)
+			continue
+		}
 
 		wgPacketStart, wgPacketLength, err := c.handler.DecryptZeroCopy(packetBuf, 0, n)
 		if err != nil {
-			c.logger.Warn("Failed to decrypt swgpPacket",
+			c.decryptFailures.Add(1)
+			c.publishEvent(EventDecryptFailure, downlink.clientAddrPort, err)
+			c.logLimiter.Warn(c.packetLogger, "Failed to decrypt swgpPacket", downlink.clientAddrPort,
 				zap.String("client", c.name),
 				zap.String("listenAddress", c.wgListen),
 				zap.Stringer("clientAddress", downlink.clientAddrPort),
@@ -563,24 +917,56 @@ func (c *client) relayProxyToWgGeneric(downlink clientNatDownlinkGeneric) {
 		}
 		wgPacket := packetBuf[wgPacketStart : wgPacketStart+wgPacketLength]
 
-		if cpp := downlink.clientPktinfo.Load(); cpp != clientPktinfop {
-			clientPktinfo = *cpp
-			clientPktinfop = cpp
-		}
-
-		_, _, err = downlink.wgConn.WriteMsgUDPAddrPort(wgPacket, clientPktinfo, downlink.clientAddrPort)
-		if err != nil {
-			c.logger.Warn("Failed to write wgPacket to wgConn",
+		if err = packet.CheckWireGuardPacket(wgPacket); err != nil {
+			c.malformedPackets.Add(1)
+			c.logLimiter.Warn(c.packetLogger, "Dropping malformed WireGuard packet", downlink.clientAddrPort,
 				zap.String("client", c.name),
 				zap.String("listenAddress", c.wgListen),
 				zap.Stringer("clientAddress", downlink.clientAddrPort),
 				zap.Stringer("proxyAddress", downlink.proxyAddrPort),
+				zap.Int("packetLength", wgPacketLength),
 				zap.Error(err),
 			)
+			continue
 		}
 
-		packetsSent++
-		wgBytesSent += uint64(wgPacketLength)
+		c.proxyReceived(downlink.clientAddrPort)
+
+		if rtt, ok := downlink.handshakeTimer.Received(wgPacket); ok {
+			c.handshakeRTT.Update(rtt)
+		}
+
+		if packet.IsCookieChallenge(wgPacket) {
+			c.answerCookieChallenge(downlink.proxyConn, packetBuf[:downlink.maxProxyPacketSize], wgPacketStart, wgPacketLength, downlink.clientAddrPort, downlink.proxyAddrPort, downlink.pendingInitiation.Load())
+			continue
+		}
+
+		if cpp := downlink.clientPktinfo.Load(); cpp != clientPktinfop {
+			clientPktinfo = *cpp
+			clientPktinfop = cpp
+		}
+
+		// A bundle is relayed as the packets it carries.
+		wgPackets = unbundle(wgPackets, wgPacket)
+
+		for _, wgPacket := range wgPackets {
+			_, _, err = conn.WriteMsgUDPAddrPort(downlink.wgConn, wgPacket, clientPktinfo, downlink.clientAddrPort)
+			if err != nil {
+				c.sendErrors.Add(1)
+				c.publishEvent(EventSendError, downlink.clientAddrPort, err)
+				c.logLimiter.Warn(c.connLogger, "Failed to write wgPacket to wgConn", downlink.clientAddrPort,
+					zap.String("client", c.name),
+					zap.String("listenAddress", c.wgListen),
+					zap.Stringer("clientAddress", downlink.clientAddrPort),
+					zap.Stringer("proxyAddress", downlink.proxyAddrPort),
+					zap.Error(err),
+				)
+			}
+
+			packetsSent++
+			wgBytesSent += uint64(len(wgPacket))
+			c.downlinkTraffic.add(1, uint64(len(wgPacket)))
+		}
 	}
 
 	c.logger.Info("Finished relay proxyConn -> wgConn",
@@ -590,12 +976,25 @@ func (c *client) relayProxyToWgGeneric(downlink clientNatDownlinkGeneric) {
 		zap.Stringer("proxyAddress", downlink.proxyAddrPort),
 		zap.Uint64("packetsSent", packetsSent),
 		zap.Uint64("wgBytesSent", wgBytesSent),
+		zap.Duration("handshakeRTT", downlink.handshakeTimer.RTT()),
 	)
 }
 
+// isAllowedSource returns whether packets from the source address are allowed to enter wgConn.
+func (c *client) isAllowedSource(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !c.wgAllowedSource.IsValid() {
+		return addr.IsLoopback()
+	}
+	return c.wgAllowedSource.Bits() == 0 || c.wgAllowedSource.Contains(addr)
+}
+
 // getPacketBuf retrieves a packet buffer from the pool.
+//
+// The returned buffer has one extra byte of capacity beyond its length,
+// so receive calls can detect oversized packets.
 func (c *client) getPacketBuf() []byte {
-	return unsafe.Slice(c.packetBufPool.Get().(*byte), c.maxProxyPacketSize)
+	return unsafe.Slice(c.packetBufPool.Get(), c.maxProxyPacketSize+1)[:c.maxProxyPacketSize]
 }
 
 // putPacketBuf puts the packet buffer back into the pool.
@@ -621,7 +1020,7 @@ func (c *client) Stop() error {
 		}
 
 		if err := proxyConn.SetReadDeadline(conn.ALongTimeAgo); err != nil {
-			c.logger.Warn("Failed to SetReadDeadline on proxyConn",
+			c.connLogger.Warn("Failed to SetReadDeadline on proxyConn",
 				zap.String("client", c.name),
 				zap.String("listenAddress", c.wgListen),
 				zap.Stringer("clientAddress", clientAddrPort),
@@ -630,11 +1029,66 @@ func (c *client) Stop() error {
 			)
 		}
 	}
+	c.closeTCPSessions()
 	c.mu.Unlock()
+	c.closeEagerProxyConn()
 
 	// Wait for all relay goroutines to exit before closing wgConn,
 	// so in-flight packets can be written out.
 	c.wg.Wait()
+	c.packetBufPool.Drain()
+	c.logLimiter.Stop()
+
+	if disallowedPackets := c.disallowedPackets.Load(); disallowedPackets > 0 {
+		c.logger.Info("Dropped packets from disallowed sources",
+			zap.String("client", c.name),
+			zap.String("listenAddress", c.wgListen),
+			zap.Uint64("disallowedPackets", disallowedPackets),
+		)
+	}
+
+	if oversizedPackets := c.oversizedPackets.Load(); oversizedPackets > 0 {
+		c.logger.Info("Dropped oversized packets",
+			zap.String("client", c.name),
+			zap.String("listenAddress", c.wgListen),
+			zap.Uint64("oversizedPackets", oversizedPackets),
+		)
+	}
+
+	if malformedPackets := c.malformedPackets.Load(); malformedPackets > 0 {
+		c.logger.Info("Dropped malformed packets",
+			zap.String("client", c.name),
+			zap.String("listenAddress", c.wgListen),
+			zap.Uint64("malformedPackets", malformedPackets),
+		)
+	}
 
 	return c.wgConn.Close()
 }
+
+// Stats implements the Service Stats method.
+func (c *client) Stats() Stats {
+	c.mu.Lock()
+	sessions := len(c.table) + len(c.tcpTable)
+	c.mu.Unlock()
+
+	return Stats{
+		Sessions:          sessions,
+		UplinkPackets:     c.uplinkTraffic.packets.Load(),
+		UplinkBytes:       c.uplinkTraffic.bytes.Load(),
+		DownlinkPackets:   c.downlinkTraffic.packets.Load(),
+		DownlinkBytes:     c.downlinkTraffic.bytes.Load(),
+		OversizedPackets:  c.oversizedPackets.Load(),
+		MalformedPackets:  c.malformedPackets.Load(),
+		DecryptFailures:   c.decryptFailures.Load(),
+		SendErrors:        c.sendErrors.Load(),
+		QueueFullPackets:  c.queueFullPackets.Load(),
+		DisallowedPackets: c.disallowedPackets.Load(),
+		BundlesSent:       c.bundlesSent.Load(),
+		BundledPackets:    c.bundledPackets.Load(),
+		ReceiveDrops:      c.receiveDrops.Load(),
+		Panics:            c.panicRecoverer.Panics(),
+		HandshakeRTT:      c.handshakeRTT.Load(),
+		ProxyDown:         !c.proxyHealth.Up(),
+	}
+}
@@ -19,10 +19,13 @@ import (
 )
 
 type clientNatUplinkMmsg struct {
-	clientAddrPort  netip.AddrPort
-	proxyAddrPort   netip.AddrPort
-	proxyConn       *conn.MmsgWConn
-	proxyConnSendCh <-chan queuedPacket
+	clientAddrPort    netip.AddrPort
+	proxyAddrPort     netip.AddrPort
+	proxyConn         *conn.MmsgWConn
+	proxyConnSendCh   <-chan queuedPacket
+	handshakeTimer    *handshakeTimer
+	handler           packet.Handler
+	pendingInitiation *pendingInitiation
 }
 
 type clientNatDownlinkMmsg struct {
@@ -33,6 +36,8 @@ type clientNatDownlinkMmsg struct {
 	proxyConn          *conn.MmsgRConn
 	wgConn             *conn.MmsgWConn
 	maxProxyPacketSize int
+	handshakeTimer     *handshakeTimer
+	pendingInitiation  *pendingInitiation
 }
 
 func (c *client) setStartFunc(batchMode string) {
@@ -45,16 +50,23 @@ func (c *client) setStartFunc(batchMode string) {
 }
 
 func (c *client) startMmsg(ctx context.Context) error {
-	wgConn, err := c.wgConnListenConfig.ListenUDPRawConn(ctx, "udp", c.wgListen)
+	udpConn, err := c.inherited.listenUDP(ctx, &c.wgConnListenConfig, "udp", c.wgListen)
 	if err != nil {
 		return err
 	}
+	wgConn, err := conn.NewRawUDPConn(udpConn)
+	if err != nil {
+		udpConn.Close()
+		return err
+	}
 	c.wgConn = wgConn.UDPConn
 
 	c.mwg.Add(1)
 
 	go func() {
-		c.recvFromWgConnRecvmmsg(ctx, wgConn.RConn())
+		c.panicRecoverer.run(func() {
+			c.recvFromWgConnRecvmmsg(ctx, wgConn.RConn())
+		}, c.releaseTableAfterPanic)
 		c.mwg.Done()
 	}()
 
@@ -75,6 +87,7 @@ func (c *client) startMmsg(ctx context.Context) error {
 			fields[4] = zap.Int("wgTunnelMTUv6", c.wgTunnelMTUv6)
 		}
 
+		fields = append(fields, zap.Int("mainRecvBatchSize", c.mainRecvBatchSize))
 		ce.Write(fields...)
 	}
 	return nil
@@ -82,7 +95,7 @@ func (c *client) startMmsg(ctx context.Context) error {
 
 func (c *client) recvFromWgConnRecvmmsg(ctx context.Context, wgConn *conn.MmsgRConn) {
 	headroom := c.handler.Headroom()
-	packetBufRecvSize := c.maxProxyPacketSize - headroom.Front - headroom.Rear
+	maxWgPacketLength := c.maxProxyPacketSize - headroom.Front - headroom.Rear
 
 	n := c.mainRecvBatchSize
 	bufvec := make([][]byte, n)
@@ -114,7 +127,7 @@ func (c *client) recvFromWgConnRecvmmsg(ctx context.Context, wgConn *conn.MmsgRC
 			packetBuf := c.getPacketBuf()
 			bufvec[i] = packetBuf
 			iovec[i].Base = &packetBuf[headroom.Front]
-			iovec[i].SetLen(packetBufRecvSize)
+			iovec[i].SetLen(maxWgPacketLength + 1)
 			msgvec[i].Msghdr.SetControllen(conn.SocketControlMessageBufferSize)
 		}
 
@@ -123,7 +136,7 @@ func (c *client) recvFromWgConnRecvmmsg(ctx context.Context, wgConn *conn.MmsgRC
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				break
 			}
-			c.logger.Warn("Failed to read from wgConn",
+			c.connLogger.Warn("Failed to read from wgConn",
 				zap.String("client", c.name),
 				zap.String("listenAddress", c.wgListen),
 				zap.Error(err),
@@ -139,7 +152,7 @@ func (c *client) recvFromWgConnRecvmmsg(ctx context.Context, wgConn *conn.MmsgRC
 			burstBatchSize = n
 		}
 
-		c.mu.Lock()
+		c.lockTable()
 
 		msgvecn := msgvec[:n]
 
@@ -148,7 +161,7 @@ func (c *client) recvFromWgConnRecvmmsg(ctx context.Context, wgConn *conn.MmsgRC
 			packetBuf := bufvec[i]
 
 			if msg.Msghdr.Controllen == 0 {
-				c.logger.Warn("Skipping packet with no control message from wgConn",
+				c.connLogger.Warn("Skipping packet with no control message from wgConn",
 					zap.String("client", c.name),
 					zap.String("listenAddress", c.wgListen),
 				)
@@ -158,7 +171,7 @@ func (c *client) recvFromWgConnRecvmmsg(ctx context.Context, wgConn *conn.MmsgRC
 
 			clientAddrPort, err := conn.SockaddrToAddrPort(msg.Msghdr.Name, msg.Msghdr.Namelen)
 			if err != nil {
-				c.logger.Warn("Failed to parse sockaddr of packet from wgConn",
+				c.connLogger.Warn("Failed to parse sockaddr of packet from wgConn",
 					zap.String("client", c.name),
 					zap.String("listenAddress", c.wgListen),
 					zap.Error(err),
@@ -167,9 +180,21 @@ func (c *client) recvFromWgConnRecvmmsg(ctx context.Context, wgConn *conn.MmsgRC
 				continue
 			}
 
+			if int(msg.Msglen) > maxWgPacketLength {
+				c.oversizedPackets.Add(1)
+				c.logLimiter.Warn(c.logger, "Dropping oversized packet from wgConn", clientAddrPort,
+					zap.String("client", c.name),
+					zap.String("listenAddress", c.wgListen),
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Int("maxPacketLength", maxWgPacketLength),
+				)
+				c.putPacketBuf(packetBuf)
+				continue
+			}
+
 			err = conn.ParseFlagsForError(int(msg.Msghdr.Flags))
 			if err != nil {
-				c.logger.Warn("Failed to read from wgConn",
+				c.connLogger.Warn("Failed to read from wgConn",
 					zap.String("client", c.name),
 					zap.String("listenAddress", c.wgListen),
 					zap.Stringer("clientAddress", clientAddrPort),
@@ -180,6 +205,19 @@ func (c *client) recvFromWgConnRecvmmsg(ctx context.Context, wgConn *conn.MmsgRC
 				continue
 			}
 
+			if !c.isAllowedSource(clientAddrPort.Addr()) {
+				c.disallowedPackets.Add(1)
+				if ce := c.logger.Check(zap.DebugLevel, "Dropping packet from disallowed source"); ce != nil {
+					ce.Write(
+						zap.String("client", c.name),
+						zap.String("listenAddress", c.wgListen),
+						zap.Stringer("clientAddress", clientAddrPort),
+					)
+				}
+				c.putPacketBuf(packetBuf)
+				continue
+			}
+
 			wgBytesReceived += uint64(msg.Msglen)
 
 			natEntry, ok := c.table[clientAddrPort]
@@ -188,19 +226,19 @@ func (c *client) recvFromWgConnRecvmmsg(ctx context.Context, wgConn *conn.MmsgRC
 			}
 
 			var clientPktinfop *[]byte
-			cmsg := cmsgvec[i][:msg.Msghdr.Controllen]
+			cmsg := c.stripReceiveDrops(cmsgvec[i][:msg.Msghdr.Controllen])
 
 			if !bytes.Equal(natEntry.clientPktinfoCache, cmsg) {
 				clientPktinfoAddr, clientPktinfoIfindex, err := conn.ParsePktinfoCmsg(cmsg)
 				if err != nil {
-					c.logger.Warn("Failed to parse pktinfo control message from wgConn",
+					c.connLogger.Warn("Failed to parse pktinfo control message from wgConn",
 						zap.String("client", c.name),
 						zap.String("listenAddress", c.wgListen),
 						zap.Stringer("clientAddress", clientAddrPort),
 						zap.Error(err),
 					)
 					c.putPacketBuf(packetBuf)
-					c.mu.Unlock()
+					c.unlockTable()
 					continue
 				}
 
@@ -236,7 +274,9 @@ func (c *client) recvFromWgConnRecvmmsg(ctx context.Context, wgConn *conn.MmsgRC
 						delete(c.table, clientAddrPort)
 						c.mu.Unlock()
 
-						if !sendChClean {
+						if sendChClean {
+							c.publishEvent(EventSessionEvicted, clientAddrPort, nil)
+						} else {
 							for queuedPacket := range proxyConnSendCh {
 								c.putPacketBuf(queuedPacket.buf)
 							}
@@ -245,31 +285,47 @@ func (c *client) recvFromWgConnRecvmmsg(ctx context.Context, wgConn *conn.MmsgRC
 						c.wg.Done()
 					}()
 
-					proxyAddrPort, err := c.proxyAddr.ResolveIPPort(ctx)
-					if err != nil {
-						c.logger.Warn("Failed to resolve proxy address for new session",
-							zap.String("client", c.name),
-							zap.String("listenAddress", c.wgListen),
-							zap.Stringer("clientAddress", clientAddrPort),
-							zap.Error(err),
-						)
-						return
+					proxyAddrPort, udpConn, ok := c.takeEagerProxyConn()
+					if !ok {
+						var err error
+						proxyAddrPort, err = c.proxyAddr.ResolveIPPortWithResolver(ctx, c.resolver)
+						if err != nil {
+							c.connLogger.Warn("Failed to resolve proxy address for new session",
+								zap.String("client", c.name),
+								zap.String("listenAddress", c.wgListen),
+								zap.Stringer("clientAddress", clientAddrPort),
+								zap.Error(err),
+							)
+							return
+						}
+
+						udpConn, err = c.proxyConnListenConfig.ListenUDP(ctx, "udp", "")
+						if err != nil {
+							c.connLogger.Warn("Failed to create UDP socket for new session",
+								zap.String("client", c.name),
+								zap.String("listenAddress", c.wgListen),
+								zap.Stringer("clientAddress", clientAddrPort),
+								zap.Error(err),
+							)
+							return
+						}
 					}
 
-					proxyConn, err := c.proxyConnListenConfig.ListenUDPRawConn(ctx, "udp", "")
+					proxyConn, err := conn.NewRawUDPConn(udpConn)
 					if err != nil {
-						c.logger.Warn("Failed to create UDP socket for new session",
+						c.connLogger.Warn("Failed to create UDP socket for new session",
 							zap.String("client", c.name),
 							zap.String("listenAddress", c.wgListen),
 							zap.Stringer("clientAddress", clientAddrPort),
 							zap.Error(err),
 						)
+						udpConn.Close()
 						return
 					}
 
 					err = proxyConn.SetReadDeadline(time.Now().Add(RejectAfterTime))
 					if err != nil {
-						c.logger.Warn("Failed to SetReadDeadline on proxyConn",
+						c.connLogger.Warn("Failed to SetReadDeadline on proxyConn",
 							zap.String("client", c.name),
 							zap.String("listenAddress", c.wgListen),
 							zap.Stringer("clientAddress", clientAddrPort),
@@ -298,6 +354,8 @@ func (c *client) recvFromWgConnRecvmmsg(ctx context.Context, wgConn *conn.MmsgRC
 						}
 					}
 
+					c.publishEvent(EventSessionCreated, clientAddrPort, nil)
+
 					c.logger.Info("Client relay started",
 						zap.String("client", c.name),
 						zap.String("listenAddress", c.wgListen),
@@ -309,25 +367,37 @@ func (c *client) recvFromWgConnRecvmmsg(ctx context.Context, wgConn *conn.MmsgRC
 					c.wg.Add(1)
 
 					go func() {
-						c.relayWgToProxySendmmsg(clientNatUplinkMmsg{
-							clientAddrPort:  clientAddrPort,
-							proxyAddrPort:   proxyAddrPort,
-							proxyConn:       proxyConn.WConn(),
-							proxyConnSendCh: proxyConnSendCh,
+						c.panicRecoverer.runSession(clientAddrPort, func() {
+							c.relayWgToProxySendmmsg(clientNatUplinkMmsg{
+								clientAddrPort:    clientAddrPort,
+								proxyAddrPort:     proxyAddrPort,
+								proxyConn:         proxyConn.WConn(),
+								proxyConnSendCh:   proxyConnSendCh,
+								handshakeTimer:    &natEntry.handshakeTimer,
+								handler:           c.newSessionHandler(clientAddrPort),
+								pendingInitiation: &natEntry.pendingInitiation,
+							})
+						}, func() {
+							c.stopSessionAfterUplinkPanic(proxyConn.UDPConn, proxyConnSendCh)
 						})
 						proxyConn.Close()
 						c.wg.Done()
 					}()
 
-					c.relayProxyToWgSendmmsg(clientNatDownlinkMmsg{
-						clientAddrPort:     clientAddrPort,
-						clientPktinfop:     clientPktinfop,
-						clientPktinfo:      &natEntry.clientPktinfo,
-						proxyAddrPort:      proxyAddrPort,
-						proxyConn:          proxyConn.RConn(),
-						wgConn:             wgConn.WConn(),
-						maxProxyPacketSize: maxProxyPacketSize,
-					})
+					// The deferred cleanup ends the session if the downlink panics.
+					c.panicRecoverer.runSession(clientAddrPort, func() {
+						c.relayProxyToWgSendmmsg(clientNatDownlinkMmsg{
+							clientAddrPort:     clientAddrPort,
+							clientPktinfop:     clientPktinfop,
+							clientPktinfo:      &natEntry.clientPktinfo,
+							proxyAddrPort:      proxyAddrPort,
+							proxyConn:          proxyConn.RConn(),
+							wgConn:             wgConn.WConn(),
+							maxProxyPacketSize: maxProxyPacketSize,
+							handshakeTimer:     &natEntry.handshakeTimer,
+							pendingInitiation:  &natEntry.pendingInitiation,
+						})
+					}, nil)
 				}()
 
 				if ce := c.logger.Check(zap.DebugLevel, "New client session"); ce != nil {
@@ -343,6 +413,7 @@ func (c *client) recvFromWgConnRecvmmsg(ctx context.Context, wgConn *conn.MmsgRC
 			select {
 			case natEntry.proxyConnSendCh <- queuedPacket{packetBuf, headroom.Front, int(msg.Msglen)}:
 			default:
+				c.queueFullPackets.Add(1)
 				if ce := c.logger.Check(zap.DebugLevel, "swgpPacket dropped due to full send channel"); ce != nil {
 					ce.Write(
 						zap.String("client", c.name),
@@ -355,7 +426,7 @@ func (c *client) recvFromWgConnRecvmmsg(ctx context.Context, wgConn *conn.MmsgRC
 			}
 		}
 
-		c.mu.Unlock()
+		c.unlockTable()
 	}
 
 	for i := range bufvec {
@@ -393,12 +464,55 @@ func (c *client) relayWgToProxySendmmsg(uplink clientNatUplinkMmsg) {
 		msgvec[i].Msghdr.SetIovlen(1)
 	}
 
-main:
+	var (
+		count          int
+		batchPackets   int
+		batchWgBytes   uint64
+		bundle         packetBundle
+		bundleDeadline time.Time
+		coalesceTimer  *time.Timer
+	)
+	tailroom := bundleTailroom(uplink.handler)
+	if c.coalesceDelay > 0 {
+		coalesceTimer = time.NewTimer(c.coalesceDelay)
+		if !coalesceTimer.Stop() {
+			<-coalesceTimer.C
+		}
+	}
+
+	// send encrypts the packet or bundle at buf[start:start+length], which carries packets WireGuard packets
+	// totalling wgBytes bytes, and adds it to the batch. If the packet cannot be encrypted, buf is put back.
+	send := func(buf []byte, start, length, packets, wgBytes int) {
+		swgpPacketStart, swgpPacketLength, err := uplink.handler.EncryptZeroCopy(buf, start, length)
+		if err != nil {
+			c.packetLogger.Warn("Failed to encrypt WireGuard packet",
+				zap.String("client", c.name),
+				zap.String("listenAddress", c.wgListen),
+				zap.Stringer("clientAddress", uplink.clientAddrPort),
+				zap.Error(err),
+			)
+			c.putPacketBuf(buf)
+			return
+		}
+
+		bufvec[count] = buf
+		iovec[count].Base = &buf[swgpPacketStart]
+		iovec[count].SetLen(swgpPacketLength)
+		count++
+		batchPackets += packets
+		batchWgBytes += uint64(wgBytes)
+
+		if packets > 1 {
+			c.bundlesSent.Add(1)
+			c.bundledPackets.Add(uint64(packets))
+		}
+	}
+
 	for {
-		var (
-			count       int
-			isHandshake bool
-		)
+		var isHandshake bool
+		count = 0
+		batchPackets = 0
+		batchWgBytes = 0
 
 		// Block on first dequeue op.
 		dequeuedPacket, ok := <-uplink.proxyConnSendCh
@@ -408,53 +522,91 @@ main:
 
 	dequeue:
 		for {
+			wgPacket := dequeuedPacket.buf[dequeuedPacket.start : dequeuedPacket.start+dequeuedPacket.length]
+			uplink.handshakeTimer.Sent(wgPacket)
+			uplink.pendingInitiation.Store(wgPacket)
+
 			// Update proxyConn read deadline when a handshake initiation/response message is received.
-			switch dequeuedPacket.buf[dequeuedPacket.start] {
+			switch wgPacket[0] {
 			case packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageTypeHandshakeResponse:
 				isHandshake = true
 			}
 
-			swgpPacketStart, swgpPacketLength, err := c.handler.EncryptZeroCopy(dequeuedPacket.buf, dequeuedPacket.start, dequeuedPacket.length)
-			if err != nil {
-				c.logger.Warn("Failed to encrypt WireGuard packet",
-					zap.String("client", c.name),
-					zap.String("listenAddress", c.wgListen),
-					zap.Stringer("clientAddress", uplink.clientAddrPort),
-					zap.Error(err),
-				)
-
-				c.putPacketBuf(dequeuedPacket.buf)
-
-				if count == 0 {
-					continue main
+			if c.proxyCoalesce {
+				if bundle.packets > 0 {
+					if bundle.add(wgPacket) {
+						c.putPacketBuf(dequeuedPacket.buf)
+						goto next
+					}
+					send(bundle.buf, bundle.start, bundle.length, bundle.packets, bundle.wgBytes)
+					bundle.close()
+				}
+				if packet.IsBundleable(wgPacket) {
+					bundle.open(dequeuedPacket.buf, dequeuedPacket.start, dequeuedPacket.length, tailroom)
+					if coalesceTimer != nil {
+						bundleDeadline = time.Now().Add(c.coalesceDelay)
+					}
+					goto next
 				}
-				goto next
 			}
 
-			bufvec[count] = dequeuedPacket.buf
-			iovec[count].Base = &dequeuedPacket.buf[swgpPacketStart]
-			iovec[count].SetLen(swgpPacketLength)
-			count++
-			wgBytesSent += uint64(dequeuedPacket.length)
+			send(dequeuedPacket.buf, dequeuedPacket.start, dequeuedPacket.length, 1, dequeuedPacket.length)
 
-			if count == c.relayBatchSize {
+		next:
+			// The open bundle takes a slot in the batch when it is sent.
+			if count >= c.relayBatchSize || bundle.packets > 0 && count+1 >= c.relayBatchSize {
 				break
 			}
 
-		next:
 			select {
 			case dequeuedPacket, ok = <-uplink.proxyConnSendCh:
 				if !ok {
 					break dequeue
 				}
+				continue
 			default:
+			}
+
+			// Hold the open bundle for more packets until its deadline.
+			if bundle.packets == 0 || coalesceTimer == nil {
+				break
+			}
+			wait := time.Until(bundleDeadline)
+			if wait <= 0 {
+				break
+			}
+			coalesceTimer.Reset(wait)
+
+			select {
+			case dequeuedPacket, ok = <-uplink.proxyConnSendCh:
+				if !coalesceTimer.Stop() {
+					<-coalesceTimer.C
+				}
+				if !ok {
+					break dequeue
+				}
+			case <-coalesceTimer.C:
 				break dequeue
 			}
 		}
 
+		if bundle.packets > 0 {
+			send(bundle.buf, bundle.start, bundle.length, bundle.packets, bundle.wgBytes)
+			bundle.close()
+		}
+
+		if count == 0 {
+			if !ok {
+				break
+			}
+			continue
+		}
+
 		// Batch write.
 		if err := uplink.proxyConn.WriteMsgs(msgvec[:count], 0); err != nil {
-			c.logger.Warn("Failed to write swgpPacket to proxyConn",
+			c.sendErrors.Add(1)
+			c.publishEvent(EventSendError, uplink.clientAddrPort, err)
+			c.logLimiter.Warn(c.connLogger, "Failed to write swgpPacket to proxyConn", uplink.clientAddrPort,
 				zap.String("client", c.name),
 				zap.String("listenAddress", c.wgListen),
 				zap.Stringer("clientAddress", uplink.clientAddrPort),
@@ -465,7 +617,7 @@ main:
 
 		if isHandshake {
 			if err := uplink.proxyConn.SetReadDeadline(time.Now().Add(RejectAfterTime)); err != nil {
-				c.logger.Warn("Failed to SetReadDeadline on proxyConn",
+				c.connLogger.Warn("Failed to SetReadDeadline on proxyConn",
 					zap.String("client", c.name),
 					zap.String("listenAddress", c.wgListen),
 					zap.Stringer("clientAddress", uplink.clientAddrPort),
@@ -476,7 +628,10 @@ main:
 		}
 
 		sendmmsgCount++
-		packetsSent += uint64(count)
+		packetsSent += uint64(batchPackets)
+		wgBytesSent += batchWgBytes
+		c.uplinkTraffic.add(uint64(batchPackets), batchWgBytes)
+		c.proxySent(uplink.clientAddrPort)
 		if burstBatchSize < count {
 			burstBatchSize = count
 		}
@@ -515,25 +670,34 @@ func (c *client) relayProxyToWgSendmmsg(downlink clientNatDownlinkMmsg) {
 	clientPktinfop := downlink.clientPktinfop
 	clientPktinfo := *clientPktinfop
 
+	// The send batch holds at least one full bundle.
+	sendBatchSize := c.relayBatchSize
+	if sendBatchSize < packet.MaxBundlePackets {
+		sendBatchSize = packet.MaxBundlePackets
+	}
+
 	name, namelen := conn.AddrPortToSockaddr(downlink.clientAddrPort)
 	savec := make([]unix.RawSockaddrInet6, c.relayBatchSize)
 	bufvec := make([][]byte, c.relayBatchSize)
 	riovec := make([]unix.Iovec, c.relayBatchSize)
-	siovec := make([]unix.Iovec, c.relayBatchSize)
+	siovec := make([]unix.Iovec, sendBatchSize)
 	rmsgvec := make([]conn.Mmsghdr, c.relayBatchSize)
-	smsgvec := make([]conn.Mmsghdr, c.relayBatchSize)
+	smsgvec := make([]conn.Mmsghdr, sendBatchSize)
 
 	for i := 0; i < c.relayBatchSize; i++ {
-		bufvec[i] = make([]byte, c.maxProxyPacketSize)
+		// Allocate one extra byte to detect oversized packets.
+		bufvec[i] = make([]byte, c.maxProxyPacketSize+1)
 
 		riovec[i].Base = &bufvec[i][0]
-		riovec[i].SetLen(c.maxProxyPacketSize)
+		riovec[i].SetLen(c.maxProxyPacketSize + 1)
 
 		rmsgvec[i].Msghdr.Name = (*byte)(unsafe.Pointer(&savec[i]))
 		rmsgvec[i].Msghdr.Namelen = unix.SizeofSockaddrInet6
 		rmsgvec[i].Msghdr.Iov = &riovec[i]
 		rmsgvec[i].Msghdr.SetIovlen(1)
+	}
 
+	for i := range smsgvec {
 		smsgvec[i].Msghdr.Name = name
 		smsgvec[i].Msghdr.Namelen = namelen
 		smsgvec[i].Msghdr.Iov = &siovec[i]
@@ -542,13 +706,55 @@ func (c *client) relayProxyToWgSendmmsg(downlink clientNatDownlinkMmsg) {
 		smsgvec[i].Msghdr.SetControllen(len(clientPktinfo))
 	}
 
+	var (
+		ns           int
+		batchWgBytes uint64
+		wgPackets    [][]byte
+	)
+
+	// flush writes the ns packets in the batch to wgConn.
+	flush := func() {
+		if cpp := downlink.clientPktinfo.Load(); cpp != clientPktinfop {
+			clientPktinfo = *cpp
+			clientPktinfop = cpp
+
+			for i := range smsgvec {
+				smsgvec[i].Msghdr.Control = &clientPktinfo[0]
+				smsgvec[i].Msghdr.SetControllen(len(clientPktinfo))
+			}
+		}
+
+		if err := downlink.wgConn.WriteMsgs(smsgvec[:ns], 0); err != nil {
+			c.sendErrors.Add(1)
+			c.publishEvent(EventSendError, downlink.clientAddrPort, err)
+			c.logLimiter.Warn(c.connLogger, "Failed to write wgPacket to wgConn", downlink.clientAddrPort,
+				zap.String("client", c.name),
+				zap.String("listenAddress", c.wgListen),
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.Stringer("proxyAddress", downlink.proxyAddrPort),
+				zap.Error(err),
+			)
+		}
+
+		sendmmsgCount++
+		packetsSent += uint64(ns)
+		wgBytesSent += batchWgBytes
+		c.downlinkTraffic.add(uint64(ns), batchWgBytes)
+		if burstBatchSize < ns {
+			burstBatchSize = ns
+		}
+
+		ns = 0
+		batchWgBytes = 0
+	}
+
 	for {
 		nr, err := downlink.proxyConn.ReadMsgs(rmsgvec, 0)
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				break
 			}
-			c.logger.Warn("Failed to read from proxyConn",
+			c.connLogger.Warn("Failed to read from proxyConn",
 				zap.String("client", c.name),
 				zap.String("listenAddress", c.wgListen),
 				zap.Stringer("clientAddress", downlink.clientAddrPort),
@@ -558,7 +764,6 @@ func (c *client) relayProxyToWgSendmmsg(downlink clientNatDownlinkMmsg) {
 			continue
 		}
 
-		var ns int
 		rmsgvecn := rmsgvec[:nr]
 
 		for i := range rmsgvecn {
@@ -566,7 +771,7 @@ func (c *client) relayProxyToWgSendmmsg(downlink clientNatDownlinkMmsg) {
 
 			packetSourceAddrPort, err := conn.SockaddrToAddrPort(msg.Msghdr.Name, msg.Msghdr.Namelen)
 			if err != nil {
-				c.logger.Warn("Failed to parse sockaddr of packet from proxyConn",
+				c.connLogger.Warn("Failed to parse sockaddr of packet from proxyConn",
 					zap.String("client", c.name),
 					zap.String("listenAddress", c.wgListen),
 					zap.Stringer("clientAddress", downlink.clientAddrPort),
@@ -588,9 +793,21 @@ func (c *client) relayProxyToWgSendmmsg(downlink clientNatDownlinkMmsg) {
 				continue
 			}
 
+			if int(msg.Msglen) > c.maxProxyPacketSize {
+				c.oversizedPackets.Add(1)
+				c.logLimiter.Warn(c.logger, "Dropping oversized packet from proxyConn", downlink.clientAddrPort,
+					zap.String("client", c.name),
+					zap.String("listenAddress", c.wgListen),
+					zap.Stringer("clientAddress", downlink.clientAddrPort),
+					zap.Stringer("proxyAddress", downlink.proxyAddrPort),
+					zap.Int("maxPacketLength", c.maxProxyPacketSize),
+				)
+				continue
+			}
+
 			err = conn.ParseFlagsForError(int(msg.Msghdr.Flags))
 			if err != nil {
-				c.logger.Warn("Packet from proxyConn discarded",
+				c.connLogger.Warn("Packet from proxyConn discarded",
 					zap.String("client", c.name),
 					zap.String("listenAddress", c.wgListen),
 					zap.Stringer("clientAddress", downlink.clientAddrPort),
@@ -605,7 +822,9 @@ func (c *client) relayProxyToWgSendmmsg(downlink clientNatDownlinkMmsg) {
 			packetBuf := bufvec[i]
 			wgPacketStart, wgPacketLength, err := c.handler.DecryptZeroCopy(packetBuf, 0, int(msg.Msglen))
 			if err != nil {
-				c.logger.Warn("Failed to decrypt swgpPacket",
+				c.decryptFailures.Add(1)
+				c.publishEvent(EventDecryptFailure, downlink.clientAddrPort, err)
+				c.logLimiter.Warn(c.packetLogger, "Failed to decrypt swgpPacket", downlink.clientAddrPort,
 					zap.String("client", c.name),
 					zap.String("listenAddress", c.wgListen),
 					zap.Stringer("clientAddress", downlink.clientAddrPort),
@@ -616,42 +835,49 @@ func (c *client) relayProxyToWgSendmmsg(downlink clientNatDownlinkMmsg) {
 				continue
 			}
 
-			siovec[ns].Base = &packetBuf[wgPacketStart]
-			siovec[ns].SetLen(wgPacketLength)
-			ns++
-			wgBytesSent += uint64(wgPacketLength)
-		}
+			if err = packet.CheckWireGuardPacket(packetBuf[wgPacketStart : wgPacketStart+wgPacketLength]); err != nil {
+				c.malformedPackets.Add(1)
+				c.logLimiter.Warn(c.packetLogger, "Dropping malformed WireGuard packet", downlink.clientAddrPort,
+					zap.String("client", c.name),
+					zap.String("listenAddress", c.wgListen),
+					zap.Stringer("clientAddress", downlink.clientAddrPort),
+					zap.Stringer("proxyAddress", downlink.proxyAddrPort),
+					zap.Int("packetLength", wgPacketLength),
+					zap.Error(err),
+				)
+				continue
+			}
 
-		if ns == 0 {
-			continue
-		}
+			c.proxyReceived(downlink.clientAddrPort)
 
-		if cpp := downlink.clientPktinfo.Load(); cpp != clientPktinfop {
-			clientPktinfo = *cpp
-			clientPktinfop = cpp
+			if rtt, ok := downlink.handshakeTimer.Received(packetBuf[wgPacketStart : wgPacketStart+wgPacketLength]); ok {
+				c.handshakeRTT.Update(rtt)
+			}
 
-			for i := range smsgvec {
-				smsgvec[i].Msghdr.Control = &clientPktinfo[0]
-				smsgvec[i].Msghdr.SetControllen(len(clientPktinfo))
+			if packet.IsCookieChallenge(packetBuf[wgPacketStart : wgPacketStart+wgPacketLength]) {
+				c.answerCookieChallenge(downlink.proxyConn.UDPConn, packetBuf[:downlink.maxProxyPacketSize], wgPacketStart, wgPacketLength, downlink.clientAddrPort, downlink.proxyAddrPort, downlink.pendingInitiation.Load())
+				continue
 			}
-		}
 
-		err = downlink.wgConn.WriteMsgs(smsgvec[:ns], 0)
-		if err != nil {
-			c.logger.Warn("Failed to write wgPacket to wgConn",
-				zap.String("client", c.name),
-				zap.String("listenAddress", c.wgListen),
-				zap.Stringer("clientAddress", downlink.clientAddrPort),
-				zap.Stringer("proxyAddress", downlink.proxyAddrPort),
-				zap.Error(err),
-			)
+			// A bundle is relayed as the packets it carries, which may not fit in the rest of the batch.
+			wgPackets = unbundle(wgPackets, packetBuf[wgPacketStart:wgPacketStart+wgPacketLength])
+			if ns+len(wgPackets) > len(smsgvec) {
+				flush()
+			}
+
+			for _, wgPacket := range wgPackets {
+				siovec[ns].Base = &wgPacket[0]
+				siovec[ns].SetLen(len(wgPacket))
+				ns++
+				batchWgBytes += uint64(len(wgPacket))
+			}
 		}
 
-		sendmmsgCount++
-		packetsSent += uint64(ns)
-		if burstBatchSize < ns {
-			burstBatchSize = ns
+		if ns == 0 {
+			continue
 		}
+
+		flush()
 	}
 
 	c.logger.Info("Finished relay proxyConn -> wgConn",
@@ -663,5 +889,6 @@ func (c *client) relayProxyToWgSendmmsg(downlink clientNatDownlinkMmsg) {
 		zap.Uint64("packetsSent", packetsSent),
 		zap.Uint64("wgBytesSent", wgBytesSent),
 		zap.Int("burstBatchSize", burstBatchSize),
+		zap.Duration("handshakeRTT", downlink.handshakeTimer.RTT()),
 	)
 }
@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"net"
 	"net/netip"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/database64128/swgp-go/conn"
 	"github.com/database64128/swgp-go/packet"
@@ -15,7 +19,7 @@ import (
 
 var logger *zap.Logger
 
-func generateTestPSK(t *testing.T) []byte {
+func generateTestPSK(t testing.TB) []byte {
 	psk := make([]byte, 32)
 	_, err := rand.Read(psk)
 	if err != nil {
@@ -38,67 +42,33 @@ func testClientServerHandshake(t *testing.T, ctx context.Context, serverConfig S
 	}
 	defer m.Stop()
 
-	// Make packets.
-	handshakeInitiationPacket := make([]byte, packet.WireGuardMessageLengthHandshakeInitiation)
-	handshakeInitiationPacket[0] = packet.WireGuardMessageTypeHandshakeInitiation
-	if _, err = rand.Read(handshakeInitiationPacket[1:]); err != nil {
-		t.Fatal(err)
-	}
-	expectedHandshakeInitiationPacket := make([]byte, packet.WireGuardMessageLengthHandshakeInitiation)
-	copy(expectedHandshakeInitiationPacket, handshakeInitiationPacket)
-	receivedHandshakeInitiationPacket := make([]byte, packet.WireGuardMessageLengthHandshakeInitiation+1)
+	peer := newFakeWgPeer(t, clientConfig.WgListen)
+	endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
 
-	handshakeResponsePacket := make([]byte, packet.WireGuardMessageLengthHandshakeResponse)
-	handshakeResponsePacket[0] = packet.WireGuardMessageTypeHandshakeResponse
-	if _, err = rand.Read(handshakeResponsePacket[1:]); err != nil {
-		t.Fatal(err)
-	}
-	expectedHandshakeResponsePacket := make([]byte, packet.WireGuardMessageLengthHandshakeResponse)
-	copy(expectedHandshakeResponsePacket, handshakeResponsePacket)
-	receivedHandshakeResponsePacket := make([]byte, packet.WireGuardMessageLengthHandshakeResponse+1)
+	// Peer sends handshake initiation, and the endpoint receives it.
+	handshakeInitiationPacket := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+	peer.Send(handshakeInitiationPacket)
+	endpoint.Expect(handshakeInitiationPacket)
 
-	// Start client and server conns.
-	clientConn, err := net.Dial("udp", clientConfig.WgListen)
-	if err != nil {
-		t.Fatal(err)
-	}
-	serverConn, err := conn.DefaultUDPClientListenConfig.ListenUDP(ctx, "udp", serverConfig.WgEndpoint.String())
-	if err != nil {
-		t.Fatal(err)
-	}
+	// Endpoint sends handshake response, and the peer receives it.
+	handshakeResponsePacket := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeResponse, packet.WireGuardMessageLengthHandshakeResponse)
+	endpoint.Send(handshakeResponsePacket)
+	peer.Expect(handshakeResponsePacket)
 
-	// Client sends handshake initiation.
-	_, err = clientConn.Write(handshakeInitiationPacket)
-	if err != nil {
-		t.Fatal(err)
+	// Both sides must have measured the handshake round trip.
+	for _, ss := range m.Stats() {
+		if ss.HandshakeRTT <= 0 {
+			t.Errorf("Expected positive handshake RTT for %s %s, got %v", ss.Role, ss.Name, ss.HandshakeRTT)
+		}
 	}
 
-	// Server receives handshake initiation.
-	n, addr, err := serverConn.ReadFromUDPAddrPort(receivedHandshakeInitiationPacket)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	// Server verifies handshake initiation.
-	if !bytes.Equal(receivedHandshakeInitiationPacket[:n], expectedHandshakeInitiationPacket) {
-		t.Error("Received handshake initiation packet does not match expectation.")
-	}
-
-	// Server sends handshake response.
-	_, err = serverConn.WriteToUDPAddrPort(handshakeResponsePacket, addr)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	// Client receives handshake response.
-	n, err = clientConn.Read(receivedHandshakeResponsePacket)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	// Client verifies handshake response.
-	if !bytes.Equal(receivedHandshakeResponsePacket[:n], expectedHandshakeResponsePacket) {
-		t.Error("Received handshake response packet does not match expectation.")
+	// The handshake initiation must have gone through the cookie gate.
+	if serverConfig.RequireCookie {
+		for _, ss := range m.Stats() {
+			if ss.Role == "server" && ss.CookieChallenges != 1 {
+				t.Errorf("Expected 1 cookie challenge, got %d", ss.CookieChallenges)
+			}
+		}
 	}
 }
 
@@ -150,91 +120,124 @@ func TestClientServerHandshakeParanoid(t *testing.T) {
 	testClientServerHandshake(t, context.Background(), serverConfig, clientConfig)
 }
 
-func testClientServerDataPackets(t *testing.T, ctx context.Context, serverConfig ServerConfig, clientConfig ClientConfig) {
-	sc := Config{
-		Servers: []ServerConfig{serverConfig},
-		Clients: []ClientConfig{clientConfig},
-	}
-	m, err := sc.Manager(logger)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if err = m.Start(ctx); err != nil {
-		t.Fatal(err)
+func TestClientServerHandshakePassthrough(t *testing.T) {
+	serverConfig := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: ":20264",
+		ProxyMode:   "passthrough",
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20265)),
+		MTU:         1500,
 	}
-	defer m.Stop()
 
-	// Make packets.
-	smallDataPacket := make([]byte, 1024)
-	smallDataPacket[0] = packet.WireGuardMessageTypeData
-	if _, err = rand.Read(smallDataPacket[1:]); err != nil {
-		t.Fatal(err)
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20266",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20264)),
+		ProxyMode:     "passthrough",
+		MTU:           1500,
 	}
-	expectedSmallDataPacket := make([]byte, 1024)
-	copy(expectedSmallDataPacket, smallDataPacket)
-	receivedSmallDataPacket := make([]byte, 1024+1)
 
-	bigDataPacket := make([]byte, 2048)
-	bigDataPacket[0] = packet.WireGuardMessageTypeData
-	if _, err = rand.Read(bigDataPacket[1:]); err != nil {
-		t.Fatal(err)
-	}
+	testClientServerHandshake(t, context.Background(), serverConfig, clientConfig)
+}
 
-	// Start client and server conns.
-	clientConn, err := net.Dial("udp", clientConfig.WgListen)
-	if err != nil {
-		t.Fatal(err)
-	}
-	serverConn, err := conn.DefaultUDPClientListenConfig.ListenUDP(ctx, "udp", serverConfig.WgEndpoint.String())
-	if err != nil {
-		t.Fatal(err)
-	}
+func TestClientServerHandshakeRequireCookieZeroOverhead(t *testing.T) {
+	psk := generateTestPSK(t)
 
-	// Client sends big data packet.
-	_, err = clientConn.Write(bigDataPacket)
-	if err != nil {
-		t.Fatal(err)
+	serverConfig := ServerConfig{
+		Name:          "wg0",
+		ProxyListen:   ":20250",
+		ProxyMode:     "zero-overhead",
+		ProxyPSK:      psk,
+		WgEndpoint:    conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20251)),
+		MTU:           1500,
+		RequireCookie: true,
 	}
 
-	// Client sends small data packet.
-	_, err = clientConn.Write(smallDataPacket)
-	if err != nil {
-		t.Fatal(err)
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20252",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20250)),
+		ProxyMode:     "zero-overhead",
+		ProxyPSK:      psk,
+		MTU:           1500,
 	}
 
-	// Server receives small data packet.
-	n, addr, err := serverConn.ReadFromUDPAddrPort(receivedSmallDataPacket)
-	if err != nil {
-		t.Fatal(err)
-	}
+	testClientServerHandshake(t, context.Background(), serverConfig, clientConfig)
+}
+
+func TestClientServerHandshakeRequireCookieParanoidNoBatch(t *testing.T) {
+	psk := generateTestPSK(t)
 
-	// Server verifies small data packet.
-	if !bytes.Equal(receivedSmallDataPacket[:n], expectedSmallDataPacket) {
-		t.Error("Received small data packet does not match expectation.")
+	serverConfig := ServerConfig{
+		Name:          "wg0",
+		ProxyListen:   ":20253",
+		ProxyMode:     "paranoid",
+		ProxyPSK:      psk,
+		WgEndpoint:    conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20254)),
+		MTU:           1500,
+		RequireCookie: true,
+		PerfConfig: PerfConfig{
+			BatchMode: "no",
+		},
 	}
 
-	// Server sends big data packet.
-	_, err = serverConn.WriteToUDPAddrPort(bigDataPacket, addr)
-	if err != nil {
-		t.Fatal(err)
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20255",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20253)),
+		ProxyMode:     "paranoid",
+		ProxyPSK:      psk,
+		MTU:           1500,
+		PerfConfig: PerfConfig{
+			BatchMode: "no",
+		},
 	}
 
-	// Server sends small data packet.
-	_, err = serverConn.WriteToUDPAddrPort(smallDataPacket, addr)
+	testClientServerHandshake(t, context.Background(), serverConfig, clientConfig)
+}
+
+func testClientServerDataPackets(t *testing.T, ctx context.Context, serverConfig ServerConfig, clientConfig ClientConfig) {
+	testClientServerDataPacketsWithLengths(t, ctx, serverConfig, clientConfig, 1024, 2048)
+}
+
+// testClientServerDataPacketsWithLengths tests that a data packet of smallLength passes through
+// the client and server in both directions, and that a data packet of bigLength is dropped.
+func testClientServerDataPacketsWithLengths(t *testing.T, ctx context.Context, serverConfig ServerConfig, clientConfig ClientConfig, smallLength, bigLength int) {
+	sc := Config{
+		Servers: []ServerConfig{serverConfig},
+		Clients: []ClientConfig{clientConfig},
+	}
+	m, err := sc.Manager(logger)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// Client receives small data packet.
-	n, err = clientConn.Read(receivedSmallDataPacket)
-	if err != nil {
+	if err = m.Start(ctx); err != nil {
 		t.Fatal(err)
 	}
+	defer m.Stop()
 
-	// Client verifies small data packet.
-	if !bytes.Equal(receivedSmallDataPacket[:n], expectedSmallDataPacket) {
-		t.Error("Received small data packet does not match expectation.")
+	peer := newFakeWgPeer(t, clientConfig.WgListen)
+	endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+
+	// The TCP transport only sets up a session once the first packet is a handshake message.
+	if serverConfig.ProxyTransport == proxyTransportTCP {
+		handshakeInitiationPacket := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+		peer.Send(handshakeInitiationPacket)
+		endpoint.Expect(handshakeInitiationPacket)
 	}
+
+	smallDataPacket := newTestWgPacket(t, packet.WireGuardMessageTypeData, smallLength)
+	bigDataPacket := newTestWgPacket(t, packet.WireGuardMessageTypeData, bigLength)
+
+	// Peer sends big and small data packets. Only the small one reaches the endpoint.
+	peer.Send(bigDataPacket)
+	peer.Send(smallDataPacket)
+	endpoint.Expect(smallDataPacket)
+
+	// Endpoint sends big and small data packets. Only the small one reaches the peer.
+	endpoint.Send(bigDataPacket)
+	endpoint.Send(smallDataPacket)
+	peer.Expect(smallDataPacket)
 }
 
 func TestClientServerDataPacketsZeroOverhead(t *testing.T) {
@@ -285,6 +288,467 @@ func TestClientServerDataPacketsParanoid(t *testing.T) {
 	testClientServerDataPackets(t, context.Background(), serverConfig, clientConfig)
 }
 
+func TestClientServerDataPacketsExtensible(t *testing.T) {
+	psk := generateTestPSK(t)
+
+	serverConfig := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: ":20291",
+		ProxyMode:   "extensible",
+		ProxyPSK:    psk,
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20292)),
+		MTU:         1500,
+	}
+
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20293",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20291)),
+		ProxyMode:     "extensible",
+		ProxyPSK:      psk,
+		MTU:           1500,
+	}
+
+	testClientServerDataPackets(t, context.Background(), serverConfig, clientConfig)
+}
+
+func TestClientServerDataPacketsIntegrity(t *testing.T) {
+	psk := generateTestPSK(t)
+
+	serverConfig := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: ":20437",
+		ProxyMode:   "integrity",
+		ProxyPSK:    psk,
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20438)),
+		MTU:         1500,
+	}
+
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20439",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20437)),
+		ProxyMode:     "integrity",
+		ProxyPSK:      psk,
+		MTU:           1500,
+	}
+
+	testClientServerDataPackets(t, context.Background(), serverConfig, clientConfig)
+}
+
+func TestClientServerDataPacketsAsymmetricPSK(t *testing.T) {
+	uplinkPSK := generateTestPSK(t)
+	downlinkPSK := generateTestPSK(t)
+
+	serverConfig := ServerConfig{
+		Name:             "wg0",
+		ProxyListen:      ":20308",
+		ProxyMode:        "paranoid",
+		ProxyPSKInbound:  uplinkPSK,
+		ProxyPSKOutbound: downlinkPSK,
+		WgEndpoint:       conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20309)),
+		MTU:              1500,
+	}
+
+	clientConfig := ClientConfig{
+		Name:             "wg0",
+		WgListen:         ":20310",
+		ProxyEndpoint:    conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20308)),
+		ProxyMode:        "paranoid",
+		ProxyPSKInbound:  downlinkPSK,
+		ProxyPSKOutbound: uplinkPSK,
+		MTU:              1500,
+	}
+
+	testClientServerDataPackets(t, context.Background(), serverConfig, clientConfig)
+}
+
+func TestClientServerDataPacketsAsymmetricMode(t *testing.T) {
+	for _, c := range []struct {
+		name           string
+		uplinkMode     string
+		downlinkMode   string
+		proxyTransport string
+		proxyPort      uint16
+		wgPort         uint16
+		wgListenPort   uint16
+	}{
+		{"ParanoidUplink", "paranoid", "zero-overhead", "", 20422, 20423, 20424},
+		{"PassthroughUplink", "passthrough", "paranoid", "", 20425, 20426, 20427},
+		{"TCP", "paranoid", "passthrough", proxyTransportTCP, 20428, 20429, 20430},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			psk := generateTestPSK(t)
+
+			serverConfig := ServerConfig{
+				Name:              "wg0",
+				ProxyListen:       fmt.Sprintf(":%d", c.proxyPort),
+				ProxyModeInbound:  c.uplinkMode,
+				ProxyModeOutbound: c.downlinkMode,
+				ProxyPSK:          psk,
+				ProxyTransport:    c.proxyTransport,
+				WgEndpoint:        conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPort)),
+				MTU:               1500,
+			}
+
+			clientConfig := ClientConfig{
+				Name:              "wg0",
+				WgListen:          fmt.Sprintf(":%d", c.wgListenPort),
+				ProxyEndpoint:     conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.proxyPort)),
+				ProxyModeInbound:  c.downlinkMode,
+				ProxyModeOutbound: c.uplinkMode,
+				ProxyPSK:          psk,
+				ProxyTransport:    c.proxyTransport,
+				MTU:               1500,
+			}
+
+			testClientServerDataPackets(t, context.Background(), serverConfig, clientConfig)
+		})
+	}
+}
+
+func TestDirectionalProxyModes(t *testing.T) {
+	for _, c := range []struct {
+		name                                 string
+		proxyMode, inboundMode, outboundMode string
+		wantInbound, wantOutbound            string
+		ok                                   bool
+	}{
+		{"Symmetric", "paranoid", "", "", "paranoid", "paranoid", true},
+		{"Directional", "", "paranoid", "zero-overhead", "paranoid", "zero-overhead", true},
+		{"InboundOnly", "", "paranoid", "", "", "", false},
+		{"OutboundOnly", "", "", "paranoid", "", "", false},
+		{"Both", "paranoid", "paranoid", "zero-overhead", "", "", false},
+		{"Keyed", "", proxyModeZeroOverheadKeyed, "zero-overhead", "", "", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			inboundMode, outboundMode, err := directionalProxyModes(c.proxyMode, c.inboundMode, c.outboundMode)
+			if ok := err == nil; ok != c.ok {
+				t.Fatalf("Expected ok %v, got error %v", c.ok, err)
+			}
+			if inboundMode != c.wantInbound || outboundMode != c.wantOutbound {
+				t.Errorf("Got modes %q, %q, want %q, %q", inboundMode, outboundMode, c.wantInbound, c.wantOutbound)
+			}
+		})
+	}
+}
+
+func TestGetPacketHandlerDirectionalPSK(t *testing.T) {
+	psk := generateTestPSK(t)
+	for _, c := range []struct {
+		name                              string
+		proxyPSK, inboundPSK, outboundPSK []byte
+		ok                                bool
+	}{
+		{"Symmetric", psk, nil, nil, true},
+		{"Directional", nil, psk, generateTestPSK(t), true},
+		{"InboundOnly", nil, psk, nil, false},
+		{"OutboundOnly", nil, nil, psk, false},
+		{"Both", psk, psk, psk, false},
+		{"ShortInbound", nil, psk[:16], psk, false},
+		{"ShortOutbound", nil, psk, psk[:16], false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := getPacketHandler("paranoid", "paranoid", c.proxyPSK, c.inboundPSK, c.outboundPSK, nil, nil)
+			if ok := err == nil; ok != c.ok {
+				t.Errorf("Expected ok %v, got error %v", c.ok, err)
+			}
+		})
+	}
+}
+
+func TestClientServerHandshakeTCPZeroOverhead(t *testing.T) {
+	psk := generateTestPSK(t)
+
+	serverConfig := ServerConfig{
+		Name:           "wg0",
+		ProxyListen:    ":20270",
+		ProxyMode:      "zero-overhead",
+		ProxyPSK:       psk,
+		WgEndpoint:     conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20271)),
+		MTU:            1500,
+		ProxyTransport: "tcp",
+	}
+
+	clientConfig := ClientConfig{
+		Name:           "wg0",
+		WgListen:       ":20272",
+		ProxyEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20270)),
+		ProxyMode:      "zero-overhead",
+		ProxyPSK:       psk,
+		MTU:            1500,
+		ProxyTransport: "tcp",
+	}
+
+	testClientServerHandshake(t, context.Background(), serverConfig, clientConfig)
+}
+
+func TestClientServerDataPacketsTCPParanoid(t *testing.T) {
+	psk := generateTestPSK(t)
+
+	serverConfig := ServerConfig{
+		Name:           "wg0",
+		ProxyListen:    ":20273",
+		ProxyMode:      "paranoid",
+		ProxyPSK:       psk,
+		WgEndpoint:     conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20274)),
+		MTU:            1500,
+		ProxyTransport: "tcp",
+	}
+
+	clientConfig := ClientConfig{
+		Name:           "wg0",
+		WgListen:       ":20275",
+		ProxyEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20273)),
+		ProxyMode:      "paranoid",
+		ProxyPSK:       psk,
+		MTU:            1500,
+		ProxyTransport: "tcp",
+	}
+
+	testClientServerDataPackets(t, context.Background(), serverConfig, clientConfig)
+}
+
+func TestClientServerHandshakeIPv6Only(t *testing.T) {
+	psk := generateTestPSK(t)
+
+	serverConfig := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: ":20276",
+		ProxyMode:   "zero-overhead",
+		ProxyPSK:    psk,
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20277)),
+		MTU:         1500,
+		Network:     "udp6",
+	}
+
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20278",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20276)),
+		ProxyMode:     "zero-overhead",
+		ProxyPSK:      psk,
+		MTU:           1500,
+	}
+
+	testClientServerHandshake(t, context.Background(), serverConfig, clientConfig)
+}
+
+func TestServerNetworkRejectsWgEndpointOfOtherFamily(t *testing.T) {
+	serverConfig := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: ":20279",
+		ProxyMode:   "zero-overhead",
+		ProxyPSK:    generateTestPSK(t),
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20280)),
+		MTU:         1500,
+		Network:     "udp4",
+	}
+
+	if _, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache()); err == nil {
+		t.Error("Server() returned nil error for an IPv6 wgEndpoint on udp4.")
+	}
+}
+
+func TestClientServerTruncatedHandshakeDropped(t *testing.T) {
+	psk := generateTestPSK(t)
+
+	serverConfig := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: ":20267",
+		ProxyMode:   "zero-overhead",
+		ProxyPSK:    psk,
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20268)),
+		MTU:         1500,
+	}
+
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20269",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20267)),
+		ProxyMode:     "zero-overhead",
+		ProxyPSK:      psk,
+		MTU:           1500,
+	}
+
+	ctx := context.Background()
+	sc := Config{
+		Servers: []ServerConfig{serverConfig},
+		Clients: []ClientConfig{clientConfig},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	handshakeInitiationPacket := make([]byte, packet.WireGuardMessageLengthHandshakeInitiation)
+	handshakeInitiationPacket[0] = packet.WireGuardMessageTypeHandshakeInitiation
+	if _, err = rand.Read(handshakeInitiationPacket[1:]); err != nil {
+		t.Fatal(err)
+	}
+	receivedPacket := make([]byte, packet.WireGuardMessageLengthHandshakeInitiation+1)
+
+	clientConn, err := net.Dial("udp", clientConfig.WgListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err := conn.DefaultUDPClientListenConfig.ListenUDP(ctx, "udp", serverConfig.WgEndpoint.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Client sends truncated handshake initiation, then a complete one.
+	if _, err = clientConn.Write(handshakeInitiationPacket[:packet.WireGuardMessageLengthHandshakeInitiation-1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = clientConn.Write(handshakeInitiationPacket); err != nil {
+		t.Fatal(err)
+	}
+
+	// Server receives only the complete handshake initiation.
+	n, _, err := serverConn.ReadFromUDPAddrPort(receivedPacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(receivedPacket[:n], handshakeInitiationPacket) {
+		t.Errorf("Received packet of length %d does not match complete handshake initiation", n)
+	}
+
+	for _, ss := range m.Stats() {
+		if ss.Role == "server" && ss.MalformedPackets != 1 {
+			t.Errorf("Expected 1 malformed packet, got %d", ss.MalformedPackets)
+		}
+	}
+}
+
+// benchmarkThroughputWindow is the maximum number of packets in flight in [BenchmarkClientServerThroughput].
+// It is kept well below the default socket buffer sizes so that loopback packets are not dropped.
+const benchmarkThroughputWindow = 32
+
+func BenchmarkClientServerThroughput(b *testing.B) {
+	for _, proxyMode := range []string{"zero-overhead", "paranoid", "extensible", "integrity", "passthrough"} {
+		for _, size := range []int{64, 256, 1024} {
+			b.Run(fmt.Sprintf("%s/%d", proxyMode, size), func(b *testing.B) {
+				benchmarkClientServerThroughput(b, proxyMode, size)
+			})
+		}
+	}
+}
+
+// benchmarkClientServerThroughput pumps b.N data packets of the given size from the client's wg side
+// through the client and server to the server's wg endpoint, and reports the received rate.
+func benchmarkClientServerThroughput(b *testing.B, proxyMode string, size int) {
+	psk := generateTestPSK(b)
+
+	serverConfig := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: ":20281",
+		ProxyMode:   proxyMode,
+		ProxyPSK:    psk,
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20282)),
+		MTU:         1500,
+	}
+
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20283",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20281)),
+		ProxyMode:     proxyMode,
+		ProxyPSK:      psk,
+		MTU:           1500,
+	}
+
+	ctx := context.Background()
+	sc := Config{
+		Servers: []ServerConfig{serverConfig},
+		Clients: []ClientConfig{clientConfig},
+	}
+	// Logging every packet would dominate the measurement.
+	m, err := sc.Manager(zap.NewNop())
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err = m.Start(ctx); err != nil {
+		b.Fatal(err)
+	}
+	defer m.Stop()
+
+	clientConn, err := net.Dial("udp", clientConfig.WgListen)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	serverConn, err := conn.DefaultUDPClientListenConfig.ListenUDP(ctx, "udp", serverConfig.WgEndpoint.String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	dataPacket := make([]byte, size)
+	dataPacket[0] = packet.WireGuardMessageTypeData
+	if _, err = rand.Read(dataPacket[1:]); err != nil {
+		b.Fatal(err)
+	}
+
+	credits := make(chan struct{}, benchmarkThroughputWindow)
+	for i := 0; i < benchmarkThroughputWindow; i++ {
+		credits <- struct{}{}
+	}
+	done := make(chan struct{})
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			select {
+			case <-credits:
+			case <-done:
+				return
+			}
+			if _, err := clientConn.Write(dataPacket); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+
+	var received int
+	recvBuf := make([]byte, size+1)
+	for received < b.N {
+		// A lost packet takes its credit with it. Once the window drains, give up on the rest.
+		if err = serverConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			b.Fatal(err)
+		}
+		n, _, err := serverConn.ReadFromUDPAddrPort(recvBuf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			b.Fatal(err)
+		}
+		if n != size {
+			b.Fatalf("Received packet length %d, expected %d", n, size)
+		}
+		received++
+		credits <- struct{}{}
+	}
+
+	b.StopTimer()
+	close(done)
+
+	if lost := b.N - received; lost > 0 {
+		b.Logf("Lost %d of %d packets", lost, b.N)
+	}
+	b.ReportMetric(float64(received)/b.Elapsed().Seconds(), "packets/s")
+}
+
 func TestMain(m *testing.M) {
 	var err error
 	logger, err = zap.NewDevelopment()
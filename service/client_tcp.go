@@ -0,0 +1,570 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+	"go.uber.org/zap"
+)
+
+type clientTCPEntry struct {
+	// proxyConn is the session's stream to the server, set once connected.
+	// closing is set when the service is stopping, so a connecting session must not proceed.
+	// Both are protected by the client's mutex.
+	proxyConn *net.TCPConn
+	closing   bool
+
+	clientPktinfo      atomic.Pointer[[]byte]
+	clientPktinfoCache []byte
+	proxyConnSendCh    chan<- queuedPacket
+	handshakeTimer     handshakeTimer
+}
+
+type clientTCPUplink struct {
+	clientAddrPort  netip.AddrPort
+	proxyAddrPort   netip.AddrPort
+	proxyConn       *net.TCPConn
+	proxyConnSendCh <-chan queuedPacket
+	handshakeTimer  *handshakeTimer
+	handler         packet.Handler
+}
+
+type clientTCPDownlink struct {
+	clientAddrPort     netip.AddrPort
+	clientPktinfo      *atomic.Pointer[[]byte]
+	proxyAddrPort      netip.AddrPort
+	proxyConn          *net.TCPConn
+	wgConn             *net.UDPConn
+	maxProxyPacketSize int
+	handshakeTimer     *handshakeTimer
+}
+
+func (c *client) startTCP(ctx context.Context) error {
+	wgConn, err := c.inherited.listenUDP(ctx, &c.wgConnListenConfig, "udp", c.wgListen)
+	if err != nil {
+		return err
+	}
+	c.wgConn = wgConn
+
+	// Stop cancels dials of connecting sessions.
+	dialCtx, cancel := context.WithCancel(ctx)
+	c.cancelTCPDials = cancel
+
+	c.mwg.Add(1)
+
+	go func() {
+		c.panicRecoverer.run(func() {
+			c.recvFromWgConnTCP(dialCtx, wgConn)
+		}, c.releaseTableAfterPanic)
+		c.mwg.Done()
+	}()
+
+	c.logger.Info("Started service",
+		zap.String("client", c.name),
+		zap.String("listenAddress", c.wgListen),
+		zap.String("proxyTransport", proxyTransportTCP),
+		zap.Stringer("proxyAddress", &c.proxyAddr),
+		zap.Int("wgTunnelMTU", c.wgTunnelMTU),
+	)
+	return nil
+}
+
+func (c *client) recvFromWgConnTCP(ctx context.Context, wgConn *net.UDPConn) {
+	headroom := c.handler.Headroom()
+	maxWgPacketLength := c.maxProxyPacketSize - headroom.Front - headroom.Rear
+
+	cmsgBuf := make([]byte, conn.SocketControlMessageBufferSize)
+
+	var (
+		packetsReceived uint64
+		wgBytesReceived uint64
+	)
+
+	for {
+		packetBuf := c.getPacketBuf()
+		recvBuf := packetBuf[headroom.Front : headroom.Front+maxWgPacketLength+1]
+
+		n, cmsgn, flags, clientAddrPort, err := wgConn.ReadMsgUDPAddrPort(recvBuf, cmsgBuf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				c.putPacketBuf(packetBuf)
+				break
+			}
+			c.connLogger.Warn("Failed to read from wgConn",
+				zap.String("client", c.name),
+				zap.String("listenAddress", c.wgListen),
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Int("packetLength", n),
+				zap.Error(err),
+			)
+			c.putPacketBuf(packetBuf)
+			continue
+		}
+		if n > maxWgPacketLength {
+			c.oversizedPackets.Add(1)
+			c.logLimiter.Warn(c.logger, "Dropping oversized packet from wgConn", clientAddrPort,
+				zap.String("client", c.name),
+				zap.String("listenAddress", c.wgListen),
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Int("maxPacketLength", maxWgPacketLength),
+			)
+			c.putPacketBuf(packetBuf)
+			continue
+		}
+		err = conn.ParseFlagsForError(flags)
+		if err != nil {
+			c.connLogger.Warn("Failed to read from wgConn",
+				zap.String("client", c.name),
+				zap.String("listenAddress", c.wgListen),
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Int("packetLength", n),
+				zap.Error(err),
+			)
+			c.putPacketBuf(packetBuf)
+			continue
+		}
+
+		if !c.isAllowedSource(clientAddrPort.Addr()) {
+			c.disallowedPackets.Add(1)
+			if ce := c.logger.Check(zap.DebugLevel, "Dropping packet from disallowed source"); ce != nil {
+				ce.Write(
+					zap.String("client", c.name),
+					zap.String("listenAddress", c.wgListen),
+					zap.Stringer("clientAddress", clientAddrPort),
+				)
+			}
+			c.putPacketBuf(packetBuf)
+			continue
+		}
+
+		packetsReceived++
+		wgBytesReceived += uint64(n)
+
+		c.lockTable()
+
+		natEntry, ok := c.tcpTable[clientAddrPort]
+		if !ok {
+			natEntry = &clientTCPEntry{}
+		}
+
+		cmsg := cmsgBuf[:cmsgn]
+
+		if !bytes.Equal(natEntry.clientPktinfoCache, cmsg) {
+			clientPktinfoAddr, clientPktinfoIfindex, err := conn.ParsePktinfoCmsg(cmsg)
+			if err != nil {
+				c.connLogger.Warn("Failed to parse pktinfo control message from wgConn",
+					zap.String("client", c.name),
+					zap.String("listenAddress", c.wgListen),
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Error(err),
+				)
+				c.putPacketBuf(packetBuf)
+				c.unlockTable()
+				continue
+			}
+
+			clientPktinfoCache := make([]byte, len(cmsg))
+			copy(clientPktinfoCache, cmsg)
+			natEntry.clientPktinfo.Store(&clientPktinfoCache)
+			natEntry.clientPktinfoCache = clientPktinfoCache
+
+			if ce := c.logger.Check(zap.DebugLevel, "Updated client pktinfo"); ce != nil {
+				ce.Write(
+					zap.String("client", c.name),
+					zap.String("listenAddress", c.wgListen),
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Stringer("clientPktinfoAddr", clientPktinfoAddr),
+					zap.Uint32("clientPktinfoIfindex", clientPktinfoIfindex),
+				)
+			}
+		}
+
+		if !ok {
+			proxyConnSendCh := make(chan queuedPacket, c.sendChannelCapacity)
+			natEntry.proxyConnSendCh = proxyConnSendCh
+			c.tcpTable[clientAddrPort] = natEntry
+			c.wg.Add(1)
+
+			go func() {
+				var sendChClean bool
+
+				defer func() {
+					c.mu.Lock()
+					close(proxyConnSendCh)
+					delete(c.tcpTable, clientAddrPort)
+					c.mu.Unlock()
+
+					if sendChClean {
+						c.publishEvent(EventSessionEvicted, clientAddrPort, nil)
+					} else {
+						for queuedPacket := range proxyConnSendCh {
+							c.putPacketBuf(queuedPacket.buf)
+						}
+					}
+
+					c.wg.Done()
+				}()
+
+				proxyAddrPort, err := c.proxyAddr.ResolveIPPortWithResolver(ctx, c.resolver)
+				if err != nil {
+					c.connLogger.Warn("Failed to resolve proxy address for new session",
+						zap.String("client", c.name),
+						zap.String("listenAddress", c.wgListen),
+						zap.Stringer("clientAddress", clientAddrPort),
+						zap.Error(err),
+					)
+					return
+				}
+
+				proxyConn, err := c.proxyConnListenConfig.DialTCP(ctx, "tcp", proxyAddrPort.String())
+				if err != nil {
+					c.connLogger.Warn("Failed to connect to proxy for new session",
+						zap.String("client", c.name),
+						zap.String("listenAddress", c.wgListen),
+						zap.Stringer("clientAddress", clientAddrPort),
+						zap.Stringer("proxyAddress", proxyAddrPort),
+						zap.Error(err),
+					)
+					return
+				}
+
+				err = proxyConn.SetReadDeadline(time.Now().Add(RejectAfterTime))
+				if err != nil {
+					c.connLogger.Warn("Failed to SetReadDeadline on proxyConn",
+						zap.String("client", c.name),
+						zap.String("listenAddress", c.wgListen),
+						zap.Stringer("clientAddress", clientAddrPort),
+						zap.Error(err),
+					)
+					proxyConn.Close()
+					return
+				}
+
+				c.mu.Lock()
+				if natEntry.closing {
+					c.mu.Unlock()
+					proxyConn.Close()
+					return
+				}
+				natEntry.proxyConn = proxyConn
+				c.mu.Unlock()
+
+				// No more early returns!
+				sendChClean = true
+
+				maxProxyPacketSize := c.maxProxyPacketSize
+				wgTunnelMTU := c.wgTunnelMTU
+
+				if c.proxyAddr.IsDomain() {
+					if addr := proxyAddrPort.Addr(); !addr.Is4() && !addr.Is4In6() {
+						maxProxyPacketSize = c.maxProxyPacketSizev6
+						wgTunnelMTU = c.wgTunnelMTUv6
+					}
+				}
+
+				c.publishEvent(EventSessionCreated, clientAddrPort, nil)
+
+				c.logger.Info("Client relay started",
+					zap.String("client", c.name),
+					zap.String("listenAddress", c.wgListen),
+					zap.String("proxyTransport", proxyTransportTCP),
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Stringer("proxyAddress", proxyAddrPort),
+					zap.Int("wgTunnelMTU", wgTunnelMTU),
+				)
+
+				c.wg.Add(1)
+
+				go func() {
+					c.panicRecoverer.runSession(clientAddrPort, func() {
+						c.relayWgToProxyTCP(clientTCPUplink{
+							clientAddrPort:  clientAddrPort,
+							proxyAddrPort:   proxyAddrPort,
+							proxyConn:       proxyConn,
+							proxyConnSendCh: proxyConnSendCh,
+							handshakeTimer:  &natEntry.handshakeTimer,
+							handler:         c.newSessionHandler(clientAddrPort),
+						})
+					}, func() {
+						c.stopSessionAfterUplinkPanic(proxyConn, proxyConnSendCh)
+					})
+					proxyConn.Close()
+					c.wg.Done()
+				}()
+
+				c.panicRecoverer.runSession(clientAddrPort, func() {
+					c.relayProxyToWgTCP(clientTCPDownlink{
+						clientAddrPort:     clientAddrPort,
+						clientPktinfo:      &natEntry.clientPktinfo,
+						proxyAddrPort:      proxyAddrPort,
+						proxyConn:          proxyConn,
+						wgConn:             wgConn,
+						maxProxyPacketSize: maxProxyPacketSize,
+						handshakeTimer:     &natEntry.handshakeTimer,
+					})
+				}, nil)
+				// Stream closed, or the downlink panicked. Unblock the uplink, which may be writing to a server that no longer reads.
+				proxyConn.SetDeadline(conn.ALongTimeAgo)
+			}()
+
+			if ce := c.logger.Check(zap.DebugLevel, "New client session"); ce != nil {
+				ce.Write(
+					zap.String("client", c.name),
+					zap.String("listenAddress", c.wgListen),
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Stringer("proxyAddress", &c.proxyAddr),
+				)
+			}
+		}
+
+		select {
+		case natEntry.proxyConnSendCh <- queuedPacket{packetBuf, headroom.Front, n}:
+		default:
+			c.queueFullPackets.Add(1)
+			if ce := c.logger.Check(zap.DebugLevel, "swgpPacket dropped due to full send channel"); ce != nil {
+				ce.Write(
+					zap.String("client", c.name),
+					zap.String("listenAddress", c.wgListen),
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Stringer("proxyAddress", &c.proxyAddr),
+				)
+			}
+			c.putPacketBuf(packetBuf)
+		}
+
+		c.unlockTable()
+	}
+
+	c.logger.Info("Finished receiving from wgConn",
+		zap.String("client", c.name),
+		zap.String("listenAddress", c.wgListen),
+		zap.Stringer("proxyAddress", &c.proxyAddr),
+		zap.Uint64("packetsReceived", packetsReceived),
+		zap.Uint64("wgBytesReceived", wgBytesReceived),
+	)
+}
+
+func (c *client) relayWgToProxyTCP(uplink clientTCPUplink) {
+	var (
+		packetsSent uint64
+		wgBytesSent uint64
+		broken      bool
+	)
+
+	w := newTCPFrameWriter(uplink.proxyConn)
+
+	for queuedPacket := range uplink.proxyConnSendCh {
+		// Keep draining the send channel after the stream breaks, until the session ends.
+		if broken {
+			c.putPacketBuf(queuedPacket.buf)
+			continue
+		}
+
+		uplink.handshakeTimer.Sent(queuedPacket.buf[queuedPacket.start : queuedPacket.start+queuedPacket.length])
+
+		// Update proxyConn read deadline when a handshake initiation/response message is received.
+		switch queuedPacket.buf[queuedPacket.start] {
+		case packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageTypeHandshakeResponse:
+			if err := uplink.proxyConn.SetReadDeadline(time.Now().Add(RejectAfterTime)); err != nil {
+				c.connLogger.Warn("Failed to SetReadDeadline on proxyConn",
+					zap.String("client", c.name),
+					zap.String("listenAddress", c.wgListen),
+					zap.Stringer("clientAddress", uplink.clientAddrPort),
+					zap.Stringer("proxyAddress", uplink.proxyAddrPort),
+					zap.Error(err),
+				)
+				c.putPacketBuf(queuedPacket.buf)
+				continue
+			}
+		}
+
+		swgpPacketStart, swgpPacketLength, err := uplink.handler.EncryptZeroCopy(queuedPacket.buf, queuedPacket.start, queuedPacket.length)
+		if err != nil {
+			c.packetLogger.Warn("Failed to encrypt WireGuard packet",
+				zap.String("client", c.name),
+				zap.String("listenAddress", c.wgListen),
+				zap.Stringer("clientAddress", uplink.clientAddrPort),
+				zap.Error(err),
+			)
+			c.putPacketBuf(queuedPacket.buf)
+			continue
+		}
+
+		err = writeTCPFrame(w, queuedPacket.buf[swgpPacketStart:swgpPacketStart+swgpPacketLength])
+		// Coalesce queued packets into fewer writes.
+		if err == nil && len(uplink.proxyConnSendCh) == 0 {
+			err = w.Flush()
+		}
+		c.putPacketBuf(queuedPacket.buf)
+		if err != nil {
+			// The stream was closed by the downlink or by Stop.
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				broken = true
+				continue
+			}
+			c.sendErrors.Add(1)
+			c.publishEvent(EventSendError, uplink.clientAddrPort, err)
+			c.logLimiter.Warn(c.connLogger, "Failed to write swgpPacket to proxyConn", uplink.clientAddrPort,
+				zap.String("client", c.name),
+				zap.String("listenAddress", c.wgListen),
+				zap.Stringer("clientAddress", uplink.clientAddrPort),
+				zap.Stringer("proxyAddress", uplink.proxyAddrPort),
+				zap.Error(err),
+			)
+			// The stream cannot recover. Stop the downlink to end the session.
+			uplink.proxyConn.SetReadDeadline(conn.ALongTimeAgo)
+			broken = true
+			continue
+		}
+
+		packetsSent++
+		wgBytesSent += uint64(queuedPacket.length)
+		c.uplinkTraffic.add(1, uint64(queuedPacket.length))
+		c.proxySent(uplink.clientAddrPort)
+	}
+
+	c.logger.Info("Finished relay wgConn -> proxyConn",
+		zap.String("client", c.name),
+		zap.String("listenAddress", c.wgListen),
+		zap.Stringer("clientAddress", uplink.clientAddrPort),
+		zap.Stringer("proxyAddress", uplink.proxyAddrPort),
+		zap.Uint64("packetsSent", packetsSent),
+		zap.Uint64("wgBytesSent", wgBytesSent),
+	)
+}
+
+func (c *client) relayProxyToWgTCP(downlink clientTCPDownlink) {
+	var (
+		clientPktinfop *[]byte
+		clientPktinfo  []byte
+		packetsSent    uint64
+		wgBytesSent    uint64
+	)
+
+	r := bufio.NewReader(downlink.proxyConn)
+	packetBuf := make([]byte, downlink.maxProxyPacketSize)
+
+	for {
+		n, err := readTCPFrame(r, packetBuf)
+		if err != nil {
+			var tooLargeErr *tcpFrameTooLargeError
+			if errors.As(err, &tooLargeErr) {
+				c.oversizedPackets.Add(1)
+			}
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) {
+				c.connLogger.Warn("Failed to read from proxyConn",
+					zap.String("client", c.name),
+					zap.String("listenAddress", c.wgListen),
+					zap.Stringer("clientAddress", downlink.clientAddrPort),
+					zap.Stringer("proxyAddress", downlink.proxyAddrPort),
+					zap.Error(err),
+				)
+			}
+			break
+		}
+
+		wgPacketStart, wgPacketLength, err := c.handler.DecryptZeroCopy(packetBuf, 0, n)
+		if err != nil {
+			c.decryptFailures.Add(1)
+			c.publishEvent(EventDecryptFailure, downlink.clientAddrPort, err)
+			c.logLimiter.Warn(c.packetLogger, "Failed to decrypt swgpPacket", downlink.clientAddrPort,
+				zap.String("client", c.name),
+				zap.String("listenAddress", c.wgListen),
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.Stringer("proxyAddress", downlink.proxyAddrPort),
+				zap.Int("packetLength", n),
+				zap.Error(err),
+			)
+			continue
+		}
+		wgPacket := packetBuf[wgPacketStart : wgPacketStart+wgPacketLength]
+
+		if err = packet.CheckWireGuardPacket(wgPacket); err != nil {
+			c.malformedPackets.Add(1)
+			c.logLimiter.Warn(c.packetLogger, "Dropping malformed WireGuard packet", downlink.clientAddrPort,
+				zap.String("client", c.name),
+				zap.String("listenAddress", c.wgListen),
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.Stringer("proxyAddress", downlink.proxyAddrPort),
+				zap.Int("packetLength", wgPacketLength),
+				zap.Error(err),
+			)
+			continue
+		}
+
+		c.proxyReceived(downlink.clientAddrPort)
+
+		if rtt, ok := downlink.handshakeTimer.Received(wgPacket); ok {
+			c.handshakeRTT.Update(rtt)
+		}
+
+		if cpp := downlink.clientPktinfo.Load(); cpp != clientPktinfop {
+			clientPktinfo = *cpp
+			clientPktinfop = cpp
+		}
+
+		_, _, err = conn.WriteMsgUDPAddrPort(downlink.wgConn, wgPacket, clientPktinfo, downlink.clientAddrPort)
+		if err != nil {
+			c.sendErrors.Add(1)
+			c.publishEvent(EventSendError, downlink.clientAddrPort, err)
+			c.logLimiter.Warn(c.connLogger, "Failed to write wgPacket to wgConn", downlink.clientAddrPort,
+				zap.String("client", c.name),
+				zap.String("listenAddress", c.wgListen),
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.Stringer("proxyAddress", downlink.proxyAddrPort),
+				zap.Error(err),
+			)
+		}
+
+		packetsSent++
+		wgBytesSent += uint64(wgPacketLength)
+		c.downlinkTraffic.add(1, uint64(wgPacketLength))
+	}
+
+	c.logger.Info("Finished relay proxyConn -> wgConn",
+		zap.String("client", c.name),
+		zap.String("listenAddress", c.wgListen),
+		zap.Stringer("clientAddress", downlink.clientAddrPort),
+		zap.Stringer("proxyAddress", downlink.proxyAddrPort),
+		zap.Uint64("packetsSent", packetsSent),
+		zap.Uint64("wgBytesSent", wgBytesSent),
+		zap.Duration("handshakeRTT", downlink.handshakeTimer.RTT()),
+	)
+}
+
+// closeTCPSessions stops all TCP sessions, including those still connecting.
+// Both reads and writes are interrupted, so that a server that stops reading cannot block Stop.
+//
+// The caller must hold c.mu.
+func (c *client) closeTCPSessions() {
+	if c.cancelTCPDials != nil {
+		c.cancelTCPDials()
+	}
+
+	for clientAddrPort, entry := range c.tcpTable {
+		entry.closing = true
+		if entry.proxyConn == nil {
+			continue
+		}
+
+		if err := entry.proxyConn.SetDeadline(conn.ALongTimeAgo); err != nil {
+			c.connLogger.Warn("Failed to SetDeadline on proxyConn",
+				zap.String("client", c.name),
+				zap.String("listenAddress", c.wgListen),
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Stringer("proxyAddress", &c.proxyAddr),
+				zap.Error(err),
+			)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestClientIsAllowedSource(t *testing.T) {
+	for _, c := range []struct {
+		prefix   string
+		addr     string
+		expected bool
+	}{
+		{"", "127.0.0.1", true},
+		{"", "::ffff:127.0.0.1", true},
+		{"", "::1", true},
+		{"", "192.0.2.1", false},
+		{"192.0.2.0/24", "192.0.2.1", true},
+		{"192.0.2.0/24", "::ffff:192.0.2.1", true},
+		{"192.0.2.0/24", "127.0.0.1", false},
+		{"::/0", "192.0.2.1", true},
+		{"::/0", "2001:db8::1", true},
+	} {
+		var cl client
+		if c.prefix != "" {
+			cl.wgAllowedSource = netip.MustParsePrefix(c.prefix)
+		}
+		if got := cl.isAllowedSource(netip.MustParseAddr(c.addr)); got != c.expected {
+			t.Errorf("isAllowedSource(%s) with prefix %q = %t, want %t", c.addr, c.prefix, got, c.expected)
+		}
+	}
+}
+
+func TestClientOversizedPackets(t *testing.T) {
+	for _, c := range []struct {
+		name           string
+		batchMode      string
+		proxyTransport string
+		proxyPort      uint16
+		wgListenPort   uint16
+	}{
+		{"Default", "", "", 20599, 20600},
+		{"NoBatch", "no", "", 20601, 20602},
+		{"TCP", "", proxyTransportTCP, 20603, 20604},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			clientConfig := ClientConfig{
+				Name:           "wg0",
+				WgListen:       fmt.Sprintf(":%d", c.wgListenPort),
+				ProxyEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), c.proxyPort)),
+				ProxyMode:      "passthrough",
+				ProxyTransport: c.proxyTransport,
+				MTU:            1500,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+
+			// The fake server is started first, for the client to connect to it.
+			// With the passthrough mode, swgp packets are WireGuard packets.
+			var (
+				send   func([]byte)
+				expect func([]byte)
+			)
+
+			if c.proxyTransport == proxyTransportTCP {
+				ln, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(clientConfig.ProxyEndpoint.IPPort()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer ln.Close()
+
+				var (
+					proxyConn *net.TCPConn
+					r         *bufio.Reader
+					w         *bufio.Writer
+				)
+				defer func() {
+					if proxyConn != nil {
+						proxyConn.Close()
+					}
+				}()
+				buf := make([]byte, 2048)
+
+				send = func(b []byte) {
+					t.Helper()
+					if err := writeTCPFrame(w, b); err == nil {
+						err = w.Flush()
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				expect = func(b []byte) {
+					t.Helper()
+					if proxyConn == nil {
+						if err := ln.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+							t.Fatal(err)
+						}
+						if proxyConn, err = ln.AcceptTCP(); err != nil {
+							t.Fatal(err)
+						}
+						r = bufio.NewReader(proxyConn)
+						w = newTCPFrameWriter(proxyConn)
+					}
+					if err := proxyConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+						t.Fatal(err)
+					}
+					n, err := readTCPFrame(r, buf)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(buf[:n], b) {
+						t.Errorf("Received frame of length %d does not match expected packet of length %d", n, len(b))
+					}
+				}
+			} else {
+				server := newFakeWgEndpoint(t, clientConfig.ProxyEndpoint.String())
+				send = server.Send
+				expect = func(b []byte) {
+					t.Helper()
+					server.Expect(b)
+				}
+			}
+
+			cl, err := clientConfig.Client(NewLoggers(logger), conn.NewListenConfigCache())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = cl.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			defer cl.Stop()
+
+			peer := newFakeWgPeer(t, clientConfig.WgListen)
+
+			maxPacket := newTestWgPacket(t, packet.WireGuardMessageTypeData, cl.maxProxyPacketSize)
+			oversizedPacket := newTestWgPacket(t, packet.WireGuardMessageTypeData, cl.maxProxyPacketSize+1)
+
+			// Uplink: the oversized packet is dropped, and the next packet is the one of maximum size.
+			peer.Send(oversizedPacket)
+			peer.Send(maxPacket)
+			expect(maxPacket)
+			if oversized := cl.Stats().OversizedPackets; oversized != 1 {
+				t.Errorf("Expected 1 oversized packet, got %d", oversized)
+			}
+
+			// Downlink: the oversized packet is dropped. A TCP stream cannot skip a frame, so it is closed instead.
+			send(oversizedPacket)
+			if c.proxyTransport != proxyTransportTCP {
+				send(maxPacket)
+				peer.Expect(maxPacket)
+			}
+			waitFor(t, "oversized downlink packet to be counted", func() bool {
+				return cl.Stats().OversizedPackets == 2
+			})
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/database64128/swgp-go/packet"
+)
+
+// checkProxyCoalesce returns an error if proxyCoalesce cannot be used with the batch mode and proxy transport,
+// or if the coalesce delay is invalid.
+func checkProxyCoalesce(coalesce bool, delay time.Duration, batchMode, proxyTransport string) error {
+	if delay < 0 {
+		return fmt.Errorf("proxy coalesce delay must not be negative: %s", delay)
+	}
+	if !coalesce {
+		if delay > 0 {
+			return errors.New("proxyCoalesceDelay requires proxyCoalesce")
+		}
+		return nil
+	}
+	if proxyTransport == proxyTransportTCP {
+		return errors.New("proxyCoalesce is not supported with the TCP proxy transport")
+	}
+	if !isSendmmsgBatchMode(batchMode) {
+		return errors.New("proxyCoalesce requires the sendmmsg batch mode, which is only available on Linux and NetBSD")
+	}
+	return nil
+}
+
+// unbundle appends the WireGuard packets carried by wgPacket to wgPackets[:0], and returns the extended slice.
+// If wgPacket is not a bundle, it is the only packet.
+func unbundle(wgPackets [][]byte, wgPacket []byte) [][]byte {
+	if packet.IsBundle(wgPacket) {
+		return packet.AppendBundledPackets(wgPackets[:0], wgPacket)
+	}
+	return append(wgPackets[:0], wgPacket)
+}
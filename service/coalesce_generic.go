@@ -0,0 +1,7 @@
+//go:build !linux && !netbsd
+
+package service
+
+func isSendmmsgBatchMode(batchMode string) bool {
+	return false
+}
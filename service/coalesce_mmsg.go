@@ -0,0 +1,68 @@
+//go:build linux || netbsd
+
+package service
+
+import "github.com/database64128/swgp-go/packet"
+
+// isSendmmsgBatchMode returns whether relays of the batch mode send packets with sendmmsg(2).
+func isSendmmsgBatchMode(batchMode string) bool {
+	switch batchMode {
+	case "sendmmsg", "":
+		return true
+	default:
+		return false
+	}
+}
+
+// packetBundle coalesces consecutive WireGuard data packets into a bundle, in place in the buffer of the first one.
+//
+// A bundle of one packet is still the plain packet, so that packets with nothing to coalesce with
+// are sent as is, without the overhead of a bundle.
+type packetBundle struct {
+	buf     []byte
+	start   int
+	length  int
+	limit   int
+	packets int
+	wgBytes int
+}
+
+// open starts a bundle with the WireGuard packet at buf[start:start+length].
+// The bundle may grow up to tailroom bytes before the end of buf.
+func (b *packetBundle) open(buf []byte, start, length, tailroom int) {
+	b.buf = buf
+	b.start = start
+	b.length = length
+	b.limit = len(buf) - tailroom
+	b.packets = 1
+	b.wgBytes = length
+}
+
+// add copies wgPacket into the bundle, and returns whether it did.
+// A packet is not added if it is not a data packet, or if the bundle has no room for it.
+func (b *packetBundle) add(wgPacket []byte) bool {
+	if b.packets == packet.MaxBundlePackets || !packet.IsBundleable(wgPacket) {
+		return false
+	}
+	if b.start+packet.BundleLength(b.packets+1, b.wgBytes+len(wgPacket)) > b.limit {
+		return false
+	}
+	if b.packets == 1 {
+		b.length = packet.StartBundle(b.buf, b.start, b.length)
+	}
+	b.length = packet.AppendToBundle(b.buf, b.start, b.length, wgPacket)
+	b.packets++
+	b.wgBytes += len(wgPacket)
+	return true
+}
+
+// close empties the bundle.
+func (b *packetBundle) close() {
+	b.buf = nil
+	b.packets = 0
+}
+
+// bundleTailroom returns the space to leave at the end of a buffer after a bundle encrypted by handler.
+func bundleTailroom(handler packet.Handler) int {
+	return handler.Headroom().Rear + packet.BundleRearReserve
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/jsonhelper"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestClientServerProxyCoalesce(t *testing.T) {
+	if !isSendmmsgBatchMode("") {
+		t.Skip("proxyCoalesce requires the sendmmsg batch mode")
+	}
+
+	for _, c := range []struct {
+		name            string
+		proxyMode       string
+		serverBatchMode string
+		proxyPort       uint16
+		wgPort          uint16
+		clientPort      uint16
+	}{
+		{"Paranoid", "paranoid", "", 20528, 20529, 20530},
+		{"ZeroOverhead", "zero-overhead", "", 20531, 20532, 20533},
+		// Servers without sendmmsg cannot send bundles, but still accept them.
+		{"ServerNoBatch", "paranoid", "no", 20536, 20537, 20538},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			psk := generateTestPSK(t)
+
+			serverConfig := ServerConfig{
+				Name:          "wg0",
+				ProxyListen:   fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:     c.proxyMode,
+				ProxyPSK:      psk,
+				ProxyCoalesce: c.serverBatchMode == "",
+				WgEndpoint:    conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPort)),
+				MTU:           1500,
+				PerfConfig: PerfConfig{
+					BatchMode: c.serverBatchMode,
+				},
+			}
+
+			clientConfig := ClientConfig{
+				Name:               "wg0",
+				WgListen:           fmt.Sprintf(":%d", c.clientPort),
+				ProxyEndpoint:      conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.proxyPort)),
+				ProxyMode:          c.proxyMode,
+				ProxyPSK:           psk,
+				ProxyCoalesce:      true,
+				ProxyCoalesceDelay: jsonhelper.Duration(20 * time.Millisecond),
+				MTU:                1500,
+			}
+
+			ctx := context.Background()
+			loggers := NewLoggers(logger)
+			listenConfigCache := conn.NewListenConfigCache()
+
+			endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+			endpoint.SetEcho(true)
+
+			s, err := serverConfig.Server(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = s.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+
+			cl, err := clientConfig.Client(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = cl.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer cl.Stop()
+
+			peer := newFakeWgPeer(t, clientConfig.WgListen)
+
+			// Handshake messages are never bundled.
+			handshake := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+			peer.Send(handshake)
+			endpoint.Expect(handshake)
+			peer.Expect(handshake)
+
+			// Data packets sent within the coalescing delay are bundled, and arrive intact and in order.
+			packets := make([][]byte, 8)
+			for i := range packets {
+				packets[i] = newTestWgPacket(t, packet.WireGuardMessageTypeData, 64+i*16)
+				peer.Send(packets[i])
+			}
+			for _, p := range packets {
+				endpoint.Expect(p)
+			}
+			for _, p := range packets {
+				peer.Expect(p)
+			}
+
+			clientStats := cl.Stats()
+			if clientStats.BundlesSent == 0 {
+				t.Error("Client sent no bundles")
+			}
+			if clientStats.BundledPackets < 2*clientStats.BundlesSent {
+				t.Errorf("Client BundledPackets = %d, expected at least twice BundlesSent %d", clientStats.BundledPackets, clientStats.BundlesSent)
+			}
+
+			serverStats := s.Stats()
+			if serverStats.UplinkPackets != uint64(1+len(packets)) {
+				t.Errorf("Server UplinkPackets = %d, expected %d", serverStats.UplinkPackets, 1+len(packets))
+			}
+			if serverStats.MalformedPackets != 0 {
+				t.Errorf("Server MalformedPackets = %d, expected 0", serverStats.MalformedPackets)
+			}
+		})
+	}
+}
+
+func TestClientConfigProxyCoalesce(t *testing.T) {
+	for _, c := range []struct {
+		name           string
+		coalesce       bool
+		delay          time.Duration
+		batchMode      string
+		proxyTransport string
+		ok             bool
+	}{
+		{"Disabled", false, 0, "", "", true},
+		{"Enabled", true, time.Millisecond, "", "", isSendmmsgBatchMode("")},
+		{"NegativeDelay", true, -time.Millisecond, "", "", false},
+		{"DelayWithoutCoalesce", false, time.Millisecond, "", "", false},
+		{"NoBatch", true, 0, "no", "", false},
+		{"TCP", true, 0, "", "tcp", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			clientConfig := ClientConfig{
+				Name:               "wg0",
+				WgListen:           ":20534",
+				ProxyEndpoint:      conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20535)),
+				ProxyMode:          "paranoid",
+				ProxyPSK:           generateTestPSK(t),
+				ProxyTransport:     c.proxyTransport,
+				ProxyCoalesce:      c.coalesce,
+				ProxyCoalesceDelay: jsonhelper.Duration(c.delay),
+				MTU:                1500,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+			_, err := clientConfig.Client(NewLoggers(logger), conn.NewListenConfigCache())
+			if ok := err == nil; ok != c.ok {
+				t.Errorf("Expected ok %v, got error %v", c.ok, err)
+			}
+		})
+	}
+}
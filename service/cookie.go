@@ -0,0 +1,192 @@
+package service
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+	"go.uber.org/zap"
+)
+
+// checkCookieGate checks a WireGuard packet from clientAddrPort against the cookie gate.
+//
+// Packets from clients with a session pass through, except cookie echoes, which are unwrapped.
+// A valid cookie echo passes with the embedded WireGuard packet. Any other packet from a client
+// without a session is dropped, and a cookie challenge is returned for the caller to send
+// with [server.sendProxyReply] after unlocking the session table. No state is kept for clients
+// that have not echoed a valid cookie.
+//
+// The caller must hold s.mu. swgpPacketLength is the length of the swgp packet the WireGuard packet was decrypted from,
+// and cmsg is the control message received with it. handler encrypts the cookie challenge.
+func (s *server) checkCookieGate(packetBuf []byte, wgPacketStart, wgPacketLength, swgpPacketLength int, clientAddrPort netip.AddrPort, cmsg []byte, handler packet.Handler, hasSession bool) (int, int, bool, proxyReply) {
+	wgPacket := packetBuf[wgPacketStart : wgPacketStart+wgPacketLength]
+
+	if packet.IsCookieEcho(wgPacket) {
+		if !s.cookieGenerator.Verify(clientAddrPort, packet.CookieFromMessage(wgPacket), time.Now()) {
+			s.invalidCookies.Add(1)
+			if ce := s.logger.Check(zap.DebugLevel, "Dropping cookie echo with invalid cookie"); ce != nil {
+				ce.Write(
+					zap.String("server", s.name),
+					zap.String("listenAddress", s.proxyListen),
+					zap.Stringer("clientAddress", clientAddrPort),
+				)
+			}
+			return 0, 0, false, proxyReply{}
+		}
+		if wgPacketLength == packet.CookieMessageHeaderLength {
+			return 0, 0, false, proxyReply{}
+		}
+		return wgPacketStart + packet.CookieMessageHeaderLength, wgPacketLength - packet.CookieMessageHeaderLength, true, proxyReply{}
+	}
+
+	if hasSession {
+		return wgPacketStart, wgPacketLength, true, proxyReply{}
+	}
+
+	return 0, 0, false, s.newCookieChallenge(swgpPacketLength, clientAddrPort, cmsg, handler)
+}
+
+// newCookieChallenge returns the cookie challenge to a packet of swgpPacketLength bytes from clientAddrPort.
+//
+// The challenge only carries the cookie, and together with its overhead and padding, it is no longer than
+// the packet that triggered it, so that the server cannot be used to amplify traffic to spoofed sources.
+// Packets too short to be answered that way are not answered, and a zero reply is returned.
+func (s *server) newCookieChallenge(swgpPacketLength int, clientAddrPort netip.AddrPort, cmsg []byte, handler packet.Handler) proxyReply {
+	maxProxyPacketSize := s.maxProxyPacketSizev6
+	if addr := clientAddrPort.Addr(); addr.Is4() || addr.Is4In6() {
+		maxProxyPacketSize = s.maxProxyPacketSizev4
+	}
+	if swgpPacketLength < maxProxyPacketSize {
+		maxProxyPacketSize = swgpPacketLength
+	}
+
+	headroom := handler.Headroom()
+	challengeStart := headroom.Front
+	if challengeStart+packet.CookieMessageHeaderLength+headroom.Rear > maxProxyPacketSize {
+		s.logNotChallenged(clientAddrPort, swgpPacketLength)
+		return proxyReply{}
+	}
+
+	packetBuf := s.getPacketBuf()
+	buf := packetBuf[:maxProxyPacketSize]
+	packet.PutCookieMessageHeader(buf[challengeStart:], packet.MessageTypeCookieChallenge, s.cookieGenerator.Generate(clientAddrPort, time.Now()))
+
+	swgpPacketStart, challengeLength, err := handler.EncryptZeroCopy(buf, challengeStart, packet.CookieMessageHeaderLength)
+	if err != nil {
+		s.putPacketBuf(packetBuf)
+
+		// Handlers that add overhead to cookie messages beyond their headroom, like zero-overhead, fail here instead.
+		if errors.Is(err, packet.ErrPacketSize) {
+			s.logNotChallenged(clientAddrPort, swgpPacketLength)
+			return proxyReply{}
+		}
+
+		s.packetLogger.Warn("Failed to encrypt cookie challenge",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		return proxyReply{}
+	}
+
+	return proxyReply{
+		kind:             "cookie challenge",
+		packetBuf:        packetBuf,
+		swgpPacketStart:  swgpPacketStart,
+		swgpPacketLength: challengeLength,
+		clientAddrPort:   clientAddrPort,
+		cmsg:             cmsg,
+		sent:             &s.cookieChallenges,
+	}
+}
+
+// logNotChallenged logs that a packet of swgpPacketLength bytes from clientAddrPort is too short
+// to be answered with a cookie challenge.
+func (s *server) logNotChallenged(clientAddrPort netip.AddrPort, swgpPacketLength int) {
+	if ce := s.logger.Check(zap.DebugLevel, "Not challenging packet too short to carry a cookie challenge"); ce != nil {
+		ce.Write(
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Int("packetLength", swgpPacketLength),
+		)
+	}
+}
+
+// pendingInitiation holds a copy of the last handshake initiation relayed in a client session,
+// so that the client can carry it in the echo of a cookie challenge, instead of waiting
+// for WireGuard to retransmit it.
+type pendingInitiation struct {
+	p atomic.Pointer[[]byte]
+}
+
+// Store keeps a copy of wgPacket if it is a handshake initiation.
+func (p *pendingInitiation) Store(wgPacket []byte) {
+	if len(wgPacket) == 0 || wgPacket[0] != packet.WireGuardMessageTypeHandshakeInitiation {
+		return
+	}
+	initiation := make([]byte, len(wgPacket))
+	copy(initiation, wgPacket)
+	p.p.Store(&initiation)
+}
+
+// Load returns the last handshake initiation, or nil if there is none.
+func (p *pendingInitiation) Load() []byte {
+	if initiation := p.p.Load(); initiation != nil {
+		return *initiation
+	}
+	return nil
+}
+
+// answerCookieChallenge echoes the cookie challenge back to the server, reusing buf.
+// The WireGuard packet must be a cookie challenge. If the session has a pending handshake initiation,
+// it is carried in the echo, so that the handshake is not delayed by a retransmission.
+func (c *client) answerCookieChallenge(proxyConn *net.UDPConn, buf []byte, wgPacketStart, wgPacketLength int, clientAddrPort, proxyAddrPort netip.AddrPort, initiation []byte) {
+	buf[wgPacketStart] = packet.MessageTypeCookieEcho
+
+	// Older servers embed the initiation in the challenge, which is echoed as is without a pending one.
+	echoLength := wgPacketLength
+	if initiation != nil && wgPacketStart+packet.CookieMessageHeaderLength+len(initiation)+c.handler.Headroom().Rear <= len(buf) {
+		echoLength = packet.CookieMessageHeaderLength + copy(buf[wgPacketStart+packet.CookieMessageHeaderLength:], initiation)
+	}
+
+	swgpPacketStart, swgpPacketLength, err := c.handler.EncryptZeroCopy(buf, wgPacketStart, echoLength)
+	if err != nil {
+		c.packetLogger.Warn("Failed to encrypt cookie echo",
+			zap.String("client", c.name),
+			zap.String("listenAddress", c.wgListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Stringer("proxyAddress", proxyAddrPort),
+			zap.Error(err),
+		)
+		return
+	}
+
+	if _, err = conn.WriteToUDPAddrPort(proxyConn, buf[swgpPacketStart:swgpPacketStart+swgpPacketLength], proxyAddrPort); err != nil {
+		c.sendErrors.Add(1)
+		c.publishEvent(EventSendError, clientAddrPort, err)
+		c.logLimiter.Warn(c.connLogger, "Failed to write cookie echo to proxyConn", clientAddrPort,
+			zap.String("client", c.name),
+			zap.String("listenAddress", c.wgListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Stringer("proxyAddress", proxyAddrPort),
+			zap.Error(err),
+		)
+		return
+	}
+
+	if ce := c.logger.Check(zap.DebugLevel, "Answered cookie challenge"); ce != nil {
+		ce.Write(
+			zap.String("client", c.name),
+			zap.String("listenAddress", c.wgListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Stringer("proxyAddress", proxyAddrPort),
+			zap.Int("echoLength", echoLength),
+		)
+	}
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestNewCookieChallengeNoAmplification(t *testing.T) {
+	clientAddrPort := netip.MustParseAddrPort("[2001:db8::1]:51820")
+
+	for _, proxyMode := range []string{"zero-overhead", "paranoid"} {
+		t.Run(proxyMode, func(t *testing.T) {
+			sc := ServerConfig{
+				Name:          "wg0",
+				ProxyListen:   ":20568",
+				ProxyMode:     proxyMode,
+				ProxyPSK:      generateTestPSK(t),
+				WgEndpoint:    conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20569)),
+				MTU:           1500,
+				RequireCookie: true,
+			}
+			s, err := sc.Server(NewLoggers(logger), conn.NewListenConfigCache())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, swgpPacketLength := range []int{packet.WireGuardMessageLengthHandshakeInitiation, 1452} {
+				reply := s.newCookieChallenge(swgpPacketLength, clientAddrPort, nil, s.handler)
+				if reply.packetBuf == nil {
+					t.Fatalf("No challenge to a packet of %d bytes", swgpPacketLength)
+				}
+				if reply.swgpPacketLength > swgpPacketLength {
+					t.Errorf("Challenge of %d bytes to a packet of %d bytes amplifies", reply.swgpPacketLength, swgpPacketLength)
+				}
+
+				wgPacketStart, wgPacketLength, err := s.handler.DecryptZeroCopy(reply.packetBuf, reply.swgpPacketStart, reply.swgpPacketLength)
+				if err != nil {
+					t.Fatal(err)
+				}
+				challenge := reply.packetBuf[wgPacketStart : wgPacketStart+wgPacketLength]
+				if !packet.IsCookieChallenge(challenge) || len(challenge) != packet.CookieMessageHeaderLength {
+					t.Errorf("Expected a bare cookie challenge, got %d bytes", len(challenge))
+				}
+				s.putPacketBuf(reply.packetBuf)
+			}
+
+			if reply := s.newCookieChallenge(packet.CookieMessageHeaderLength, clientAddrPort, nil, s.handler); reply.packetBuf != nil {
+				t.Errorf("Expected no challenge to a packet of %d bytes", packet.CookieMessageHeaderLength)
+			}
+		})
+	}
+}
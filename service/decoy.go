@@ -0,0 +1,233 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/database64128/swgp-go/conn"
+	"go.uber.org/zap"
+)
+
+// decoyRecvBufferSize is the size of the receive buffer of a decoy port.
+// Received packets are discarded, so truncation does not matter.
+const decoyRecvBufferSize = 2048
+
+// decoySet is a set of decoy ports that accept and silently discard all packets.
+type decoySet struct {
+	addresses    []string
+	network      string
+	listenConfig conn.ListenConfig
+	conns        []*net.UDPConn
+	packets      atomic.Uint64
+	bytes        atomic.Uint64
+	wg           sync.WaitGroup
+}
+
+// checkDecoyPorts returns an error if the decoy ports are out of range,
+// duplicated, or collide with the proxy listen port.
+func checkDecoyPorts(decoyPorts []int, proxyListen string) error {
+	_, proxyPortString, err := net.SplitHostPort(proxyListen)
+	if err != nil {
+		return fmt.Errorf("failed to parse proxy listen address: %w", err)
+	}
+	proxyPort, _ := strconv.Atoi(proxyPortString)
+
+	seen := make(map[int]struct{}, len(decoyPorts))
+	for _, port := range decoyPorts {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("decoy port out of range: %d", port)
+		}
+		if port == proxyPort {
+			return fmt.Errorf("decoy port collides with proxy listen port: %d", port)
+		}
+		if _, ok := seen[port]; ok {
+			return fmt.Errorf("duplicate decoy port: %d", port)
+		}
+		seen[port] = struct{}{}
+	}
+	return nil
+}
+
+// checkDecoyPortCollisions returns an error if a server's decoy port collides with
+// the listen port of any service.
+func (sc *Config) checkDecoyPortCollisions() error {
+	listenPorts := make(map[int]string, len(sc.Servers)+len(sc.Clients))
+
+	addListenPort := func(address, serviceName string) {
+		if _, portString, err := net.SplitHostPort(address); err == nil {
+			if port, err := strconv.Atoi(portString); err == nil {
+				listenPorts[port] = serviceName
+			}
+		}
+	}
+
+	for i := range sc.Servers {
+		addListenPort(sc.Servers[i].ProxyListen, sc.Servers[i].Name)
+	}
+	for i := range sc.Clients {
+		addListenPort(sc.Clients[i].WgListen, sc.Clients[i].Name)
+	}
+
+	for i := range sc.Servers {
+		for _, port := range sc.Servers[i].DecoyPorts {
+			if serviceName, ok := listenPorts[port]; ok {
+				return fmt.Errorf("decoy port %d of server %s collides with listen port of %s", port, sc.Servers[i].Name, serviceName)
+			}
+		}
+	}
+
+	return nil
+}
+
+// newDecoySet returns a decoy set listening on decoyPorts on the host of proxyListen.
+// It returns nil if there are no decoy ports.
+func newDecoySet(decoyPorts []int, proxyListen, network string, listenConfig conn.ListenConfig) *decoySet {
+	if len(decoyPorts) == 0 {
+		return nil
+	}
+
+	host, _, _ := net.SplitHostPort(proxyListen)
+	addresses := make([]string, len(decoyPorts))
+	for i, port := range decoyPorts {
+		addresses[i] = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	return &decoySet{
+		addresses:    addresses,
+		network:      network,
+		listenConfig: listenConfig,
+	}
+}
+
+// listenDecoys opens the decoy ports. Call serveDecoys to start discarding packets received on them.
+func (s *server) listenDecoys(ctx context.Context) error {
+	d := s.decoys
+	if d == nil {
+		return nil
+	}
+
+	d.conns = make([]*net.UDPConn, 0, len(d.addresses))
+
+	for _, address := range d.addresses {
+		c, err := s.inherited.listenUDP(ctx, &d.listenConfig, d.network, address)
+		if err != nil {
+			for _, c := range d.conns {
+				c.Close()
+			}
+			d.conns = nil
+			return fmt.Errorf("failed to listen on decoy port %s: %w", address, err)
+		}
+		d.conns = append(d.conns, c)
+	}
+	return nil
+}
+
+// serveDecoys starts discarding packets received on the decoy ports opened by listenDecoys.
+func (s *server) serveDecoys() {
+	d := s.decoys
+	if d == nil {
+		return
+	}
+
+	for i, c := range d.conns {
+		d.wg.Add(1)
+
+		go func(address string, c *net.UDPConn) {
+			defer d.wg.Done()
+			s.recvFromDecoyConn(address, c)
+		}(d.addresses[i], c)
+	}
+
+	s.logger.Info("Started decoy ports",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.Strings("decoyAddresses", d.addresses),
+	)
+}
+
+// recvFromDecoyConn reads and discards packets from a decoy port until the read deadline is exceeded.
+func (s *server) recvFromDecoyConn(address string, c *net.UDPConn) {
+	d := s.decoys
+	buf := make([]byte, decoyRecvBufferSize)
+
+	for {
+		n, sourceAddrPort, err := c.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return
+			}
+			s.connLogger.Warn("Failed to read from decoy port",
+				zap.String("server", s.name),
+				zap.String("decoyAddress", address),
+				zap.Error(err),
+			)
+			continue
+		}
+
+		d.packets.Add(1)
+		d.bytes.Add(uint64(n))
+
+		if ce := s.logger.Check(zap.DebugLevel, "Discarded packet from decoy port"); ce != nil {
+			ce.Write(
+				zap.String("server", s.name),
+				zap.String("decoyAddress", address),
+				zap.Stringer("sourceAddress", sourceAddrPort),
+				zap.Int("packetLength", n),
+			)
+		}
+	}
+}
+
+// stopDecoys closes the decoy ports.
+func (s *server) stopDecoys() {
+	d := s.decoys
+	if d == nil || d.conns == nil {
+		return
+	}
+
+	for _, c := range d.conns {
+		if err := c.SetReadDeadline(conn.ALongTimeAgo); err != nil {
+			s.connLogger.Warn("Failed to SetReadDeadline on decoy port",
+				zap.String("server", s.name),
+				zap.Stringer("decoyAddress", c.LocalAddr()),
+				zap.Error(err),
+			)
+		}
+	}
+
+	d.wg.Wait()
+
+	for _, c := range d.conns {
+		c.Close()
+	}
+	d.conns = nil
+
+	s.logger.Info("Stopped decoy ports",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.Uint64("decoyPackets", d.packets.Load()),
+		zap.Uint64("decoyBytes", d.bytes.Load()),
+	)
+}
+
+// Packets returns the number of packets received on the decoy ports.
+func (d *decoySet) Packets() uint64 {
+	if d == nil {
+		return 0
+	}
+	return d.packets.Load()
+}
+
+// Bytes returns the number of bytes received on the decoy ports.
+func (d *decoySet) Bytes() uint64 {
+	if d == nil {
+		return 0
+	}
+	return d.bytes.Load()
+}
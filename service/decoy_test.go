@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+)
+
+func TestCheckDecoyPorts(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		decoyPorts []int
+		ok         bool
+	}{
+		{"Valid", []int{20261, 20262}, true},
+		{"OutOfRange", []int{65536}, false},
+		{"Zero", []int{0}, false},
+		{"Duplicate", []int{20261, 20261}, false},
+		{"ProxyListenPort", []int{20260}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkDecoyPorts(c.decoyPorts, ":20260")
+			if ok := err == nil; ok != c.ok {
+				t.Errorf("Expected ok %v, got error %v", c.ok, err)
+			}
+		})
+	}
+}
+
+func TestConfigCheckDecoyPortCollisions(t *testing.T) {
+	sc := Config{
+		Servers: []ServerConfig{
+			{Name: "wg0", ProxyListen: ":20260", DecoyPorts: []int{20261}},
+		},
+		Clients: []ClientConfig{
+			{Name: "wg1", WgListen: ":20261"},
+		},
+	}
+	if err := sc.checkDecoyPortCollisions(); err == nil {
+		t.Error("Expected error for decoy port colliding with client listen port.")
+	}
+
+	sc.Clients[0].WgListen = ":20262"
+	if err := sc.checkDecoyPortCollisions(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestServerDecoyPorts(t *testing.T) {
+	ctx := context.Background()
+
+	sc := Config{
+		Servers: []ServerConfig{
+			{
+				Name:        "wg0",
+				ProxyListen: ":20260",
+				ProxyMode:   "zero-overhead",
+				ProxyPSK:    generateTestPSK(t),
+				WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20263)),
+				MTU:         1500,
+				DecoyPorts:  []int{20261, 20262},
+			},
+		},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	for _, address := range []string{"[::1]:20261", "[::1]:20262"} {
+		c, err := net.Dial("udp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.Write([]byte("probe")); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := m.Stats()[0]
+		if stats.DecoyPackets == 2 {
+			if stats.DecoyBytes != 10 {
+				t.Errorf("Expected 10 decoy bytes, got %d", stats.DecoyBytes)
+			}
+			if stats.Sessions != 0 {
+				t.Errorf("Expected no sessions, got %d", stats.Sessions)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 decoy packets, got %d", stats.DecoyPackets)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,58 @@
+package service
+
+import "sync/atomic"
+
+// decryptBudget caps the decryption attempts of a server per second, as a last line of defense
+// against floods of packets that are expensive to reject, like spoofed packets that fail decryption.
+//
+// Each attempt takes a token from a bucket of one second's worth of attempts, refilled continuously.
+// Packets beyond the budget are shed before decryption and counted, so that the CPU time spent on decryption
+// stays bounded, whatever the rate of the flood. Unlike rate limits, it does not tell sources apart,
+// so under a flood, legitimate packets are shed as well.
+//
+// decryptBudget is safe for concurrent use by multiple goroutines.
+type decryptBudget struct {
+	bucket *tokenBucket
+
+	shed atomic.Uint64
+}
+
+// newDecryptBudget returns a new budget of perSec decryption attempts per second.
+//
+// If perSec is not positive, nil is returned. All methods are safe to call on a nil budget.
+func newDecryptBudget(perSec int) *decryptBudget {
+	if perSec <= 0 {
+		return nil
+	}
+	return &decryptBudget{
+		bucket: newTokenBucket(float64(perSec), float64(perSec)),
+	}
+}
+
+// Allow returns whether a packet may be decrypted, and counts it against the budget.
+func (b *decryptBudget) Allow() bool {
+	if b == nil {
+		return true
+	}
+	if !b.bucket.Take(1) {
+		b.shed.Add(1)
+		return false
+	}
+	return true
+}
+
+// WouldAllow returns whether a packet would be decrypted now, without counting it against the budget.
+func (b *decryptBudget) WouldAllow() bool {
+	if b == nil {
+		return true
+	}
+	return b.bucket.Has(1)
+}
+
+// Shed returns the number of packets shed for exceeding the budget.
+func (b *decryptBudget) Shed() uint64 {
+	if b == nil {
+		return 0
+	}
+	return b.shed.Load()
+}
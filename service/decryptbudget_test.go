@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestDecryptBudget(t *testing.T) {
+	b := newDecryptBudget(3)
+
+	for i := 0; i < 3; i++ {
+		if !b.WouldAllow() {
+			t.Fatalf("WouldAllow() = false before packet %d, expected it to be within the budget", i)
+		}
+		if !b.Allow() {
+			t.Fatalf("Packet %d shed, expected it to be within the budget", i)
+		}
+	}
+	if b.WouldAllow() {
+		t.Error("WouldAllow() = true, expected the budget to be used up")
+	}
+	if b.Allow() {
+		t.Error("Expected packet beyond the budget to be shed")
+	}
+	if shed := b.Shed(); shed != 1 {
+		t.Errorf("Shed() = %d, expected 1", shed)
+	}
+
+	// 3 per second refills an attempt every 333ms, so the budget is not renewed all at once.
+	time.Sleep(400 * time.Millisecond)
+	if !b.Allow() {
+		t.Error("Expected packet to pass after refill")
+	}
+	if b.Allow() {
+		t.Error("Expected only one attempt to be refilled")
+	}
+}
+
+func TestDecryptBudgetNil(t *testing.T) {
+	b := newDecryptBudget(0)
+	if b != nil {
+		t.Fatal("Expected nil budget for zero budget")
+	}
+	if !b.Allow() || !b.WouldAllow() {
+		t.Error("Expected nil budget to allow all packets")
+	}
+	if shed := b.Shed(); shed != 0 {
+		t.Errorf("Shed() = %d, expected 0", shed)
+	}
+}
+
+func TestServerDecryptBudget(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		batchMode  string
+		proxyPort  uint16
+		wgPort     uint16
+		clientPort uint16
+	}{
+		{"Default", "", 20520, 20521, 20522},
+		{"NoBatch", "no", 20523, 20524, 20525},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			psk := generateTestPSK(t)
+
+			serverConfig := ServerConfig{
+				Name:                "wg0",
+				ProxyListen:         fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:           "paranoid",
+				ProxyPSK:            psk,
+				WgEndpoint:          conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPort)),
+				MTU:                 1500,
+				DecryptBudgetPerSec: 2,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+
+			clientConfig := ClientConfig{
+				Name:          "wg0",
+				WgListen:      fmt.Sprintf(":%d", c.clientPort),
+				ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.proxyPort)),
+				ProxyMode:     "paranoid",
+				ProxyPSK:      psk,
+				MTU:           1500,
+			}
+
+			ctx := context.Background()
+			loggers := NewLoggers(logger)
+			listenConfigCache := conn.NewListenConfigCache()
+
+			endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+
+			s, err := serverConfig.Server(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = s.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+
+			cl, err := clientConfig.Client(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = cl.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer cl.Stop()
+
+			peer := newFakeWgPeer(t, clientConfig.WgListen)
+
+			// Start at the beginning of a second, so that all packets fall in the same window.
+			time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+
+			packets := [][]byte{
+				newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation),
+				newTestWgPacket(t, packet.WireGuardMessageTypeData, 128),
+			}
+			for _, p := range packets {
+				peer.Send(p)
+				endpoint.Expect(p)
+			}
+
+			peer.Send(newTestWgPacket(t, packet.WireGuardMessageTypeData, 256))
+			endpoint.ExpectNone(100 * time.Millisecond)
+
+			if shed := s.Stats().DecryptBudgetShed; shed != 1 {
+				t.Errorf("DecryptBudgetShed = %d, expected 1", shed)
+			}
+		})
+	}
+}
+
+func TestServerConfigDecryptBudget(t *testing.T) {
+	for _, c := range []struct {
+		name           string
+		budget         int
+		proxyTransport string
+		ok             bool
+	}{
+		{"Disabled", 0, "", true},
+		{"Enabled", 1000, "", true},
+		{"Negative", -1, "", false},
+		{"TCP", 1000, "tcp", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			serverConfig := ServerConfig{
+				Name:                "wg0",
+				ProxyListen:         ":20526",
+				ProxyMode:           "paranoid",
+				ProxyPSK:            generateTestPSK(t),
+				ProxyTransport:      c.proxyTransport,
+				WgEndpoint:          conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20527)),
+				MTU:                 1500,
+				DecryptBudgetPerSec: c.budget,
+			}
+			_, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache())
+			if ok := err == nil; ok != c.ok {
+				t.Errorf("Expected ok %v, got error %v", c.ok, err)
+			}
+		})
+	}
+}
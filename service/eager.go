@@ -0,0 +1,68 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"go.uber.org/zap"
+)
+
+// eagerProxyConn is an upstream socket set up when the client starts, before any session needs it.
+type eagerProxyConn struct {
+	proxyAddrPort netip.AddrPort
+	proxyConn     *net.UDPConn
+}
+
+// connectEagerly resolves the proxy endpoint, checks that it is routable, and, with the UDP proxy transport,
+// sets up the upstream socket of the first session.
+func (c *client) connectEagerly(ctx context.Context) error {
+	proxyAddrPort, err := c.proxyAddr.ResolveIPPortWithResolver(ctx, c.resolver)
+	if err != nil {
+		return fmt.Errorf("failed to resolve proxy endpoint %s: %w", &c.proxyAddr, err)
+	}
+
+	if _, err = routeLocalAddr(proxyAddrPort); err != nil {
+		return fmt.Errorf("no route to proxy endpoint %s: %w", proxyAddrPort, err)
+	}
+
+	// TCP sessions dial their own connections.
+	if c.proxyTransport == proxyTransportTCP {
+		return nil
+	}
+
+	proxyConn, err := c.proxyConnListenConfig.ListenUDP(ctx, "udp", "")
+	if err != nil {
+		return fmt.Errorf("failed to create UDP socket for proxy endpoint %s: %w", proxyAddrPort, err)
+	}
+
+	c.eagerProxyConn.Store(&eagerProxyConn{
+		proxyAddrPort: proxyAddrPort,
+		proxyConn:     proxyConn,
+	})
+
+	c.logger.Info("Eagerly connected to proxy endpoint",
+		zap.String("client", c.name),
+		zap.String("listenAddress", c.wgListen),
+		zap.Stringer("proxyAddress", proxyAddrPort),
+	)
+	return nil
+}
+
+// takeEagerProxyConn returns the eagerly set up upstream socket and its proxy address,
+// or false if there is none or it has been taken by an earlier session.
+func (c *client) takeEagerProxyConn() (netip.AddrPort, *net.UDPConn, bool) {
+	eager := c.eagerProxyConn.Swap(nil)
+	if eager == nil {
+		return netip.AddrPort{}, nil, false
+	}
+	return eager.proxyAddrPort, eager.proxyConn, true
+}
+
+// closeEagerProxyConn closes the eagerly set up upstream socket if no session has taken it.
+func (c *client) closeEagerProxyConn() {
+	if _, proxyConn, ok := c.takeEagerProxyConn(); ok {
+		proxyConn.Close()
+	}
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestClientEagerConnect(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		batchMode    string
+		proxyPort    uint16
+		wgPort       uint16
+		wgListenPort uint16
+	}{
+		{"Default", "", 20365, 20366, 20367},
+		{"NoBatch", "no", 20368, 20369, 20370},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			psk := generateTestPSK(t)
+
+			serverConfig := ServerConfig{
+				Name:        "wg0",
+				ProxyListen: fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:   "zero-overhead",
+				ProxyPSK:    psk,
+				WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPort)),
+				MTU:         1500,
+			}
+
+			clientConfig := ClientConfig{
+				Name:          "wg0",
+				WgListen:      fmt.Sprintf(":%d", c.wgListenPort),
+				ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.proxyPort)),
+				ProxyMode:     "zero-overhead",
+				ProxyPSK:      psk,
+				MTU:           1500,
+				EagerConnect:  true,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+
+			ctx := context.Background()
+			loggers := NewLoggers(logger)
+			listenConfigCache := conn.NewListenConfigCache()
+
+			s, err := serverConfig.Server(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = s.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+
+			cl, err := clientConfig.Client(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = cl.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer cl.Stop()
+
+			eager := cl.eagerProxyConn.Load()
+			if eager == nil {
+				t.Fatal("Expected an eagerly set up upstream socket after Start")
+			}
+			eagerPort := eager.proxyConn.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+
+			peer := newFakeWgPeer(t, clientConfig.WgListen)
+			endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+
+			handshakeInitiationPacket := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+			peer.Send(handshakeInitiationPacket)
+			endpoint.Expect(handshakeInitiationPacket)
+
+			if cl.eagerProxyConn.Load() != nil {
+				t.Error("Expected the first session to take the eagerly set up upstream socket")
+			}
+
+			s.mu.Lock()
+			hasSession, _ := s.hasSessionLocked(netip.AddrPortFrom(netip.IPv6Loopback(), eagerPort))
+			s.mu.Unlock()
+			if !hasSession {
+				t.Errorf("Expected the server to have a session from the eager upstream socket port %d", eagerPort)
+			}
+		})
+	}
+}
+
+func TestClientEagerConnectUnresolvable(t *testing.T) {
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20371",
+		ProxyEndpoint: conn.MustAddrFromDomainPort("swgp.invalid", 20372),
+		ProxyMode:     "zero-overhead",
+		ProxyPSK:      generateTestPSK(t),
+		MTU:           1500,
+		EagerConnect:  true,
+	}
+
+	cl, err := clientConfig.Client(NewLoggers(logger), conn.NewListenConfigCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cl.Start(context.Background()); err == nil {
+		cl.Stop()
+		t.Fatal("Expected Start to fail with an unresolvable proxy endpoint")
+	}
+}
@@ -0,0 +1,86 @@
+package service
+
+import "crypto/sha256"
+
+// redactedOptionValue replaces the values of proxy mode options in the effective config.
+const redactedOptionValue = "redacted"
+
+// EffectiveConfig returns the config of the running services, with all secrets redacted,
+// to check what a running swgp uses after reloads and PSK resolution.
+//
+// Servers and clients are those the manager runs, in config order, including those from included files,
+// so Include is empty. Disabled services and services that failed to start on reload are left out.
+// An MTU of 0 (auto) is replaced by the MTU the service uses, and the WireGuard endpoint of a migrated
+// server is its new endpoint. Domain names are kept as configured, as they are resolved for each session.
+// Settings that are not reloaded are those the manager was created with.
+//
+// Each PSK is replaced by its fingerprint, the first 8 bytes of its SHA-256 hash, which logPSKFingerprint logs in hex.
+// Values of proxy mode options are replaced by "redacted", as they may hold secrets of custom proxy modes.
+// Other slices and maps in the returned config are shared with the manager, and must not be modified.
+func (m *Manager) EffectiveConfig() Config {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sc := m.config
+	for _, s := range m.services {
+		switch {
+		case s.serverConfig != nil:
+			sc.Servers = append(sc.Servers, redactServerConfig(*s.serverConfig))
+		case s.clientConfig != nil:
+			sc.Clients = append(sc.Clients, redactClientConfig(*s.clientConfig))
+		}
+	}
+	return sc
+}
+
+// redactServerConfig returns a copy of the server config with its secrets redacted.
+func redactServerConfig(sc ServerConfig) ServerConfig {
+	sc.ProxyPSK = redactPSK(sc.ProxyPSK)
+	sc.ProxyPSKInbound = redactPSK(sc.ProxyPSKInbound)
+	sc.ProxyPSKOutbound = redactPSK(sc.ProxyPSKOutbound)
+	sc.ProxyModeOptions = redactProxyModeOptions(sc.ProxyModeOptions)
+	sc.ProxyKeyMaskKey = redactPSK(sc.ProxyKeyMaskKey)
+
+	if sc.ProxyKeys != nil {
+		keys := make([]ProxyKeyConfig, len(sc.ProxyKeys))
+		for i, key := range sc.ProxyKeys {
+			key.PSK = redactPSK(key.PSK)
+			keys[i] = key
+		}
+		sc.ProxyKeys = keys
+	}
+
+	return sc
+}
+
+// redactClientConfig returns a copy of the client config with its secrets redacted.
+func redactClientConfig(cc ClientConfig) ClientConfig {
+	cc.ProxyPSK = redactPSK(cc.ProxyPSK)
+	cc.ProxyPSKInbound = redactPSK(cc.ProxyPSKInbound)
+	cc.ProxyPSKOutbound = redactPSK(cc.ProxyPSKOutbound)
+	cc.ProxyModeOptions = redactProxyModeOptions(cc.ProxyModeOptions)
+	cc.ProxyKeyMaskKey = redactPSK(cc.ProxyKeyMaskKey)
+	return cc
+}
+
+// redactPSK returns the fingerprint of psk, or nil if psk is nil.
+func redactPSK(psk []byte) []byte {
+	if psk == nil {
+		return nil
+	}
+	sum := sha256.Sum256(psk)
+	return sum[:pskFingerprintLength]
+}
+
+// redactProxyModeOptions returns a copy of opts with every value replaced by [redactedOptionValue],
+// or nil if opts is nil.
+func redactProxyModeOptions(opts map[string]any) map[string]any {
+	if opts == nil {
+		return nil
+	}
+	redacted := make(map[string]any, len(opts))
+	for k := range opts {
+		redacted[k] = redactedOptionValue
+	}
+	return redacted
+}
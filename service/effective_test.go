@@ -0,0 +1,150 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/jsonhelper"
+)
+
+func TestManagerEffectiveConfig(t *testing.T) {
+	psk := generateTestPSK(t)
+	keyPSK := generateTestPSK(t)
+	maskKey := generateTestPSK(t)
+
+	serverConfig := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: ":20539",
+		ProxyMode:   "paranoid",
+		ProxyPSK:    psk,
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20540)),
+	}
+
+	keyedServerConfig := ServerConfig{
+		Name:            "wg1",
+		ProxyListen:     ":20541",
+		ProxyMode:       proxyModeZeroOverheadKeyed,
+		ProxyKeys:       []ProxyKeyConfig{{ID: 1, PSK: keyPSK}},
+		ProxyKeyMaskKey: maskKey,
+		WgEndpoint:      conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20540)),
+		MTU:             1500,
+	}
+
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20542",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20539)),
+		ProxyMode:     "paranoid",
+		ProxyPSK:      psk,
+		MTU:           1500,
+	}
+
+	disabledClientConfig := ClientConfig{
+		Name:          "wg1",
+		WgListen:      ":20543",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20539)),
+		ProxyMode:     "paranoid",
+		ProxyPSK:      psk,
+		MTU:           1500,
+		Disabled:      true,
+	}
+
+	ctx := context.Background()
+	sc := Config{
+		Servers:          []ServerConfig{serverConfig, keyedServerConfig},
+		Clients:          []ClientConfig{clientConfig, disabledClientConfig},
+		StatsLogInterval: jsonhelper.Duration(time.Hour),
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	// Migrate the first server to a new WireGuard endpoint.
+	serverConfig.WgEndpoint = conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20544))
+	sc.Servers[0] = serverConfig
+	sc.StatsLogInterval = 0
+	if err = m.Reload(ctx, sc); err != nil {
+		t.Fatal(err)
+	}
+
+	ec := m.EffectiveConfig()
+
+	if len(ec.Servers) != 2 {
+		t.Fatalf("len(Servers) = %d, expected 2", len(ec.Servers))
+	}
+	if len(ec.Clients) != 1 {
+		t.Fatalf("len(Clients) = %d, expected 1 without the disabled client", len(ec.Clients))
+	}
+	if ec.StatsLogInterval != jsonhelper.Duration(time.Hour) {
+		t.Errorf("StatsLogInterval = %s, expected the value the manager was created with", time.Duration(ec.StatsLogInterval))
+	}
+
+	es := ec.Servers[0]
+	if es.WgEndpoint.String() != serverConfig.WgEndpoint.String() {
+		t.Errorf("WgEndpoint = %s, expected the migrated endpoint %s", es.WgEndpoint, serverConfig.WgEndpoint)
+	}
+	if es.MTU != autoMTUFallback {
+		t.Errorf("MTU = %d, expected the auto MTU %d", es.MTU, autoMTUFallback)
+	}
+	if fingerprint := hex.EncodeToString(es.ProxyPSK); fingerprint != pskFingerprint(psk) {
+		t.Errorf("ProxyPSK = %s, expected fingerprint %s", fingerprint, pskFingerprint(psk))
+	}
+	if fingerprint := hex.EncodeToString(ec.Servers[1].ProxyKeys[0].PSK); fingerprint != pskFingerprint(keyPSK) {
+		t.Errorf("ProxyKeys[0].PSK = %s, expected fingerprint %s", fingerprint, pskFingerprint(keyPSK))
+	}
+
+	// No secret may appear in the config, or be changed in the manager.
+	b, err := json.Marshal(ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range [][]byte{psk, keyPSK, maskKey} {
+		if bytes.Contains(b, []byte(base64.StdEncoding.EncodeToString(secret))) {
+			t.Errorf("Effective config leaks a PSK: %s", b)
+		}
+	}
+	if ec = m.EffectiveConfig(); hex.EncodeToString(ec.Servers[1].ProxyKeys[0].PSK) != pskFingerprint(keyPSK) {
+		t.Error("Redacting the effective config changed the manager's config")
+	}
+}
+
+func TestRedactClientConfig(t *testing.T) {
+	inboundPSK := generateTestPSK(t)
+	outboundPSK := generateTestPSK(t)
+
+	cc := ClientConfig{
+		Name:             "wg0",
+		ProxyPSKInbound:  inboundPSK,
+		ProxyPSKOutbound: outboundPSK,
+		ProxyModeOptions: map[string]any{"secret": "hunter2"},
+	}
+	redacted := redactClientConfig(cc)
+
+	if redacted.ProxyPSK != nil {
+		t.Errorf("ProxyPSK = %x, expected nil", redacted.ProxyPSK)
+	}
+	if fingerprint := hex.EncodeToString(redacted.ProxyPSKInbound); fingerprint != pskFingerprint(inboundPSK) {
+		t.Errorf("ProxyPSKInbound = %s, expected fingerprint %s", fingerprint, pskFingerprint(inboundPSK))
+	}
+	if fingerprint := hex.EncodeToString(redacted.ProxyPSKOutbound); fingerprint != pskFingerprint(outboundPSK) {
+		t.Errorf("ProxyPSKOutbound = %s, expected fingerprint %s", fingerprint, pskFingerprint(outboundPSK))
+	}
+	if v := redacted.ProxyModeOptions["secret"]; v != redactedOptionValue {
+		t.Errorf("ProxyModeOptions[secret] = %v, expected %q", v, redactedOptionValue)
+	}
+	if v := cc.ProxyModeOptions["secret"]; v != "hunter2" {
+		t.Errorf("Redacting changed the original proxyModeOptions to %v", v)
+	}
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// eventSubscriberChannelCapacity is the capacity of a subscriber's event channel.
+const eventSubscriberChannelCapacity = 256
+
+// EventType is the type of an [Event].
+type EventType uint8
+
+const (
+	// EventSessionCreated is published when a session starts relaying.
+	EventSessionCreated EventType = iota + 1
+
+	// EventSessionEvicted is published when a session is removed from the table.
+	EventSessionEvicted
+
+	// EventDecryptFailure is published when a packet fails to decrypt.
+	EventDecryptFailure
+
+	// EventSendError is published when a packet fails to send.
+	EventSendError
+
+	// EventProxyDown is published when a client stops receiving return traffic from its proxy endpoint.
+	// PeerAddr is the session that noticed it.
+	EventProxyDown
+
+	// EventProxyUp is published when a client receives return traffic from its proxy endpoint
+	// again after [EventProxyDown].
+	EventProxyUp
+
+	// EventUpstreamUnreachable is published when a server's WireGuard endpoint answers with ICMP port unreachable.
+	EventUpstreamUnreachable
+)
+
+// String implements the [fmt.Stringer] String method.
+func (t EventType) String() string {
+	switch t {
+	case EventSessionCreated:
+		return "session-created"
+	case EventSessionEvicted:
+		return "session-evicted"
+	case EventDecryptFailure:
+		return "decrypt-failure"
+	case EventSendError:
+		return "send-error"
+	case EventProxyDown:
+		return "proxy-down"
+	case EventProxyUp:
+		return "proxy-up"
+	case EventUpstreamUnreachable:
+		return "upstream-unreachable"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a notable occurrence in a service.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Role is either "server" or "client".
+	Role string
+
+	// Name is the name of the service in the config.
+	Name string
+
+	// PeerAddr is the address of the session's client.
+	// For servers, it is the swgp client's address. For clients, it is the WireGuard peer's address.
+	PeerAddr netip.AddrPort
+
+	// Err is the error that caused the event, if any.
+	Err error
+}
+
+// eventBus fans out events to subscribers without blocking publishers.
+//
+// A nil *eventBus is valid and discards all events.
+type eventBus struct {
+	mu          sync.RWMutex
+	subscribers map[chan Event]struct{}
+	dropped     atomic.Uint64
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Subscribe registers a new subscriber and returns its event channel and a function to unsubscribe.
+// The channel is closed on unsubscribe. The unsubscribe function may be called more than once.
+func (b *eventBus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventSubscriberChannelCapacity)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, ch)
+			close(ch)
+			b.mu.Unlock()
+		})
+	}
+}
+
+// Publish sends the event to all subscribers.
+// Subscribers that are not keeping up miss the event, which is counted as dropped.
+func (b *eventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(b.subscribers) == 0 {
+		return
+	}
+
+	e.Time = time.Now()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			b.dropped.Add(1)
+		}
+	}
+}
+
+// Dropped returns the number of events dropped because subscribers fell behind.
+func (b *eventBus) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+// publishEvent publishes an event from the server.
+func (s *server) publishEvent(t EventType, peerAddr netip.AddrPort, err error) {
+	s.events.Publish(Event{
+		Type:     t,
+		Role:     "server",
+		Name:     s.name,
+		PeerAddr: peerAddr,
+		Err:      err,
+	})
+}
+
+// publishEvent publishes an event from the client.
+func (c *client) publishEvent(t EventType, peerAddr netip.AddrPort, err error) {
+	c.events.Publish(Event{
+		Type:     t,
+		Role:     "client",
+		Name:     c.name,
+		PeerAddr: peerAddr,
+		Err:      err,
+	})
+}
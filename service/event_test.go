@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestEventBus(t *testing.T) {
+	b := newEventBus()
+
+	// Publishing without subscribers must not block or count drops.
+	b.Publish(Event{Type: EventSessionCreated})
+	if dropped := b.Dropped(); dropped != 0 {
+		t.Errorf("Expected 0 dropped events, got %d", dropped)
+	}
+
+	ch, unsubscribe := b.Subscribe()
+
+	for i := 0; i < eventSubscriberChannelCapacity+3; i++ {
+		b.Publish(Event{Type: EventSendError})
+	}
+	if dropped := b.Dropped(); dropped != 3 {
+		t.Errorf("Expected 3 dropped events, got %d", dropped)
+	}
+
+	e := <-ch
+	if e.Type != EventSendError {
+		t.Errorf("Expected %s, got %s", EventSendError, e.Type)
+	}
+	if e.Time.IsZero() {
+		t.Error("Event time is not set.")
+	}
+
+	unsubscribe()
+	unsubscribe()
+
+	for range ch {
+	}
+
+	b.Publish(Event{Type: EventSendError})
+}
+
+func TestManagerSubscribeSessionCreated(t *testing.T) {
+	ctx := context.Background()
+	psk := generateTestPSK(t)
+
+	sc := Config{
+		Servers: []ServerConfig{
+			{
+				Name:        "wg0",
+				ProxyListen: ":20256",
+				ProxyMode:   "zero-overhead",
+				ProxyPSK:    psk,
+				WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20257)),
+				MTU:         1500,
+			},
+		},
+		Clients: []ClientConfig{
+			{
+				Name:          "wg0",
+				WgListen:      ":20258",
+				ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20256)),
+				ProxyMode:     "zero-overhead",
+				ProxyPSK:      psk,
+				MTU:           1500,
+			},
+		},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	handshakeInitiationPacket := make([]byte, packet.WireGuardMessageLengthHandshakeInitiation)
+	handshakeInitiationPacket[0] = packet.WireGuardMessageTypeHandshakeInitiation
+	if _, err = rand.Read(handshakeInitiationPacket[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, err := net.Dial("udp", ":20258")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	if _, err = clientConn.Write(handshakeInitiationPacket); err != nil {
+		t.Fatal(err)
+	}
+
+	created := make(map[string]bool)
+	timer := time.NewTimer(5 * time.Second)
+	defer timer.Stop()
+
+	for len(created) < 2 {
+		select {
+		case e := <-events:
+			if e.Type == EventSessionCreated {
+				if e.Name != "wg0" || !e.PeerAddr.IsValid() {
+					t.Errorf("Unexpected event: %+v", e)
+				}
+				created[e.Role] = true
+			}
+		case <-timer.C:
+			t.Fatalf("Timed out waiting for session-created events, got %v", created)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+// fakeWgTimeout is how long a fake WireGuard socket waits for an expected packet.
+const fakeWgTimeout = 5 * time.Second
+
+// fakeWgPacket is a packet received by a fake WireGuard socket.
+type fakeWgPacket struct {
+	b    []byte
+	from netip.AddrPort
+}
+
+func (p fakeWgPacket) String() string {
+	if len(p.b) == 0 {
+		return fmt.Sprintf("empty packet from %s", p.from)
+	}
+	return fmt.Sprintf("packet (type %d, length %d) from %s", p.b[0], len(p.b), p.from)
+}
+
+// fakeWg stands in for a WireGuard socket in tests. It receives packets in the background,
+// records them, and hands them out in order to Expect calls.
+//
+// As a WireGuard endpoint behind a server, it listens on the server's wgEndpoint, and replies
+// to the address of the last packet it received. As a WireGuard peer in front of a client,
+// it is connected to the client's wgListen.
+//
+// The socket is closed when the test ends.
+type fakeWg struct {
+	t         *testing.T
+	conn      *net.UDPConn
+	connected bool
+	recvCh    chan fakeWgPacket
+	done      chan struct{}
+
+	mu       sync.Mutex
+	echo     bool
+	lastFrom netip.AddrPort
+	received []fakeWgPacket
+}
+
+// newFakeWgEndpoint returns a fake WireGuard endpoint listening on listenAddress,
+// for use as the wgEndpoint of a server.
+func newFakeWgEndpoint(t *testing.T, listenAddress string) *fakeWg {
+	t.Helper()
+	laddr, err := net.ResolveUDPAddr("udp", listenAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newFakeWg(t, c, false)
+}
+
+// newFakeWgPeer returns a fake WireGuard peer connected to wgListen of a client.
+func newFakeWgPeer(t *testing.T, wgListen string) *fakeWg {
+	t.Helper()
+	raddr, err := net.ResolveUDPAddr("udp", wgListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newFakeWg(t, c, true)
+}
+
+func newFakeWg(t *testing.T, c *net.UDPConn, connected bool) *fakeWg {
+	w := &fakeWg{
+		t:         t,
+		conn:      c,
+		connected: connected,
+		recvCh:    make(chan fakeWgPacket, 64),
+		done:      make(chan struct{}),
+	}
+	go w.recv()
+	t.Cleanup(func() {
+		c.Close()
+		<-w.done
+	})
+	return w
+}
+
+func (w *fakeWg) recv() {
+	defer close(w.done)
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := w.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		p := fakeWgPacket{b: append([]byte(nil), buf[:n]...), from: from}
+
+		w.mu.Lock()
+		w.lastFrom = from
+		w.received = append(w.received, p)
+		echo := w.echo
+		w.mu.Unlock()
+
+		if echo {
+			w.conn.WriteToUDPAddrPort(p.b, from)
+		}
+
+		select {
+		case w.recvCh <- p:
+		default:
+		}
+	}
+}
+
+// SetEcho sets whether every received packet is sent back to its sender.
+func (w *fakeWg) SetEcho(echo bool) {
+	w.mu.Lock()
+	w.echo = echo
+	w.mu.Unlock()
+}
+
+// AddrPort returns the local address of the socket.
+func (w *fakeWg) AddrPort() netip.AddrPort {
+	return w.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// Send sends b to the client's wgListen for a peer,
+// or to the sender of the last received packet for an endpoint.
+func (w *fakeWg) Send(b []byte) {
+	w.t.Helper()
+	var err error
+	if w.connected {
+		_, err = w.conn.Write(b)
+	} else {
+		w.mu.Lock()
+		to := w.lastFrom
+		w.mu.Unlock()
+		if !to.IsValid() {
+			w.t.Fatal("No packet received to reply to")
+		}
+		_, err = w.conn.WriteToUDPAddrPort(b, to)
+	}
+	if err != nil {
+		w.t.Fatal(err)
+	}
+}
+
+// Expect waits for the next received packet and fails the test if it is not expected.
+func (w *fakeWg) Expect(expected []byte) fakeWgPacket {
+	w.t.Helper()
+	select {
+	case p := <-w.recvCh:
+		if !bytes.Equal(p.b, expected) {
+			w.t.Errorf("Received %s does not match expected packet (type %d, length %d)", p, expected[0], len(expected))
+		}
+		return p
+	case <-time.After(fakeWgTimeout):
+		w.t.Fatalf("Timed out waiting for packet (type %d, length %d)", expected[0], len(expected))
+		return fakeWgPacket{}
+	}
+}
+
+// ExpectNone fails the test if a packet is received within d.
+func (w *fakeWg) ExpectNone(d time.Duration) {
+	w.t.Helper()
+	select {
+	case p := <-w.recvCh:
+		w.t.Errorf("Unexpected %s", p)
+	case <-time.After(d):
+	}
+}
+
+// Received returns all packets received so far, in order.
+func (w *fakeWg) Received() []fakeWgPacket {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]fakeWgPacket(nil), w.received...)
+}
+
+// newTestWgPacket returns a WireGuard packet of the message type and length with random contents.
+func newTestWgPacket(t *testing.T, msgType byte, length int) []byte {
+	t.Helper()
+	b := make([]byte, length)
+	b[0] = msgType
+	if _, err := rand.Read(b[1:]); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestClientServerFakeWgEndpointEcho(t *testing.T) {
+	psk := generateTestPSK(t)
+
+	serverConfig := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: ":20347",
+		ProxyMode:   "paranoid",
+		ProxyPSK:    psk,
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20348)),
+		MTU:         1500,
+	}
+
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20349",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20347)),
+		ProxyMode:     "paranoid",
+		ProxyPSK:      psk,
+		MTU:           1500,
+	}
+
+	ctx := context.Background()
+	sc := Config{
+		Servers: []ServerConfig{serverConfig},
+		Clients: []ClientConfig{clientConfig},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	peer := newFakeWgPeer(t, clientConfig.WgListen)
+	endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+	endpoint.SetEcho(true)
+
+	packets := [][]byte{
+		newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation),
+		newTestWgPacket(t, packet.WireGuardMessageTypeData, 128),
+		newTestWgPacket(t, packet.WireGuardMessageTypeData, 1024),
+	}
+	for _, p := range packets {
+		peer.Send(p)
+		peer.Expect(p)
+	}
+
+	received := endpoint.Received()
+	if len(received) != len(packets) {
+		t.Fatalf("Expected endpoint to receive %d packets, got %d", len(packets), len(received))
+	}
+	for i, p := range received {
+		if !bytes.Equal(p.b, packets[i]) {
+			t.Errorf("Endpoint received %s, expected packet %d", p, i)
+		}
+		if p.from != received[0].from {
+			t.Errorf("Expected all packets from the session address %s, got %s", received[0].from, p.from)
+		}
+	}
+}
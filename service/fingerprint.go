@@ -0,0 +1,33 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"go.uber.org/zap"
+)
+
+// pskFingerprintLength is the number of leading bytes of a PSK's SHA-256 hash used as its fingerprint.
+const pskFingerprintLength = 8
+
+// pskFingerprint returns the hex-encoded fingerprint of psk.
+// The fingerprint identifies the key without revealing it.
+func pskFingerprint(psk []byte) string {
+	sum := sha256.Sum256(psk)
+	return hex.EncodeToString(sum[:pskFingerprintLength])
+}
+
+// pskFingerprintFields returns the log fields of the fingerprints of the configured PSKs,
+// or nil if no PSK is configured.
+func pskFingerprintFields(proxyPSK, inboundPSK, outboundPSK []byte) []zap.Field {
+	if inboundPSK != nil || outboundPSK != nil {
+		return []zap.Field{
+			zap.String("proxyPSKInboundFingerprint", pskFingerprint(inboundPSK)),
+			zap.String("proxyPSKOutboundFingerprint", pskFingerprint(outboundPSK)),
+		}
+	}
+	if proxyPSK != nil {
+		return []zap.Field{zap.String("proxyPSKFingerprint", pskFingerprint(proxyPSK))}
+	}
+	return nil
+}
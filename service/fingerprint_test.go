@@ -0,0 +1,58 @@
+package service
+
+import (
+	"bytes"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestPSKFingerprint(t *testing.T) {
+	psk := generateTestPSK(t)
+
+	fingerprint := pskFingerprint(psk)
+	if len(fingerprint) != 2*pskFingerprintLength {
+		t.Errorf("Expected fingerprint length %d, got %d", 2*pskFingerprintLength, len(fingerprint))
+	}
+	if fingerprint != pskFingerprint(bytes.Clone(psk)) {
+		t.Error("Expected the same PSK to have the same fingerprint")
+	}
+	if fingerprint == pskFingerprint(generateTestPSK(t)) {
+		t.Error("Expected different PSKs to have different fingerprints")
+	}
+}
+
+func TestPSKFingerprintFields(t *testing.T) {
+	psk := generateTestPSK(t)
+	inboundPSK := generateTestPSK(t)
+	outboundPSK := generateTestPSK(t)
+
+	for _, c := range []struct {
+		name           string
+		proxyPSK       []byte
+		inboundPSK     []byte
+		outboundPSK    []byte
+		expectedFields []zap.Field
+	}{
+		{"None", nil, nil, nil, nil},
+		{"ProxyPSK", psk, nil, nil, []zap.Field{
+			zap.String("proxyPSKFingerprint", pskFingerprint(psk)),
+		}},
+		{"Directional", nil, inboundPSK, outboundPSK, []zap.Field{
+			zap.String("proxyPSKInboundFingerprint", pskFingerprint(inboundPSK)),
+			zap.String("proxyPSKOutboundFingerprint", pskFingerprint(outboundPSK)),
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			fields := pskFingerprintFields(c.proxyPSK, c.inboundPSK, c.outboundPSK)
+			if len(fields) != len(c.expectedFields) {
+				t.Fatalf("Expected %d fields, got %d", len(c.expectedFields), len(fields))
+			}
+			for i := range fields {
+				if !fields[i].Equals(c.expectedFields[i]) {
+					t.Errorf("Field %d is %v, expected %v", i, fields[i], c.expectedFields[i])
+				}
+			}
+		})
+	}
+}
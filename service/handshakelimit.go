@@ -0,0 +1,62 @@
+package service
+
+import (
+	"sync/atomic"
+
+	"github.com/database64128/swgp-go/packet"
+)
+
+// handshakeLimiter limits the rate of handshake initiations forwarded to the WireGuard endpoint.
+//
+// Each handshake takes a token from a bucket of one second's worth of handshakes,
+// so a burst of up to rate handshakes passes right away. Handshakes beyond the limit are dropped and counted.
+// WireGuard retries dropped handshakes after 5 seconds, which spreads out a reconnection storm.
+//
+// handshakeLimiter is safe for concurrent use by multiple goroutines.
+type handshakeLimiter struct {
+	bucket *tokenBucket
+
+	dropped atomic.Uint64
+}
+
+// newHandshakeLimiter returns a new limiter that forwards up to rate handshake initiations per second.
+//
+// If rate is not positive, nil is returned. All methods are safe to call on a nil limiter.
+func newHandshakeLimiter(rate int) *handshakeLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &handshakeLimiter{
+		bucket: newTokenBucket(float64(rate), float64(rate)),
+	}
+}
+
+// Allow returns whether wgPacket may be forwarded.
+// Packets other than handshake initiations are always allowed.
+func (l *handshakeLimiter) Allow(wgPacket []byte) bool {
+	if l == nil || wgPacket[0] != packet.WireGuardMessageTypeHandshakeInitiation {
+		return true
+	}
+
+	if !l.bucket.Take(1) {
+		l.dropped.Add(1)
+		return false
+	}
+	return true
+}
+
+// Dropped returns the number of handshake initiations dropped for exceeding the limit.
+func (l *handshakeLimiter) Dropped() uint64 {
+	if l == nil {
+		return 0
+	}
+	return l.dropped.Load()
+}
+
+// WouldAllow returns whether a handshake initiation would be forwarded now, without taking a token.
+func (l *handshakeLimiter) WouldAllow() bool {
+	if l == nil {
+		return true
+	}
+	return l.bucket.Has(1)
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestHandshakeLimiter(t *testing.T) {
+	l := newHandshakeLimiter(5)
+	initiation := []byte{packet.WireGuardMessageTypeHandshakeInitiation}
+	data := []byte{packet.WireGuardMessageTypeData}
+
+	for i := 0; i < 5; i++ {
+		if !l.Allow(initiation) {
+			t.Fatalf("Handshake initiation %d dropped, expected burst to pass", i)
+		}
+	}
+	if l.Allow(initiation) {
+		t.Error("Expected handshake initiation beyond the burst to be dropped")
+	}
+	if !l.Allow(data) {
+		t.Error("Expected data packet to pass")
+	}
+	if dropped := l.Dropped(); dropped != 1 {
+		t.Errorf("Expected 1 dropped handshake initiation, got %d", dropped)
+	}
+
+	// 5 per second refills a token every 200ms.
+	time.Sleep(250 * time.Millisecond)
+	if !l.Allow(initiation) {
+		t.Error("Expected handshake initiation to pass after refill")
+	}
+}
+
+func TestHandshakeLimiterNil(t *testing.T) {
+	l := newHandshakeLimiter(0)
+	if l != nil {
+		t.Fatal("Expected nil limiter for zero rate")
+	}
+	if !l.Allow([]byte{packet.WireGuardMessageTypeHandshakeInitiation}) {
+		t.Error("Nil limiter must never drop packets")
+	}
+	if dropped := l.Dropped(); dropped != 0 {
+		t.Errorf("Expected 0 dropped packets, got %d", dropped)
+	}
+}
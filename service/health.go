@@ -0,0 +1,96 @@
+package service
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultProxyHealthTimeout is the default silence period after which a client considers its proxy path down.
+//
+// A WireGuard peer answers a handshake initiation right away, and a data packet at the latest
+// with a passive keepalive after 10 seconds. Handshake initiations are retried every 5 seconds.
+// So a healthy path never goes 15 seconds without return traffic while packets are being sent.
+const defaultProxyHealthTimeout = 15 * time.Second
+
+// proxyHealth tracks whether a client is receiving return traffic from its proxy endpoint.
+//
+// The path is down when packets have been sent for longer than the timeout without any
+// packet coming back. An idle path is not down.
+//
+// proxyHealth is safe for concurrent use by multiple goroutines.
+type proxyHealth struct {
+	timeout time.Duration
+
+	// pendingSince is the Unix time in nanoseconds of the first packet sent
+	// since the last packet was received. 0 means no packets are awaiting return traffic.
+	pendingSince atomic.Int64
+
+	// down is the last reported state, used to report each transition once.
+	down atomic.Bool
+}
+
+// Sent records that a packet was sent to the proxy endpoint.
+// It returns true if this finds the path down for the first time since it was last up.
+func (h *proxyHealth) Sent() bool {
+	now := time.Now().UnixNano()
+	since := h.pendingSince.Load()
+	if since == 0 {
+		h.pendingSince.CompareAndSwap(0, now)
+		return false
+	}
+	return now-since > int64(h.timeout) && !h.down.Load() && !h.down.Swap(true)
+}
+
+// Received records that a packet was received from the proxy endpoint.
+// If the path was reported down, it returns how long it has been down and true.
+func (h *proxyHealth) Received() (time.Duration, bool) {
+	since := h.pendingSince.Load()
+	if since == 0 {
+		return 0, false
+	}
+	h.pendingSince.Store(0)
+	if !h.down.Load() || !h.down.Swap(false) {
+		return 0, false
+	}
+	return time.Since(time.Unix(0, since)), true
+}
+
+// Up returns whether the path is up.
+func (h *proxyHealth) Up() bool {
+	since := h.pendingSince.Load()
+	return since == 0 || time.Now().UnixNano()-since <= int64(h.timeout)
+}
+
+// proxySent records a packet sent to the proxy endpoint for session clientAddrPort,
+// and reports the proxy path going down.
+func (c *client) proxySent(clientAddrPort netip.AddrPort) {
+	if !c.proxyHealth.Sent() {
+		return
+	}
+	c.publishEvent(EventProxyDown, clientAddrPort, nil)
+	c.logger.Warn("Proxy endpoint stopped responding",
+		zap.String("client", c.name),
+		zap.String("listenAddress", c.wgListen),
+		zap.Stringer("proxyAddress", &c.proxyAddr),
+		zap.Duration("proxyHealthTimeout", c.proxyHealth.timeout),
+	)
+}
+
+// proxyReceived records a packet received from the proxy endpoint for session clientAddrPort,
+// and reports the proxy path recovering.
+func (c *client) proxyReceived(clientAddrPort netip.AddrPort) {
+	downtime, ok := c.proxyHealth.Received()
+	if !ok {
+		return
+	}
+	c.publishEvent(EventProxyUp, clientAddrPort, nil)
+	c.logger.Info("Proxy endpoint recovered",
+		zap.String("client", c.name),
+		zap.String("listenAddress", c.wgListen),
+		zap.Stringer("proxyAddress", &c.proxyAddr),
+		zap.Duration("downtime", downtime),
+	)
+}
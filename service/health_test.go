@@ -0,0 +1,49 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProxyHealth(t *testing.T) {
+	h := proxyHealth{timeout: 50 * time.Millisecond}
+	if !h.Up() {
+		t.Error("Expected idle path to be up")
+	}
+
+	if h.Sent() {
+		t.Error("Expected first send not to report the path down")
+	}
+	if _, ok := h.Received(); ok {
+		t.Error("Expected path that was never down not to report recovery")
+	}
+	if !h.Up() {
+		t.Error("Expected path with return traffic to be up")
+	}
+
+	h.Sent()
+	time.Sleep(2 * h.timeout)
+	if h.Up() {
+		t.Error("Expected path without return traffic to be down")
+	}
+	if !h.Sent() {
+		t.Error("Expected send after timeout to report the path down")
+	}
+	if h.Sent() {
+		t.Error("Expected the path going down to be reported only once")
+	}
+
+	downtime, ok := h.Received()
+	if !ok {
+		t.Fatal("Expected return traffic to report recovery")
+	}
+	if downtime < 2*h.timeout {
+		t.Errorf("Expected downtime of at least %v, got %v", 2*h.timeout, downtime)
+	}
+	if !h.Up() {
+		t.Error("Expected recovered path to be up")
+	}
+	if _, ok = h.Received(); ok {
+		t.Error("Expected recovery to be reported only once")
+	}
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/database64128/swgp-go/jsonhelper"
+)
+
+// LoadConfig loads the JSON configuration file at path, processes include directives,
+// and returns the merged configuration.
+//
+// Include patterns are resolved relative to the directory of the including file,
+// and may contain wildcards, e.g. "conf.d/*.json". Servers and clients from
+// included files are appended to those of the including file. Each file may only
+// be loaded once, and service names must be unique across all loaded files.
+// Included files may only contain servers, clients, and include directives.
+// Other top-level fields are only read from the root file, and are rejected in included files,
+// so that they are not silently ignored.
+func LoadConfig(path string) (Config, error) {
+	sc, _, err := loadConfig(path)
+	return sc, err
+}
+
+// loadConfig is like [LoadConfig], but also returns the absolute paths of the loaded files.
+func loadConfig(path string) (Config, []string, error) {
+	var sc Config
+	loaded := make(map[string]struct{})
+	if err := sc.loadFile(path, loaded, true); err != nil {
+		return Config{}, nil, err
+	}
+	sc.Include = nil
+
+	if err := sc.checkDuplicateNames(); err != nil {
+		return Config{}, nil, err
+	}
+
+	files := make([]string, 0, len(loaded))
+	for file := range loaded {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return sc, files, nil
+}
+
+// includedConfig is the configuration of an included file.
+type includedConfig struct {
+	Servers []ServerConfig `json:"servers"`
+	Clients []ClientConfig `json:"clients"`
+	Include []string       `json:"include"`
+}
+
+// loadFile loads the configuration file at path and merges its services into sc.
+// The root file also sets the other fields of sc.
+func (sc *Config) loadFile(path string, loaded map[string]struct{}, root bool) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if _, ok := loaded[absPath]; ok {
+		return fmt.Errorf("config file %s is included more than once", path)
+	}
+	loaded[absPath] = struct{}{}
+
+	var include []string
+	if root {
+		if err = jsonhelper.LoadAndDecodeDisallowUnknownFields(absPath, sc); err != nil {
+			return fmt.Errorf("failed to load config file %s: %w", path, err)
+		}
+		include = sc.Include
+	} else {
+		var fc includedConfig
+		if err = jsonhelper.LoadAndDecodeDisallowUnknownFields(absPath, &fc); err != nil {
+			return fmt.Errorf("failed to load included config file %s, which may only contain servers, clients, and include: %w", path, err)
+		}
+		sc.Servers = append(sc.Servers, fc.Servers...)
+		sc.Clients = append(sc.Clients, fc.Clients...)
+		include = fc.Include
+	}
+
+	dir := filepath.Dir(absPath)
+
+	for _, pattern := range include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("bad include pattern %s in %s: %w", pattern, path, err)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("include pattern %s in %s matched no files", pattern, path)
+		}
+
+		for _, match := range matches {
+			if err = sc.loadFile(match, loaded, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkDuplicateNames returns an error if two servers or two clients share the same name.
+// A server and a client may share a name, as they are often named after the same interface.
+func (sc *Config) checkDuplicateNames() error {
+	serverNames := make(map[string]struct{}, len(sc.Servers))
+	for i := range sc.Servers {
+		name := sc.Servers[i].Name
+		if _, ok := serverNames[name]; ok {
+			return fmt.Errorf("duplicate server name: %s", name)
+		}
+		serverNames[name] = struct{}{}
+	}
+
+	clientNames := make(map[string]struct{}, len(sc.Clients))
+	for i := range sc.Clients {
+		name := sc.Clients[i].Name
+		if _, ok := clientNames[name]; ok {
+			return fmt.Errorf("duplicate client name: %s", name)
+		}
+		clientNames[name] = struct{}{}
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestConfigFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigInclude(t *testing.T) {
+	dir := t.TempDir()
+
+	writeTestConfigFile(t, filepath.Join(dir, "config.json"), `{
+	"servers": [{"name": "wg0"}],
+	"include": ["conf.d/*.json"],
+	"nodeID": "vps1",
+	"logFormat": "json"
+}`)
+	writeTestConfigFile(t, filepath.Join(dir, "conf.d", "wg1.json"), `{"servers": [{"name": "wg1"}]}`)
+	writeTestConfigFile(t, filepath.Join(dir, "conf.d", "wg2.json"), `{"clients": [{"name": "wg2"}]}`)
+
+	sc, err := LoadConfig(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sc.Servers) != 2 || sc.Servers[0].Name != "wg0" || sc.Servers[1].Name != "wg1" {
+		t.Errorf("Unexpected servers: %+v", sc.Servers)
+	}
+	if len(sc.Clients) != 1 || sc.Clients[0].Name != "wg2" {
+		t.Errorf("Unexpected clients: %+v", sc.Clients)
+	}
+	if sc.Include != nil {
+		t.Errorf("Expected include directives to be cleared, got %v", sc.Include)
+	}
+
+	if sc.NodeID != "vps1" {
+		t.Errorf("Expected node ID vps1 from the root file, got %q", sc.NodeID)
+	}
+	if sc.LogFormat != "json" {
+		t.Errorf("Expected log format json from the root file, got %q", sc.LogFormat)
+	}
+}
+
+func TestLoadConfigIncludeErrors(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		files       map[string]string
+		expectedErr string
+	}{
+		{
+			name: "DuplicateName",
+			files: map[string]string{
+				"config.json": `{"servers": [{"name": "wg0"}], "include": ["other.json"]}`,
+				"other.json":  `{"servers": [{"name": "wg0"}]}`,
+			},
+			expectedErr: "duplicate server name: wg0",
+		},
+		{
+			name: "Cycle",
+			files: map[string]string{
+				"config.json": `{"include": ["other.json"]}`,
+				"other.json":  `{"include": ["config.json"]}`,
+			},
+			expectedErr: "included more than once",
+		},
+		{
+			name: "NoMatch",
+			files: map[string]string{
+				"config.json": `{"include": ["missing/*.json"]}`,
+			},
+			expectedErr: "matched no files",
+		},
+		{
+			name: "TopLevelFieldInInclude",
+			files: map[string]string{
+				"config.json": `{"include": ["other.json"]}`,
+				"other.json":  `{"servers": [{"name": "wg0"}], "statsdAddr": "127.0.0.1:8125"}`,
+			},
+			expectedErr: `unknown field "statsdAddr"`,
+		},
+		{
+			name: "UnknownFieldInInclude",
+			files: map[string]string{
+				"config.json": `{"include": ["other.json"]}`,
+				"other.json":  `{"servers": [{"name": "wg0"}], "sever": []}`,
+			},
+			expectedErr: `unknown field "sever"`,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range c.files {
+				writeTestConfigFile(t, filepath.Join(dir, name), content)
+			}
+
+			_, err := LoadConfig(filepath.Join(dir, "config.json"))
+			if err == nil || !strings.Contains(err.Error(), c.expectedErr) {
+				t.Errorf("Expected error containing %q, got %v", c.expectedErr, err)
+			}
+		})
+	}
+}
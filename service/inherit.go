@@ -0,0 +1,252 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/database64128/swgp-go/conn"
+	"go.uber.org/zap"
+)
+
+// InheritedSocketsEnv is the environment variable that passes listening sockets to a new process.
+// Its value is a JSON object that maps socket keys, like "udp :20220", to inherited file descriptors.
+const InheritedSocketsEnv = "SWGP_INHERITED_SOCKETS"
+
+// socketKey returns the key of the listening socket of kind ("udp" or "tcp") on address.
+func socketKey(kind, address string) string {
+	return kind + " " + address
+}
+
+// inheritedSockets holds the listening sockets inherited from a previous process,
+// until the services that listen on the same addresses claim them.
+//
+// A nil inheritedSockets has no sockets, and listens on new sockets.
+type inheritedSockets struct {
+	mu    sync.Mutex
+	files map[string]*os.File
+}
+
+// take removes and returns the inherited socket of key, or nil if there is none.
+func (s *inheritedSockets) take(key string) *os.File {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.files[key]
+	delete(s.files, key)
+	return f
+}
+
+// listenUDP returns the inherited UDP socket on address, or listens on a new one with lc.
+func (s *inheritedSockets) listenUDP(ctx context.Context, lc *conn.ListenConfig, network, address string) (*net.UDPConn, error) {
+	f := s.take(socketKey("udp", address))
+	if f == nil {
+		return lc.ListenUDP(ctx, network, address)
+	}
+	defer f.Close()
+
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use inherited socket %s: %w", f.Name(), err)
+	}
+	udpConn, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, fmt.Errorf("inherited socket %s is not a UDP socket", f.Name())
+	}
+	return udpConn, nil
+}
+
+// listenTCP returns the inherited TCP listener on address, or listens on a new one with lc.
+func (s *inheritedSockets) listenTCP(ctx context.Context, lc *conn.ListenConfig, network, address string) (*net.TCPListener, error) {
+	f := s.take(socketKey("tcp", address))
+	if f == nil {
+		return lc.ListenTCP(ctx, network, address)
+	}
+	defer f.Close()
+
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use inherited socket %s: %w", f.Name(), err)
+	}
+	tcpListener, ok := ln.(*net.TCPListener)
+	if !ok {
+		ln.Close()
+		return nil, fmt.Errorf("inherited socket %s is not a TCP listener", f.Name())
+	}
+	return tcpListener, nil
+}
+
+// closeUnclaimed closes the inherited sockets no service claimed, and returns their keys.
+func (s *inheritedSockets) closeUnclaimed() []string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.files))
+	for key, f := range s.files {
+		f.Close()
+		keys = append(keys, key)
+	}
+	s.files = nil
+	return keys
+}
+
+// InheritedSocketsFromEnv returns the listening sockets passed by [InheritedSocketsEnv], keyed by socket key,
+// and unsets the variable, so that it is not passed on to other processes.
+// It returns nil if the variable is not set.
+func InheritedSocketsFromEnv() (map[string]*os.File, error) {
+	value, ok := os.LookupEnv(InheritedSocketsEnv)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(InheritedSocketsEnv)
+
+	var fds map[string]int
+	if err := json.Unmarshal([]byte(value), &fds); err != nil {
+		return nil, fmt.Errorf("bad %s: %w", InheritedSocketsEnv, err)
+	}
+
+	files := make(map[string]*os.File, len(fds))
+	for key, fd := range fds {
+		if !isInheritedSocketKey(key) {
+			return nil, fmt.Errorf("bad %s: bad socket key %q", InheritedSocketsEnv, key)
+		}
+		if fd < 3 {
+			return nil, fmt.Errorf("bad %s: socket %q has reserved file descriptor %d", InheritedSocketsEnv, key, fd)
+		}
+		files[key] = os.NewFile(uintptr(fd), key)
+	}
+	return files, nil
+}
+
+// InheritedSocketsEnvValue returns the value of [InheritedSocketsEnv] that maps socket keys to file descriptors.
+func InheritedSocketsEnvValue(fds map[string]int) string {
+	b, _ := json.Marshal(fds)
+	return string(b)
+}
+
+// InheritSockets makes the services use the listening sockets in files, keyed by socket key,
+// instead of listening on new ones. It must be called before [Manager.Start], which closes the
+// sockets no service claimed. The manager takes ownership of the files.
+//
+// Inherited sockets keep the socket options they were created with.
+func (m *Manager) InheritSockets(files map[string]*os.File) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(files) == 0 {
+		return
+	}
+	m.inherited = &inheritedSockets{files: files}
+	for _, s := range m.services {
+		switch svc := s.Service.(type) {
+		case *server:
+			svc.inherited = m.inherited
+		case *client:
+			svc.inherited = m.inherited
+		}
+	}
+}
+
+// closeUnclaimedInheritedSockets closes the inherited sockets no service claimed on start.
+// Services started later by [Manager.Reload] listen on new sockets.
+func (m *Manager) closeUnclaimedInheritedSockets() {
+	if m.inherited == nil {
+		return
+	}
+	for _, key := range m.inherited.closeUnclaimed() {
+		m.logger.Warn("Closed inherited socket not used by any service", zap.String("socket", key))
+	}
+	m.inherited = nil
+}
+
+// ListenerFiles returns duplicates of the listening sockets of the running services, keyed by socket key,
+// for passing to a new process with [InheritedSocketsEnv]. The caller owns the returned files.
+//
+// The services keep running on their sockets. Sockets of outgoing connections, like the server's
+// sockets to the WireGuard endpoint, are not included: the new process creates its own.
+func (m *Manager) ListenerFiles() (map[string]*os.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	files := make(map[string]*os.File)
+	for _, s := range m.services {
+		var err error
+		switch svc := s.Service.(type) {
+		case *server:
+			err = svc.listenerFiles(files)
+		case *client:
+			err = svc.listenerFiles(files)
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, fmt.Errorf("failed to get listening sockets of %s %s: %w", s.role, s.name, err)
+		}
+	}
+	return files, nil
+}
+
+// fileConn is implemented by [*net.UDPConn] and [*net.TCPListener].
+type fileConn interface {
+	File() (*os.File, error)
+}
+
+// addListenerFile adds a duplicate of c to files under the key of the socket of kind on address.
+func addListenerFile(files map[string]*os.File, kind, address string, c fileConn) error {
+	f, err := c.File()
+	if err != nil {
+		return err
+	}
+	key := socketKey(kind, address)
+	if old, ok := files[key]; ok {
+		old.Close()
+	}
+	files[key] = f
+	return nil
+}
+
+// listenerFiles adds duplicates of the server's proxy socket and decoy sockets to files.
+func (s *server) listenerFiles(files map[string]*os.File) error {
+	switch {
+	case s.proxyListener != nil:
+		if err := addListenerFile(files, "tcp", s.proxyListen, s.proxyListener); err != nil {
+			return err
+		}
+	case s.proxyConn != nil:
+		if err := addListenerFile(files, "udp", s.proxyListen, s.proxyConn); err != nil {
+			return err
+		}
+	}
+	if d := s.decoys; d != nil {
+		for i, c := range d.conns {
+			if err := addListenerFile(files, "udp", d.addresses[i], c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// listenerFiles adds a duplicate of the client's WireGuard socket to files.
+func (c *client) listenerFiles(files map[string]*os.File) error {
+	if c.wgConn == nil {
+		return nil
+	}
+	return addListenerFile(files, "udp", c.wgListen, c.wgConn)
+}
+
+// isInheritedSocketKey reports whether key looks like a socket key.
+func isInheritedSocketKey(key string) bool {
+	kind, address, ok := strings.Cut(key, " ")
+	return ok && (kind == "udp" || kind == "tcp") && address != ""
+}
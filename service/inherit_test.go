@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestManagerInheritSockets(t *testing.T) {
+	psk := generateTestPSK(t)
+	serverConfig := testReloadServerConfig("wg0", ":20434", psk)
+	serverConfig.WgEndpoint = conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20435))
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20436",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20434)),
+		ProxyMode:     "zero-overhead",
+		ProxyPSK:      psk,
+		MTU:           1500,
+	}
+	sc := Config{
+		Servers: []ServerConfig{serverConfig},
+		Clients: []ClientConfig{clientConfig},
+	}
+
+	oldManager, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = oldManager.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stopped := false
+	defer func() {
+		if !stopped {
+			oldManager.Stop()
+		}
+	}()
+
+	files, err := oldManager.ListenerFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"udp :20434", "udp :20436"} {
+		if files[key] == nil {
+			t.Errorf("Missing listening socket %q", key)
+		}
+	}
+	if len(files) != 2 {
+		t.Errorf("Expected 2 listening sockets, got %d", len(files))
+	}
+
+	// The new manager cannot bind the addresses in use, so it must use the inherited sockets.
+	newManager, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newManager.InheritSockets(files)
+	if err = newManager.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer newManager.Stop()
+
+	oldManager.Stop()
+	stopped = true
+	assertPortInUse(t, ":20434", true)
+	assertPortInUse(t, ":20436", true)
+
+	peer := newFakeWgPeer(t, clientConfig.WgListen)
+	endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+	handshake := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+	peer.Send(handshake)
+	endpoint.Expect(handshake)
+}
+
+func TestInheritedSocketsFromEnv(t *testing.T) {
+	// Use fds that are not open in the test process, so that closing the files is harmless.
+	for _, c := range []struct {
+		name  string
+		value string
+		count int
+		ok    bool
+	}{
+		{"Empty", "{}", 0, true},
+		{"Valid", `{"udp :20220":1000,"tcp :20221":1001}`, 2, true},
+		{"BadJSON", "udp :20220=1000", 0, false},
+		{"BadKey", `{"unix /run/swgp.sock":1000}`, 0, false},
+		{"ReservedFD", `{"udp :20220":2}`, 0, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv(InheritedSocketsEnv, c.value)
+			files, err := InheritedSocketsFromEnv()
+			if ok := err == nil; ok != c.ok {
+				t.Errorf("Expected ok %v, got error %v", c.ok, err)
+			}
+			if _, set := os.LookupEnv(InheritedSocketsEnv); set {
+				t.Errorf("Expected %s to be unset", InheritedSocketsEnv)
+			}
+			if len(files) != c.count {
+				t.Errorf("Expected %d sockets, got %d", c.count, len(files))
+			}
+			for _, f := range files {
+				f.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+	"go.uber.org/zap"
+)
+
+// proxyModeZeroOverheadKeyed is the proxy mode of [packet.KeyedHandler] over zero-overhead handlers.
+const proxyModeZeroOverheadKeyed = "zero-overhead-keyed"
+
+// ProxyKeyConfig is a PSK of a server in the "zero-overhead-keyed" proxy mode.
+type ProxyKeyConfig struct {
+	// ID identifies the key in packets. Clients using the key set it as their proxyKeyID.
+	ID uint8 `json:"id"`
+
+	// PSK is the 32-byte key.
+	PSK []byte `json:"psk"`
+
+	// Name names the tenant of the key in stats. It must be unique among the server's keys.
+	// The default empty value uses the key ID.
+	Name string `json:"name"`
+
+	// WgEndpoint is the WireGuard endpoint of the sessions of the key, so that tenants sharing
+	// the server's socket each reach their own endpoint. It cannot be combined with transparentRoutes.
+	// The default zero value uses the server's wgEndpoint.
+	WgEndpoint conn.Addr `json:"wgEndpoint"`
+
+	// NotAfter is the time after which the key is no longer accepted, so that the old key of a rotation
+	// stops being accepted once the rotation window closes, without another config change.
+	// Packets carrying an expired key are dropped before decryption and counted, and sessions of the key
+	// expire as their peers stop getting through. It is an RFC 3339 timestamp, like "2024-07-01T00:00:00Z".
+	//
+	// The default zero value never expires the key.
+	NotAfter time.Time `json:"notAfter"`
+}
+
+// getKeyedPacketHandler creates the packet handler for the "zero-overhead-keyed" proxy mode.
+// Packets are encrypted with the key of keyID, and decrypted with the key of the key ID they carry.
+// Key IDs are masked with maskKey.
+func getKeyedPacketHandler(keys []ProxyKeyConfig, maskKey []byte, keyID uint8) (packet.KeyedHandler, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no proxy keys")
+	}
+	if len(maskKey) != packet.KeyIDMaskKeySize {
+		return nil, fmt.Errorf("the %s proxy mode requires a %d-byte proxyKeyMaskKey", proxyModeZeroOverheadKeyed, packet.KeyIDMaskKeySize)
+	}
+
+	handlers := make(map[byte]packet.Handler, len(keys))
+	for _, key := range keys {
+		if _, ok := handlers[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate proxy key ID: %d", key.ID)
+		}
+		handler, err := packet.NewZeroOverheadHandler(key.PSK)
+		if err != nil {
+			return nil, fmt.Errorf("proxy key %d: %w", key.ID, err)
+		}
+		handlers[key.ID] = handler
+	}
+	return packet.NewKeyedHandler(handlers, maskKey, keyID)
+}
+
+// getServerPacketHandler creates the packet handler of the server.
+// In the "zero-overhead-keyed" proxy mode, the keyed handler is also returned.
+func getServerPacketHandler(sc *ServerConfig) (packet.Handler, packet.KeyedHandler, error) {
+	inboundMode, outboundMode, err := directionalProxyModes(sc.ProxyMode, sc.ProxyModeInbound, sc.ProxyModeOutbound)
+	if err != nil {
+		return nil, nil, err
+	}
+	sizeClasses, err := checkPaddingStrategy(sc.PaddingStrategy, sc.PaddingSizeClasses, outboundMode)
+	if err != nil {
+		return nil, nil, err
+	}
+	inboundOpts, outboundOpts, err := optionsWithSessionSubkeys(sc.ProxyModeOptions, sc.SessionSubkeys, inboundMode, outboundMode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if sc.ProxyMode != proxyModeZeroOverheadKeyed {
+		if len(sc.ProxyKeys) > 0 {
+			return nil, nil, fmt.Errorf("proxyKeys requires the %s proxy mode", proxyModeZeroOverheadKeyed)
+		}
+		if sc.ProxyKeyMaskKey != nil {
+			return nil, nil, fmt.Errorf("proxyKeyMaskKey requires the %s proxy mode", proxyModeZeroOverheadKeyed)
+		}
+		handler, err := getPacketHandler(inboundMode, outboundMode, sc.ProxyPSK, sc.ProxyPSKInbound, sc.ProxyPSKOutbound,
+			inboundOpts, optionsWithSizeClasses(outboundOpts, sizeClasses))
+		return handler, nil, err
+	}
+
+	if sc.ProxyPSK != nil || sc.ProxyPSKInbound != nil || sc.ProxyPSKOutbound != nil {
+		return nil, nil, fmt.Errorf("the %s proxy mode uses proxyKeys instead of proxyPSK", proxyModeZeroOverheadKeyed)
+	}
+	if len(sc.ProxyKeys) == 0 {
+		return nil, nil, fmt.Errorf("the %s proxy mode requires proxyKeys", proxyModeZeroOverheadKeyed)
+	}
+	keyedHandler, err := getKeyedPacketHandler(sc.ProxyKeys, sc.ProxyKeyMaskKey, sc.ProxyKeys[0].ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keyedHandler, keyedHandler, nil
+}
+
+// getClientPacketHandler creates the packet handler of the client.
+func getClientPacketHandler(cc *ClientConfig) (packet.Handler, error) {
+	inboundMode, outboundMode, err := directionalProxyModes(cc.ProxyMode, cc.ProxyModeInbound, cc.ProxyModeOutbound)
+	if err != nil {
+		return nil, err
+	}
+	sizeClasses, err := checkPaddingStrategy(cc.PaddingStrategy, cc.PaddingSizeClasses, outboundMode)
+	if err != nil {
+		return nil, err
+	}
+	inboundOpts, outboundOpts, err := optionsWithSessionSubkeys(cc.ProxyModeOptions, cc.SessionSubkeys, inboundMode, outboundMode)
+	if err != nil {
+		return nil, err
+	}
+
+	if cc.ProxyMode != proxyModeZeroOverheadKeyed {
+		if cc.ProxyKeyMaskKey != nil {
+			return nil, fmt.Errorf("proxyKeyMaskKey requires the %s proxy mode", proxyModeZeroOverheadKeyed)
+		}
+		return getPacketHandler(inboundMode, outboundMode, cc.ProxyPSK, cc.ProxyPSKInbound, cc.ProxyPSKOutbound,
+			inboundOpts, optionsWithSizeClasses(outboundOpts, sizeClasses))
+	}
+	if cc.ProxyPSKInbound != nil || cc.ProxyPSKOutbound != nil {
+		return nil, fmt.Errorf("directional PSKs are not supported in the %s proxy mode", proxyModeZeroOverheadKeyed)
+	}
+	return getKeyedPacketHandler([]ProxyKeyConfig{{ID: cc.ProxyKeyID, PSK: cc.ProxyPSK}}, cc.ProxyKeyMaskKey, cc.ProxyKeyID)
+}
+
+// newKeyHandlers returns the handler of each key of keyedHandler, indexed by key ID.
+func newKeyHandlers(keyedHandler packet.KeyedHandler, keys []ProxyKeyConfig) *[256]packet.Handler {
+	var keyHandlers [256]packet.Handler
+	for _, key := range keys {
+		keyHandlers[key.ID] = keyedHandler.WithKeyID(key.ID)
+	}
+	return &keyHandlers
+}
+
+// newKeyNotAfter returns the expiry times of the proxy keys that have one, indexed by key ID,
+// or nil if no key has one.
+func newKeyNotAfter(keys []ProxyKeyConfig) map[uint8]time.Time {
+	var notAfter map[uint8]time.Time
+	for _, key := range keys {
+		if key.NotAfter.IsZero() {
+			continue
+		}
+		if notAfter == nil {
+			notAfter = make(map[uint8]time.Time, len(keys))
+		}
+		notAfter[key.ID] = key.NotAfter
+	}
+	return notAfter
+}
+
+// keyExpired reports whether the proxy key of keyID expired before now.
+// Keys without an expiry time and unknown key IDs never expire.
+func (s *server) keyExpired(keyID uint8, now time.Time) bool {
+	notAfter, ok := s.keyNotAfter[keyID]
+	return ok && now.After(notAfter)
+}
+
+// acceptKeyID reports whether a packet from clientAddrPort carrying keyID may be decrypted,
+// and counts the packet if its key has expired.
+func (s *server) acceptKeyID(keyID uint8, clientAddrPort netip.AddrPort) bool {
+	if s.keyNotAfter == nil || !s.keyExpired(keyID, time.Now()) {
+		return true
+	}
+	s.expiredKeyPackets.Add(1)
+	s.logLimiter.Warn(s.packetLogger, "Dropping packet with expired proxy key", clientAddrPort,
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.Stringer("clientAddress", clientAddrPort),
+		zap.Uint8("keyID", keyID),
+		zap.Time("notAfter", s.keyNotAfter[keyID]),
+	)
+	return false
+}
+
+// proxyKeyFingerprintFields returns the log fields of the fingerprints of the proxy keys.
+func proxyKeyFingerprintFields(keys []ProxyKeyConfig) []zap.Field {
+	fields := make([]zap.Field, len(keys))
+	for i, key := range keys {
+		fields[i] = zap.String(fmt.Sprintf("proxyKey%dFingerprint", key.ID), pskFingerprint(key.PSK))
+	}
+	return fields
+}
+
+// packetKeyID returns the key ID carried by the swgp packet.
+// It must be called before the packet is decrypted in place.
+// If the server is not in the "zero-overhead-keyed" proxy mode, 0 is returned.
+func (s *server) packetKeyID(swgpPacket []byte) uint8 {
+	if s.keyedHandler == nil {
+		return 0
+	}
+	keyID, _ := s.keyedHandler.KeyID(swgpPacket)
+	return keyID
+}
+
+// sessionHandler returns the handler that encrypts packets of a session with the key of keyID.
+// It returns the server's handler if the server is not in the "zero-overhead-keyed" proxy mode,
+// or if there is no such key.
+func (s *server) sessionHandler(keyID uint8) packet.Handler {
+	if s.keyHandlers == nil {
+		return s.handler
+	}
+	if handler := s.keyHandlers[keyID]; handler != nil {
+		return handler
+	}
+	return s.handler
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestGetServerPacketHandlerProxyKeys(t *testing.T) {
+	psk := generateTestPSK(t)
+	maskKey := generateTestPSK(t)
+	keys := []ProxyKeyConfig{{ID: 1, PSK: psk}, {ID: 2, PSK: generateTestPSK(t)}}
+	for _, c := range []struct {
+		name      string
+		proxyMode string
+		proxyPSK  []byte
+		proxyKeys []ProxyKeyConfig
+		maskKey   []byte
+		ok        bool
+	}{
+		{"Keyed", proxyModeZeroOverheadKeyed, nil, keys, maskKey, true},
+		{"NoKeys", proxyModeZeroOverheadKeyed, nil, nil, maskKey, false},
+		{"ProxyPSK", proxyModeZeroOverheadKeyed, psk, keys, maskKey, false},
+		{"DuplicateID", proxyModeZeroOverheadKeyed, nil, []ProxyKeyConfig{{ID: 1, PSK: psk}, {ID: 1, PSK: psk}}, maskKey, false},
+		{"ShortPSK", proxyModeZeroOverheadKeyed, nil, []ProxyKeyConfig{{ID: 1, PSK: psk[:16]}}, maskKey, false},
+		{"NoMaskKey", proxyModeZeroOverheadKeyed, nil, keys, nil, false},
+		{"ShortMaskKey", proxyModeZeroOverheadKeyed, nil, keys, maskKey[:16], false},
+		{"KeysWithoutKeyedMode", "zero-overhead", psk, keys, nil, false},
+		{"MaskKeyWithoutKeyedMode", "zero-overhead", psk, nil, maskKey, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			sc := ServerConfig{
+				ProxyMode:       c.proxyMode,
+				ProxyPSK:        c.proxyPSK,
+				ProxyKeys:       c.proxyKeys,
+				ProxyKeyMaskKey: c.maskKey,
+			}
+			_, _, err := getServerPacketHandler(&sc)
+			if ok := err == nil; ok != c.ok {
+				t.Errorf("Expected ok %v, got error %v", c.ok, err)
+			}
+		})
+	}
+}
+
+func testZeroOverheadKeyedConfigs(t *testing.T, proxyPort, wgPort, wgListenPort uint16) (ServerConfig, ClientConfig) {
+	psk := generateTestPSK(t)
+	maskKey := generateTestPSK(t)
+
+	serverConfig := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: fmt.Sprintf(":%d", proxyPort),
+		ProxyMode:   proxyModeZeroOverheadKeyed,
+		ProxyKeys: []ProxyKeyConfig{
+			{ID: 1, PSK: generateTestPSK(t)},
+			{ID: 2, PSK: psk},
+		},
+		ProxyKeyMaskKey: maskKey,
+		WgEndpoint:      conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), wgPort)),
+		MTU:             1500,
+	}
+
+	// The client uses the second key, so replies must be encrypted with the key of the session.
+	clientConfig := ClientConfig{
+		Name:            "wg0",
+		WgListen:        fmt.Sprintf(":%d", wgListenPort),
+		ProxyEndpoint:   conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), proxyPort)),
+		ProxyMode:       proxyModeZeroOverheadKeyed,
+		ProxyPSK:        psk,
+		ProxyKeyID:      2,
+		ProxyKeyMaskKey: maskKey,
+		MTU:             1500,
+	}
+
+	return serverConfig, clientConfig
+}
+
+func TestClientServerHandshakeZeroOverheadKeyed(t *testing.T) {
+	serverConfig, clientConfig := testZeroOverheadKeyedConfigs(t, 20321, 20322, 20323)
+	testClientServerHandshake(t, context.Background(), serverConfig, clientConfig)
+}
+
+func TestClientServerHandshakeRequireCookieZeroOverheadKeyedNoBatch(t *testing.T) {
+	serverConfig, clientConfig := testZeroOverheadKeyedConfigs(t, 20324, 20325, 20326)
+	serverConfig.RequireCookie = true
+	serverConfig.BatchMode = "no"
+	clientConfig.BatchMode = "no"
+	testClientServerHandshake(t, context.Background(), serverConfig, clientConfig)
+}
+
+func TestClientServerDataPacketsZeroOverheadKeyed(t *testing.T) {
+	serverConfig, clientConfig := testZeroOverheadKeyedConfigs(t, 20327, 20328, 20329)
+	testClientServerDataPackets(t, context.Background(), serverConfig, clientConfig)
+}
+
+func TestServerExpiredProxyKey(t *testing.T) {
+	for _, c := range []struct {
+		name          string
+		batchMode     string
+		proxyPort     uint16
+		wgPort        uint16
+		wgListenPortA uint16
+		wgListenPortB uint16
+	}{
+		{"Default", "", 20512, 20513, 20514, 20515},
+		{"NoBatch", "no", 20516, 20517, 20518, 20519},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			pskA, pskB := generateTestPSK(t), generateTestPSK(t)
+			maskKey := generateTestPSK(t)
+			now := time.Now()
+
+			serverConfig := ServerConfig{
+				Name:        "wg0",
+				ProxyListen: fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:   proxyModeZeroOverheadKeyed,
+				ProxyKeys: []ProxyKeyConfig{
+					{ID: 1, PSK: pskA, Name: "old", NotAfter: now.Add(-time.Hour)},
+					{ID: 2, PSK: pskB, Name: "new", NotAfter: now.Add(time.Hour)},
+				},
+				ProxyKeyMaskKey: maskKey,
+				WgEndpoint:      conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPort)),
+				MTU:             1500,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+			clientConfigA := ClientConfig{
+				Name:            "old",
+				WgListen:        fmt.Sprintf(":%d", c.wgListenPortA),
+				ProxyEndpoint:   conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.proxyPort)),
+				ProxyMode:       proxyModeZeroOverheadKeyed,
+				ProxyPSK:        pskA,
+				ProxyKeyID:      1,
+				ProxyKeyMaskKey: maskKey,
+				MTU:             1500,
+			}
+			clientConfigB := clientConfigA
+			clientConfigB.Name = "new"
+			clientConfigB.WgListen = fmt.Sprintf(":%d", c.wgListenPortB)
+			clientConfigB.ProxyPSK = pskB
+			clientConfigB.ProxyKeyID = 2
+
+			sc := Config{
+				Servers: []ServerConfig{serverConfig},
+				Clients: []ClientConfig{clientConfigA, clientConfigB},
+			}
+			m, err := sc.Manager(logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = m.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			defer m.Stop()
+
+			peerA := newFakeWgPeer(t, clientConfigA.WgListen)
+			peerB := newFakeWgPeer(t, clientConfigB.WgListen)
+			endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+
+			// The expired key is no longer accepted, while the key within its window still is.
+			initiationA := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+			peerA.Send(initiationA)
+			endpoint.ExpectNone(100 * time.Millisecond)
+
+			initiationB := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+			peerB.Send(initiationB)
+			endpoint.Expect(initiationB)
+
+			for _, ss := range m.Stats() {
+				if ss.Role != "server" {
+					continue
+				}
+				if ss.ExpiredKeyPackets != 1 {
+					t.Errorf("ExpiredKeyPackets = %d, expected 1", ss.ExpiredKeyPackets)
+				}
+				if len(ss.Tenants) != 2 {
+					t.Fatalf("Expected 2 tenants, got %+v", ss.Tenants)
+				}
+				for i, expired := range []bool{true, false} {
+					ts := ss.Tenants[i]
+					if ts.Expired != expired || !ts.NotAfter.Equal(serverConfig.ProxyKeys[i].NotAfter) {
+						t.Errorf("Unexpected expiry of tenant %s: %+v", ts.Name, ts)
+					}
+				}
+				if ss.Tenants[0].Sessions != 0 || ss.Tenants[1].Sessions != 1 {
+					t.Errorf("Unexpected sessions of tenants: %+v", ss.Tenants)
+				}
+			}
+		})
+	}
+}
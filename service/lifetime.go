@@ -0,0 +1,40 @@
+package service
+
+import (
+	"net/netip"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sessionMaxExpiresAt returns when a session created at createdAt reaches the maximum session lifetime,
+// or the zero time if the lifetime is unlimited.
+func (s *server) sessionMaxExpiresAt(createdAt time.Time) time.Time {
+	if s.sessionMaxLifetime <= 0 {
+		return time.Time{}
+	}
+	return createdAt.Add(s.sessionMaxLifetime)
+}
+
+// clampSessionExpiresAt returns expiresAt, or maxExpiresAt if it is earlier and not the zero time.
+func clampSessionExpiresAt(expiresAt, maxExpiresAt time.Time) time.Time {
+	if !maxExpiresAt.IsZero() && maxExpiresAt.Before(expiresAt) {
+		return maxExpiresAt
+	}
+	return expiresAt
+}
+
+// countSessionLifetimeEviction is called when the wgConn read deadline of a session expires.
+// If the session has reached its maximum lifetime, the eviction is counted and logged.
+func (s *server) countSessionLifetimeEviction(clientAddrPort netip.AddrPort, maxExpiresAt time.Time) {
+	if maxExpiresAt.IsZero() || time.Now().Before(maxExpiresAt) {
+		return
+	}
+	s.lifetimeEvictions.Add(1)
+	s.logger.Info("Evicting session at maximum lifetime",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.Stringer("clientAddress", clientAddrPort),
+		zap.Duration("sessionMaxLifetime", s.sessionMaxLifetime),
+	)
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/jsonhelper"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestClampSessionExpiresAt(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Minute)
+	if got := clampSessionExpiresAt(later, time.Time{}); !got.Equal(later) {
+		t.Errorf("Expected unlimited lifetime to keep %v, got %v", later, got)
+	}
+	if got := clampSessionExpiresAt(later, now); !got.Equal(now) {
+		t.Errorf("Expected max lifetime to clamp to %v, got %v", now, got)
+	}
+	if got := clampSessionExpiresAt(now, later); !got.Equal(now) {
+		t.Errorf("Expected earlier expiry %v to be kept, got %v", now, got)
+	}
+}
+
+func TestServerSessionMaxLifetime(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		batchMode    string
+		proxyPort    uint16
+		wgPort       uint16
+		wgListenPort uint16
+	}{
+		{"Default", "", 20359, 20360, 20361},
+		{"NoBatch", "no", 20362, 20363, 20364},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			psk := generateTestPSK(t)
+
+			serverConfig := ServerConfig{
+				Name:               "wg0",
+				ProxyListen:        fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:          "zero-overhead",
+				ProxyPSK:           psk,
+				WgEndpoint:         conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPort)),
+				MTU:                1500,
+				SessionMaxLifetime: jsonhelper.Duration(300 * time.Millisecond),
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+
+			clientConfig := ClientConfig{
+				Name:          "wg0",
+				WgListen:      fmt.Sprintf(":%d", c.wgListenPort),
+				ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.proxyPort)),
+				ProxyMode:     "zero-overhead",
+				ProxyPSK:      psk,
+				MTU:           1500,
+			}
+
+			ctx := context.Background()
+			sc := Config{
+				Servers: []ServerConfig{serverConfig},
+				Clients: []ClientConfig{clientConfig},
+			}
+			m, err := sc.Manager(logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = m.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer m.Stop()
+
+			peer := newFakeWgPeer(t, clientConfig.WgListen)
+			endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+
+			// Keep the session busy with handshakes, which would otherwise extend it.
+			var firstFrom netip.AddrPort
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				handshakeInitiationPacket := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+				peer.Send(handshakeInitiationPacket)
+				p := endpoint.Expect(handshakeInitiationPacket)
+				if !firstFrom.IsValid() {
+					firstFrom = p.from
+				}
+				for _, ss := range m.Stats() {
+					if ss.Role == "server" && ss.LifetimeEvictions > 0 && p.from != firstFrom {
+						// The busy session was evicted, and a new one with a new upstream socket took over.
+						return
+					}
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("Timed out waiting for the session to reach its maximum lifetime")
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		})
+	}
+}
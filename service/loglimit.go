@@ -0,0 +1,130 @@
+package service
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// logLimitInterval is the window over which repeated log messages are collapsed.
+	logLimitInterval = 10 * time.Second
+
+	// logLimitBurst is the number of times a message is logged in full in each window.
+	logLimitBurst = 5
+
+	// logLimitMaxSources caps the number of distinct sources counted for a suppressed message.
+	logLimitMaxSources = 1024
+)
+
+// logLimiter collapses repeated per-packet warnings, like decrypt failures and send errors,
+// into one summary per message per window, so that a flood does not turn into a flood of log lines.
+//
+// The first logLimitBurst occurrences of a message in a window are logged in full.
+// The rest are counted, with their distinct sources, and logged as a summary at the end of the window.
+// Unlike zap sampling, nothing is silently lost: the summary says how many lines were suppressed.
+//
+// A nil logLimiter logs every message in full.
+type logLimiter struct {
+	interval time.Duration
+	burst    int
+	fields   []zap.Field
+
+	mu     sync.Mutex
+	events map[string]*limitedLog
+}
+
+// limitedLog is the state of a message in the current window.
+type limitedLog struct {
+	logger     *zap.Logger
+	logged     int
+	suppressed uint64
+	sources    map[netip.AddrPort]struct{}
+	timer      *time.Timer
+}
+
+// newLogLimiter returns a new log limiter that adds fields to its summaries.
+func newLogLimiter(fields ...zap.Field) *logLimiter {
+	return &logLimiter{
+		interval: logLimitInterval,
+		burst:    logLimitBurst,
+		fields:   fields,
+		events:   make(map[string]*limitedLog),
+	}
+}
+
+// Warn logs msg with fields at warn level to logger, unless msg has already been logged
+// logLimitBurst times in the current window, in which case it is counted for the summary.
+// source is the address the event is about, and is counted once per window.
+func (l *logLimiter) Warn(logger *zap.Logger, msg string, source netip.AddrPort, fields ...zap.Field) {
+	if l == nil {
+		logger.Warn(msg, fields...)
+		return
+	}
+
+	l.mu.Lock()
+	e := l.events[msg]
+	if e == nil {
+		e = &limitedLog{logger: logger}
+		e.timer = time.AfterFunc(l.interval, func() { l.flush(msg) })
+		l.events[msg] = e
+	}
+	if e.logged < l.burst {
+		e.logged++
+		l.mu.Unlock()
+		logger.Warn(msg, fields...)
+		return
+	}
+	e.suppressed++
+	if e.sources == nil {
+		e.sources = make(map[netip.AddrPort]struct{})
+	}
+	if len(e.sources) < logLimitMaxSources {
+		e.sources[source] = struct{}{}
+	}
+	l.mu.Unlock()
+}
+
+// flush ends the window of msg, and logs its summary if any line was suppressed.
+func (l *logLimiter) flush(msg string) {
+	l.mu.Lock()
+	e := l.events[msg]
+	delete(l.events, msg)
+	l.mu.Unlock()
+
+	if e == nil || e.suppressed == 0 {
+		return
+	}
+
+	fields := make([]zap.Field, 0, len(l.fields)+4)
+	fields = append(fields, l.fields...)
+	fields = append(fields,
+		zap.String("message", msg),
+		zap.Uint64("suppressed", e.suppressed),
+		zap.Int("sources", len(e.sources)),
+		zap.Duration("interval", l.interval),
+	)
+	e.logger.Warn("Suppressed repeated log messages", fields...)
+}
+
+// Stop ends all windows, and logs the summaries of suppressed messages.
+// It is a no-op on a nil logLimiter.
+func (l *logLimiter) Stop() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	msgs := make([]string, 0, len(l.events))
+	for msg, e := range l.events {
+		e.timer.Stop()
+		msgs = append(msgs, msg)
+	}
+	l.mu.Unlock()
+
+	for _, msg := range msgs {
+		l.flush(msg)
+	}
+}
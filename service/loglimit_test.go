@@ -0,0 +1,80 @@
+package service
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogLimiter(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	logger := zap.New(core)
+	l := newLogLimiter(zap.String("server", "wg0"))
+
+	for i := 0; i < 100; i++ {
+		source := netip.AddrPortFrom(netip.IPv6Loopback(), uint16(20000+i%10))
+		l.Warn(logger, "Failed to decrypt swgpPacket", source)
+	}
+	l.Warn(logger, "Failed to write wgPacket to wgConn", netip.AddrPort{})
+
+	if n := logs.FilterMessage("Failed to decrypt swgpPacket").Len(); n != logLimitBurst {
+		t.Errorf("Expected %d full lines, got %d", logLimitBurst, n)
+	}
+	if n := logs.FilterMessage("Failed to write wgPacket to wgConn").Len(); n != 1 {
+		t.Errorf("Expected other messages to be limited separately, got %d lines", n)
+	}
+
+	l.Stop()
+
+	summaries := logs.FilterMessage("Suppressed repeated log messages").All()
+	if len(summaries) != 1 {
+		t.Fatalf("Expected 1 summary, got %d", len(summaries))
+	}
+	for key, value := range map[string]any{
+		"server":     "wg0",
+		"message":    "Failed to decrypt swgpPacket",
+		"suppressed": uint64(100 - logLimitBurst),
+		"sources":    int64(10),
+	} {
+		if got := summaries[0].ContextMap()[key]; got != value {
+			t.Errorf("Got %s=%v, want %v", key, got, value)
+		}
+	}
+}
+
+func TestLogLimiterWindow(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	logger := zap.New(core)
+	l := newLogLimiter()
+	l.interval = 20 * time.Millisecond
+	l.burst = 1
+
+	l.Warn(logger, "Failed to decrypt swgpPacket", netip.AddrPort{})
+	l.Warn(logger, "Failed to decrypt swgpPacket", netip.AddrPort{})
+
+	// The summary is logged at the end of the window, and a new window starts with full lines.
+	time.Sleep(100 * time.Millisecond)
+	if n := logs.FilterMessage("Suppressed repeated log messages").Len(); n != 1 {
+		t.Errorf("Expected 1 summary at the end of the window, got %d", n)
+	}
+	l.Warn(logger, "Failed to decrypt swgpPacket", netip.AddrPort{})
+	if n := logs.FilterMessage("Failed to decrypt swgpPacket").Len(); n != 2 {
+		t.Errorf("Expected a full line in the new window, got %d full lines", n)
+	}
+	l.Stop()
+}
+
+func TestLogLimiterNil(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	var l *logLimiter
+	for i := 0; i < 10; i++ {
+		l.Warn(zap.New(core), "Failed to decrypt swgpPacket", netip.AddrPort{})
+	}
+	if n := logs.Len(); n != 10 {
+		t.Errorf("Expected nil limiter to log every line, got %d", n)
+	}
+	l.Stop()
+}
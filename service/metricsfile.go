@@ -0,0 +1,114 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// metricsFileWriter periodically writes service stats to a file in the Prometheus text format,
+// for nodes that cannot be scraped, and whose metrics are collected out of band.
+//
+// Each write goes to a temporary file in the same directory, which is then renamed over the metrics file,
+// so that a reader sees either the previous or the new metrics, never a partial write.
+type metricsFileWriter struct {
+	path     string
+	interval time.Duration
+	stats    func() []ServiceStats
+	logger   *zap.Logger
+	renderer prometheusRenderer
+	buf      []byte
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newMetricsFileWriter returns a new metrics file writer that writes the stats returned by stats to path every interval.
+//
+// If interval is not positive, nil is returned. Start and Stop are no-ops on a nil metrics file writer.
+func newMetricsFileWriter(path string, interval time.Duration, stats func() []ServiceStats, logger *zap.Logger) *metricsFileWriter {
+	if interval <= 0 {
+		return nil
+	}
+	return &metricsFileWriter{
+		path:     path,
+		interval: interval,
+		stats:    stats,
+		logger:   logger,
+	}
+}
+
+// Start writes initial to the metrics file, and starts rewriting it with the current stats every interval.
+// It returns an error if the first write fails, so that an unwritable path is caught on start.
+func (w *metricsFileWriter) Start(initial []ServiceStats) error {
+	if w == nil {
+		return nil
+	}
+
+	if err := w.write(initial); err != nil {
+		return err
+	}
+
+	w.done = make(chan struct{})
+
+	w.wg.Add(1)
+
+	go func() {
+		defer w.wg.Done()
+
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := w.write(w.stats()); err != nil {
+					w.logger.Warn("Failed to write metrics file",
+						zap.String("metricsFile", w.path),
+						zap.Error(err),
+					)
+				}
+			case <-w.done:
+				return
+			}
+		}
+	}()
+
+	w.logger.Info("Started metrics file writer",
+		zap.String("metricsFile", w.path),
+		zap.Duration("interval", w.interval),
+	)
+	return nil
+}
+
+// Stop writes the final metrics and stops the writer.
+// It is a no-op if the writer was not started.
+func (w *metricsFileWriter) Stop() {
+	if w == nil || w.done == nil {
+		return
+	}
+
+	close(w.done)
+	w.wg.Wait()
+
+	if err := w.write(w.stats()); err != nil {
+		w.logger.Warn("Failed to write metrics file",
+			zap.String("metricsFile", w.path),
+			zap.Error(err),
+		)
+	}
+
+	w.logger.Info("Stopped metrics file writer", zap.String("metricsFile", w.path))
+}
+
+// write renders all and atomically replaces the metrics file with them.
+//
+// The file is made world-readable, so that the collector, which may run as another user, can read it.
+func (w *metricsFileWriter) write(all []ServiceStats) error {
+	w.buf = w.renderer.appendMetrics(w.buf[:0], all)
+	if err := writeFileAtomic(w.path, w.buf, 0o644); err != nil {
+		return fmt.Errorf("failed to replace metrics file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/jsonhelper"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestManagerMetricsFile(t *testing.T) {
+	psk := generateTestPSK(t)
+	path := filepath.Join(t.TempDir(), "swgp.prom")
+
+	serverConfig := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: ":20505",
+		ProxyMode:   "paranoid",
+		ProxyPSK:    psk,
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20506)),
+		MTU:         1500,
+	}
+
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20507",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20505)),
+		ProxyMode:     "paranoid",
+		ProxyPSK:      psk,
+		MTU:           1500,
+	}
+
+	sc := Config{
+		Servers:             []ServerConfig{serverConfig},
+		Clients:             []ClientConfig{clientConfig},
+		MetricsFile:         path,
+		MetricsFileInterval: jsonhelper.Duration(time.Hour),
+		NodeID:              "vps1",
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is written on start.
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := `swgp_uplink_packets_total{role="server",name="wg0",node="vps1"} 0`; !strings.Contains(string(b), line) {
+		t.Errorf("Metrics file does not contain %q:\n%s", line, b)
+	}
+
+	peer := newFakeWgPeer(t, clientConfig.WgListen)
+	endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+	p := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+	peer.Send(p)
+	endpoint.Expect(p)
+
+	// The final stats are written on stop.
+	m.Stop()
+	b, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := `swgp_uplink_packets_total{role="server",name="wg0",node="vps1"} 1`; !strings.Contains(string(b), line) {
+		t.Errorf("Metrics file does not contain %q:\n%s", line, b)
+	}
+
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := fi.Mode().Perm(); mode != 0o644 {
+			t.Errorf("Metrics file mode = %v, expected %v", mode, os.FileMode(0o644))
+		}
+	}
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the metrics file in its directory, got %d entries", len(entries))
+	}
+}
+
+// TestManagerMetricsFileRelative checks that a bare file name is written next to itself in the working directory,
+// instead of going through a temporary file in another directory, which may be on another file system.
+func TestManagerMetricsFileRelative(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	// Make any temporary file created outside the working directory fail loudly.
+	t.Setenv("TMPDIR", filepath.Join(dir, "missing"))
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	sc := Config{
+		Servers: []ServerConfig{
+			{
+				Name:        "wg0",
+				ProxyListen: ":20605",
+				ProxyMode:   "zero-overhead",
+				ProxyPSK:    generateTestPSK(t),
+				WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20606)),
+				MTU:         1500,
+			},
+		},
+		MetricsFile:         "swgp.prom",
+		MetricsFileInterval: jsonhelper.Duration(time.Hour),
+		NodeID:              "vps1",
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	m.Stop()
+
+	b, err := os.ReadFile(filepath.Join(dir, "swgp.prom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := `swgp_uplink_packets_total{role="server",name="wg0",node="vps1"} 0`; !strings.Contains(string(b), line) {
+		t.Errorf("Metrics file does not contain %q:\n%s", line, b)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the metrics file in the working directory, got %d entries", len(entries))
+	}
+}
+
+func TestManagerMetricsFileUnwritable(t *testing.T) {
+	sc := Config{
+		Servers: []ServerConfig{
+			{
+				Name:        "wg0",
+				ProxyListen: ":20508",
+				ProxyMode:   "zero-overhead",
+				ProxyPSK:    generateTestPSK(t),
+				WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20509)),
+				MTU:         1500,
+			},
+		},
+		MetricsFile:         filepath.Join(t.TempDir(), "missing", "swgp.prom"),
+		MetricsFileInterval: jsonhelper.Duration(time.Hour),
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(context.Background()); err == nil {
+		m.Stop()
+		t.Fatal("Expected error for metrics file in a missing directory")
+	}
+}
+
+func TestConfigMetricsFileInterval(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		file     string
+		interval time.Duration
+		ok       bool
+	}{
+		{"Disabled", "", 0, true},
+		{"FileWithoutInterval", "swgp.prom", 0, false},
+		{"Enabled", "swgp.prom", time.Minute, true},
+		{"IntervalWithoutFile", "", time.Minute, false},
+		{"NegativeInterval", "swgp.prom", -time.Minute, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			sc := Config{
+				Servers: []ServerConfig{
+					{
+						Name:        "wg0",
+						ProxyListen: ":20510",
+						ProxyMode:   "zero-overhead",
+						ProxyPSK:    generateTestPSK(t),
+						WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20511)),
+						MTU:         1500,
+					},
+				},
+				MetricsFile:         c.file,
+				MetricsFileInterval: jsonhelper.Duration(c.interval),
+			}
+			_, err := sc.Manager(logger)
+			if c.ok && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if !c.ok && err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package service
+
+import (
+	"encoding/json"
+
+	"github.com/database64128/swgp-go/conn"
+	"go.uber.org/zap"
+)
+
+// serverMigrationFingerprint returns the JSON encoding of the server config without its WireGuard endpoint.
+// Two configs with the same migration fingerprint only differ in wgEndpoint, so a running server
+// can switch from one to the other without a restart.
+func serverMigrationFingerprint(serverConfig ServerConfig) (string, error) {
+	serverConfig.WgEndpoint = conn.Addr{}
+	b, err := json.Marshal(serverConfig)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// migrateWgEndpoint sends new sessions to wgAddr. Existing sessions keep relaying to the endpoint
+// they started with, until they expire or are evicted, unless the upstream switch grace is set.
+func (s *server) migrateWgEndpoint(wgAddr conn.Addr) {
+	oldWgAddr := s.wgAddr.Swap(&wgAddr)
+
+	if s.upstreamSwitchGrace > 0 {
+		s.switchSessionUpstreams(*oldWgAddr, wgAddr)
+		return
+	}
+
+	s.mu.Lock()
+	sessions := len(s.table) + len(s.tcpTable)
+	s.mu.Unlock()
+
+	s.logger.Info("Migrating new sessions to new WireGuard endpoint",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.Stringer("oldWgAddress", oldWgAddr),
+		zap.Stringer("wgAddress", &wgAddr),
+		zap.Int("drainingSessions", sessions),
+	)
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestManagerReloadMigrateWgEndpoint(t *testing.T) {
+	psk := generateTestPSK(t)
+
+	serverConfig := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: ":20373",
+		ProxyMode:   "zero-overhead",
+		ProxyPSK:    psk,
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20374)),
+		MTU:         1500,
+	}
+
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20376",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20373)),
+		ProxyMode:     "zero-overhead",
+		ProxyPSK:      psk,
+		MTU:           1500,
+	}
+
+	ctx := context.Background()
+	sc := Config{
+		Servers: []ServerConfig{serverConfig},
+		Clients: []ClientConfig{clientConfig},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	endpointA := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+	endpointB := newFakeWgEndpoint(t, "[::1]:20375")
+	oldPeer := newFakeWgPeer(t, clientConfig.WgListen)
+
+	oldPacket := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+	oldPeer.Send(oldPacket)
+	endpointA.Expect(oldPacket)
+
+	serverConfig.WgEndpoint = conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20375))
+	if err = m.Reload(ctx, Config{
+		Servers: []ServerConfig{serverConfig},
+		Clients: []ClientConfig{clientConfig},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The existing session keeps going to the old endpoint.
+	oldPacket = newTestWgPacket(t, packet.WireGuardMessageTypeData, 128)
+	oldPeer.Send(oldPacket)
+	endpointA.Expect(oldPacket)
+
+	// A new session goes to the new endpoint.
+	newPeer := newFakeWgPeer(t, clientConfig.WgListen)
+	newPacket := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+	newPeer.Send(newPacket)
+	endpointB.Expect(newPacket)
+
+	endpointA.ExpectNone(100 * time.Millisecond)
+	if received := endpointB.Received(); len(received) != 1 {
+		t.Errorf("Expected the new endpoint to receive only the new session's packet, got %d packets", len(received))
+	}
+
+	// Migrating did not restart the server.
+	for _, ss := range m.Stats() {
+		if ss.Role == "server" && ss.Sessions != 2 {
+			t.Errorf("Expected the server to have 2 sessions, got %d", ss.Sessions)
+		}
+	}
+}
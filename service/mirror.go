@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/database64128/swgp-go/conn"
+	"go.uber.org/zap"
+)
+
+// mirrorQueueLength is the number of packet copies that may wait to be sent to the mirror endpoint.
+const mirrorQueueLength = 1024
+
+// packetMirror sends a copy of each decrypted WireGuard packet the server relays to its WireGuard endpoint
+// to a mirror endpoint, so that monitoring tools can inspect the traffic without being inline.
+//
+// Mirroring is best-effort. Copies are queued without blocking, and dropped and counted when the queue
+// is full, so that a slow or unreachable mirror endpoint never holds up the relay.
+//
+// A nil packetMirror mirrors nothing.
+type packetMirror struct {
+	addrPort netip.AddrPort
+	queue    chan *[]byte
+	bufPool  sync.Pool
+	mirrored atomic.Uint64
+	dropped  atomic.Uint64
+	conn     *net.UDPConn
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newPacketMirror returns a mirror that sends copies of packets of up to bufSize bytes to addrPort,
+// or nil if addrPort is the zero value.
+func newPacketMirror(addrPort netip.AddrPort, bufSize int) *packetMirror {
+	if !addrPort.IsValid() {
+		return nil
+	}
+	m := packetMirror{
+		addrPort: addrPort,
+		queue:    make(chan *[]byte, mirrorQueueLength),
+	}
+	m.bufPool.New = func() any {
+		b := make([]byte, 0, bufSize)
+		return &b
+	}
+	return &m
+}
+
+// start starts sending queued copies with c, which is closed by Stop.
+// Failed writes are dropped, counted, and passed to onError.
+func (m *packetMirror) start(c *net.UDPConn, onError func(error)) {
+	m.conn = c
+	m.done = make(chan struct{})
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		for {
+			select {
+			case bp := <-m.queue:
+				if _, err := conn.WriteToUDPAddrPort(c, *bp, m.addrPort); err != nil {
+					m.dropped.Add(1)
+					onError(err)
+				} else {
+					m.mirrored.Add(1)
+				}
+				m.bufPool.Put(bp)
+			case <-m.done:
+				return
+			}
+		}
+	}()
+}
+
+// Mirror queues a copy of wgPacket to be sent to the mirror endpoint.
+// If the queue is full, the copy is dropped.
+func (m *packetMirror) Mirror(wgPacket []byte) {
+	if m == nil {
+		return
+	}
+	bp := m.bufPool.Get().(*[]byte)
+	*bp = append((*bp)[:0], wgPacket...)
+	select {
+	case m.queue <- bp:
+	default:
+		m.bufPool.Put(bp)
+		m.dropped.Add(1)
+	}
+}
+
+// Stop stops sending copies and closes the mirror socket. Copies still in the queue are discarded.
+func (m *packetMirror) Stop() {
+	if m == nil || m.conn == nil {
+		return
+	}
+	close(m.done)
+	m.wg.Wait()
+	m.conn.Close()
+	m.conn = nil
+}
+
+// Mirrored returns the number of copies sent to the mirror endpoint.
+func (m *packetMirror) Mirrored() uint64 {
+	if m == nil {
+		return 0
+	}
+	return m.mirrored.Load()
+}
+
+// Dropped returns the number of copies dropped because the queue was full or the write failed.
+func (m *packetMirror) Dropped() uint64 {
+	if m == nil {
+		return 0
+	}
+	return m.dropped.Load()
+}
+
+// startMirror creates the mirror socket and starts mirroring, if the server has a mirror endpoint.
+func (s *server) startMirror(ctx context.Context) error {
+	m := s.mirror
+	if m == nil {
+		return nil
+	}
+
+	c, err := s.mirrorListenConfig.ListenUDP(ctx, "udp", "")
+	if err != nil {
+		return fmt.Errorf("failed to create UDP socket for mirror endpoint %s: %w", m.addrPort, err)
+	}
+
+	m.start(c, func(err error) {
+		s.logLimiter.Warn(s.connLogger, "Failed to write mirrored packet", m.addrPort,
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("mirrorAddress", m.addrPort),
+			zap.Error(err),
+		)
+	})
+
+	s.logger.Info("Started packet mirror",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.Stringer("mirrorAddress", m.addrPort),
+	)
+	return nil
+}
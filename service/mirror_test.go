@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestServerMirrorTo(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		batchMode  string
+		proxyPort  uint16
+		wgPort     uint16
+		clientPort uint16
+		mirrorPort uint16
+	}{
+		{"Default", "", 20458, 20459, 20460, 20461},
+		{"NoBatch", "no", 20462, 20463, 20464, 20465},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			psk := generateTestPSK(t)
+			mirrorAddrPort := netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), c.mirrorPort)
+
+			serverConfig := ServerConfig{
+				Name:        "wg0",
+				ProxyListen: fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:   "paranoid",
+				ProxyPSK:    psk,
+				WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPort)),
+				MTU:         1500,
+				MirrorTo:    mirrorAddrPort,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+
+			clientConfig := ClientConfig{
+				Name:          "wg0",
+				WgListen:      fmt.Sprintf(":%d", c.clientPort),
+				ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.proxyPort)),
+				ProxyMode:     "paranoid",
+				ProxyPSK:      psk,
+				MTU:           1500,
+			}
+
+			ctx := context.Background()
+			loggers := NewLoggers(logger)
+			listenConfigCache := conn.NewListenConfigCache()
+
+			mirror := newFakeWgEndpoint(t, mirrorAddrPort.String())
+			endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+
+			s, err := serverConfig.Server(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = s.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+
+			cl, err := clientConfig.Client(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = cl.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer cl.Stop()
+
+			peer := newFakeWgPeer(t, clientConfig.WgListen)
+
+			packets := [][]byte{
+				newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation),
+				newTestWgPacket(t, packet.WireGuardMessageTypeData, 128),
+				newTestWgPacket(t, packet.WireGuardMessageTypeData, 1024),
+			}
+			for _, p := range packets {
+				peer.Send(p)
+				endpoint.Expect(p)
+				mirror.Expect(p)
+			}
+
+			// Downlink packets are not mirrored.
+			reply := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeResponse, packet.WireGuardMessageLengthHandshakeResponse)
+			endpoint.Send(reply)
+			peer.Expect(reply)
+			mirror.ExpectNone(100 * time.Millisecond)
+
+			stats := s.Stats()
+			if stats.MirroredPackets != uint64(len(packets)) {
+				t.Errorf("MirroredPackets = %d, expected %d", stats.MirroredPackets, len(packets))
+			}
+			if stats.MirrorDropped != 0 {
+				t.Errorf("MirrorDropped = %d, expected 0", stats.MirrorDropped)
+			}
+		})
+	}
+}
+
+func TestPacketMirrorQueueFull(t *testing.T) {
+	m := newPacketMirror(netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 9), 64)
+
+	// Without a running sender, the queue fills up and further copies are dropped.
+	b := make([]byte, 32)
+	for i := 0; i < mirrorQueueLength+3; i++ {
+		m.Mirror(b)
+	}
+	if dropped := m.Dropped(); dropped != 3 {
+		t.Errorf("Dropped() = %d, expected 3", dropped)
+	}
+	if mirrored := m.Mirrored(); mirrored != 0 {
+		t.Errorf("Mirrored() = %d, expected 0", mirrored)
+	}
+}
+
+func TestServerConfigMirrorToNoPort(t *testing.T) {
+	serverConfig := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: ":20466",
+		ProxyMode:   "zero-overhead",
+		ProxyPSK:    generateTestPSK(t),
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20467)),
+		MTU:         1500,
+		MirrorTo:    netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 0),
+	}
+	if _, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache()); err == nil {
+		t.Error("Expected error for mirrorTo without a port")
+	}
+}
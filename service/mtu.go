@@ -0,0 +1,142 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"go.uber.org/zap"
+)
+
+// autoMTUFallback is the default MTU used in place of MTU 0 (auto) when the network interface
+// cannot be determined, for example when listening on a wildcard address.
+const autoMTUFallback = 1500
+
+// resolveFallbackMTU returns the MTU to use when the network interface of MTU 0 (auto) cannot be determined:
+// fallbackMTU if set, or autoMTUFallback. It returns an error if fallbackMTU is set and out of the allowed range.
+func resolveFallbackMTU(fallbackMTU int) (int, error) {
+	switch {
+	case fallbackMTU == 0:
+		return autoMTUFallback, nil
+	case fallbackMTU < minimumMTU:
+		return 0, fmt.Errorf("bad fallbackMTU %d: %w", fallbackMTU, ErrMTUTooSmall)
+	case fallbackMTU > maximumMTU:
+		return 0, fmt.Errorf("bad fallbackMTU %d: %w", fallbackMTU, ErrMTUTooLarge)
+	}
+	return fallbackMTU, nil
+}
+
+// interfaceMTU returns the MTU of the network interface that has the address.
+func interfaceMTU(addr netip.Addr) (int, error) {
+	addr = addr.Unmap().WithZone("")
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, iface := range ifaces {
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			return 0, err
+		}
+
+		for _, ifaceAddr := range ifaceAddrs {
+			ipnet, ok := ifaceAddr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip, ok := netip.AddrFromSlice(ipnet.IP); ok && ip.Unmap() == addr {
+				return iface.MTU, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("no network interface has address %s", addr)
+}
+
+// listenHostAddr returns the IP address in the host part of the listen address,
+// or the zero value if the host is empty or not an IP address.
+func listenHostAddr(listenAddress string) netip.Addr {
+	host, _, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr
+}
+
+// routeLocalAddr returns the local address the system would use to send packets to addrPort.
+// No packets are sent.
+func routeLocalAddr(addrPort netip.AddrPort) (netip.Addr, error) {
+	c, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(addrPort))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).AddrPort().Addr(), nil
+}
+
+// autoMTU returns the MTU of the network interface that has localAddr, clamped to maximumMTU,
+// as some interfaces, like the Linux loopback interface, have an MTU larger than any IP packet.
+// If localAddr is invalid or a wildcard address, or no interface has it, fallbackMTU is returned.
+// The choice is logged with fields.
+func autoMTU(localAddr netip.Addr, fallbackMTU int, logger *zap.Logger, fields ...zap.Field) int {
+	if !localAddr.IsValid() || localAddr.IsUnspecified() {
+		logger.Info("Using fallback MTU for unknown network interface",
+			append(fields, zap.Int("mtu", fallbackMTU))...,
+		)
+		return fallbackMTU
+	}
+
+	mtu, err := interfaceMTU(localAddr)
+	if err != nil {
+		logger.Warn("Failed to get network interface MTU, using fallback MTU",
+			append(fields,
+				zap.Stringer("localAddress", localAddr),
+				zap.Int("mtu", fallbackMTU),
+				zap.Error(err),
+			)...,
+		)
+		return fallbackMTU
+	}
+
+	if mtu > maximumMTU {
+		logger.Info("Clamping network interface MTU to the maximum MTU",
+			append(fields,
+				zap.Stringer("localAddress", localAddr),
+				zap.Int("interfaceMTU", mtu),
+				zap.Int("mtu", maximumMTU),
+			)...,
+		)
+		return maximumMTU
+	}
+
+	logger.Info("Using network interface MTU",
+		append(fields,
+			zap.Stringer("localAddress", localAddr),
+			zap.Int("mtu", mtu),
+		)...,
+	)
+	return mtu
+}
+
+// checkMTU returns an error if the MTU is out of the allowed range,
+// and logs a warning if the MTU exceeds the largest common jumbo frame size.
+func checkMTU(mtu int, logger *zap.Logger, fields ...zap.Field) error {
+	if mtu < minimumMTU {
+		return ErrMTUTooSmall
+	}
+	if mtu > maximumMTU {
+		return ErrMTUTooLarge
+	}
+	if mtu > jumboMTUWarningThreshold {
+		logger.Warn("MTU exceeds the largest common jumbo frame size",
+			append(fields,
+				zap.Int("mtu", mtu),
+				zap.Int("jumboMTUWarningThreshold", jumboMTUWarningThreshold),
+			)...,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/database64128/swgp-go/conn"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestInterfaceMTU(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var loopback *net.Interface
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback != 0 {
+			loopback = &ifaces[i]
+			break
+		}
+	}
+	if loopback == nil {
+		t.Skip("No loopback interface")
+	}
+
+	mtu, err := interfaceMTU(netip.MustParseAddr("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtu != loopback.MTU {
+		t.Errorf("Got MTU %d, expected loopback MTU %d", mtu, loopback.MTU)
+	}
+
+	if _, err = interfaceMTU(netip.MustParseAddr("192.0.2.1")); err == nil {
+		t.Error("Expected error for address not on any interface")
+	}
+}
+
+func TestAutoMTUFallback(t *testing.T) {
+	for _, listenAddress := range []string{":20220", "[::]:20220", "0.0.0.0:20220", "localhost:20220", "[2001:db8::1]:20220"} {
+		if mtu := autoMTU(listenHostAddr(listenAddress), 1400, zap.NewNop()); mtu != 1400 {
+			t.Errorf("%s: got MTU %d, expected fallback MTU 1400", listenAddress, mtu)
+		}
+	}
+}
+
+func TestServerConfigFallbackMTU(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		mtu         int
+		fallbackMTU int
+		expectedMTU int
+		expectedErr error
+	}{
+		{"Default", 0, 0, autoMTUFallback, nil},
+		{"Configured", 0, 1400, 1400, nil},
+		{"IgnoredWithMTU", 1280, 1400, 0, nil},
+		{"TooSmall", 0, minimumMTU - 1, 0, ErrMTUTooSmall},
+		{"TooLarge", 0, maximumMTU + 1, 0, ErrMTUTooLarge},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			sc := ServerConfig{
+				Name:        "wg0",
+				ProxyListen: ":20618",
+				ProxyMode:   "zero-overhead",
+				ProxyPSK:    generateTestPSK(t),
+				WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20619)),
+				MTU:         c.mtu,
+				FallbackMTU: c.fallbackMTU,
+			}
+			core, logs := observer.New(zap.InfoLevel)
+			_, err := sc.Server(NewLoggers(zap.New(core)), conn.NewListenConfigCache())
+			if !errors.Is(err, c.expectedErr) {
+				t.Fatalf("Expected error %v, got %v", c.expectedErr, err)
+			}
+
+			// The fallback MTU in use is logged.
+			entries := logs.FilterMessage("Using fallback MTU for unknown network interface").All()
+			if c.expectedMTU == 0 {
+				if len(entries) != 0 {
+					t.Errorf("Expected no fallback MTU log, got %d", len(entries))
+				}
+				return
+			}
+			if len(entries) != 1 {
+				t.Fatalf("Expected 1 fallback MTU log, got %d", len(entries))
+			}
+			if mtu := entries[0].ContextMap()["mtu"]; mtu != int64(c.expectedMTU) {
+				t.Errorf("Logged fallback MTU %v, expected %d", mtu, c.expectedMTU)
+			}
+		})
+	}
+}
+
+func TestAutoMTULoopback(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var loopback *net.Interface
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback != 0 {
+			loopback = &ifaces[i]
+			break
+		}
+	}
+	if loopback == nil {
+		t.Skip("No loopback interface")
+	}
+
+	// The Linux loopback interface has MTU 65536, which must be clamped to maximumMTU.
+	expectedMTU := loopback.MTU
+	if expectedMTU > maximumMTU {
+		expectedMTU = maximumMTU
+	}
+
+	mtu := autoMTU(netip.MustParseAddr("127.0.0.1"), autoMTUFallback, zap.NewNop())
+	if mtu != expectedMTU {
+		t.Errorf("Got MTU %d, expected %d for loopback MTU %d", mtu, expectedMTU, loopback.MTU)
+	}
+	if err = checkMTU(mtu, zap.NewNop()); err != nil {
+		t.Errorf("Auto MTU %d is not allowed: %v", mtu, err)
+	}
+
+	sc := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: "127.0.0.1:20572",
+		ProxyMode:   "zero-overhead",
+		ProxyPSK:    generateTestPSK(t),
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20573)),
+	}
+	if _, err = sc.Server(NewLoggers(zap.NewNop()), conn.NewListenConfigCache()); err != nil {
+		t.Errorf("Failed to create server with auto MTU on loopback: %v", err)
+	}
+}
+
+func TestCheckMTU(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		mtu         int
+		expectedErr error
+		warn        bool
+	}{
+		{"TooSmall", minimumMTU - 1, ErrMTUTooSmall, false},
+		{"Minimum", minimumMTU, nil, false},
+		{"Ethernet", 1500, nil, false},
+		{"Jumbo", 9000, nil, false},
+		{"JumboThreshold", jumboMTUWarningThreshold, nil, false},
+		{"AboveJumboThreshold", jumboMTUWarningThreshold + 1, nil, true},
+		{"Maximum", maximumMTU, nil, true},
+		{"TooLarge", maximumMTU + 1, ErrMTUTooLarge, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			core, logs := observer.New(zap.WarnLevel)
+			if err := checkMTU(c.mtu, zap.New(core)); !errors.Is(err, c.expectedErr) {
+				t.Errorf("Expected error %v, got %v", c.expectedErr, err)
+			}
+			if warned := logs.Len() > 0; warned != c.warn {
+				t.Errorf("Expected warning %v, got %v", c.warn, warned)
+			}
+		})
+	}
+}
+
+func testJumboMTUConfigs(t *testing.T, proxyMode string, proxyPort, wgPort, wgListenPort uint16) (ServerConfig, ClientConfig) {
+	psk := generateTestPSK(t)
+
+	serverConfig := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: fmt.Sprintf(":%d", proxyPort),
+		ProxyMode:   proxyMode,
+		ProxyPSK:    psk,
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), wgPort)),
+		MTU:         9000,
+	}
+
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      fmt.Sprintf(":%d", wgListenPort),
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), proxyPort)),
+		ProxyMode:     proxyMode,
+		ProxyPSK:      psk,
+		MTU:           9000,
+	}
+
+	return serverConfig, clientConfig
+}
+
+// The small data packet is bigger than any packet that fits in a 1500-byte MTU,
+// and the big data packet is bigger than the 9000-byte MTU.
+const (
+	jumboSmallDataPacketLength = 8800
+	jumboBigDataPacketLength   = 16384
+)
+
+func TestClientServerDataPacketsJumboMTUZeroOverhead(t *testing.T) {
+	serverConfig, clientConfig := testJumboMTUConfigs(t, "zero-overhead", 20338, 20339, 20340)
+	testClientServerDataPacketsWithLengths(t, context.Background(), serverConfig, clientConfig, jumboSmallDataPacketLength, jumboBigDataPacketLength)
+}
+
+func TestClientServerDataPacketsJumboMTUParanoid(t *testing.T) {
+	serverConfig, clientConfig := testJumboMTUConfigs(t, "paranoid", 20341, 20342, 20343)
+	testClientServerDataPacketsWithLengths(t, context.Background(), serverConfig, clientConfig, jumboSmallDataPacketLength, jumboBigDataPacketLength)
+}
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/fastrand"
+	"github.com/database64128/swgp-go/packet"
+	"go.uber.org/zap"
+)
+
+const (
+	// mtuProbeTimeout is how long the client waits for the ack of an MTU probe.
+	mtuProbeTimeout = 200 * time.Millisecond
+
+	// mtuProbeAttempts is the number of probes sent for each MTU before giving up on it,
+	// so that a lost probe or ack does not lower the MTU.
+	mtuProbeAttempts = 2
+
+	// mtuProbeMinLength is the swgp packet length of the smallest MTU probe, sent for the minimum MTU over IPv6.
+	// The server ignores shorter probes, so that acks are always much smaller than probes.
+	mtuProbeMinLength = minimumMTU - IPv6HeaderLength - UDPHeaderLength
+
+	// mtuProbeAckPaddingRoom is the buffer space given to handlers for the overhead and padding of MTU probe acks,
+	// beyond the headroom they report. It keeps acks small, so that they get back on paths with a smaller MTU.
+	mtuProbeAckPaddingRoom = 64
+)
+
+// mtuProbeMTUs are the MTUs probed below the configured MTU, in descending order.
+var mtuProbeMTUs = [...]int{1500, 1492, 1480, 1460, 1440, 1420, 1400, 1380, 1360, 1340, 1320, 1300, minimumMTU}
+
+// newMTUProbeAck returns the ack to the MTU probe from clientAddrPort, received in a swgp packet of swgpPacketLength bytes,
+// to be sent with [server.sendProxyReply]. handler encrypts the ack. Probes shorter than mtuProbeMinLength are not acked.
+//
+// Probes are acked without creating a session or checking cookies. This does not amplify traffic to spoofed sources,
+// as the ack is much smaller than the probe.
+func (s *server) newMTUProbeAck(wgPacket []byte, swgpPacketLength int, clientAddrPort netip.AddrPort, cmsg []byte, handler packet.Handler) proxyReply {
+	if swgpPacketLength < mtuProbeMinLength {
+		return proxyReply{}
+	}
+
+	headroom := handler.Headroom()
+	packetBuf := s.getPacketBuf()
+	buf := packetBuf[:headroom.Front+packet.MTUProbeAckLength+headroom.Rear+mtuProbeAckPaddingRoom]
+
+	packet.PutMTUProbeAck(buf[headroom.Front:], packet.MTUProbeID(wgPacket), swgpPacketLength)
+
+	swgpPacketStart, ackLength, err := handler.EncryptZeroCopy(buf, headroom.Front, packet.MTUProbeAckLength)
+	if err != nil {
+		s.putPacketBuf(packetBuf)
+		s.packetLogger.Warn("Failed to encrypt MTU probe ack",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		return proxyReply{}
+	}
+
+	return proxyReply{
+		kind:             "MTU probe ack",
+		packetBuf:        packetBuf,
+		swgpPacketStart:  swgpPacketStart,
+		swgpPacketLength: ackLength,
+		clientAddrPort:   clientAddrPort,
+		cmsg:             cmsg,
+	}
+}
+
+// measureMTU measures the MTU of the path to the proxy endpoint with MTU probes, and clamps the client's MTU to it.
+// If the path MTU cannot be measured, for example because the server does not answer MTU probes,
+// the configured MTU is kept. It must be called before the client starts relaying packets.
+//
+// A probe of the minimum MTU is sent first. It fits any path, so if it is not acked, the server does not answer
+// probes, or cannot be reached, and no other probes are sent. This keeps the delay to the start of the client
+// within mtuProbeAttempts * mtuProbeTimeout when the server is too old to answer probes.
+func (c *client) measureMTU(ctx context.Context) {
+	proxyAddrPort, err := c.proxyAddr.ResolveIPPortWithResolver(ctx, c.resolver)
+	if err != nil {
+		c.logger.Warn("Failed to resolve proxy endpoint for MTU probes, keeping configured MTU",
+			zap.String("client", c.name),
+			zap.String("listenAddress", c.wgListen),
+			zap.Stringer("proxyAddress", &c.proxyAddr),
+			zap.Error(err),
+		)
+		return
+	}
+
+	// Domain endpoints have separate values for IPv6.
+	maxProxyPacketSize, wgTunnelMTU := &c.maxProxyPacketSize, &c.wgTunnelMTU
+	headerLength := IPv4HeaderLength + UDPHeaderLength
+	if addr := proxyAddrPort.Addr(); !addr.Is4() && !addr.Is4In6() {
+		headerLength = IPv6HeaderLength + UDPHeaderLength
+		if c.proxyAddr.IsDomain() {
+			maxProxyPacketSize, wgTunnelMTU = &c.maxProxyPacketSizev6, &c.wgTunnelMTUv6
+		}
+	}
+	configuredMTU := *maxProxyPacketSize + headerLength
+
+	probeConn, err := c.mtuProbeListenConfig.ListenUDP(ctx, "udp", "")
+	if err != nil {
+		c.logger.Warn("Failed to create UDP socket for MTU probes, keeping configured MTU",
+			zap.String("client", c.name),
+			zap.String("listenAddress", c.wgListen),
+			zap.Stringer("proxyAddress", proxyAddrPort),
+			zap.Error(err),
+		)
+		return
+	}
+	defer probeConn.Close()
+
+	if !c.sendMTUProbes(ctx, probeConn, proxyAddrPort, minimumMTU-headerLength) {
+		if ctx.Err() != nil {
+			return
+		}
+		c.logger.Warn("Proxy endpoint did not answer MTU probe of the minimum MTU, keeping configured MTU",
+			zap.String("client", c.name),
+			zap.String("listenAddress", c.wgListen),
+			zap.Stringer("proxyAddress", proxyAddrPort),
+			zap.Int("configuredMTU", configuredMTU),
+			zap.Int("probedMTU", minimumMTU),
+		)
+		return
+	}
+
+	// The minimum MTU is known to get through, so it is not probed again,
+	// and is used when no larger probe gets through.
+	mtus := make([]int, 0, 1+len(mtuProbeMTUs))
+	if configuredMTU > minimumMTU {
+		mtus = append(mtus, configuredMTU)
+	}
+	for _, mtu := range mtuProbeMTUs {
+		if mtu < configuredMTU && mtu > minimumMTU {
+			mtus = append(mtus, mtu)
+		}
+	}
+
+	measuredMTU := minimumMTU
+	for _, mtu := range mtus {
+		if c.sendMTUProbes(ctx, probeConn, proxyAddrPort, mtu-headerLength) {
+			measuredMTU = mtu
+			break
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+
+	if measuredMTU < configuredMTU {
+		*maxProxyPacketSize = measuredMTU - headerLength
+		*wgTunnelMTU = getWgTunnelMTUForHandler(c.handler, *maxProxyPacketSize)
+	}
+
+	c.logger.Info("Measured path MTU to proxy endpoint",
+		zap.String("client", c.name),
+		zap.String("listenAddress", c.wgListen),
+		zap.Stringer("proxyAddress", proxyAddrPort),
+		zap.Int("configuredMTU", configuredMTU),
+		zap.Int("mtu", measuredMTU),
+		zap.Int("wgTunnelMTU", *wgTunnelMTU),
+	)
+}
+
+// sendMTUProbes sends up to mtuProbeAttempts MTU probes of swgpPacketLength bytes to proxyAddrPort,
+// and returns whether one of them was acked.
+func (c *client) sendMTUProbes(ctx context.Context, probeConn *net.UDPConn, proxyAddrPort netip.AddrPort, swgpPacketLength int) bool {
+	headroom := c.handler.Headroom()
+	packetBuf := c.getPacketBuf()
+	defer c.putPacketBuf(packetBuf)
+
+	for i := 0; i < mtuProbeAttempts; i++ {
+		if ctx.Err() != nil {
+			return false
+		}
+
+		probeID := fastrand.Uint32()
+		buf := packetBuf[:swgpPacketLength]
+		packet.PutMTUProbe(buf[headroom.Front:swgpPacketLength-headroom.Rear], probeID)
+
+		swgpPacketStart, probeLength, err := c.handler.EncryptZeroCopy(buf, headroom.Front, swgpPacketLength-headroom.Front-headroom.Rear)
+		if err != nil {
+			c.packetLogger.Warn("Failed to encrypt MTU probe",
+				zap.String("client", c.name),
+				zap.String("listenAddress", c.wgListen),
+				zap.Stringer("proxyAddress", proxyAddrPort),
+				zap.Int("probeLength", swgpPacketLength),
+				zap.Error(err),
+			)
+			return false
+		}
+
+		if _, err = conn.WriteToUDPAddrPort(probeConn, buf[swgpPacketStart:swgpPacketStart+probeLength], proxyAddrPort); err != nil {
+			// Probes larger than the known path MTU fail with EMSGSIZE.
+			if ce := c.connLogger.Check(zap.DebugLevel, "Failed to write MTU probe"); ce != nil {
+				ce.Write(
+					zap.String("client", c.name),
+					zap.String("listenAddress", c.wgListen),
+					zap.Stringer("proxyAddress", proxyAddrPort),
+					zap.Int("probeLength", probeLength),
+					zap.Error(err),
+				)
+			}
+			return false
+		}
+
+		if c.waitMTUProbeAck(probeConn, packetBuf, proxyAddrPort, probeID, probeLength) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// waitMTUProbeAck reads from probeConn into packetBuf until the ack of the probe of probeID and probeLength arrives,
+// or mtuProbeTimeout passes. It returns whether the ack arrived.
+func (c *client) waitMTUProbeAck(probeConn *net.UDPConn, packetBuf []byte, proxyAddrPort netip.AddrPort, probeID uint32, probeLength int) bool {
+	if err := probeConn.SetReadDeadline(time.Now().Add(mtuProbeTimeout)); err != nil {
+		return false
+	}
+
+	for {
+		n, packetSourceAddrPort, err := probeConn.ReadFromUDPAddrPort(packetBuf)
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				c.connLogger.Warn("Failed to read MTU probe ack",
+					zap.String("client", c.name),
+					zap.String("listenAddress", c.wgListen),
+					zap.Stringer("proxyAddress", proxyAddrPort),
+					zap.Error(err),
+				)
+			}
+			return false
+		}
+		if !conn.AddrPortMappedEqual(packetSourceAddrPort, proxyAddrPort) {
+			continue
+		}
+
+		wgPacketStart, wgPacketLength, err := c.handler.DecryptZeroCopy(packetBuf, 0, n)
+		if err != nil {
+			continue
+		}
+		ack := packetBuf[wgPacketStart : wgPacketStart+wgPacketLength]
+		if packet.IsMTUProbeAck(ack) && packet.MTUProbeID(ack) == probeID && packet.MTUProbeAckProbeLength(ack) == probeLength {
+			return true
+		}
+	}
+}
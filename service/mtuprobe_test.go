@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+)
+
+func TestClientProbeMTU(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		proxyMode string
+		batchMode string
+		proxyPort uint16
+		wgPort    uint16
+	}{
+		{"ZeroOverhead", "zero-overhead", "", 20450, 20451},
+		{"Paranoid", "paranoid", "", 20452, 20453},
+		{"ParanoidNoBatch", "paranoid", "no", 20454, 20455},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			psk := generateTestPSK(t)
+
+			// The server drops probes larger than its MTU as oversized, like a path with a smaller MTU would.
+			serverConfig := ServerConfig{
+				Name:        "wg0",
+				ProxyListen: fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:   c.proxyMode,
+				ProxyPSK:    psk,
+				WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPort)),
+				MTU:         1480,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+
+			clientConfig := ClientConfig{
+				Name:          "wg0",
+				WgListen:      "127.0.0.1:0",
+				ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), c.proxyPort)),
+				ProxyMode:     c.proxyMode,
+				ProxyPSK:      psk,
+				MTU:           1500,
+				ProbeMTU:      true,
+			}
+
+			ctx := context.Background()
+			loggers := NewLoggers(logger)
+			listenConfigCache := conn.NewListenConfigCache()
+
+			s, err := serverConfig.Server(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = s.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+
+			cl, err := clientConfig.Client(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = cl.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer cl.Stop()
+
+			const expectedMaxProxyPacketSize = 1480 - IPv4HeaderLength - UDPHeaderLength
+			if cl.maxProxyPacketSize != expectedMaxProxyPacketSize {
+				t.Errorf("maxProxyPacketSize = %d, expected %d", cl.maxProxyPacketSize, expectedMaxProxyPacketSize)
+			}
+			if expected := getWgTunnelMTUForHandler(cl.handler, expectedMaxProxyPacketSize); cl.wgTunnelMTU != expected {
+				t.Errorf("wgTunnelMTU = %d, expected %d", cl.wgTunnelMTU, expected)
+			}
+		})
+	}
+}
+
+func TestClientProbeMTUNoAnswer(t *testing.T) {
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      "127.0.0.1:0",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 20456)),
+		ProxyMode:     "zero-overhead",
+		ProxyPSK:      generateTestPSK(t),
+		MTU:           1500,
+		ProbeMTU:      true,
+	}
+
+	cl, err := clientConfig.Client(NewLoggers(logger), conn.NewListenConfigCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err = cl.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Stop()
+
+	// Only the probes of the minimum MTU are sent, instead of probes of every MTU down from the configured one.
+	if elapsed, limit := time.Since(start), 2*mtuProbeAttempts*mtuProbeTimeout; elapsed > limit {
+		t.Errorf("Start took %v, expected at most %v", elapsed, limit)
+	}
+
+	const expectedMaxProxyPacketSize = 1500 - IPv4HeaderLength - UDPHeaderLength
+	if cl.maxProxyPacketSize != expectedMaxProxyPacketSize {
+		t.Errorf("maxProxyPacketSize = %d, expected %d", cl.maxProxyPacketSize, expectedMaxProxyPacketSize)
+	}
+}
+
+func TestClientProbeMTUTCP(t *testing.T) {
+	clientConfig := ClientConfig{
+		Name:           "wg0",
+		WgListen:       "127.0.0.1:0",
+		ProxyEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 20457)),
+		ProxyMode:      "zero-overhead",
+		ProxyPSK:       generateTestPSK(t),
+		MTU:            1500,
+		ProbeMTU:       true,
+		ProxyTransport: "tcp",
+	}
+
+	if _, err := clientConfig.Client(NewLoggers(logger), conn.NewListenConfigCache()); err == nil {
+		t.Error("Expected error for probeMTU with the TCP proxy transport")
+	}
+}
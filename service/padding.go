@@ -0,0 +1,48 @@
+package service
+
+import (
+	"fmt"
+)
+
+// Padding strategies of the paranoid proxy mode.
+const (
+	// paddingStrategyUniform pads each packet by a random length. This is the default.
+	paddingStrategyUniform = "uniform"
+
+	// paddingStrategySizeClass pads each packet up to the smallest of a set of sizes that fits it.
+	paddingStrategySizeClass = "size-class"
+)
+
+// checkPaddingStrategy validates the padding strategy and returns the size classes to pad packets up to,
+// or nil for the uniform strategy.
+func checkPaddingStrategy(paddingStrategy string, sizeClasses []int, proxyMode string) ([]int, error) {
+	switch paddingStrategy {
+	case "", paddingStrategyUniform:
+		if len(sizeClasses) > 0 {
+			return nil, fmt.Errorf("paddingSizeClasses requires the %s padding strategy", paddingStrategySizeClass)
+		}
+		return nil, nil
+	case paddingStrategySizeClass:
+		if proxyMode != "paranoid" {
+			return nil, fmt.Errorf("the %s padding strategy is only supported in the paranoid proxy mode", paddingStrategySizeClass)
+		}
+		if len(sizeClasses) == 0 {
+			return nil, fmt.Errorf("the %s padding strategy requires paddingSizeClasses", paddingStrategySizeClass)
+		}
+		return sizeClasses, nil
+	default:
+		return nil, fmt.Errorf("unknown padding strategy: %s", paddingStrategy)
+	}
+}
+
+// checkPaddingSizeClassesCoverage returns an error if the largest size class is smaller than maxProxyPacketSize.
+// Packets larger than the largest size class could not be padded to a size class, and their sizes would stand out.
+func checkPaddingSizeClassesCoverage(sizeClasses []int, maxProxyPacketSize int) error {
+	if len(sizeClasses) == 0 {
+		return nil
+	}
+	if largest := sizeClasses[len(sizeClasses)-1]; largest < maxProxyPacketSize {
+		return fmt.Errorf("largest padding size class %d does not cover the maximum packet size %d", largest, maxProxyPacketSize)
+	}
+	return nil
+}
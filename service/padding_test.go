@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/database64128/swgp-go/conn"
+)
+
+func TestCheckPaddingStrategy(t *testing.T) {
+	sizeClasses := []int{96, 256, 1472}
+	for _, c := range []struct {
+		name            string
+		paddingStrategy string
+		sizeClasses     []int
+		proxyMode       string
+		ok              bool
+	}{
+		{"Default", "", nil, "paranoid", true},
+		{"Uniform", "uniform", nil, "paranoid", true},
+		{"UniformWithSizeClasses", "uniform", sizeClasses, "paranoid", false},
+		{"SizeClass", "size-class", sizeClasses, "paranoid", true},
+		{"SizeClassWithoutSizeClasses", "size-class", nil, "paranoid", false},
+		{"SizeClassZeroOverhead", "size-class", sizeClasses, "zero-overhead", false},
+		{"Unknown", "gaussian", nil, "paranoid", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := checkPaddingStrategy(c.paddingStrategy, c.sizeClasses, c.proxyMode)
+			if ok := err == nil; ok != c.ok {
+				t.Errorf("Expected ok %v, got error %v", c.ok, err)
+			}
+		})
+	}
+}
+
+func TestCheckPaddingSizeClassesCoverage(t *testing.T) {
+	if err := checkPaddingSizeClassesCoverage([]int{96, 1472}, 1472); err != nil {
+		t.Errorf("Expected size classes up to 1472 to cover 1472, got %v", err)
+	}
+	if err := checkPaddingSizeClassesCoverage([]int{96, 1280}, 1472); err == nil {
+		t.Error("Expected error for size classes not covering the maximum packet size")
+	}
+	if err := checkPaddingSizeClassesCoverage(nil, 1472); err != nil {
+		t.Errorf("Expected no error without size classes, got %v", err)
+	}
+}
+
+func TestClientServerDataPacketsParanoidSizeClass(t *testing.T) {
+	psk := generateTestPSK(t)
+	sizeClasses := []int{96, 256, 1280, 1472}
+
+	serverConfig := ServerConfig{
+		Name:               "wg0",
+		ProxyListen:        ":20334",
+		ProxyMode:          "paranoid",
+		ProxyPSK:           psk,
+		PaddingStrategy:    "size-class",
+		PaddingSizeClasses: sizeClasses,
+		WgEndpoint:         conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20335)),
+		MTU:                1500,
+	}
+
+	// The client keeps the default strategy. The receiver does not depend on the sender's strategy.
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20336",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20334)),
+		ProxyMode:     "paranoid",
+		ProxyPSK:      psk,
+		MTU:           1500,
+	}
+
+	testClientServerDataPackets(t, context.Background(), serverConfig, clientConfig)
+}
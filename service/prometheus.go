@@ -0,0 +1,236 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+)
+
+// prometheusMetricPrefix is the prefix of all Prometheus metric names.
+const prometheusMetricPrefix = "swgp_"
+
+// prometheusMetric is a per-service metric in the Prometheus text format.
+type prometheusMetric struct {
+	name  string
+	typ   string
+	help  string
+	value func(*ServiceStats) (uint64, bool)
+}
+
+// prometheusCounter returns a counter metric whose value is the counter returned by value.
+func prometheusCounter(name, help string, value func(*Stats) uint64) prometheusMetric {
+	return prometheusMetric{
+		name: name + "_total",
+		typ:  "counter",
+		help: help,
+		value: func(ss *ServiceStats) (uint64, bool) {
+			return value(&ss.Stats), true
+		},
+	}
+}
+
+// prometheusServiceMetrics are the metrics reported for each service.
+// They have the same names as the statsd metrics, with counters suffixed by "_total".
+var prometheusServiceMetrics = []prometheusMetric{
+	{
+		name: "sessions",
+		typ:  "gauge",
+		help: "Number of live sessions.",
+		value: func(ss *ServiceStats) (uint64, bool) {
+			return uint64(ss.Sessions), true
+		},
+	},
+	prometheusCounter("uplink_packets", "WireGuard packets relayed from peers to endpoints.", func(s *Stats) uint64 { return s.UplinkPackets }),
+	prometheusCounter("uplink_bytes", "WireGuard bytes relayed from peers to endpoints.", func(s *Stats) uint64 { return s.UplinkBytes }),
+	prometheusCounter("downlink_packets", "WireGuard packets relayed from endpoints to peers.", func(s *Stats) uint64 { return s.DownlinkPackets }),
+	prometheusCounter("downlink_bytes", "WireGuard bytes relayed from endpoints to peers.", func(s *Stats) uint64 { return s.DownlinkBytes }),
+	prometheusCounter("oversized_packets", "Packets dropped for exceeding the maximum packet size.", func(s *Stats) uint64 { return s.OversizedPackets }),
+	prometheusCounter("malformed_packets", "Packets dropped for not being valid WireGuard packets.", func(s *Stats) uint64 { return s.MalformedPackets }),
+	prometheusCounter("ports_exhausted", "Sessions not created because the upstream port range was exhausted.", func(s *Stats) uint64 { return s.PortsExhausted }),
+	prometheusCounter("upstream_unreachable", "ICMP port unreachable errors received from the WireGuard endpoint.", func(s *Stats) uint64 { return s.UpstreamUnreachable }),
+	prometheusCounter("lifetime_evictions", "Sessions evicted for reaching the maximum session lifetime.", func(s *Stats) uint64 { return s.LifetimeEvictions }),
+	prometheusCounter("quiesced_packets", "Packets dropped while the service was quiesced.", func(s *Stats) uint64 { return s.QuiescedPackets }),
+	prometheusCounter("decrypt_failures", "Packets dropped for failing decryption.", func(s *Stats) uint64 { return s.DecryptFailures }),
+	prometheusCounter("send_errors", "Failed socket writes.", func(s *Stats) uint64 { return s.SendErrors }),
+	prometheusCounter("queue_full_packets", "Packets dropped because the session's send channel was full.", func(s *Stats) uint64 { return s.QueueFullPackets }),
+	prometheusCounter("disallowed_packets", "Packets dropped for coming from a disallowed peer.", func(s *Stats) uint64 { return s.DisallowedPackets }),
+	prometheusCounter("egress_shaper_dropped", "Packets dropped by egress shaping.", func(s *Stats) uint64 { return s.EgressShaperDropped }),
+	prometheusCounter("session_rate_dropped", "Packets dropped by per-session rate limiting.", func(s *Stats) uint64 { return s.SessionRateDropped }),
+	prometheusCounter("handshakes_limited", "Handshake initiations dropped by the handshake rate limit.", func(s *Stats) uint64 { return s.HandshakesLimited }),
+	prometheusCounter("decrypt_budget_shed", "Packets dropped before decryption for exceeding the decrypt budget.", func(s *Stats) uint64 { return s.DecryptBudgetShed }),
+	prometheusCounter("sessionless_data", "Data packets received from clients without a session.", func(s *Stats) uint64 { return s.SessionlessData }),
+	prometheusCounter("sessionless_dropped", "Data packets without a session dropped by dropSessionlessData.", func(s *Stats) uint64 { return s.SessionlessDropped }),
+	prometheusCounter("backoff_dropped", "Packets dropped while their session's WireGuard endpoint resolution was being retried.", func(s *Stats) uint64 { return s.BackoffDropped }),
+	prometheusCounter("expired_key_packets", "Packets dropped for carrying an expired proxy key.", func(s *Stats) uint64 { return s.ExpiredKeyPackets }),
+	prometheusCounter("cookie_challenges", "Cookie challenges sent.", func(s *Stats) uint64 { return s.CookieChallenges }),
+	prometheusCounter("invalid_cookies", "Cookie echoes dropped for carrying an invalid cookie.", func(s *Stats) uint64 { return s.InvalidCookies }),
+	prometheusCounter("decoy_packets", "Packets received and discarded on decoy ports.", func(s *Stats) uint64 { return s.DecoyPackets }),
+	prometheusCounter("decoy_bytes", "Bytes received and discarded on decoy ports.", func(s *Stats) uint64 { return s.DecoyBytes }),
+	prometheusCounter("mirrored_packets", "Packet copies sent to the mirror endpoint.", func(s *Stats) uint64 { return s.MirroredPackets }),
+	prometheusCounter("mirror_dropped", "Packet copies dropped instead of being sent to the mirror endpoint.", func(s *Stats) uint64 { return s.MirrorDropped }),
+	prometheusCounter("bundles_sent", "Bundles of coalesced WireGuard packets sent.", func(s *Stats) uint64 { return s.BundlesSent }),
+	prometheusCounter("bundled_packets", "WireGuard packets sent in bundles.", func(s *Stats) uint64 { return s.BundledPackets }),
+	prometheusCounter("receive_drops", "Packets the kernel dropped on the listener because its receive buffer was full.", func(s *Stats) uint64 { return s.ReceiveDrops }),
+	prometheusCounter("panics", "Panics recovered in the service's receive loops.", func(s *Stats) uint64 { return s.Panics }),
+	{
+		name: "proxy_up",
+		typ:  "gauge",
+		help: "Whether packets are coming back from the proxy endpoint. Only reported by clients.",
+		value: func(ss *ServiceStats) (uint64, bool) {
+			if ss.Role != "client" {
+				return 0, false
+			}
+			if ss.ProxyDown {
+				return 0, true
+			}
+			return 1, true
+		},
+	},
+	{
+		name: "handshake_rtt_us",
+		typ:  "gauge",
+		help: "Smoothed round-trip time of relayed WireGuard handshakes, in microseconds.",
+		value: func(ss *ServiceStats) (uint64, bool) {
+			if ss.HandshakeRTT <= 0 {
+				return 0, false
+			}
+			return uint64(ss.HandshakeRTT.Microseconds()), true
+		},
+	},
+}
+
+// prometheusTenantMetric is a per-tenant metric in the Prometheus text format.
+type prometheusTenantMetric struct {
+	name  string
+	typ   string
+	help  string
+	value func(*TenantStats) uint64
+}
+
+// prometheusTenantMetrics are the metrics reported for each proxy key of servers
+// in the "zero-overhead-keyed" proxy mode.
+var prometheusTenantMetrics = []prometheusTenantMetric{
+	{"tenant_sessions", "gauge", "Number of live sessions of the proxy key.", func(ts *TenantStats) uint64 { return uint64(ts.Sessions) }},
+	{"tenant_expired", "gauge", "Whether the proxy key is past its notAfter time.", func(ts *TenantStats) uint64 {
+		if ts.Expired {
+			return 1
+		}
+		return 0
+	}},
+	{"tenant_uplink_packets_total", "counter", "WireGuard packets relayed from peers of the proxy key.", func(ts *TenantStats) uint64 { return ts.UplinkPackets }},
+	{"tenant_uplink_bytes_total", "counter", "WireGuard bytes relayed from peers of the proxy key.", func(ts *TenantStats) uint64 { return ts.UplinkBytes }},
+	{"tenant_downlink_packets_total", "counter", "WireGuard packets relayed to peers of the proxy key.", func(ts *TenantStats) uint64 { return ts.DownlinkPackets }},
+	{"tenant_downlink_bytes_total", "counter", "WireGuard bytes relayed to peers of the proxy key.", func(ts *TenantStats) uint64 { return ts.DownlinkBytes }},
+}
+
+// prometheusRenderer renders service stats in the Prometheus text exposition format.
+type prometheusRenderer struct {
+	// nodeLabel is added to the labels of every sample. It is empty when there is no node ID.
+	nodeLabel string
+
+	// bufferPoolBytes, if not nil, returns the memory retained by the packet buffer pools.
+	bufferPoolBytes func() uint64
+}
+
+// setNodeID labels every sample with the node ID. An empty node ID is not labeled.
+func (r *prometheusRenderer) setNodeID(nodeID string) {
+	if nodeID == "" {
+		r.nodeLabel = ""
+		return
+	}
+	r.nodeLabel = `node="` + prometheusEscapeLabelValue(nodeID) + `"`
+}
+
+// appendMetrics appends the metrics of all services to b and returns the extended buffer.
+// Samples of each metric are grouped under its HELP and TYPE lines, in service order.
+func (r *prometheusRenderer) appendMetrics(b []byte, all []ServiceStats) []byte {
+	for _, m := range prometheusServiceMetrics {
+		b = appendPrometheusHeader(b, m.name, m.typ, m.help)
+		for i := range all {
+			ss := &all[i]
+			value, ok := m.value(ss)
+			if !ok {
+				continue
+			}
+			b = r.appendSample(b, m.name, value, "role", ss.Role, "name", ss.Name)
+		}
+	}
+
+	hasTenants := false
+	for i := range all {
+		if len(all[i].Tenants) > 0 {
+			hasTenants = true
+			break
+		}
+	}
+	if hasTenants {
+		for _, m := range prometheusTenantMetrics {
+			b = appendPrometheusHeader(b, m.name, m.typ, m.help)
+			for i := range all {
+				ss := &all[i]
+				for j := range ss.Tenants {
+					ts := &ss.Tenants[j]
+					b = r.appendSample(b, m.name, m.value(ts), "role", ss.Role, "name", ss.Name, "tenant", ts.Name)
+				}
+			}
+		}
+	}
+
+	if r.bufferPoolBytes != nil {
+		b = appendPrometheusHeader(b, "buffer_pool_bytes", "gauge", "Memory retained by the packet buffer pools.")
+		b = r.appendSample(b, "buffer_pool_bytes", r.bufferPoolBytes())
+	}
+
+	return b
+}
+
+// appendPrometheusHeader appends the HELP and TYPE lines of a metric.
+func appendPrometheusHeader(b []byte, name, typ, help string) []byte {
+	b = append(b, "# HELP "...)
+	b = append(b, prometheusMetricPrefix...)
+	b = append(b, name...)
+	b = append(b, ' ')
+	b = append(b, help...)
+	b = append(b, "\n# TYPE "...)
+	b = append(b, prometheusMetricPrefix...)
+	b = append(b, name...)
+	b = append(b, ' ')
+	b = append(b, typ...)
+	return append(b, '\n')
+}
+
+// appendSample appends a sample line of the metric, labeled with the label name and value pairs
+// in labels, followed by the node label.
+func (r *prometheusRenderer) appendSample(b []byte, name string, value uint64, labels ...string) []byte {
+	b = append(b, prometheusMetricPrefix...)
+	b = append(b, name...)
+	if len(labels) > 0 || r.nodeLabel != "" {
+		b = append(b, '{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = append(b, labels[i]...)
+			b = append(b, `="`...)
+			b = append(b, prometheusEscapeLabelValue(labels[i+1])...)
+			b = append(b, '"')
+		}
+		if r.nodeLabel != "" {
+			if len(labels) > 0 {
+				b = append(b, ',')
+			}
+			b = append(b, r.nodeLabel...)
+		}
+		b = append(b, '}')
+	}
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, value, 10)
+	return append(b, '\n')
+}
+
+// prometheusLabelValueReplacer escapes the characters that have special meanings in label values.
+var prometheusLabelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// prometheusEscapeLabelValue escapes backslashes, double quotes, and line feeds in a label value.
+func prometheusEscapeLabelValue(value string) string {
+	return prometheusLabelValueReplacer.Replace(value)
+}
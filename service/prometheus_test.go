@@ -0,0 +1,94 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusRendererAppendMetrics(t *testing.T) {
+	stats := []ServiceStats{
+		{
+			Role: "server",
+			Name: "wg0",
+			Stats: Stats{
+				Sessions:      2,
+				UplinkPackets: 10,
+				HandshakeRTT:  1500 * time.Microsecond,
+				Tenants: []TenantStats{
+					{KeyID: 1, Name: `a"b`, Sessions: 1, UplinkBytes: 100},
+				},
+			},
+		},
+		{
+			Role: "client",
+			Name: "wg0",
+			Stats: Stats{
+				ProxyDown: true,
+			},
+		},
+	}
+
+	var r prometheusRenderer
+	r.setNodeID("vps1")
+	r.bufferPoolBytes = func() uint64 { return 4096 }
+	out := string(r.appendMetrics(nil, stats))
+
+	for _, line := range []string{
+		"# HELP swgp_sessions Number of live sessions.\n# TYPE swgp_sessions gauge\n" +
+			`swgp_sessions{role="server",name="wg0",node="vps1"} 2` + "\n" +
+			`swgp_sessions{role="client",name="wg0",node="vps1"} 0` + "\n",
+		"# TYPE swgp_uplink_packets_total counter\n" +
+			`swgp_uplink_packets_total{role="server",name="wg0",node="vps1"} 10` + "\n",
+		"# TYPE swgp_proxy_up gauge\n" +
+			`swgp_proxy_up{role="client",name="wg0",node="vps1"} 0` + "\n",
+		"# TYPE swgp_handshake_rtt_us gauge\n" +
+			`swgp_handshake_rtt_us{role="server",name="wg0",node="vps1"} 1500` + "\n",
+		`swgp_tenant_uplink_bytes_total{role="server",name="wg0",tenant="a\"b",node="vps1"} 100` + "\n",
+		`swgp_buffer_pool_bytes{node="vps1"} 4096` + "\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("Output does not contain %q:\n%s", line, out)
+		}
+	}
+
+	// Only the server has an RTT, and only the client reports proxy_up.
+	for _, line := range []string{
+		`swgp_proxy_up{role="server"`,
+		`swgp_handshake_rtt_us{role="client"`,
+	} {
+		if strings.Contains(out, line) {
+			t.Errorf("Output unexpectedly contains %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestPrometheusRendererNoTenantsNoNode(t *testing.T) {
+	var r prometheusRenderer
+	out := string(r.appendMetrics(nil, []ServiceStats{{Role: "server", Name: "wg0"}}))
+
+	if line := `swgp_sessions{role="server",name="wg0"} 0` + "\n"; !strings.Contains(out, line) {
+		t.Errorf("Output does not contain %q:\n%s", line, out)
+	}
+	for _, s := range []string{"swgp_tenant_", "swgp_buffer_pool_bytes", "node="} {
+		if strings.Contains(out, s) {
+			t.Errorf("Output unexpectedly contains %q:\n%s", s, out)
+		}
+	}
+}
+
+func TestPrometheusEscapeLabelValue(t *testing.T) {
+	for _, c := range []struct {
+		value    string
+		expected string
+	}{
+		{"wg0", "wg0"},
+		{`a\b`, `a\\b`},
+		{`a"b`, `a\"b`},
+		{"a\nb", `a\nb`},
+	} {
+		if got := prometheusEscapeLabelValue(c.value); got != c.expected {
+			t.Errorf("prometheusEscapeLabelValue(%q) = %q, expected %q", c.value, got, c.expected)
+		}
+	}
+}
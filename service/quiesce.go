@@ -0,0 +1,57 @@
+package service
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// Quiesce stops the named server from forwarding packets to its WireGuard endpoint,
+// for example while the endpoint is down for maintenance. Sockets and sessions are kept,
+// and packets from clients are dropped and counted until [Manager.Resume] is called.
+//
+// Sessions still expire as usual. A server restarted by [Manager.Reload] is no longer quiesced.
+func (m *Manager) Quiesce(name string) error {
+	return m.setQuiesced(name, true)
+}
+
+// Resume resumes forwarding on the named server after [Manager.Quiesce].
+func (m *Manager) Resume(name string) error {
+	return m.setQuiesced(name, false)
+}
+
+func (m *Manager) setQuiesced(name string, quiesced bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.services {
+		if s.role == "server" && s.name == name {
+			s.Service.(*server).setQuiesced(quiesced)
+			return nil
+		}
+	}
+	return fmt.Errorf("no server named %s", name)
+}
+
+// setQuiesced sets whether the server drops packets instead of forwarding them to wgAddr.
+func (s *server) setQuiesced(quiesced bool) {
+	if s.quiesced.Swap(quiesced) == quiesced {
+		return
+	}
+
+	if quiesced {
+		s.logger.Info("Quiesced service",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("wgAddress", s.wgAddr.Load()),
+		)
+		return
+	}
+
+	s.logger.Info("Resumed service",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.Stringer("wgAddress", s.wgAddr.Load()),
+		zap.Uint64("quiescedPackets", s.quiescedPackets.Load()),
+	)
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestManagerQuiesceResume(t *testing.T) {
+	psk := generateTestPSK(t)
+
+	serverConfig := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: ":20305",
+		ProxyMode:   "zero-overhead",
+		ProxyPSK:    psk,
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20306)),
+		MTU:         1500,
+	}
+
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20307",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20305)),
+		ProxyMode:     "zero-overhead",
+		ProxyPSK:      psk,
+		MTU:           1500,
+	}
+
+	ctx := context.Background()
+	sc := Config{
+		Servers: []ServerConfig{serverConfig},
+		Clients: []ClientConfig{clientConfig},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	if err = m.Quiesce("wg1"); err == nil {
+		t.Error("Expected error quiescing unknown server")
+	}
+	if err = m.Quiesce("wg0"); err != nil {
+		t.Fatal(err)
+	}
+
+	handshakeInitiationPacket := make([]byte, packet.WireGuardMessageLengthHandshakeInitiation)
+	handshakeInitiationPacket[0] = packet.WireGuardMessageTypeHandshakeInitiation
+	if _, err = rand.Read(handshakeInitiationPacket[1:]); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, packet.WireGuardMessageLengthHandshakeInitiation+1)
+
+	clientConn, err := net.Dial("udp", clientConfig.WgListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	serverConn, err := conn.DefaultUDPClientListenConfig.ListenUDP(ctx, "udp", serverConfig.WgEndpoint.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	// Quiesced: the packet is dropped.
+	if _, err = clientConn.Write(handshakeInitiationPacket); err != nil {
+		t.Fatal(err)
+	}
+	if err = serverConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = serverConn.ReadFromUDPAddrPort(b); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected no packet while quiesced, got error %v", err)
+	}
+	for _, ss := range m.Stats() {
+		if ss.Role == "server" && ss.QuiescedPackets != 1 {
+			t.Errorf("Expected 1 quiesced packet, got %d", ss.QuiescedPackets)
+		}
+	}
+
+	// Resumed: the packet goes through.
+	if err = m.Resume("wg0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = clientConn.Write(handshakeInitiationPacket); err != nil {
+		t.Fatal(err)
+	}
+	if err = serverConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = serverConn.ReadFromUDPAddrPort(b); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,217 @@
+package service
+
+import (
+	"net"
+	"net/netip"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"go.uber.org/zap"
+)
+
+const (
+	// panicRestartBurst is the number of times a receive loop is restarted after panics within panicRestartWindow.
+	// The loop is stopped on the next panic in the window.
+	panicRestartBurst = 5
+
+	// panicRestartWindow is the window over which restarts are bounded by panicRestartBurst.
+	panicRestartWindow = time.Minute
+)
+
+// panicRecoverer recovers panics in the receive loops of a service, and restarts them,
+// so that a bug triggered by one peer's traffic does not take down the other services in the process.
+// Panics in the relays of a session are recovered too, and only tear down that session.
+//
+// Each panic is logged with the service name and the stack of the panicking goroutine, and counted.
+// A loop that keeps panicking is stopped after panicRestartBurst restarts within panicRestartWindow,
+// instead of being restarted in a tight loop. The other services, and the service's sessions, keep running.
+//
+// panicRecoverer is safe for concurrent use by multiple goroutines.
+type panicRecoverer struct {
+	logger *zap.Logger
+
+	// serviceField is the role and name of the service, like zap.String("server", "wg0").
+	serviceField zap.Field
+
+	mu sync.Mutex
+
+	// restarts are the times of the restarts within the last panicRestartWindow, oldest first.
+	restarts []time.Time
+
+	panics atomic.Uint64
+}
+
+// newPanicRecoverer returns a new recoverer for the receive loops and session relays of the service identified by serviceField.
+//
+// All methods are safe to call on a nil recoverer, which does not recover panics.
+func newPanicRecoverer(logger *zap.Logger, serviceField zap.Field) *panicRecoverer {
+	return &panicRecoverer{
+		logger:       logger,
+		serviceField: serviceField,
+	}
+}
+
+// run calls loop, and calls it again each time it panics, until it returns,
+// or is stopped for panicking too often. After each panic, cleanup is called on the same goroutine,
+// to release the locks the loop may have held.
+//
+// loop starts over with its own state, but state shared with other goroutines is not reset,
+// except for the locks released by cleanup.
+// A restarted receive loop reuses the same socket, so a loop that panicked while stopping
+// returns right away, as the socket's read deadline has passed.
+func (r *panicRecoverer) run(loop, cleanup func()) {
+	if r == nil {
+		loop()
+		return
+	}
+	for !r.runOnce(loop, cleanup) {
+		if !r.allowRestart(time.Now()) {
+			r.logger.Error("Stopped receive loop after too many panics",
+				r.serviceField,
+				zap.Int("restarts", panicRestartBurst),
+				zap.Duration("window", panicRestartWindow),
+			)
+			return
+		}
+		r.logger.Warn("Restarting receive loop after panic", r.serviceField)
+	}
+}
+
+// runOnce calls loop, and returns whether it returned without panicking.
+func (r *panicRecoverer) runOnce(loop, cleanup func()) (returned bool) {
+	defer func() {
+		if returned {
+			return
+		}
+		v := recover()
+		cleanup()
+		r.panics.Add(1)
+		r.logger.Error("Recovered from panic in receive loop",
+			r.serviceField,
+			zap.Any("panic", v),
+			zap.ByteString("stack", debug.Stack()),
+		)
+	}()
+	loop()
+	return true
+}
+
+// runSession calls relay, which relays one direction of the session of clientAddrPort.
+// If relay panics, the panic is logged and counted, and teardown, unless nil, is called on the same goroutine
+// to make the other direction of the session stop. The relay is not restarted, so the session ends,
+// and the peer's next packet starts a new one.
+func (r *panicRecoverer) runSession(clientAddrPort netip.AddrPort, relay, teardown func()) {
+	if r == nil {
+		relay()
+		return
+	}
+	returned := false
+	defer func() {
+		if returned {
+			return
+		}
+		v := recover()
+		r.panics.Add(1)
+		r.logger.Error("Recovered from panic in session relay",
+			r.serviceField,
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Any("panic", v),
+			zap.ByteString("stack", debug.Stack()),
+		)
+		if teardown != nil {
+			teardown()
+		}
+	}()
+	relay()
+	returned = true
+}
+
+// allowRestart reports whether a loop may be restarted at now, and records the restart if so.
+func (r *panicRecoverer) allowRestart(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cutoff := now.Add(-panicRestartWindow)
+	i := 0
+	for i < len(r.restarts) && !r.restarts[i].After(cutoff) {
+		i++
+	}
+	r.restarts = r.restarts[i:]
+
+	if len(r.restarts) >= panicRestartBurst {
+		return false
+	}
+	r.restarts = append(r.restarts, now)
+	return true
+}
+
+// lockTable locks the session table from the receive loop, and records that the loop holds it,
+// so that [server.releaseTableAfterPanic] can release it.
+func (s *server) lockTable() {
+	s.mu.Lock()
+	s.recvHoldsTable = true
+}
+
+// unlockTable unlocks the session table locked by [server.lockTable].
+func (s *server) unlockTable() {
+	s.recvHoldsTable = false
+	s.mu.Unlock()
+}
+
+// releaseTableAfterPanic unlocks the session table if the receive loop panicked while holding it.
+// It must be called on the goroutine of the receive loop.
+func (s *server) releaseTableAfterPanic() {
+	if s.recvHoldsTable {
+		s.unlockTable()
+	}
+}
+
+// lockTable locks the session table from the receive loop, and records that the loop holds it,
+// so that [client.releaseTableAfterPanic] can release it.
+func (c *client) lockTable() {
+	c.mu.Lock()
+	c.recvHoldsTable = true
+}
+
+// unlockTable unlocks the session table locked by [client.lockTable].
+func (c *client) unlockTable() {
+	c.recvHoldsTable = false
+	c.mu.Unlock()
+}
+
+// releaseTableAfterPanic unlocks the session table if the receive loop panicked while holding it.
+// It must be called on the goroutine of the receive loop.
+func (c *client) releaseTableAfterPanic() {
+	if c.recvHoldsTable {
+		c.unlockTable()
+	}
+}
+
+// stopSessionAfterUplinkPanic stops the downlink of a session whose uplink panicked, by interrupting reads on wgConn,
+// and releases the packets queued for the uplink until the session ends and closes wgConnSendCh.
+func (s *server) stopSessionAfterUplinkPanic(wgConn net.Conn, wgConnSendCh <-chan queuedPacket) {
+	wgConn.SetReadDeadline(conn.ALongTimeAgo)
+	for queuedPacket := range wgConnSendCh {
+		s.putPacketBuf(queuedPacket.buf)
+	}
+}
+
+// stopSessionAfterUplinkPanic stops the downlink of a session whose uplink panicked, by interrupting reads on proxyConn,
+// and releases the packets queued for the uplink until the session ends and closes proxyConnSendCh.
+func (c *client) stopSessionAfterUplinkPanic(proxyConn net.Conn, proxyConnSendCh <-chan queuedPacket) {
+	proxyConn.SetReadDeadline(conn.ALongTimeAgo)
+	for queuedPacket := range proxyConnSendCh {
+		c.putPacketBuf(queuedPacket.buf)
+	}
+}
+
+// Panics returns the number of panics recovered.
+func (r *panicRecoverer) Panics() uint64 {
+	if r == nil {
+		return 0
+	}
+	return r.panics.Load()
+}
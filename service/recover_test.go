@@ -0,0 +1,359 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+	"go.uber.org/zap"
+)
+
+const (
+	// testPanicPacketLength is the length of swgp packets that make the "test-panic" proxy mode panic on decryption.
+	testPanicPacketLength = 333
+
+	// testPanicEncryptPacketLength is the length of WireGuard packets that make the "test-panic" proxy mode panic on encryption.
+	testPanicEncryptPacketLength = 334
+)
+
+// panicHandler is a passthrough handler that panics on decrypting a packet of testPanicPacketLength bytes,
+// and on encrypting a packet of testPanicEncryptPacketLength bytes.
+type panicHandler struct {
+	packet.Handler
+}
+
+// EncryptZeroCopy implements the Handler EncryptZeroCopy method.
+func (h panicHandler) EncryptZeroCopy(buf []byte, wgPacketStart, wgPacketLength int) (swgpPacketStart, swgpPacketLength int, err error) {
+	if wgPacketLength == testPanicEncryptPacketLength {
+		panic("test panic")
+	}
+	return h.Handler.EncryptZeroCopy(buf, wgPacketStart, wgPacketLength)
+}
+
+// DecryptZeroCopy implements the Handler DecryptZeroCopy method.
+func (h panicHandler) DecryptZeroCopy(buf []byte, swgpPacketStart, swgpPacketLength int) (wgPacketStart, wgPacketLength int, err error) {
+	if swgpPacketLength == testPanicPacketLength {
+		panic("test panic")
+	}
+	return h.Handler.DecryptZeroCopy(buf, swgpPacketStart, swgpPacketLength)
+}
+
+func init() {
+	packet.RegisterHandler("test-panic", func(psk []byte, opts map[string]any) (packet.Handler, error) {
+		return panicHandler{packet.NewPassthroughHandler()}, nil
+	})
+}
+
+func TestPanicRecovererRestarts(t *testing.T) {
+	r := newPanicRecoverer(logger, zap.String("server", "wg0"))
+
+	var calls int
+	r.run(func() {
+		calls++
+		if calls < 3 {
+			panic(fmt.Sprintf("panic %d", calls))
+		}
+	}, func() {})
+
+	if calls != 3 {
+		t.Errorf("calls = %d, expected 3", calls)
+	}
+	if panics := r.Panics(); panics != 2 {
+		t.Errorf("Panics() = %d, expected 2", panics)
+	}
+}
+
+func TestPanicRecovererStopsAfterBurst(t *testing.T) {
+	r := newPanicRecoverer(logger, zap.String("server", "wg0"))
+
+	var calls int
+	r.run(func() {
+		calls++
+		panic("always")
+	}, func() {})
+
+	if calls != panicRestartBurst+1 {
+		t.Errorf("calls = %d, expected %d", calls, panicRestartBurst+1)
+	}
+	if panics := r.Panics(); panics != panicRestartBurst+1 {
+		t.Errorf("Panics() = %d, expected %d", panics, panicRestartBurst+1)
+	}
+}
+
+func TestPanicRecovererAllowRestart(t *testing.T) {
+	r := newPanicRecoverer(logger, zap.String("server", "wg0"))
+	now := time.Now()
+
+	for i := 0; i < panicRestartBurst; i++ {
+		if !r.allowRestart(now.Add(time.Duration(i) * time.Second)) {
+			t.Fatalf("Restart %d not allowed within the burst", i)
+		}
+	}
+	if r.allowRestart(now.Add(panicRestartBurst * time.Second)) {
+		t.Error("Expected restart beyond the burst to be denied")
+	}
+
+	// The first restart leaves the window.
+	if !r.allowRestart(now.Add(panicRestartWindow)) {
+		t.Error("Expected restart to be allowed once the oldest restart left the window")
+	}
+	if r.allowRestart(now.Add(panicRestartWindow)) {
+		t.Error("Expected restart to be denied with the window full again")
+	}
+}
+
+func TestPanicRecovererNil(t *testing.T) {
+	var r *panicRecoverer
+
+	var calls int
+	r.run(func() {
+		calls++
+	}, func() {})
+	if calls != 1 {
+		t.Errorf("calls = %d, expected 1", calls)
+	}
+	if panics := r.Panics(); panics != 0 {
+		t.Errorf("Panics() = %d, expected 0", panics)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected the panic to propagate without a recoverer")
+		}
+	}()
+	r.run(func() {
+		panic("not recovered")
+	}, func() {})
+}
+
+func TestServerRecoversPanic(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		batchMode  string
+		proxyPort  uint16
+		wgPort     uint16
+		clientPort uint16
+	}{
+		{"Default", "", 20559, 20560, 20561},
+		{"NoBatch", "no", 20562, 20563, 20564},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			serverConfig := ServerConfig{
+				Name:        "wg0",
+				ProxyListen: fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:   "test-panic",
+				WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPort)),
+				MTU:         1500,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+
+			clientConfig := ClientConfig{
+				Name:          "wg0",
+				WgListen:      fmt.Sprintf(":%d", c.clientPort),
+				ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.proxyPort)),
+				ProxyMode:     "test-panic",
+				MTU:           1500,
+			}
+
+			ctx := context.Background()
+			loggers := NewLoggers(logger)
+			listenConfigCache := conn.NewListenConfigCache()
+
+			endpoint := newFakeWgEndpoint(t, fmt.Sprintf("[::1]:%d", c.wgPort))
+
+			s, err := serverConfig.Server(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = s.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+
+			cl, err := clientConfig.Client(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = cl.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer cl.Stop()
+
+			peer := newFakeWgPeer(t, clientConfig.WgListen)
+
+			handshake := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+			peer.Send(handshake)
+			endpoint.Expect(handshake)
+
+			// The server's receive loop panics on this packet, and is restarted.
+			peer.Send(newTestWgPacket(t, packet.WireGuardMessageTypeData, testPanicPacketLength))
+			waitFor(t, "panic to be recovered", func() bool {
+				return s.Stats().Panics == 1
+			})
+
+			p := newTestWgPacket(t, packet.WireGuardMessageTypeData, 256)
+			peer.Send(p)
+			endpoint.Expect(p)
+		})
+	}
+}
+
+func TestSessionRelayRecoversPanic(t *testing.T) {
+	for _, c := range []struct {
+		name           string
+		batchMode      string
+		proxyTransport string
+		proxyPort      uint16
+		wgPort         uint16
+		clientPort     uint16
+	}{
+		{"Default", "", "", 20584, 20585, 20586},
+		{"NoBatch", "no", "", 20587, 20588, 20589},
+		{"TCP", "", proxyTransportTCP, 20590, 20591, 20592},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			serverConfig := ServerConfig{
+				Name:           "wg0",
+				ProxyListen:    fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:      "test-panic",
+				ProxyTransport: c.proxyTransport,
+				WgEndpoint:     conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPort)),
+				MTU:            1500,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+
+			clientConfig := ClientConfig{
+				Name:           "wg0",
+				WgListen:       fmt.Sprintf(":%d", c.clientPort),
+				ProxyEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.proxyPort)),
+				ProxyMode:      "test-panic",
+				ProxyTransport: c.proxyTransport,
+				MTU:            1500,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+
+			ctx := context.Background()
+			loggers := NewLoggers(logger)
+			listenConfigCache := conn.NewListenConfigCache()
+
+			endpoint := newFakeWgEndpoint(t, fmt.Sprintf("[::1]:%d", c.wgPort))
+
+			s, err := serverConfig.Server(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = s.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+
+			cl, err := clientConfig.Client(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = cl.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer cl.Stop()
+
+			// Two peers, each with its own session on the client and on the server.
+			peer1 := newFakeWgPeer(t, clientConfig.WgListen)
+			peer2 := newFakeWgPeer(t, clientConfig.WgListen)
+
+			handshake := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+			peer1.Send(handshake)
+			session1 := endpoint.Expect(handshake)
+			peer2.Send(handshake)
+			session2 := endpoint.Expect(handshake)
+
+			sendToSession := func(session fakeWgPacket, b []byte) {
+				t.Helper()
+				if _, err := endpoint.conn.WriteToUDPAddrPort(b, session.from); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// expectSession2 checks that the session of peer2 still relays in both directions.
+			expectSession2 := func() {
+				t.Helper()
+				p := newTestWgPacket(t, packet.WireGuardMessageTypeData, 256)
+				peer2.Send(p)
+				endpoint.Expect(p)
+				sendToSession(session2, p)
+				peer2.Expect(p)
+			}
+
+			panicPacket := newTestWgPacket(t, packet.WireGuardMessageTypeData, testPanicEncryptPacketLength)
+
+			// The server's downlink of session 1 panics, and only that session is torn down.
+			sendToSession(session1, panicPacket)
+			waitFor(t, "server session relay panic to be recovered", func() bool {
+				ss := s.Stats()
+				return ss.Panics == 1 && ss.Sessions == 1
+			})
+			expectSession2()
+
+			// peer1 gets a new server session.
+			peer1.Send(handshake)
+			endpoint.Expect(handshake)
+
+			// The client's uplink of session 1 panics, and only that session is torn down.
+			peer1.Send(panicPacket)
+			waitFor(t, "client session relay panic to be recovered", func() bool {
+				cs := cl.Stats()
+				return cs.Panics == 1 && cs.Sessions == 1
+			})
+			expectSession2()
+
+			// peer1 gets a new client session.
+			peer1.Send(handshake)
+			endpoint.Expect(handshake)
+
+			if panics := s.Stats().Panics; panics != 1 {
+				t.Errorf("Server panics = %d, expected 1", panics)
+			}
+		})
+	}
+}
+
+func TestConfigDisablePanicRecovery(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		sc := Config{
+			Servers: []ServerConfig{{
+				Name:        "wg0",
+				ProxyListen: ":20565",
+				ProxyMode:   "test-panic",
+				WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20566)),
+				MTU:         1500,
+			}},
+			Clients: []ClientConfig{{
+				Name:          "wg0",
+				WgListen:      ":20567",
+				ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20565)),
+				ProxyMode:     "test-panic",
+				MTU:           1500,
+			}},
+			DisablePanicRecovery: disabled,
+		}
+		m, err := sc.Manager(logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if recovers := m.services[0].Service.(*server).panicRecoverer != nil; recovers == disabled {
+			t.Errorf("DisablePanicRecovery %v: server recovers panics: %v", disabled, recovers)
+		}
+		if recovers := m.services[1].Service.(*client).panicRecoverer != nil; recovers == disabled {
+			t.Errorf("DisablePanicRecovery %v: client recovers panics: %v", disabled, recovers)
+		}
+	}
+}
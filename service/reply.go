@@ -0,0 +1,63 @@
+package service
+
+import (
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/database64128/swgp-go/conn"
+	"go.uber.org/zap"
+)
+
+// proxyReply is an encrypted packet the server answers a client with on its own, like a cookie challenge or an MTU probe ack.
+//
+// Replies are built in the receive loop, and sent with [server.sendProxyReply] after the loop unlocks
+// the session table, so that writing them does not hold up the sessions of other clients.
+type proxyReply struct {
+	// kind names the reply in logs, like "cookie challenge".
+	kind string
+
+	packetBuf        []byte
+	swgpPacketStart  int
+	swgpPacketLength int
+	clientAddrPort   netip.AddrPort
+	cmsg             []byte
+
+	// sent is incremented when the reply is sent, if not nil.
+	sent *atomic.Uint64
+}
+
+// sendProxyReply sends the reply, and returns its buffer to the pool.
+// A zero reply is ignored.
+func (s *server) sendProxyReply(r *proxyReply) {
+	if r.packetBuf == nil {
+		return
+	}
+	defer s.putPacketBuf(r.packetBuf)
+
+	if _, _, err := conn.WriteMsgUDPAddrPort(s.proxyConn, r.packetBuf[r.swgpPacketStart:r.swgpPacketStart+r.swgpPacketLength], r.cmsg, r.clientAddrPort); err != nil {
+		s.sendErrors.Add(1)
+		s.publishEvent(EventSendError, r.clientAddrPort, err)
+		s.logLimiter.Warn(s.connLogger, "Failed to write reply to proxyConn", r.clientAddrPort,
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", r.clientAddrPort),
+			zap.String("reply", r.kind),
+			zap.Error(err),
+		)
+		return
+	}
+
+	if r.sent != nil {
+		r.sent.Add(1)
+	}
+
+	if ce := s.logger.Check(zap.DebugLevel, "Sent reply"); ce != nil {
+		ce.Write(
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", r.clientAddrPort),
+			zap.String("reply", r.kind),
+			zap.Int("replyLength", r.swgpPacketLength),
+		)
+	}
+}
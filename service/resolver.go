@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// defaultResolverPort is the port of a resolver address without a port.
+const defaultResolverPort = 53
+
+// parseResolverAddr parses a DNS server address, either an IP address or an IP address and port.
+// An address without a port uses port 53.
+func parseResolverAddr(s string) (netip.AddrPort, error) {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("bad resolver address %q: must be an IP address, optionally with a port", s)
+	}
+	return netip.AddrPortFrom(addr, defaultResolverPort), nil
+}
+
+// newResolver returns a resolver that sends all queries to the DNS server at addr,
+// or nil for the system resolver if addr is empty.
+func newResolver(addr string) (*net.Resolver, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	addrPort, err := parseResolverAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	server := addrPort.String()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}, nil
+}
+
+// setResolver sets the resolver of the server's WireGuard endpoint and SRV lookups.
+// A nil resolver is the system resolver.
+func (s *server) setResolver(resolver *net.Resolver) {
+	s.resolver = resolver
+	if resolver != nil && s.srvEndpoint != nil {
+		s.srvEndpoint.lookupSRV = resolver.LookupSRV
+	}
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+)
+
+func TestParseResolverAddr(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		addr string
+		want netip.AddrPort
+		ok   bool
+	}{
+		{"IPv4", "10.0.0.53", netip.MustParseAddrPort("10.0.0.53:53"), true},
+		{"IPv4Port", "10.0.0.53:5353", netip.MustParseAddrPort("10.0.0.53:5353"), true},
+		{"IPv6", "fd00::53", netip.MustParseAddrPort("[fd00::53]:53"), true},
+		{"IPv6Port", "[fd00::53]:5353", netip.MustParseAddrPort("[fd00::53]:5353"), true},
+		{"Hostname", "dns.example.com", netip.AddrPort{}, false},
+		{"BadPort", "10.0.0.53:dns", netip.AddrPort{}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parseResolverAddr(c.addr)
+			if ok := err == nil; ok != c.ok {
+				t.Fatalf("Expected ok %v, got error %v", c.ok, err)
+			}
+			if got != c.want {
+				t.Errorf("Got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+// newFakeDNSServer starts a DNS server that answers A queries for any name with ip,
+// and every other query with no records. It returns the server address.
+func newFakeDNSServer(t *testing.T, ip netip.Addr) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			// Find the end of the question, skipping the name, type, and class.
+			i := 12
+			for i < n && b[i] != 0 {
+				i += int(b[i]) + 1
+			}
+			i += 5
+			if i > n {
+				continue
+			}
+			qtype := binary.BigEndian.Uint16(b[i-4:])
+
+			resp := append([]byte(nil), b[:i]...)
+			binary.BigEndian.PutUint16(resp[2:], 0x8180) // response, recursion desired and available
+			binary.BigEndian.PutUint16(resp[6:], 0)      // answer count
+			binary.BigEndian.PutUint16(resp[8:], 0)      // authority count
+			binary.BigEndian.PutUint16(resp[10:], 0)     // additional count
+			if qtype == 1 {
+				binary.BigEndian.PutUint16(resp[6:], 1)
+				ip4 := ip.As4()
+				resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+				resp = append(resp, ip4[:]...)
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+
+	return pc.LocalAddr().String()
+}
+
+func TestResolver(t *testing.T) {
+	ip := netip.MustParseAddr("192.0.2.1")
+	resolver, err := newResolver(newFakeDNSServer(t, ip))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := conn.AddrFromHostPort("wg.swgp-go.internal.", 20220)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	addrPort, err := addr.ResolveIPPortNetworkWithResolver(ctx, resolver, "udp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.AddrPortFrom(ip, 20220); addrPort != want {
+		t.Errorf("Got %s, want %s", addrPort, want)
+	}
+
+	if resolver, err = newResolver(""); err != nil || resolver != nil {
+		t.Errorf("Expected nil resolver for empty address, got %v, %v", resolver, err)
+	}
+}
+
+func TestConfigResolver(t *testing.T) {
+	psk := generateTestPSK(t)
+
+	sc := Config{
+		Servers:  []ServerConfig{testReloadServerConfig("wg0", ":20421", psk)},
+		Resolver: "dns.example.com",
+	}
+	if _, err := sc.Manager(logger); err == nil {
+		t.Error("Expected error for resolver address that is not an IP address.")
+	}
+
+	sc.Resolver = "127.0.0.1:5353"
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.services[0].Service.(*server).resolver == nil {
+		t.Error("Expected server to use the configured resolver.")
+	}
+}
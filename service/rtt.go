@@ -0,0 +1,78 @@
+package service
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/database64128/swgp-go/packet"
+)
+
+// rttEstimator maintains a smoothed round-trip time using an exponentially weighted moving average
+// with a gain of 1/8, the same as TCP's SRTT.
+//
+// rttEstimator is safe for concurrent use by multiple goroutines.
+type rttEstimator struct {
+	// srtt is the smoothed RTT in nanoseconds. 0 means no samples yet.
+	srtt atomic.Int64
+}
+
+// Update adds an RTT sample.
+func (e *rttEstimator) Update(sample time.Duration) {
+	if sample <= 0 {
+		sample = 1
+	}
+	for {
+		srtt := e.srtt.Load()
+		next := int64(sample)
+		if srtt != 0 {
+			next = srtt + (int64(sample)-srtt)/8
+		}
+		if e.srtt.CompareAndSwap(srtt, next) {
+			return
+		}
+	}
+}
+
+// Load returns the smoothed RTT, or 0 if there are no samples.
+func (e *rttEstimator) Load() time.Duration {
+	return time.Duration(e.srtt.Load())
+}
+
+// handshakeTimer measures the round-trip time of WireGuard handshakes in a session:
+// the time between relaying a handshake initiation and relaying the matching response.
+//
+// For servers, this is the RTT to the WireGuard endpoint. For clients, it is the RTT
+// through the proxy to the server's WireGuard endpoint.
+type handshakeTimer struct {
+	// sentAt is the Unix time in nanoseconds when the last pending initiation was relayed.
+	sentAt atomic.Int64
+
+	rtt rttEstimator
+}
+
+// Sent starts the timer if wgPacket is a handshake initiation.
+func (t *handshakeTimer) Sent(wgPacket []byte) {
+	if len(wgPacket) > 0 && wgPacket[0] == packet.WireGuardMessageTypeHandshakeInitiation {
+		t.sentAt.Store(time.Now().UnixNano())
+	}
+}
+
+// Received stops the timer if wgPacket is a handshake response to a pending initiation.
+// It returns the RTT sample and true if the timer was stopped.
+func (t *handshakeTimer) Received(wgPacket []byte) (time.Duration, bool) {
+	if len(wgPacket) == 0 || wgPacket[0] != packet.WireGuardMessageTypeHandshakeResponse {
+		return 0, false
+	}
+	sentAt := t.sentAt.Swap(0)
+	if sentAt == 0 {
+		return 0, false
+	}
+	sample := time.Duration(time.Now().UnixNano() - sentAt)
+	t.rtt.Update(sample)
+	return sample, true
+}
+
+// RTT returns the smoothed handshake RTT of the session, or 0 if there are no samples.
+func (t *handshakeTimer) RTT() time.Duration {
+	return t.rtt.Load()
+}
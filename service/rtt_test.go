@@ -0,0 +1,62 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestRTTEstimator(t *testing.T) {
+	var e rttEstimator
+	if rtt := e.Load(); rtt != 0 {
+		t.Errorf("Expected 0 before any samples, got %v", rtt)
+	}
+
+	e.Update(80 * time.Millisecond)
+	if rtt := e.Load(); rtt != 80*time.Millisecond {
+		t.Errorf("Expected first sample to be taken as is, got %v", rtt)
+	}
+
+	e.Update(160 * time.Millisecond)
+	if rtt := e.Load(); rtt != 90*time.Millisecond {
+		t.Errorf("Expected 90ms after second sample, got %v", rtt)
+	}
+}
+
+func TestHandshakeTimer(t *testing.T) {
+	initiation := []byte{packet.WireGuardMessageTypeHandshakeInitiation, 0, 0, 0}
+	response := []byte{packet.WireGuardMessageTypeHandshakeResponse, 0, 0, 0}
+	data := []byte{packet.WireGuardMessageTypeData, 0, 0, 0}
+
+	var ht handshakeTimer
+
+	if _, ok := ht.Received(response); ok {
+		t.Error("Expected no sample for response without pending initiation")
+	}
+
+	ht.Sent(data)
+	if _, ok := ht.Received(response); ok {
+		t.Error("Expected data packet not to start the timer")
+	}
+
+	ht.Sent(initiation)
+	time.Sleep(time.Millisecond)
+	if _, ok := ht.Received(data); ok {
+		t.Error("Expected data packet not to stop the timer")
+	}
+	sample, ok := ht.Received(response)
+	if !ok {
+		t.Fatal("Expected sample for response to pending initiation")
+	}
+	if sample < time.Millisecond {
+		t.Errorf("Expected sample of at least 1ms, got %v", sample)
+	}
+	if rtt := ht.RTT(); rtt != sample {
+		t.Errorf("Expected session RTT %v, got %v", sample, rtt)
+	}
+
+	if _, ok := ht.Received(response); ok {
+		t.Error("Expected duplicate response not to produce a sample")
+	}
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"math"
+	"runtime/metrics"
+	"time"
+)
+
+// statsdRuntimeMetricPrefix is the prefix of Go runtime metric names.
+const statsdRuntimeMetricPrefix = statsdMetricPrefix + "runtime."
+
+const (
+	runtimeMetricGoroutines = "/sched/goroutines:goroutines"
+	runtimeMetricHeapBytes  = "/memory/classes/heap/objects:bytes"
+	runtimeMetricTotalBytes = "/memory/classes/total:bytes"
+	runtimeMetricGCCycles   = "/gc/cycles/total:gc-cycles"
+	runtimeMetricGCPauses   = "/gc/pauses:seconds"
+)
+
+// runtimeStats reads Go runtime metrics for the statsd exporter, so that forwarding hiccups
+// can be correlated with GC activity.
+//
+// The metrics are read with [metrics.Read], which does not stop the world.
+type runtimeStats struct {
+	samples []metrics.Sample
+
+	// prevGCCycles is the GC cycle count of the previous push.
+	prevGCCycles uint64
+
+	// prevGCPauseCounts are the GC pause histogram counts of the previous push.
+	prevGCPauseCounts []uint64
+}
+
+func newRuntimeStats() *runtimeStats {
+	return &runtimeStats{
+		samples: []metrics.Sample{
+			{Name: runtimeMetricGoroutines},
+			{Name: runtimeMetricHeapBytes},
+			{Name: runtimeMetricTotalBytes},
+			{Name: runtimeMetricGCCycles},
+			{Name: runtimeMetricGCPauses},
+		},
+	}
+}
+
+// appendMetrics reads the runtime metrics and appends them to the exporter's send buffer.
+// Metrics not supported by the Go runtime are skipped.
+func (r *runtimeStats) appendMetrics(e *statsdExporter) {
+	metrics.Read(r.samples)
+
+	for i := range r.samples {
+		s := &r.samples[i]
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			v := s.Value.Uint64()
+			switch s.Name {
+			case runtimeMetricGoroutines:
+				e.appendMetric(statsdRuntimeMetricPrefix, "goroutines", v, "|g")
+			case runtimeMetricHeapBytes:
+				e.appendMetric(statsdRuntimeMetricPrefix, "heap_bytes", v, "|g")
+			case runtimeMetricTotalBytes:
+				e.appendMetric(statsdRuntimeMetricPrefix, "total_bytes", v, "|g")
+			case runtimeMetricGCCycles:
+				e.appendCounter(statsdRuntimeMetricPrefix, "gc_cycles", v, r.prevGCCycles)
+				r.prevGCCycles = v
+			}
+		case metrics.KindFloat64Histogram:
+			if s.Name == runtimeMetricGCPauses {
+				r.appendGCPauses(e, s.Value.Float64Histogram())
+			}
+		}
+	}
+}
+
+// appendGCPauses appends the number of GC pauses since the previous push, and the longest of them.
+// The longest pause is the upper bound of the highest histogram bucket that gained pauses.
+func (r *runtimeStats) appendGCPauses(e *statsdExporter, h *metrics.Float64Histogram) {
+	if len(r.prevGCPauseCounts) != len(h.Counts) {
+		r.prevGCPauseCounts = make([]uint64, len(h.Counts))
+	}
+
+	var (
+		pauses   uint64
+		maxPause float64
+	)
+
+	for i, count := range h.Counts {
+		prev := r.prevGCPauseCounts[i]
+		r.prevGCPauseCounts[i] = count
+		if count <= prev {
+			continue
+		}
+		pauses += count - prev
+		upper := h.Buckets[i+1]
+		if math.IsInf(upper, 1) {
+			upper = h.Buckets[i]
+		}
+		maxPause = upper
+	}
+
+	if pauses == 0 {
+		return
+	}
+	e.appendMetric(statsdRuntimeMetricPrefix, "gc_pauses", pauses, "|c")
+	e.appendMetric(statsdRuntimeMetricPrefix, "gc_pause_max_us", uint64(maxPause*float64(time.Second/time.Microsecond)), "|g")
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"sync/atomic"
+
+	"github.com/database64128/swgp-go/conn"
+	"go.uber.org/zap"
+)
+
+// receiveDropCounter tracks the number of packets the kernel dropped on a listener
+// because its receive buffer was full, as reported by SO_RXQ_OVFL control messages.
+//
+// The count is only updated by the listener's receive goroutine, and may be read concurrently.
+type receiveDropCounter struct {
+	count atomic.Uint32
+
+	// warned is whether the first drops have been logged. It is only accessed by the receive goroutine.
+	warned bool
+}
+
+// strip removes the drop counter control message from cmsg, records the count,
+// and returns the remaining control messages and the number of new drops.
+func (c *receiveDropCounter) strip(cmsg []byte) ([]byte, uint32) {
+	cmsg, count, ok := conn.StripDropCounterCmsg(cmsg)
+	if !ok {
+		return cmsg, 0
+	}
+	// The counter is cumulative, so a packet received out of order may report an older count.
+	// Unsigned subtraction handles the counter wrapping around.
+	if delta := count - c.count.Load(); delta > 0 && delta < 1<<31 {
+		c.count.Store(count)
+		return cmsg, delta
+	}
+	return cmsg, 0
+}
+
+// Load returns the number of packets dropped so far.
+func (c *receiveDropCounter) Load() uint64 {
+	return uint64(c.count.Load())
+}
+
+// logReceiveDrops logs newly reported receive buffer drops on the listener.
+// The first drops are logged as a warning, and later ones at debug level.
+func logReceiveDrops(logger *zap.Logger, c *receiveDropCounter, newDrops uint32, fields ...zap.Field) {
+	level := zap.DebugLevel
+	if !c.warned {
+		c.warned = true
+		level = zap.WarnLevel
+	}
+	if ce := logger.Check(level, "Kernel dropped packets due to full receive buffer"); ce != nil {
+		ce.Write(append(fields,
+			zap.Uint32("newDrops", newDrops),
+			zap.Uint64("receiveDrops", c.Load()),
+		)...)
+	}
+}
+
+// stripReceiveDrops removes the drop counter control message from cmsg received on proxyConn,
+// records and logs the drops, and returns the remaining control messages.
+func (s *server) stripReceiveDrops(cmsg []byte) []byte {
+	cmsg, newDrops := s.receiveDrops.strip(cmsg)
+	if newDrops > 0 {
+		logReceiveDrops(s.connLogger, &s.receiveDrops, newDrops,
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+		)
+	}
+	return cmsg
+}
+
+// stripReceiveDrops removes the drop counter control message from cmsg received on wgConn,
+// records and logs the drops, and returns the remaining control messages.
+func (c *client) stripReceiveDrops(cmsg []byte) []byte {
+	cmsg, newDrops := c.receiveDrops.strip(cmsg)
+	if newDrops > 0 {
+		logReceiveDrops(c.connLogger, &c.receiveDrops, newDrops,
+			zap.String("client", c.name),
+			zap.String("listenAddress", c.wgListen),
+		)
+	}
+	return cmsg
+}
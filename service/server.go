@@ -4,19 +4,27 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"net/netip"
 	"os"
+	"runtime"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
 
 	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/jsonhelper"
 	"github.com/database64128/swgp-go/packet"
 	"go.uber.org/zap"
 )
 
+// maxSessionTableInitialCapacity caps SessionTableInitialCapacity at about 100 MiB of preallocated table.
+// Tests lower it to check the bound without preallocating that much.
+var maxSessionTableInitialCapacity = 1 << 20
+
 // ServerConfig stores configurations for a swgp server service.
 // It may be marshaled as or unmarshaled from JSON.
 type ServerConfig struct {
@@ -30,6 +38,272 @@ type ServerConfig struct {
 	WgFwmark          int       `json:"wgFwmark"`
 	WgTrafficClass    int       `json:"wgTrafficClass"`
 	MTU               int       `json:"mtu"`
+
+	// FallbackMTU is the MTU used in place of MTU 0 (auto) when the network interface cannot be determined,
+	// for example when listening on a wildcard address. It is ignored unless MTU is 0.
+	//
+	// The default value 0 uses 1500.
+	FallbackMTU int `json:"fallbackMTU"`
+
+	// Disabled keeps the server from being started. Its config is still validated.
+	// Set it to turn the server off without removing its config, then reload.
+	Disabled bool `json:"disabled,omitempty"`
+
+	// LogPSKFingerprint logs a fingerprint of each configured PSK when the server starts.
+	// The fingerprint is the first 8 bytes of the key's SHA-256 hash. Compare it with the client's
+	// to check that both use the same key, without logging the key itself.
+	// With directional PSKs, the inbound fingerprint matches the client's outbound fingerprint.
+	LogPSKFingerprint bool `json:"logPSKFingerprint,omitempty"`
+
+	// ProxyPSKInbound and ProxyPSKOutbound replace ProxyPSK with a separate key for each direction.
+	// Received packets are decrypted with ProxyPSKInbound, and sent packets are encrypted with ProxyPSKOutbound.
+	// The server's inbound key is the client's outbound key, and vice versa.
+	ProxyPSKInbound  []byte `json:"proxyPSKInbound"`
+	ProxyPSKOutbound []byte `json:"proxyPSKOutbound"`
+
+	// ProxyModeInbound and ProxyModeOutbound replace ProxyMode with a separate proxy mode for each direction,
+	// to save CPU on a direction that crosses a trusted network. Received packets are decrypted in ProxyModeInbound,
+	// and sent packets are encrypted in ProxyModeOutbound. The server's inbound mode is the client's outbound mode,
+	// and vice versa. PaddingStrategy applies to the outbound mode.
+	ProxyModeInbound  string `json:"proxyModeInbound"`
+	ProxyModeOutbound string `json:"proxyModeOutbound"`
+
+	// PaddingStrategy selects how packets sent by the server are padded in the paranoid proxy mode.
+	// "uniform" (default) pads each packet by a random length. "size-class" pads each packet up to
+	// the smallest of PaddingSizeClasses that fits it, to mimic the packet sizes of another protocol.
+	// The receiver reads the true length from the packet, so the client may use a different strategy.
+	PaddingStrategy string `json:"paddingStrategy"`
+
+	// PaddingSizeClasses are the swgp packet lengths, in ascending order, of the "size-class" padding strategy.
+	// The largest must be at least the maximum packet size, which is MTU minus 28, so that every packet fits a class.
+	PaddingSizeClasses []int `json:"paddingSizeClasses"`
+
+	// SessionSubkeys encrypts the packets of each session under its own subkey in the paranoid proxy mode,
+	// instead of under the PSK itself, to limit the data encrypted under any single key.
+	// Each subkey is derived from the PSK and a random session salt carried in every packet.
+	// It changes the packet format, so the client must enable it too.
+	SessionSubkeys bool `json:"sessionSubkeys"`
+
+	// ProxyModeOptions are passed as is to the handler registered for ProxyMode with [packet.RegisterHandler].
+	// The built-in proxy modes take their options from dedicated fields instead.
+	ProxyModeOptions map[string]any `json:"proxyModeOptions,omitempty"`
+
+	// ProxyKeys are the keys of the "zero-overhead-keyed" proxy mode, which replace ProxyPSK.
+	// Each client picks a key by its proxyKeyID, and every packet carries the ID of its key,
+	// so the server looks up the key instead of trying each one. Replies to a client are
+	// encrypted with the key of the session's first packet. Key IDs must be unique.
+	ProxyKeys []ProxyKeyConfig `json:"proxyKeys"`
+
+	// ProxyKeyMaskKey is the 32-byte key that masks the key ID of each packet in the "zero-overhead-keyed" proxy mode,
+	// so that the key ID does not identify the tenant on the wire. It is shared by all tenants of the server,
+	// and clients of the server must use the same value. It is required in that mode, and only used in that mode.
+	ProxyKeyMaskKey []byte `json:"proxyKeyMaskKey,omitempty"`
+
+	// EgressRateBps paces swgp packets sent to clients to this many bytes per second.
+	// Over-rate packets are queued briefly, and dropped when the queue is full.
+	//
+	// The default value 0 disables egress shaping.
+	EgressRateBps int `json:"egressRateBps"`
+
+	// HandshakeRateLimit limits the handshake initiations forwarded to WgEndpoint to this many per second,
+	// with bursts of up to one second's worth. Excess handshake initiations are dropped and counted,
+	// and WireGuard retries them later. This smooths out reconnection storms. Other packets are unaffected.
+	//
+	// The default value 0 disables the limit.
+	HandshakeRateLimit int `json:"handshakeRateLimit"`
+
+	// DecryptBudgetPerSec caps the packets the server attempts to decrypt to this many per second,
+	// as a last-resort safety valve that keeps the host responsive under a flood, such as of spoofed packets.
+	// The budget is a token bucket of that many attempts, refilled continuously, so bursts never exceed it.
+	// Packets beyond the budget are dropped before decryption and counted.
+	// Unlike the per-session and handshake rate limits, it applies to all sources together,
+	// so set it well above the peak legitimate packet rate.
+	//
+	// It is not supported with the TCP proxy transport. The default value 0 disables the budget.
+	DecryptBudgetPerSec int `json:"decryptBudgetPerSec"`
+
+	// TTL sets the IP TTL and IPv6 hop limit of packets sent by both proxyConn and wgConn,
+	// for example to keep packets from looping in a misconfigured network. It must be between 1 and 255.
+	//
+	// The default value 0 uses the system default.
+	TTL int `json:"ttl"`
+
+	// RequireCookie requires clients to echo a stateless cookie before a session is created for them.
+	// This stops spoofed-source packets from creating sessions. Clients answer cookie challenges automatically.
+	RequireCookie bool `json:"requireCookie"`
+
+	// CPUAffinity pins the server's receive loops on proxyConn to the listed CPUs.
+	// Each loop is locked to its own OS thread once, when it starts.
+	// The goroutines of each session are short-lived, and are left to the Go runtime.
+	// Only supported on Linux. It is not supported with the TCP proxy transport,
+	// where each connection is served by the goroutines of its session.
+	//
+	// The default empty list leaves scheduling to the Go runtime.
+	CPUAffinity []int `json:"cpuAffinity"`
+
+	// MirrorTo is a UDP endpoint to send a copy of each decrypted WireGuard packet relayed to WgEndpoint to,
+	// so that monitoring tools can inspect the WireGuard traffic without being inline. Mirroring is best-effort:
+	// copies are dropped and counted when they cannot be sent fast enough, and never hold up the relay.
+	// Only packets from clients are mirrored, as bare WireGuard packets.
+	//
+	// The default empty value disables mirroring.
+	MirrorTo netip.AddrPort `json:"mirrorTo"`
+
+	// DecoyPorts are extra UDP ports opened on the host of ProxyListen to blend it into noise.
+	// Packets received on decoy ports are silently discarded and counted.
+	DecoyPorts []int `json:"decoyPorts"`
+
+	// ProxyTransport selects how swgp packets are carried between clients and servers.
+	// "udp" is the default. "tcp" accepts a TCP connection per session, with each swgp packet
+	// prefixed by its length, as a fallback for networks that block UDP. It must match the clients.
+	ProxyTransport string `json:"proxyTransport"`
+
+	// ProxyCoalesce bundles small WireGuard data packets to a client into one swgp packet,
+	// to save per-packet overhead on the path, like for a burst of TCP acks. Only packets read from
+	// WgEndpoint in the same batch are bundled, so no packet is held back. Handshakes and packets
+	// that do not fit are sent on their own. Bundles are always accepted, but the client must be
+	// a version that understands them.
+	//
+	// It requires the sendmmsg batch mode, and is not supported with the TCP proxy transport.
+	ProxyCoalesce bool `json:"proxyCoalesce,omitempty"`
+
+	// Network restricts proxyConn and wgConn to an address family: "udp" (default, both),
+	// "udp4" (IPv4 only), or "udp6" (IPv6 only). WgEndpoint domains are resolved to
+	// addresses of the same family, and IP addresses of the other family are rejected.
+	Network string `json:"network"`
+
+	// UpstreamSourcePort binds wgConn to this local port, so that replies from WgEndpoint
+	// can be matched by a static firewall rule.
+	//
+	// Only one session can hold the port at a time. This is meant for a single client,
+	// as new sessions fail to be created while another session is using the port.
+	//
+	// The default value 0 lets the system pick an ephemeral port for each session.
+	UpstreamSourcePort int `json:"upstreamSourcePort"`
+
+	// UpstreamPortRange restricts the local port of each session's wgConn to [min, max].
+	// Ports in use are skipped. When all ports in the range are taken, new sessions fail
+	// with a "no ports available" error, counted in stats as upstream ports exhausted.
+	//
+	// It cannot be used with UpstreamSourcePort. The default zero value disables the restriction.
+	UpstreamPortRange [2]int `json:"upstreamPortRange"`
+
+	// EndpointResolveTimeout is how long to keep retrying a failed resolution of WgEndpoint
+	// when creating a session, with exponential backoff between attempts. This helps the first
+	// sessions survive DNS not being ready yet, for example right after boot.
+	//
+	// The default value 0 gives up on the first failure, dropping the packet that started the session.
+	EndpointResolveTimeout jsonhelper.Duration `json:"endpointResolveTimeout"`
+
+	// BackoffBehavior selects what happens to packets that arrive for a session while the resolution
+	// of its WireGuard endpoint is being retried, see EndpointResolveTimeout. "buffer" keeps the newest
+	// BackoffBufferPackets of them, dropping older ones, and forwards them once the endpoint resolves.
+	// "drop" drops them right away, so that a dead endpoint costs no memory for queued packets.
+	// Dropped packets are counted.
+	//
+	// It requires EndpointResolveTimeout, and is not supported with the TCP proxy transport.
+	// The default empty value queues them in the session's send channel, up to SendChannelCapacity.
+	BackoffBehavior string `json:"backoffBehavior"`
+
+	// BackoffBufferPackets is the number of packets kept by the "buffer" backoff behavior.
+	// It must not exceed SendChannelCapacity.
+	//
+	// The default value 0 keeps 16 packets.
+	BackoffBufferPackets int `json:"backoffBufferPackets"`
+
+	// Transparent sets IP_TRANSPARENT on proxyConn, so that it can receive packets redirected by TPROXY
+	// for any destination. The original destination address of each new session is logged.
+	// Only receiving is affected. Replies are sent through proxyConn as usual.
+	//
+	// It requires CAP_NET_ADMIN and is only supported on Linux with the UDP proxy transport.
+	Transparent bool `json:"transparent"`
+
+	// TransparentRoutes maps original destination ports to WireGuard endpoints, so that a transparent
+	// proxyConn can serve multiple backends. Packets to ports without a route go to WgEndpoint.
+	// Sessions are keyed by both the client address and the original destination address,
+	// so each backend's replies return through the session they belong to.
+	//
+	// It requires Transparent. The default empty map sends all packets to WgEndpoint.
+	TransparentRoutes map[uint16]conn.Addr `json:"transparentRoutes"`
+
+	// VRF is the name of a VRF device to place the server's sockets in with SO_BINDTODEVICE,
+	// so that both proxyConn and wgConn use the VRF's routing table.
+	// The VRF must exist when the server is created.
+	//
+	// It is only supported on Linux. The default empty value uses the default routing table.
+	VRF string `json:"vrf"`
+
+	// WgEndpointSRV replaces WgEndpoint with an SRV record to discover it from, as an srv://_service._proto.name URI.
+	// The record is looked up when the server starts, and then every WgEndpointSRVInterval. The target of
+	// the highest priority record, picked by weight among equals, becomes the endpoint of new sessions.
+	// Existing sessions keep the endpoint they started with. If a lookup fails, the last good target is kept.
+	//
+	// The first lookup must succeed for the server to start.
+	WgEndpointSRV string `json:"wgEndpointSRV"`
+
+	// WgEndpointSRVInterval is the interval between lookups of WgEndpointSRV.
+	//
+	// The default value 0 uses 30 seconds.
+	WgEndpointSRVInterval jsonhelper.Duration `json:"wgEndpointSRVInterval"`
+
+	// SessionStateFile is the path of the file where the session table is saved when the server stops,
+	// and restored from when it starts, so that sessions survive a restart. Expired sessions are not restored.
+	// Restored sessions bind to their previous local ports, so wgEndpoint can reach clients right away.
+	// On a graceful restart, the sessions are also saved before the new process starts, and the restored sessions
+	// wait for the old process to release their ports.
+	//
+	// It is not supported with the TCP proxy transport. The default empty path disables saving sessions.
+	SessionStateFile string `json:"sessionStateFile"`
+
+	// OnUpstreamUnreachable selects what to do when WgEndpoint answers with ICMP port unreachable,
+	// for example because WireGuard is down. "ignore" counts and logs it, and keeps the session.
+	// "evict-session" also ends the session, so that the next packet from the client starts a new one.
+	// "failover" is reserved for multiple WireGuard endpoints, which are not supported yet.
+	//
+	// The default empty value does not detect unreachable endpoints. Detection is only supported on Linux.
+	OnUpstreamUnreachable string `json:"onUpstreamUnreachable"`
+
+	// SessionMaxLifetime is the maximum time a session lasts, even when it is passing traffic.
+	// A session reaching it is evicted, and the next packet from the client starts a new session
+	// with a new upstream socket. This limits how long a single NAT mapping persists.
+	//
+	// The default value 0 lets sessions last as long as they are active.
+	SessionMaxLifetime jsonhelper.Duration `json:"sessionMaxLifetime"`
+
+	// DropSessionlessData drops WireGuard data packets from clients without a session,
+	// instead of starting a session with them. Such packets mostly arrive after the server lost its sessions,
+	// for example in a restart, while clients kept theirs. Forwarding them to WgEndpoint lets WireGuard
+	// carry on right away, while dropping them stalls the tunnel until the next handshake, in up to 2 minutes,
+	// but makes sure only handshakes create sessions. Both ways, they are counted.
+	//
+	// It is not supported with the TCP proxy transport, where each connection is a session.
+	// The default value false starts sessions with data packets.
+	DropSessionlessData bool `json:"dropSessionlessData"`
+
+	// UpstreamSwitchGrace switches existing sessions to a new WgEndpoint, set by reload or discovered
+	// through WgEndpointSRV, instead of leaving them on the old endpoint until they expire.
+	// Replies from the old endpoint are still accepted for this long, so that packets in flight
+	// during the switch are not dropped.
+	//
+	// It is not supported with the TCP proxy transport. The default value 0 does not switch existing sessions.
+	UpstreamSwitchGrace jsonhelper.Duration `json:"upstreamSwitchGrace"`
+
+	// PerSessionRateBps limits the WireGuard packets each session, keyed by client address,
+	// forwards to WgEndpoint to this many bytes per second. Over-rate packets are dropped
+	// and counted per session, so that no single peer saturates the link.
+	//
+	// It is not supported with the TCP proxy transport. The default value 0 disables per-session rate limiting.
+	PerSessionRateBps int `json:"perSessionRateBps"`
+
+	// SessionTableInitialCapacity preallocates the session table for this many sessions when the server starts,
+	// so that a burst of reconnecting peers, like after a reboot, does not rehash the table as it grows.
+	// Each preallocated slot costs about 100 bytes, whether or not a session uses it, and the table
+	// keeps its largest size until the server stops. Set it to the expected number of peers.
+	// The table still grows past it as needed. It must not exceed 1048576.
+	//
+	// The default value 0 starts with an empty table.
+	SessionTableInitialCapacity int `json:"sessionTableInitialCapacity"`
+
 	PerfConfig
 }
 
@@ -47,28 +321,81 @@ type serverNatEntry struct {
 	state              atomic.Pointer[net.UDPConn]
 	clientPktinfo      atomic.Pointer[[]byte]
 	clientPktinfoCache []byte
-	wgConnSendCh       chan<- queuedPacket
+	wgConnSendCh       chan queuedPacket
+	handshakeTimer     handshakeTimer
+
+	// backingOff is whether the resolution of the session's WireGuard endpoint is being retried.
+	backingOff atomic.Bool
+
+	// wgAddr is the WireGuard endpoint of the session.
+	wgAddr conn.Addr
+
+	// keyID is the proxy key ID of the session in the "zero-overhead-keyed" proxy mode.
+	keyID uint8
+
+	// tenant counts the traffic of the session's proxy key.
+	// It is nil if the server is not in the "zero-overhead-keyed" proxy mode.
+	tenant *tenantCounters
+
+	// handler encrypts packets sent to the client.
+	handler packet.Handler
+
+	// expiresAt is the Unix time in nanoseconds when the wgConn read deadline expires the session.
+	expiresAt atomic.Int64
+
+	// createdAt is when the session was created, from which its maximum lifetime counts.
+	// A restored session keeps the creation time of the saved session.
+	createdAt time.Time
+
+	// upstream is the WireGuard endpoint the session relays to, which may switch when the server's changes.
+	upstream sessionUpstream
+
+	// rateLimiter limits the rate of packets the session forwards to the WireGuard endpoint.
+	// It is nil if per-session rate limiting is disabled.
+	rateLimiter *sessionRateLimiter
+}
+
+// newServerNatEntry returns the entry of a new session of clientAddrPort, which authenticated with the key of keyID,
+// and relays to the WireGuard endpoint wgAddr.
+func (s *server) newServerNatEntry(wgAddr conn.Addr, keyID uint8, clientAddrPort netip.AddrPort) *serverNatEntry {
+	return &serverNatEntry{
+		wgAddr:      wgAddr,
+		keyID:       keyID,
+		tenant:      s.tenant(keyID),
+		handler:     s.newSessionHandler(s.sessionHandler(keyID), clientAddrPort),
+		rateLimiter: newSessionRateLimiter(s.perSessionRateBps),
+		createdAt:   time.Now(),
+	}
 }
 
 type serverNatUplinkGeneric struct {
 	clientAddrPort netip.AddrPort
-	wgAddrPort     netip.AddrPort
+	upstream       *sessionUpstream
+	tenant         *tenantCounters
 	wgConn         *net.UDPConn
 	wgConnSendCh   <-chan queuedPacket
+	handshakeTimer *handshakeTimer
+	expiresAt      *atomic.Int64
+	maxExpiresAt   time.Time
 }
 
 type serverNatDownlinkGeneric struct {
 	clientAddrPort     netip.AddrPort
 	clientPktinfo      *atomic.Pointer[[]byte]
-	wgAddrPort         netip.AddrPort
+	upstream           *sessionUpstream
+	tenant             *tenantCounters
 	wgConn             *net.UDPConn
 	proxyConn          *net.UDPConn
 	maxProxyPacketSize int
+	handshakeTimer     *handshakeTimer
+	handler            packet.Handler
+	maxExpiresAt       time.Time
 }
 
 type server struct {
 	name                  string
 	proxyListen           string
+	mtu                   int
 	relayBatchSize        int
 	mainRecvBatchSize     int
 	sendChannelCapacity   int
@@ -76,81 +403,466 @@ type server struct {
 	maxProxyPacketSizev6  int
 	wgTunnelMTUv4         int
 	wgTunnelMTUv6         int
-	wgAddr                conn.Addr
+	wgAddr                atomic.Pointer[conn.Addr]
+	wgConnListenAddress   string
+	upstreamPortRange     [2]uint16
+	resolveTimeout        time.Duration
+	backoffBehavior       string
+	backoffBufferPackets  int
+	sessionMaxLifetime    time.Duration
+	upstreamSwitchGrace   time.Duration
+	perSessionRateBps     int
+	sessionStateFile      string
+	onUpstreamUnreachable string
+	pskFingerprintFields  []zap.Field
+	transparent           bool
+	dropSessionlessData   bool
+	proxyCoalesce         bool
+	transparentRoutes     map[uint16]conn.Addr
+	srvEndpoint           *srvEndpoint
+	resolveCtx            context.Context
+	cancelResolve         context.CancelFunc
 	handler               packet.Handler
+	keyedHandler          packet.KeyedHandler
+	keyHandlers           *[256]packet.Handler
+	keyRoutes             map[uint8]conn.Addr
+	keyNotAfter           map[uint8]time.Time
+	tenants               *[256]*tenantCounters
+	egressShaper          *egressShaper
+	handshakeLimiter      *handshakeLimiter
+	panicRecoverer        *panicRecoverer
+	decryptBudget         *decryptBudget
+	cookieGenerator       *packet.CookieGenerator
+	cpuAffinity           []int
+	decoys                *decoySet
+	mirror                *packetMirror
+	proxyTransport        string
+	network               string
+	events                *eventBus
+	resolver              *net.Resolver
+	inherited             *inheritedSockets
+	oversizedPackets      atomic.Uint64
+	malformedPackets      atomic.Uint64
+	portsExhausted        atomic.Uint64
+	lifetimeEvictions     atomic.Uint64
+	upstreamUnreachable   atomic.Uint64
+	quiesced              atomic.Bool
+	quiescedPackets       atomic.Uint64
+	receiveDrops          receiveDropCounter
+	decryptFailures       atomic.Uint64
+	sendErrors            atomic.Uint64
+	queueFullPackets      atomic.Uint64
+	cookieChallenges      atomic.Uint64
+	invalidCookies        atomic.Uint64
+	sessionRateDropped    atomic.Uint64
+	expiredKeyPackets     atomic.Uint64
+	sessionlessData       atomic.Uint64
+	sessionlessDropped    atomic.Uint64
+	backoffDropped        atomic.Uint64
+	bundlesSent           atomic.Uint64
+	bundledPackets        atomic.Uint64
+	uplinkTraffic         trafficCounters
+	downlinkTraffic       trafficCounters
+	handshakeRTT          rttEstimator
 	logger                *zap.Logger
+	connLogger            *zap.Logger
+	packetLogger          *zap.Logger
+	logLimiter            *logLimiter
 	proxyConn             *net.UDPConn
+	proxyListener         *net.TCPListener
 	proxyConnListenConfig conn.ListenConfig
 	wgConnListenConfig    conn.ListenConfig
-	packetBufPool         sync.Pool
+	mirrorListenConfig    conn.ListenConfig
+	packetBufPool         packetBufPool
 	mu                    sync.Mutex
 	wg                    sync.WaitGroup
 	mwg                   sync.WaitGroup
-	table                 map[netip.AddrPort]*serverNatEntry
+	recvHoldsTable        bool
+	table                 map[serverSessionKey]*serverNatEntry
+	tcpTable              map[netip.AddrPort]*net.TCPConn
 	startFunc             func(context.Context) error
+
+	// stopped is set by Stop with mu held. Connections accepted after that are closed instead of served.
+	stopped bool
 }
 
 // Server creates a swgp server service from the server config.
 // Call the Start method on the returned service to start it.
-func (sc *ServerConfig) Server(logger *zap.Logger, listenConfigCache conn.ListenConfigCache) (*server, error) {
-	// Require MTU to be at least 1280.
-	if sc.MTU < minimumMTU {
-		return nil, ErrMTUTooSmall
+func (sc *ServerConfig) Server(loggers Loggers, listenConfigCache conn.ListenConfigCache) (*server, error) {
+	// MTU 0 uses the MTU of the network interface that has the listen address.
+	mtu := sc.MTU
+	if mtu == 0 {
+		fallbackMTU, err := resolveFallbackMTU(sc.FallbackMTU)
+		if err != nil {
+			return nil, err
+		}
+		mtu = autoMTU(listenHostAddr(sc.ProxyListen), fallbackMTU, loggers.Service,
+			zap.String("server", sc.Name),
+			zap.String("listenAddress", sc.ProxyListen),
+		)
+	}
+
+	// Require MTU to be between 1280 and 65535.
+	if err := checkMTU(mtu, loggers.Service,
+		zap.String("server", sc.Name),
+		zap.String("listenAddress", sc.ProxyListen),
+	); err != nil {
+		return nil, err
+	}
+
+	if err := checkVRF(sc.VRF); err != nil {
+		return nil, err
+	}
+
+	if err := checkTTL(sc.TTL); err != nil {
+		return nil, err
+	}
+
+	if sc.MirrorTo.IsValid() && sc.MirrorTo.Port() == 0 {
+		return nil, fmt.Errorf("mirrorTo must have a port: %s", sc.MirrorTo)
+	}
+
+	if len(sc.CPUAffinity) > 0 {
+		if err := checkCPUAffinity(sc.CPUAffinity); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(sc.DecoyPorts) > 0 {
+		if err := checkDecoyPorts(sc.DecoyPorts, sc.ProxyListen); err != nil {
+			return nil, err
+		}
+	}
+
+	proxyTransport, err := checkProxyTransport(sc.ProxyTransport)
+	if err != nil {
+		return nil, err
+	}
+	if proxyTransport == proxyTransportTCP && sc.RequireCookie {
+		return nil, errors.New("requireCookie is not supported with the TCP proxy transport")
+	}
+	if proxyTransport == proxyTransportTCP && sc.SessionStateFile != "" {
+		return nil, errors.New("sessionStateFile is not supported with the TCP proxy transport")
+	}
+	if proxyTransport == proxyTransportTCP && sc.DecryptBudgetPerSec > 0 {
+		return nil, errors.New("decryptBudgetPerSec is not supported with the TCP proxy transport")
+	}
+	if proxyTransport == proxyTransportTCP && sc.BackoffBehavior != "" {
+		return nil, errors.New("backoffBehavior is not supported with the TCP proxy transport")
+	}
+	if proxyTransport == proxyTransportTCP && len(sc.CPUAffinity) > 0 {
+		return nil, errors.New("cpuAffinity is not supported with the TCP proxy transport")
+	}
+	if proxyTransport == proxyTransportTCP && sc.DropSessionlessData {
+		return nil, errors.New("dropSessionlessData is not supported with the TCP proxy transport")
+	}
+	if proxyTransport == proxyTransportTCP && sc.ProxyMode == proxyModeZeroOverheadKeyed {
+		return nil, fmt.Errorf("the %s proxy mode is not supported with the TCP proxy transport", proxyModeZeroOverheadKeyed)
+	}
+	if sc.Transparent {
+		if runtime.GOOS != "linux" {
+			return nil, errors.New("transparent is only supported on Linux")
+		}
+		if proxyTransport == proxyTransportTCP {
+			return nil, errors.New("transparent is not supported with the TCP proxy transport")
+		}
+	}
+
+	network, err := checkNetwork(sc.Network)
+	if err != nil {
+		return nil, err
+	}
+	var srvEndpoint *srvEndpoint
+	if sc.WgEndpointSRV != "" {
+		if sc.WgEndpoint.IsValid() {
+			return nil, errors.New("wgEndpoint must not be set together with wgEndpointSRV")
+		}
+		name, err := parseSRVEndpoint(sc.WgEndpointSRV)
+		if err != nil {
+			return nil, err
+		}
+		if sc.WgEndpointSRVInterval < 0 {
+			return nil, fmt.Errorf("wgEndpointSRV interval must not be negative: %s", time.Duration(sc.WgEndpointSRVInterval))
+		}
+		srvEndpoint = newSRVEndpoint(name, time.Duration(sc.WgEndpointSRVInterval))
+	}
+	if sc.WgEndpoint.IsIP() && !conn.IPMatchesNetwork(sc.WgEndpoint.IP(), network) {
+		return nil, fmt.Errorf("wgEndpoint %s cannot be used on network %s", sc.WgEndpoint, network)
+	}
+	if err = checkOnUpstreamUnreachable(sc.OnUpstreamUnreachable); err != nil {
+		return nil, err
+	}
+
+	if err = checkTransparentRoutes(sc.TransparentRoutes, sc.Transparent, network); err != nil {
+		return nil, err
+	}
+	if err = checkProxyKeyTenants(sc.ProxyKeys, sc.TransparentRoutes, network); err != nil {
+		return nil, err
+	}
+
+	var wgConnListenAddress string
+	if sc.UpstreamSourcePort != 0 {
+		if err = checkUpstreamSourcePort(sc.UpstreamSourcePort, sc.ProxyListen, sc.DecoyPorts); err != nil {
+			return nil, err
+		}
+		wgConnListenAddress = net.JoinHostPort("", strconv.Itoa(sc.UpstreamSourcePort))
+	}
+
+	var upstreamPortRange [2]uint16
+	if sc.UpstreamPortRange != [2]int{} {
+		if sc.UpstreamSourcePort != 0 {
+			return nil, errors.New("upstreamSourcePort and upstreamPortRange are mutually exclusive")
+		}
+		if err = checkUpstreamPortRange(sc.UpstreamPortRange); err != nil {
+			return nil, err
+		}
+		upstreamPortRange = [2]uint16{uint16(sc.UpstreamPortRange[0]), uint16(sc.UpstreamPortRange[1])}
+	}
+
+	if sc.HandshakeRateLimit < 0 {
+		return nil, fmt.Errorf("handshake rate limit must not be negative: %d", sc.HandshakeRateLimit)
+	}
+
+	if sc.DecryptBudgetPerSec < 0 {
+		return nil, fmt.Errorf("decrypt budget must not be negative: %d", sc.DecryptBudgetPerSec)
+	}
+
+	if sc.EndpointResolveTimeout < 0 {
+		return nil, fmt.Errorf("endpoint resolve timeout must not be negative: %s", time.Duration(sc.EndpointResolveTimeout))
+	}
+
+	if sc.UpstreamSwitchGrace < 0 {
+		return nil, fmt.Errorf("upstream switch grace must not be negative: %s", time.Duration(sc.UpstreamSwitchGrace))
+	}
+	if sc.UpstreamSwitchGrace > 0 && proxyTransport == proxyTransportTCP {
+		return nil, errors.New("upstreamSwitchGrace is not supported with the TCP proxy transport")
+	}
+
+	if sc.SessionMaxLifetime < 0 {
+		return nil, fmt.Errorf("session max lifetime must not be negative: %s", time.Duration(sc.SessionMaxLifetime))
+	}
+
+	if sc.EgressRateBps < 0 {
+		return nil, fmt.Errorf("egress rate must not be negative: %d", sc.EgressRateBps)
+	}
+
+	if sc.PerSessionRateBps < 0 {
+		return nil, fmt.Errorf("per-session rate must not be negative: %d", sc.PerSessionRateBps)
+	}
+	if sc.PerSessionRateBps > 0 && proxyTransport == proxyTransportTCP {
+		return nil, errors.New("perSessionRateBps is not supported with the TCP proxy transport")
+	}
+
+	if sc.SessionTableInitialCapacity < 0 || sc.SessionTableInitialCapacity > maxSessionTableInitialCapacity {
+		return nil, fmt.Errorf("session table initial capacity must be between 0 and %d: %d", maxSessionTableInitialCapacity, sc.SessionTableInitialCapacity)
+	}
+	var tableCapacity, tcpTableCapacity int
+	if proxyTransport == proxyTransportTCP {
+		tcpTableCapacity = sc.SessionTableInitialCapacity
+	} else {
+		tableCapacity = sc.SessionTableInitialCapacity
 	}
 
 	// Check and apply PerfConfig defaults.
+	requestedMainRecvBatchSize := sc.MainRecvBatchSize
 	if err := sc.CheckAndApplyDefaults(); err != nil {
 		return nil, err
 	}
+	if requestedMainRecvBatchSize > sc.MainRecvBatchSize {
+		loggers.Service.Warn("Clamped main recv batch size",
+			zap.String("server", sc.Name),
+			zap.Int("requestedMainRecvBatchSize", requestedMainRecvBatchSize),
+			zap.Int("mainRecvBatchSize", sc.MainRecvBatchSize),
+		)
+	}
+
+	if err = checkProxyCoalesce(sc.ProxyCoalesce, 0, sc.BatchMode, proxyTransport); err != nil {
+		return nil, err
+	}
+
+	backoffBufferPackets, err := checkBackoffBehavior(sc.BackoffBehavior, sc.BackoffBufferPackets, time.Duration(sc.EndpointResolveTimeout), sc.SendChannelCapacity)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create packet handler for user-specified proxy mode.
-	handler, err := getPacketHandlerForProxyMode(sc.ProxyMode, sc.ProxyPSK)
+	handler, keyedHandler, err := getServerPacketHandler(sc)
 	if err != nil {
 		return nil, err
 	}
 
 	// maxProxyPacketSize = MTU - IP header length - UDP header length
-	maxProxyPacketSizev4 := sc.MTU - IPv4HeaderLength - UDPHeaderLength
-	maxProxyPacketSizev6 := sc.MTU - IPv6HeaderLength - UDPHeaderLength
+	maxProxyPacketSizev4 := mtu - IPv4HeaderLength - UDPHeaderLength
+	maxProxyPacketSizev6 := mtu - IPv6HeaderLength - UDPHeaderLength
+	if err = checkPaddingSizeClassesCoverage(sc.PaddingSizeClasses, maxProxyPacketSizev4); err != nil {
+		return nil, err
+	}
 	wgTunnelMTUv4 := getWgTunnelMTUForHandler(handler, maxProxyPacketSizev4)
 	wgTunnelMTUv6 := getWgTunnelMTUForHandler(handler, maxProxyPacketSizev6)
 
+	var cookieGenerator *packet.CookieGenerator
+	if sc.RequireCookie {
+		cookieGenerator, err = packet.NewCookieGenerator()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	s := server{
-		name:                 sc.Name,
-		proxyListen:          sc.ProxyListen,
-		relayBatchSize:       sc.RelayBatchSize,
-		mainRecvBatchSize:    sc.MainRecvBatchSize,
-		sendChannelCapacity:  sc.SendChannelCapacity,
-		maxProxyPacketSizev4: maxProxyPacketSizev4,
-		maxProxyPacketSizev6: maxProxyPacketSizev6,
-		wgTunnelMTUv4:        wgTunnelMTUv4,
-		wgTunnelMTUv6:        wgTunnelMTUv6,
-		wgAddr:               sc.WgEndpoint,
-		handler:              handler,
-		logger:               logger,
+		name:                  sc.Name,
+		proxyListen:           sc.ProxyListen,
+		mtu:                   mtu,
+		relayBatchSize:        sc.RelayBatchSize,
+		mainRecvBatchSize:     sc.MainRecvBatchSize,
+		sendChannelCapacity:   sc.SendChannelCapacity,
+		maxProxyPacketSizev4:  maxProxyPacketSizev4,
+		maxProxyPacketSizev6:  maxProxyPacketSizev6,
+		wgTunnelMTUv4:         wgTunnelMTUv4,
+		wgTunnelMTUv6:         wgTunnelMTUv6,
+		wgConnListenAddress:   wgConnListenAddress,
+		upstreamPortRange:     upstreamPortRange,
+		resolveTimeout:        time.Duration(sc.EndpointResolveTimeout),
+		backoffBehavior:       sc.BackoffBehavior,
+		backoffBufferPackets:  backoffBufferPackets,
+		sessionMaxLifetime:    time.Duration(sc.SessionMaxLifetime),
+		upstreamSwitchGrace:   time.Duration(sc.UpstreamSwitchGrace),
+		perSessionRateBps:     sc.PerSessionRateBps,
+		sessionStateFile:      sc.SessionStateFile,
+		onUpstreamUnreachable: sc.OnUpstreamUnreachable,
+		transparent:           sc.Transparent,
+		dropSessionlessData:   sc.DropSessionlessData,
+		proxyCoalesce:         sc.ProxyCoalesce,
+		transparentRoutes:     sc.TransparentRoutes,
+		handler:               handler,
+		keyedHandler:          keyedHandler,
+		egressShaper:          newEgressShaper(sc.EgressRateBps),
+		handshakeLimiter:      newHandshakeLimiter(sc.HandshakeRateLimit),
+		panicRecoverer:        newPanicRecoverer(loggers.Service, zap.String("server", sc.Name)),
+		decryptBudget:         newDecryptBudget(sc.DecryptBudgetPerSec),
+		cookieGenerator:       cookieGenerator,
+		cpuAffinity:           sc.CPUAffinity,
+		mirror:                newPacketMirror(sc.MirrorTo, maxProxyPacketSizev4+1),
+		proxyTransport:        proxyTransport,
+		network:               network,
+		logger:                loggers.Service,
+		connLogger:            loggers.Conn,
+		packetLogger:          loggers.Packet,
+		logLimiter: newLogLimiter(
+			zap.String("server", sc.Name),
+			zap.String("listenAddress", sc.ProxyListen),
+		),
 		proxyConnListenConfig: listenConfigCache.Get(conn.ListenerSocketOptions{
-			Fwmark:            sc.ProxyFwmark,
-			TrafficClass:      sc.ProxyTrafficClass,
-			PathMTUDiscovery:  true,
-			ReceivePacketInfo: true,
+			Fwmark:             sc.ProxyFwmark,
+			TrafficClass:       sc.ProxyTrafficClass,
+			TTL:                sc.TTL,
+			PathMTUDiscovery:   true,
+			ReceivePacketInfo:  true,
+			Transparent:        sc.Transparent,
+			ReceiveDropCounter: true,
+			BindToDevice:       sc.VRF,
 		}),
 		wgConnListenConfig: listenConfigCache.Get(conn.ListenerSocketOptions{
 			Fwmark:           sc.WgFwmark,
 			TrafficClass:     sc.WgTrafficClass,
+			TTL:              sc.TTL,
 			PathMTUDiscovery: true,
+			ReceiveErrors:    sc.OnUpstreamUnreachable != "",
+			BindToDevice:     sc.VRF,
+		}),
+		mirrorListenConfig: listenConfigCache.Get(conn.ListenerSocketOptions{
+			Fwmark:       sc.WgFwmark,
+			BindToDevice: sc.VRF,
 		}),
-		packetBufPool: sync.Pool{
-			New: func() any {
-				b := make([]byte, maxProxyPacketSizev4)
-				return &b[0]
-			},
+		packetBufPool: packetBufPool{
+			size: maxProxyPacketSizev4 + 1,
 		},
-		table: make(map[netip.AddrPort]*serverNatEntry),
+		table:    make(map[serverSessionKey]*serverNatEntry, tableCapacity),
+		tcpTable: make(map[netip.AddrPort]*net.TCPConn, tcpTableCapacity),
+	}
+	wgAddr := sc.WgEndpoint
+	s.wgAddr.Store(&wgAddr)
+	s.srvEndpoint = srvEndpoint
+	if proxyTransport == proxyTransportTCP {
+		// PMTUD, DF, and pktinfo only apply to UDP sockets.
+		s.proxyConnListenConfig = listenConfigCache.Get(conn.ListenerSocketOptions{
+			Fwmark:       sc.ProxyFwmark,
+			TrafficClass: sc.ProxyTrafficClass,
+			TTL:          sc.TTL,
+			BindToDevice: sc.VRF,
+		})
+	}
+	s.decoys = newDecoySet(sc.DecoyPorts, sc.ProxyListen, network, listenConfigCache.Get(conn.ListenerSocketOptions{
+		Fwmark:       sc.ProxyFwmark,
+		TrafficClass: sc.ProxyTrafficClass,
+		BindToDevice: sc.VRF,
+	}))
+	if keyedHandler != nil {
+		s.keyHandlers = newKeyHandlers(keyedHandler, sc.ProxyKeys)
+		s.keyRoutes = newKeyRoutes(sc.ProxyKeys)
+		s.keyNotAfter = newKeyNotAfter(sc.ProxyKeys)
+		s.tenants = newTenants(sc.ProxyKeys)
+	}
+	if sc.LogPSKFingerprint {
+		if keyedHandler != nil {
+			s.pskFingerprintFields = proxyKeyFingerprintFields(sc.ProxyKeys)
+		} else {
+			s.pskFingerprintFields = pskFingerprintFields(sc.ProxyPSK, sc.ProxyPSKInbound, sc.ProxyPSKOutbound)
+		}
 	}
 	s.setStartFunc(sc.BatchMode)
+	if proxyTransport == proxyTransportTCP {
+		s.startFunc = s.startTCP
+	}
 	return &s, nil
 }
 
+// checkUpstreamSourcePort returns an error if the upstream source port is out of range,
+// or collides with the proxy listen port or a decoy port.
+func checkUpstreamSourcePort(port int, proxyListen string, decoyPorts []int) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("upstream source port out of range: %d", port)
+	}
+
+	_, proxyPortString, err := net.SplitHostPort(proxyListen)
+	if err != nil {
+		return fmt.Errorf("failed to parse proxy listen address: %w", err)
+	}
+	if proxyPort, _ := strconv.Atoi(proxyPortString); port == proxyPort {
+		return fmt.Errorf("upstream source port collides with proxy listen port: %d", port)
+	}
+
+	for _, decoyPort := range decoyPorts {
+		if port == decoyPort {
+			return fmt.Errorf("upstream source port collides with decoy port: %d", port)
+		}
+	}
+	return nil
+}
+
+// checkUpstreamPortRange returns an error if the upstream port range is out of range or reversed.
+func checkUpstreamPortRange(r [2]int) error {
+	if r[0] <= 0 || r[1] > 65535 || r[0] > r[1] {
+		return fmt.Errorf("invalid upstream port range: %d-%d", r[0], r[1])
+	}
+	return nil
+}
+
+// listenWgConn creates the socket of a new session for relaying to wgAddr.
+// If port is not 0, the socket is bound to port, as for a session restored from a snapshot.
+func (s *server) listenWgConn(ctx context.Context, port uint16) (*net.UDPConn, error) {
+	if port != 0 {
+		return s.wgConnListenConfig.ListenUDP(ctx, s.network, net.JoinHostPort("", strconv.FormatUint(uint64(port), 10)))
+	}
+	if s.upstreamPortRange[1] == 0 {
+		return s.wgConnListenConfig.ListenUDP(ctx, s.network, s.wgConnListenAddress)
+	}
+	wgConn, err := s.wgConnListenConfig.ListenUDPPortRange(ctx, s.network, "", s.upstreamPortRange[0], s.upstreamPortRange[1])
+	if errors.Is(err, conn.ErrNoPortsAvailable) {
+		s.portsExhausted.Add(1)
+	}
+	return wgConn, err
+}
+
 // String implements the Service String method.
 func (s *server) String() string {
 	return s.name + " swgp server service"
@@ -158,27 +870,133 @@ func (s *server) String() string {
 
 // Start implements the Service Start method.
 func (s *server) Start(ctx context.Context) (err error) {
-	return s.startFunc(ctx)
+	s.resolveCtx, s.cancelResolve = context.WithCancel(ctx)
+	if err = s.startSRVEndpoint(ctx); err != nil {
+		s.cancelResolve()
+		return err
+	}
+	// Bind the decoy ports first, but only serve them once the proxy listener is up,
+	// so that no goroutine runs if any socket fails to bind.
+	if err = s.listenDecoys(ctx); err != nil {
+		s.cancelResolve()
+		s.stopSRVEndpoint()
+		return err
+	}
+	if err = s.startMirror(ctx); err != nil {
+		s.stopDecoys()
+		s.cancelResolve()
+		s.stopSRVEndpoint()
+		return err
+	}
+	if err = s.startFunc(ctx); err != nil {
+		s.mirror.Stop()
+		s.stopDecoys()
+		s.cancelResolve()
+		s.stopSRVEndpoint()
+		return err
+	}
+	s.serveDecoys()
+	s.logPSKFingerprint()
+	return nil
+}
+
+// logPSKFingerprint logs the fingerprints of the configured PSKs if requested.
+func (s *server) logPSKFingerprint() {
+	if len(s.pskFingerprintFields) == 0 {
+		return
+	}
+	s.logger.Info("PSK fingerprint", append([]zap.Field{zap.String("server", s.name)}, s.pskFingerprintFields...)...)
+}
+
+const (
+	// endpointResolveInitialBackoff is the wait before the first retry of a failed wgAddr resolution.
+	endpointResolveInitialBackoff = 100 * time.Millisecond
+
+	// endpointResolveMaxBackoff caps the exponential backoff between wgAddr resolution retries.
+	endpointResolveMaxBackoff = 5 * time.Second
+)
+
+// resolveWgAddrPort resolves wgAddr for a new session from clientAddrPort.
+//
+// Failed resolutions are retried with exponential backoff until the resolve timeout elapses
+// or the server is stopped. The last error is returned. If backingOff is not nil, it is set while retrying.
+func (s *server) resolveWgAddrPort(wgAddr *conn.Addr, clientAddrPort netip.AddrPort, backingOff *atomic.Bool) (netip.AddrPort, error) {
+	wgAddrPort, err := wgAddr.ResolveIPPortNetworkWithResolver(s.resolveCtx, s.resolver, s.network)
+	if err == nil || s.resolveTimeout <= 0 {
+		return wgAddrPort, err
+	}
+
+	if backingOff != nil {
+		backingOff.Store(true)
+		defer backingOff.Store(false)
+	}
+
+	deadline := time.Now().Add(s.resolveTimeout)
+	backoff := endpointResolveInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return netip.AddrPort{}, err
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+
+		s.connLogger.Info("Retrying wg address resolution",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Stringer("wgAddress", wgAddr),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err),
+		)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-s.resolveCtx.Done():
+			timer.Stop()
+			return netip.AddrPort{}, err
+		}
+
+		wgAddrPort, err = wgAddr.ResolveIPPortNetworkWithResolver(s.resolveCtx, s.resolver, s.network)
+		if err == nil {
+			return wgAddrPort, nil
+		}
+
+		backoff *= 2
+		if backoff > endpointResolveMaxBackoff {
+			backoff = endpointResolveMaxBackoff
+		}
+	}
 }
 
 func (s *server) startGeneric(ctx context.Context) error {
-	proxyConn, err := s.proxyConnListenConfig.ListenUDP(ctx, "udp", s.proxyListen)
+	proxyConn, err := s.inherited.listenUDP(ctx, &s.proxyConnListenConfig, s.network, s.proxyListen)
 	if err != nil {
 		return err
 	}
 	s.proxyConn = proxyConn
 
+	s.restoreSessions(func(key serverSessionKey, entry *sessionStateEntry, natEntry *serverNatEntry, wgConnSendCh chan queuedPacket) {
+		go s.relaySessionGeneric(ctx, proxyConn, key, natEntry, wgConnSendCh, entry)
+	})
+
 	s.mwg.Add(1)
 
 	go func() {
-		s.recvFromProxyConnGeneric(ctx, proxyConn)
+		s.panicRecoverer.run(func() {
+			s.recvFromProxyConnGeneric(ctx, proxyConn)
+		}, s.releaseTableAfterPanic)
 		s.mwg.Done()
 	}()
 
 	s.logger.Info("Started service",
 		zap.String("server", s.name),
 		zap.String("listenAddress", s.proxyListen),
-		zap.Stringer("wgAddress", &s.wgAddr),
+		zap.Stringer("wgAddress", s.wgAddr.Load()),
 		zap.Int("wgTunnelMTUv4", s.wgTunnelMTUv4),
 		zap.Int("wgTunnelMTUv6", s.wgTunnelMTUv6),
 	)
@@ -186,6 +1004,8 @@ func (s *server) startGeneric(ctx context.Context) error {
 }
 
 func (s *server) recvFromProxyConnGeneric(ctx context.Context, proxyConn *net.UDPConn) {
+	s.pinWorkerThread()
+
 	cmsgBuf := make([]byte, conn.SocketControlMessageBufferSize)
 
 	var (
@@ -196,13 +1016,13 @@ func (s *server) recvFromProxyConnGeneric(ctx context.Context, proxyConn *net.UD
 	for {
 		packetBuf := s.getPacketBuf()
 
-		n, cmsgn, flags, clientAddrPort, err := proxyConn.ReadMsgUDPAddrPort(packetBuf, cmsgBuf)
+		n, cmsgn, flags, clientAddrPort, err := proxyConn.ReadMsgUDPAddrPort(packetBuf[:len(packetBuf)+1], cmsgBuf)
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				s.putPacketBuf(packetBuf)
 				break
 			}
-			s.logger.Warn("Failed to read from proxyConn",
+			s.connLogger.Warn("Failed to read from proxyConn",
 				zap.String("server", s.name),
 				zap.String("listenAddress", s.proxyListen),
 				zap.Stringer("clientAddress", clientAddrPort),
@@ -212,9 +1032,20 @@ func (s *server) recvFromProxyConnGeneric(ctx context.Context, proxyConn *net.UD
 			s.putPacketBuf(packetBuf)
 			continue
 		}
+		if n > len(packetBuf) {
+			s.oversizedPackets.Add(1)
+			s.logLimiter.Warn(s.logger, "Dropping oversized packet from proxyConn", clientAddrPort,
+				zap.String("server", s.name),
+				zap.String("listenAddress", s.proxyListen),
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Int("maxPacketLength", len(packetBuf)),
+			)
+			s.putPacketBuf(packetBuf)
+			continue
+		}
 		err = conn.ParseFlagsForError(flags)
 		if err != nil {
-			s.logger.Warn("Failed to read from proxyConn",
+			s.connLogger.Warn("Failed to read from proxyConn",
 				zap.String("server", s.name),
 				zap.String("listenAddress", s.proxyListen),
 				zap.Stringer("clientAddress", clientAddrPort),
@@ -225,9 +1056,22 @@ func (s *server) recvFromProxyConnGeneric(ctx context.Context, proxyConn *net.UD
 			continue
 		}
 
+		keyID := s.packetKeyID(packetBuf[:n])
+		if !s.acceptKeyID(keyID, clientAddrPort) {
+			s.putPacketBuf(packetBuf)
+			continue
+		}
+
+		if !s.decryptBudget.Allow() {
+			s.putPacketBuf(packetBuf)
+			continue
+		}
+
 		wgPacketStart, wgPacketLength, err := s.handler.DecryptZeroCopy(packetBuf, 0, n)
 		if err != nil {
-			s.logger.Warn("Failed to decrypt swgpPacket",
+			s.decryptFailures.Add(1)
+			s.publishEvent(EventDecryptFailure, clientAddrPort, err)
+			s.logLimiter.Warn(s.packetLogger, "Failed to decrypt swgpPacket", clientAddrPort,
 				zap.String("server", s.name),
 				zap.String("listenAddress", s.proxyListen),
 				zap.Stringer("clientAddress", clientAddrPort),
@@ -238,29 +1082,92 @@ func (s *server) recvFromProxyConnGeneric(ctx context.Context, proxyConn *net.UD
 			continue
 		}
 
+		if err = packet.CheckWireGuardPacket(packetBuf[wgPacketStart : wgPacketStart+wgPacketLength]); err != nil {
+			s.malformedPackets.Add(1)
+			s.logLimiter.Warn(s.packetLogger, "Dropping malformed WireGuard packet", clientAddrPort,
+				zap.String("server", s.name),
+				zap.String("listenAddress", s.proxyListen),
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Int("packetLength", wgPacketLength),
+				zap.Error(err),
+			)
+			s.putPacketBuf(packetBuf)
+			continue
+		}
+
+		if s.quiesced.Load() {
+			s.quiescedPackets.Add(1)
+			s.putPacketBuf(packetBuf)
+			continue
+		}
+
 		packetsReceived++
 		wgBytesReceived += uint64(wgPacketLength)
 
-		s.mu.Lock()
+		cmsg := s.stripReceiveDrops(cmsgBuf[:cmsgn])
 
-		natEntry, ok := s.table[clientAddrPort]
-		if !ok {
-			natEntry = &serverNatEntry{}
+		var origDstAddrPort netip.AddrPort
+		if s.transparent {
+			var ok bool
+			cmsg, origDstAddrPort, ok = s.parseTransparentCmsg(cmsg, clientAddrPort)
+			if !ok {
+				s.putPacketBuf(packetBuf)
+				continue
+			}
+		}
+
+		if wgPacket := packetBuf[wgPacketStart : wgPacketStart+wgPacketLength]; packet.IsMTUProbe(wgPacket) {
+			reply := s.newMTUProbeAck(wgPacket, n, clientAddrPort, cmsg, s.sessionHandler(keyID))
+			s.putPacketBuf(packetBuf)
+			s.sendProxyReply(&reply)
+			continue
+		}
+
+		s.lockTable()
+
+		key, wgAddr := s.sessionKey(clientAddrPort, origDstAddrPort, keyID)
+		natEntry, ok := s.table[key]
+
+		if s.cookieGenerator != nil {
+			var (
+				pass  bool
+				reply proxyReply
+			)
+			wgPacketStart, wgPacketLength, pass, reply = s.checkCookieGate(packetBuf, wgPacketStart, wgPacketLength, n, clientAddrPort, cmsg, s.sessionHandler(keyID), ok)
+			if !pass {
+				s.putPacketBuf(packetBuf)
+				s.unlockTable()
+				s.sendProxyReply(&reply)
+				continue
+			}
 		}
 
-		cmsg := cmsgBuf[:cmsgn]
+		if !s.handshakeLimiter.Allow(packetBuf[wgPacketStart : wgPacketStart+wgPacketLength]) {
+			s.putPacketBuf(packetBuf)
+			s.unlockTable()
+			continue
+		}
+
+		if !ok {
+			if !s.allowNewSession(packetBuf[wgPacketStart:wgPacketStart+wgPacketLength], clientAddrPort) {
+				s.putPacketBuf(packetBuf)
+				s.unlockTable()
+				continue
+			}
+			natEntry = s.newServerNatEntry(wgAddr, keyID, clientAddrPort)
+		}
 
 		if !bytes.Equal(natEntry.clientPktinfoCache, cmsg) {
 			clientPktinfoAddr, clientPktinfoIfindex, err := conn.ParsePktinfoCmsg(cmsg)
 			if err != nil {
-				s.logger.Warn("Failed to parse pktinfo control message from proxyConn",
+				s.connLogger.Warn("Failed to parse pktinfo control message from proxyConn",
 					zap.String("server", s.name),
 					zap.String("listenAddress", s.proxyListen),
 					zap.Stringer("clientAddress", clientAddrPort),
 					zap.Error(err),
 				)
 				s.putPacketBuf(packetBuf)
-				s.mu.Unlock()
+				s.unlockTable()
 				continue
 			}
 
@@ -283,193 +1190,266 @@ func (s *server) recvFromProxyConnGeneric(ctx context.Context, proxyConn *net.UD
 		if !ok {
 			wgConnSendCh := make(chan queuedPacket, s.sendChannelCapacity)
 			natEntry.wgConnSendCh = wgConnSendCh
-			s.table[clientAddrPort] = natEntry
+			s.table[key] = natEntry
 			s.wg.Add(1)
 
-			go func() {
-				var sendChClean bool
-
-				defer func() {
-					s.mu.Lock()
-					close(wgConnSendCh)
-					delete(s.table, clientAddrPort)
-					s.mu.Unlock()
-
-					if !sendChClean {
-						for queuedPacket := range wgConnSendCh {
-							s.putPacketBuf(queuedPacket.buf)
-						}
-					}
-
-					s.wg.Done()
-				}()
-
-				wgAddrPort, err := s.wgAddr.ResolveIPPort(ctx)
-				if err != nil {
-					s.logger.Warn("Failed to resolve wg address for new session",
-						zap.String("server", s.name),
-						zap.String("listenAddress", s.proxyListen),
-						zap.Stringer("clientAddress", clientAddrPort),
-						zap.Error(err),
-					)
-					return
-				}
-
-				wgConn, err := s.wgConnListenConfig.ListenUDP(ctx, "udp", "")
-				if err != nil {
-					s.logger.Warn("Failed to create UDP socket for new session",
-						zap.String("server", s.name),
-						zap.String("listenAddress", s.proxyListen),
-						zap.Stringer("clientAddress", clientAddrPort),
-						zap.Error(err),
-					)
-					return
-				}
-
-				err = wgConn.SetReadDeadline(time.Now().Add(RejectAfterTime))
-				if err != nil {
-					s.logger.Warn("Failed to SetReadDeadline on wgConn",
-						zap.String("server", s.name),
-						zap.String("listenAddress", s.proxyListen),
-						zap.Stringer("clientAddress", clientAddrPort),
-						zap.Error(err),
-					)
-					wgConn.Close()
-					return
-				}
-
-				oldState := natEntry.state.Swap(wgConn)
-				if oldState != nil {
-					wgConn.Close()
-					return
-				}
-
-				// No more early returns!
-				sendChClean = true
-
-				var (
-					maxProxyPacketSize int
-					wgTunnelMTU        int
-				)
-
-				if addr := clientAddrPort.Addr(); addr.Is4() || addr.Is4In6() {
-					maxProxyPacketSize = s.maxProxyPacketSizev4
-					wgTunnelMTU = s.wgTunnelMTUv4
-				} else {
-					maxProxyPacketSize = s.maxProxyPacketSizev6
-					wgTunnelMTU = s.wgTunnelMTUv6
-				}
-
-				s.logger.Info("Server relay started",
-					zap.String("server", s.name),
-					zap.String("listenAddress", s.proxyListen),
-					zap.Stringer("clientAddress", clientAddrPort),
-					zap.Stringer("wgAddress", wgAddrPort),
-					zap.Int("wgTunnelMTU", wgTunnelMTU),
-				)
-
-				s.wg.Add(1)
-
-				go func() {
-					s.relayProxyToWgGeneric(serverNatUplinkGeneric{
-						clientAddrPort: clientAddrPort,
-						wgAddrPort:     wgAddrPort,
-						wgConn:         wgConn,
-						wgConnSendCh:   wgConnSendCh,
-					})
-					wgConn.Close()
-					s.wg.Done()
-				}()
-
-				s.relayWgToProxyGeneric(serverNatDownlinkGeneric{
-					clientAddrPort:     clientAddrPort,
-					clientPktinfo:      &natEntry.clientPktinfo,
-					wgAddrPort:         wgAddrPort,
-					wgConn:             wgConn,
-					proxyConn:          proxyConn,
-					maxProxyPacketSize: maxProxyPacketSize,
-				})
-			}()
+			go s.relaySessionGeneric(ctx, proxyConn, key, natEntry, wgConnSendCh, nil)
 
 			if ce := s.logger.Check(zap.DebugLevel, "New server session"); ce != nil {
 				ce.Write(
 					zap.String("server", s.name),
 					zap.String("listenAddress", s.proxyListen),
 					zap.Stringer("clientAddress", clientAddrPort),
-					zap.Stringer("wgAddress", &s.wgAddr),
+					zap.Stringer("wgAddress", &natEntry.wgAddr),
 				)
 			}
+
+			if s.transparent {
+				s.logTransparentSession(clientAddrPort, origDstAddrPort, &natEntry.wgAddr)
+			}
+		}
+
+		if !natEntry.rateLimiter.Allow(wgPacketLength) {
+			s.countSessionRateDropped(clientAddrPort, natEntry)
+			s.putPacketBuf(packetBuf)
+			s.unlockTable()
+			continue
+		}
+
+		if ok && !s.admitDuringBackoff(natEntry, clientAddrPort) {
+			s.putPacketBuf(packetBuf)
+			s.unlockTable()
+			continue
 		}
 
 		select {
 		case natEntry.wgConnSendCh <- queuedPacket{packetBuf, wgPacketStart, wgPacketLength}:
 		default:
+			s.queueFullPackets.Add(1)
 			if ce := s.logger.Check(zap.DebugLevel, "wgPacket dropped due to full send channel"); ce != nil {
 				ce.Write(
 					zap.String("server", s.name),
 					zap.String("listenAddress", s.proxyListen),
 					zap.Stringer("clientAddress", clientAddrPort),
-					zap.Stringer("wgAddress", &s.wgAddr),
+					zap.Stringer("wgAddress", &natEntry.wgAddr),
 				)
 			}
 			s.putPacketBuf(packetBuf)
 		}
 
-		s.mu.Unlock()
+		s.unlockTable()
 	}
 
 	s.logger.Info("Finished receiving from proxyConn",
 		zap.String("server", s.name),
 		zap.String("listenAddress", s.proxyListen),
-		zap.Stringer("wgAddress", &s.wgAddr),
+		zap.Stringer("wgAddress", s.wgAddr.Load()),
 		zap.Uint64("packetsReceived", packetsReceived),
 		zap.Uint64("wgBytesReceived", wgBytesReceived),
 	)
 }
 
+// relaySessionGeneric initializes and runs the session of key until it expires or the server is stopped.
+// If restored is not nil, the session is restored from a session state snapshot.
+//
+// The caller must add the session to the table and call s.wg.Add(1) before starting the goroutine.
+func (s *server) relaySessionGeneric(ctx context.Context, proxyConn *net.UDPConn, key serverSessionKey, natEntry *serverNatEntry, wgConnSendCh chan queuedPacket, restored *sessionStateEntry) {
+	clientAddrPort := key.clientAddrPort
+	var sendChClean bool
+
+	defer func() {
+		s.mu.Lock()
+		close(wgConnSendCh)
+		delete(s.table, key)
+		s.mu.Unlock()
+
+		if sendChClean {
+			s.publishEvent(EventSessionEvicted, clientAddrPort, nil)
+		} else {
+			for queuedPacket := range wgConnSendCh {
+				s.putPacketBuf(queuedPacket.buf)
+			}
+		}
+
+		s.wg.Done()
+	}()
+
+	wgAddrPort, err := s.resolveWgAddrPort(&natEntry.wgAddr, clientAddrPort, &natEntry.backingOff)
+	if err != nil {
+		s.connLogger.Warn("Failed to resolve wg address for new session",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		return
+	}
+	natEntry.upstream.init(natEntry.wgAddr, wgAddrPort)
+
+	var wgConnPort uint16
+	expiresAt := time.Now().Add(RejectAfterTime)
+	if restored != nil {
+		wgConnPort = restored.WgConnPort
+		expiresAt = restored.ExpiresAt
+	}
+	maxExpiresAt := s.sessionMaxExpiresAt(natEntry.createdAt)
+	expiresAt = clampSessionExpiresAt(expiresAt, maxExpiresAt)
+
+	wgConn, err := s.listenWgConn(ctx, wgConnPort)
+	if restored != nil && conn.IsAddrInUse(err) {
+		wgConn, err = s.retryListenRestoredWgConn(ctx, clientAddrPort, wgConnPort, err)
+	}
+	if err != nil {
+		s.connLogger.Warn("Failed to create UDP socket for new session",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		return
+	}
+
+	err = wgConn.SetReadDeadline(expiresAt)
+	if err != nil {
+		s.connLogger.Warn("Failed to SetReadDeadline on wgConn",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		wgConn.Close()
+		return
+	}
+
+	oldState := natEntry.state.Swap(wgConn)
+	if oldState != nil {
+		wgConn.Close()
+		return
+	}
+
+	// No more early returns!
+	sendChClean = true
+	natEntry.expiresAt.Store(expiresAt.UnixNano())
+
+	var (
+		maxProxyPacketSize int
+		wgTunnelMTU        int
+	)
+
+	if addr := clientAddrPort.Addr(); addr.Is4() || addr.Is4In6() {
+		maxProxyPacketSize = s.maxProxyPacketSizev4
+		wgTunnelMTU = s.wgTunnelMTUv4
+	} else {
+		maxProxyPacketSize = s.maxProxyPacketSizev6
+		wgTunnelMTU = s.wgTunnelMTUv6
+	}
+
+	s.publishEvent(EventSessionCreated, clientAddrPort, nil)
+
+	s.logger.Info("Server relay started",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.Stringer("clientAddress", clientAddrPort),
+		zap.Stringer("wgAddress", wgAddrPort),
+		zap.Int("wgTunnelMTU", wgTunnelMTU),
+	)
+
+	s.wg.Add(1)
+
+	go func() {
+		s.panicRecoverer.runSession(clientAddrPort, func() {
+			s.relayProxyToWgGeneric(serverNatUplinkGeneric{
+				clientAddrPort: clientAddrPort,
+				upstream:       &natEntry.upstream,
+				tenant:         natEntry.tenant,
+				wgConn:         wgConn,
+				wgConnSendCh:   wgConnSendCh,
+				handshakeTimer: &natEntry.handshakeTimer,
+				expiresAt:      &natEntry.expiresAt,
+				maxExpiresAt:   maxExpiresAt,
+			})
+		}, func() {
+			s.stopSessionAfterUplinkPanic(wgConn, wgConnSendCh)
+		})
+		wgConn.Close()
+		s.wg.Done()
+	}()
+
+	// The deferred cleanup ends the session if the downlink panics.
+	s.panicRecoverer.runSession(clientAddrPort, func() {
+		s.relayWgToProxyGeneric(serverNatDownlinkGeneric{
+			clientAddrPort:     clientAddrPort,
+			clientPktinfo:      &natEntry.clientPktinfo,
+			upstream:           &natEntry.upstream,
+			tenant:             natEntry.tenant,
+			wgConn:             wgConn,
+			proxyConn:          proxyConn,
+			maxProxyPacketSize: maxProxyPacketSize,
+			handshakeTimer:     &natEntry.handshakeTimer,
+			handler:            natEntry.handler,
+			maxExpiresAt:       maxExpiresAt,
+		})
+	}, nil)
+}
+
 func (s *server) relayProxyToWgGeneric(uplink serverNatUplinkGeneric) {
 	var (
+		wgPackets   [][]byte
 		packetsSent uint64
 		wgBytesSent uint64
 	)
 
 	for queuedPacket := range uplink.wgConnSendCh {
-		wgPacket := queuedPacket.buf[queuedPacket.start : queuedPacket.start+queuedPacket.length]
+		// A bundle is relayed as the packets it carries.
+		wgPackets = unbundle(wgPackets, queuedPacket.buf[queuedPacket.start:queuedPacket.start+queuedPacket.length])
 
-		if _, err := uplink.wgConn.WriteToUDPAddrPort(wgPacket, uplink.wgAddrPort); err != nil {
-			s.logger.Warn("Failed to write wgPacket to wgConn",
-				zap.String("server", s.name),
-				zap.String("listenAddress", s.proxyListen),
-				zap.Stringer("clientAddress", uplink.clientAddrPort),
-				zap.Stringer("wgAddress", uplink.wgAddrPort),
-				zap.Error(err),
-			)
-		}
+		for _, wgPacket := range wgPackets {
+			uplink.handshakeTimer.Sent(wgPacket)
 
-		// Update wgConn read deadline when a handshake initiation/response message is received.
-		switch wgPacket[0] {
-		case packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageTypeHandshakeResponse:
-			if err := uplink.wgConn.SetReadDeadline(time.Now().Add(RejectAfterTime)); err != nil {
-				s.logger.Warn("Failed to SetReadDeadline on wgConn",
+			if _, err := conn.WriteToUDPAddrPort(uplink.wgConn, wgPacket, uplink.upstream.AddrPort()); err != nil {
+				s.sendErrors.Add(1)
+				s.publishEvent(EventSendError, uplink.clientAddrPort, err)
+				s.drainWgConnErrorQueue(uplink.wgConn, uplink.clientAddrPort, uplink.upstream.AddrPort())
+				s.logLimiter.Warn(s.connLogger, "Failed to write wgPacket to wgConn", uplink.clientAddrPort,
 					zap.String("server", s.name),
 					zap.String("listenAddress", s.proxyListen),
 					zap.Stringer("clientAddress", uplink.clientAddrPort),
-					zap.Stringer("wgAddress", uplink.wgAddrPort),
+					zap.Stringer("wgAddress", uplink.upstream),
 					zap.Error(err),
 				)
 			}
+			s.mirror.Mirror(wgPacket)
+
+			// Update wgConn read deadline when a handshake initiation/response message is received.
+			switch wgPacket[0] {
+			case packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageTypeHandshakeResponse:
+				expiresAt := clampSessionExpiresAt(time.Now().Add(RejectAfterTime), uplink.maxExpiresAt)
+				uplink.expiresAt.Store(expiresAt.UnixNano())
+				if err := uplink.wgConn.SetReadDeadline(expiresAt); err != nil {
+					s.connLogger.Warn("Failed to SetReadDeadline on wgConn",
+						zap.String("server", s.name),
+						zap.String("listenAddress", s.proxyListen),
+						zap.Stringer("clientAddress", uplink.clientAddrPort),
+						zap.Stringer("wgAddress", uplink.upstream),
+						zap.Error(err),
+					)
+				}
+			}
+
+			packetsSent++
+			wgBytesSent += uint64(len(wgPacket))
+			s.uplinkTraffic.add(1, uint64(len(wgPacket)))
+			uplink.tenant.addUplink(1, uint64(len(wgPacket)))
 		}
 
 		s.putPacketBuf(queuedPacket.buf)
-		packetsSent++
-		wgBytesSent += uint64(queuedPacket.length)
 	}
 
 	s.logger.Info("Finished relay proxyConn -> wgConn",
 		zap.String("server", s.name),
 		zap.String("listenAddress", s.proxyListen),
 		zap.Stringer("clientAddress", uplink.clientAddrPort),
-		zap.Stringer("wgAddress", uplink.wgAddrPort),
+		zap.Stringer("wgAddress", uplink.upstream),
 		zap.Uint64("packetsSent", packetsSent),
 		zap.Uint64("wgBytesSent", wgBytesSent),
 	)
@@ -483,22 +1463,32 @@ func (s *server) relayWgToProxyGeneric(downlink serverNatDownlinkGeneric) {
 		wgBytesSent    uint64
 	)
 
-	packetBuf := make([]byte, downlink.maxProxyPacketSize)
+	// Allocate one extra byte to detect oversized packets.
+	packetBuf := make([]byte, downlink.maxProxyPacketSize+1)[:downlink.maxProxyPacketSize]
 
-	headroom := s.handler.Headroom()
-	plaintextBuf := packetBuf[headroom.Front : downlink.maxProxyPacketSize-headroom.Rear]
+	headroom := downlink.handler.Headroom()
+	maxWgPacketLength := downlink.maxProxyPacketSize - headroom.Front - headroom.Rear
+	recvBuf := packetBuf[headroom.Front : headroom.Front+maxWgPacketLength+1]
 
 	for {
-		n, _, flags, packetSourceAddrPort, err := downlink.wgConn.ReadMsgUDPAddrPort(plaintextBuf, nil)
+		n, _, flags, packetSourceAddrPort, err := downlink.wgConn.ReadMsgUDPAddrPort(recvBuf, nil)
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
+				s.countSessionLifetimeEviction(downlink.clientAddrPort, downlink.maxExpiresAt)
 				break
 			}
-			s.logger.Warn("Failed to read from wgConn",
+			if isUpstreamUnreachable(err) {
+				if s.handleUpstreamUnreachable(downlink.wgConn, downlink.clientAddrPort, downlink.upstream.AddrPort(), err) {
+					break
+				}
+				continue
+			}
+			s.drainWgConnErrorQueue(downlink.wgConn, downlink.clientAddrPort, downlink.upstream.AddrPort())
+			s.connLogger.Warn("Failed to read from wgConn",
 				zap.String("server", s.name),
 				zap.String("listenAddress", s.proxyListen),
 				zap.Stringer("clientAddress", downlink.clientAddrPort),
-				zap.Stringer("wgAddress", downlink.wgAddrPort),
+				zap.Stringer("wgAddress", downlink.upstream),
 				zap.Stringer("packetSourceAddress", packetSourceAddrPort),
 				zap.Int("packetLength", n),
 				zap.Error(err),
@@ -507,37 +1497,52 @@ func (s *server) relayWgToProxyGeneric(downlink serverNatDownlinkGeneric) {
 		}
 		err = conn.ParseFlagsForError(flags)
 		if err != nil {
-			s.logger.Warn("Failed to read from wgConn",
+			s.connLogger.Warn("Failed to read from wgConn",
 				zap.String("server", s.name),
 				zap.String("listenAddress", s.proxyListen),
 				zap.Stringer("clientAddress", downlink.clientAddrPort),
-				zap.Stringer("wgAddress", downlink.wgAddrPort),
+				zap.Stringer("wgAddress", downlink.upstream),
 				zap.Stringer("packetSourceAddress", packetSourceAddrPort),
 				zap.Int("packetLength", n),
 				zap.Error(err),
 			)
 			continue
 		}
-		if !conn.AddrPortMappedEqual(packetSourceAddrPort, downlink.wgAddrPort) {
+		if !downlink.upstream.Accepts(packetSourceAddrPort) {
 			s.logger.Warn("Ignoring packet from non-wg address",
 				zap.String("server", s.name),
 				zap.String("listenAddress", s.proxyListen),
 				zap.Stringer("clientAddress", downlink.clientAddrPort),
-				zap.Stringer("wgAddress", downlink.wgAddrPort),
+				zap.Stringer("wgAddress", downlink.upstream),
 				zap.Stringer("packetSourceAddress", packetSourceAddrPort),
 				zap.Int("packetLength", n),
 				zap.Error(err),
 			)
 			continue
 		}
+		if n > maxWgPacketLength {
+			s.oversizedPackets.Add(1)
+			s.logLimiter.Warn(s.logger, "Dropping oversized packet from wgConn", downlink.clientAddrPort,
+				zap.String("server", s.name),
+				zap.String("listenAddress", s.proxyListen),
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.Stringer("wgAddress", downlink.upstream),
+				zap.Int("maxPacketLength", maxWgPacketLength),
+			)
+			continue
+		}
 
-		swgpPacketStart, swgpPacketLength, err := s.handler.EncryptZeroCopy(packetBuf, headroom.Front, n)
+		if rtt, ok := downlink.handshakeTimer.Received(packetBuf[headroom.Front : headroom.Front+n]); ok {
+			s.handshakeRTT.Update(rtt)
+		}
+
+		swgpPacketStart, swgpPacketLength, err := downlink.handler.EncryptZeroCopy(packetBuf, headroom.Front, n)
 		if err != nil {
-			s.logger.Warn("Failed to encrypt WireGuard packet",
+			s.packetLogger.Warn("Failed to encrypt WireGuard packet",
 				zap.String("server", s.name),
 				zap.String("listenAddress", s.proxyListen),
 				zap.Stringer("clientAddress", downlink.clientAddrPort),
-				zap.Stringer("wgAddress", downlink.wgAddrPort),
+				zap.Stringer("wgAddress", downlink.upstream),
 				zap.Error(err),
 			)
 			continue
@@ -549,34 +1554,54 @@ func (s *server) relayWgToProxyGeneric(downlink serverNatDownlinkGeneric) {
 			clientPktinfop = cpp
 		}
 
-		_, _, err = downlink.proxyConn.WriteMsgUDPAddrPort(swgpPacket, clientPktinfo, downlink.clientAddrPort)
+		if !s.egressShaper.Wait(swgpPacketLength) {
+			if ce := s.logger.Check(zap.DebugLevel, "swgpPacket dropped due to full egress queue"); ce != nil {
+				ce.Write(
+					zap.String("server", s.name),
+					zap.String("listenAddress", s.proxyListen),
+					zap.Stringer("clientAddress", downlink.clientAddrPort),
+					zap.Stringer("wgAddress", downlink.upstream),
+				)
+			}
+			continue
+		}
+
+		_, _, err = conn.WriteMsgUDPAddrPort(downlink.proxyConn, swgpPacket, clientPktinfo, downlink.clientAddrPort)
 		if err != nil {
-			s.logger.Warn("Failed to write swgpPacket to proxyConn",
+			s.sendErrors.Add(1)
+			s.publishEvent(EventSendError, downlink.clientAddrPort, err)
+			s.logLimiter.Warn(s.connLogger, "Failed to write swgpPacket to proxyConn", downlink.clientAddrPort,
 				zap.String("server", s.name),
 				zap.String("listenAddress", s.proxyListen),
 				zap.Stringer("clientAddress", downlink.clientAddrPort),
-				zap.Stringer("wgAddress", downlink.wgAddrPort),
+				zap.Stringer("wgAddress", downlink.upstream),
 				zap.Error(err),
 			)
 		}
 
 		packetsSent++
 		wgBytesSent += uint64(n)
+		s.downlinkTraffic.add(1, uint64(n))
+		downlink.tenant.addDownlink(1, uint64(n))
 	}
 
 	s.logger.Info("Finished relay wgConn -> proxyConn",
 		zap.String("server", s.name),
 		zap.String("listenAddress", s.proxyListen),
 		zap.Stringer("clientAddress", downlink.clientAddrPort),
-		zap.Stringer("wgAddress", downlink.wgAddrPort),
+		zap.Stringer("wgAddress", downlink.upstream),
 		zap.Uint64("packetsSent", packetsSent),
 		zap.Uint64("wgBytesSent", wgBytesSent),
+		zap.Duration("handshakeRTT", downlink.handshakeTimer.RTT()),
 	)
 }
 
 // getPacketBuf retrieves a packet buffer from the pool.
+//
+// The returned buffer has one extra byte of capacity beyond its length,
+// so receive calls can detect oversized packets.
 func (s *server) getPacketBuf() []byte {
-	return unsafe.Slice(s.packetBufPool.Get().(*byte), s.maxProxyPacketSizev4)
+	return unsafe.Slice(s.packetBufPool.Get(), s.maxProxyPacketSizev4+1)[:s.maxProxyPacketSizev4]
 }
 
 // putPacketBuf puts the packet buffer back into the pool.
@@ -586,7 +1611,15 @@ func (s *server) putPacketBuf(packetBuf []byte) {
 
 // Stop implements the Service Stop method.
 func (s *server) Stop() error {
-	if err := s.proxyConn.SetReadDeadline(conn.ALongTimeAgo); err != nil {
+	// Abort pending wgAddr resolution retries and SRV lookups.
+	s.cancelResolve()
+	s.stopSRVEndpoint()
+
+	if s.proxyListener != nil {
+		if err := s.proxyListener.Close(); err != nil {
+			return err
+		}
+	} else if err := s.proxyConn.SetReadDeadline(conn.ALongTimeAgo); err != nil {
 		return err
 	}
 
@@ -595,27 +1628,114 @@ func (s *server) Stop() error {
 	s.mwg.Wait()
 
 	s.mu.Lock()
-	for clientAddrPort, entry := range s.table {
+	var sessions []sessionStateEntry
+	if s.sessionStateFile != "" {
+		sessions = s.snapshotSessions()
+	}
+	for key, entry := range s.table {
 		wgConn := entry.state.Swap(s.proxyConn)
 		if wgConn == nil {
 			continue
 		}
 
 		if err := wgConn.SetReadDeadline(conn.ALongTimeAgo); err != nil {
-			s.logger.Warn("Failed to SetReadDeadline on wgConn",
+			s.connLogger.Warn("Failed to SetReadDeadline on wgConn",
 				zap.String("server", s.name),
 				zap.String("listenAddress", s.proxyListen),
-				zap.Stringer("clientAddress", clientAddrPort),
-				zap.Stringer("wgAddress", &s.wgAddr),
+				zap.Stringer("clientAddress", key.clientAddrPort),
+				zap.Stringer("wgAddress", &entry.wgAddr),
 				zap.Error(err),
 			)
 		}
 	}
+	s.stopped = true
+	s.closeTCPSessions()
 	s.mu.Unlock()
 
 	// Wait for all relay goroutines to exit before closing proxyConn,
 	// so in-flight packets can be written out.
 	s.wg.Wait()
+	s.mirror.Stop()
+	s.packetBufPool.Drain()
+	s.logLimiter.Stop()
+
+	if s.sessionStateFile != "" {
+		s.saveSessionState(sessions)
+	}
+
+	if oversizedPackets := s.oversizedPackets.Load(); oversizedPackets > 0 {
+		s.logger.Info("Dropped oversized packets",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Uint64("oversizedPackets", oversizedPackets),
+		)
+	}
 
+	if malformedPackets := s.malformedPackets.Load(); malformedPackets > 0 {
+		s.logger.Info("Dropped malformed packets",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Uint64("malformedPackets", malformedPackets),
+		)
+	}
+
+	if s.egressShaper != nil {
+		s.logger.Info("Stopped egress shaper",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Uint64("packetsDropped", s.egressShaper.Dropped()),
+		)
+	}
+
+	s.stopDecoys()
+
+	if s.proxyListener != nil {
+		return nil
+	}
 	return s.proxyConn.Close()
 }
+
+// Stats implements the Service Stats method.
+func (s *server) Stats() Stats {
+	s.mu.Lock()
+	sessions := len(s.table) + len(s.tcpTable)
+	s.mu.Unlock()
+
+	return Stats{
+		Sessions:            sessions,
+		UplinkPackets:       s.uplinkTraffic.packets.Load(),
+		UplinkBytes:         s.uplinkTraffic.bytes.Load(),
+		DownlinkPackets:     s.downlinkTraffic.packets.Load(),
+		DownlinkBytes:       s.downlinkTraffic.bytes.Load(),
+		OversizedPackets:    s.oversizedPackets.Load(),
+		MalformedPackets:    s.malformedPackets.Load(),
+		PortsExhausted:      s.portsExhausted.Load(),
+		LifetimeEvictions:   s.lifetimeEvictions.Load(),
+		UpstreamUnreachable: s.upstreamUnreachable.Load(),
+		QuiescedPackets:     s.quiescedPackets.Load(),
+		DecryptFailures:     s.decryptFailures.Load(),
+		SendErrors:          s.sendErrors.Load(),
+		QueueFullPackets:    s.queueFullPackets.Load(),
+		EgressShaperDropped: s.egressShaper.Dropped(),
+		HandshakesLimited:   s.handshakeLimiter.Dropped(),
+		DecryptBudgetShed:   s.decryptBudget.Shed(),
+		ReceiveDrops:        s.receiveDrops.Load(),
+		CookieChallenges:    s.cookieChallenges.Load(),
+		InvalidCookies:      s.invalidCookies.Load(),
+		SessionRateDropped:  s.sessionRateDropped.Load(),
+		ExpiredKeyPackets:   s.expiredKeyPackets.Load(),
+		SessionlessData:     s.sessionlessData.Load(),
+		SessionlessDropped:  s.sessionlessDropped.Load(),
+		BackoffDropped:      s.backoffDropped.Load(),
+		Panics:              s.panicRecoverer.Panics(),
+		SessionRates:        s.sessionRates(),
+		Tenants:             s.tenantStats(),
+		HandshakeRTT:        s.handshakeRTT.Load(),
+		DecoyPackets:        s.decoys.Packets(),
+		DecoyBytes:          s.decoys.Bytes(),
+		MirroredPackets:     s.mirror.Mirrored(),
+		MirrorDropped:       s.mirror.Dropped(),
+		BundlesSent:         s.bundlesSent.Load(),
+		BundledPackets:      s.bundledPackets.Load(),
+	}
+}
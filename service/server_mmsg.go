@@ -20,19 +20,27 @@ import (
 
 type serverNatUplinkMmsg struct {
 	clientAddrPort netip.AddrPort
-	wgAddrPort     netip.AddrPort
+	upstream       *sessionUpstream
+	tenant         *tenantCounters
 	wgConn         *conn.MmsgWConn
 	wgConnSendCh   <-chan queuedPacket
+	handshakeTimer *handshakeTimer
+	expiresAt      *atomic.Int64
+	maxExpiresAt   time.Time
 }
 
 type serverNatDownlinkMmsg struct {
 	clientAddrPort     netip.AddrPort
 	clientPktinfop     *[]byte
 	clientPktinfo      *atomic.Pointer[[]byte]
-	wgAddrPort         netip.AddrPort
+	upstream           *sessionUpstream
+	tenant             *tenantCounters
 	wgConn             *conn.MmsgRConn
 	proxyConn          *conn.MmsgWConn
 	maxProxyPacketSize int
+	handshakeTimer     *handshakeTimer
+	handler            packet.Handler
+	maxExpiresAt       time.Time
 }
 
 func (s *server) setStartFunc(batchMode string) {
@@ -45,30 +53,44 @@ func (s *server) setStartFunc(batchMode string) {
 }
 
 func (s *server) startMmsg(ctx context.Context) error {
-	proxyConn, err := s.proxyConnListenConfig.ListenUDPRawConn(ctx, "udp", s.proxyListen)
+	udpConn, err := s.inherited.listenUDP(ctx, &s.proxyConnListenConfig, s.network, s.proxyListen)
 	if err != nil {
 		return err
 	}
+	proxyConn, err := conn.NewRawUDPConn(udpConn)
+	if err != nil {
+		udpConn.Close()
+		return err
+	}
 	s.proxyConn = proxyConn.UDPConn
 
+	s.restoreSessions(func(key serverSessionKey, entry *sessionStateEntry, natEntry *serverNatEntry, wgConnSendCh chan queuedPacket) {
+		go s.relaySessionMmsg(ctx, proxyConn.WConn(), key, natEntry, natEntry.clientPktinfo.Load(), wgConnSendCh, entry)
+	})
+
 	s.mwg.Add(1)
 
 	go func() {
-		s.recvFromProxyConnRecvmmsg(ctx, proxyConn.RConn())
+		s.panicRecoverer.run(func() {
+			s.recvFromProxyConnRecvmmsg(ctx, proxyConn.RConn())
+		}, s.releaseTableAfterPanic)
 		s.mwg.Done()
 	}()
 
 	s.logger.Info("Started service",
 		zap.String("server", s.name),
 		zap.String("listenAddress", s.proxyListen),
-		zap.Stringer("wgAddress", &s.wgAddr),
+		zap.Stringer("wgAddress", s.wgAddr.Load()),
 		zap.Int("wgTunnelMTUv4", s.wgTunnelMTUv4),
 		zap.Int("wgTunnelMTUv6", s.wgTunnelMTUv6),
+		zap.Int("mainRecvBatchSize", s.mainRecvBatchSize),
 	)
 	return nil
 }
 
 func (s *server) recvFromProxyConnRecvmmsg(ctx context.Context, proxyConn *conn.MmsgRConn) {
+	s.pinWorkerThread()
+
 	n := s.mainRecvBatchSize
 	bufvec := make([][]byte, n)
 	namevec := make([]unix.RawSockaddrInet6, n)
@@ -92,6 +114,9 @@ func (s *server) recvFromProxyConnRecvmmsg(ctx context.Context, proxyConn *conn.
 		packetsReceived uint64
 		wgBytesReceived uint64
 		burstBatchSize  int
+
+		// replies are sent after the session table is unlocked.
+		replies []proxyReply
 	)
 
 	for {
@@ -99,7 +124,7 @@ func (s *server) recvFromProxyConnRecvmmsg(ctx context.Context, proxyConn *conn.
 			packetBuf := s.getPacketBuf()
 			bufvec[i] = packetBuf
 			iovec[i].Base = &packetBuf[0]
-			iovec[i].SetLen(len(packetBuf))
+			iovec[i].SetLen(len(packetBuf) + 1)
 			msgvec[i].Msghdr.SetControllen(conn.SocketControlMessageBufferSize)
 		}
 
@@ -108,7 +133,7 @@ func (s *server) recvFromProxyConnRecvmmsg(ctx context.Context, proxyConn *conn.
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				break
 			}
-			s.logger.Warn("Failed to read from proxyConn",
+			s.connLogger.Warn("Failed to read from proxyConn",
 				zap.String("server", s.name),
 				zap.String("listenAddress", s.proxyListen),
 				zap.Error(err),
@@ -124,7 +149,7 @@ func (s *server) recvFromProxyConnRecvmmsg(ctx context.Context, proxyConn *conn.
 			burstBatchSize = n
 		}
 
-		s.mu.Lock()
+		s.lockTable()
 
 		msgvecn := msgvec[:n]
 
@@ -133,7 +158,7 @@ func (s *server) recvFromProxyConnRecvmmsg(ctx context.Context, proxyConn *conn.
 			packetBuf := bufvec[i]
 
 			if msg.Msghdr.Controllen == 0 {
-				s.logger.Warn("Skipping packet with no control message from proxyConn",
+				s.connLogger.Warn("Skipping packet with no control message from proxyConn",
 					zap.String("server", s.name),
 					zap.String("listenAddress", s.proxyListen),
 				)
@@ -143,7 +168,7 @@ func (s *server) recvFromProxyConnRecvmmsg(ctx context.Context, proxyConn *conn.
 
 			clientAddrPort, err := conn.SockaddrToAddrPort(msg.Msghdr.Name, msg.Msghdr.Namelen)
 			if err != nil {
-				s.logger.Warn("Failed to parse sockaddr of packet from proxyConn",
+				s.connLogger.Warn("Failed to parse sockaddr of packet from proxyConn",
 					zap.String("server", s.name),
 					zap.String("listenAddress", s.proxyListen),
 					zap.Error(err),
@@ -152,9 +177,21 @@ func (s *server) recvFromProxyConnRecvmmsg(ctx context.Context, proxyConn *conn.
 				continue
 			}
 
+			if int(msg.Msglen) > len(packetBuf) {
+				s.oversizedPackets.Add(1)
+				s.logLimiter.Warn(s.logger, "Dropping oversized packet from proxyConn", clientAddrPort,
+					zap.String("server", s.name),
+					zap.String("listenAddress", s.proxyListen),
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Int("maxPacketLength", len(packetBuf)),
+				)
+				s.putPacketBuf(packetBuf)
+				continue
+			}
+
 			err = conn.ParseFlagsForError(int(msg.Msghdr.Flags))
 			if err != nil {
-				s.logger.Warn("Failed to read from proxyConn",
+				s.connLogger.Warn("Failed to read from proxyConn",
 					zap.String("server", s.name),
 					zap.String("listenAddress", s.proxyListen),
 					zap.Stringer("clientAddress", clientAddrPort),
@@ -165,9 +202,22 @@ func (s *server) recvFromProxyConnRecvmmsg(ctx context.Context, proxyConn *conn.
 				continue
 			}
 
+			keyID := s.packetKeyID(packetBuf[:msg.Msglen])
+			if !s.acceptKeyID(keyID, clientAddrPort) {
+				s.putPacketBuf(packetBuf)
+				continue
+			}
+
+			if !s.decryptBudget.Allow() {
+				s.putPacketBuf(packetBuf)
+				continue
+			}
+
 			wgPacketStart, wgPacketLength, err := s.handler.DecryptZeroCopy(packetBuf, 0, int(msg.Msglen))
 			if err != nil {
-				s.logger.Warn("Failed to decrypt swgpPacket",
+				s.decryptFailures.Add(1)
+				s.publishEvent(EventDecryptFailure, clientAddrPort, err)
+				s.logLimiter.Warn(s.packetLogger, "Failed to decrypt swgpPacket", clientAddrPort,
 					zap.String("server", s.name),
 					zap.String("listenAddress", s.proxyListen),
 					zap.Stringer("clientAddress", clientAddrPort),
@@ -178,27 +228,91 @@ func (s *server) recvFromProxyConnRecvmmsg(ctx context.Context, proxyConn *conn.
 				continue
 			}
 
+			if err = packet.CheckWireGuardPacket(packetBuf[wgPacketStart : wgPacketStart+wgPacketLength]); err != nil {
+				s.malformedPackets.Add(1)
+				s.logLimiter.Warn(s.packetLogger, "Dropping malformed WireGuard packet", clientAddrPort,
+					zap.String("server", s.name),
+					zap.String("listenAddress", s.proxyListen),
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Int("packetLength", wgPacketLength),
+					zap.Error(err),
+				)
+				s.putPacketBuf(packetBuf)
+				continue
+			}
+
+			if s.quiesced.Load() {
+				s.quiescedPackets.Add(1)
+				s.putPacketBuf(packetBuf)
+				continue
+			}
+
 			wgBytesReceived += uint64(wgPacketLength)
 
-			natEntry, ok := s.table[clientAddrPort]
+			cmsg := s.stripReceiveDrops(cmsgvec[i][:msg.Msghdr.Controllen])
+
+			var origDstAddrPort netip.AddrPort
+			if s.transparent {
+				var ok bool
+				cmsg, origDstAddrPort, ok = s.parseTransparentCmsg(cmsg, clientAddrPort)
+				if !ok {
+					s.putPacketBuf(packetBuf)
+					continue
+				}
+			}
+
+			if wgPacket := packetBuf[wgPacketStart : wgPacketStart+wgPacketLength]; packet.IsMTUProbe(wgPacket) {
+				if reply := s.newMTUProbeAck(wgPacket, int(msg.Msglen), clientAddrPort, cmsg, s.sessionHandler(keyID)); reply.packetBuf != nil {
+					replies = append(replies, reply)
+				}
+				s.putPacketBuf(packetBuf)
+				continue
+			}
+
+			key, wgAddr := s.sessionKey(clientAddrPort, origDstAddrPort, keyID)
+			natEntry, ok := s.table[key]
+
+			if s.cookieGenerator != nil {
+				var (
+					pass  bool
+					reply proxyReply
+				)
+				wgPacketStart, wgPacketLength, pass, reply = s.checkCookieGate(packetBuf, wgPacketStart, wgPacketLength, int(msg.Msglen), clientAddrPort, cmsg, s.sessionHandler(keyID), ok)
+				if !pass {
+					if reply.packetBuf != nil {
+						replies = append(replies, reply)
+					}
+					s.putPacketBuf(packetBuf)
+					continue
+				}
+			}
+
+			if !s.handshakeLimiter.Allow(packetBuf[wgPacketStart : wgPacketStart+wgPacketLength]) {
+				s.putPacketBuf(packetBuf)
+				continue
+			}
+
 			if !ok {
-				natEntry = &serverNatEntry{}
+				if !s.allowNewSession(packetBuf[wgPacketStart:wgPacketStart+wgPacketLength], clientAddrPort) {
+					s.putPacketBuf(packetBuf)
+					continue
+				}
+				natEntry = s.newServerNatEntry(wgAddr, keyID, clientAddrPort)
 			}
 
 			var clientPktinfop *[]byte
-			cmsg := cmsgvec[i][:msg.Msghdr.Controllen]
 
 			if !bytes.Equal(natEntry.clientPktinfoCache, cmsg) {
 				clientPktinfoAddr, clientPktinfoIfindex, err := conn.ParsePktinfoCmsg(cmsg)
 				if err != nil {
-					s.logger.Warn("Failed to parse pktinfo control message from proxyConn",
+					s.connLogger.Warn("Failed to parse pktinfo control message from proxyConn",
 						zap.String("server", s.name),
 						zap.String("listenAddress", s.proxyListen),
 						zap.Stringer("clientAddress", clientAddrPort),
 						zap.Error(err),
 					)
 					s.putPacketBuf(packetBuf)
-					s.mu.Unlock()
+					s.unlockTable()
 					continue
 				}
 
@@ -222,141 +336,59 @@ func (s *server) recvFromProxyConnRecvmmsg(ctx context.Context, proxyConn *conn.
 			if !ok {
 				wgConnSendCh := make(chan queuedPacket, s.sendChannelCapacity)
 				natEntry.wgConnSendCh = wgConnSendCh
-				s.table[clientAddrPort] = natEntry
+				s.table[key] = natEntry
 				s.wg.Add(1)
 
-				go func() {
-					var sendChClean bool
-
-					defer func() {
-						s.mu.Lock()
-						close(wgConnSendCh)
-						delete(s.table, clientAddrPort)
-						s.mu.Unlock()
-
-						if !sendChClean {
-							for queuedPacket := range wgConnSendCh {
-								s.putPacketBuf(queuedPacket.buf)
-							}
-						}
-
-						s.wg.Done()
-					}()
-
-					wgAddrPort, err := s.wgAddr.ResolveIPPort(ctx)
-					if err != nil {
-						s.logger.Warn("Failed to resolve wgAddr",
-							zap.String("server", s.name),
-							zap.String("listenAddress", s.proxyListen),
-							zap.Stringer("clientAddress", clientAddrPort),
-							zap.Error(err),
-						)
-						return
-					}
-
-					wgConn, err := s.wgConnListenConfig.ListenUDPRawConn(ctx, "udp", "")
-					if err != nil {
-						s.logger.Warn("Failed to create UDP socket for new session",
-							zap.String("server", s.name),
-							zap.String("listenAddress", s.proxyListen),
-							zap.Stringer("clientAddress", clientAddrPort),
-							zap.Error(err),
-						)
-						return
-					}
-
-					err = wgConn.SetReadDeadline(time.Now().Add(RejectAfterTime))
-					if err != nil {
-						s.logger.Warn("Failed to SetReadDeadline on wgConn",
-							zap.String("server", s.name),
-							zap.String("listenAddress", s.proxyListen),
-							zap.Stringer("clientAddress", clientAddrPort),
-							zap.Error(err),
-						)
-						wgConn.Close()
-						return
-					}
-
-					oldState := natEntry.state.Swap(wgConn.UDPConn)
-					if oldState != nil {
-						wgConn.Close()
-						return
-					}
-
-					// No more early returns!
-					sendChClean = true
-
-					var (
-						maxProxyPacketSize int
-						wgTunnelMTU        int
-					)
-
-					if addr := clientAddrPort.Addr(); addr.Is4() || addr.Is4In6() {
-						maxProxyPacketSize = s.maxProxyPacketSizev4
-						wgTunnelMTU = s.wgTunnelMTUv4
-					} else {
-						maxProxyPacketSize = s.maxProxyPacketSizev6
-						wgTunnelMTU = s.wgTunnelMTUv6
-					}
-
-					s.logger.Info("Server relay started",
-						zap.String("server", s.name),
-						zap.String("listenAddress", s.proxyListen),
-						zap.Stringer("clientAddress", clientAddrPort),
-						zap.Stringer("wgAddress", wgAddrPort),
-						zap.Int("wgTunnelMTU", wgTunnelMTU),
-					)
-
-					s.wg.Add(1)
-
-					go func() {
-						s.relayProxyToWgSendmmsg(serverNatUplinkMmsg{
-							clientAddrPort: clientAddrPort,
-							wgAddrPort:     wgAddrPort,
-							wgConn:         wgConn.WConn(),
-							wgConnSendCh:   wgConnSendCh,
-						})
-						wgConn.Close()
-						s.wg.Done()
-					}()
-
-					s.relayWgToProxySendmmsg(serverNatDownlinkMmsg{
-						clientAddrPort:     clientAddrPort,
-						clientPktinfop:     clientPktinfop,
-						clientPktinfo:      &natEntry.clientPktinfo,
-						wgAddrPort:         wgAddrPort,
-						wgConn:             wgConn.RConn(),
-						proxyConn:          proxyConn.WConn(),
-						maxProxyPacketSize: maxProxyPacketSize,
-					})
-				}()
+				go s.relaySessionMmsg(ctx, proxyConn.WConn(), key, natEntry, clientPktinfop, wgConnSendCh, nil)
 
 				if ce := s.logger.Check(zap.DebugLevel, "New server session"); ce != nil {
 					ce.Write(
 						zap.String("server", s.name),
 						zap.String("listenAddress", s.proxyListen),
 						zap.Stringer("clientAddress", clientAddrPort),
-						zap.Stringer("wgAddress", &s.wgAddr),
+						zap.Stringer("wgAddress", &natEntry.wgAddr),
 					)
 				}
+
+				if s.transparent {
+					s.logTransparentSession(clientAddrPort, origDstAddrPort, &natEntry.wgAddr)
+				}
+			}
+
+			if !natEntry.rateLimiter.Allow(wgPacketLength) {
+				s.countSessionRateDropped(clientAddrPort, natEntry)
+				s.putPacketBuf(packetBuf)
+				continue
+			}
+
+			if ok && !s.admitDuringBackoff(natEntry, clientAddrPort) {
+				s.putPacketBuf(packetBuf)
+				continue
 			}
 
 			select {
 			case natEntry.wgConnSendCh <- queuedPacket{packetBuf, wgPacketStart, wgPacketLength}:
 			default:
+				s.queueFullPackets.Add(1)
 				if ce := s.logger.Check(zap.DebugLevel, "wgPacket dropped due to full send channel"); ce != nil {
 					ce.Write(
 						zap.String("server", s.name),
 						zap.String("listenAddress", s.proxyListen),
 						zap.Stringer("clientAddress", clientAddrPort),
-						zap.Stringer("wgAddress", &s.wgAddr),
+						zap.Stringer("wgAddress", &natEntry.wgAddr),
 					)
 				}
 				s.putPacketBuf(packetBuf)
 			}
 		}
 
-		s.mu.Unlock()
+		s.unlockTable()
+
+		for i := range replies {
+			s.sendProxyReply(&replies[i])
+			replies[i] = proxyReply{}
+		}
+		replies = replies[:0]
 	}
 
 	for i := range bufvec {
@@ -366,7 +398,7 @@ func (s *server) recvFromProxyConnRecvmmsg(ctx context.Context, proxyConn *conn.
 	s.logger.Info("Finished receiving from proxyConn",
 		zap.String("server", s.name),
 		zap.String("listenAddress", s.proxyListen),
-		zap.Stringer("wgAddress", &s.wgAddr),
+		zap.Stringer("wgAddress", s.wgAddr.Load()),
 		zap.Uint64("recvmmsgCount", recvmmsgCount),
 		zap.Uint64("packetsReceived", packetsReceived),
 		zap.Uint64("wgBytesReceived", wgBytesReceived),
@@ -374,6 +406,159 @@ func (s *server) recvFromProxyConnRecvmmsg(ctx context.Context, proxyConn *conn.
 	)
 }
 
+// relaySessionMmsg is like [server.relaySessionGeneric], but relays packets using sendmmsg(2) and recvmmsg(2).
+func (s *server) relaySessionMmsg(ctx context.Context, proxyConn *conn.MmsgWConn, key serverSessionKey, natEntry *serverNatEntry, clientPktinfop *[]byte, wgConnSendCh chan queuedPacket, restored *sessionStateEntry) {
+	clientAddrPort := key.clientAddrPort
+	var sendChClean bool
+
+	defer func() {
+		s.mu.Lock()
+		close(wgConnSendCh)
+		delete(s.table, key)
+		s.mu.Unlock()
+
+		if sendChClean {
+			s.publishEvent(EventSessionEvicted, clientAddrPort, nil)
+		} else {
+			for queuedPacket := range wgConnSendCh {
+				s.putPacketBuf(queuedPacket.buf)
+			}
+		}
+
+		s.wg.Done()
+	}()
+
+	wgAddrPort, err := s.resolveWgAddrPort(&natEntry.wgAddr, clientAddrPort, &natEntry.backingOff)
+	if err != nil {
+		s.connLogger.Warn("Failed to resolve wgAddr",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		return
+	}
+	natEntry.upstream.init(natEntry.wgAddr, wgAddrPort)
+
+	var wgConnPort uint16
+	expiresAt := time.Now().Add(RejectAfterTime)
+	if restored != nil {
+		wgConnPort = restored.WgConnPort
+		expiresAt = restored.ExpiresAt
+	}
+	maxExpiresAt := s.sessionMaxExpiresAt(natEntry.createdAt)
+	expiresAt = clampSessionExpiresAt(expiresAt, maxExpiresAt)
+
+	udpConn, err := s.listenWgConn(ctx, wgConnPort)
+	if restored != nil && conn.IsAddrInUse(err) {
+		udpConn, err = s.retryListenRestoredWgConn(ctx, clientAddrPort, wgConnPort, err)
+	}
+	if err != nil {
+		s.connLogger.Warn("Failed to create UDP socket for new session",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		return
+	}
+
+	wgConn, err := conn.NewRawUDPConn(udpConn)
+	if err != nil {
+		s.connLogger.Warn("Failed to get raw conn for new session",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		udpConn.Close()
+		return
+	}
+
+	err = wgConn.SetReadDeadline(expiresAt)
+	if err != nil {
+		s.connLogger.Warn("Failed to SetReadDeadline on wgConn",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		wgConn.Close()
+		return
+	}
+
+	oldState := natEntry.state.Swap(wgConn.UDPConn)
+	if oldState != nil {
+		wgConn.Close()
+		return
+	}
+
+	// No more early returns!
+	sendChClean = true
+	natEntry.expiresAt.Store(expiresAt.UnixNano())
+
+	var (
+		maxProxyPacketSize int
+		wgTunnelMTU        int
+	)
+
+	if addr := clientAddrPort.Addr(); addr.Is4() || addr.Is4In6() {
+		maxProxyPacketSize = s.maxProxyPacketSizev4
+		wgTunnelMTU = s.wgTunnelMTUv4
+	} else {
+		maxProxyPacketSize = s.maxProxyPacketSizev6
+		wgTunnelMTU = s.wgTunnelMTUv6
+	}
+
+	s.publishEvent(EventSessionCreated, clientAddrPort, nil)
+
+	s.logger.Info("Server relay started",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.Stringer("clientAddress", clientAddrPort),
+		zap.Stringer("wgAddress", wgAddrPort),
+		zap.Int("wgTunnelMTU", wgTunnelMTU),
+	)
+
+	s.wg.Add(1)
+
+	go func() {
+		s.panicRecoverer.runSession(clientAddrPort, func() {
+			s.relayProxyToWgSendmmsg(serverNatUplinkMmsg{
+				clientAddrPort: clientAddrPort,
+				upstream:       &natEntry.upstream,
+				tenant:         natEntry.tenant,
+				wgConn:         wgConn.WConn(),
+				wgConnSendCh:   wgConnSendCh,
+				handshakeTimer: &natEntry.handshakeTimer,
+				expiresAt:      &natEntry.expiresAt,
+				maxExpiresAt:   maxExpiresAt,
+			})
+		}, func() {
+			s.stopSessionAfterUplinkPanic(wgConn.UDPConn, wgConnSendCh)
+		})
+		wgConn.Close()
+		s.wg.Done()
+	}()
+
+	// The deferred cleanup ends the session if the downlink panics.
+	s.panicRecoverer.runSession(clientAddrPort, func() {
+		s.relayWgToProxySendmmsg(serverNatDownlinkMmsg{
+			clientAddrPort:     clientAddrPort,
+			clientPktinfop:     clientPktinfop,
+			clientPktinfo:      &natEntry.clientPktinfo,
+			upstream:           &natEntry.upstream,
+			tenant:             natEntry.tenant,
+			wgConn:             wgConn.RConn(),
+			proxyConn:          proxyConn.WConn(),
+			maxProxyPacketSize: maxProxyPacketSize,
+			handshakeTimer:     &natEntry.handshakeTimer,
+			handler:            natEntry.handler,
+			maxExpiresAt:       maxExpiresAt,
+		})
+	}, nil)
+}
+
 func (s *server) relayProxyToWgSendmmsg(uplink serverNatUplinkMmsg) {
 	var (
 		sendmmsgCount  uint64
@@ -382,10 +567,14 @@ func (s *server) relayProxyToWgSendmmsg(uplink serverNatUplinkMmsg) {
 		burstBatchSize int
 	)
 
-	rsa6 := conn.AddrPortToSockaddrInet6(uplink.wgAddrPort)
+	rsaAddrPort := uplink.upstream.AddrPort()
+	rsa6 := conn.AddrPortToSockaddrInet6(rsaAddrPort)
 	bufvec := make([][]byte, s.relayBatchSize)
-	iovec := make([]unix.Iovec, s.relayBatchSize)
-	msgvec := make([]conn.Mmsghdr, s.relayBatchSize)
+
+	// A bundle dequeued into the last slot of a batch may carry up to MaxBundlePackets packets.
+	iovec := make([]unix.Iovec, s.relayBatchSize+packet.MaxBundlePackets-1)
+	msgvec := make([]conn.Mmsghdr, s.relayBatchSize+packet.MaxBundlePackets-1)
+	var wgPackets [][]byte
 
 	for i := range msgvec {
 		msgvec[i].Msghdr.Name = (*byte)(unsafe.Pointer(&rsa6))
@@ -396,8 +585,10 @@ func (s *server) relayProxyToWgSendmmsg(uplink serverNatUplinkMmsg) {
 
 	for {
 		var (
-			count       int
-			isHandshake bool
+			count        int
+			bufCount     int
+			isHandshake  bool
+			batchWgBytes uint64
 		)
 
 		// Block on first dequeue op.
@@ -408,19 +599,29 @@ func (s *server) relayProxyToWgSendmmsg(uplink serverNatUplinkMmsg) {
 
 	dequeue:
 		for {
-			// Update wgConn read deadline when a handshake initiation/response message is received.
-			switch dequeuedPacket.buf[dequeuedPacket.start] {
-			case packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageTypeHandshakeResponse:
-				isHandshake = true
-			}
+			bufvec[bufCount] = dequeuedPacket.buf
+			bufCount++
+
+			// A bundle is relayed as the packets it carries.
+			wgPackets = unbundle(wgPackets, dequeuedPacket.buf[dequeuedPacket.start:dequeuedPacket.start+dequeuedPacket.length])
+
+			for _, wgPacket := range wgPackets {
+				uplink.handshakeTimer.Sent(wgPacket)
+				s.mirror.Mirror(wgPacket)
 
-			bufvec[count] = dequeuedPacket.buf
-			iovec[count].Base = &dequeuedPacket.buf[dequeuedPacket.start]
-			iovec[count].SetLen(dequeuedPacket.length)
-			count++
-			wgBytesSent += uint64(dequeuedPacket.length)
+				// Update wgConn read deadline when a handshake initiation/response message is received.
+				switch wgPacket[0] {
+				case packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageTypeHandshakeResponse:
+					isHandshake = true
+				}
+
+				iovec[count].Base = &wgPacket[0]
+				iovec[count].SetLen(len(wgPacket))
+				count++
+				batchWgBytes += uint64(len(wgPacket))
+			}
 
-			if count == s.relayBatchSize {
+			if count >= s.relayBatchSize {
 				break
 			}
 
@@ -434,23 +635,34 @@ func (s *server) relayProxyToWgSendmmsg(uplink serverNatUplinkMmsg) {
 			}
 		}
 
+		// The session's endpoint may have switched.
+		if wgAddrPort := uplink.upstream.AddrPort(); wgAddrPort != rsaAddrPort {
+			rsaAddrPort = wgAddrPort
+			rsa6 = conn.AddrPortToSockaddrInet6(wgAddrPort)
+		}
+
 		if err := uplink.wgConn.WriteMsgs(msgvec[:count], 0); err != nil {
-			s.logger.Warn("Failed to write wgPacket to wgConn",
+			s.sendErrors.Add(1)
+			s.publishEvent(EventSendError, uplink.clientAddrPort, err)
+			s.drainWgConnErrorQueue(uplink.wgConn.UDPConn, uplink.clientAddrPort, rsaAddrPort)
+			s.logLimiter.Warn(s.connLogger, "Failed to write wgPacket to wgConn", uplink.clientAddrPort,
 				zap.String("server", s.name),
 				zap.String("listenAddress", s.proxyListen),
 				zap.Stringer("clientAddress", uplink.clientAddrPort),
-				zap.Stringer("wgAddress", uplink.wgAddrPort),
+				zap.Stringer("wgAddress", uplink.upstream),
 				zap.Error(err),
 			)
 		}
 
 		if isHandshake {
-			if err := uplink.wgConn.SetReadDeadline(time.Now().Add(RejectAfterTime)); err != nil {
-				s.logger.Warn("Failed to SetReadDeadline on wgConn",
+			expiresAt := clampSessionExpiresAt(time.Now().Add(RejectAfterTime), uplink.maxExpiresAt)
+			uplink.expiresAt.Store(expiresAt.UnixNano())
+			if err := uplink.wgConn.SetReadDeadline(expiresAt); err != nil {
+				s.connLogger.Warn("Failed to SetReadDeadline on wgConn",
 					zap.String("server", s.name),
 					zap.String("listenAddress", s.proxyListen),
 					zap.Stringer("clientAddress", uplink.clientAddrPort),
-					zap.Stringer("wgAddress", uplink.wgAddrPort),
+					zap.Stringer("wgAddress", uplink.upstream),
 					zap.Error(err),
 				)
 			}
@@ -458,11 +670,14 @@ func (s *server) relayProxyToWgSendmmsg(uplink serverNatUplinkMmsg) {
 
 		sendmmsgCount++
 		packetsSent += uint64(count)
+		wgBytesSent += batchWgBytes
+		s.uplinkTraffic.add(uint64(count), batchWgBytes)
+		uplink.tenant.addUplink(uint64(count), batchWgBytes)
 		if burstBatchSize < count {
 			burstBatchSize = count
 		}
 
-		bufvecn := bufvec[:count]
+		bufvecn := bufvec[:bufCount]
 
 		for i := range bufvecn {
 			s.putPacketBuf(bufvecn[i])
@@ -477,7 +692,7 @@ func (s *server) relayProxyToWgSendmmsg(uplink serverNatUplinkMmsg) {
 		zap.String("server", s.name),
 		zap.String("listenAddress", s.proxyListen),
 		zap.Stringer("clientAddress", uplink.clientAddrPort),
-		zap.Stringer("wgAddress", uplink.wgAddrPort),
+		zap.Stringer("wgAddress", uplink.upstream),
 		zap.Uint64("sendmmsgCount", sendmmsgCount),
 		zap.Uint64("packetsSent", packetsSent),
 		zap.Uint64("wgBytesSent", wgBytesSent),
@@ -493,11 +708,15 @@ func (s *server) relayWgToProxySendmmsg(downlink serverNatDownlinkMmsg) {
 		burstBatchSize int
 	)
 
+	// A restored session may have no pktinfo of the client, until the client sends a packet.
 	clientPktinfop := downlink.clientPktinfop
-	clientPktinfo := *clientPktinfop
+	var clientPktinfo []byte
+	if clientPktinfop != nil {
+		clientPktinfo = *clientPktinfop
+	}
 
 	name, namelen := conn.AddrPortToSockaddr(downlink.clientAddrPort)
-	headroom := s.handler.Headroom()
+	headroom := downlink.handler.Headroom()
 	plaintextLen := downlink.maxProxyPacketSize - headroom.Front - headroom.Rear
 
 	savec := make([]unix.RawSockaddrInet6, s.relayBatchSize)
@@ -507,11 +726,18 @@ func (s *server) relayWgToProxySendmmsg(downlink serverNatDownlinkMmsg) {
 	rmsgvec := make([]conn.Mmsghdr, s.relayBatchSize)
 	smsgvec := make([]conn.Mmsghdr, s.relayBatchSize)
 
+	// sendAtvec holds the start of each message's transmission slot, when the egress shaper is enabled.
+	var sendAtvec []time.Time
+	if s.egressShaper != nil {
+		sendAtvec = make([]time.Time, s.relayBatchSize)
+	}
+
 	for i := 0; i < s.relayBatchSize; i++ {
-		bufvec[i] = make([]byte, downlink.maxProxyPacketSize)
+		// Allocate one extra byte to detect oversized packets.
+		bufvec[i] = make([]byte, downlink.maxProxyPacketSize+1)[:downlink.maxProxyPacketSize]
 
 		riovec[i].Base = &bufvec[i][headroom.Front]
-		riovec[i].SetLen(plaintextLen)
+		riovec[i].SetLen(plaintextLen + 1)
 
 		rmsgvec[i].Msghdr.Name = (*byte)(unsafe.Pointer(&savec[i]))
 		rmsgvec[i].Msghdr.Namelen = unix.SizeofSockaddrInet6
@@ -522,27 +748,90 @@ func (s *server) relayWgToProxySendmmsg(downlink serverNatDownlinkMmsg) {
 		smsgvec[i].Msghdr.Namelen = namelen
 		smsgvec[i].Msghdr.Iov = &siovec[i]
 		smsgvec[i].Msghdr.SetIovlen(1)
-		smsgvec[i].Msghdr.Control = &clientPktinfo[0]
-		smsgvec[i].Msghdr.SetControllen(len(clientPktinfo))
+		if len(clientPktinfo) > 0 {
+			smsgvec[i].Msghdr.Control = &clientPktinfo[0]
+			smsgvec[i].Msghdr.SetControllen(len(clientPktinfo))
+		}
+	}
+
+	var (
+		ns           int
+		batchPackets int
+		batchWgBytes uint64
+		bundle       packetBundle
+	)
+	tailroom := bundleTailroom(downlink.handler)
+
+	// send encrypts the packet or bundle at buf[start:start+length], which carries packets WireGuard packets
+	// totalling wgBytes bytes, and adds it to the batch.
+	send := func(buf []byte, start, length, packets, wgBytes int) {
+		swgpPacketStart, swgpPacketLength, err := downlink.handler.EncryptZeroCopy(buf, start, length)
+		if err != nil {
+			s.packetLogger.Warn("Failed to encrypt WireGuard packet",
+				zap.String("server", s.name),
+				zap.String("listenAddress", s.proxyListen),
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.Stringer("wgAddress", downlink.upstream),
+				zap.Error(err),
+			)
+			return
+		}
+
+		delay, ok := s.egressShaper.Reserve(swgpPacketLength)
+		if !ok {
+			if ce := s.logger.Check(zap.DebugLevel, "swgpPacket dropped due to full egress queue"); ce != nil {
+				ce.Write(
+					zap.String("server", s.name),
+					zap.String("listenAddress", s.proxyListen),
+					zap.Stringer("clientAddress", downlink.clientAddrPort),
+					zap.Stringer("wgAddress", downlink.upstream),
+				)
+			}
+			return
+		}
+		if sendAtvec != nil {
+			sendAtvec[ns] = time.Now().Add(delay)
+		}
+
+		siovec[ns].Base = &buf[swgpPacketStart]
+		siovec[ns].SetLen(swgpPacketLength)
+		ns++
+		batchPackets += packets
+		batchWgBytes += uint64(wgBytes)
+
+		if packets > 1 {
+			s.bundlesSent.Add(1)
+			s.bundledPackets.Add(uint64(packets))
+		}
 	}
 
 	for {
 		nr, err := downlink.wgConn.ReadMsgs(rmsgvec, 0)
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
+				s.countSessionLifetimeEviction(downlink.clientAddrPort, downlink.maxExpiresAt)
 				break
 			}
-			s.logger.Warn("Failed to read from wgConn",
+			if isUpstreamUnreachable(err) {
+				if s.handleUpstreamUnreachable(downlink.wgConn.UDPConn, downlink.clientAddrPort, downlink.upstream.AddrPort(), err) {
+					break
+				}
+				continue
+			}
+			s.drainWgConnErrorQueue(downlink.wgConn.UDPConn, downlink.clientAddrPort, downlink.upstream.AddrPort())
+			s.connLogger.Warn("Failed to read from wgConn",
 				zap.String("server", s.name),
 				zap.String("listenAddress", s.proxyListen),
 				zap.Stringer("clientAddress", downlink.clientAddrPort),
-				zap.Stringer("wgAddress", downlink.wgAddrPort),
+				zap.Stringer("wgAddress", downlink.upstream),
 				zap.Error(err),
 			)
 			continue
 		}
 
-		var ns int
+		ns = 0
+		batchPackets = 0
+		batchWgBytes = 0
 		rmsgvecn := rmsgvec[:nr]
 
 		for i := range rmsgvecn {
@@ -550,21 +839,21 @@ func (s *server) relayWgToProxySendmmsg(downlink serverNatDownlinkMmsg) {
 
 			packetSourceAddrPort, err := conn.SockaddrToAddrPort(msg.Msghdr.Name, msg.Msghdr.Namelen)
 			if err != nil {
-				s.logger.Warn("Failed to parse sockaddr of packet from wgConn",
+				s.connLogger.Warn("Failed to parse sockaddr of packet from wgConn",
 					zap.String("server", s.name),
 					zap.String("listenAddress", s.proxyListen),
 					zap.Stringer("clientAddress", downlink.clientAddrPort),
-					zap.Stringer("wgAddress", downlink.wgAddrPort),
+					zap.Stringer("wgAddress", downlink.upstream),
 					zap.Error(err),
 				)
 				continue
 			}
-			if !conn.AddrPortMappedEqual(packetSourceAddrPort, downlink.wgAddrPort) {
+			if !downlink.upstream.Accepts(packetSourceAddrPort) {
 				s.logger.Warn("Ignoring packet from non-wg address",
 					zap.String("server", s.name),
 					zap.String("listenAddress", s.proxyListen),
 					zap.Stringer("clientAddress", downlink.clientAddrPort),
-					zap.Stringer("wgAddress", downlink.wgAddrPort),
+					zap.Stringer("wgAddress", downlink.upstream),
 					zap.Stringer("packetSourceAddress", packetSourceAddrPort),
 					zap.Uint32("packetLength", msg.Msglen),
 					zap.Error(err),
@@ -572,36 +861,57 @@ func (s *server) relayWgToProxySendmmsg(downlink serverNatDownlinkMmsg) {
 				continue
 			}
 
-			err = conn.ParseFlagsForError(int(msg.Msghdr.Flags))
-			if err != nil {
-				s.logger.Warn("Packet from wgConn discarded",
+			if int(msg.Msglen) > plaintextLen {
+				s.oversizedPackets.Add(1)
+				s.logLimiter.Warn(s.logger, "Dropping oversized packet from wgConn", downlink.clientAddrPort,
 					zap.String("server", s.name),
 					zap.String("listenAddress", s.proxyListen),
 					zap.Stringer("clientAddress", downlink.clientAddrPort),
-					zap.Stringer("wgAddress", downlink.wgAddrPort),
-					zap.Uint32("packetLength", msg.Msglen),
-					zap.Error(err),
+					zap.Stringer("wgAddress", downlink.upstream),
+					zap.Int("maxPacketLength", plaintextLen),
 				)
 				continue
 			}
 
-			packetBuf := bufvec[i]
-			swgpPacketStart, swgpPacketLength, err := s.handler.EncryptZeroCopy(packetBuf, headroom.Front, int(msg.Msglen))
+			err = conn.ParseFlagsForError(int(msg.Msghdr.Flags))
 			if err != nil {
-				s.logger.Warn("Failed to encrypt WireGuard packet",
+				s.connLogger.Warn("Packet from wgConn discarded",
 					zap.String("server", s.name),
 					zap.String("listenAddress", s.proxyListen),
 					zap.Stringer("clientAddress", downlink.clientAddrPort),
-					zap.Stringer("wgAddress", downlink.wgAddrPort),
+					zap.Stringer("wgAddress", downlink.upstream),
+					zap.Uint32("packetLength", msg.Msglen),
 					zap.Error(err),
 				)
 				continue
 			}
 
-			siovec[ns].Base = &packetBuf[swgpPacketStart]
-			siovec[ns].SetLen(swgpPacketLength)
-			ns++
-			wgBytesSent += uint64(msg.Msglen)
+			packetBuf := bufvec[i]
+			wgPacket := packetBuf[headroom.Front : headroom.Front+int(msg.Msglen)]
+			if rtt, ok := downlink.handshakeTimer.Received(wgPacket); ok {
+				s.handshakeRTT.Update(rtt)
+			}
+
+			if s.proxyCoalesce {
+				if bundle.packets > 0 {
+					if bundle.add(wgPacket) {
+						continue
+					}
+					send(bundle.buf, bundle.start, bundle.length, bundle.packets, bundle.wgBytes)
+					bundle.close()
+				}
+				if packet.IsBundleable(wgPacket) {
+					bundle.open(packetBuf, headroom.Front, len(wgPacket), tailroom)
+					continue
+				}
+			}
+
+			send(packetBuf, headroom.Front, len(wgPacket), 1, len(wgPacket))
+		}
+
+		if bundle.packets > 0 {
+			send(bundle.buf, bundle.start, bundle.length, bundle.packets, bundle.wgBytes)
+			bundle.close()
 		}
 
 		if ns == 0 {
@@ -618,32 +928,52 @@ func (s *server) relayWgToProxySendmmsg(downlink serverNatDownlinkMmsg) {
 			}
 		}
 
-		err = downlink.proxyConn.WriteMsgs(smsgvec[:ns], 0)
-		if err != nil {
-			s.logger.Warn("Failed to write swgpPacket to proxyConn",
-				zap.String("server", s.name),
-				zap.String("listenAddress", s.proxyListen),
-				zap.Stringer("clientAddress", downlink.clientAddrPort),
-				zap.Stringer("wgAddress", downlink.wgAddrPort),
-				zap.Error(err),
-			)
-		}
+		// With the egress shaper, the batch is split into sub-batches of the messages
+		// whose slots begin within egressShaperBatchWindow, each sent when its first slot begins.
+		for start := 0; start < ns; {
+			end := ns
+			if sendAtvec != nil {
+				end = pacedBatchEnd(sendAtvec[:ns], start)
+				if delay := time.Until(sendAtvec[start]); delay > 0 {
+					time.Sleep(delay)
+				}
+			}
 
-		sendmmsgCount++
-		packetsSent += uint64(ns)
-		if burstBatchSize < ns {
-			burstBatchSize = ns
+			err = downlink.proxyConn.WriteMsgs(smsgvec[start:end], 0)
+			if err != nil {
+				s.sendErrors.Add(1)
+				s.publishEvent(EventSendError, downlink.clientAddrPort, err)
+				s.logLimiter.Warn(s.connLogger, "Failed to write swgpPacket to proxyConn", downlink.clientAddrPort,
+					zap.String("server", s.name),
+					zap.String("listenAddress", s.proxyListen),
+					zap.Stringer("clientAddress", downlink.clientAddrPort),
+					zap.Stringer("wgAddress", downlink.upstream),
+					zap.Error(err),
+				)
+			}
+
+			sendmmsgCount++
+			if burstBatchSize < end-start {
+				burstBatchSize = end - start
+			}
+			start = end
 		}
+
+		packetsSent += uint64(batchPackets)
+		wgBytesSent += batchWgBytes
+		s.downlinkTraffic.add(uint64(batchPackets), batchWgBytes)
+		downlink.tenant.addDownlink(uint64(batchPackets), batchWgBytes)
 	}
 
 	s.logger.Info("Finished relay wgConn -> proxyConn",
 		zap.String("server", s.name),
 		zap.String("listenAddress", s.proxyListen),
 		zap.Stringer("clientAddress", downlink.clientAddrPort),
-		zap.Stringer("wgAddress", downlink.wgAddrPort),
+		zap.Stringer("wgAddress", downlink.upstream),
 		zap.Uint64("sendmmsgCount", sendmmsgCount),
 		zap.Uint64("packetsSent", packetsSent),
 		zap.Uint64("wgBytesSent", wgBytesSent),
 		zap.Int("burstBatchSize", burstBatchSize),
+		zap.Duration("handshakeRTT", downlink.handshakeTimer.RTT()),
 	)
 }
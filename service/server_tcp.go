@@ -0,0 +1,596 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+	"go.uber.org/zap"
+)
+
+// tcpFirstFrameTimeout is how long a new TCP connection has to send its first swgp packet.
+// The connection is closed if the packet does not arrive in time, or does not decrypt to a WireGuard handshake message.
+// Tests lower it to check idle connections without waiting that long.
+var tcpFirstFrameTimeout = 5 * time.Second
+
+// tcpMaxInvalidPackets is the number of consecutive swgp packets that fail to decrypt,
+// or are not well-formed WireGuard packets, after which a TCP session is closed.
+const tcpMaxInvalidPackets = 16
+
+type serverTCPUplink struct {
+	clientAddrPort netip.AddrPort
+	wgAddrPort     netip.AddrPort
+	wgConn         *net.UDPConn
+	r              *bufio.Reader
+	packetBuf      []byte
+	firstWgPacket  []byte
+	handshakeTimer *handshakeTimer
+	maxExpiresAt   time.Time
+}
+
+type serverTCPDownlink struct {
+	clientAddrPort     netip.AddrPort
+	wgAddrPort         netip.AddrPort
+	wgConn             *net.UDPConn
+	proxyConn          *net.TCPConn
+	maxProxyPacketSize int
+	handshakeTimer     *handshakeTimer
+	handler            packet.Handler
+	maxExpiresAt       time.Time
+}
+
+func (s *server) startTCP(ctx context.Context) error {
+	proxyListener, err := s.inherited.listenTCP(ctx, &s.proxyConnListenConfig, tcpNetwork(s.network), s.proxyListen)
+	if err != nil {
+		return err
+	}
+	s.proxyListener = proxyListener
+
+	s.mwg.Add(1)
+
+	go func() {
+		s.panicRecoverer.run(func() {
+			s.acceptFromProxyListener(ctx, proxyListener)
+		}, s.releaseTableAfterPanic)
+		s.mwg.Done()
+	}()
+
+	s.logger.Info("Started service",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.String("proxyTransport", proxyTransportTCP),
+		zap.Stringer("wgAddress", s.wgAddr.Load()),
+		zap.Int("wgTunnelMTUv4", s.wgTunnelMTUv4),
+		zap.Int("wgTunnelMTUv6", s.wgTunnelMTUv6),
+	)
+	return nil
+}
+
+func (s *server) acceptFromProxyListener(ctx context.Context, proxyListener *net.TCPListener) {
+	var connsAccepted uint64
+
+	for {
+		proxyConn, err := proxyListener.AcceptTCP()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			s.connLogger.Warn("Failed to accept TCP connection",
+				zap.String("server", s.name),
+				zap.String("listenAddress", s.proxyListen),
+				zap.Error(err),
+			)
+			continue
+		}
+		connsAccepted++
+
+		clientAddrPort := proxyConn.RemoteAddr().(*net.TCPAddr).AddrPort()
+
+		s.lockTable()
+		if s.stopped {
+			s.unlockTable()
+			proxyConn.Close()
+			continue
+		}
+		s.tcpTable[clientAddrPort] = proxyConn
+		s.wg.Add(1)
+		s.unlockTable()
+
+		go func() {
+			// The first packet is decrypted before the relays start.
+			s.panicRecoverer.runSession(clientAddrPort, func() {
+				s.serveProxyTCPConn(ctx, proxyConn, clientAddrPort)
+			}, nil)
+
+			s.mu.Lock()
+			delete(s.tcpTable, clientAddrPort)
+			s.mu.Unlock()
+
+			proxyConn.Close()
+			s.wg.Done()
+		}()
+
+		if ce := s.logger.Check(zap.DebugLevel, "New server session"); ce != nil {
+			ce.Write(
+				zap.String("server", s.name),
+				zap.String("listenAddress", s.proxyListen),
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Stringer("wgAddress", s.wgAddr.Load()),
+			)
+		}
+	}
+
+	s.logger.Info("Finished accepting from proxyListener",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.Stringer("wgAddress", s.wgAddr.Load()),
+		zap.Uint64("connsAccepted", connsAccepted),
+	)
+}
+
+// serveProxyTCPConn relays the session carried by proxyConn until either side stops.
+//
+// The session is only set up once the first swgp packet on proxyConn decrypts to a WireGuard handshake message,
+// so that unauthenticated connections never get a wgConn.
+func (s *server) serveProxyTCPConn(ctx context.Context, proxyConn *net.TCPConn, clientAddrPort netip.AddrPort) {
+	r := bufio.NewReader(proxyConn)
+	packetBuf := make([]byte, s.maxProxyPacketSizev4)
+
+	firstWgPacket, ok := s.readFirstTCPWgPacket(proxyConn, r, packetBuf, clientAddrPort)
+	if !ok {
+		return
+	}
+
+	wgAddrPort, err := s.resolveWgAddrPort(s.wgAddr.Load(), clientAddrPort, nil)
+	if err != nil {
+		s.connLogger.Warn("Failed to resolve wg address for new session",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		return
+	}
+
+	wgConn, err := s.listenWgConn(ctx, 0)
+	if err != nil {
+		s.connLogger.Warn("Failed to create UDP socket for new session",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		return
+	}
+	defer wgConn.Close()
+
+	maxExpiresAt := s.sessionMaxExpiresAt(time.Now())
+	err = wgConn.SetReadDeadline(clampSessionExpiresAt(time.Now().Add(RejectAfterTime), maxExpiresAt))
+	if err != nil {
+		s.connLogger.Warn("Failed to SetReadDeadline on wgConn",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		return
+	}
+
+	var (
+		maxProxyPacketSize int
+		wgTunnelMTU        int
+		ht                 handshakeTimer
+	)
+
+	if addr := clientAddrPort.Addr(); addr.Is4() || addr.Is4In6() {
+		maxProxyPacketSize = s.maxProxyPacketSizev4
+		wgTunnelMTU = s.wgTunnelMTUv4
+	} else {
+		maxProxyPacketSize = s.maxProxyPacketSizev6
+		wgTunnelMTU = s.wgTunnelMTUv6
+	}
+
+	s.publishEvent(EventSessionCreated, clientAddrPort, nil)
+
+	s.logger.Info("Server relay started",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.String("proxyTransport", proxyTransportTCP),
+		zap.Stringer("clientAddress", clientAddrPort),
+		zap.Stringer("wgAddress", wgAddrPort),
+		zap.Int("wgTunnelMTU", wgTunnelMTU),
+	)
+
+	var rwg sync.WaitGroup
+	rwg.Add(1)
+
+	go func() {
+		s.panicRecoverer.runSession(clientAddrPort, func() {
+			s.relayWgToProxyTCP(serverTCPDownlink{
+				clientAddrPort:     clientAddrPort,
+				wgAddrPort:         wgAddrPort,
+				wgConn:             wgConn,
+				proxyConn:          proxyConn,
+				maxProxyPacketSize: maxProxyPacketSize,
+				handshakeTimer:     &ht,
+				handler:            s.newSessionHandler(s.handler, clientAddrPort),
+				maxExpiresAt:       maxExpiresAt,
+			})
+		}, nil)
+		// Session expired, or the downlink panicked. Stop the uplink.
+		proxyConn.SetDeadline(conn.ALongTimeAgo)
+		rwg.Done()
+	}()
+
+	s.panicRecoverer.runSession(clientAddrPort, func() {
+		s.relayProxyToWgTCP(serverTCPUplink{
+			clientAddrPort: clientAddrPort,
+			wgAddrPort:     wgAddrPort,
+			wgConn:         wgConn,
+			r:              r,
+			packetBuf:      packetBuf,
+			firstWgPacket:  firstWgPacket,
+			handshakeTimer: &ht,
+			maxExpiresAt:   maxExpiresAt,
+		})
+	}, nil)
+	// Stream closed, or the uplink panicked. Stop the downlink, which may be blocked writing to a peer that no longer reads.
+	wgConn.SetReadDeadline(conn.ALongTimeAgo)
+	proxyConn.SetDeadline(conn.ALongTimeAgo)
+	rwg.Wait()
+
+	s.publishEvent(EventSessionEvicted, clientAddrPort, nil)
+}
+
+// readFirstTCPWgPacket reads the first swgp packet on proxyConn into packetBuf within [tcpFirstFrameTimeout],
+// and returns the WireGuard packet it decrypts to. It returns false if the packet did not arrive in time,
+// is not a valid handshake message, or the server was stopped meanwhile, and the connection should be closed.
+func (s *server) readFirstTCPWgPacket(proxyConn *net.TCPConn, r *bufio.Reader, packetBuf []byte, clientAddrPort netip.AddrPort) ([]byte, bool) {
+	if err := proxyConn.SetReadDeadline(time.Now().Add(tcpFirstFrameTimeout)); err != nil {
+		s.connLogger.Warn("Failed to SetReadDeadline on proxyConn",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		return nil, false
+	}
+
+	n, err := readTCPFrame(r, packetBuf)
+	if err != nil {
+		var tooLargeErr *tcpFrameTooLargeError
+		if errors.As(err, &tooLargeErr) {
+			s.oversizedPackets.Add(1)
+		}
+		s.logLimiter.Warn(s.connLogger, "Closing TCP connection without a first swgpPacket", clientAddrPort,
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		return nil, false
+	}
+
+	wgPacket, err := s.openTCPWgPacket(packetBuf, n, clientAddrPort)
+	if err != nil {
+		return nil, false
+	}
+
+	// Handshake messages are the only ones every proxy mode authenticates.
+	switch wgPacket[0] {
+	case packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageTypeHandshakeResponse, packet.WireGuardMessageTypeHandshakeCookieReply:
+	default:
+		s.logLimiter.Warn(s.packetLogger, "Closing TCP connection whose first packet is not a handshake", clientAddrPort,
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Uint8("packetType", wgPacket[0]),
+		)
+		return nil, false
+	}
+
+	// Clear the deadline under the lock, so that it does not undo one set by Stop.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return nil, false
+	}
+	if err = proxyConn.SetReadDeadline(time.Time{}); err != nil {
+		s.connLogger.Warn("Failed to SetReadDeadline on proxyConn",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		return nil, false
+	}
+	return wgPacket, true
+}
+
+// openTCPWgPacket decrypts the swgp packet of length n at the start of packetBuf, and returns the WireGuard packet.
+// Packets that fail to decrypt or are not well-formed WireGuard packets are counted and logged.
+func (s *server) openTCPWgPacket(packetBuf []byte, n int, clientAddrPort netip.AddrPort) ([]byte, error) {
+	wgPacketStart, wgPacketLength, err := s.handler.DecryptZeroCopy(packetBuf, 0, n)
+	if err != nil {
+		s.decryptFailures.Add(1)
+		s.publishEvent(EventDecryptFailure, clientAddrPort, err)
+		s.logLimiter.Warn(s.packetLogger, "Failed to decrypt swgpPacket", clientAddrPort,
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Int("packetLength", n),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	wgPacket := packetBuf[wgPacketStart : wgPacketStart+wgPacketLength]
+
+	if err = packet.CheckWireGuardPacket(wgPacket); err != nil {
+		s.malformedPackets.Add(1)
+		s.logLimiter.Warn(s.packetLogger, "Dropping malformed WireGuard packet", clientAddrPort,
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Int("packetLength", wgPacketLength),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return wgPacket, nil
+}
+
+func (s *server) relayProxyToWgTCP(uplink serverTCPUplink) {
+	var (
+		packetsSent    uint64
+		wgBytesSent    uint64
+		invalidPackets int
+	)
+
+	// The first packet was read and decrypted before the session was set up.
+	for wgPacket := uplink.firstWgPacket; ; wgPacket = nil {
+		var err error
+
+		if wgPacket == nil {
+			var n int
+			n, err = readTCPFrame(uplink.r, uplink.packetBuf)
+			if err != nil {
+				var tooLargeErr *tcpFrameTooLargeError
+				if errors.As(err, &tooLargeErr) {
+					s.oversizedPackets.Add(1)
+				}
+				if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) {
+					s.connLogger.Warn("Failed to read from proxyConn",
+						zap.String("server", s.name),
+						zap.String("listenAddress", s.proxyListen),
+						zap.Stringer("clientAddress", uplink.clientAddrPort),
+						zap.Stringer("wgAddress", uplink.wgAddrPort),
+						zap.Error(err),
+					)
+				}
+				break
+			}
+
+			if wgPacket, err = s.openTCPWgPacket(uplink.packetBuf, n, uplink.clientAddrPort); err != nil {
+				invalidPackets++
+				if invalidPackets >= tcpMaxInvalidPackets {
+					s.connLogger.Warn("Closing TCP session after too many invalid packets",
+						zap.String("server", s.name),
+						zap.String("listenAddress", s.proxyListen),
+						zap.Stringer("clientAddress", uplink.clientAddrPort),
+						zap.Stringer("wgAddress", uplink.wgAddrPort),
+						zap.Int("invalidPackets", invalidPackets),
+					)
+					break
+				}
+				continue
+			}
+			invalidPackets = 0
+		}
+		wgPacketLength := len(wgPacket)
+
+		if s.quiesced.Load() {
+			s.quiescedPackets.Add(1)
+			continue
+		}
+
+		if !s.handshakeLimiter.Allow(wgPacket) {
+			continue
+		}
+
+		uplink.handshakeTimer.Sent(wgPacket)
+
+		if _, err = conn.WriteToUDPAddrPort(uplink.wgConn, wgPacket, uplink.wgAddrPort); err != nil {
+			s.sendErrors.Add(1)
+			s.publishEvent(EventSendError, uplink.clientAddrPort, err)
+			s.drainWgConnErrorQueue(uplink.wgConn, uplink.clientAddrPort, uplink.wgAddrPort)
+			s.logLimiter.Warn(s.connLogger, "Failed to write wgPacket to wgConn", uplink.clientAddrPort,
+				zap.String("server", s.name),
+				zap.String("listenAddress", s.proxyListen),
+				zap.Stringer("clientAddress", uplink.clientAddrPort),
+				zap.Stringer("wgAddress", uplink.wgAddrPort),
+				zap.Error(err),
+			)
+		}
+		s.mirror.Mirror(wgPacket)
+
+		// Update wgConn read deadline when a handshake initiation/response message is received.
+		switch wgPacket[0] {
+		case packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageTypeHandshakeResponse:
+			if err = uplink.wgConn.SetReadDeadline(clampSessionExpiresAt(time.Now().Add(RejectAfterTime), uplink.maxExpiresAt)); err != nil {
+				s.connLogger.Warn("Failed to SetReadDeadline on wgConn",
+					zap.String("server", s.name),
+					zap.String("listenAddress", s.proxyListen),
+					zap.Stringer("clientAddress", uplink.clientAddrPort),
+					zap.Stringer("wgAddress", uplink.wgAddrPort),
+					zap.Error(err),
+				)
+			}
+		}
+
+		packetsSent++
+		wgBytesSent += uint64(wgPacketLength)
+		s.uplinkTraffic.add(1, uint64(wgPacketLength))
+	}
+
+	s.logger.Info("Finished relay proxyConn -> wgConn",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.Stringer("clientAddress", uplink.clientAddrPort),
+		zap.Stringer("wgAddress", uplink.wgAddrPort),
+		zap.Uint64("packetsSent", packetsSent),
+		zap.Uint64("wgBytesSent", wgBytesSent),
+	)
+}
+
+func (s *server) relayWgToProxyTCP(downlink serverTCPDownlink) {
+	var (
+		packetsSent uint64
+		wgBytesSent uint64
+	)
+
+	// Allocate one extra byte to detect oversized packets.
+	packetBuf := make([]byte, downlink.maxProxyPacketSize+1)[:downlink.maxProxyPacketSize]
+
+	headroom := s.handler.Headroom()
+	maxWgPacketLength := downlink.maxProxyPacketSize - headroom.Front - headroom.Rear
+	recvBuf := packetBuf[headroom.Front : headroom.Front+maxWgPacketLength+1]
+
+	w := newTCPFrameWriter(downlink.proxyConn)
+
+	for {
+		n, packetSourceAddrPort, err := downlink.wgConn.ReadFromUDPAddrPort(recvBuf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				s.countSessionLifetimeEviction(downlink.clientAddrPort, downlink.maxExpiresAt)
+				break
+			}
+			if isUpstreamUnreachable(err) {
+				if s.handleUpstreamUnreachable(downlink.wgConn, downlink.clientAddrPort, downlink.wgAddrPort, err) {
+					break
+				}
+				continue
+			}
+			s.drainWgConnErrorQueue(downlink.wgConn, downlink.clientAddrPort, downlink.wgAddrPort)
+			s.connLogger.Warn("Failed to read from wgConn",
+				zap.String("server", s.name),
+				zap.String("listenAddress", s.proxyListen),
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.Stringer("wgAddress", downlink.wgAddrPort),
+				zap.Stringer("packetSourceAddress", packetSourceAddrPort),
+				zap.Int("packetLength", n),
+				zap.Error(err),
+			)
+			continue
+		}
+		if !conn.AddrPortMappedEqual(packetSourceAddrPort, downlink.wgAddrPort) {
+			s.logger.Warn("Ignoring packet from non-wg address",
+				zap.String("server", s.name),
+				zap.String("listenAddress", s.proxyListen),
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.Stringer("wgAddress", downlink.wgAddrPort),
+				zap.Stringer("packetSourceAddress", packetSourceAddrPort),
+				zap.Int("packetLength", n),
+			)
+			continue
+		}
+		if n > maxWgPacketLength {
+			s.oversizedPackets.Add(1)
+			s.logLimiter.Warn(s.logger, "Dropping oversized packet from wgConn", downlink.clientAddrPort,
+				zap.String("server", s.name),
+				zap.String("listenAddress", s.proxyListen),
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.Stringer("wgAddress", downlink.wgAddrPort),
+				zap.Int("maxPacketLength", maxWgPacketLength),
+			)
+			continue
+		}
+
+		if rtt, ok := downlink.handshakeTimer.Received(packetBuf[headroom.Front : headroom.Front+n]); ok {
+			s.handshakeRTT.Update(rtt)
+		}
+
+		swgpPacketStart, swgpPacketLength, err := downlink.handler.EncryptZeroCopy(packetBuf, headroom.Front, n)
+		if err != nil {
+			s.packetLogger.Warn("Failed to encrypt WireGuard packet",
+				zap.String("server", s.name),
+				zap.String("listenAddress", s.proxyListen),
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.Stringer("wgAddress", downlink.wgAddrPort),
+				zap.Error(err),
+			)
+			continue
+		}
+
+		if !s.egressShaper.Wait(swgpPacketLength) {
+			if ce := s.logger.Check(zap.DebugLevel, "swgpPacket dropped due to full egress queue"); ce != nil {
+				ce.Write(
+					zap.String("server", s.name),
+					zap.String("listenAddress", s.proxyListen),
+					zap.Stringer("clientAddress", downlink.clientAddrPort),
+					zap.Stringer("wgAddress", downlink.wgAddrPort),
+				)
+			}
+			continue
+		}
+
+		if err = writeTCPFrame(w, packetBuf[swgpPacketStart:swgpPacketStart+swgpPacketLength]); err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			// The stream was closed by the uplink or by Stop.
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			s.sendErrors.Add(1)
+			s.publishEvent(EventSendError, downlink.clientAddrPort, err)
+			s.logLimiter.Warn(s.connLogger, "Failed to write swgpPacket to proxyConn", downlink.clientAddrPort,
+				zap.String("server", s.name),
+				zap.String("listenAddress", s.proxyListen),
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.Stringer("wgAddress", downlink.wgAddrPort),
+				zap.Error(err),
+			)
+			// The stream is broken and the session cannot continue.
+			break
+		}
+
+		packetsSent++
+		wgBytesSent += uint64(n)
+		s.downlinkTraffic.add(1, uint64(n))
+	}
+
+	s.logger.Info("Finished relay wgConn -> proxyConn",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.Stringer("clientAddress", downlink.clientAddrPort),
+		zap.Stringer("wgAddress", downlink.wgAddrPort),
+		zap.Uint64("packetsSent", packetsSent),
+		zap.Uint64("wgBytesSent", wgBytesSent),
+		zap.Duration("handshakeRTT", downlink.handshakeTimer.RTT()),
+	)
+}
+
+// closeTCPSessions stops all TCP sessions by interrupting reads and writes on their streams.
+// Writes must be interrupted too, or a peer that stops reading would block Stop forever.
+//
+// The caller must hold s.mu.
+func (s *server) closeTCPSessions() {
+	for clientAddrPort, proxyConn := range s.tcpTable {
+		if err := proxyConn.SetDeadline(conn.ALongTimeAgo); err != nil {
+			s.connLogger.Warn("Failed to SetDeadline on proxyConn",
+				zap.String("server", s.name),
+				zap.String("listenAddress", s.proxyListen),
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Error(err),
+			)
+		}
+	}
+}
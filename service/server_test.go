@@ -0,0 +1,509 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/jsonhelper"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestCheckUpstreamSourcePort(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		port int
+		ok   bool
+	}{
+		{"Valid", 20285, true},
+		{"OutOfRange", 65536, false},
+		{"Negative", -1, false},
+		{"ProxyListenPort", 20284, false},
+		{"DecoyPort", 20286, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkUpstreamSourcePort(c.port, ":20284", []int{20286})
+			if ok := err == nil; ok != c.ok {
+				t.Errorf("Expected ok %v, got error %v", c.ok, err)
+			}
+		})
+	}
+}
+
+func TestCheckUpstreamPortRange(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		r    [2]int
+		ok   bool
+	}{
+		{"Valid", [2]int{20300, 20301}, true},
+		{"SinglePort", [2]int{20300, 20300}, true},
+		{"Reversed", [2]int{20301, 20300}, false},
+		{"ZeroMin", [2]int{0, 20300}, false},
+		{"OutOfRange", [2]int{20300, 65536}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkUpstreamPortRange(c.r)
+			if ok := err == nil; ok != c.ok {
+				t.Errorf("Expected ok %v, got error %v", c.ok, err)
+			}
+		})
+	}
+}
+
+func TestServerUpstreamPortRange(t *testing.T) {
+	psk := generateTestPSK(t)
+
+	serverConfig := ServerConfig{
+		Name:              "wg0",
+		ProxyListen:       ":20302",
+		ProxyMode:         "zero-overhead",
+		ProxyPSK:          psk,
+		WgEndpoint:        conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20303)),
+		MTU:               1500,
+		UpstreamPortRange: [2]int{20300, 20301},
+	}
+
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20304",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20302)),
+		ProxyMode:     "zero-overhead",
+		ProxyPSK:      psk,
+		MTU:           1500,
+	}
+
+	badConfig := serverConfig
+	badConfig.UpstreamSourcePort = 20300
+	if _, err := badConfig.Server(NewLoggers(logger), conn.NewListenConfigCache()); err == nil {
+		t.Error("Expected error for both upstreamSourcePort and upstreamPortRange")
+	}
+
+	ctx := context.Background()
+	sc := Config{
+		Servers: []ServerConfig{serverConfig},
+		Clients: []ClientConfig{clientConfig},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	handshakeInitiationPacket := make([]byte, packet.WireGuardMessageLengthHandshakeInitiation)
+	handshakeInitiationPacket[0] = packet.WireGuardMessageTypeHandshakeInitiation
+	if _, err = rand.Read(handshakeInitiationPacket[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, err := net.Dial("udp", clientConfig.WgListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	serverConn, err := conn.DefaultUDPClientListenConfig.ListenUDP(ctx, "udp", serverConfig.WgEndpoint.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	if _, err = clientConn.Write(handshakeInitiationPacket); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, packet.WireGuardMessageLengthHandshakeInitiation+1)
+	_, addr, err := serverConn.ReadFromUDPAddrPort(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := int(addr.Port()); port < serverConfig.UpstreamPortRange[0] || port > serverConfig.UpstreamPortRange[1] {
+		t.Errorf("Received packet from port %d, expected port in range %v", port, serverConfig.UpstreamPortRange)
+	}
+}
+
+func TestServerUpstreamSourcePort(t *testing.T) {
+	psk := generateTestPSK(t)
+
+	serverConfig := ServerConfig{
+		Name:               "wg0",
+		ProxyListen:        ":20287",
+		ProxyMode:          "zero-overhead",
+		ProxyPSK:           psk,
+		WgEndpoint:         conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20288)),
+		MTU:                1500,
+		UpstreamSourcePort: 20289,
+	}
+
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20290",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20287)),
+		ProxyMode:     "zero-overhead",
+		ProxyPSK:      psk,
+		MTU:           1500,
+	}
+
+	ctx := context.Background()
+	sc := Config{
+		Servers: []ServerConfig{serverConfig},
+		Clients: []ClientConfig{clientConfig},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	handshakeInitiationPacket := make([]byte, packet.WireGuardMessageLengthHandshakeInitiation)
+	handshakeInitiationPacket[0] = packet.WireGuardMessageTypeHandshakeInitiation
+	if _, err = rand.Read(handshakeInitiationPacket[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, err := net.Dial("udp", clientConfig.WgListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	serverConn, err := conn.DefaultUDPClientListenConfig.ListenUDP(ctx, "udp", serverConfig.WgEndpoint.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	if _, err = clientConn.Write(handshakeInitiationPacket); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, packet.WireGuardMessageLengthHandshakeInitiation+1)
+	_, addr, err := serverConn.ReadFromUDPAddrPort(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.Port() != uint16(serverConfig.UpstreamSourcePort) {
+		t.Errorf("Received packet from port %d, expected %d", addr.Port(), serverConfig.UpstreamSourcePort)
+	}
+}
+
+func testResolveRetryServer(t *testing.T, resolveTimeout time.Duration) *server {
+	serverConfig := ServerConfig{
+		Name:                   "wg0",
+		ProxyListen:            ":20294",
+		ProxyMode:              "zero-overhead",
+		ProxyPSK:               generateTestPSK(t),
+		WgEndpoint:             conn.MustAddrFromDomainPort("wg.invalid", 20295),
+		MTU:                    1500,
+		EndpointResolveTimeout: jsonhelper.Duration(resolveTimeout),
+	}
+
+	s, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.resolveCtx, s.cancelResolve = context.WithCancel(context.Background())
+	t.Cleanup(s.cancelResolve)
+	return s
+}
+
+func TestServerResolveWgAddrPortRetry(t *testing.T) {
+	const resolveTimeout = 300 * time.Millisecond
+	s := testResolveRetryServer(t, resolveTimeout)
+
+	start := time.Now()
+	if _, err := s.resolveWgAddrPort(s.wgAddr.Load(), netip.AddrPort{}, nil); err == nil {
+		t.Fatal("Expected error resolving wg.invalid")
+	}
+	if elapsed := time.Since(start); elapsed < resolveTimeout {
+		t.Errorf("Gave up after %v, expected to keep retrying for %v", elapsed, resolveTimeout)
+	}
+}
+
+func TestServerResolveWgAddrPortRetryCanceled(t *testing.T) {
+	s := testResolveRetryServer(t, time.Hour)
+
+	time.AfterFunc(200*time.Millisecond, s.cancelResolve)
+
+	start := time.Now()
+	if _, err := s.resolveWgAddrPort(s.wgAddr.Load(), netip.AddrPort{}, nil); err == nil {
+		t.Fatal("Expected error resolving wg.invalid")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Resolution retries took %v after cancellation", elapsed)
+	}
+}
+
+func TestServerDecryptFailures(t *testing.T) {
+	serverConfig := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: ":20296",
+		ProxyMode:   "paranoid",
+		ProxyPSK:    generateTestPSK(t),
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20297)),
+		MTU:         1500,
+	}
+
+	ctx := context.Background()
+	sc := Config{
+		Servers: []ServerConfig{serverConfig},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	proxyConn, err := net.Dial("udp", "[::1]:20296")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyConn.Close()
+
+	garbage := make([]byte, 128)
+	if _, err = rand.Read(garbage); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = proxyConn.Write(garbage); err != nil {
+		t.Fatal(err)
+	}
+
+	// The packet is processed asynchronously.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ss := m.Stats()[0]
+		if ss.DecryptFailures == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 1 decrypt failure, got %d", ss.DecryptFailures)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerOversizedPackets(t *testing.T) {
+	for _, c := range []struct {
+		name           string
+		batchMode      string
+		proxyTransport string
+		proxyPort      uint16
+		wgPort         uint16
+	}{
+		{"Default", "", "", 20593, 20594},
+		{"NoBatch", "no", "", 20595, 20596},
+		{"TCP", "", proxyTransportTCP, 20597, 20598},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			serverConfig := ServerConfig{
+				Name:           "wg0",
+				ProxyListen:    fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:      "passthrough",
+				ProxyTransport: c.proxyTransport,
+				WgEndpoint:     conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPort)),
+				MTU:            1500,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+
+			s, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = s.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+
+			endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+
+			// The fake client sends from an IPv4 address, so the limit is the same in both directions.
+			// With the passthrough mode, swgp packets are WireGuard packets.
+			proxyAddress := fmt.Sprintf("127.0.0.1:%d", c.proxyPort)
+			maxPacket := newTestWgPacket(t, packet.WireGuardMessageTypeData, s.maxProxyPacketSizev4)
+			oversizedPacket := newTestWgPacket(t, packet.WireGuardMessageTypeData, s.maxProxyPacketSizev4+1)
+
+			var (
+				send   func([]byte)
+				expect func([]byte)
+			)
+
+			if c.proxyTransport == proxyTransportTCP {
+				proxyConn, err := net.Dial("tcp", proxyAddress)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer proxyConn.Close()
+
+				w := newTCPFrameWriter(proxyConn)
+				r := bufio.NewReader(proxyConn)
+				buf := make([]byte, 2*s.maxProxyPacketSizev4)
+
+				send = func(b []byte) {
+					t.Helper()
+					if err := writeTCPFrame(w, b); err == nil {
+						err = w.Flush()
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				expect = func(b []byte) {
+					t.Helper()
+					if err := proxyConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+						t.Fatal(err)
+					}
+					n, err := readTCPFrame(r, buf)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(buf[:n], b) {
+						t.Errorf("Received frame of length %d does not match expected packet of length %d", n, len(b))
+					}
+				}
+			} else {
+				client := newFakeWgPeer(t, proxyAddress)
+				send = client.Send
+				expect = func(b []byte) {
+					t.Helper()
+					client.Expect(b)
+				}
+			}
+
+			handshake := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+			send(handshake)
+			endpoint.Expect(handshake)
+
+			// Downlink: the oversized packet is dropped, and the next packet is the one of maximum size.
+			endpoint.Send(oversizedPacket)
+			endpoint.Send(maxPacket)
+			expect(maxPacket)
+			if oversized := s.Stats().OversizedPackets; oversized != 1 {
+				t.Errorf("Expected 1 oversized packet, got %d", oversized)
+			}
+
+			// Uplink: the oversized packet is dropped. A TCP stream cannot skip a frame, so it is closed instead.
+			send(oversizedPacket)
+			if c.proxyTransport != proxyTransportTCP {
+				send(maxPacket)
+				endpoint.Expect(maxPacket)
+			}
+			waitFor(t, "oversized uplink packet to be counted", func() bool {
+				return s.Stats().OversizedPackets == 2
+			})
+		})
+	}
+}
+
+func TestServerRepliesFromReceivingAddress(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("127.0.0.2 is only a local address on Linux by default")
+	}
+	for _, batchMode := range []string{"", "no"} {
+		t.Run("BatchMode="+batchMode, func(t *testing.T) {
+			testServerRepliesFromReceivingAddress(t, batchMode)
+		})
+	}
+}
+
+// testServerRepliesFromReceivingAddress checks that a server listening on a wildcard address
+// replies from the local address that the client sent to.
+func testServerRepliesFromReceivingAddress(t *testing.T, batchMode string) {
+	// All of 127.0.0.0/8 is on the loopback interface, so a wildcard listener
+	// receives packets on many local addresses.
+	localAddr := netip.AddrFrom4([4]byte{127, 0, 0, 2})
+
+	serverConfig := ServerConfig{
+		Name:        "wg0",
+		ProxyListen: ":20332",
+		ProxyMode:   "passthrough",
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20333)),
+		MTU:         1500,
+		PerfConfig: PerfConfig{
+			BatchMode: batchMode,
+		},
+	}
+
+	ctx := context.Background()
+	sc := Config{
+		Servers: []ServerConfig{serverConfig},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	wgConn, err := conn.DefaultUDPClientListenConfig.ListenUDP(ctx, "udp", serverConfig.WgEndpoint.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wgConn.Close()
+
+	// An unconnected socket sees the source address of the reply, whatever it is.
+	clientConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	handshakeInitiationPacket := make([]byte, packet.WireGuardMessageLengthHandshakeInitiation)
+	handshakeInitiationPacket[0] = packet.WireGuardMessageTypeHandshakeInitiation
+	if _, err = rand.Read(handshakeInitiationPacket[1:]); err != nil {
+		t.Fatal(err)
+	}
+	proxyAddrPort := netip.AddrPortFrom(localAddr, 20332)
+	if _, err = clientConn.WriteToUDPAddrPort(handshakeInitiationPacket, proxyAddrPort); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = wgConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, packet.WireGuardMessageLengthHandshakeInitiation+1)
+	_, addr, err := wgConn.ReadFromUDPAddrPort(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshakeResponsePacket := make([]byte, packet.WireGuardMessageLengthHandshakeResponse)
+	handshakeResponsePacket[0] = packet.WireGuardMessageTypeHandshakeResponse
+	if _, err = rand.Read(handshakeResponsePacket[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = wgConn.WriteToUDPAddrPort(handshakeResponsePacket, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = clientConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	_, replyAddrPort, err := clientConn.ReadFromUDPAddrPort(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replyAddrPort != proxyAddrPort {
+		t.Errorf("Received reply from %s, expected %s", replyAddrPort, proxyAddrPort)
+	}
+}
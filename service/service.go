@@ -4,11 +4,17 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/jsonhelper"
 	"github.com/database64128/swgp-go/packet"
 	"go.uber.org/zap"
 )
@@ -17,6 +23,13 @@ const (
 	// minimumMTU is the minimum allowed MTU.
 	minimumMTU = 1280
 
+	// maximumMTU is the maximum allowed MTU, as the length of an IP packet is a 16-bit field.
+	maximumMTU = 65535
+
+	// jumboMTUWarningThreshold is the largest MTU commonly supported by jumbo frame networks.
+	// Larger MTUs are allowed, but logged with a warning, as they are most likely misconfigurations.
+	jumboMTUWarningThreshold = 9216
+
 	// defaultRelayBatchSize is the default batch size of recvmmsg(2) and sendmmsg(2) calls in relay sessions.
 	//
 	// On an i9-13900K, the average number of messages received in a single recvmmsg(2) call is
@@ -30,6 +43,10 @@ const (
 	// defaultMainRecvBatchSize is the default batch size of a relay service's main receive routine.
 	defaultMainRecvBatchSize = 64
 
+	// maxMainRecvBatchSize is the maximum batch size of a relay service's main receive routine.
+	// Larger values are clamped. It matches UIO_MAXIOV, the kernel's limit on the msgvec length.
+	maxMainRecvBatchSize = 1024
+
 	// defaultSendChannelCapacity is the default capacity of a relay session's uplink send channel.
 	defaultSendChannelCapacity = 1024
 )
@@ -48,7 +65,10 @@ const (
 	WireGuardDataPacketLengthMask = 0xFFF0
 )
 
-var ErrMTUTooSmall = errors.New("MTU must be at least 1280")
+var (
+	ErrMTUTooSmall = errors.New("MTU must be at least 1280")
+	ErrMTUTooLarge = errors.New("MTU must be at most 65535")
+)
 
 // Service is implemented by encapsulations that utilize packet handlers
 // to provide swgp service over a connection or other abstractions.
@@ -61,6 +81,9 @@ type Service interface {
 
 	// Stop stops the service.
 	Stop() error
+
+	// Stats returns a snapshot of the service's counters and gauges.
+	Stats() Stats
 }
 
 // PerfConfig exposes performance tuning knobs.
@@ -76,10 +99,18 @@ type PerfConfig struct {
 	// RelayBatchSize is the batch size of recvmmsg(2) and sendmmsg(2) calls in relay sessions.
 	RelayBatchSize int `json:"relayBatchSize"`
 
-	// MainRecvBatchSize is the batch size of a relay service's main receive routine.
+	// MainRecvBatchSize is the batch size of a relay service's main receive routine,
+	// i.e. the number of messages requested per recvmmsg(2) call.
+	//
+	// Larger values save system calls under load at the cost of memory: each message reserves a packet buffer.
+	// The default value is 64. Values greater than 1024 are clamped to 1024.
 	MainRecvBatchSize int `json:"mainRecvBatchSize"`
 
-	// SendChannelCapacity is the capacity of a relay session's uplink send channel.
+	// SendChannelCapacity is the capacity of a relay session's uplink send channel,
+	// which queues packets from the listener for the session's sender goroutine.
+	// Packets that arrive while the channel is full are dropped and counted in [Stats.QueueFullPackets].
+	//
+	// The default value is 1024. The minimum value is 64.
 	SendChannelCapacity int `json:"sendChannelCapacity"`
 }
 
@@ -100,11 +131,13 @@ func (pc *PerfConfig) CheckAndApplyDefaults() error {
 	}
 
 	switch {
-	case pc.MainRecvBatchSize > 0 && pc.MainRecvBatchSize <= 1024:
+	case pc.MainRecvBatchSize > 0 && pc.MainRecvBatchSize <= maxMainRecvBatchSize:
+	case pc.MainRecvBatchSize > maxMainRecvBatchSize:
+		pc.MainRecvBatchSize = maxMainRecvBatchSize
 	case pc.MainRecvBatchSize == 0:
 		pc.MainRecvBatchSize = defaultMainRecvBatchSize
 	default:
-		return fmt.Errorf("main recv batch size out of range [0, 1024]: %d", pc.MainRecvBatchSize)
+		return fmt.Errorf("main recv batch size must not be negative: %d", pc.MainRecvBatchSize)
 	}
 
 	switch {
@@ -123,76 +156,700 @@ func (pc *PerfConfig) CheckAndApplyDefaults() error {
 type Config struct {
 	Servers []ServerConfig `json:"servers"`
 	Clients []ClientConfig `json:"clients"`
+
+	// Include is a list of paths or glob patterns of additional configuration files to load.
+	// It is processed by [LoadConfig]. Only servers, clients, and include directives
+	// are loaded from included files.
+	Include []string `json:"include,omitempty"`
+
+	// StatsdAddr is the address of a statsd server to push service stats to over UDP.
+	// Leave empty to disable the statsd exporter.
+	StatsdAddr string `json:"statsdAddr,omitempty"`
+
+	// StatsdFlushInterval is the interval between statsd pushes.
+	// The default value is 10s.
+	StatsdFlushInterval jsonhelper.Duration `json:"statsdFlushInterval,omitempty"`
+
+	// StatsdDisableRuntimeMetrics stops the statsd exporter from pushing Go runtime metrics,
+	// like goroutine count, heap size, and GC pauses, for setups that already collect them elsewhere.
+	StatsdDisableRuntimeMetrics bool `json:"statsdDisableRuntimeMetrics,omitempty"`
+
+	// StatsdTags makes the statsd exporter tag every metric with the node ID as the DogStatsD tag "node".
+	// Tags are a DogStatsD extension that plain statsd servers do not understand, so they are off by default.
+	StatsdTags bool `json:"statsdTags,omitempty"`
+
+	// StatsLogInterval is the interval between stats summary log lines. Each summary logs one line per service,
+	// with its live sessions, and the packets, bytes, and drops since the previous summary.
+	//
+	// The default value 0 disables stats summaries.
+	StatsLogInterval jsonhelper.Duration `json:"statsLogInterval,omitempty"`
+
+	// MetricsFile is the path of a file to write service stats to every MetricsFileInterval,
+	// in the Prometheus text format, for nodes that cannot be scraped. The file is replaced atomically
+	// by renaming a temporary file in the same directory over it, so readers never see a partial write.
+	MetricsFile string `json:"metricsFile,omitempty"`
+
+	// MetricsFileInterval is the interval between metrics file writes. It must be set with MetricsFile.
+	//
+	// The default value 0 disables the metrics file.
+	MetricsFileInterval jsonhelper.Duration `json:"metricsFileInterval,omitempty"`
+
+	// MaxBufferPoolBytes caps the memory retained by the packet buffer pools of all services.
+	// Under bursts beyond the cap, buffers are allocated and left to the garbage collector
+	// instead of being returned to the pools.
+	//
+	// The default value 0 leaves the pools unbounded.
+	MaxBufferPoolBytes int64 `json:"maxBufferPoolBytes,omitempty"`
+
+	// NodeID identifies this node in logs and metrics shipped from many nodes to one place.
+	// swgp-go attaches it to every log line as the "nodeID" field, and to every metric
+	// as the "node" label of the metrics file, or the DogStatsD tag "node" when StatsdTags is set.
+	//
+	// The default empty value uses the hostname.
+	NodeID string `json:"nodeID,omitempty"`
+
+	// Resolver is the address of the DNS server that resolves the domain names of WireGuard endpoints,
+	// proxy endpoints, and SRV records, like "10.0.0.53" or "[fd00::53]:5353". The port defaults to 53.
+	//
+	// The default empty value uses the system resolver.
+	Resolver string `json:"resolver,omitempty"`
+
+	// LogFormat selects the encoder of the logger built by swgp-go: "console" or "json".
+	//
+	// The default empty value keeps the encoder of the logger preset, which is console
+	// for the console and systemd presets, and JSON for the production preset.
+	LogFormat string `json:"logFormat,omitempty"`
+
+	// DisablePanicRecovery disables the recovery of panics in the receive loops of servers and clients.
+	// By default, a panicking loop is logged, counted in the panics stat, and restarted,
+	// up to 5 times a minute, after which it is stopped, while other services keep running.
+	// With panic recovery disabled, a panic crashes the process. It is not reloaded.
+	DisablePanicRecovery bool `json:"disablePanicRecovery,omitempty"`
+}
+
+// NodeIDOrHostname returns NodeID, or the hostname if NodeID is not set.
+// It returns an empty string if the hostname cannot be determined.
+func (sc *Config) NodeIDOrHostname() string {
+	if sc.NodeID != "" {
+		return sc.NodeID
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// Loggers holds the loggers used by each subsystem of the services.
+type Loggers struct {
+	// Service logs service lifecycle and session events.
+	Service *zap.Logger
+
+	// Conn logs socket errors, such as failed reads, writes, and address resolutions.
+	Conn *zap.Logger
+
+	// Packet logs packet handler errors, such as failed encryptions and decryptions.
+	Packet *zap.Logger
+}
+
+// NewLoggers returns a [Loggers] that uses the given logger for all subsystems.
+func NewLoggers(logger *zap.Logger) Loggers {
+	return Loggers{
+		Service: logger,
+		Conn:    logger,
+		Packet:  logger,
+	}
+}
+
+// withDefaults returns a copy of the loggers with unset loggers
+// defaulting to the service logger, or a no-op logger if it's also unset.
+func (l Loggers) withDefaults() Loggers {
+	if l.Service == nil {
+		l.Service = zap.NewNop()
+	}
+	if l.Conn == nil {
+		l.Conn = l.Service
+	}
+	if l.Packet == nil {
+		l.Packet = l.Service
+	}
+	return l
 }
 
 // Manager initializes the service manager.
 func (sc *Config) Manager(logger *zap.Logger) (*Manager, error) {
+	return sc.ManagerWithLoggers(NewLoggers(logger))
+}
+
+// ManagerWithLoggers is like [Config.Manager] but allows using a different logger for each subsystem.
+// Unset loggers default to the service logger.
+func (sc *Config) ManagerWithLoggers(loggers Loggers) (*Manager, error) {
+	loggers = loggers.withDefaults()
+	listenConfigCache := conn.NewListenConfigCacheWithLogger(loggers.Conn)
+	events := newEventBus()
+
+	if sc.MaxBufferPoolBytes < 0 {
+		return nil, fmt.Errorf("max buffer pool bytes must not be negative: %d", sc.MaxBufferPoolBytes)
+	}
+	var bufferPool *bufferPoolBudget
+	if sc.MaxBufferPoolBytes > 0 {
+		bufferPool = newBufferPoolBudget(sc.MaxBufferPoolBytes)
+	}
+
+	resolver, err := newResolver(sc.Resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	services, err := sc.services(loggers, listenConfigCache, events, bufferPool, resolver, sc.DisablePanicRecovery)
+	if err != nil {
+		return nil, err
+	}
+
+	if sc.StatsdFlushInterval < 0 {
+		return nil, fmt.Errorf("statsd flush interval must not be negative: %s", time.Duration(sc.StatsdFlushInterval))
+	}
+
+	if sc.StatsLogInterval < 0 {
+		return nil, fmt.Errorf("stats log interval must not be negative: %s", time.Duration(sc.StatsLogInterval))
+	}
+
+	if sc.MetricsFileInterval < 0 {
+		return nil, fmt.Errorf("metrics file interval must not be negative: %s", time.Duration(sc.MetricsFileInterval))
+	}
+
+	if sc.MetricsFileInterval > 0 && sc.MetricsFile == "" {
+		return nil, errors.New("metricsFileInterval requires metricsFile")
+	}
+
+	if sc.MetricsFile != "" && sc.MetricsFileInterval == 0 {
+		return nil, errors.New("metricsFile requires metricsFileInterval")
+	}
+
+	m := Manager{
+		services:          services,
+		loggers:           loggers,
+		logger:            loggers.Service,
+		listenConfigCache: listenConfigCache,
+		events:            events,
+		bufferPool:        bufferPool,
+		resolver:          resolver,
+		config:            *sc,
+	}
+	m.config.Servers = nil
+	m.config.Clients = nil
+	m.config.Include = nil
+
+	if sc.StatsdAddr != "" {
+		m.statsd = newStatsdExporter(sc.StatsdAddr, time.Duration(sc.StatsdFlushInterval), m.Stats, loggers.Service)
+		if sc.StatsdTags {
+			m.statsd.setNodeID(sc.NodeIDOrHostname())
+		}
+		if bufferPool != nil {
+			m.statsd.bufferPoolBytes = bufferPool.Pooled
+		}
+		if !sc.StatsdDisableRuntimeMetrics {
+			m.statsd.runtime = newRuntimeStats()
+		}
+	}
+
+	m.statsLog = newStatsLogger(time.Duration(sc.StatsLogInterval), m.Stats, loggers.Service)
+
+	m.metricsFile = newMetricsFileWriter(sc.MetricsFile, time.Duration(sc.MetricsFileInterval), m.Stats, loggers.Service)
+	if m.metricsFile != nil {
+		m.metricsFile.renderer.setNodeID(sc.NodeIDOrHostname())
+		if bufferPool != nil {
+			m.metricsFile.renderer.bufferPoolBytes = bufferPool.Pooled
+		}
+	}
+
+	return &m, nil
+}
+
+// services creates the configured services, skipping disabled ones after validating their configs.
+// The services publish events to events,
+// and share bufferPool as the budget of their packet buffer pools if it is not nil.
+// If disablePanicRecovery is true, panics in their receive loops are not recovered.
+func (sc *Config) services(loggers Loggers, listenConfigCache conn.ListenConfigCache, events *eventBus, bufferPool *bufferPoolBudget, resolver *net.Resolver, disablePanicRecovery bool) ([]managedService, error) {
 	serviceCount := len(sc.Servers) + len(sc.Clients)
 	if serviceCount == 0 {
 		return nil, errors.New("no services to start")
 	}
 
-	services := make([]Service, 0, serviceCount)
-	listenConfigCache := conn.NewListenConfigCache()
+	if err := sc.checkDuplicateNames(); err != nil {
+		return nil, err
+	}
+
+	if err := sc.checkDecoyPortCollisions(); err != nil {
+		return nil, err
+	}
+
+	services := make([]managedService, 0, serviceCount)
 
 	for i := range sc.Servers {
-		s, err := sc.Servers[i].Server(logger, listenConfigCache)
+		serverConfig := &sc.Servers[i]
+		s, err := serverConfig.Server(loggers, listenConfigCache)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create server service %s: %w", sc.Servers[i].Name, err)
+			return nil, fmt.Errorf("failed to create server service %s: %w", serverConfig.Name, err)
 		}
-		services = append(services, s)
+		if serverConfig.Disabled {
+			loggers.Service.Info("Skipping disabled server", zap.String("server", serverConfig.Name))
+			continue
+		}
+		s.events = events
+		s.packetBufPool.budget = bufferPool
+		s.setResolver(resolver)
+		if disablePanicRecovery {
+			s.panicRecoverer = nil
+		}
+		fingerprint, err := json.Marshal(serverConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal server config %s: %w", serverConfig.Name, err)
+		}
+		migrationFingerprint, err := serverMigrationFingerprint(*serverConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal server config %s: %w", serverConfig.Name, err)
+		}
+		effectiveConfig := *serverConfig
+		effectiveConfig.MTU = s.mtu
+		services = append(services, managedService{
+			Service:              s,
+			role:                 "server",
+			name:                 serverConfig.Name,
+			fingerprint:          string(fingerprint),
+			migrationFingerprint: migrationFingerprint,
+			serverConfig:         &effectiveConfig,
+		})
 	}
 
 	for i := range sc.Clients {
-		c, err := sc.Clients[i].Client(logger, listenConfigCache)
+		clientConfig := &sc.Clients[i]
+		c, err := clientConfig.Client(loggers, listenConfigCache)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create client service %s: %w", sc.Clients[i].Name, err)
+			return nil, fmt.Errorf("failed to create client service %s: %w", clientConfig.Name, err)
 		}
-		services = append(services, c)
+		if clientConfig.Disabled {
+			loggers.Service.Info("Skipping disabled client", zap.String("client", clientConfig.Name))
+			continue
+		}
+		c.events = events
+		c.packetBufPool.budget = bufferPool
+		c.resolver = resolver
+		if disablePanicRecovery {
+			c.panicRecoverer = nil
+		}
+		fingerprint, err := json.Marshal(clientConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal client config %s: %w", clientConfig.Name, err)
+		}
+		effectiveConfig := *clientConfig
+		effectiveConfig.MTU = c.mtu
+		services = append(services, managedService{
+			Service:      c,
+			role:         "client",
+			name:         clientConfig.Name,
+			fingerprint:  string(fingerprint),
+			clientConfig: &effectiveConfig,
+		})
 	}
 
-	return &Manager{services, logger}, nil
+	return services, nil
+}
+
+// managedService is a service managed by a [Manager].
+type managedService struct {
+	Service
+
+	// role is either "server" or "client".
+	role string
+
+	// name is the name of the service in the config.
+	name string
+
+	// fingerprint is the JSON encoding of the service config.
+	// A service is restarted on reload when its fingerprint changes.
+	fingerprint string
+
+	// migrationFingerprint is the JSON encoding of a server config without its WireGuard endpoint.
+	// A server whose wgEndpoint is the only change is migrated on reload instead of restarted.
+	// It is empty for clients.
+	migrationFingerprint string
+
+	// serverConfig is the config of a server, with the MTU it uses. It is nil for clients.
+	serverConfig *ServerConfig
+
+	// clientConfig is the config of a client, with the MTU it uses. It is nil for servers.
+	clientConfig *ClientConfig
+
+	// statsBase holds the final counters of the services this one replaced on reload.
+	// It is added to the service's own counters, so that counters keep growing across
+	// restarts of the same role and name.
+	statsBase Stats
+}
+
+// Stats returns the service's stats, with counters carried over from the services it replaced.
+func (s managedService) Stats() Stats {
+	stats := s.Service.Stats()
+	stats.addCounters(&s.statsBase)
+	return stats
+}
+
+// key identifies the service by its role and name.
+func (s *managedService) key() string {
+	return s.role + ":" + s.name
 }
 
 // Manager manages the services.
 type Manager struct {
-	services []Service
-	logger   *zap.Logger
+	mu                sync.Mutex
+	services          []managedService
+	loggers           Loggers
+	logger            *zap.Logger
+	listenConfigCache conn.ListenConfigCache
+	statsd            *statsdExporter
+	statsLog          *statsLogger
+	metricsFile       *metricsFileWriter
+	events            *eventBus
+	bufferPool        *bufferPoolBudget
+	resolver          *net.Resolver
+	inherited         *inheritedSockets
+
+	// config holds the settings of the config the manager was created from, without its services.
+	// They are not reloaded.
+	config Config
+
+	// startOrder, if not nil, returns the order in which Start starts the n services,
+	// as a permutation of their indexes. Tests set it to shuffle the bring-up.
+	startOrder func(n int) []int
+}
+
+// Subscribe returns a channel of events from all managed services, and a function to unsubscribe.
+//
+// Events are dropped for subscribers that fall behind, instead of blocking the services.
+// See [Manager.DroppedEvents]. Calling the returned function closes the channel.
+func (m *Manager) Subscribe() (<-chan Event, func()) {
+	return m.events.Subscribe()
+}
+
+// BufferPoolBytes returns the memory currently retained by the packet buffer pools of all services,
+// or 0 if [Config.MaxBufferPoolBytes] is not set.
+func (m *Manager) BufferPoolBytes() uint64 {
+	if m.bufferPool == nil {
+		return 0
+	}
+	return m.bufferPool.Pooled()
+}
+
+// DroppedEvents returns the number of events dropped because subscribers fell behind.
+func (m *Manager) DroppedEvents() uint64 {
+	return m.events.Dropped()
+}
+
+// ServiceStats is a snapshot of a managed service's stats.
+type ServiceStats struct {
+	// Role is either "server" or "client".
+	Role string
+
+	// Name is the name of the service in the config.
+	Name string
+
+	Stats
+}
+
+// Stats returns a snapshot of the stats of all managed services.
+func (m *Manager) Stats() []ServiceStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.serviceStats()
+}
+
+// serviceStats returns a snapshot of the stats of all managed services.
+// The caller must hold the lock.
+func (m *Manager) serviceStats() []ServiceStats {
+	stats := make([]ServiceStats, len(m.services))
+	for i, s := range m.services {
+		stats[i] = ServiceStats{
+			Role:  s.role,
+			Name:  s.name,
+			Stats: s.Stats(),
+		}
+	}
+	return stats
 }
 
 // Start starts all configured server (interface) and client (peer) services.
+//
+// Services are started one at a time, servers before clients, each in config order.
+// When a service's Start returns, it has bound its listening sockets, and its goroutines
+// only use sockets it owns. Services do not depend on each other, so the bring-up does not
+// rely on this order. The statsd exporter, the stats logger, and the metrics file writer are started last.
+//
+// ctx bounds the whole bring-up. If it is canceled or its deadline expires before all services
+// have started, Start returns an error naming the service that did not come up in time.
+// Once started, services keep running regardless of ctx, until [Manager.Stop] is called.
+//
+// If Start returns an error, the services it started are stopped and their sockets closed,
+// and the manager is left without services.
 func (m *Manager) Start(ctx context.Context) error {
-	for _, s := range m.services {
-		if err := s.Start(ctx); err != nil {
-			return fmt.Errorf("failed to start %s: %w", s.String(), err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	order := m.serviceStartOrder()
+	started := make([]managedService, 0, len(order))
+
+	for _, i := range order {
+		s := m.services[i]
+		if err := m.startService(ctx, s); err != nil {
+			m.abortStart(started)
+			return err
+		}
+		started = append(started, s)
+	}
+
+	if m.statsd != nil {
+		if err := m.statsd.Start(ctx); err != nil {
+			m.abortStart(started)
+			return fmt.Errorf("failed to start statsd exporter: %w", err)
+		}
+	}
+
+	if err := m.metricsFile.Start(m.serviceStats()); err != nil {
+		if m.statsd != nil {
+			m.statsd.Stop()
 		}
+		m.abortStart(started)
+		return fmt.Errorf("failed to start metrics file writer: %w", err)
 	}
+
+	m.closeUnclaimedInheritedSockets()
+	m.statsLog.Start()
 	return nil
 }
 
+// serviceStartOrder returns the indexes of the services in the order Start starts them.
+func (m *Manager) serviceStartOrder() []int {
+	if m.startOrder != nil {
+		return m.startOrder(len(m.services))
+	}
+	order := make([]int, len(m.services))
+	for i := range order {
+		order[i] = i
+	}
+	return order
+}
+
+// abortStart stops the started services and removes all services from the manager.
+func (m *Manager) abortStart(started []managedService) {
+	for _, s := range started {
+		m.stopService(s)
+	}
+	m.services = nil
+	m.statsd = nil
+	m.statsLog = nil
+	m.metricsFile = nil
+}
+
 // Stop stops all running services.
 func (m *Manager) Stop() {
+	// The statsd exporter, the stats logger, and the metrics file writer read stats under the lock, so stop them first.
+	m.statsLog.Stop()
+	m.metricsFile.Stop()
+	if m.statsd != nil {
+		if err := m.statsd.Stop(); err != nil {
+			m.logger.Warn("Failed to stop statsd exporter", zap.Error(err))
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.services {
+		m.stopService(s)
+	}
+}
+
+// stopService stops the service and logs the result.
+func (m *Manager) stopService(s Service) {
+	if err := s.Stop(); err != nil {
+		m.logger.Warn("Failed to stop service",
+			zap.Stringer("service", s),
+			zap.Error(err),
+		)
+	}
+	m.logger.Info("Stopped service", zap.Stringer("service", s))
+}
+
+// Reload applies the new config to the running services.
+//
+// Services are matched by role and name. Services whose role and config are unchanged keep running
+// without interruption. Services that were removed, renamed, disabled, or changed are stopped, and their
+// sockets closed, before new and changed services are started, so a new service may reuse the
+// listen address of a stopped one.
+//
+// A server whose wgEndpoint is its only change keeps running: new sessions go to the new endpoint,
+// while existing sessions keep relaying to the old one until they expire or are evicted.
+//
+// Counters in [Manager.Stats] survive reloads: a restarted service continues from the counters
+// of the service it replaced, so only new services start at zero.
+//
+// Statsd exporter settings, the stats log interval, the metrics file settings, the resolver, the node ID, and the log format are not reloaded.
+//
+// If the new config is invalid, an error is returned and the running services are left untouched.
+// ctx bounds the start of each new service, like in [Manager.Start].
+// If a new service fails to start, Reload continues starting the remaining services,
+// and returns the errors. Services that failed to start are not managed by the manager.
+func (m *Manager) Reload(ctx context.Context, sc Config) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	newServices, err := sc.services(m.loggers, m.listenConfigCache, m.events, m.bufferPool, m.resolver, m.config.DisablePanicRecovery)
+	if err != nil {
+		return err
+	}
+
+	oldServiceByKey := make(map[string]managedService, len(m.services))
+	for _, s := range m.services {
+		oldServiceByKey[s.key()] = s
+	}
+
+	services := make([]managedService, 0, len(newServices))
+	toStart := make([]managedService, 0, len(newServices))
+	replaced := make(map[string]*managedService)
+	var migrated int
+
+	for _, s := range newServices {
+		old, ok := oldServiceByKey[s.key()]
+		if ok && old.fingerprint == s.fingerprint {
+			delete(oldServiceByKey, s.key())
+			services = append(services, old)
+			continue
+		}
+		if ok && old.migrationFingerprint != "" && old.migrationFingerprint == s.migrationFingerprint {
+			// Only wgEndpoint changed. Keep the running server, and let its existing sessions drain.
+			old.Service.(*server).migrateWgEndpoint(*s.Service.(*server).wgAddr.Load())
+			old.fingerprint = s.fingerprint
+			old.serverConfig.WgEndpoint = s.serverConfig.WgEndpoint
+			delete(oldServiceByKey, s.key())
+			services = append(services, old)
+			migrated++
+			continue
+		}
+		if ok {
+			replaced[s.key()] = &old
+		}
+		toStart = append(toStart, s)
+	}
+
+	// Stop removed and changed services first to release their sockets.
 	for _, s := range m.services {
-		if err := s.Stop(); err != nil {
-			m.logger.Warn("Failed to stop service",
-				zap.Stringer("service", s),
-				zap.Error(err),
-			)
+		if _, ok := oldServiceByKey[s.key()]; ok {
+			m.stopService(s)
+		}
+	}
+
+	// Changed services carry over the final counters of the services they replace.
+	// Removed services take their counters with them.
+	for i := range toStart {
+		s := &toStart[i]
+		if old, ok := replaced[s.key()]; ok {
+			s.statsBase = old.Stats()
+		}
+	}
+
+	var errs []error
+
+	for _, s := range toStart {
+		if err := m.startService(ctx, s); err != nil {
+			errs = append(errs, err)
+			continue
 		}
-		m.logger.Info("Stopped service", zap.Stringer("service", s))
+		services = append(services, s)
 	}
+
+	m.services = services
+
+	m.logger.Info("Reloaded services",
+		zap.Int("servicesKept", len(services)-len(toStart)+len(errs)),
+		zap.Int("serversMigrated", migrated),
+		zap.Int("servicesStarted", len(toStart)-len(errs)),
+		zap.Int("servicesStopped", len(oldServiceByKey)),
+		zap.Int("servicesFailed", len(errs)),
+	)
+
+	return errors.Join(errs...)
 }
 
-func getPacketHandlerForProxyMode(proxyMode string, proxyPSK []byte) (handler packet.Handler, err error) {
-	switch proxyMode {
-	case "zero-overhead":
-		handler, err = packet.NewZeroOverheadHandler(proxyPSK)
-	case "paranoid":
-		handler, err = packet.NewParanoidHandler(proxyPSK)
-	default:
-		err = fmt.Errorf("unknown proxy mode: %s", proxyMode)
+// getPacketHandler creates the packet handler that decrypts packets in inboundMode and encrypts packets in outboundMode.
+// If directional PSKs are given, packets are encrypted with outboundPSK and decrypted with inboundPSK.
+// inboundOpts and outboundOpts are passed to the handler factories registered for the proxy modes.
+func getPacketHandler(inboundMode, outboundMode string, proxyPSK, inboundPSK, outboundPSK []byte, inboundOpts, outboundOpts map[string]any) (packet.Handler, error) {
+	if inboundPSK == nil && outboundPSK == nil {
+		if inboundMode == outboundMode {
+			return getPacketHandlerForProxyMode(outboundMode, proxyPSK, outboundOpts)
+		}
+		inboundPSK, outboundPSK = proxyPSK, proxyPSK
+	} else {
+		if inboundPSK == nil || outboundPSK == nil {
+			return nil, errors.New("proxyPSKInbound and proxyPSKOutbound must be set together")
+		}
+		if proxyPSK != nil {
+			return nil, errors.New("proxyPSK must not be set together with proxyPSKInbound and proxyPSKOutbound")
+		}
+		if inboundMode != "passthrough" && len(inboundPSK) != 32 {
+			return nil, fmt.Errorf("proxyPSKInbound must be 32 bytes, got %d", len(inboundPSK))
+		}
+		if outboundMode != "passthrough" && len(outboundPSK) != 32 {
+			return nil, fmt.Errorf("proxyPSKOutbound must be 32 bytes, got %d", len(outboundPSK))
+		}
+	}
+
+	encrypter, err := getPacketHandlerForProxyMode(outboundMode, outboundPSK, outboundOpts)
+	if err != nil {
+		return nil, err
+	}
+	decrypter, err := getPacketHandlerForProxyMode(inboundMode, inboundPSK, inboundOpts)
+	if err != nil {
+		return nil, err
+	}
+	return packet.NewSplitHandler(encrypter, decrypter), nil
+}
+
+// directionalProxyModes returns the proxy modes of received and sent packets.
+// Without proxyModeInbound and proxyModeOutbound, proxyMode is used for both directions.
+func directionalProxyModes(proxyMode, inboundMode, outboundMode string) (string, string, error) {
+	if inboundMode == "" && outboundMode == "" {
+		return proxyMode, proxyMode, nil
+	}
+	if inboundMode == "" || outboundMode == "" {
+		return "", "", errors.New("proxyModeInbound and proxyModeOutbound must be set together")
+	}
+	if proxyMode != "" {
+		return "", "", errors.New("proxyMode must not be set together with proxyModeInbound and proxyModeOutbound")
+	}
+	if inboundMode == proxyModeZeroOverheadKeyed || outboundMode == proxyModeZeroOverheadKeyed {
+		return "", "", fmt.Errorf("the %s proxy mode cannot be set per direction", proxyModeZeroOverheadKeyed)
+	}
+	return inboundMode, outboundMode, nil
+}
+
+// getPacketHandlerForProxyMode creates the packet handler registered for the proxy mode.
+func getPacketHandlerForProxyMode(proxyMode string, proxyPSK []byte, opts map[string]any) (packet.Handler, error) {
+	handler, err := packet.NewHandler(proxyMode, proxyPSK, opts)
+	if errors.Is(err, packet.ErrUnknownHandler) {
+		return nil, fmt.Errorf("unknown proxy mode: %s, registered proxy modes: %s", proxyMode, strings.Join(packet.RegisteredHandlers(), ", "))
+	}
+	return handler, err
+}
+
+// optionsWithSizeClasses returns a copy of opts with the size classes set,
+// or opts itself if sizeClasses is nil.
+func optionsWithSizeClasses(opts map[string]any, sizeClasses []int) map[string]any {
+	if sizeClasses == nil {
+		return opts
+	}
+	optsCopy := make(map[string]any, len(opts)+1)
+	for k, v := range opts {
+		optsCopy[k] = v
 	}
-	return
+	optsCopy[packet.OptionSizeClasses] = sizeClasses
+	return optsCopy
 }
 
 func getWgTunnelMTUForHandler(handler packet.Handler, maxProxyPacketSize int) int {
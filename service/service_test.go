@@ -0,0 +1,298 @@
+package service
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func testReloadServerConfig(name, proxyListen string, psk []byte) ServerConfig {
+	return ServerConfig{
+		Name:        name,
+		ProxyListen: proxyListen,
+		ProxyMode:   "zero-overhead",
+		ProxyPSK:    psk,
+		WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20249)),
+		MTU:         1500,
+	}
+}
+
+func assertPortInUse(t *testing.T, address string, inUse bool) {
+	t.Helper()
+	c, err := net.ListenPacket("udp", address)
+	if err == nil {
+		c.Close()
+	}
+	if got := err != nil; got != inUse {
+		t.Errorf("%s in use: got %v, want %v (err: %v)", address, got, inUse, err)
+	}
+}
+
+func TestManagerReloadRename(t *testing.T) {
+	ctx := context.Background()
+	psk := generateTestPSK(t)
+
+	sc := Config{
+		Servers: []ServerConfig{
+			testReloadServerConfig("wg0", ":20240", psk),
+			testReloadServerConfig("wg1", ":20241", psk),
+		},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	// Rename wg0 to wg2 on the same port, and replace wg1 with wg3 on a new port.
+	newConfig := Config{
+		Servers: []ServerConfig{
+			testReloadServerConfig("wg2", ":20240", psk),
+			testReloadServerConfig("wg3", ":20243", psk),
+		},
+	}
+	if err = m.Reload(ctx, newConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	assertPortInUse(t, ":20240", true)
+	assertPortInUse(t, ":20241", false)
+	assertPortInUse(t, ":20243", true)
+}
+
+func TestManagerReloadKeepUnchanged(t *testing.T) {
+	ctx := context.Background()
+	psk := generateTestPSK(t)
+
+	sc := Config{
+		Servers: []ServerConfig{
+			testReloadServerConfig("wg0", ":20244", psk),
+		},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	oldService := m.services[0].Service
+
+	if err = m.Reload(ctx, Config{
+		Servers: []ServerConfig{
+			testReloadServerConfig("wg0", ":20244", psk),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.services[0].Service != oldService {
+		t.Error("Unchanged service was restarted.")
+	}
+
+	// An invalid config must leave the running services untouched.
+	if err = m.Reload(ctx, Config{
+		Servers: []ServerConfig{
+			testReloadServerConfig("wg0", ":20244", psk),
+			testReloadServerConfig("wg0", ":20245", psk),
+		},
+	}); err == nil {
+		t.Error("Expected error for duplicate service names.")
+	}
+
+	if len(m.services) != 1 || m.services[0].Service != oldService {
+		t.Error("Running services changed after failed reload.")
+	}
+	assertPortInUse(t, ":20244", true)
+}
+
+func TestManagerReloadKeepsCounters(t *testing.T) {
+	ctx := context.Background()
+	psk := generateTestPSK(t)
+
+	sc := Config{
+		Servers: []ServerConfig{
+			testReloadServerConfig("wg0", ":20419", psk),
+			testReloadServerConfig("wg1", ":20420", psk),
+		},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	m.services[0].Service.(*server).uplinkTraffic.add(3, 300)
+	m.services[1].Service.(*server).uplinkTraffic.add(5, 500)
+
+	// Change wg0, so that it is restarted, and remove wg1.
+	changed := testReloadServerConfig("wg0", ":20419", psk)
+	changed.MTU = 1492
+	if err = m.Reload(ctx, Config{Servers: []ServerConfig{changed}}); err != nil {
+		t.Fatal(err)
+	}
+	m.services[0].Service.(*server).uplinkTraffic.add(1, 100)
+
+	stats := m.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("Expected 1 service, got %d", len(stats))
+	}
+	if got := stats[0].UplinkPackets; got != 4 {
+		t.Errorf("Restarted service: got %d uplink packets, want 4", got)
+	}
+	if got := stats[0].UplinkBytes; got != 400 {
+		t.Errorf("Restarted service: got %d uplink bytes, want 400", got)
+	}
+
+	// Add wg1 back. It starts at zero.
+	if err = m.Reload(ctx, Config{Servers: []ServerConfig{changed, testReloadServerConfig("wg1", ":20420", psk)}}); err != nil {
+		t.Fatal(err)
+	}
+	stats = m.Stats()
+	if got := stats[0].UplinkPackets; got != 4 {
+		t.Errorf("Kept service: got %d uplink packets, want 4", got)
+	}
+	if got := stats[1].UplinkPackets; got != 0 {
+		t.Errorf("New service: got %d uplink packets, want 0", got)
+	}
+}
+
+func TestManagerReloadDisabled(t *testing.T) {
+	ctx := context.Background()
+	psk := generateTestPSK(t)
+
+	disabled := testReloadServerConfig("wg1", ":20318", psk)
+	disabled.Disabled = true
+
+	sc := Config{
+		Servers: []ServerConfig{
+			testReloadServerConfig("wg0", ":20317", psk),
+			disabled,
+		},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	if len(m.services) != 1 {
+		t.Fatalf("Expected 1 running service, got %d", len(m.services))
+	}
+	assertPortInUse(t, ":20318", false)
+
+	// Disabled services must still be valid.
+	invalid := disabled
+	invalid.ProxyMode = "invalid"
+	if err = m.Reload(ctx, Config{
+		Servers: []ServerConfig{
+			testReloadServerConfig("wg0", ":20317", psk),
+			invalid,
+		},
+	}); err == nil {
+		t.Error("Expected error for invalid disabled service.")
+	}
+
+	// Disable wg0 and enable wg1.
+	wg0 := testReloadServerConfig("wg0", ":20317", psk)
+	wg0.Disabled = true
+	disabled.Disabled = false
+	if err = m.Reload(ctx, Config{
+		Servers: []ServerConfig{wg0, disabled},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertPortInUse(t, ":20317", false)
+	assertPortInUse(t, ":20318", true)
+}
+
+func TestPerfConfigMainRecvBatchSize(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		value    int
+		expected int
+		ok       bool
+	}{
+		{"Default", 0, defaultMainRecvBatchSize, true},
+		{"Custom", 16, 16, true},
+		{"Max", maxMainRecvBatchSize, maxMainRecvBatchSize, true},
+		{"Clamped", maxMainRecvBatchSize + 1, maxMainRecvBatchSize, true},
+		{"Negative", -1, 0, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			pc := PerfConfig{MainRecvBatchSize: c.value}
+			err := pc.CheckAndApplyDefaults()
+			if ok := err == nil; ok != c.ok {
+				t.Fatalf("Expected ok %v, got error %v", c.ok, err)
+			}
+			if c.ok && pc.MainRecvBatchSize != c.expected {
+				t.Errorf("Expected %d, got %d", c.expected, pc.MainRecvBatchSize)
+			}
+		})
+	}
+}
+
+func TestConfigNodeIDOrHostname(t *testing.T) {
+	sc := Config{NodeID: "vps1"}
+	if got := sc.NodeIDOrHostname(); got != "vps1" {
+		t.Errorf("Got node ID %q, want %q", got, "vps1")
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+	sc.NodeID = ""
+	if got := sc.NodeIDOrHostname(); got != hostname {
+		t.Errorf("Got node ID %q, want hostname %q", got, hostname)
+	}
+}
+
+func TestGetPacketHandlerForProxyModeUnknown(t *testing.T) {
+	_, err := getPacketHandlerForProxyMode("no-such-mode", nil, nil)
+	if err == nil {
+		t.Fatal("Expected error for unknown proxy mode.")
+	}
+	for _, mode := range []string{"paranoid", "passthrough", proxyModeZeroOverheadKeyed} {
+		if !strings.Contains(err.Error(), mode) {
+			t.Errorf("Expected error to list proxy mode %s, got %v", mode, err)
+		}
+	}
+}
+
+func TestGetServerPacketHandlerRegisteredMode(t *testing.T) {
+	var gotOpts map[string]any
+	packet.RegisterHandler("test-service-registered", func(psk []byte, opts map[string]any) (packet.Handler, error) {
+		gotOpts = opts
+		return packet.NewPassthroughHandler(), nil
+	})
+
+	sc := ServerConfig{
+		ProxyMode:        "test-service-registered",
+		ProxyModeOptions: map[string]any{"key": "value"},
+	}
+	if _, _, err := getServerPacketHandler(&sc); err != nil {
+		t.Fatal(err)
+	}
+	if gotOpts["key"] != "value" {
+		t.Errorf("Expected proxyModeOptions to be passed to the factory, got %v", gotOpts)
+	}
+}
@@ -0,0 +1,42 @@
+package service
+
+import (
+	"net/netip"
+
+	"github.com/database64128/swgp-go/packet"
+	"go.uber.org/zap"
+)
+
+// allowNewSession reports whether wgPacket from clientAddrPort, which has no session, may start one.
+//
+// A data packet or bundle without a session usually means the server lost its session table, for example in a restart,
+// while the client kept sending. Such packets are counted. Forwarding them to wgEndpoint lets WireGuard
+// pick up the session where it left off, without waiting for the next handshake. Servers with
+// dropSessionlessData drop them instead, so that only handshakes start sessions.
+func (s *server) allowNewSession(wgPacket []byte, clientAddrPort netip.AddrPort) bool {
+	if wgPacket[0] != packet.WireGuardMessageTypeData && wgPacket[0] != packet.MessageTypeBundle {
+		return true
+	}
+	s.sessionlessData.Add(1)
+
+	if s.dropSessionlessData {
+		s.sessionlessDropped.Add(1)
+		if ce := s.logger.Check(zap.DebugLevel, "Dropping data packet without a session"); ce != nil {
+			ce.Write(
+				zap.String("server", s.name),
+				zap.String("listenAddress", s.proxyListen),
+				zap.Stringer("clientAddress", clientAddrPort),
+			)
+		}
+		return false
+	}
+
+	if ce := s.logger.Check(zap.DebugLevel, "Starting session with data packet"); ce != nil {
+		ce.Write(
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+		)
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestServerSessionlessData(t *testing.T) {
+	for _, c := range []struct {
+		name                string
+		batchMode           string
+		dropSessionlessData bool
+		proxyPort           uint16
+		wgPort              uint16
+		clientPort          uint16
+	}{
+		{"Forward", "", false, 20468, 20469, 20470},
+		{"ForwardNoBatch", "no", false, 20471, 20472, 20473},
+		{"Drop", "", true, 20474, 20475, 20476},
+		{"DropNoBatch", "no", true, 20477, 20478, 20479},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			psk := generateTestPSK(t)
+
+			serverConfig := ServerConfig{
+				Name:                "wg0",
+				ProxyListen:         fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:           "paranoid",
+				ProxyPSK:            psk,
+				WgEndpoint:          conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPort)),
+				MTU:                 1500,
+				DropSessionlessData: c.dropSessionlessData,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+
+			clientConfig := ClientConfig{
+				Name:          "wg0",
+				WgListen:      fmt.Sprintf(":%d", c.clientPort),
+				ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.proxyPort)),
+				ProxyMode:     "paranoid",
+				ProxyPSK:      psk,
+				MTU:           1500,
+			}
+
+			ctx := context.Background()
+			loggers := NewLoggers(logger)
+			listenConfigCache := conn.NewListenConfigCache()
+
+			endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+
+			s, err := serverConfig.Server(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = s.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+
+			cl, err := clientConfig.Client(loggers, listenConfigCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = cl.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer cl.Stop()
+
+			peer := newFakeWgPeer(t, clientConfig.WgListen)
+
+			dataPacket := newTestWgPacket(t, packet.WireGuardMessageTypeData, 128)
+			peer.Send(dataPacket)
+			if c.dropSessionlessData {
+				endpoint.ExpectNone(100 * time.Millisecond)
+
+				// A handshake still starts a session, which then passes data packets.
+				handshakePacket := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+				peer.Send(handshakePacket)
+				endpoint.Expect(handshakePacket)
+				peer.Send(dataPacket)
+			}
+			endpoint.Expect(dataPacket)
+
+			stats := s.Stats()
+			if stats.SessionlessData != 1 {
+				t.Errorf("SessionlessData = %d, expected 1", stats.SessionlessData)
+			}
+			var expectedDropped uint64
+			if c.dropSessionlessData {
+				expectedDropped = 1
+			}
+			if stats.SessionlessDropped != expectedDropped {
+				t.Errorf("SessionlessDropped = %d, expected %d", stats.SessionlessDropped, expectedDropped)
+			}
+		})
+	}
+}
+
+func TestServerConfigDropSessionlessDataTCP(t *testing.T) {
+	serverConfig := ServerConfig{
+		Name:                "wg0",
+		ProxyListen:         ":20480",
+		ProxyMode:           "paranoid",
+		ProxyPSK:            generateTestPSK(t),
+		WgEndpoint:          conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20481)),
+		MTU:                 1500,
+		ProxyTransport:      "tcp",
+		DropSessionlessData: true,
+	}
+	if _, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache()); err == nil {
+		t.Error("Expected error for dropSessionlessData with the TCP proxy transport")
+	}
+}
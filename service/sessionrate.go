@@ -0,0 +1,171 @@
+package service
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// sessionRateMinBurst is the minimum bucket size of a session rate limiter in bytes,
+	// so that a maximum-sized packet passes even at very low rates.
+	sessionRateMinBurst = 65535
+
+	// sessionRateWindow is the interval over which a session's current rate is measured.
+	sessionRateWindow = time.Second
+)
+
+// SessionRate is the current rate of a server session limited by PerSessionRateBps.
+type SessionRate struct {
+	// ClientAddress is the address of the session's client.
+	ClientAddress netip.AddrPort
+
+	// RateBps is the rate in bytes per second of WireGuard packets forwarded
+	// to the WireGuard endpoint in the last complete measurement window.
+	RateBps uint64
+
+	// Dropped is the number of packets of the session dropped for exceeding the rate.
+	Dropped uint64
+}
+
+// sessionRateLimiter limits the rate of WireGuard packets a session forwards to the WireGuard endpoint.
+//
+// Each packet takes its length from a bucket of one second's worth of bytes, but no less than [sessionRateMinBurst].
+// Packets beyond the limit are dropped and counted.
+// Unlike [egressShaper], nothing is queued, because the limiter sits in the path of every session.
+//
+// sessionRateLimiter is safe for concurrent use by multiple goroutines.
+type sessionRateLimiter struct {
+	bucket *tokenBucket
+
+	// mu protects the measurement window.
+	mu sync.Mutex
+
+	// windowStart is the start of the current measurement window.
+	windowStart time.Time
+
+	// windowBytes is the number of bytes forwarded in the current measurement window.
+	windowBytes uint64
+
+	// windowRate is the rate in bytes per second of the previous measurement window.
+	windowRate uint64
+
+	dropped atomic.Uint64
+}
+
+// newSessionRateLimiter returns a new limiter that forwards up to rate bytes per second.
+//
+// If rate is not positive, nil is returned. All methods are safe to call on a nil limiter.
+func newSessionRateLimiter(rate int) *sessionRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(rate)
+	if burst < sessionRateMinBurst {
+		burst = sessionRateMinBurst
+	}
+	return &sessionRateLimiter{
+		bucket:      newTokenBucket(float64(rate), burst),
+		windowStart: time.Now(),
+	}
+}
+
+// Allow returns whether a WireGuard packet of length n may be forwarded.
+func (l *sessionRateLimiter) Allow(n int) bool {
+	if l == nil {
+		return true
+	}
+
+	if !l.bucket.Take(float64(n)) {
+		l.dropped.Add(1)
+		return false
+	}
+
+	l.mu.Lock()
+	l.advanceWindowLocked(time.Now())
+	l.windowBytes += uint64(n)
+	l.mu.Unlock()
+	return true
+}
+
+// advanceWindowLocked starts a new measurement window if the current one has ended.
+// A session idle for more than a whole window has a rate of 0.
+func (l *sessionRateLimiter) advanceWindowLocked(now time.Time) {
+	elapsed := now.Sub(l.windowStart)
+	switch {
+	case elapsed < sessionRateWindow:
+		return
+	case elapsed < 2*sessionRateWindow:
+		l.windowRate = uint64(float64(l.windowBytes) / elapsed.Seconds())
+	default:
+		l.windowRate = 0
+	}
+	l.windowStart = now
+	l.windowBytes = 0
+}
+
+// Rate returns the rate in bytes per second of the last complete measurement window.
+func (l *sessionRateLimiter) Rate() uint64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	l.advanceWindowLocked(time.Now())
+	rate := l.windowRate
+	l.mu.Unlock()
+	return rate
+}
+
+// Dropped returns the number of packets dropped for exceeding the rate.
+func (l *sessionRateLimiter) Dropped() uint64 {
+	if l == nil {
+		return 0
+	}
+	return l.dropped.Load()
+}
+
+// countSessionRateDropped counts a packet dropped by the session rate limiter of clientAddrPort.
+func (s *server) countSessionRateDropped(clientAddrPort netip.AddrPort, natEntry *serverNatEntry) {
+	s.sessionRateDropped.Add(1)
+	if ce := s.logger.Check(zap.DebugLevel, "wgPacket dropped due to session rate limit"); ce != nil {
+		ce.Write(
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Stringer("wgAddress", &natEntry.wgAddr),
+			zap.Uint64("sessionPacketsDropped", natEntry.rateLimiter.Dropped()),
+		)
+	}
+}
+
+// sessionRates returns the current rates of the sessions, ordered by client address,
+// or nil if per-session rate limiting is disabled.
+func (s *server) sessionRates() []SessionRate {
+	if s.perSessionRateBps <= 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	rates := make([]SessionRate, 0, len(s.table))
+	for key, natEntry := range s.table {
+		rates = append(rates, SessionRate{
+			ClientAddress: key.clientAddrPort,
+			RateBps:       natEntry.rateLimiter.Rate(),
+			Dropped:       natEntry.rateLimiter.Dropped(),
+		})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(rates, func(i, j int) bool {
+		a, b := rates[i].ClientAddress, rates[j].ClientAddress
+		if a.Addr() != b.Addr() {
+			return a.Addr().Less(b.Addr())
+		}
+		return a.Port() < b.Port()
+	})
+	return rates
+}
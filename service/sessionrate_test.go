@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestSessionRateLimiter(t *testing.T) {
+	l := newSessionRateLimiter(100000)
+
+	// The bucket holds one second's worth of bytes.
+	for i := 0; i < 100; i++ {
+		if !l.Allow(1000) {
+			t.Fatalf("Packet %d dropped, expected burst to pass", i)
+		}
+	}
+	if l.Allow(1000) {
+		t.Error("Expected packet beyond the burst to be dropped")
+	}
+	if dropped := l.Dropped(); dropped != 1 {
+		t.Errorf("Expected 1 dropped packet, got %d", dropped)
+	}
+
+	// 100000 bytes per second refills 1000 bytes every 10ms.
+	time.Sleep(50 * time.Millisecond)
+	if !l.Allow(1000) {
+		t.Error("Expected packet to pass after refill")
+	}
+
+	if rate := l.Rate(); rate != 0 {
+		t.Errorf("Expected rate 0 before the first window ends, got %d", rate)
+	}
+	l.mu.Lock()
+	l.windowStart = l.windowStart.Add(-sessionRateWindow)
+	l.mu.Unlock()
+	if rate := l.Rate(); rate < 90000 || rate > 101000 {
+		t.Errorf("Expected rate of about 101000 B/s, got %d", rate)
+	}
+}
+
+func TestSessionRateLimiterMinBurst(t *testing.T) {
+	l := newSessionRateLimiter(1)
+	if !l.Allow(sessionRateMinBurst) {
+		t.Error("Expected a maximum-sized packet to pass at a low rate")
+	}
+	if l.Allow(1) {
+		t.Error("Expected packet beyond the burst to be dropped")
+	}
+}
+
+func TestSessionRateLimiterNil(t *testing.T) {
+	l := newSessionRateLimiter(0)
+	if l != nil {
+		t.Fatal("Expected nil limiter for zero rate")
+	}
+	if !l.Allow(1 << 20) {
+		t.Error("Nil limiter must never drop packets")
+	}
+	if rate, dropped := l.Rate(), l.Dropped(); rate != 0 || dropped != 0 {
+		t.Errorf("Expected rate 0 and 0 dropped packets, got %d and %d", rate, dropped)
+	}
+}
+
+func TestServerConfigPerSessionRateBps(t *testing.T) {
+	for _, c := range []struct {
+		name           string
+		rate           int
+		proxyTransport string
+		ok             bool
+	}{
+		{"Disabled", 0, "", true},
+		{"Enabled", 1 << 20, "", true},
+		{"Negative", -1, "", false},
+		{"TCP", 1 << 20, proxyTransportTCP, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			sc := ServerConfig{
+				Name:              "wg0",
+				ProxyListen:       ":20399",
+				ProxyMode:         "zero-overhead",
+				ProxyPSK:          generateTestPSK(t),
+				ProxyTransport:    c.proxyTransport,
+				WgEndpoint:        conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20400)),
+				MTU:               1500,
+				PerSessionRateBps: c.rate,
+			}
+			_, err := sc.Server(NewLoggers(logger), conn.NewListenConfigCache())
+			if ok := err == nil; ok != c.ok {
+				t.Errorf("Expected ok %v, got error %v", c.ok, err)
+			}
+		})
+	}
+}
+
+func TestServerPerSessionRateBps(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		batchMode    string
+		proxyPort    uint16
+		wgPort       uint16
+		wgListenPort uint16
+	}{
+		{"Default", "", 20401, 20402, 20403},
+		{"NoBatch", "no", 20404, 20405, 20406},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			psk := generateTestPSK(t)
+
+			serverConfig := ServerConfig{
+				Name:              "wg0",
+				ProxyListen:       fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:         "zero-overhead",
+				ProxyPSK:          psk,
+				WgEndpoint:        conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPort)),
+				MTU:               1500,
+				PerSessionRateBps: sessionRateMinBurst,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+
+			clientConfig := ClientConfig{
+				Name:          "wg0",
+				WgListen:      fmt.Sprintf(":%d", c.wgListenPort),
+				ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.proxyPort)),
+				ProxyMode:     "zero-overhead",
+				ProxyPSK:      psk,
+				MTU:           1500,
+			}
+
+			ctx := context.Background()
+			sc := Config{
+				Servers: []ServerConfig{serverConfig},
+				Clients: []ClientConfig{clientConfig},
+			}
+			m, err := sc.Manager(logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = m.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer m.Stop()
+
+			peer := newFakeWgPeer(t, clientConfig.WgListen)
+			endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+
+			handshakeInitiationPacket := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+			peer.Send(handshakeInitiationPacket)
+			endpoint.Expect(handshakeInitiationPacket)
+
+			// 128 KiB is twice the bucket size, so about half of the packets are over the rate.
+			const dataPackets = 128
+			for i := 0; i < dataPackets; i++ {
+				peer.Send(newTestWgPacket(t, packet.WireGuardMessageTypeData, 1024))
+				if i%16 == 15 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			if received := len(endpoint.Received()) - 1; received >= dataPackets {
+				t.Errorf("Expected some of the %d data packets to be dropped, endpoint received %d", dataPackets, received)
+			}
+
+			for _, ss := range m.Stats() {
+				if ss.Role != "server" {
+					continue
+				}
+				if ss.SessionRateDropped == 0 {
+					t.Error("Expected over-rate packets to be counted")
+				}
+				if len(ss.SessionRates) != 1 {
+					t.Fatalf("Expected 1 session rate, got %d", len(ss.SessionRates))
+				}
+				if sr := ss.SessionRates[0]; sr.Dropped != ss.SessionRateDropped {
+					t.Errorf("Expected session to account for all %d dropped packets, got %d", ss.SessionRateDropped, sr.Dropped)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/jsonhelper"
+	"go.uber.org/zap"
+)
+
+const (
+	// restoredWgConnBindTimeout is how long a restored session retries binding its previous port while it is in use.
+	// During a graceful restart, the old process holds the ports of its sessions until it stops its services,
+	// which it does once the new process is ready.
+	restoredWgConnBindTimeout = 30 * time.Second
+
+	// restoredWgConnBindInitialBackoff is the wait before the first retry of binding a restored session's port.
+	restoredWgConnBindInitialBackoff = 10 * time.Millisecond
+
+	// restoredWgConnBindMaxBackoff caps the exponential backoff between retries of binding a restored session's port.
+	restoredWgConnBindMaxBackoff = time.Second
+)
+
+// sessionState is the snapshot of a server's session table saved to its session state file.
+type sessionState struct {
+	SavedAt  time.Time           `json:"savedAt"`
+	Sessions []sessionStateEntry `json:"sessions"`
+}
+
+// sessionStateEntry is the saved state of a server session.
+//
+// It holds no secrets. Session keys belong to the WireGuard peers, not to swgp.
+type sessionStateEntry struct {
+	// ClientAddress is the address of the client, which identifies the session.
+	ClientAddress netip.AddrPort `json:"clientAddress"`
+
+	// OriginalDestination is the original destination address of the session's packets.
+	// It is only saved for sessions of a server with transparent routes.
+	OriginalDestination netip.AddrPort `json:"originalDestination"`
+
+	// KeyID is the proxy key ID of the session in the "zero-overhead-keyed" proxy mode.
+	KeyID uint8 `json:"keyID,omitempty"`
+
+	// WgConnPort is the local port of the session's wgConn. A restored session binds to the same port,
+	// so that packets from wgEndpoint reach the client without waiting for the client to send first.
+	WgConnPort uint16 `json:"wgConnPort"`
+
+	// ClientPktinfo is the pktinfo control message of the last packet from the client.
+	ClientPktinfo []byte `json:"clientPktinfo,omitempty"`
+
+	// ExpiresAt is when the session expires, unless a handshake extends it.
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	// CreatedAt is when the session was created. A restored session reaches the maximum session lifetime
+	// at the same time as it would have without the restart. Snapshots without it count from the restore.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// snapshotSessions returns the state of initialized UDP sessions.
+// The caller must hold s.mu.
+func (s *server) snapshotSessions() []sessionStateEntry {
+	entries := make([]sessionStateEntry, 0, len(s.table))
+	for key, natEntry := range s.table {
+		wgConn := natEntry.state.Load()
+		expiresAt := natEntry.expiresAt.Load()
+		if wgConn == nil || expiresAt == 0 {
+			continue
+		}
+
+		entry := sessionStateEntry{
+			ClientAddress:       key.clientAddrPort,
+			OriginalDestination: key.origDstAddrPort,
+			KeyID:               natEntry.keyID,
+			WgConnPort:          uint16(wgConn.LocalAddr().(*net.UDPAddr).Port),
+			ExpiresAt:           time.Unix(0, expiresAt),
+			CreatedAt:           natEntry.createdAt,
+		}
+		if clientPktinfop := natEntry.clientPktinfo.Load(); clientPktinfop != nil {
+			entry.ClientPktinfo = *clientPktinfop
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// saveSessionState writes the sessions to the session state file.
+// The file is replaced atomically, so a crash never leaves a partial snapshot behind.
+func (s *server) saveSessionState(entries []sessionStateEntry) {
+	b, err := json.Marshal(sessionState{
+		SavedAt:  time.Now(),
+		Sessions: entries,
+	})
+	if err == nil {
+		err = writeFileAtomic(s.sessionStateFile, b, 0o600)
+	}
+	if err != nil {
+		s.logger.Warn("Failed to save session state",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.String("sessionStateFile", s.sessionStateFile),
+			zap.Error(err),
+		)
+		return
+	}
+
+	s.logger.Info("Saved session state",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.String("sessionStateFile", s.sessionStateFile),
+		zap.Int("sessions", len(entries)),
+	)
+}
+
+// saveRunningSessionState saves the sessions of the running server to the session state file.
+// It does nothing if the server has no session state file, or is not running.
+func (s *server) saveRunningSessionState() {
+	if s.sessionStateFile == "" || s.proxyConn == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	entries := s.snapshotSessions()
+	s.mu.Unlock()
+
+	s.saveSessionState(entries)
+}
+
+// SaveSessionState saves the sessions of the running servers to their session state files, without stopping them.
+//
+// It is called before handing the listening sockets over to a new process with [Manager.ListenerFiles],
+// so that the new process restores the current sessions, and not the ones saved by the last stop.
+func (m *Manager) SaveSessionState() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.services {
+		if svc, ok := s.Service.(*server); ok {
+			svc.saveRunningSessionState()
+		}
+	}
+}
+
+// loadSessionState reads the session state file and returns the sessions that have not expired.
+// A missing file is not an error, as there is nothing to restore on the first start.
+func (s *server) loadSessionState() []sessionStateEntry {
+	var state sessionState
+	if err := jsonhelper.LoadAndDecodeDisallowUnknownFields(s.sessionStateFile, &state); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			s.logger.Warn("Failed to load session state",
+				zap.String("server", s.name),
+				zap.String("listenAddress", s.proxyListen),
+				zap.String("sessionStateFile", s.sessionStateFile),
+				zap.Error(err),
+			)
+		}
+		return nil
+	}
+
+	now := time.Now()
+	entries := make([]sessionStateEntry, 0, len(state.Sessions))
+	seen := make(map[serverSessionKey]struct{}, len(state.Sessions))
+
+	for _, entry := range state.Sessions {
+		if !entry.ExpiresAt.After(now) || !entry.ClientAddress.IsValid() || entry.WgConnPort == 0 {
+			continue
+		}
+		if !entry.CreatedAt.IsZero() {
+			if maxExpiresAt := s.sessionMaxExpiresAt(entry.CreatedAt); !maxExpiresAt.IsZero() && !maxExpiresAt.After(now) {
+				continue
+			}
+		}
+		key, _ := s.sessionKey(entry.ClientAddress, entry.OriginalDestination, entry.KeyID)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		if len(entry.ClientPktinfo) > 0 {
+			if _, _, err := conn.ParsePktinfoCmsg(entry.ClientPktinfo); err != nil {
+				entry.ClientPktinfo = nil
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	s.logger.Info("Loaded session state",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.String("sessionStateFile", s.sessionStateFile),
+		zap.Time("savedAt", state.SavedAt),
+		zap.Int("sessions", len(entries)),
+		zap.Int("prunedSessions", len(state.Sessions)-len(entries)),
+	)
+	return entries
+}
+
+// restoreSessions adds the sessions in the session state file to the table,
+// and calls startSession to start the relay goroutine of each restored session.
+//
+// It must be called before the proxyConn receive goroutine is started.
+func (s *server) restoreSessions(startSession func(key serverSessionKey, entry *sessionStateEntry, natEntry *serverNatEntry, wgConnSendCh chan queuedPacket)) {
+	if s.sessionStateFile == "" {
+		return
+	}
+
+	entries := s.loadSessionState()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range entries {
+		entry := &entries[i]
+		key, wgAddr := s.sessionKey(entry.ClientAddress, entry.OriginalDestination, entry.KeyID)
+		natEntry := s.newServerNatEntry(wgAddr, entry.KeyID, entry.ClientAddress)
+		if !entry.CreatedAt.IsZero() {
+			natEntry.createdAt = entry.CreatedAt
+		}
+		if len(entry.ClientPktinfo) > 0 {
+			clientPktinfoCache := entry.ClientPktinfo
+			natEntry.clientPktinfo.Store(&clientPktinfoCache)
+			natEntry.clientPktinfoCache = clientPktinfoCache
+		}
+		wgConnSendCh := make(chan queuedPacket, s.sendChannelCapacity)
+		natEntry.wgConnSendCh = wgConnSendCh
+		s.table[key] = natEntry
+		s.wg.Add(1)
+
+		startSession(key, entry, natEntry, wgConnSendCh)
+
+		if ce := s.logger.Check(zap.DebugLevel, "Restored server session"); ce != nil {
+			ce.Write(
+				zap.String("server", s.name),
+				zap.String("listenAddress", s.proxyListen),
+				zap.Stringer("clientAddress", entry.ClientAddress),
+				zap.Uint16("wgConnPort", entry.WgConnPort),
+				zap.Time("expiresAt", entry.ExpiresAt),
+			)
+		}
+	}
+}
+
+// retryListenRestoredWgConn retries creating the socket of a restored session, after binding its previous port failed with err,
+// because the port is in use, like by the old process during a graceful restart.
+//
+// It retries with exponential backoff for up to restoredWgConnBindTimeout, until the port is released, or the server is stopped.
+// Packets from the client queue up in the session's send channel in the meantime.
+func (s *server) retryListenRestoredWgConn(ctx context.Context, clientAddrPort netip.AddrPort, port uint16, err error) (*net.UDPConn, error) {
+	s.connLogger.Info("Port of restored session is in use, retrying",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.Stringer("clientAddress", clientAddrPort),
+		zap.Uint16("wgConnPort", port),
+	)
+
+	deadline := time.Now().Add(restoredWgConnBindTimeout)
+	backoff := restoredWgConnBindInitialBackoff
+
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, err
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-s.resolveCtx.Done():
+			timer.Stop()
+			return nil, err
+		}
+
+		var wgConn *net.UDPConn
+		wgConn, err = s.listenWgConn(ctx, port)
+		if err == nil || !conn.IsAddrInUse(err) {
+			return wgConn, err
+		}
+
+		backoff *= 2
+		if backoff > restoredWgConnBindMaxBackoff {
+			backoff = restoredWgConnBindMaxBackoff
+		}
+	}
+}
+
+// writeFileAtomic writes b to a temporary file in the directory of path, sets its mode to perm, and renames it to path.
+// The contents are flushed to disk before the rename, so that a crash cannot leave an empty or partial file behind.
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	// CreateTemp creates the file readable only by its owner.
+	if err == nil && perm != 0o600 {
+		err = os.Chmod(tmpPath, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
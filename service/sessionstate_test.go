@@ -0,0 +1,373 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/jsonhelper"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestServerSessionStateRestore(t *testing.T) {
+	psk := generateTestPSK(t)
+	handler, err := packet.NewZeroOverheadHandler(psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := ServerConfig{
+		Name:             "wg0",
+		ProxyListen:      ":20311",
+		ProxyMode:        "zero-overhead",
+		ProxyPSK:         psk,
+		WgEndpoint:       conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20312)),
+		MTU:              1500,
+		SessionStateFile: filepath.Join(t.TempDir(), "sessions.json"),
+	}
+
+	ctx := context.Background()
+	sc := Config{
+		Servers: []ServerConfig{serverConfig},
+	}
+
+	serverConn, err := conn.DefaultUDPClientListenConfig.ListenUDP(ctx, "udp", serverConfig.WgEndpoint.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	clientConn, err := net.Dial("udp", "[::1]:20311")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	headroom := handler.Headroom()
+	b := make([]byte, 1500)
+
+	// Create a session by sending a handshake initiation through the first server.
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	wgPacket := b[headroom.Front : headroom.Front+packet.WireGuardMessageLengthHandshakeInitiation]
+	if _, err = rand.Read(wgPacket); err != nil {
+		t.Fatal(err)
+	}
+	wgPacket[0] = packet.WireGuardMessageTypeHandshakeInitiation
+	// Leave the padding headroom well within the server's maximum packet size.
+	swgpPacketStart, swgpPacketLength, err := handler.EncryptZeroCopy(b[:1280], headroom.Front, len(wgPacket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = clientConn.Write(b[swgpPacketStart : swgpPacketStart+swgpPacketLength]); err != nil {
+		t.Fatal(err)
+	}
+
+	_, wgConnAddrPort, err := serverConn.ReadFromUDPAddrPort(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Stop()
+
+	// The second server restores the session, and relays packets from wgEndpoint
+	// to the client before the client sends anything.
+	m, err = sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	if sessions := m.Stats()[0].Sessions; sessions != 1 {
+		t.Fatalf("Expected 1 restored session, got %d", sessions)
+	}
+
+	responsePacket := make([]byte, packet.WireGuardMessageLengthHandshakeResponse)
+	if _, err = rand.Read(responsePacket); err != nil {
+		t.Fatal(err)
+	}
+	responsePacket[0] = packet.WireGuardMessageTypeHandshakeResponse
+
+	// The restored session binds its wgConn asynchronously.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err = serverConn.WriteToUDPAddrPort(responsePacket, wgConnAddrPort); err != nil {
+			t.Fatal(err)
+		}
+		if err = clientConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := clientConn.Read(b)
+		if err == nil {
+			wgPacketStart, wgPacketLength, err := handler.DecryptZeroCopy(b, 0, n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := b[wgPacketStart : wgPacketStart+wgPacketLength]; string(got) != string(responsePacket) {
+				t.Error("Relayed packet is different from original packet.")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Failed to receive packet relayed by restored session: %v", err)
+		}
+	}
+}
+
+func TestServerSessionStateRestoreWithoutPktinfo(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		batchMode  string
+		proxyPort  uint16
+		wgPort     uint16
+		clientPort uint16
+	}{
+		{"Default", "", 20612, 20613, 20614},
+		{"NoBatch", "no", 20615, 20616, 20617},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			serverConfig := ServerConfig{
+				Name:             "wg0",
+				ProxyListen:      fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:        "passthrough",
+				WgEndpoint:       conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPort)),
+				MTU:              1500,
+				SessionStateFile: filepath.Join(t.TempDir(), "sessions.json"),
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+			s, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// In the passthrough mode, the client's packets are WireGuard packets, so a fake endpoint stands in for the client.
+			client := newFakeWgEndpoint(t, fmt.Sprintf("[::1]:%d", c.clientPort))
+			endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+
+			// Pick a free port for the restored session's wgConn.
+			wgConn, err := net.ListenUDP("udp", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wgConnPort := uint16(wgConn.LocalAddr().(*net.UDPAddr).Port)
+			wgConn.Close()
+
+			// A session saved without the pktinfo of the client, like one that failed to parse.
+			s.saveSessionState([]sessionStateEntry{
+				{ClientAddress: client.AddrPort(), WgConnPort: wgConnPort, ExpiresAt: time.Now().Add(time.Minute)},
+			})
+
+			if err = s.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+
+			response := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeResponse, packet.WireGuardMessageLengthHandshakeResponse)
+			wgConnAddrPort := netip.AddrPortFrom(netip.IPv6Loopback(), wgConnPort)
+			waitFor(t, "restored session to relay a packet from wgEndpoint", func() bool {
+				if _, err := endpoint.conn.WriteToUDPAddrPort(response, wgConnAddrPort); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(20 * time.Millisecond)
+				return len(client.Received()) > 0
+			})
+			client.Expect(response)
+
+			if panics := s.Stats().Panics; panics != 0 {
+				t.Errorf("Expected no panics, got %d", panics)
+			}
+		})
+	}
+}
+
+func TestServerLoadSessionStatePrunesExpired(t *testing.T) {
+	serverConfig := ServerConfig{
+		Name:             "wg0",
+		ProxyListen:      ":20313",
+		ProxyMode:        "zero-overhead",
+		ProxyPSK:         generateTestPSK(t),
+		WgEndpoint:       conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20314)),
+		MTU:              1500,
+		SessionStateFile: filepath.Join(t.TempDir(), "sessions.json"),
+	}
+
+	s, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entries := s.loadSessionState(); len(entries) != 0 {
+		t.Errorf("Expected no sessions from missing file, got %d", len(entries))
+	}
+
+	now := time.Now()
+	live := netip.AddrPortFrom(netip.IPv6Loopback(), 1)
+	s.saveSessionState([]sessionStateEntry{
+		{ClientAddress: live, WgConnPort: 30000, ExpiresAt: now.Add(time.Minute)},
+		{ClientAddress: live, WgConnPort: 30001, ExpiresAt: now.Add(time.Minute)},
+		{ClientAddress: netip.AddrPortFrom(netip.IPv6Loopback(), 2), WgConnPort: 30002, ExpiresAt: now.Add(-time.Minute)},
+		{ClientAddress: netip.AddrPortFrom(netip.IPv6Loopback(), 3), ExpiresAt: now.Add(time.Minute)},
+	})
+
+	entries := s.loadSessionState()
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 session, got %d", len(entries))
+	}
+	if entries[0].ClientAddress != live || entries[0].WgConnPort != 30000 {
+		t.Errorf("Got session %+v, expected %v with wgConn port 30000", entries[0], live)
+	}
+}
+
+func TestServerSessionStateKeepsMaxLifetime(t *testing.T) {
+	serverConfig := ServerConfig{
+		Name:               "wg0",
+		ProxyListen:        ":20610",
+		ProxyMode:          "passthrough",
+		WgEndpoint:         conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20611)),
+		MTU:                1500,
+		SessionMaxLifetime: jsonhelper.Duration(time.Minute),
+		SessionStateFile:   filepath.Join(t.TempDir(), "sessions.json"),
+	}
+	s, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pick a free port for the restored session's wgConn.
+	c, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wgConnPort := uint16(c.LocalAddr().(*net.UDPAddr).Port)
+	c.Close()
+
+	now := time.Now()
+	live := netip.AddrPortFrom(netip.IPv6Loopback(), 1)
+	createdAt := now.Add(-30 * time.Second)
+	s.saveSessionState([]sessionStateEntry{
+		{ClientAddress: live, WgConnPort: wgConnPort, ExpiresAt: now.Add(2 * time.Minute), CreatedAt: createdAt},
+		{ClientAddress: netip.AddrPortFrom(netip.IPv6Loopback(), 2), WgConnPort: 30000, ExpiresAt: now.Add(2 * time.Minute), CreatedAt: now.Add(-2 * time.Minute)},
+	})
+
+	// The session past its maximum lifetime is not restored.
+	entries := s.loadSessionState()
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 session, got %d", len(entries))
+	}
+	if entries[0].ClientAddress != live || !entries[0].CreatedAt.Equal(createdAt) {
+		t.Errorf("Got session %+v, expected %v created at %v", entries[0], live, createdAt)
+	}
+
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// The restored session reaches its maximum lifetime when it would have without the restart,
+	// and not one lifetime after the restore.
+	var expiresAt int64
+	waitFor(t, "restored session to start", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, natEntry := range s.table {
+			expiresAt = natEntry.expiresAt.Load()
+		}
+		return expiresAt != 0
+	})
+	if got, expected := time.Unix(0, expiresAt), createdAt.Add(time.Minute); !got.Equal(expected) {
+		t.Errorf("Restored session expires at %v, expected %v", got, expected)
+	}
+
+	s.mu.Lock()
+	snapshot := s.snapshotSessions()
+	s.mu.Unlock()
+	if len(snapshot) != 1 || !snapshot[0].CreatedAt.Equal(createdAt) {
+		t.Errorf("Got snapshot %+v, expected a session created at %v", snapshot, createdAt)
+	}
+}
+
+func TestManagerInheritSocketsSessionState(t *testing.T) {
+	serverConfig := ServerConfig{
+		Name:             "wg0",
+		ProxyListen:      ":20607",
+		ProxyMode:        "passthrough",
+		WgEndpoint:       conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20608)),
+		MTU:              1500,
+		SessionStateFile: filepath.Join(t.TempDir(), "sessions.json"),
+	}
+	sc := Config{
+		Servers: []ServerConfig{serverConfig},
+	}
+
+	oldManager, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = oldManager.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stopped := false
+	defer func() {
+		if !stopped {
+			oldManager.Stop()
+		}
+	}()
+
+	// In the passthrough mode, the client's packets are WireGuard packets, so a fake peer stands in for the client.
+	peer := newFakeWgPeer(t, serverConfig.ProxyListen)
+	endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+	initiation := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+	peer.Send(initiation)
+	endpoint.Expect(initiation)
+
+	// Hand the socket over like a graceful restart: save the sessions first, then start the new process.
+	oldManager.SaveSessionState()
+	files, err := oldManager.ListenerFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newManager, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newManager.InheritSockets(files)
+	if err = newManager.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer newManager.Stop()
+
+	// The restored session waits for the old process to release its port, instead of giving up.
+	time.Sleep(100 * time.Millisecond)
+	if sessions := newManager.Stats()[0].Sessions; sessions != 1 {
+		t.Fatalf("Expected 1 restored session, got %d", sessions)
+	}
+
+	oldManager.Stop()
+	stopped = true
+
+	// Once bound, the restored session relays packets from wgEndpoint to the client without waiting for the client.
+	response := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeResponse, packet.WireGuardMessageLengthHandshakeResponse)
+	waitFor(t, "restored session to relay a packet from wgEndpoint", func() bool {
+		endpoint.Send(response)
+		time.Sleep(20 * time.Millisecond)
+		return len(peer.Received()) > 0
+	})
+	peer.Expect(response)
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/database64128/swgp-go/conn"
+)
+
+func TestServerSessionTableInitialCapacity(t *testing.T) {
+	defer func(max int) { maxSessionTableInitialCapacity = max }(maxSessionTableInitialCapacity)
+	maxSessionTableInitialCapacity = 8192
+
+	psk := generateTestPSK(t)
+	for _, c := range []struct {
+		name     string
+		capacity int
+		ok       bool
+	}{
+		{"Default", 0, true},
+		{"Preallocated", 4096, true},
+		{"Max", maxSessionTableInitialCapacity, true},
+		{"Negative", -1, false},
+		{"TooLarge", maxSessionTableInitialCapacity + 1, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			serverConfig := testReloadServerConfig("wg0", ":20433", psk)
+			serverConfig.SessionTableInitialCapacity = c.capacity
+			_, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache())
+			if ok := err == nil; ok != c.ok {
+				t.Errorf("Expected ok %v, got error %v", c.ok, err)
+			}
+		})
+	}
+}
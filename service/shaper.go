@@ -0,0 +1,104 @@
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// egressShaperMaxQueueDelay is the maximum amount of time a packet may wait in the egress shaper's queue.
+// Packets that would have to wait longer are dropped.
+const egressShaperMaxQueueDelay = 50 * time.Millisecond
+
+// egressShaperBatchWindow is the longest span of transmission slots sent together by one sendmmsg call.
+// A batch whose slots span longer is split, so that it is paced instead of sent in a burst.
+const egressShaperBatchWindow = time.Millisecond
+
+// egressShaper paces egress traffic to a fixed byte rate.
+//
+// The shaper maintains a virtual queue: each packet reserves a transmission slot
+// right after the previously reserved one, and the sender waits until its slot begins.
+// The queue is bounded by [egressShaperMaxQueueDelay]. When a reservation would exceed the bound,
+// the packet is dropped and counted.
+//
+// egressShaper is safe for concurrent use by multiple goroutines.
+type egressShaper struct {
+	mu sync.Mutex
+
+	// next is the time when the last reserved slot ends.
+	next time.Time
+
+	// nsPerByte is the transmission time of a single byte in nanoseconds.
+	nsPerByte float64
+
+	dropped atomic.Uint64
+}
+
+// newEgressShaper returns a new shaper that paces traffic to rate bytes per second.
+//
+// If rate is not positive, nil is returned. All methods are safe to call on a nil shaper.
+func newEgressShaper(rate int) *egressShaper {
+	if rate <= 0 {
+		return nil
+	}
+	return &egressShaper{
+		nsPerByte: float64(time.Second) / float64(rate),
+	}
+}
+
+// Reserve reserves a transmission slot for a packet of length n.
+//
+// It returns how long the caller must wait before sending the packet,
+// or false if the queue is full and the packet must be dropped.
+func (s *egressShaper) Reserve(n int) (time.Duration, bool) {
+	if s == nil {
+		return 0, true
+	}
+
+	now := time.Now()
+
+	s.mu.Lock()
+	start := s.next
+	if start.Before(now) {
+		start = now
+	}
+	delay := start.Sub(now)
+	if delay > egressShaperMaxQueueDelay {
+		s.mu.Unlock()
+		s.dropped.Add(1)
+		return 0, false
+	}
+	s.next = start.Add(time.Duration(float64(n) * s.nsPerByte))
+	s.mu.Unlock()
+
+	return delay, true
+}
+
+// Wait reserves a transmission slot for a packet of length n and blocks until the slot begins.
+//
+// It returns false if the queue is full and the packet must be dropped.
+func (s *egressShaper) Wait(n int) bool {
+	delay, ok := s.Reserve(n)
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return ok
+}
+
+// pacedBatchEnd returns the end of the sub-batch of messages that starts at start,
+// made of the messages whose slots, given by sendAt, begin within egressShaperBatchWindow of the first.
+func pacedBatchEnd(sendAt []time.Time, start int) int {
+	end := start + 1
+	for end < len(sendAt) && sendAt[end].Sub(sendAt[start]) < egressShaperBatchWindow {
+		end++
+	}
+	return end
+}
+
+// Dropped returns the number of packets dropped due to a full queue.
+func (s *egressShaper) Dropped() uint64 {
+	if s == nil {
+		return 0
+	}
+	return s.dropped.Load()
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEgressShaperReserve(t *testing.T) {
+	// 1000 bytes per second: each 10-byte packet takes 10ms.
+	s := newEgressShaper(1000)
+
+	for i := 0; i < 6; i++ {
+		delay, ok := s.Reserve(10)
+		if !ok {
+			t.Fatalf("Reservation %d dropped, expected queued", i)
+		}
+		if max := time.Duration(i) * 10 * time.Millisecond; delay > max {
+			t.Errorf("Reservation %d delay %v exceeds %v", i, delay, max)
+		}
+	}
+
+	// The queue now holds 60ms worth of packets, which exceeds the bound.
+	if _, ok := s.Reserve(10); ok {
+		t.Error("Expected reservation to be dropped due to full queue")
+	}
+	if dropped := s.Dropped(); dropped != 1 {
+		t.Errorf("Expected 1 dropped packet, got %d", dropped)
+	}
+}
+
+func TestEgressShaperNil(t *testing.T) {
+	s := newEgressShaper(0)
+	if s != nil {
+		t.Fatal("Expected nil shaper for zero rate")
+	}
+	if !s.Wait(1500) {
+		t.Error("Nil shaper must never drop packets")
+	}
+	if dropped := s.Dropped(); dropped != 0 {
+		t.Errorf("Expected 0 dropped packets, got %d", dropped)
+	}
+}
+
+func TestPacedBatchEnd(t *testing.T) {
+	now := time.Now()
+	sendAt := []time.Time{
+		now,
+		now.Add(egressShaperBatchWindow / 2),
+		now.Add(egressShaperBatchWindow),
+		now.Add(3 * egressShaperBatchWindow),
+		now.Add(3 * egressShaperBatchWindow),
+	}
+
+	var ends []int
+	for start := 0; start < len(sendAt); {
+		start = pacedBatchEnd(sendAt, start)
+		ends = append(ends, start)
+	}
+
+	expected := []int{2, 3, 5}
+	if len(ends) != len(expected) {
+		t.Fatalf("Got sub-batch ends %v, expected %v", ends, expected)
+	}
+	for i := range ends {
+		if ends[i] != expected[i] {
+			t.Fatalf("Got sub-batch ends %v, expected %v", ends, expected)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/jsonhelper"
+	"github.com/database64128/swgp-go/packet"
+)
+
+// shutdownTimeout is how long goroutines have to exit after the manager is stopped.
+const shutdownTimeout = 5 * time.Second
+
+func TestManagerStopReleasesGoroutinesAndSockets(t *testing.T) {
+	for _, c := range []struct {
+		name           string
+		proxyMode      string
+		batchMode      string
+		proxyTransport string
+		proxyPort      uint16
+		wgPort         uint16
+		clientPort     uint16
+		decoyPort      uint16
+		statsdPort     uint16
+		mirrorPort     uint16
+	}{
+		{"Paranoid", "paranoid", "", "", 20482, 20483, 20484, 20485, 20486, 20487},
+		{"ParanoidNoBatch", "paranoid", "no", "", 20488, 20489, 20490, 20491, 20492, 20493},
+		{"ZeroOverhead", "zero-overhead", "", "", 20494, 20495, 20496, 20497, 20498, 20499},
+		{"TCP", "paranoid", "", "tcp", 20500, 20501, 20502, 20503, 20504, 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			psk := generateTestPSK(t)
+
+			// Enable the features that run goroutines or hold sockets of their own.
+			serverConfig := ServerConfig{
+				Name:               "wg0",
+				ProxyListen:        fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:          c.proxyMode,
+				ProxyPSK:           psk,
+				ProxyTransport:     c.proxyTransport,
+				WgEndpoint:         conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPort)),
+				MTU:                1500,
+				EgressRateBps:      1 << 20,
+				HandshakeRateLimit: 100,
+				DecoyPorts:         []int{int(c.decoyPort)},
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+			if c.mirrorPort != 0 {
+				serverConfig.MirrorTo = netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), c.mirrorPort)
+			}
+
+			clientConfig := ClientConfig{
+				Name:           "wg0",
+				WgListen:       fmt.Sprintf(":%d", c.clientPort),
+				ProxyEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.proxyPort)),
+				ProxyMode:      c.proxyMode,
+				ProxyPSK:       psk,
+				ProxyTransport: c.proxyTransport,
+				MTU:            1500,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+
+			sc := Config{
+				Servers:             []ServerConfig{serverConfig},
+				Clients:             []ClientConfig{clientConfig},
+				StatsdAddr:          fmt.Sprintf("127.0.0.1:%d", c.statsdPort),
+				StatsdFlushInterval: jsonhelper.Duration(10 * time.Millisecond),
+				StatsLogInterval:    jsonhelper.Duration(10 * time.Millisecond),
+			}
+
+			goroutines := runtime.NumGoroutine()
+
+			// The fake WireGuard sockets are closed when the subtest ends, before the goroutines are counted.
+			t.Run("Traffic", func(t *testing.T) {
+				m, err := sc.Manager(logger)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = m.Start(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+
+				peer := newFakeWgPeer(t, clientConfig.WgListen)
+				endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+				endpoint.SetEcho(true)
+				if c.mirrorPort != 0 {
+					newFakeWgEndpoint(t, serverConfig.MirrorTo.String())
+				}
+
+				for _, p := range [][]byte{
+					newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation),
+					newTestWgPacket(t, packet.WireGuardMessageTypeData, 128),
+					newTestWgPacket(t, packet.WireGuardMessageTypeData, 1024),
+				} {
+					peer.Send(p)
+					peer.Expect(p)
+				}
+
+				m.Stop()
+			})
+
+			waitForGoroutines(t, goroutines)
+
+			// The listening sockets must have been closed, so their ports can be bound again right away.
+			listenUDP(t, serverConfig.ProxyListen)
+			listenUDP(t, clientConfig.WgListen)
+			listenUDP(t, fmt.Sprintf(":%d", c.decoyPort))
+			if c.proxyTransport == "tcp" {
+				ln, err := net.Listen("tcp", serverConfig.ProxyListen)
+				if err != nil {
+					t.Fatalf("Failed to rebind proxy TCP listener after stop: %v", err)
+				}
+				ln.Close()
+			}
+		})
+	}
+}
+
+// waitForGoroutines waits for the number of goroutines to drop to at most n,
+// and fails the test with the stacks of all goroutines if it does not in time.
+func waitForGoroutines(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(shutdownTimeout)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("%d goroutines still running after stop, expected at most %d:\n%s", runtime.NumGoroutine(), n, buf)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// listenUDP binds a UDP socket to address and closes it, failing the test if the address is still in use.
+func listenUDP(t *testing.T, address string) {
+	t.Helper()
+	c, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Fatalf("Failed to rebind %s after stop: %v", address, err)
+	}
+	c.Close()
+}
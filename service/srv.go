@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"go.uber.org/zap"
+)
+
+const (
+	// srvEndpointScheme is the URI scheme of WgEndpointSRV.
+	srvEndpointScheme = "srv://"
+
+	// defaultSRVRefreshInterval is the default interval between SRV lookups of WgEndpointSRV.
+	defaultSRVRefreshInterval = 30 * time.Second
+)
+
+// parseSRVEndpoint parses an srv://_service._proto.name URI and returns the SRV record name
+// _service._proto.name.
+func parseSRVEndpoint(uri string) (string, error) {
+	name, ok := strings.CutPrefix(uri, srvEndpointScheme)
+	if !ok {
+		return "", fmt.Errorf("wgEndpointSRV %q must start with %s", uri, srvEndpointScheme)
+	}
+	labels := strings.SplitN(name, ".", 3)
+	if len(labels) != 3 || len(labels[0]) < 2 || len(labels[1]) < 2 || labels[0][0] != '_' || labels[1][0] != '_' || labels[2] == "" {
+		return "", fmt.Errorf("wgEndpointSRV %q must be in the form srv://_service._proto.name", uri)
+	}
+	return name, nil
+}
+
+// srvEndpoint discovers the WireGuard endpoint of a server through an SRV record.
+type srvEndpoint struct {
+	name     string
+	interval time.Duration
+
+	// lookupSRV is [net.Resolver.LookupSRV]. Tests replace it.
+	lookupSRV func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+
+	wg sync.WaitGroup
+}
+
+// newSRVEndpoint returns a new SRV endpoint that looks up the record name every interval.
+func newSRVEndpoint(name string, interval time.Duration) *srvEndpoint {
+	if interval == 0 {
+		interval = defaultSRVRefreshInterval
+	}
+	return &srvEndpoint{
+		name:      name,
+		interval:  interval,
+		lookupSRV: net.DefaultResolver.LookupSRV,
+	}
+}
+
+// lookup looks up the SRV record and returns the target to use.
+//
+// The records are ordered by priority, and randomized by weight within a priority,
+// so the first record is the one to use.
+func (e *srvEndpoint) lookup(ctx context.Context) (conn.Addr, error) {
+	_, records, err := e.lookupSRV(ctx, "", "", e.name)
+	if err != nil {
+		return conn.Addr{}, err
+	}
+	if len(records) == 0 {
+		return conn.Addr{}, errors.New("no SRV records")
+	}
+	r := records[0]
+	return conn.AddrFromHostPort(strings.TrimSuffix(r.Target, "."), r.Port)
+}
+
+// startSRVEndpoint looks up the WireGuard endpoint, and keeps looking it up until the server stops.
+// The first lookup must succeed for the server to start.
+func (s *server) startSRVEndpoint(ctx context.Context) error {
+	e := s.srvEndpoint
+	if e == nil {
+		return nil
+	}
+
+	wgAddr, err := e.lookup(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to look up wgEndpointSRV %s: %w", e.name, err)
+	}
+	s.wgAddr.Store(&wgAddr)
+
+	s.logger.Info("Discovered WireGuard endpoint",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.String("wgEndpointSRV", e.name),
+		zap.Stringer("wgAddress", &wgAddr),
+	)
+
+	e.wg.Add(1)
+
+	go func() {
+		defer e.wg.Done()
+		s.refreshSRVEndpoint(s.resolveCtx)
+	}()
+
+	return nil
+}
+
+// refreshSRVEndpoint looks up the WireGuard endpoint every interval until ctx is canceled.
+// A changed target becomes the endpoint of new sessions. Existing sessions keep their endpoint.
+// On lookup failure, the last good target is kept.
+func (s *server) refreshSRVEndpoint(ctx context.Context) {
+	e := s.srvEndpoint
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		wgAddr, err := e.lookup(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.logger.Warn("Failed to look up wgEndpointSRV, keeping the last good target",
+				zap.String("server", s.name),
+				zap.String("listenAddress", s.proxyListen),
+				zap.String("wgEndpointSRV", e.name),
+				zap.Stringer("wgAddress", s.wgAddr.Load()),
+				zap.Error(err),
+			)
+			continue
+		}
+
+		if oldWgAddr := s.wgAddr.Load(); oldWgAddr.Equals(wgAddr) {
+			continue
+		}
+		s.migrateWgEndpoint(wgAddr)
+	}
+}
+
+// stopSRVEndpoint waits for the lookups to stop. The server's resolve context must have been canceled.
+func (s *server) stopSRVEndpoint() {
+	if s.srvEndpoint != nil {
+		s.srvEndpoint.wg.Wait()
+	}
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/jsonhelper"
+)
+
+func TestParseSRVEndpoint(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		uri      string
+		expected string
+		ok       bool
+	}{
+		{"Valid", "srv://_wireguard._udp.example.com", "_wireguard._udp.example.com", true},
+		{"ValidSingleLabelName", "srv://_wireguard._udp.svc", "_wireguard._udp.svc", true},
+		{"NoScheme", "_wireguard._udp.example.com", "", false},
+		{"WrongScheme", "dns://_wireguard._udp.example.com", "", false},
+		{"NoServiceUnderscore", "srv://wireguard._udp.example.com", "", false},
+		{"NoProtoUnderscore", "srv://_wireguard.udp.example.com", "", false},
+		{"NoName", "srv://_wireguard._udp", "", false},
+		{"EmptyName", "srv://_wireguard._udp.", "", false},
+		{"EmptyService", "srv://_._udp.example.com", "", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			name, err := parseSRVEndpoint(c.uri)
+			if ok := err == nil; ok != c.ok {
+				t.Fatalf("parseSRVEndpoint(%q) error = %v, want ok %t", c.uri, err, c.ok)
+			}
+			if name != c.expected {
+				t.Errorf("parseSRVEndpoint(%q) = %q, want %q", c.uri, name, c.expected)
+			}
+		})
+	}
+}
+
+// fakeSRVResolver answers SRV lookups with the records it is set to, or an error.
+type fakeSRVResolver struct {
+	mu      sync.Mutex
+	records []*net.SRV
+	err     error
+	lookups int
+}
+
+func (r *fakeSRVResolver) set(records []*net.SRV, err error) {
+	r.mu.Lock()
+	r.records, r.err = records, err
+	r.mu.Unlock()
+}
+
+func (r *fakeSRVResolver) lookupCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+func (r *fakeSRVResolver) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	return name, r.records, r.err
+}
+
+func TestServerSRVEndpoint(t *testing.T) {
+	serverConfig := ServerConfig{
+		Name:                  "wg0",
+		ProxyListen:           ":20388",
+		ProxyMode:             "zero-overhead",
+		ProxyPSK:              generateTestPSK(t),
+		WgEndpointSRV:         "srv://_wireguard._udp.example.com",
+		WgEndpointSRVInterval: jsonhelper.Duration(20 * time.Millisecond),
+		MTU:                   1500,
+	}
+
+	newServer := func(r *fakeSRVResolver) *server {
+		s, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.srvEndpoint.lookupSRV = r.LookupSRV
+		return s
+	}
+
+	waitFor := func(cond func() bool) bool {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				return false
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return true
+	}
+
+	var r fakeSRVResolver
+	r.set(nil, errors.New("no such host"))
+	if err := newServer(&r).Start(context.Background()); err == nil {
+		t.Fatal("Expected Start to fail when the first SRV lookup fails")
+	}
+
+	r.set([]*net.SRV{
+		{Target: "::1.", Port: 20389, Priority: 10},
+		{Target: "::1.", Port: 20390, Priority: 20},
+	}, nil)
+	s := newServer(&r)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	first := conn.AddrFromIPPort(netip.MustParseAddrPort("[::1]:20389"))
+	if got := *s.wgAddr.Load(); !got.Equals(first) {
+		t.Errorf("Expected discovered endpoint %s, got %s", first, got)
+	}
+
+	// A changed target becomes the endpoint of new sessions.
+	r.set([]*net.SRV{{Target: "::1.", Port: 20390}}, nil)
+	second := conn.AddrFromIPPort(netip.MustParseAddrPort("[::1]:20390"))
+	if !waitFor(func() bool { return s.wgAddr.Load().Equals(second) }) {
+		t.Fatalf("Expected endpoint to change to %s, got %s", second, s.wgAddr.Load())
+	}
+
+	// Failed lookups keep the last good target.
+	r.set(nil, errors.New("no such host"))
+	lookups := r.lookupCount()
+	if !waitFor(func() bool { return r.lookupCount() >= lookups+3 }) {
+		t.Fatal("Expected SRV lookups to continue")
+	}
+	if got := *s.wgAddr.Load(); !got.Equals(second) {
+		t.Errorf("Expected last good endpoint %s to be kept, got %s", second, got)
+	}
+}
+
+func TestServerConfigSRVEndpointValidation(t *testing.T) {
+	serverConfig := ServerConfig{
+		Name:          "wg0",
+		ProxyListen:   ":20388",
+		ProxyMode:     "zero-overhead",
+		ProxyPSK:      generateTestPSK(t),
+		WgEndpoint:    conn.AddrFromIPPort(netip.MustParseAddrPort("[::1]:20389")),
+		WgEndpointSRV: "srv://_wireguard._udp.example.com",
+		MTU:           1500,
+	}
+	if _, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache()); err == nil {
+		t.Error("Expected error with both wgEndpoint and wgEndpointSRV set")
+	}
+
+	serverConfig.WgEndpoint = conn.Addr{}
+	serverConfig.WgEndpointSRV = "_wireguard._udp.example.com"
+	if _, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache()); err == nil {
+		t.Error("Expected error with wgEndpointSRV not being an srv:// URI")
+	}
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// detachedContext carries the values of its parent, but not its deadline or cancellation.
+//
+// Services keep the context passed to their Start method for their whole lifetime,
+// for example to resolve addresses of new sessions. The context of [Manager.Start]
+// only bounds the bring-up, so services are started with a detached copy of it.
+type detachedContext struct {
+	parent context.Context
+}
+
+// Deadline implements the [context.Context] Deadline method.
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// Done implements the [context.Context] Done method.
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+// Err implements the [context.Context] Err method.
+func (detachedContext) Err() error {
+	return nil
+}
+
+// Value implements the [context.Context] Value method.
+func (c detachedContext) Value(key any) any {
+	return c.parent.Value(key)
+}
+
+// startService starts s with a context detached from ctx, and gives up when ctx is done.
+//
+// If s finishes starting after ctx is done, it is stopped right away, closing its sockets.
+func (m *Manager) startService(ctx context.Context, s Service) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("gave up starting %s: %w", s.String(), err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Start(detachedContext{ctx})
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return fmt.Errorf("failed to start %s: %w", s.String(), err)
+		}
+		return nil
+	case <-ctx.Done():
+		go func() {
+			if err := <-errCh; err == nil {
+				m.stopService(s)
+			}
+		}()
+		return fmt.Errorf("gave up starting %s: %w", s.String(), ctx.Err())
+	}
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+// hangingService is a [Service] whose Start blocks until release is closed.
+type hangingService struct {
+	release chan struct{}
+	stopped chan struct{}
+}
+
+func (*hangingService) String() string {
+	return "hang0 test service"
+}
+
+func (s *hangingService) Start(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); ok {
+		return errors.New("service context must not carry the start deadline")
+	}
+	<-s.release
+	return nil
+}
+
+func (s *hangingService) Stop() error {
+	close(s.stopped)
+	return nil
+}
+
+func (*hangingService) Stats() Stats {
+	return Stats{}
+}
+
+func TestManagerStartTimeout(t *testing.T) {
+	sc := Config{
+		Servers: []ServerConfig{
+			testReloadServerConfig("wg0", ":20320", generateTestPSK(t)),
+		},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hang := &hangingService{
+		release: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	m.services = append(m.services, managedService{
+		Service: hang,
+		role:    "server",
+		name:    "hang0",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	err = m.Start(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), hang.String()) {
+		t.Errorf("Expected error to name %q, got %v", hang.String(), err)
+	}
+
+	// The service started before the hung one must have been stopped.
+	assertPortInUse(t, ":20320", false)
+	if len(m.services) != 0 {
+		t.Errorf("Expected no services after failed start, got %d", len(m.services))
+	}
+
+	// The hung service is stopped once it finishes starting.
+	close(hang.release)
+	select {
+	case <-hang.stopped:
+	case <-time.After(5 * time.Second):
+		t.Error("Hung service was not stopped after it finished starting")
+	}
+
+	m.Stop()
+}
+
+func TestDetachedContext(t *testing.T) {
+	type key struct{}
+	parent, cancel := context.WithTimeout(context.WithValue(context.Background(), key{}, "value"), time.Hour)
+	cancel()
+
+	ctx := detachedContext{parent}
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("Expected no deadline")
+	}
+	if ctx.Done() != nil || ctx.Err() != nil {
+		t.Error("Expected detached context not to be canceled")
+	}
+	if v := ctx.Value(key{}); v != "value" {
+		t.Errorf("Expected parent value, got %v", v)
+	}
+}
+
+// shuffledStartOrder returns a start order hook that shuffles the bring-up with the seed.
+func shuffledStartOrder(seed int64) func(n int) []int {
+	return func(n int) []int {
+		return rand.New(rand.NewSource(seed)).Perm(n)
+	}
+}
+
+func TestManagerStartShuffled(t *testing.T) {
+	psk := generateTestPSK(t)
+
+	var (
+		serverConfigs []ServerConfig
+		clientConfigs []ClientConfig
+	)
+	for i, ports := range [][3]uint16{{20377, 20378, 20379}, {20380, 20381, 20382}} {
+		name := fmt.Sprintf("wg%d", i)
+		serverConfigs = append(serverConfigs, ServerConfig{
+			Name:        name,
+			ProxyListen: fmt.Sprintf(":%d", ports[0]),
+			ProxyMode:   "zero-overhead",
+			ProxyPSK:    psk,
+			WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), ports[1])),
+			MTU:         1500,
+		})
+		clientConfigs = append(clientConfigs, ClientConfig{
+			Name:          name,
+			WgListen:      fmt.Sprintf(":%d", ports[2]),
+			ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), ports[0])),
+			ProxyMode:     "zero-overhead",
+			ProxyPSK:      psk,
+			MTU:           1500,
+		})
+	}
+
+	for seed := int64(1); seed <= 5; seed++ {
+		t.Run(fmt.Sprintf("Seed%d", seed), func(t *testing.T) {
+			sc := Config{
+				Servers: serverConfigs,
+				Clients: clientConfigs,
+			}
+			m, err := sc.Manager(logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.startOrder = shuffledStartOrder(seed)
+			if err = m.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := range serverConfigs {
+				peer := newFakeWgPeer(t, clientConfigs[i].WgListen)
+				endpoint := newFakeWgEndpoint(t, serverConfigs[i].WgEndpoint.String())
+				endpoint.SetEcho(true)
+
+				handshakeInitiationPacket := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+				peer.Send(handshakeInitiationPacket)
+				peer.Expect(handshakeInitiationPacket)
+			}
+
+			m.Stop()
+
+			for i := range serverConfigs {
+				assertPortInUse(t, serverConfigs[i].ProxyListen, false)
+				assertPortInUse(t, clientConfigs[i].WgListen, false)
+			}
+		})
+	}
+}
+
+func TestManagerStartShuffledFailure(t *testing.T) {
+	psk := generateTestPSK(t)
+
+	taken, err := net.ListenPacket("udp", ":20385")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	serverConfigs := []ServerConfig{
+		testReloadServerConfig("wg0", ":20383", psk),
+		testReloadServerConfig("wg1", ":20384", psk),
+		testReloadServerConfig("wg2", ":20385", psk),
+	}
+	serverConfigs[1].DecoyPorts = []int{20386}
+	serverConfigs[2].DecoyPorts = []int{20387}
+
+	for seed := int64(1); seed <= 5; seed++ {
+		t.Run(fmt.Sprintf("Seed%d", seed), func(t *testing.T) {
+			sc := Config{Servers: serverConfigs}
+			m, err := sc.Manager(logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.startOrder = shuffledStartOrder(seed)
+			if err = m.Start(context.Background()); err == nil {
+				m.Stop()
+				t.Fatal("Expected Start to fail with a listen address in use")
+			}
+
+			// Whatever was started before the failing server must have been stopped.
+			if len(m.services) != 0 {
+				t.Errorf("Expected no services after failed start, got %d", len(m.services))
+			}
+			assertPortInUse(t, ":20383", false)
+			assertPortInUse(t, ":20384", false)
+			assertPortInUse(t, ":20386", false)
+			assertPortInUse(t, ":20387", false)
+		})
+	}
+}
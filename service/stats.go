@@ -0,0 +1,216 @@
+package service
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of a service's counters and gauges.
+//
+// Uplink is the direction from the client's WireGuard peer to the server's WireGuard endpoint.
+// Downlink is the opposite direction. Traffic is counted in WireGuard packets and bytes.
+type Stats struct {
+	// Sessions is the number of active sessions.
+	Sessions int
+
+	UplinkPackets   uint64
+	UplinkBytes     uint64
+	DownlinkPackets uint64
+	DownlinkBytes   uint64
+
+	// OversizedPackets is the number of packets dropped for exceeding the maximum packet length.
+	OversizedPackets uint64
+
+	// MalformedPackets is the number of decrypted packets dropped for having a length
+	// that does not match their WireGuard message type.
+	MalformedPackets uint64
+
+	// PortsExhausted is the number of sessions that failed to start because
+	// every port in the upstream port range was in use. It is only counted by servers.
+	PortsExhausted uint64
+
+	// UpstreamUnreachable is the number of ICMP port-unreachable errors received from the WireGuard endpoint.
+	// It is only counted by servers with onUpstreamUnreachable set, on Linux.
+	UpstreamUnreachable uint64
+
+	// LifetimeEvictions is the number of sessions evicted for reaching the maximum session lifetime.
+	// It is only counted by servers.
+	LifetimeEvictions uint64
+
+	// QuiescedPackets is the number of packets dropped while the server was quiesced.
+	// It is only counted by servers.
+	QuiescedPackets uint64
+
+	// DecryptFailures is the number of swgp packets dropped for failing to decrypt.
+	DecryptFailures uint64
+
+	// SendErrors is the number of failed socket writes. A failed batch write is counted once,
+	// even if it dropped more than one packet.
+	SendErrors uint64
+
+	// QueueFullPackets is the number of packets dropped because the session's send channel was full.
+	QueueFullPackets uint64
+
+	// DisallowedPackets is the number of packets dropped for coming from a disallowed source.
+	// It is only counted by clients.
+	DisallowedPackets uint64
+
+	// EgressShaperDropped is the number of packets dropped by the egress shaper.
+	// It is only counted by servers.
+	EgressShaperDropped uint64
+
+	// SessionRateDropped is the number of packets dropped by per-session rate limiting.
+	// It is only counted by servers.
+	SessionRateDropped uint64
+
+	// HandshakesLimited is the number of handshake initiations dropped by the handshake rate limit.
+	// It is only counted by servers.
+	HandshakesLimited uint64
+
+	// DecryptBudgetShed is the number of packets dropped before decryption for exceeding the decrypt budget.
+	// It is only counted by servers with decryptBudgetPerSec.
+	DecryptBudgetShed uint64
+
+	// SessionlessData is the number of data packets received from clients without a session,
+	// and SessionlessDropped is the number of them dropped by dropSessionlessData.
+	// The rest started sessions. They are only counted by servers.
+	SessionlessData    uint64
+	SessionlessDropped uint64
+
+	// BackoffDropped is the number of packets dropped while the resolution of their session's WireGuard endpoint
+	// was being retried, by the drop backoff behavior, or to make room in the buffer of the buffer behavior.
+	// It is only counted by servers with backoffBehavior.
+	BackoffDropped uint64
+
+	// ExpiredKeyPackets is the number of packets dropped for carrying a proxy key past its notAfter time.
+	// It is only counted by servers in the "zero-overhead-keyed" proxy mode.
+	ExpiredKeyPackets uint64
+
+	// CookieChallenges is the number of cookie challenges sent.
+	// It is only counted by servers that require cookies.
+	CookieChallenges uint64
+
+	// InvalidCookies is the number of cookie echoes dropped for carrying an invalid cookie.
+	// It is only counted by servers that require cookies.
+	InvalidCookies uint64
+
+	// DecoyPackets and DecoyBytes count packets received and discarded on decoy ports.
+	// They are only counted by servers with decoy ports.
+	DecoyPackets uint64
+	DecoyBytes   uint64
+
+	// MirroredPackets is the number of packet copies sent to the mirror endpoint, and
+	// MirrorDropped is the number of copies dropped because they could not be sent fast enough or failed to send.
+	// Dropped copies do not affect the relayed packets. They are only counted by servers with mirrorTo.
+	MirroredPackets uint64
+	MirrorDropped   uint64
+
+	// BundlesSent is the number of bundles sent by proxyCoalesce, and BundledPackets is the number of
+	// WireGuard packets they carried. Bundled packets are also counted in the traffic counters.
+	BundlesSent    uint64
+	BundledPackets uint64
+
+	// ReceiveDrops is the number of packets the kernel dropped on the service's listener
+	// because its receive buffer was full. Increase the receive buffer size if it keeps growing.
+	// It is only reported on Linux.
+	ReceiveDrops uint64
+
+	// Panics is the number of panics recovered in the service's receive loops.
+	// It stays at 0 with disablePanicRecovery, which lets panics crash the process.
+	Panics uint64
+
+	// HandshakeRTT is the smoothed round-trip time of WireGuard handshakes relayed by the service,
+	// or 0 if no handshake has completed.
+	HandshakeRTT time.Duration
+
+	// ProxyDown is whether the client has been sending packets to its proxy endpoint
+	// without receiving any back for longer than the proxy health timeout.
+	// It is only reported by clients.
+	ProxyDown bool
+
+	// SessionRates are the current rates of the server's sessions, ordered by client address.
+	// They are only reported by servers with per-session rate limiting.
+	SessionRates []SessionRate
+
+	// Tenants are the stats of the server's proxy keys, ordered by key ID.
+	// They are only reported by servers in the "zero-overhead-keyed" proxy mode,
+	// and, unlike the service's own counters, start from zero when the server is restarted by a reload.
+	Tenants []TenantStats
+}
+
+// DroppedPackets returns the total number of packets dropped for any reason.
+func (s *Stats) DroppedPackets() uint64 {
+	return s.OversizedPackets +
+		s.MalformedPackets +
+		s.QuiescedPackets +
+		s.DecryptFailures +
+		s.QueueFullPackets +
+		s.DisallowedPackets +
+		s.EgressShaperDropped +
+		s.SessionRateDropped +
+		s.HandshakesLimited +
+		s.DecryptBudgetShed +
+		s.SessionlessDropped +
+		s.BackoffDropped +
+		s.ExpiredKeyPackets +
+		s.InvalidCookies +
+		s.ReceiveDrops
+}
+
+// addCounters adds the counters of o to s. Gauges are left unchanged.
+func (s *Stats) addCounters(o *Stats) {
+	s.UplinkPackets += o.UplinkPackets
+	s.UplinkBytes += o.UplinkBytes
+	s.DownlinkPackets += o.DownlinkPackets
+	s.DownlinkBytes += o.DownlinkBytes
+	s.OversizedPackets += o.OversizedPackets
+	s.MalformedPackets += o.MalformedPackets
+	s.PortsExhausted += o.PortsExhausted
+	s.UpstreamUnreachable += o.UpstreamUnreachable
+	s.LifetimeEvictions += o.LifetimeEvictions
+	s.QuiescedPackets += o.QuiescedPackets
+	s.DecryptFailures += o.DecryptFailures
+	s.SendErrors += o.SendErrors
+	s.QueueFullPackets += o.QueueFullPackets
+	s.DisallowedPackets += o.DisallowedPackets
+	s.EgressShaperDropped += o.EgressShaperDropped
+	s.SessionRateDropped += o.SessionRateDropped
+	s.HandshakesLimited += o.HandshakesLimited
+	s.DecryptBudgetShed += o.DecryptBudgetShed
+	s.SessionlessData += o.SessionlessData
+	s.SessionlessDropped += o.SessionlessDropped
+	s.BackoffDropped += o.BackoffDropped
+	s.ExpiredKeyPackets += o.ExpiredKeyPackets
+	s.CookieChallenges += o.CookieChallenges
+	s.InvalidCookies += o.InvalidCookies
+	s.DecoyPackets += o.DecoyPackets
+	s.DecoyBytes += o.DecoyBytes
+	s.MirroredPackets += o.MirroredPackets
+	s.MirrorDropped += o.MirrorDropped
+	s.BundlesSent += o.BundlesSent
+	s.BundledPackets += o.BundledPackets
+	s.ReceiveDrops += o.ReceiveDrops
+	s.Panics += o.Panics
+}
+
+// trafficCounters counts packets and bytes relayed in one direction.
+type trafficCounters struct {
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+}
+
+// add adds n packets totalling b bytes to the counters.
+func (c *trafficCounters) add(n, b uint64) {
+	c.packets.Add(n)
+	c.bytes.Add(b)
+}
+
+// counterDelta returns the increase of a counter from prev to cur.
+// A counter smaller than its previous value means the service was restarted,
+// and the full value is returned.
+func counterDelta(cur, prev uint64) uint64 {
+	if cur >= prev {
+		return cur - prev
+	}
+	return cur
+}
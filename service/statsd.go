@@ -0,0 +1,277 @@
+package service
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultStatsdFlushInterval is the default interval between statsd pushes.
+	defaultStatsdFlushInterval = 10 * time.Second
+
+	// statsdMaxPacketSize is the maximum size of a statsd packet.
+	// It fits in a single IPv6 packet on a 1500-byte MTU path.
+	statsdMaxPacketSize = 1432
+
+	// statsdMetricPrefix is the prefix of all statsd metric names.
+	statsdMetricPrefix = "swgp."
+)
+
+// statsdExporter periodically pushes service stats to a statsd server over UDP.
+//
+// Gauges are sent as statsd gauges. Counters are sent as statsd counters,
+// with values being the deltas since the previous push.
+type statsdExporter struct {
+	addr          string
+	flushInterval time.Duration
+	stats         func() []ServiceStats
+	logger        *zap.Logger
+	conn          net.Conn
+	last          map[string]Stats
+	buf           []byte
+	done          chan struct{}
+	wg            sync.WaitGroup
+
+	// bufferPoolBytes, if not nil, returns the memory retained by the packet buffer pools.
+	bufferPoolBytes func() uint64
+
+	// runtime, if not nil, adds Go runtime metrics to every push.
+	runtime *runtimeStats
+
+	// tags is appended to every metric line. It is empty when there are no tags.
+	tags string
+}
+
+// newStatsdExporter returns a new statsd exporter that pushes the stats returned by stats to addr.
+func newStatsdExporter(addr string, flushInterval time.Duration, stats func() []ServiceStats, logger *zap.Logger) *statsdExporter {
+	if flushInterval <= 0 {
+		flushInterval = defaultStatsdFlushInterval
+	}
+	return &statsdExporter{
+		addr:          addr,
+		flushInterval: flushInterval,
+		stats:         stats,
+		logger:        logger,
+		last:          make(map[string]Stats),
+		buf:           make([]byte, 0, statsdMaxPacketSize),
+	}
+}
+
+// setNodeID tags every metric with the node ID. An empty node ID is not sent.
+func (e *statsdExporter) setNodeID(nodeID string) {
+	if nodeID == "" {
+		e.tags = ""
+		return
+	}
+	e.tags = "|#node:" + statsdSanitizeTagValue(nodeID)
+}
+
+// Start starts pushing stats.
+func (e *statsdExporter) Start(ctx context.Context) error {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", e.addr)
+	if err != nil {
+		return err
+	}
+	e.conn = c
+	e.done = make(chan struct{})
+
+	e.wg.Add(1)
+
+	go func() {
+		defer e.wg.Done()
+
+		ticker := time.NewTicker(e.flushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				e.flush()
+			case <-e.done:
+				return
+			}
+		}
+	}()
+
+	e.logger.Info("Started statsd exporter",
+		zap.String("statsdAddress", e.addr),
+		zap.Duration("flushInterval", e.flushInterval),
+	)
+	return nil
+}
+
+// Stop pushes the final stats and stops the exporter.
+// It is a no-op if the exporter was not started.
+func (e *statsdExporter) Stop() error {
+	if e.conn == nil {
+		return nil
+	}
+
+	close(e.done)
+	e.wg.Wait()
+	e.flush()
+
+	e.logger.Info("Stopped statsd exporter", zap.String("statsdAddress", e.addr))
+	return e.conn.Close()
+}
+
+// flush pushes the current stats to the statsd server.
+func (e *statsdExporter) flush() {
+	all := e.stats()
+	last := make(map[string]Stats, len(all))
+
+	for i := range all {
+		ss := &all[i]
+		key := ss.Role + ":" + ss.Name
+		prev := e.last[key]
+		last[key] = ss.Stats
+
+		prefix := statsdMetricPrefix + ss.Role + "." + statsdSanitizeName(ss.Name) + "."
+		e.appendMetric(prefix, "sessions", uint64(ss.Sessions), "|g")
+		e.appendCounter(prefix, "uplink_packets", ss.UplinkPackets, prev.UplinkPackets)
+		e.appendCounter(prefix, "uplink_bytes", ss.UplinkBytes, prev.UplinkBytes)
+		e.appendCounter(prefix, "downlink_packets", ss.DownlinkPackets, prev.DownlinkPackets)
+		e.appendCounter(prefix, "downlink_bytes", ss.DownlinkBytes, prev.DownlinkBytes)
+		e.appendCounter(prefix, "oversized_packets", ss.OversizedPackets, prev.OversizedPackets)
+		e.appendCounter(prefix, "malformed_packets", ss.MalformedPackets, prev.MalformedPackets)
+		e.appendCounter(prefix, "ports_exhausted", ss.PortsExhausted, prev.PortsExhausted)
+		e.appendCounter(prefix, "upstream_unreachable", ss.UpstreamUnreachable, prev.UpstreamUnreachable)
+		e.appendCounter(prefix, "lifetime_evictions", ss.LifetimeEvictions, prev.LifetimeEvictions)
+		e.appendCounter(prefix, "quiesced_packets", ss.QuiescedPackets, prev.QuiescedPackets)
+		e.appendCounter(prefix, "decrypt_failures", ss.DecryptFailures, prev.DecryptFailures)
+		e.appendCounter(prefix, "send_errors", ss.SendErrors, prev.SendErrors)
+		e.appendCounter(prefix, "queue_full_packets", ss.QueueFullPackets, prev.QueueFullPackets)
+		e.appendCounter(prefix, "disallowed_packets", ss.DisallowedPackets, prev.DisallowedPackets)
+		e.appendCounter(prefix, "egress_shaper_dropped", ss.EgressShaperDropped, prev.EgressShaperDropped)
+		e.appendCounter(prefix, "session_rate_dropped", ss.SessionRateDropped, prev.SessionRateDropped)
+		e.appendCounter(prefix, "handshakes_limited", ss.HandshakesLimited, prev.HandshakesLimited)
+		e.appendCounter(prefix, "decrypt_budget_shed", ss.DecryptBudgetShed, prev.DecryptBudgetShed)
+		e.appendCounter(prefix, "sessionless_data", ss.SessionlessData, prev.SessionlessData)
+		e.appendCounter(prefix, "sessionless_dropped", ss.SessionlessDropped, prev.SessionlessDropped)
+		e.appendCounter(prefix, "backoff_dropped", ss.BackoffDropped, prev.BackoffDropped)
+		e.appendCounter(prefix, "expired_key_packets", ss.ExpiredKeyPackets, prev.ExpiredKeyPackets)
+		e.appendCounter(prefix, "cookie_challenges", ss.CookieChallenges, prev.CookieChallenges)
+		e.appendCounter(prefix, "invalid_cookies", ss.InvalidCookies, prev.InvalidCookies)
+		e.appendCounter(prefix, "decoy_packets", ss.DecoyPackets, prev.DecoyPackets)
+		e.appendCounter(prefix, "decoy_bytes", ss.DecoyBytes, prev.DecoyBytes)
+		e.appendCounter(prefix, "mirrored_packets", ss.MirroredPackets, prev.MirroredPackets)
+		e.appendCounter(prefix, "mirror_dropped", ss.MirrorDropped, prev.MirrorDropped)
+		e.appendCounter(prefix, "bundles_sent", ss.BundlesSent, prev.BundlesSent)
+		e.appendCounter(prefix, "bundled_packets", ss.BundledPackets, prev.BundledPackets)
+		e.appendCounter(prefix, "receive_drops", ss.ReceiveDrops, prev.ReceiveDrops)
+		e.appendCounter(prefix, "panics", ss.Panics, prev.Panics)
+		if ss.Role == "client" {
+			var proxyUp uint64
+			if !ss.ProxyDown {
+				proxyUp = 1
+			}
+			e.appendMetric(prefix, "proxy_up", proxyUp, "|g")
+		}
+		if ss.HandshakeRTT > 0 {
+			e.appendMetric(prefix, "handshake_rtt_us", uint64(ss.HandshakeRTT/time.Microsecond), "|g")
+		}
+		for _, ts := range ss.Tenants {
+			tenantPrefix := prefix + "tenant." + statsdSanitizeName(ts.Name) + "."
+			tprev := prev.tenant(ts.KeyID)
+			e.appendMetric(tenantPrefix, "sessions", uint64(ts.Sessions), "|g")
+			if !ts.NotAfter.IsZero() {
+				var expired uint64
+				if ts.Expired {
+					expired = 1
+				}
+				e.appendMetric(tenantPrefix, "expired", expired, "|g")
+			}
+			e.appendCounter(tenantPrefix, "uplink_packets", ts.UplinkPackets, tprev.UplinkPackets)
+			e.appendCounter(tenantPrefix, "uplink_bytes", ts.UplinkBytes, tprev.UplinkBytes)
+			e.appendCounter(tenantPrefix, "downlink_packets", ts.DownlinkPackets, tprev.DownlinkPackets)
+			e.appendCounter(tenantPrefix, "downlink_bytes", ts.DownlinkBytes, tprev.DownlinkBytes)
+		}
+	}
+
+	if e.bufferPoolBytes != nil {
+		e.appendMetric(statsdMetricPrefix, "buffer_pool_bytes", e.bufferPoolBytes(), "|g")
+	}
+
+	if e.runtime != nil {
+		e.runtime.appendMetrics(e)
+	}
+
+	e.last = last
+	e.send()
+}
+
+// appendCounter appends a counter metric with the delta between cur and prev.
+// Zero deltas are omitted. A counter smaller than its previous value means the service
+// was restarted, and the full value is sent.
+func (e *statsdExporter) appendCounter(prefix, name string, cur, prev uint64) {
+	delta := counterDelta(cur, prev)
+	if delta == 0 {
+		return
+	}
+	e.appendMetric(prefix, name, delta, "|c")
+}
+
+// appendMetric appends a metric line to the send buffer,
+// sending the buffer first if the line does not fit.
+func (e *statsdExporter) appendMetric(prefix, name string, value uint64, suffix string) {
+	lineLen := len(prefix) + len(name) + 1 + 20 + len(suffix) + len(e.tags)
+	if len(e.buf) > 0 && len(e.buf)+1+lineLen > statsdMaxPacketSize {
+		e.send()
+	}
+	if len(e.buf) > 0 {
+		e.buf = append(e.buf, '\n')
+	}
+	e.buf = append(e.buf, prefix...)
+	e.buf = append(e.buf, name...)
+	e.buf = append(e.buf, ':')
+	e.buf = strconv.AppendUint(e.buf, value, 10)
+	e.buf = append(e.buf, suffix...)
+	e.buf = append(e.buf, e.tags...)
+}
+
+// send writes the send buffer to the statsd server and resets it.
+func (e *statsdExporter) send() {
+	if len(e.buf) == 0 {
+		return
+	}
+	if _, err := e.conn.Write(e.buf); err != nil {
+		e.logger.Warn("Failed to send statsd packet",
+			zap.String("statsdAddress", e.addr),
+			zap.Error(err),
+		)
+	}
+	e.buf = e.buf[:0]
+}
+
+// statsdSanitizeName replaces characters that have special meanings in statsd metric names.
+func statsdSanitizeName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// statsdSanitizeTagValue replaces characters that have special meanings in DogStatsD tags.
+// Unlike metric names, tag values may contain dots, so hostnames are kept intact.
+func statsdSanitizeTagValue(value string) string {
+	b := []byte(value)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '/':
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
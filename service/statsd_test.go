@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+)
+
+func TestStatsdExporterFlush(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	stats := []ServiceStats{
+		{
+			Role: "server",
+			Name: "wg.0",
+			Stats: Stats{
+				Sessions:      2,
+				UplinkPackets: 10,
+				UplinkBytes:   1000,
+			},
+		},
+	}
+
+	e := newStatsdExporter(pc.LocalAddr().String(), time.Hour, func() []ServiceStats { return stats }, logger)
+	if err = e.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	b := make([]byte, statsdMaxPacketSize)
+
+	readLines := func() string {
+		t.Helper()
+		if err := pc.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		n, _, err := pc.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b[:n])
+	}
+
+	e.flush()
+	const expectedFirst = "swgp.server.wg_0.sessions:2|g\nswgp.server.wg_0.uplink_packets:10|c\nswgp.server.wg_0.uplink_bytes:1000|c"
+	if got := readLines(); got != expectedFirst {
+		t.Errorf("First flush: got %q, want %q", got, expectedFirst)
+	}
+
+	// Counters are sent as deltas, and unchanged counters are omitted.
+	stats[0].Sessions = 1
+	stats[0].UplinkPackets = 15
+	stats[0].UplinkBytes = 1500
+	stats[0].DownlinkPackets = 3
+	e.flush()
+	const expectedSecond = "swgp.server.wg_0.sessions:1|g\nswgp.server.wg_0.uplink_packets:5|c\nswgp.server.wg_0.uplink_bytes:500|c\nswgp.server.wg_0.downlink_packets:3|c"
+	if got := readLines(); got != expectedSecond {
+		t.Errorf("Second flush: got %q, want %q", got, expectedSecond)
+	}
+
+	// A counter reset sends the full value.
+	stats[0].UplinkPackets = 4
+	e.flush()
+	if got := readLines(); !strings.Contains(got, "swgp.server.wg_0.uplink_packets:4|c") {
+		t.Errorf("Flush after reset: got %q", got)
+	}
+}
+
+func TestStatsdExporterNodeIDTag(t *testing.T) {
+	e := newStatsdExporter("127.0.0.1:8125", time.Hour, nil, logger)
+	e.setNodeID("vps1.example.com")
+	e.appendMetric("swgp.server.wg0.", "sessions", 1, "|g")
+	e.appendCounter("swgp.server.wg0.", "uplink_packets", 3, 1)
+
+	const expected = "swgp.server.wg0.sessions:1|g|#node:vps1.example.com\nswgp.server.wg0.uplink_packets:2|c|#node:vps1.example.com"
+	if got := string(e.buf); got != expected {
+		t.Errorf("Got %q, want %q", got, expected)
+	}
+
+	e.buf = e.buf[:0]
+	e.setNodeID("")
+	e.appendMetric("swgp.server.wg0.", "sessions", 1, "|g")
+	if got := string(e.buf); got != "swgp.server.wg0.sessions:1|g" {
+		t.Errorf("Got %q for empty node ID, want no tags", got)
+	}
+}
+
+func TestManagerStatsdTagsOptIn(t *testing.T) {
+	for _, statsdTags := range []bool{false, true} {
+		sc := Config{
+			Servers: []ServerConfig{{
+				Name:        "wg0",
+				ProxyListen: ":20576",
+				ProxyMode:   "zero-overhead",
+				ProxyPSK:    generateTestPSK(t),
+				WgEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20577)),
+				MTU:         1500,
+			}},
+			StatsdAddr: "127.0.0.1:8125",
+			StatsdTags: statsdTags,
+			NodeID:     "vps1",
+		}
+		m, err := sc.Manager(logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hasTags := m.statsd.tags != ""; hasTags != statsdTags {
+			t.Errorf("statsdTags %v: got tags %q", statsdTags, m.statsd.tags)
+		}
+	}
+}
+
+func TestStatsdSanitizeTagValue(t *testing.T) {
+	for _, c := range []struct {
+		in       string
+		expected string
+	}{
+		{"vps1", "vps1"},
+		{"vps1.example.com", "vps1.example.com"},
+		{"eu/vps1", "eu/vps1"},
+		{"a,b|c#d:e", "a_b_c_d_e"},
+	} {
+		if got := statsdSanitizeTagValue(c.in); got != c.expected {
+			t.Errorf("statsdSanitizeTagValue(%q) = %q, want %q", c.in, got, c.expected)
+		}
+	}
+}
+
+func TestStatsdExporterRuntimeMetrics(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	e := newStatsdExporter(pc.LocalAddr().String(), time.Hour, func() []ServiceStats { return nil }, logger)
+	e.runtime = newRuntimeStats()
+	if err = e.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	runtime.GC()
+	e.flush()
+
+	if err = pc.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, statsdMaxPacketSize)
+	n, _, err := pc.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(b[:n])
+
+	for _, prefix := range []string{
+		"swgp.runtime.goroutines:",
+		"swgp.runtime.heap_bytes:",
+		"swgp.runtime.total_bytes:",
+		"swgp.runtime.gc_cycles:",
+		"swgp.runtime.gc_pauses:",
+		"swgp.runtime.gc_pause_max_us:",
+	} {
+		if !strings.Contains(got, prefix) {
+			t.Errorf("Expected metric %s in %q", prefix, got)
+		}
+	}
+}
+
+func TestStatsdExporterTenants(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	var stats []ServiceStats
+	e := newStatsdExporter(pc.LocalAddr().String(), time.Hour, func() []ServiceStats { return stats }, logger)
+	if err = e.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	b := make([]byte, statsdMaxPacketSize)
+	readLines := func() string {
+		t.Helper()
+		if err := pc.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		n, _, err := pc.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b[:n])
+	}
+
+	stats = []ServiceStats{{Role: "server", Name: "wg0", Stats: Stats{
+		Tenants: []TenantStats{{KeyID: 1, Name: "alpha.corp", Sessions: 1, UplinkPackets: 10}},
+	}}}
+	e.flush()
+	const expectedFirst = "swgp.server.wg0.sessions:0|g\nswgp.server.wg0.tenant.alpha_corp.sessions:1|g\nswgp.server.wg0.tenant.alpha_corp.uplink_packets:10|c"
+	if got := readLines(); got != expectedFirst {
+		t.Errorf("First flush: got %q, want %q", got, expectedFirst)
+	}
+
+	// Tenant counters are sent as deltas.
+	stats = []ServiceStats{{Role: "server", Name: "wg0", Stats: Stats{
+		Tenants: []TenantStats{{KeyID: 1, Name: "alpha.corp", Sessions: 1, UplinkPackets: 15}},
+	}}}
+	e.flush()
+	const expectedSecond = "swgp.server.wg0.sessions:0|g\nswgp.server.wg0.tenant.alpha_corp.sessions:1|g\nswgp.server.wg0.tenant.alpha_corp.uplink_packets:5|c"
+	if got := readLines(); got != expectedSecond {
+		t.Errorf("Second flush: got %q, want %q", got, expectedSecond)
+	}
+}
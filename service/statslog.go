@@ -0,0 +1,99 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// statsLogger periodically logs a one-line stats summary of each service,
+// for deployments without a metrics pipeline.
+//
+// Sessions are logged as is. Traffic and drops are logged as the deltas since the previous summary.
+type statsLogger struct {
+	interval time.Duration
+	stats    func() []ServiceStats
+	logger   *zap.Logger
+	last     map[string]Stats
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newStatsLogger returns a new stats logger that logs the stats returned by stats every interval.
+//
+// If interval is not positive, nil is returned. Start and Stop are no-ops on a nil stats logger.
+func newStatsLogger(interval time.Duration, stats func() []ServiceStats, logger *zap.Logger) *statsLogger {
+	if interval <= 0 {
+		return nil
+	}
+	return &statsLogger{
+		interval: interval,
+		stats:    stats,
+		logger:   logger,
+		last:     make(map[string]Stats),
+	}
+}
+
+// Start starts logging stats summaries.
+func (l *statsLogger) Start() {
+	if l == nil {
+		return
+	}
+
+	l.done = make(chan struct{})
+
+	l.wg.Add(1)
+
+	go func() {
+		defer l.wg.Done()
+
+		ticker := time.NewTicker(l.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				l.log()
+			case <-l.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops logging stats summaries.
+// It is a no-op if the stats logger was not started.
+func (l *statsLogger) Stop() {
+	if l == nil || l.done == nil {
+		return
+	}
+	close(l.done)
+	l.wg.Wait()
+}
+
+// log logs the stats summary of each service.
+func (l *statsLogger) log() {
+	all := l.stats()
+	last := make(map[string]Stats, len(all))
+
+	for i := range all {
+		ss := &all[i]
+		key := ss.Role + ":" + ss.Name
+		prev := l.last[key]
+		last[key] = ss.Stats
+
+		l.logger.Info("Stats summary",
+			zap.String(ss.Role, ss.Name),
+			zap.Duration("interval", l.interval),
+			zap.Int("sessions", ss.Sessions),
+			zap.Uint64("uplinkPackets", counterDelta(ss.UplinkPackets, prev.UplinkPackets)),
+			zap.Uint64("uplinkBytes", counterDelta(ss.UplinkBytes, prev.UplinkBytes)),
+			zap.Uint64("downlinkPackets", counterDelta(ss.DownlinkPackets, prev.DownlinkPackets)),
+			zap.Uint64("downlinkBytes", counterDelta(ss.DownlinkBytes, prev.DownlinkBytes)),
+			zap.Uint64("droppedPackets", counterDelta(ss.DroppedPackets(), prev.DroppedPackets())),
+		)
+	}
+
+	l.last = last
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestStatsLogger(t *testing.T) {
+	stats := []ServiceStats{
+		{
+			Role: "server",
+			Name: "wg0",
+			Stats: Stats{
+				Sessions:        2,
+				UplinkPackets:   10,
+				UplinkBytes:     1000,
+				DownlinkPackets: 8,
+				DownlinkBytes:   800,
+				DecryptFailures: 1,
+			},
+		},
+		{
+			Role: "client",
+			Name: "wg0",
+		},
+	}
+
+	core, logs := observer.New(zap.InfoLevel)
+	l := newStatsLogger(time.Hour, func() []ServiceStats { return stats }, zap.New(core))
+
+	l.log()
+	if n := logs.Len(); n != 2 {
+		t.Fatalf("Expected 1 summary line per service, got %d", n)
+	}
+	first := logs.TakeAll()[0].ContextMap()
+	for key, value := range map[string]any{
+		"server":          "wg0",
+		"sessions":        int64(2),
+		"uplinkPackets":   uint64(10),
+		"uplinkBytes":     uint64(1000),
+		"downlinkPackets": uint64(8),
+		"downlinkBytes":   uint64(800),
+		"droppedPackets":  uint64(1),
+	} {
+		if got := first[key]; got != value {
+			t.Errorf("First summary: got %s=%v, want %v", key, got, value)
+		}
+	}
+
+	// Traffic and drops are logged as deltas.
+	stats[0].Sessions = 1
+	stats[0].UplinkPackets = 15
+	stats[0].QueueFullPackets = 2
+	l.log()
+	second := logs.TakeAll()[0].ContextMap()
+	for key, value := range map[string]any{
+		"sessions":       int64(1),
+		"uplinkPackets":  uint64(5),
+		"uplinkBytes":    uint64(0),
+		"droppedPackets": uint64(2),
+	} {
+		if got := second[key]; got != value {
+			t.Errorf("Second summary: got %s=%v, want %v", key, got, value)
+		}
+	}
+}
+
+func TestStatsLoggerDisabled(t *testing.T) {
+	l := newStatsLogger(0, nil, logger)
+	if l != nil {
+		t.Fatal("Expected nil stats logger for zero interval")
+	}
+	l.Start()
+	l.Stop()
+}
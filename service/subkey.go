@@ -0,0 +1,71 @@
+package service
+
+import (
+	"errors"
+	"net/netip"
+
+	"github.com/database64128/swgp-go/packet"
+	"go.uber.org/zap"
+)
+
+// optionsWithSessionSubkeys returns the handler options of each direction, with session subkeys enabled
+// for the directions in the paranoid proxy mode. If sessionSubkeys is false, opts itself is returned for both.
+func optionsWithSessionSubkeys(opts map[string]any, sessionSubkeys bool, inboundMode, outboundMode string) (inboundOpts, outboundOpts map[string]any, err error) {
+	inboundOpts, outboundOpts = opts, opts
+	if !sessionSubkeys {
+		return
+	}
+	if inboundMode != "paranoid" && outboundMode != "paranoid" {
+		return nil, nil, errors.New("sessionSubkeys is only supported in the paranoid proxy mode")
+	}
+	subkeyOpts := copyOptionsWithSessionSubkeys(opts)
+	if inboundMode == "paranoid" {
+		inboundOpts = subkeyOpts
+	}
+	if outboundMode == "paranoid" {
+		outboundOpts = subkeyOpts
+	}
+	return
+}
+
+// copyOptionsWithSessionSubkeys returns a copy of opts with session subkeys enabled.
+func copyOptionsWithSessionSubkeys(opts map[string]any) map[string]any {
+	optsCopy := make(map[string]any, len(opts)+1)
+	for k, v := range opts {
+		optsCopy[k] = v
+	}
+	optsCopy[packet.OptionSessionSubkeys] = true
+	return optsCopy
+}
+
+// newSessionHandler returns the handler that encrypts the packets the server sends to the session of clientAddrPort.
+// With session subkeys, the session gets its own subkey. Otherwise, handler itself is returned.
+func (s *server) newSessionHandler(handler packet.Handler, clientAddrPort netip.AddrPort) packet.Handler {
+	sessionHandler, err := packet.NewSessionHandler(handler)
+	if err != nil {
+		s.logger.Warn("Failed to create session subkey, falling back to the shared subkey",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		return handler
+	}
+	return sessionHandler
+}
+
+// newSessionHandler returns the handler that encrypts the packets the client sends for the session of clientAddrPort.
+// With session subkeys, the session gets its own subkey. Otherwise, the client's handler is returned.
+func (c *client) newSessionHandler(clientAddrPort netip.AddrPort) packet.Handler {
+	sessionHandler, err := packet.NewSessionHandler(c.handler)
+	if err != nil {
+		c.logger.Warn("Failed to create session subkey, falling back to the shared subkey",
+			zap.String("client", c.name),
+			zap.String("listenAddress", c.wgListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		return c.handler
+	}
+	return sessionHandler
+}
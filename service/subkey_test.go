@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestClientServerDataPacketsParanoidSessionSubkeys(t *testing.T) {
+	for _, c := range []struct {
+		name           string
+		batchMode      string
+		proxyTransport string
+		proxyPort      uint16
+		wgPort         uint16
+		wgListenPort   uint16
+	}{
+		{"Default", "", "", 20407, 20408, 20409},
+		{"NoBatch", "no", "", 20410, 20411, 20412},
+		{"TCP", "", proxyTransportTCP, 20413, 20414, 20415},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			psk := generateTestPSK(t)
+
+			serverConfig := ServerConfig{
+				Name:           "wg0",
+				ProxyListen:    fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:      "paranoid",
+				ProxyPSK:       psk,
+				SessionSubkeys: true,
+				ProxyTransport: c.proxyTransport,
+				WgEndpoint:     conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPort)),
+				MTU:            1500,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+
+			clientConfig := ClientConfig{
+				Name:           "wg0",
+				WgListen:       fmt.Sprintf(":%d", c.wgListenPort),
+				ProxyEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.proxyPort)),
+				ProxyMode:      "paranoid",
+				ProxyPSK:       psk,
+				SessionSubkeys: true,
+				ProxyTransport: c.proxyTransport,
+				MTU:            1500,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+
+			testClientServerDataPackets(t, context.Background(), serverConfig, clientConfig)
+		})
+	}
+}
+
+func TestClientServerParanoidSessionSubkeysMismatch(t *testing.T) {
+	psk := generateTestPSK(t)
+
+	serverConfig := ServerConfig{
+		Name:           "wg0",
+		ProxyListen:    ":20416",
+		ProxyMode:      "paranoid",
+		ProxyPSK:       psk,
+		SessionSubkeys: true,
+		WgEndpoint:     conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20417)),
+		MTU:            1500,
+	}
+
+	clientConfig := ClientConfig{
+		Name:          "wg0",
+		WgListen:      ":20418",
+		ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20416)),
+		ProxyMode:     "paranoid",
+		ProxyPSK:      psk,
+		MTU:           1500,
+	}
+
+	sc := Config{
+		Servers: []ServerConfig{serverConfig},
+		Clients: []ClientConfig{clientConfig},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	peer := newFakeWgPeer(t, clientConfig.WgListen)
+	endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+
+	// Packets encrypted under the raw PSK do not decrypt under session subkeys.
+	peer.Send(newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation))
+	endpoint.ExpectNone(200 * time.Millisecond)
+
+	for _, ss := range m.Stats() {
+		if ss.Role == "server" && ss.DecryptFailures == 0 {
+			t.Error("Expected the server to count the decrypt failure")
+		}
+	}
+}
+
+func TestSessionSubkeysRequiresParanoid(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		proxyMode string
+		ok        bool
+	}{
+		{"Paranoid", "paranoid", true},
+		{"ZeroOverhead", "zero-overhead", false},
+		{"Extensible", "extensible", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			psk := generateTestPSK(t)
+			serverConfig := ServerConfig{
+				ProxyMode:      c.proxyMode,
+				ProxyPSK:       psk,
+				SessionSubkeys: true,
+			}
+			_, _, err := getServerPacketHandler(&serverConfig)
+			if ok := err == nil; ok != c.ok {
+				t.Errorf("Server: expected ok %v, got error %v", c.ok, err)
+			}
+
+			clientConfig := ClientConfig{
+				ProxyMode:      c.proxyMode,
+				ProxyPSK:       psk,
+				SessionSubkeys: true,
+			}
+			_, err = getClientPacketHandler(&clientConfig)
+			if ok := err == nil; ok != c.ok {
+				t.Errorf("Client: expected ok %v, got error %v", c.ok, err)
+			}
+		})
+	}
+}
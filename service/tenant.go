@@ -0,0 +1,173 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+)
+
+// TenantStats is a snapshot of the traffic of a proxy key's sessions on a server
+// in the "zero-overhead-keyed" proxy mode.
+type TenantStats struct {
+	// KeyID is the ID of the proxy key.
+	KeyID uint8
+
+	// Name is the name of the proxy key, or its ID if it has no name.
+	Name string
+
+	// Sessions is the number of active sessions of the key.
+	Sessions int
+
+	// NotAfter is the time after which the key is no longer accepted, or the zero value if it never expires.
+	NotAfter time.Time
+
+	// Expired is whether the key is past its NotAfter time, and packets carrying it are dropped.
+	Expired bool
+
+	UplinkPackets   uint64
+	UplinkBytes     uint64
+	DownlinkPackets uint64
+	DownlinkBytes   uint64
+}
+
+// tenant returns the stats of the proxy key of keyID, or zero stats if there is none.
+func (s *Stats) tenant(keyID uint8) TenantStats {
+	for _, ts := range s.Tenants {
+		if ts.KeyID == keyID {
+			return ts
+		}
+	}
+	return TenantStats{}
+}
+
+// tenantCounters counts the traffic of the sessions of a proxy key.
+//
+// A nil tenantCounters counts nothing.
+type tenantCounters struct {
+	keyID    uint8
+	name     string
+	uplink   trafficCounters
+	downlink trafficCounters
+}
+
+// addUplink adds n uplink packets totalling b bytes to the counters.
+func (t *tenantCounters) addUplink(n, b uint64) {
+	if t == nil {
+		return
+	}
+	t.uplink.add(n, b)
+}
+
+// addDownlink adds n downlink packets totalling b bytes to the counters.
+func (t *tenantCounters) addDownlink(n, b uint64) {
+	if t == nil {
+		return
+	}
+	t.downlink.add(n, b)
+}
+
+// checkProxyKeyTenants returns an error if the names or WireGuard endpoints of the proxy keys are invalid.
+func checkProxyKeyTenants(keys []ProxyKeyConfig, transparentRoutes map[uint16]conn.Addr, network string) error {
+	names := make(map[string]uint8, len(keys))
+	for _, key := range keys {
+		name := key.tenantName()
+		if id, ok := names[name]; ok {
+			return fmt.Errorf("proxy keys %d and %d have the same name %q", id, key.ID, name)
+		}
+		names[name] = key.ID
+
+		if !key.WgEndpoint.IsValid() {
+			continue
+		}
+		if len(transparentRoutes) > 0 {
+			return errors.New("proxy key wgEndpoint cannot be combined with transparentRoutes")
+		}
+		if key.WgEndpoint.IsIP() && !conn.IPMatchesNetwork(key.WgEndpoint.IP(), network) {
+			return fmt.Errorf("proxy key %d wgEndpoint %s cannot be used on network %s", key.ID, key.WgEndpoint, network)
+		}
+	}
+	return nil
+}
+
+// tenantName returns the name of the key in stats, or its ID if it has no name.
+func (key *ProxyKeyConfig) tenantName() string {
+	if key.Name != "" {
+		return key.Name
+	}
+	return strconv.Itoa(int(key.ID))
+}
+
+// newKeyRoutes returns the WireGuard endpoints of the proxy keys that have one, indexed by key ID,
+// or nil if no key has one.
+func newKeyRoutes(keys []ProxyKeyConfig) map[uint8]conn.Addr {
+	var routes map[uint8]conn.Addr
+	for _, key := range keys {
+		if !key.WgEndpoint.IsValid() {
+			continue
+		}
+		if routes == nil {
+			routes = make(map[uint8]conn.Addr, len(keys))
+		}
+		routes[key.ID] = key.WgEndpoint
+	}
+	return routes
+}
+
+// newTenants returns the traffic counters of the proxy keys, indexed by key ID.
+func newTenants(keys []ProxyKeyConfig) *[256]*tenantCounters {
+	var tenants [256]*tenantCounters
+	for _, key := range keys {
+		tenants[key.ID] = &tenantCounters{
+			keyID: key.ID,
+			name:  key.tenantName(),
+		}
+	}
+	return &tenants
+}
+
+// tenant returns the traffic counters of the sessions of keyID,
+// or nil if the server is not in the "zero-overhead-keyed" proxy mode.
+func (s *server) tenant(keyID uint8) *tenantCounters {
+	if s.tenants == nil {
+		return nil
+	}
+	return s.tenants[keyID]
+}
+
+// tenantStats returns the stats of the server's proxy keys, ordered by key ID,
+// or nil if the server is not in the "zero-overhead-keyed" proxy mode.
+func (s *server) tenantStats() []TenantStats {
+	if s.tenants == nil {
+		return nil
+	}
+
+	var sessions [256]int
+	s.mu.Lock()
+	for _, natEntry := range s.table {
+		sessions[natEntry.keyID]++
+	}
+	s.mu.Unlock()
+
+	now := time.Now()
+	var stats []TenantStats
+	for _, t := range s.tenants {
+		if t == nil {
+			continue
+		}
+		stats = append(stats, TenantStats{
+			KeyID:           t.keyID,
+			Name:            t.name,
+			Sessions:        sessions[t.keyID],
+			NotAfter:        s.keyNotAfter[t.keyID],
+			Expired:         s.keyExpired(t.keyID, now),
+			UplinkPackets:   t.uplink.packets.Load(),
+			UplinkBytes:     t.uplink.bytes.Load(),
+			DownlinkPackets: t.downlink.packets.Load(),
+			DownlinkBytes:   t.downlink.bytes.Load(),
+		})
+	}
+	return stats
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestServerTenants(t *testing.T) {
+	for _, c := range []struct {
+		name          string
+		batchMode     string
+		proxyPort     uint16
+		wgPortA       uint16
+		wgPortB       uint16
+		wgListenPortA uint16
+		wgListenPortB uint16
+	}{
+		{"Default", "", 20440, 20441, 20442, 20443, 20444},
+		{"NoBatch", "no", 20445, 20446, 20447, 20448, 20449},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			pskA, pskB := generateTestPSK(t), generateTestPSK(t)
+			maskKey := generateTestPSK(t)
+			proxyEndpoint := conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.proxyPort))
+
+			serverConfig := ServerConfig{
+				Name:        "wg0",
+				ProxyListen: fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:   proxyModeZeroOverheadKeyed,
+				ProxyKeys: []ProxyKeyConfig{
+					{ID: 1, PSK: pskA, Name: "alpha", WgEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPortA))},
+					{ID: 2, PSK: pskB},
+				},
+				ProxyKeyMaskKey: maskKey,
+				WgEndpoint:      conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPortB)),
+				MTU:             1500,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+			clientConfigA := ClientConfig{
+				Name:            "alpha",
+				WgListen:        fmt.Sprintf(":%d", c.wgListenPortA),
+				ProxyEndpoint:   proxyEndpoint,
+				ProxyMode:       proxyModeZeroOverheadKeyed,
+				ProxyPSK:        pskA,
+				ProxyKeyID:      1,
+				ProxyKeyMaskKey: maskKey,
+				MTU:             1500,
+			}
+			clientConfigB := clientConfigA
+			clientConfigB.Name = "beta"
+			clientConfigB.WgListen = fmt.Sprintf(":%d", c.wgListenPortB)
+			clientConfigB.ProxyPSK = pskB
+			clientConfigB.ProxyKeyID = 2
+
+			sc := Config{
+				Servers: []ServerConfig{serverConfig},
+				Clients: []ClientConfig{clientConfigA, clientConfigB},
+			}
+			m, err := sc.Manager(logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = m.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			defer m.Stop()
+
+			peerA := newFakeWgPeer(t, clientConfigA.WgListen)
+			peerB := newFakeWgPeer(t, clientConfigB.WgListen)
+			endpointA := newFakeWgEndpoint(t, fmt.Sprintf("[::1]:%d", c.wgPortA))
+			endpointB := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+
+			// Each tenant reaches its own endpoint, and replies return to its own peer.
+			for _, p := range []struct {
+				peer, endpoint *fakeWg
+			}{
+				{peerA, endpointA},
+				{peerB, endpointB},
+			} {
+				initiation := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+				p.peer.Send(initiation)
+				p.endpoint.Expect(initiation)
+
+				response := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeResponse, packet.WireGuardMessageLengthHandshakeResponse)
+				p.endpoint.Send(response)
+				p.peer.Expect(response)
+			}
+
+			for _, ss := range m.Stats() {
+				if ss.Role != "server" {
+					continue
+				}
+				if len(ss.Tenants) != 2 {
+					t.Fatalf("Expected 2 tenants, got %+v", ss.Tenants)
+				}
+				for i, name := range []string{"alpha", "2"} {
+					ts := ss.Tenants[i]
+					if ts.Name != name || ts.Sessions != 1 || ts.UplinkPackets != 1 || ts.DownlinkPackets != 1 {
+						t.Errorf("Unexpected stats of tenant %s: %+v", name, ts)
+					}
+					if ts.UplinkBytes != packet.WireGuardMessageLengthHandshakeInitiation || ts.DownlinkBytes != packet.WireGuardMessageLengthHandshakeResponse {
+						t.Errorf("Unexpected traffic of tenant %s: %+v", name, ts)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCheckProxyKeyTenants(t *testing.T) {
+	backend := conn.AddrFromIPPort(netip.MustParseAddrPort("[::1]:51820"))
+	backendv4 := conn.AddrFromIPPort(netip.MustParseAddrPort("127.0.0.1:51820"))
+	for _, c := range []struct {
+		name              string
+		keys              []ProxyKeyConfig
+		transparentRoutes map[uint16]conn.Addr
+		network           string
+		ok                bool
+	}{
+		{"NoTenants", []ProxyKeyConfig{{ID: 1}, {ID: 2}}, nil, "udp", true},
+		{"Tenants", []ProxyKeyConfig{{ID: 1, Name: "alpha", WgEndpoint: backend}, {ID: 2, Name: "beta"}}, nil, "udp", true},
+		{"DuplicateName", []ProxyKeyConfig{{ID: 1, Name: "alpha"}, {ID: 2, Name: "alpha"}}, nil, "udp", false},
+		{"NameOfOtherID", []ProxyKeyConfig{{ID: 1, Name: "2"}, {ID: 2}}, nil, "udp", false},
+		{"TransparentRoutes", []ProxyKeyConfig{{ID: 1, WgEndpoint: backend}}, map[uint16]conn.Addr{51820: backend}, "udp", false},
+		{"WrongNetwork", []ProxyKeyConfig{{ID: 1, WgEndpoint: backendv4}}, nil, "udp6", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkProxyKeyTenants(c.keys, c.transparentRoutes, c.network)
+			if ok := err == nil; ok != c.ok {
+				t.Errorf("Expected ok %v, got error %v", c.ok, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket that refills continuously at a fixed rate, up to its size.
+// It is the shared implementation of the rate limits of a server.
+//
+// tokenBucket is safe for concurrent use by multiple goroutines.
+type tokenBucket struct {
+	mu sync.Mutex
+
+	// tokens is the number of tokens that may be taken right away.
+	tokens float64
+
+	// last is the time tokens was last refilled.
+	last time.Time
+
+	// rate is the number of tokens added per second.
+	rate float64
+
+	// size is the maximum number of tokens.
+	size float64
+}
+
+// newTokenBucket returns a new full bucket of size tokens that refills at rate tokens per second.
+func newTokenBucket(rate, size float64) *tokenBucket {
+	return &tokenBucket{
+		tokens: size,
+		last:   time.Now(),
+		rate:   rate,
+		size:   size,
+	}
+}
+
+// refillLocked adds the tokens refilled since the last refill.
+func (b *tokenBucket) refillLocked(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.size {
+			b.tokens = b.size
+		}
+		b.last = now
+	}
+}
+
+// Take takes n tokens and returns true if the bucket holds at least n tokens.
+// Otherwise, it takes nothing and returns false.
+func (b *tokenBucket) Take(n float64) bool {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refillLocked(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Has returns whether the bucket holds at least n tokens, without taking them.
+func (b *tokenBucket) Has(n float64) bool {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refillLocked(now)
+	return b.tokens >= n
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	// 100 tokens per second refills a token every 10ms.
+	b := newTokenBucket(100, 10)
+
+	if !b.Take(10) {
+		t.Fatal("Expected a full bucket to hold its size")
+	}
+	if b.Has(1) {
+		t.Error("Expected an empty bucket")
+	}
+	if b.Take(1) {
+		t.Error("Expected take from an empty bucket to fail")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if !b.Has(3) {
+		t.Error("Expected bucket to refill")
+	}
+	if b.Take(10) {
+		t.Error("Expected take of more than the refilled tokens to fail")
+	}
+	if !b.Take(3) {
+		t.Error("Expected take of the refilled tokens to pass")
+	}
+
+	// The bucket never holds more than its size.
+	time.Sleep(200 * time.Millisecond)
+	if b.Take(11) {
+		t.Error("Expected take of more than the bucket size to fail")
+	}
+}
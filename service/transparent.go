@@ -0,0 +1,90 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/database64128/swgp-go/conn"
+	"go.uber.org/zap"
+)
+
+// serverSessionKey identifies a UDP session in the server's table.
+//
+// origDstAddrPort is only set when transparent routes are configured, so that a client
+// reaching multiple backends through the same transparent proxyConn gets a session for each.
+type serverSessionKey struct {
+	clientAddrPort  netip.AddrPort
+	origDstAddrPort netip.AddrPort
+
+	// keyID is the proxy key ID of the session in the "zero-overhead-keyed" proxy mode,
+	// so that tenants behind the same address have separate sessions.
+	keyID uint8
+}
+
+// checkTransparentRoutes returns an error if the transparent routes are invalid.
+func checkTransparentRoutes(routes map[uint16]conn.Addr, transparent bool, network string) error {
+	if len(routes) == 0 {
+		return nil
+	}
+	if !transparent {
+		return errors.New("transparentRoutes requires transparent")
+	}
+	for port, wgAddr := range routes {
+		if port == 0 {
+			return errors.New("transparent route port must not be 0")
+		}
+		if !wgAddr.IsValid() {
+			return fmt.Errorf("transparent route for port %d has no wgEndpoint", port)
+		}
+		if wgAddr.IsIP() && !conn.IPMatchesNetwork(wgAddr.IP(), network) {
+			return fmt.Errorf("transparent route wgEndpoint %s cannot be used on network %s", wgAddr, network)
+		}
+	}
+	return nil
+}
+
+// sessionKey returns the table key and the WireGuard endpoint of the session
+// of a packet from clientAddrPort to origDstAddrPort under the proxy key of keyID.
+func (s *server) sessionKey(clientAddrPort, origDstAddrPort netip.AddrPort, keyID uint8) (serverSessionKey, conn.Addr) {
+	if len(s.transparentRoutes) == 0 {
+		key := serverSessionKey{clientAddrPort: clientAddrPort, keyID: keyID}
+		if wgAddr, ok := s.keyRoutes[keyID]; ok {
+			return key, wgAddr
+		}
+		return key, *s.wgAddr.Load()
+	}
+	key := serverSessionKey{clientAddrPort, origDstAddrPort, keyID}
+	if wgAddr, ok := s.transparentRoutes[origDstAddrPort.Port()]; ok {
+		return key, wgAddr
+	}
+	return key, *s.wgAddr.Load()
+}
+
+// parseTransparentCmsg splits the control messages of a packet received on a transparent proxyConn
+// into the pktinfo control message, which is kept for sending replies, and the original destination address.
+// It returns false if the packet must be dropped.
+func (s *server) parseTransparentCmsg(cmsg []byte, clientAddrPort netip.AddrPort) ([]byte, netip.AddrPort, bool) {
+	pktinfo, origDstAddrPort, err := conn.ParseOrigDstAddrCmsg(cmsg)
+	if err != nil {
+		s.connLogger.Warn("Failed to parse original destination control message from proxyConn",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+		return nil, netip.AddrPort{}, false
+	}
+	return pktinfo, origDstAddrPort, true
+}
+
+// logTransparentSession logs the original destination address of a new session on a transparent proxyConn.
+func (s *server) logTransparentSession(clientAddrPort, origDstAddrPort netip.AddrPort, wgAddr *conn.Addr) {
+	s.logger.Info("New transparent session",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.Stringer("clientAddress", clientAddrPort),
+		zap.Stringer("originalDestination", origDstAddrPort),
+		zap.Stringer("wgAddress", wgAddr),
+	)
+}
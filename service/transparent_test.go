@@ -0,0 +1,70 @@
+package service
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/database64128/swgp-go/conn"
+)
+
+func TestCheckTransparentRoutes(t *testing.T) {
+	backendA := conn.AddrFromIPPort(netip.MustParseAddrPort("[::1]:51820"))
+	backendB := conn.AddrFromIPPort(netip.MustParseAddrPort("127.0.0.1:51821"))
+
+	for _, c := range []struct {
+		name        string
+		routes      map[uint16]conn.Addr
+		transparent bool
+		network     string
+		ok          bool
+	}{
+		{"None", nil, false, "udp", true},
+		{"Valid", map[uint16]conn.Addr{51820: backendA, 51821: backendB}, true, "udp", true},
+		{"NotTransparent", map[uint16]conn.Addr{51820: backendA}, false, "udp", false},
+		{"ZeroPort", map[uint16]conn.Addr{0: backendA}, true, "udp", false},
+		{"NoEndpoint", map[uint16]conn.Addr{51820: {}}, true, "udp", false},
+		{"NetworkMismatch", map[uint16]conn.Addr{51821: backendB}, true, "udp6", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkTransparentRoutes(c.routes, c.transparent, c.network)
+			if ok := err == nil; ok != c.ok {
+				t.Errorf("Expected ok %v, got error %v", c.ok, err)
+			}
+		})
+	}
+}
+
+func TestServerSessionKey(t *testing.T) {
+	defaultAddr := conn.AddrFromIPPort(netip.MustParseAddrPort("[::1]:51819"))
+	backendA := conn.AddrFromIPPort(netip.MustParseAddrPort("[::1]:51820"))
+	clientAddrPort := netip.MustParseAddrPort("[2001:db8::1]:40000")
+	origDstA := netip.MustParseAddrPort("[2001:db8::2]:51820")
+	origDstOther := netip.MustParseAddrPort("[2001:db8::2]:51830")
+
+	var s server
+	s.wgAddr.Store(&defaultAddr)
+	key, wgAddr := s.sessionKey(clientAddrPort, origDstA, 0)
+	if key != (serverSessionKey{clientAddrPort: clientAddrPort}) {
+		t.Errorf("Expected key without original destination, got %v", key)
+	}
+	if !wgAddr.Equals(defaultAddr) {
+		t.Errorf("Expected wgAddr %s, got %s", defaultAddr, wgAddr)
+	}
+
+	s.transparentRoutes = map[uint16]conn.Addr{51820: backendA}
+	key, wgAddr = s.sessionKey(clientAddrPort, origDstA, 0)
+	if key != (serverSessionKey{clientAddrPort, origDstA, 0}) {
+		t.Errorf("Expected key with original destination, got %v", key)
+	}
+	if !wgAddr.Equals(backendA) {
+		t.Errorf("Expected wgAddr %s, got %s", backendA, wgAddr)
+	}
+
+	key, wgAddr = s.sessionKey(clientAddrPort, origDstOther, 0)
+	if key != (serverSessionKey{clientAddrPort, origDstOther, 0}) {
+		t.Errorf("Expected key with original destination, got %v", key)
+	}
+	if !wgAddr.Equals(defaultAddr) {
+		t.Errorf("Expected unrouted port to use wgAddr %s, got %s", defaultAddr, wgAddr)
+	}
+}
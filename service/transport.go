@@ -0,0 +1,135 @@
+package service
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Proxy transports carry swgp packets between clients and servers.
+const (
+	// proxyTransportUDP sends each swgp packet as a UDP datagram. This is the default.
+	proxyTransportUDP = "udp"
+
+	// proxyTransportTCP sends swgp packets over a TCP connection per session,
+	// each prefixed with its length. It is a fallback for networks that block UDP.
+	proxyTransportTCP = "tcp"
+)
+
+// checkProxyTransport validates the proxy transport and returns it with the default applied.
+func checkProxyTransport(proxyTransport string) (string, error) {
+	switch proxyTransport {
+	case "", proxyTransportUDP:
+		return proxyTransportUDP, nil
+	case proxyTransportTCP:
+		return proxyTransportTCP, nil
+	default:
+		return "", fmt.Errorf("unknown proxy transport: %s", proxyTransport)
+	}
+}
+
+// checkNetwork validates the UDP network of a service and returns it with the default applied.
+func checkNetwork(network string) (string, error) {
+	switch network {
+	case "":
+		return "udp", nil
+	case "udp", "udp4", "udp6":
+		return network, nil
+	default:
+		return "", fmt.Errorf("unknown network: %s", network)
+	}
+}
+
+// tcpNetwork returns the TCP network of the same address family as the UDP network.
+func tcpNetwork(network string) string {
+	switch network {
+	case "udp4":
+		return "tcp4"
+	case "udp6":
+		return "tcp6"
+	default:
+		return "tcp"
+	}
+}
+
+// tcpFrameHeaderLength is the length of the frame header of a swgp packet on a TCP stream.
+//
+//	tcpFrame := 2B big-endian swgp packet length + swgp packet
+const tcpFrameHeaderLength = 2
+
+// tcpFrameTooLargeError is returned when a TCP frame does not fit in the receive buffer.
+// The stream cannot be resynchronized after such an error.
+type tcpFrameTooLargeError struct {
+	length    int
+	maxLength int
+}
+
+func (e *tcpFrameTooLargeError) Error() string {
+	return fmt.Sprintf("TCP frame length %d exceeds maximum %d", e.length, e.maxLength)
+}
+
+// readTCPFrame reads a swgp packet framed by [writeTCPFrame] into buf and returns its length.
+//
+// A frame may arrive split across any number of reads. readTCPFrame blocks until the whole frame
+// is available. A clean end of stream between frames is reported as [io.EOF].
+func readTCPFrame(r *bufio.Reader, buf []byte) (int, error) {
+	var header [tcpFrameHeaderLength]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if n > len(buf) {
+		return 0, &tcpFrameTooLargeError{n, len(buf)}
+	}
+
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+// newTCPFrameWriter returns a buffered writer of TCP frames to w.
+//
+// [bufio.Writer] gives up with [io.ErrShortWrite] when w accepts only part of the buffer without an error.
+// The returned writer keeps writing the rest instead, so that a frame is never cut short on the stream.
+func newTCPFrameWriter(w io.Writer) *bufio.Writer {
+	return bufio.NewWriter(fullWriter{w})
+}
+
+// fullWriter retries short writes to w until all bytes are written or w returns an error.
+type fullWriter struct {
+	w io.Writer
+}
+
+// Write implements [io.Writer].
+func (fw fullWriter) Write(b []byte) (int, error) {
+	var written int
+	for written < len(b) {
+		n, err := fw.w.Write(b[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// writeTCPFrame writes a swgp packet to w with a length prefix.
+// The caller is responsible for flushing w.
+func writeTCPFrame(w *bufio.Writer, swgpPacket []byte) error {
+	var header [tcpFrameHeaderLength]byte
+	binary.BigEndian.PutUint16(header[:], uint16(len(swgpPacket)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(swgpPacket)
+	return err
+}
@@ -0,0 +1,583 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestCheckProxyTransport(t *testing.T) {
+	for _, c := range []struct {
+		in       string
+		expected string
+		ok       bool
+	}{
+		{"", proxyTransportUDP, true},
+		{"udp", proxyTransportUDP, true},
+		{"tcp", proxyTransportTCP, true},
+		{"quic", "", false},
+	} {
+		got, err := checkProxyTransport(c.in)
+		if (err == nil) != c.ok {
+			t.Errorf("checkProxyTransport(%q) error = %v", c.in, err)
+		}
+		if got != c.expected {
+			t.Errorf("checkProxyTransport(%q) = %q, expected %q", c.in, got, c.expected)
+		}
+	}
+}
+
+func TestCheckNetwork(t *testing.T) {
+	for _, c := range []struct {
+		in       string
+		expected string
+		ok       bool
+	}{
+		{"", "udp", true},
+		{"udp", "udp", true},
+		{"udp4", "udp4", true},
+		{"udp6", "udp6", true},
+		{"tcp", "", false},
+		{"ip6", "", false},
+	} {
+		got, err := checkNetwork(c.in)
+		if (err == nil) != c.ok {
+			t.Errorf("checkNetwork(%q) error = %v", c.in, err)
+		}
+		if got != c.expected {
+			t.Errorf("checkNetwork(%q) = %q, expected %q", c.in, got, c.expected)
+		}
+	}
+}
+
+func TestTCPFrameRoundTrip(t *testing.T) {
+	var stream bytes.Buffer
+	w := bufio.NewWriter(&stream)
+
+	packets := [][]byte{
+		{},
+		{1, 2, 3},
+		bytes.Repeat([]byte{0xAA}, 1452),
+	}
+	for _, p := range packets {
+		if err := writeTCPFrame(w, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(&stream)
+	buf := make([]byte, 1452)
+	for i, p := range packets {
+		n, err := readTCPFrame(r, buf)
+		if err != nil {
+			t.Fatalf("Frame %d: %v", i, err)
+		}
+		if !bytes.Equal(buf[:n], p) {
+			t.Errorf("Frame %d: got %d bytes, expected %d", i, n, len(p))
+		}
+	}
+
+	if _, err := readTCPFrame(r, buf); err != io.EOF {
+		t.Errorf("Expected io.EOF at end of stream, got %v", err)
+	}
+}
+
+func TestTCPFrameErrors(t *testing.T) {
+	var tooLargeErr *tcpFrameTooLargeError
+	r := bufio.NewReader(bytes.NewReader([]byte{0x05, 0xDD}))
+	if _, err := readTCPFrame(r, make([]byte, 1452)); !errors.As(err, &tooLargeErr) {
+		t.Errorf("Expected tcpFrameTooLargeError, got %v", err)
+	}
+
+	r = bufio.NewReader(bytes.NewReader([]byte{0x00, 0x04, 1, 2}))
+	if _, err := readTCPFrame(r, make([]byte, 1452)); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF for truncated frame, got %v", err)
+	}
+
+	r = bufio.NewReader(bytes.NewReader([]byte{0x00}))
+	if _, err := readTCPFrame(r, make([]byte, 1452)); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF for truncated header, got %v", err)
+	}
+}
+
+// shortWriter accepts at most one byte per write.
+type shortWriter struct {
+	w io.Writer
+}
+
+func (sw shortWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return sw.w.Write(b[:1])
+}
+
+// zeroWriter accepts nothing without an error.
+type zeroWriter struct{}
+
+func (zeroWriter) Write(b []byte) (int, error) {
+	return 0, nil
+}
+
+func TestTCPFrameOneByteAtATime(t *testing.T) {
+	packets := [][]byte{
+		{1, 2, 3},
+		{},
+		bytes.Repeat([]byte{0x55}, 1452),
+		{4},
+	}
+
+	var stream bytes.Buffer
+	w := newTCPFrameWriter(shortWriter{&stream})
+	for _, p := range packets {
+		if err := writeTCPFrame(w, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Failed to flush frames through short writes: %v", err)
+	}
+
+	r := bufio.NewReader(iotest.OneByteReader(&stream))
+	buf := make([]byte, 1452)
+	for i, p := range packets {
+		n, err := readTCPFrame(r, buf)
+		if err != nil {
+			t.Fatalf("Frame %d: %v", i, err)
+		}
+		if !bytes.Equal(buf[:n], p) {
+			t.Errorf("Frame %d: got %d bytes, expected %d", i, n, len(p))
+		}
+	}
+
+	if _, err := readTCPFrame(r, buf); err != io.EOF {
+		t.Errorf("Expected io.EOF at end of stream, got %v", err)
+	}
+}
+
+func TestTCPFrameOneByteAtATimeTruncated(t *testing.T) {
+	r := bufio.NewReader(iotest.OneByteReader(bytes.NewReader([]byte{0x00, 0x04, 1, 2, 3})))
+	if _, err := readTCPFrame(r, make([]byte, 1452)); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF for truncated frame, got %v", err)
+	}
+}
+
+func TestTCPFrameWriterNoProgress(t *testing.T) {
+	w := newTCPFrameWriter(zeroWriter{})
+	if err := writeTCPFrame(w, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != io.ErrShortWrite {
+		t.Errorf("Expected io.ErrShortWrite from a writer that makes no progress, got %v", err)
+	}
+}
+
+func TestClientTCPReconnectAfterReset(t *testing.T) {
+	clientConfig := ClientConfig{
+		Name:           "wg0",
+		WgListen:       ":20330",
+		ProxyEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20331)),
+		ProxyMode:      "passthrough",
+		MTU:            1500,
+		ProxyTransport: proxyTransportTCP,
+	}
+
+	ln, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(clientConfig.ProxyEndpoint.IPPort()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	sc := Config{
+		Clients: []ClientConfig{clientConfig},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	wgConn, err := net.Dial("udp", clientConfig.WgListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wgConn.Close()
+
+	handshakeInitiationPacket := make([]byte, packet.WireGuardMessageLengthHandshakeInitiation)
+	handshakeInitiationPacket[0] = packet.WireGuardMessageTypeHandshakeInitiation
+	if _, err = rand.Read(handshakeInitiationPacket[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	// accept sends the packet until the client connects, then reads the first frame.
+	accept := func() *net.TCPConn {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, err := wgConn.Write(handshakeInitiationPacket); err != nil {
+				t.Fatal(err)
+			}
+			if err := ln.SetDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+				t.Fatal(err)
+			}
+			proxyConn, err := ln.AcceptTCP()
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) && time.Now().Before(deadline) {
+					continue
+				}
+				t.Fatal(err)
+			}
+
+			if err = proxyConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, packet.WireGuardMessageLengthHandshakeInitiation)
+			n, err := readTCPFrame(bufio.NewReader(proxyConn), buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[:n], handshakeInitiationPacket) {
+				t.Error("Received frame does not match the handshake initiation")
+			}
+			return proxyConn
+		}
+	}
+
+	// Reset the first connection. The client must connect again for the next packet.
+	proxyConn := accept()
+	if err = proxyConn.SetLinger(0); err != nil {
+		t.Fatal(err)
+	}
+	proxyConn.Close()
+
+	proxyConn = accept()
+	proxyConn.Close()
+}
+
+func TestServerTCPClosesConnAcceptedAfterStop(t *testing.T) {
+	serverConfig := ServerConfig{
+		Name:           "wg0",
+		ProxyListen:    "[::1]:20574",
+		ProxyMode:      "zero-overhead",
+		ProxyPSK:       generateTestPSK(t),
+		WgEndpoint:     conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20575)),
+		MTU:            1500,
+		ProxyTransport: proxyTransportTCP,
+	}
+
+	s, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// Mark the server stopped without closing the listener, like a Stop racing with an accept.
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+
+	c, err := net.Dial("tcp", serverConfig.ProxyListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected connection accepted after Stop to be closed, got %v", err)
+	}
+
+	s.mu.Lock()
+	sessions := len(s.tcpTable)
+	s.mu.Unlock()
+	if sessions != 0 {
+		t.Errorf("Expected no TCP sessions after Stop, got %d", sessions)
+	}
+}
+
+func TestServerTCPAuthenticatesFirstFrame(t *testing.T) {
+	defer func(timeout time.Duration) { tcpFirstFrameTimeout = timeout }(tcpFirstFrameTimeout)
+	tcpFirstFrameTimeout = 200 * time.Millisecond
+
+	serverConfig := ServerConfig{
+		Name:           "wg0",
+		ProxyListen:    "[::1]:20578",
+		ProxyMode:      "paranoid",
+		ProxyPSK:       generateTestPSK(t),
+		WgEndpoint:     conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20579)),
+		MTU:            1500,
+		ProxyTransport: proxyTransportTCP,
+	}
+
+	s, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.events = newEventBus()
+	events, unsubscribe := s.events.Subscribe()
+	defer unsubscribe()
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", serverConfig.ProxyListen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	expectClosed := func(c net.Conn, what string) {
+		t.Helper()
+		if err := c.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Expected the server to close %s, got %v", what, err)
+		}
+	}
+	expectNoSession := func(what string) {
+		t.Helper()
+		for {
+			select {
+			case e := <-events:
+				if e.Type == EventSessionCreated {
+					t.Errorf("Expected no session for %s", what)
+				}
+			default:
+				return
+			}
+		}
+	}
+	encrypt := func(wgPacket []byte) []byte {
+		headroom := s.handler.Headroom()
+		buf := make([]byte, 1452)
+		copy(buf[headroom.Front:], wgPacket)
+		swgpPacketStart, swgpPacketLength, err := s.handler.EncryptZeroCopy(buf, headroom.Front, len(wgPacket))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[swgpPacketStart : swgpPacketStart+swgpPacketLength]
+	}
+	garbage := make([]byte, packet.WireGuardMessageLengthHandshakeInitiation)
+	if _, err = rand.Read(garbage); err != nil {
+		t.Fatal(err)
+	}
+
+	// An idle connection is closed once the first frame times out.
+	c := dial()
+	expectClosed(c, "an idle connection")
+	c.Close()
+	expectNoSession("an idle connection")
+
+	// A first frame that does not decrypt closes the connection.
+	c = dial()
+	w := newTCPFrameWriter(c)
+	if err = writeTCPFrame(w, garbage); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(c, "a connection with a garbage first frame")
+	c.Close()
+	expectNoSession("a garbage first frame")
+	if invalid := s.decryptFailures.Load() + s.malformedPackets.Load(); invalid != 1 {
+		t.Errorf("Expected 1 invalid packet, got %d", invalid)
+	}
+
+	// An authenticated session is closed after too many consecutive invalid packets.
+	c = dial()
+	defer c.Close()
+	w = newTCPFrameWriter(c)
+	frames := [][]byte{encrypt(newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation))}
+	for i := 0; i < tcpMaxInvalidPackets; i++ {
+		frames = append(frames, garbage)
+	}
+	for _, frame := range frames {
+		if err = writeTCPFrame(w, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(c, "a session streaming garbage")
+
+	select {
+	case e := <-events:
+		if e.Type != EventSessionCreated {
+			t.Errorf("Expected a session for an authenticated connection, got event %v", e.Type)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for a session for an authenticated connection")
+	}
+}
+
+// floodUntilStalled calls send until the packet counter stops increasing,
+// which means the relay is blocked writing to a peer that does not read.
+func floodUntilStalled(t *testing.T, send func(), packets *atomic.Uint64) {
+	t.Helper()
+	var (
+		last        uint64
+		lastChanged = time.Now()
+		deadline    = time.Now().Add(10 * time.Second)
+	)
+	for time.Now().Before(deadline) {
+		for i := 0; i < 64; i++ {
+			send()
+		}
+		if cur := packets.Load(); cur != last {
+			last = cur
+			lastChanged = time.Now()
+		} else if time.Since(lastChanged) > 500*time.Millisecond {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for the relay to stall")
+}
+
+// expectStopReturns fails the test if stop does not return in time.
+func expectStopReturns(t *testing.T, stop func() error) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		done <- stop()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for Stop to return")
+	}
+}
+
+func TestServerTCPStopWithPeerNotReading(t *testing.T) {
+	serverConfig := ServerConfig{
+		Name:           "wg0",
+		ProxyListen:    "[::1]:20580",
+		ProxyMode:      "passthrough",
+		WgEndpoint:     conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20581)),
+		MTU:            1500,
+		ProxyTransport: proxyTransportTCP,
+	}
+
+	s, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stopped := false
+	defer func() {
+		if !stopped {
+			s.Stop()
+		}
+	}()
+
+	endpoint := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+
+	// The peer sends a handshake initiation, then never reads from the stream.
+	c, err := net.Dial("tcp", serverConfig.ProxyListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	handshakeInitiationPacket := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+	w := newTCPFrameWriter(c)
+	if err = writeTCPFrame(w, handshakeInitiationPacket); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint.Expect(handshakeInitiationPacket)
+
+	dataPacket := newTestWgPacket(t, packet.WireGuardMessageTypeData, 1024)
+	floodUntilStalled(t, func() { endpoint.Send(dataPacket) }, &s.downlinkTraffic.packets)
+
+	stopped = true
+	expectStopReturns(t, s.Stop)
+}
+
+func TestClientTCPStopWithServerNotReading(t *testing.T) {
+	clientConfig := ClientConfig{
+		Name:           "wg0",
+		WgListen:       ":20582",
+		ProxyEndpoint:  conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20583)),
+		ProxyMode:      "passthrough",
+		MTU:            1500,
+		ProxyTransport: proxyTransportTCP,
+	}
+
+	// The server accepts the stream, then never reads from it.
+	ln, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(clientConfig.ProxyEndpoint.IPPort()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if proxyConn, err := ln.Accept(); err == nil {
+			accepted <- proxyConn
+		}
+	}()
+	defer func() {
+		select {
+		case proxyConn := <-accepted:
+			proxyConn.Close()
+		default:
+		}
+	}()
+
+	c, err := clientConfig.Client(NewLoggers(logger), conn.NewListenConfigCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stopped := false
+	defer func() {
+		if !stopped {
+			c.Stop()
+		}
+	}()
+
+	peer := newFakeWgPeer(t, clientConfig.WgListen)
+	dataPacket := newTestWgPacket(t, packet.WireGuardMessageTypeData, 1024)
+	floodUntilStalled(t, func() { peer.Send(dataPacket) }, &c.uplinkTraffic.packets)
+
+	stopped = true
+	expectStopReturns(t, c.Stop)
+}
@@ -0,0 +1,11 @@
+package service
+
+import "fmt"
+
+// checkTTL returns an error if ttl is set and is not a valid IP TTL or IPv6 hop limit.
+func checkTTL(ttl int) error {
+	if ttl < 0 || ttl > 255 {
+		return fmt.Errorf("ttl must be between 1 and 255: %d", ttl)
+	}
+	return nil
+}
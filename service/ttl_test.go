@@ -0,0 +1,21 @@
+package service
+
+import "testing"
+
+func TestCheckTTL(t *testing.T) {
+	for _, c := range []struct {
+		ttl int
+		ok  bool
+	}{
+		{0, true},
+		{1, true},
+		{64, true},
+		{255, true},
+		{-1, false},
+		{256, false},
+	} {
+		if err := checkTTL(c.ttl); (err == nil) != c.ok {
+			t.Errorf("checkTTL(%d) error = %v", c.ttl, err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"github.com/database64128/swgp-go/conn"
+	"go.uber.org/zap"
+)
+
+const (
+	// upstreamUnreachableIgnore counts and logs ICMP port-unreachable errors from the WireGuard endpoint,
+	// and keeps the session.
+	upstreamUnreachableIgnore = "ignore"
+
+	// upstreamUnreachableEvictSession counts and logs ICMP port-unreachable errors from the WireGuard endpoint,
+	// and ends the session, so that the next packet from the client starts a new one.
+	upstreamUnreachableEvictSession = "evict-session"
+
+	// upstreamUnreachableFailover is reserved for switching to another WireGuard endpoint.
+	upstreamUnreachableFailover = "failover"
+)
+
+// checkOnUpstreamUnreachable returns an error if the action is not supported.
+func checkOnUpstreamUnreachable(action string) error {
+	switch action {
+	case "", upstreamUnreachableIgnore, upstreamUnreachableEvictSession:
+		return nil
+	case upstreamUnreachableFailover:
+		return errors.New("onUpstreamUnreachable failover requires multiple WireGuard endpoints, which are not supported")
+	default:
+		return fmt.Errorf("unknown onUpstreamUnreachable action: %s", action)
+	}
+}
+
+// isUpstreamUnreachable returns whether err is a read error reporting that the WireGuard endpoint
+// answered with ICMP port unreachable.
+func isUpstreamUnreachable(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// handleUpstreamUnreachable handles an ICMP port-unreachable error reported on the session's wgConn.
+// It returns whether the session must end.
+func (s *server) handleUpstreamUnreachable(wgConn *net.UDPConn, clientAddrPort, wgAddrPort netip.AddrPort, err error) bool {
+	s.upstreamUnreachable.Add(1)
+	s.publishEvent(EventUpstreamUnreachable, clientAddrPort, err)
+	s.drainWgConnErrorQueue(wgConn, clientAddrPort, wgAddrPort)
+
+	evict := s.onUpstreamUnreachable == upstreamUnreachableEvictSession
+
+	s.connLogger.Warn("WireGuard endpoint is unreachable",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.Stringer("clientAddress", clientAddrPort),
+		zap.Stringer("wgAddress", wgAddrPort),
+		zap.Bool("evictSession", evict),
+		zap.Error(err),
+	)
+
+	return evict
+}
+
+// drainWgConnErrorQueue drains the error queue of the session's wgConn after a failed read or write.
+//
+// With onUpstreamUnreachable set, wgConn queues every ICMP error, not only port unreachable,
+// and a write may report a queued error before the downlink reads it. So the queue is drained
+// after every error on wgConn, to keep queued errors from filling the receive buffer.
+func (s *server) drainWgConnErrorQueue(wgConn *net.UDPConn, clientAddrPort, wgAddrPort netip.AddrPort) {
+	if s.onUpstreamUnreachable == "" {
+		return
+	}
+	if err := conn.DrainErrorQueue(wgConn); err != nil {
+		s.connLogger.Warn("Failed to drain wgConn error queue",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Stringer("wgAddress", wgAddrPort),
+			zap.Error(err),
+		)
+	}
+}
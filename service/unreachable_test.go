@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestCheckOnUpstreamUnreachable(t *testing.T) {
+	for _, c := range []struct {
+		action string
+		ok     bool
+	}{
+		{"", true},
+		{upstreamUnreachableIgnore, true},
+		{upstreamUnreachableEvictSession, true},
+		{upstreamUnreachableFailover, false},
+		{"restart", false},
+	} {
+		if err := checkOnUpstreamUnreachable(c.action); (err == nil) != c.ok {
+			t.Errorf("%q: expected ok %v, got error %v", c.action, c.ok, err)
+		}
+	}
+}
+
+func TestServerOnUpstreamUnreachable(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Unreachable upstream detection is only supported on Linux")
+	}
+
+	for _, c := range []struct {
+		name             string
+		action           string
+		batchMode        string
+		proxyPort        uint16
+		wgPort           uint16
+		wgListenPort     uint16
+		expectedSessions int
+	}{
+		{"Ignore", upstreamUnreachableIgnore, "", 20350, 20351, 20352, 1},
+		{"EvictSession", upstreamUnreachableEvictSession, "", 20353, 20354, 20355, 0},
+		{"EvictSessionNoBatch", upstreamUnreachableEvictSession, "no", 20356, 20357, 20358, 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			psk := generateTestPSK(t)
+
+			// Nothing listens on the WireGuard endpoint port.
+			serverConfig := ServerConfig{
+				Name:                  "wg0",
+				ProxyListen:           fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:             "zero-overhead",
+				ProxyPSK:              psk,
+				WgEndpoint:            conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPort)),
+				MTU:                   1500,
+				OnUpstreamUnreachable: c.action,
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+
+			clientConfig := ClientConfig{
+				Name:          "wg0",
+				WgListen:      fmt.Sprintf(":%d", c.wgListenPort),
+				ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.proxyPort)),
+				ProxyMode:     "zero-overhead",
+				ProxyPSK:      psk,
+				MTU:           1500,
+			}
+
+			ctx := context.Background()
+			sc := Config{
+				Servers: []ServerConfig{serverConfig},
+				Clients: []ClientConfig{clientConfig},
+			}
+			m, err := sc.Manager(logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = m.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer m.Stop()
+
+			peer := newFakeWgPeer(t, clientConfig.WgListen)
+			peer.Send(newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation))
+
+			serverStats := func() Stats {
+				for _, ss := range m.Stats() {
+					if ss.Role == "server" {
+						return ss.Stats
+					}
+				}
+				t.Fatal("No server stats")
+				return Stats{}
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				ss := serverStats()
+				if ss.UpstreamUnreachable > 0 && ss.Sessions == c.expectedSessions {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected unreachable upstream to be counted with %d sessions left, got %d unreachable and %d sessions",
+						c.expectedSessions, ss.UpstreamUnreachable, ss.Sessions)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
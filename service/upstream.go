@@ -0,0 +1,97 @@
+package service
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"go.uber.org/zap"
+)
+
+// sessionUpstream is the WireGuard endpoint a session relays to. It may switch during the session,
+// in which case replies from the previous endpoint are still accepted until a grace deadline.
+type sessionUpstream struct {
+	// addr is the configured endpoint that addrPort was resolved from.
+	// It is nil until the session has resolved its endpoint.
+	addr atomic.Pointer[conn.Addr]
+
+	addrPort     atomic.Pointer[netip.AddrPort]
+	prevAddrPort atomic.Pointer[netip.AddrPort]
+
+	// prevUntil is the Unix time in nanoseconds until which replies from prevAddrPort are accepted.
+	prevUntil atomic.Int64
+}
+
+// init sets the endpoint the session starts with.
+func (u *sessionUpstream) init(addr conn.Addr, addrPort netip.AddrPort) {
+	u.addrPort.Store(&addrPort)
+	u.addr.Store(&addr)
+}
+
+// AddrPort returns the address packets are sent to.
+func (u *sessionUpstream) AddrPort() netip.AddrPort {
+	return *u.addrPort.Load()
+}
+
+// String implements [fmt.Stringer], so that the current address can be logged.
+func (u *sessionUpstream) String() string {
+	return u.AddrPort().String()
+}
+
+// Accepts returns whether a packet from sourceAddrPort is a reply from the session's endpoint.
+func (u *sessionUpstream) Accepts(sourceAddrPort netip.AddrPort) bool {
+	if conn.AddrPortMappedEqual(sourceAddrPort, *u.addrPort.Load()) {
+		return true
+	}
+	prev := u.prevAddrPort.Load()
+	return prev != nil && conn.AddrPortMappedEqual(sourceAddrPort, *prev) && time.Now().UnixNano() < u.prevUntil.Load()
+}
+
+// switchTo sends the session's packets to addrPort, and keeps accepting replies from the current address for grace.
+func (u *sessionUpstream) switchTo(addr conn.Addr, addrPort netip.AddrPort, grace time.Duration) {
+	// Publish the grace window before the new address, so that replies from the old address
+	// are never rejected in between.
+	u.prevAddrPort.Store(u.addrPort.Load())
+	u.prevUntil.Store(time.Now().Add(grace).UnixNano())
+	u.addrPort.Store(&addrPort)
+	u.addr.Store(&addr)
+}
+
+// switchSessionUpstreams switches the sessions relaying to oldWgAddr to wgAddr.
+// Replies from the old endpoint are accepted for the upstream switch grace period.
+//
+// Sessions routed to other endpoints, and sessions still resolving their endpoint, are left alone.
+func (s *server) switchSessionUpstreams(oldWgAddr, wgAddr conn.Addr) {
+	wgAddrPort, err := wgAddr.ResolveIPPortNetworkWithResolver(s.resolveCtx, s.resolver, s.network)
+	if err != nil {
+		s.logger.Warn("Failed to resolve new WireGuard endpoint, keeping existing sessions on the old one",
+			zap.String("server", s.name),
+			zap.String("listenAddress", s.proxyListen),
+			zap.Stringer("wgAddress", &wgAddr),
+			zap.Error(err),
+		)
+		return
+	}
+
+	var switched int
+
+	s.mu.Lock()
+	for _, natEntry := range s.table {
+		if addr := natEntry.upstream.addr.Load(); addr == nil || !addr.Equals(oldWgAddr) {
+			continue
+		}
+		natEntry.upstream.switchTo(wgAddr, wgAddrPort, s.upstreamSwitchGrace)
+		switched++
+	}
+	s.mu.Unlock()
+
+	s.logger.Info("Switched sessions to new WireGuard endpoint",
+		zap.String("server", s.name),
+		zap.String("listenAddress", s.proxyListen),
+		zap.Stringer("oldWgAddress", &oldWgAddr),
+		zap.Stringer("wgAddress", wgAddrPort),
+		zap.Int("switchedSessions", switched),
+		zap.Duration("upstreamSwitchGrace", s.upstreamSwitchGrace),
+	)
+}
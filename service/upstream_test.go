@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/jsonhelper"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestSessionUpstreamAccepts(t *testing.T) {
+	oldAddrPort := netip.MustParseAddrPort("[::1]:51820")
+	newAddrPort := netip.MustParseAddrPort("[::1]:51821")
+	otherAddrPort := netip.MustParseAddrPort("[::1]:51822")
+
+	var u sessionUpstream
+	u.init(conn.AddrFromIPPort(oldAddrPort), oldAddrPort)
+	if !u.Accepts(oldAddrPort) {
+		t.Error("Expected the initial endpoint to be accepted")
+	}
+
+	u.switchTo(conn.AddrFromIPPort(newAddrPort), newAddrPort, time.Hour)
+	if got := u.AddrPort(); got != newAddrPort {
+		t.Errorf("Expected switched endpoint %s, got %s", newAddrPort, got)
+	}
+	if !u.Accepts(newAddrPort) || !u.Accepts(oldAddrPort) {
+		t.Error("Expected both endpoints to be accepted during the grace period")
+	}
+	if u.Accepts(otherAddrPort) {
+		t.Error("Expected other addresses to be rejected")
+	}
+
+	u.switchTo(conn.AddrFromIPPort(oldAddrPort), oldAddrPort, 0)
+	if u.Accepts(newAddrPort) {
+		t.Error("Expected the previous endpoint to be rejected without a grace period")
+	}
+}
+
+func TestManagerReloadUpstreamSwitchGrace(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		batchMode    string
+		proxyPort    uint16
+		wgPortA      uint16
+		wgPortB      uint16
+		wgListenPort uint16
+	}{
+		{"Default", "", 20391, 20392, 20393, 20394},
+		{"NoBatch", "no", 20395, 20396, 20397, 20398},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			psk := generateTestPSK(t)
+
+			serverConfig := ServerConfig{
+				Name:                "wg0",
+				ProxyListen:         fmt.Sprintf(":%d", c.proxyPort),
+				ProxyMode:           "zero-overhead",
+				ProxyPSK:            psk,
+				WgEndpoint:          conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPortA)),
+				MTU:                 1500,
+				UpstreamSwitchGrace: jsonhelper.Duration(300 * time.Millisecond),
+				PerfConfig: PerfConfig{
+					BatchMode: c.batchMode,
+				},
+			}
+
+			clientConfig := ClientConfig{
+				Name:          "wg0",
+				WgListen:      fmt.Sprintf(":%d", c.wgListenPort),
+				ProxyEndpoint: conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.proxyPort)),
+				ProxyMode:     "zero-overhead",
+				ProxyPSK:      psk,
+				MTU:           1500,
+			}
+
+			ctx := context.Background()
+			sc := Config{
+				Servers: []ServerConfig{serverConfig},
+				Clients: []ClientConfig{clientConfig},
+			}
+			m, err := sc.Manager(logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = m.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer m.Stop()
+
+			endpointA := newFakeWgEndpoint(t, serverConfig.WgEndpoint.String())
+			endpointB := newFakeWgEndpoint(t, fmt.Sprintf("[::1]:%d", c.wgPortB))
+			peer := newFakeWgPeer(t, clientConfig.WgListen)
+
+			handshakeInitiationPacket := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeInitiation, packet.WireGuardMessageLengthHandshakeInitiation)
+			peer.Send(handshakeInitiationPacket)
+			endpointA.Expect(handshakeInitiationPacket)
+
+			serverConfig.WgEndpoint = conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), c.wgPortB))
+			sc.Servers = []ServerConfig{serverConfig}
+			if err = m.Reload(ctx, sc); err != nil {
+				t.Fatal(err)
+			}
+
+			// The existing session switches to the new endpoint.
+			dataPacket := newTestWgPacket(t, packet.WireGuardMessageTypeData, 128)
+			peer.Send(dataPacket)
+			endpointB.Expect(dataPacket)
+
+			// In-flight replies from the old endpoint still get through during the grace period.
+			lateReply := newTestWgPacket(t, packet.WireGuardMessageTypeHandshakeResponse, packet.WireGuardMessageLengthHandshakeResponse)
+			endpointA.Send(lateReply)
+			peer.Expect(lateReply)
+
+			newReply := newTestWgPacket(t, packet.WireGuardMessageTypeData, 128)
+			endpointB.Send(newReply)
+			peer.Expect(newReply)
+
+			// After the grace period, the old endpoint is no longer accepted.
+			time.Sleep(400 * time.Millisecond)
+			endpointA.Send(newTestWgPacket(t, packet.WireGuardMessageTypeData, 128))
+			peer.ExpectNone(100 * time.Millisecond)
+
+			newReply = newTestWgPacket(t, packet.WireGuardMessageTypeData, 128)
+			endpointB.Send(newReply)
+			peer.Expect(newReply)
+		})
+	}
+}
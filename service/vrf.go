@@ -0,0 +1,23 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/database64128/swgp-go/conn"
+)
+
+// checkVRF returns an error if vrf is set and is not a VRF device on this host.
+func checkVRF(vrf string) error {
+	if vrf == "" {
+		return nil
+	}
+	if runtime.GOOS != "linux" {
+		return errors.New("vrf is only supported on Linux")
+	}
+	if err := conn.CheckVRF(vrf); err != nil {
+		return fmt.Errorf("bad vrf: %w", err)
+	}
+	return nil
+}
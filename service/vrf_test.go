@@ -0,0 +1,38 @@
+package service
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/database64128/swgp-go/conn"
+)
+
+func TestServerClientVRF(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("VRF is only supported on Linux")
+	}
+
+	psk := generateTestPSK(t)
+	for _, vrf := range []string{"swgp-no-such-vrf", "lo"} {
+		t.Run(vrf, func(t *testing.T) {
+			serverConfig := testReloadServerConfig("wg0", ":20431", psk)
+			serverConfig.VRF = vrf
+			if _, err := serverConfig.Server(NewLoggers(logger), conn.NewListenConfigCache()); err == nil {
+				t.Error("Server: expected error for a device that is not a VRF.")
+			}
+
+			clientConfig := ClientConfig{
+				Name:          "wg0",
+				WgListen:      ":20432",
+				ProxyEndpoint: serverConfig.WgEndpoint,
+				ProxyMode:     "zero-overhead",
+				ProxyPSK:      psk,
+				MTU:           1500,
+				VRF:           vrf,
+			}
+			if _, err := clientConfig.Client(NewLoggers(logger), conn.NewListenConfigCache()); err == nil {
+				t.Error("Client: expected error for a device that is not a VRF.")
+			}
+		})
+	}
+}
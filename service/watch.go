@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultConfigWatchInterval is the default interval between polls of the watched files.
+	defaultConfigWatchInterval = time.Second
+
+	// defaultConfigWatchSettle is the default time the watched files must stay unchanged
+	// after a change before the configuration is loaded.
+	defaultConfigWatchSettle = 2 * time.Second
+)
+
+// ConfigWatcher watches a configuration file, the files it includes, and the directories
+// containing them for changes, and loads the configuration when they change.
+//
+// Files are polled by path, so a file replaced by an atomic rename, as most editors
+// and config management tools save files, is picked up like a file written in place.
+// Newly created files matching an include pattern are picked up through the change
+// to their directory.
+type ConfigWatcher struct {
+	path     string
+	interval time.Duration
+	settle   time.Duration
+	logger   *zap.Logger
+}
+
+// NewConfigWatcher returns a new watcher of the configuration file at path.
+func NewConfigWatcher(path string, logger *zap.Logger) *ConfigWatcher {
+	return &ConfigWatcher{
+		path:     path,
+		interval: defaultConfigWatchInterval,
+		settle:   defaultConfigWatchSettle,
+		logger:   logger,
+	}
+}
+
+// Run watches the files until ctx is canceled.
+//
+// After a change, Run waits for the files to settle, so that partial writes are not loaded.
+// It then loads and validates the configuration, and calls reload with it.
+// If the configuration fails to load, the error is logged, reload is not called,
+// and the running configuration is kept until the next change.
+func (w *ConfigWatcher) Run(ctx context.Context, reload func(Config)) {
+	_, files, err := loadConfig(w.path)
+	if err != nil {
+		files = []string{w.path}
+	}
+	states := statWatchedFiles(files)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	var (
+		pending    bool
+		lastChange time.Time
+	)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			newStates := statWatchedFiles(files)
+			if !watchedFilesEqual(states, newStates) {
+				states = newStates
+				pending = true
+				lastChange = now
+				continue
+			}
+
+			if !pending || now.Sub(lastChange) < w.settle {
+				continue
+			}
+			pending = false
+
+			w.logger.Info("Config files changed, reloading", zap.String("confPath", w.path))
+
+			sc, newFiles, err := loadConfig(w.path)
+			if err != nil {
+				w.logger.Warn("Failed to load config for reload, keeping the running config",
+					zap.String("confPath", w.path),
+					zap.Error(err),
+				)
+				continue
+			}
+
+			// Included files may have been added or removed.
+			files = newFiles
+			states = statWatchedFiles(files)
+			reload(sc)
+		}
+	}
+}
+
+// statWatchedFiles returns the file info of the files and their directories, keyed by path.
+// The file info of a path that cannot be stat'ed is nil.
+func statWatchedFiles(files []string) map[string]os.FileInfo {
+	states := make(map[string]os.FileInfo, 2*len(files))
+	for _, file := range files {
+		for _, path := range [...]string{file, filepath.Dir(file)} {
+			if _, ok := states[path]; ok {
+				continue
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				fi = nil
+			}
+			states[path] = fi
+		}
+	}
+	return states
+}
+
+// watchedFilesEqual returns whether the two sets of file info describe the same files,
+// with the same sizes and modification times.
+func watchedFilesEqual(a, b map[string]os.FileInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, fa := range a {
+		fb, ok := b[path]
+		if !ok {
+			return false
+		}
+		if fa == nil || fb == nil {
+			if fa != fb {
+				return false
+			}
+			continue
+		}
+		if !os.SameFile(fa, fb) || fa.Size() != fb.Size() || !fa.ModTime().Equal(fb.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
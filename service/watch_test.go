@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newTestConfigWatcher(path string) *ConfigWatcher {
+	w := NewConfigWatcher(path, zap.NewNop())
+	w.interval = 10 * time.Millisecond
+	w.settle = 50 * time.Millisecond
+	return w
+}
+
+func expectConfigReload(t *testing.T, reloadCh <-chan Config, serverNames ...string) {
+	t.Helper()
+	select {
+	case sc := <-reloadCh:
+		if len(sc.Servers) != len(serverNames) {
+			t.Fatalf("Expected servers %v, got %+v", serverNames, sc.Servers)
+		}
+		for i, name := range serverNames {
+			if sc.Servers[i].Name != name {
+				t.Errorf("Expected server %d to be %s, got %s", i, name, sc.Servers[i].Name)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for reload")
+	}
+}
+
+func expectNoConfigReload(t *testing.T, reloadCh <-chan Config) {
+	t.Helper()
+	select {
+	case sc := <-reloadCh:
+		t.Fatalf("Unexpected reload with servers %+v", sc.Servers)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestConfigWatcher(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	writeTestConfigFile(t, path, `{"servers": [{"name": "wg0"}], "include": ["conf.d/*.json"]}`)
+	writeTestConfigFile(t, filepath.Join(dir, "conf.d", "wg1.json"), `{"servers": [{"name": "wg1"}]}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloadCh := make(chan Config, 8)
+	done := make(chan struct{})
+	go func() {
+		newTestConfigWatcher(path).Run(ctx, func(sc Config) {
+			reloadCh <- sc
+		})
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Let the watcher take its initial snapshot.
+	expectNoConfigReload(t, reloadCh)
+
+	t.Run("AtomicRename", func(t *testing.T) {
+		tmpPath := filepath.Join(dir, ".config.json.tmp")
+		writeTestConfigFile(t, tmpPath, `{"servers": [{"name": "wg2"}], "include": ["conf.d/*.json"]}`)
+		if err := os.Rename(tmpPath, path); err != nil {
+			t.Fatal(err)
+		}
+		expectConfigReload(t, reloadCh, "wg2", "wg1")
+	})
+
+	t.Run("InvalidConfigKept", func(t *testing.T) {
+		writeTestConfigFile(t, path, `{"servers": [{"name": "wg3"}`)
+		expectNoConfigReload(t, reloadCh)
+
+		writeTestConfigFile(t, path, `{"servers": [{"name": "wg3"}], "include": ["conf.d/*.json"]}`)
+		expectConfigReload(t, reloadCh, "wg3", "wg1")
+	})
+
+	t.Run("NewIncludedFile", func(t *testing.T) {
+		writeTestConfigFile(t, filepath.Join(dir, "conf.d", "wg4.json"), `{"servers": [{"name": "wg4"}]}`)
+		expectConfigReload(t, reloadCh, "wg3", "wg1", "wg4")
+	})
+
+	t.Run("ModifiedIncludedFile", func(t *testing.T) {
+		writeTestConfigFile(t, filepath.Join(dir, "conf.d", "wg4.json"), `{"servers": [{"name": "wg5"}]}`)
+		expectConfigReload(t, reloadCh, "wg3", "wg1", "wg5")
+	})
+}
+
+func TestConfigWatcherDebounce(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	writeTestConfigFile(t, path, `{"servers": [{"name": "wg0"}]}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloadCh := make(chan Config, 8)
+	w := newTestConfigWatcher(path)
+	w.settle = 200 * time.Millisecond
+	go w.Run(ctx, func(sc Config) {
+		reloadCh <- sc
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	// Keep writing faster than the settle time. No reload should happen until the writes stop.
+	for i := 0; i < 5; i++ {
+		writeTestConfigFile(t, path, `{"servers": [{"name": "wg0"}, {"name": "wg`+string(rune('1'+i))+`"}]}`)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	expectConfigReload(t, reloadCh, "wg0", "wg5")
+	expectNoConfigReload(t, reloadCh)
+}
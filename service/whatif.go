@@ -0,0 +1,126 @@
+package service
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// WhatIfVerdict is how a service would currently treat a packet from a source address.
+type WhatIfVerdict string
+
+const (
+	// WhatIfAllowed means the packet would be forwarded.
+	WhatIfAllowed WhatIfVerdict = "allowed"
+
+	// WhatIfPrefixDenied means the source address is outside the client's wgAllowedSource.
+	WhatIfPrefixDenied WhatIfVerdict = "prefix-denied"
+
+	// WhatIfDecryptBudgetShed means the packet would be shed before decryption,
+	// as the server's decrypt budget is used up by other packets.
+	WhatIfDecryptBudgetShed WhatIfVerdict = "decrypt-budget-shed"
+
+	// WhatIfQuiesced means the server is quiesced and drops all packets.
+	WhatIfQuiesced WhatIfVerdict = "quiesced"
+
+	// WhatIfCookieChallenged means the source has no session, and would be answered
+	// with a cookie challenge instead of having a session created for it.
+	WhatIfCookieChallenged WhatIfVerdict = "cookie-challenged"
+
+	// WhatIfRateLimited means a handshake initiation would be dropped by the handshake rate limit.
+	WhatIfRateLimited WhatIfVerdict = "rate-limited"
+
+	// WhatIfSessionCapped means the source has no session, and no new session can be created,
+	// as all the upstream source ports are taken by other sessions.
+	WhatIfSessionCapped WhatIfVerdict = "session-capped"
+)
+
+// WhatIf reports how the named service of the role, "server" or "client", would currently treat
+// a handshake initiation from sourceAddrPort. Handshake initiations are what a client sends to connect,
+// so the verdict tells why a client cannot connect. The service's state is not changed.
+//
+// For a server, sourceAddrPort is the address of a swgp client. For a client,
+// it is the address of a WireGuard peer sending packets to wgListen.
+func (m *Manager) WhatIf(role, name string, sourceAddrPort netip.AddrPort) (WhatIfVerdict, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.services {
+		if s.role != role || s.name != name {
+			continue
+		}
+		switch svc := s.Service.(type) {
+		case *server:
+			return svc.whatIf(sourceAddrPort), nil
+		case *client:
+			return svc.whatIf(sourceAddrPort), nil
+		}
+	}
+	return "", fmt.Errorf("no %s named %s", role, name)
+}
+
+// whatIf returns how the server would currently treat a handshake initiation from clientAddrPort.
+// The checks are in the order of the receive pipeline.
+func (s *server) whatIf(clientAddrPort netip.AddrPort) WhatIfVerdict {
+	if !s.decryptBudget.WouldAllow() {
+		return WhatIfDecryptBudgetShed
+	}
+
+	if s.quiesced.Load() {
+		return WhatIfQuiesced
+	}
+
+	s.mu.Lock()
+	hasSession, sessions := s.hasSessionLocked(clientAddrPort)
+	s.mu.Unlock()
+
+	if s.cookieGenerator != nil && !hasSession {
+		return WhatIfCookieChallenged
+	}
+
+	if !s.handshakeLimiter.WouldAllow() {
+		return WhatIfRateLimited
+	}
+
+	if !hasSession && s.sessionPortsTaken(sessions) {
+		return WhatIfSessionCapped
+	}
+
+	return WhatIfAllowed
+}
+
+// hasSessionLocked returns whether clientAddrPort has a session, and the number of sessions.
+// The caller must hold s.mu.
+func (s *server) hasSessionLocked(clientAddrPort netip.AddrPort) (bool, int) {
+	if s.proxyTransport == proxyTransportTCP {
+		_, ok := s.tcpTable[clientAddrPort]
+		return ok, len(s.tcpTable)
+	}
+	for key := range s.table {
+		if key.clientAddrPort == clientAddrPort {
+			return true, len(s.table)
+		}
+	}
+	return false, len(s.table)
+}
+
+// sessionPortsTaken returns whether the number of sessions uses up the upstream source ports
+// the server is restricted to.
+//
+// Ports in use by other sockets are not accounted for.
+func (s *server) sessionPortsTaken(sessions int) bool {
+	if s.wgConnListenAddress != "" {
+		return sessions > 0
+	}
+	if s.upstreamPortRange[0] != 0 {
+		return sessions > int(s.upstreamPortRange[1]-s.upstreamPortRange[0])
+	}
+	return false
+}
+
+// whatIf returns how the client would currently treat a packet from wgAddrPort.
+func (c *client) whatIf(wgAddrPort netip.AddrPort) WhatIfVerdict {
+	if !c.isAllowedSource(wgAddrPort.Addr()) {
+		return WhatIfPrefixDenied
+	}
+	return WhatIfAllowed
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/database64128/swgp-go/conn"
+	"github.com/database64128/swgp-go/packet"
+)
+
+func TestServerWhatIf(t *testing.T) {
+	clientAddrPort := netip.MustParseAddrPort("[2001:db8::1]:51820")
+	otherAddrPort := netip.MustParseAddrPort("[2001:db8::2]:51820")
+
+	exhaustedLimiter := newHandshakeLimiter(1)
+	exhaustedLimiter.Allow([]byte{packet.WireGuardMessageTypeHandshakeInitiation})
+
+	exhaustedBudget := newDecryptBudget(1)
+	exhaustedBudget.Allow()
+
+	for _, c := range []struct {
+		name     string
+		setup    func(s *server)
+		expected WhatIfVerdict
+	}{
+		{"Allowed", func(s *server) {}, WhatIfAllowed},
+		{"DecryptBudgetShed", func(s *server) {
+			s.decryptBudget = exhaustedBudget
+			s.quiesced.Store(true)
+		}, WhatIfDecryptBudgetShed},
+		{"DecryptBudgetLeft", func(s *server) { s.decryptBudget = newDecryptBudget(1) }, WhatIfAllowed},
+		{"Quiesced", func(s *server) { s.quiesced.Store(true) }, WhatIfQuiesced},
+		{"CookieChallenged", func(s *server) { s.cookieGenerator = &packet.CookieGenerator{} }, WhatIfCookieChallenged},
+		{"CookieSession", func(s *server) {
+			s.cookieGenerator = &packet.CookieGenerator{}
+			s.table[serverSessionKey{clientAddrPort: clientAddrPort}] = &serverNatEntry{}
+		}, WhatIfAllowed},
+		{"RateLimited", func(s *server) { s.handshakeLimiter = exhaustedLimiter }, WhatIfRateLimited},
+		{"SourcePortTaken", func(s *server) {
+			s.wgConnListenAddress = ":20400"
+			s.table[serverSessionKey{clientAddrPort: otherAddrPort}] = &serverNatEntry{}
+		}, WhatIfSessionCapped},
+		{"SourcePortOwnSession", func(s *server) {
+			s.wgConnListenAddress = ":20400"
+			s.table[serverSessionKey{clientAddrPort: clientAddrPort}] = &serverNatEntry{}
+		}, WhatIfAllowed},
+		{"PortRangeFree", func(s *server) {
+			s.upstreamPortRange = [2]uint16{20400, 20401}
+			s.table[serverSessionKey{clientAddrPort: otherAddrPort}] = &serverNatEntry{}
+		}, WhatIfAllowed},
+		{"PortRangeTaken", func(s *server) {
+			s.upstreamPortRange = [2]uint16{20400, 20400}
+			s.table[serverSessionKey{clientAddrPort: otherAddrPort}] = &serverNatEntry{}
+		}, WhatIfSessionCapped},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := &server{table: make(map[serverSessionKey]*serverNatEntry)}
+			c.setup(s)
+			if verdict := s.whatIf(clientAddrPort); verdict != c.expected {
+				t.Errorf("Expected verdict %s, got %s", c.expected, verdict)
+			}
+		})
+	}
+}
+
+func TestManagerWhatIf(t *testing.T) {
+	psk := generateTestPSK(t)
+
+	sc := Config{
+		Servers: []ServerConfig{{
+			Name:          "wg0",
+			ProxyListen:   ":20344",
+			ProxyMode:     "zero-overhead",
+			ProxyPSK:      psk,
+			WgEndpoint:    conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20345)),
+			MTU:           1500,
+			RequireCookie: true,
+		}},
+		Clients: []ClientConfig{{
+			Name:            "wg0",
+			WgListen:        ":20346",
+			ProxyEndpoint:   conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 20344)),
+			ProxyMode:       "zero-overhead",
+			ProxyPSK:        psk,
+			MTU:             1500,
+			WgAllowedSource: netip.MustParsePrefix("192.0.2.0/24"),
+		}},
+	}
+	m, err := sc.Manager(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name        string
+		role        string
+		serviceName string
+		sourceAddr  string
+		expected    WhatIfVerdict
+		ok          bool
+	}{
+		{"ServerCookieChallenged", "server", "wg0", "[2001:db8::1]:51820", WhatIfCookieChallenged, true},
+		{"ClientAllowed", "client", "wg0", "192.0.2.1:51820", WhatIfAllowed, true},
+		{"ClientPrefixDenied", "client", "wg0", "198.51.100.1:51820", WhatIfPrefixDenied, true},
+		{"UnknownRole", "relay", "wg0", "192.0.2.1:51820", "", false},
+		{"UnknownName", "server", "wg1", "192.0.2.1:51820", "", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			verdict, err := m.WhatIf(c.role, c.serviceName, netip.MustParseAddrPort(c.sourceAddr))
+			if ok := err == nil; ok != c.ok {
+				t.Fatalf("Expected ok %v, got error %v", c.ok, err)
+			}
+			if verdict != c.expected {
+				t.Errorf("Expected verdict %s, got %s", c.expected, verdict)
+			}
+		})
+	}
+}